@@ -0,0 +1,178 @@
+/*
+	Package client provides Go functions for DVID's HTTP API so tools don't need to build
+	request URLs and decode the binary and JSON formats of each endpoint themselves.
+
+	Each function takes the server address, e.g., "localhost:8000" or "http://emdata:8000",
+	along with the UUID and data instance name.  GET requests are retried after connection
+	errors and temporary server errors, while POST requests that modify data are sent
+	once.  Errors returned by the server are converted to *Error.
+*/
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// APIPath is the path of the DVID HTTP API on a server.
+const APIPath = "/api/"
+
+var (
+	// HTTPClient is the client used for all requests.
+	HTTPClient = http.DefaultClient
+
+	// MaxRetries is the number of times a GET request is retried after a connection
+	// error or a 502, 503, or 504 response.
+	MaxRetries = 3
+
+	// RetryDelay is the wait before the first retry.  The wait doubles for each
+	// further retry.
+	RetryDelay = 200 * time.Millisecond
+)
+
+// Error is an error response from a DVID server.  Kind and RequestID are only set
+// by endpoints that return JSON errors of the form {"error": ..., "kind": ..., "request-id": ...}.
+type Error struct {
+	StatusCode int
+	Message    string
+	Kind       string
+	RequestID  string
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("DVID returned status %d: %s [request %s]", e.StatusCode, e.Message, e.RequestID)
+	}
+	return fmt.Sprintf("DVID returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// Temporary returns true if the request may succeed when retried.
+func (e *Error) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// errorFromResponse returns an *Error for a response with the given status and body.
+func errorFromResponse(resp *http.Response, body []byte) *Error {
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get("X-Request-Id"),
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var jsonErr struct {
+			Error     string `json:"error"`
+			Kind      string `json:"kind"`
+			RequestID string `json:"request-id"`
+		}
+		if err := json.Unmarshal(body, &jsonErr); err == nil && jsonErr.Error != "" {
+			e.Message = jsonErr.Error
+			e.Kind = jsonErr.Kind
+			if jsonErr.RequestID != "" {
+				e.RequestID = jsonErr.RequestID
+			}
+			return e
+		}
+	}
+	e.Message = strings.TrimSpace(string(body))
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+// apiURL returns the URL of an endpoint of a data instance.  The parts are joined
+// with "/" and, like the data name, must not need escaping.
+func apiURL(server, uuid, name string, query url.Values, parts ...string) string {
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	urlStr := strings.TrimRight(server, "/") + APIPath + "node/" + uuid + "/" + name
+	if len(parts) > 0 {
+		urlStr += "/" + strings.Join(parts, "/")
+	}
+	if len(query) > 0 {
+		urlStr += "?" + query.Encode()
+	}
+	return urlStr
+}
+
+// response is a successful response with its body read and decompressed.
+type response struct {
+	header http.Header
+	body   []byte
+}
+
+// get sends a GET request, retrying after connection errors and temporary server errors.
+func get(urlStr string) (*response, error) {
+	delay := RetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := do("GET", urlStr, "", nil)
+		if err == nil {
+			return resp, nil
+		}
+		if e, ok := err.(*Error); ok && !e.Temporary() {
+			return nil, err
+		}
+		if attempt >= MaxRetries {
+			return nil, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends a POST request once, since requests that modify data may not be repeatable.
+func post(urlStr, contentType string, body []byte) (*response, error) {
+	return do("POST", urlStr, contentType, body)
+}
+
+// do sends a single request, asking for a gzip-encoded response, and returns either the
+// decompressed body of a successful response or an *Error.
+func do(method, urlStr, contentType string, body []byte) (*response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, urlStr, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Bad gzip response from %s: %s", urlStr, err.Error())
+		}
+		defer gz.Close()
+		r = gz
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response from %s: %s", urlStr, err.Error())
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, errorFromResponse(resp, data)
+	}
+	return &response{resp.Header, data}, nil
+}
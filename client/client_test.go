@@ -0,0 +1,226 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func TestErrors(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "abc-1")
+		if strings.HasSuffix(r.URL.Path, "/json") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"no such tile","kind":"not-found","request-id":"abc-2"}`)
+			return
+		}
+		http.Error(w, "ERROR: bad label (/api/node/1f/labels/text).", http.StatusBadRequest)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	_, err := get(apiURL(ts.URL, "1f", "labels", nil, "json"))
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected *Error, got %v\n", err)
+	}
+	expected := Error{http.StatusNotFound, "no such tile", "not-found", "abc-2"}
+	if *e != expected {
+		t.Errorf("Expected %+v from JSON error, got %+v\n", expected, *e)
+	}
+
+	_, err = get(apiURL(ts.URL, "1f", "labels", nil, "text"))
+	e, ok = err.(*Error)
+	if !ok {
+		t.Fatalf("Expected *Error, got %v\n", err)
+	}
+	expected = Error{http.StatusBadRequest, "ERROR: bad label (/api/node/1f/labels/text).", "", "abc-1"}
+	if *e != expected {
+		t.Errorf("Expected %+v from text error, got %+v\n", expected, *e)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	defer func(delay time.Duration) { RetryDelay = delay }(RetryDelay)
+	RetryDelay = time.Millisecond
+
+	var count, failures int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&count, 1)
+		if atomic.AddInt64(&failures, -1) >= 0 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+	urlStr := apiURL(ts.URL, "1f", "labels", nil, "info")
+
+	failures = 2
+	if resp, err := get(urlStr); err != nil || string(resp.body) != "ok" {
+		t.Errorf("Expected GET to succeed after retries, got %v\n", err)
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 GET attempts, got %d\n", count)
+	}
+
+	count, failures = 0, int64(MaxRetries+1)
+	if _, err := get(urlStr); err == nil || !err.(*Error).Temporary() {
+		t.Errorf("Expected temporary error after retries run out, got %v\n", err)
+	}
+	if count != int64(MaxRetries+1) {
+		t.Errorf("Expected %d GET attempts, got %d\n", MaxRetries+1, count)
+	}
+
+	count, failures = 0, 1
+	if _, err := post(urlStr, "application/json", []byte("[]")); err == nil {
+		t.Errorf("Expected POST to fail without retries\n")
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 POST attempt, got %d\n", count)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			http.Error(w, "expected gzip", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		fmt.Fprint(gz, "compressed")
+		gz.Close()
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	resp, err := get(apiURL(ts.URL, "1f", "labels", nil, "info"))
+	if err != nil {
+		t.Fatalf("Unable to get gzip response: %s\n", err.Error())
+	}
+	if string(resp.body) != "compressed" {
+		t.Errorf("Expected decompressed body, got %q\n", string(resp.body))
+	}
+}
+
+func TestURLs(t *testing.T) {
+	spec := TileReq{
+		Plane:    "xz",
+		Scaling:  2,
+		Coord:    dvid.Point3d{3, -1, 20},
+		Format:   "jpeg:80",
+		TileSize: 256,
+		Query:    map[string][]string{"noblanks": {"true"}},
+	}
+	parts, query := spec.path()
+	expected := "http://emdata:8000/api/node/3f8c/grayscale/tile/xz/2/3_-1_20/jpeg:80?noblanks=true&tilesize=256"
+	if got := apiURL("emdata:8000/", "3f8c", "grayscale", query, parts...); got != expected {
+		t.Errorf("Expected tile URL %q, got %q\n", expected, got)
+	}
+	if spec.Query.Get("tilesize") != "" {
+		t.Errorf("Tile URL modified request's query: %v\n", spec.Query)
+	}
+	parts, query = TileReq{}.path()
+	expected = "https://emdata/api/node/3f8c/grayscale/tile/xy/0/0_0_0"
+	if got := apiURL("https://emdata", "3f8c", "grayscale", query, parts...); got != expected {
+		t.Errorf("Expected tile URL %q, got %q\n", expected, got)
+	}
+}
+
+func TestSparseVolEncoding(t *testing.T) {
+	rles := dvid.RLEs{
+		dvid.NewRLE(dvid.Point3d{10, 40, 10}, 20),
+		dvid.NewRLE(dvid.Point3d{-5, 41, 10}, 3),
+	}
+	encoding, err := EncodeSparseVol(rles)
+	if err != nil {
+		t.Fatalf("Unable to encode sparse volume: %s\n", err.Error())
+	}
+	if len(encoding) != 12+2*16 || binary.LittleEndian.Uint32(encoding[4:8]) != 23 {
+		t.Errorf("Expected 2 spans with 23 voxels, got %d bytes with %d voxels\n",
+			len(encoding), binary.LittleEndian.Uint32(encoding[4:8]))
+	}
+	decoded, err := DecodeSparseVol(encoding)
+	if err != nil {
+		t.Fatalf("Unable to decode sparse volume: %s\n", err.Error())
+	}
+	if !reflect.DeepEqual(decoded, rles) {
+		t.Errorf("Expected decoded spans %v, got %v\n", rles, decoded)
+	}
+
+	for _, bad := range [][]byte{encoding[:8], encoding[:len(encoding)-1], append([]byte{1}, encoding[1:]...)} {
+		if _, err := DecodeSparseVol(bad); err == nil {
+			t.Errorf("Expected error decoding bad sparse volume %v\n", bad)
+		}
+	}
+}
+
+func TestSparseVolReader(t *testing.T) {
+	rles := dvid.RLEs{dvid.NewRLE(dvid.Point3d{1, 2, 3}, 4)}
+	encoding, err := EncodeSparseVol(rles)
+	if err != nil {
+		t.Fatalf("Unable to encode sparse volume: %s\n", err.Error())
+	}
+	var stream []byte
+	for _, frame := range []struct {
+		label    uint64
+		encoding []byte
+	}{{7, encoding}, {8, nil}} {
+		header := make([]byte, 16)
+		binary.LittleEndian.PutUint64(header[0:8], frame.label)
+		binary.LittleEndian.PutUint64(header[8:16], uint64(len(frame.encoding)))
+		stream = append(stream, header...)
+		stream = append(stream, frame.encoding...)
+	}
+
+	reader := NewSparseVolReader(bytes.NewReader(stream))
+	if label, got, err := reader.Next(); err != nil || label != 7 || !reflect.DeepEqual(got, rles) {
+		t.Errorf("Expected label 7 with spans %v, got label %d with %v, err %v\n", rles, label, got, err)
+	}
+	if label, got, err := reader.Next(); err != nil || label != 8 || got != nil {
+		t.Errorf("Expected label 8 without spans, got label %d with %v, err %v\n", label, got, err)
+	}
+	if _, _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected EOF after last label, got %v\n", err)
+	}
+
+	// Streams cut off within a frame are errors.
+	for _, n := range []int{10, 30} {
+		reader = NewSparseVolReader(bytes.NewReader(stream[:n]))
+		if _, _, err := reader.Next(); err != io.ErrUnexpectedEOF {
+			t.Errorf("Expected unexpected EOF for stream of %d bytes, got %v\n", n, err)
+		}
+	}
+}
+
+func TestRawTiles(t *testing.T) {
+	img, err := rawTile(dvid.ChannelUint16, []byte{1, 0, 2, 0, 3, 1, 4, 0})
+	if err != nil {
+		t.Fatalf("Unable to read raw uint16 tile: %s\n", err.Error())
+	}
+	gray16, ok := img.(*image.Gray16)
+	if !ok || gray16.Bounds().Dx() != 2 || gray16.Gray16At(0, 1).Y != 259 {
+		t.Errorf("Expected 2 x 2 uint16 tile with 259 at (0,1), got %T %v\n", img, img.Bounds())
+	}
+	if _, err := rawTile(dvid.ChannelUint8, make([]byte, 10)); err == nil {
+		t.Errorf("Expected error for raw tile that isn't square\n")
+	}
+	if _, err := rawTile(dvid.ChannelFloat32, make([]byte, 16)); err == nil {
+		t.Errorf("Expected error for raw float tile\n")
+	}
+}
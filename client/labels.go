@@ -0,0 +1,203 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// sparseVolHeaderSize is the number of bytes before the spans of an encoded sparse volume.
+const sparseVolHeaderSize = 12
+
+// EncodeSparseVol returns the binary sparse volume format used by the sparsevol and split
+// endpoints of label data:
+//
+//    byte     Payload descriptor, 0 for no payload
+//    uint8    Number of dimensions, 3
+//    uint8    Dimension of run, 0 for X
+//    byte     Reserved
+//    uint32   # Voxels
+//    uint32   # Spans
+//    Repeating unit of:
+//        int32   Coordinate of run start (dimension 0)
+//        int32   Coordinate of run start (dimension 1)
+//        int32   Coordinate of run start (dimension 2)
+//        int32   Length of run
+//
+// All values are little-endian.
+func EncodeSparseVol(rles dvid.RLEs) ([]byte, error) {
+	spans, err := rles.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	numVoxels, numSpans := rles.Stats()
+	encoding := make([]byte, sparseVolHeaderSize, sparseVolHeaderSize+len(spans))
+	encoding[0] = dvid.EncodingBinary
+	encoding[1] = 3
+	binary.LittleEndian.PutUint32(encoding[4:8], uint32(numVoxels))
+	binary.LittleEndian.PutUint32(encoding[8:12], uint32(numSpans))
+	return append(encoding, spans...), nil
+}
+
+// DecodeSparseVol returns the spans of a binary sparse volume without a payload.
+func DecodeSparseVol(encoding []byte) (dvid.RLEs, error) {
+	if len(encoding) < sparseVolHeaderSize {
+		return nil, fmt.Errorf("Sparse volume of %d bytes is too short for its header", len(encoding))
+	}
+	if encoding[0] != dvid.EncodingBinary {
+		return nil, fmt.Errorf("Expected sparse volume with payload descriptor %d, got %d", dvid.EncodingBinary, encoding[0])
+	}
+	if encoding[1] != 3 || encoding[2] != 0 {
+		return nil, fmt.Errorf("Expected 3d sparse volume with runs along X, got %d dimensions with runs along dimension %d",
+			encoding[1], encoding[2])
+	}
+	numSpans := binary.LittleEndian.Uint32(encoding[8:12])
+	if size := sparseVolHeaderSize + 16*int64(numSpans); size != int64(len(encoding)) {
+		return nil, fmt.Errorf("Sparse volume with %d spans requires %d bytes, got %d", numSpans, size, len(encoding))
+	}
+	var rles dvid.RLEs
+	if err := rles.UnmarshalBinaryReader(bytes.NewReader(encoding[sparseVolHeaderSize:]), numSpans); err != nil {
+		return nil, err
+	}
+	return rles, nil
+}
+
+// GetSparseVol returns the spans of a label, optionally restricted to the given bounds.
+// If exact is false, only the blocks intersecting the bounds are used to restrict spans.
+func GetSparseVol(server, uuid, name string, label uint64, bounds *dvid.Bounds, exact bool) (dvid.RLEs, error) {
+	query := url.Values{}
+	if bounds != nil {
+		for _, bound := range []struct {
+			key   string
+			value func() (int32, bool)
+		}{
+			{"minx", bounds.MinX}, {"maxx", bounds.MaxX},
+			{"miny", bounds.MinY}, {"maxy", bounds.MaxY},
+			{"minz", bounds.MinZ}, {"maxz", bounds.MaxZ},
+		} {
+			if value, ok := bound.value(); ok {
+				query.Set(bound.key, strconv.Itoa(int(value)))
+			}
+		}
+	}
+	if exact {
+		query.Set("exact", "true")
+	}
+	resp, err := get(apiURL(server, uuid, name, query, "sparsevol", strconv.FormatUint(label, 10)))
+	if err != nil {
+		return nil, err
+	}
+	return DecodeSparseVol(resp.body)
+}
+
+// SparseVolReader reads the stream of framed sparse volumes returned by the sparsevols
+// endpoint of label data.  Each frame is a uint64 label, the uint64 length of its sparse
+// volume, and the sparse volume, all little-endian.
+type SparseVolReader struct {
+	r io.Reader
+}
+
+// NewSparseVolReader returns a reader of framed sparse volumes from r.
+func NewSparseVolReader(r io.Reader) *SparseVolReader {
+	return &SparseVolReader{r}
+}
+
+// Next returns the next label and its spans, which are nil if the label has no voxels.
+// It returns io.EOF after the last sparse volume and io.ErrUnexpectedEOF if the stream
+// ends within a frame, which happens if the server stopped after an error.
+func (svr *SparseVolReader) Next() (label uint64, rles dvid.RLEs, err error) {
+	frame := make([]byte, 16)
+	if _, err = io.ReadFull(svr.r, frame); err != nil {
+		return
+	}
+	label = binary.LittleEndian.Uint64(frame[0:8])
+	length := binary.LittleEndian.Uint64(frame[8:16])
+	if length == 0 {
+		return
+	}
+	encoding := make([]byte, length)
+	if _, err = io.ReadFull(svr.r, encoding); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	rles, err = DecodeSparseVol(encoding)
+	return
+}
+
+// GetSparseVols returns the spans of many labels with one request.  Labels without voxels
+// are returned with nil spans.
+func GetSparseVols(server, uuid, name string, labels []uint64) (map[uint64]dvid.RLEs, error) {
+	jsonBytes, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := post(apiURL(server, uuid, name, nil, "sparsevols"), "application/json", jsonBytes)
+	if err != nil {
+		return nil, err
+	}
+	vols := make(map[uint64]dvid.RLEs, len(labels))
+	reader := NewSparseVolReader(bytes.NewReader(resp.body))
+	for {
+		label, rles, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading sparse volumes after %d labels: %s", len(vols), err.Error())
+		}
+		vols[label] = rles
+	}
+	for _, label := range labels {
+		if _, found := vols[label]; !found {
+			return nil, fmt.Errorf("Sparse volumes response is missing label %d", label)
+		}
+	}
+	return vols, nil
+}
+
+// Merge merges labels, where each tuple gives the label to keep followed by the labels
+// merged into it, e.g., [][]uint64{{20, 3, 5}, {30, 7}}.  The optional query-string
+// options, e.g., "strict" or "force", are passed to the merge endpoint.
+func Merge(server, uuid, name string, tuples [][]uint64, options url.Values) error {
+	jsonBytes, err := json.Marshal(tuples)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"terse": {"true"}}
+	for key, values := range options {
+		query[key] = values
+	}
+	_, err = post(apiURL(server, uuid, name, query, "merge"), "application/json", jsonBytes)
+	return err
+}
+
+// Split splits the voxels given by the spans off their label, returning the new label
+// from the JSON response, e.g., {"label": 23}.
+func Split(server, uuid, name string, rles dvid.RLEs) (newLabel uint64, err error) {
+	encoding, err := EncodeSparseVol(rles)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := post(apiURL(server, uuid, name, nil, "split"), "application/octet-stream", encoding)
+	if err != nil {
+		return 0, err
+	}
+	var result struct {
+		Label *uint64 `json:"label"`
+	}
+	if err := json.Unmarshal(resp.body, &result); err != nil {
+		return 0, fmt.Errorf("Bad split response %q: %s", string(resp.body), err.Error())
+	}
+	if result.Label == nil {
+		return 0, fmt.Errorf("Split response has no new label: %q", string(resp.body))
+	}
+	return *result.Label, nil
+}
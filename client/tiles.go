@@ -0,0 +1,108 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+	"net/url"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// TileReq specifies a tile using the grammar of the tile endpoint of googlevoxels and
+// multiscale2d data:
+//
+//    <api URL>/node/<UUID>/<data name>/tile/<plane>/<scaling>/<tile coord>[/<format>][?options]
+type TileReq struct {
+	// Plane is "xy", "xz", "yz", or axes like "0_2".
+	Plane string
+
+	// Scaling is 0 for the original resolution, with each step a downres by 2.
+	Scaling uint8
+
+	// Coord is the tile coordinate.
+	Coord dvid.Point3d
+
+	// Format is the optional image format, e.g., "png" or "jpeg:80".  If empty, the
+	// instance's default format is used.
+	Format string
+
+	// TileSize is the optional size in pixels along one dimension of the square tile.
+	TileSize int32
+
+	// Query holds any other query-string options, e.g., "noblanks" or "offline".
+	Query url.Values
+}
+
+// path returns the URL path elements and query string of the tile request.
+func (spec TileReq) path() ([]string, url.Values) {
+	plane := spec.Plane
+	if plane == "" {
+		plane = "xy"
+	}
+	coord := fmt.Sprintf("%d_%d_%d", spec.Coord[0], spec.Coord[1], spec.Coord[2])
+	parts := []string{"tile", plane, strconv.Itoa(int(spec.Scaling)), coord}
+	if spec.Format != "" {
+		parts = append(parts, spec.Format)
+	}
+	query := url.Values{}
+	for key, values := range spec.Query {
+		query[key] = values
+	}
+	if spec.TileSize != 0 {
+		query.Set("tilesize", strconv.Itoa(int(spec.TileSize)))
+	}
+	return parts, query
+}
+
+// GetTile returns a decoded tile.  Tiles in the "raw" format are returned as
+// *image.Gray or *image.Gray16 depending on the X-DVID-Voxel-Type header, and raw
+// tiles of other voxel types are an error.
+func GetTile(server, uuid, name string, spec TileReq) (image.Image, error) {
+	parts, query := spec.path()
+	resp, err := get(apiURL(server, uuid, name, query, parts...))
+	if err != nil {
+		return nil, err
+	}
+	if resp.header.Get("Content-Type") == "application/octet-stream" {
+		return rawTile(resp.header.Get("X-DVID-Voxel-Type"), resp.body)
+	}
+	img, _, err := image.Decode(bytes.NewReader(resp.body))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode %s tile: %s", resp.header.Get("Content-Type"), err.Error())
+	}
+	return img, nil
+}
+
+// rawTile returns a square image from little-endian voxel values.
+func rawTile(voxelType string, data []byte) (image.Image, error) {
+	var bytesPerVoxel int
+	switch voxelType {
+	case dvid.ChannelUint8:
+		bytesPerVoxel = 1
+	case dvid.ChannelUint16:
+		bytesPerVoxel = 2
+	default:
+		return nil, fmt.Errorf("Raw tiles of %q voxels can't be returned as images", voxelType)
+	}
+	numVoxels := len(data) / bytesPerVoxel
+	size := int(math.Sqrt(float64(numVoxels)))
+	if size*size != numVoxels || numVoxels*bytesPerVoxel != len(data) {
+		return nil, fmt.Errorf("Raw tile of %d bytes is not a square of %s voxels", len(data), voxelType)
+	}
+	bounds := image.Rect(0, 0, size, size)
+	if bytesPerVoxel == 1 {
+		img := image.NewGray(bounds)
+		copy(img.Pix, data)
+		return img, nil
+	}
+	img := image.NewGray16(bounds)
+	for i := 0; i < numVoxels; i++ {
+		value := binary.LittleEndian.Uint16(data[2*i:])
+		binary.BigEndian.PutUint16(img.Pix[2*i:], value)
+	}
+	return img, nil
+}
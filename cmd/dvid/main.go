@@ -270,6 +270,9 @@ func DoServe(cmd dvid.Command) error {
 	if err := datastore.Initialize(); err != nil {
 		return fmt.Errorf("Unable to initialize datastore: %s\n", err.Error())
 	}
+	if err := server.LoadSettings(); err != nil {
+		return err
+	}
 
 	// Serve HTTP and RPC
 	if err := server.Serve(*httpAddress, *clientDir, *rpcAddress); err != nil {
@@ -144,6 +144,25 @@ type DataService interface {
 	//gob.GobDecoder
 }
 
+// Shutdowner is implemented by data services that run background goroutines, which
+// must be stopped when the data instance is deleted or the server shuts down.
+type Shutdowner interface {
+	Shutdown()
+}
+
+// Recoverer is implemented by data services that must finish or flag operations that
+// were interrupted, e.g., by a crash, when the server loads their data instance.
+type Recoverer interface {
+	Recover() error
+}
+
+// ReferenceChecker is implemented by data services whose settings name other data
+// instances in their repo.  A repo calls CheckReferences with a lookup of its instances
+// when the data is created and rejects the data if a reference is bad.
+type ReferenceChecker interface {
+	CheckReferences(getData func(dvid.DataString) (DataService, error)) error
+}
+
 // Persistence indicates the level of persistence needed for data within this instance.
 // It's a method to mark how critical it is to protect data.
 type Persistence uint8
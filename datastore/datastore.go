@@ -114,6 +114,13 @@ func Types() (map[dvid.URLString]TypeService, error) {
 	return Manager.Types()
 }
 
+// Shutdown stops background work for all data instances.
+func Shutdown() {
+	if Manager != nil {
+		Manager.Shutdown()
+	}
+}
+
 func GetData(versionID dvid.VersionID, name dvid.DataString) (DataService, error) {
 	if Manager == nil {
 		return nil, fmt.Errorf("datastore not initialized")
@@ -39,6 +39,16 @@ type TypeService interface {
 	Help() string
 }
 
+// Cloner is implemented by datatypes whose instances can be copied into another repo
+// without contacting the external resources they were created from, e.g., network-backed
+// types whose properties are expensive to fetch.
+type Cloner interface {
+	// CloneProperties returns a new instance in the repo with the given root UUID, local
+	// instance ID, and name whose properties are copied from the source instance and then
+	// modified by any settings in config.
+	CloneProperties(src DataService, uuid dvid.UUID, id dvid.InstanceID, name dvid.DataString, c dvid.Config) (DataService, error)
+}
+
 var (
 	// Compiled is the set of registered datatypes compiled into DVID and
 	// held as a global variable initialized at runtime.
@@ -0,0 +1,202 @@
+/*
+	This file aggregates the label mutations logged by the data instances of a repo, so
+	admins can audit recent merges across all label instances in one place.
+*/
+
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// DefaultMutationLimit is the number of label mutations returned by a page of
+// ListLabelMutations if no limit is given, and MaxMutationLimit is the most allowed.
+const (
+	DefaultMutationLimit = 500
+	MaxMutationLimit     = 10000
+)
+
+// LabelMutation is a logged change to labels of a data instance.  For merges, Labels are
+// the target label followed by the labels merged into it, and mutations of several merge
+// tuples in one operation share an ID.
+type LabelMutation struct {
+	Instance dvid.DataString `json:"instance"`
+	UUID     dvid.UUID       `json:"uuid"`
+	ID       uint64          `json:"id"`
+	Op       string          `json:"op"`
+	Labels   []uint64        `json:"labels"`
+	User     string          `json:"user,omitempty"`
+	Time     time.Time       `json:"time"`
+}
+
+// MutationLister is implemented by data services that log label mutations, which are
+// aggregated across a repo by ListLabelMutations.  Data created before mutations were
+// logged simply has none.
+type MutationLister interface {
+	// ListMutations returns the logged label mutations at all versions that happened at
+	// or after the given time in any order.  The Instance of the mutations needn't be set.
+	ListMutations(since time.Time) ([]LabelMutation, error)
+}
+
+// MutationCursor is the position in the time-ordered label mutations of a repo after
+// which a page of ListLabelMutations starts.  Since the mutations of one merge share its
+// time, id, and instance, Seq is the number of them already returned.
+type MutationCursor struct {
+	Time     time.Time
+	ID       uint64
+	Seq      int
+	Instance dvid.DataString
+}
+
+// String returns the cursor in the form parsed by ParseMutationCursor.
+func (c MutationCursor) String() string {
+	return fmt.Sprintf("%d_%d_%d_%s", c.Time.UnixNano(), c.ID, c.Seq, c.Instance)
+}
+
+// ParseMutationCursor parses a cursor returned as the Next field of a LabelMutationPage.
+func ParseMutationCursor(s string) (*MutationCursor, error) {
+	parts := strings.SplitN(s, "_", 4)
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bad mutation cursor %q", s)
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad time in mutation cursor %q", s)
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad id in mutation cursor %q", s)
+	}
+	seq, err := strconv.Atoi(parts[2])
+	if err != nil || seq < 1 {
+		return nil, fmt.Errorf("bad sequence number in mutation cursor %q", s)
+	}
+	return &MutationCursor{time.Unix(0, nanos), id, seq, dvid.DataString(parts[3])}, nil
+}
+
+// compare returns -1, 0, or 1 if the mutation is before, at, or after the position of
+// the cursor's last mutation in time order, ignoring Seq.  Mutations at the same time are
+// ordered by id and then instance.
+func (c MutationCursor) compare(m LabelMutation) int {
+	switch {
+	case m.Time.Before(c.Time):
+		return -1
+	case m.Time.After(c.Time):
+		return 1
+	case m.ID < c.ID:
+		return -1
+	case m.ID > c.ID:
+		return 1
+	case m.Instance < c.Instance:
+		return -1
+	case m.Instance > c.Instance:
+		return 1
+	}
+	return 0
+}
+
+// LabelMutationPage is a page of the label mutations of a repo in time order.  If more
+// mutations remain, Next is the cursor of the next page.  Skipped gives the error of
+// each instance whose mutations couldn't be read.
+type LabelMutationPage struct {
+	Mutations []LabelMutation            `json:"mutations"`
+	Next      string                     `json:"next,omitempty"`
+	Skipped   map[dvid.DataString]string `json:"skipped,omitempty"`
+}
+
+type mutationsByTime []LabelMutation
+
+func (m mutationsByTime) Len() int      { return len(m) }
+func (m mutationsByTime) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m mutationsByTime) Less(i, j int) bool {
+	if !m[i].Time.Equal(m[j].Time) {
+		return m[i].Time.Before(m[j].Time)
+	}
+	if m[i].ID != m[j].ID {
+		return m[i].ID < m[j].ID
+	}
+	return m[i].Instance < m[j].Instance
+}
+
+// ListLabelMutations returns a page of up to limit label mutations of all instances in a
+// repo that log them, ordered by time, that happened at or after the since time and
+// follow the cursor if it's not nil.  A limit of 0 uses DefaultMutationLimit.  Instances
+// whose mutations can't be read are noted in the page rather than failing the listing.
+func ListLabelMutations(repo Repo, since time.Time, cursor *MutationCursor, limit int) (*LabelMutationPage, error) {
+	if limit == 0 {
+		limit = DefaultMutationLimit
+	}
+	if limit < 0 || limit > MaxMutationLimit {
+		return nil, fmt.Errorf("limit %d must be between 1 and %d", limit, MaxMutationLimit)
+	}
+	if cursor != nil && cursor.Time.After(since) {
+		since = cursor.Time
+	}
+	allData, err := repo.GetAllData()
+	if err != nil {
+		return nil, err
+	}
+	listers := make(map[dvid.DataString]MutationLister)
+	for name, dataservice := range allData {
+		if lister, ok := dataservice.(MutationLister); ok {
+			listers[name] = lister
+		}
+	}
+	page := &LabelMutationPage{Mutations: []LabelMutation{}}
+	var mutations mutationsByTime
+	for name, lister := range listers {
+		logged, err := lister.ListMutations(since)
+		if err != nil {
+			dvid.Errorf("Skipping label mutations of %q: %s\n", name, err.Error())
+			if page.Skipped == nil {
+				page.Skipped = make(map[dvid.DataString]string)
+			}
+			page.Skipped[name] = err.Error()
+			continue
+		}
+		for _, mutation := range logged {
+			mutation.Instance = name
+			if !mutation.Time.Before(since) {
+				mutations = append(mutations, mutation)
+			}
+		}
+	}
+
+	// The mutations of one merge keep the order they were listed in.
+	sort.Stable(mutations)
+	if cursor != nil {
+		start, seq := 0, 0
+		for ; start < len(mutations); start++ {
+			cmp := cursor.compare(mutations[start])
+			if cmp > 0 || (cmp == 0 && seq == cursor.Seq) {
+				break
+			}
+			if cmp == 0 {
+				seq++
+			}
+		}
+		mutations = mutations[start:]
+	}
+	if len(mutations) > limit {
+		last := mutations[limit-1]
+		next := MutationCursor{last.Time, last.ID, 0, last.Instance}
+		if cursor != nil && cursor.Time.Equal(last.Time) && cursor.ID == last.ID && cursor.Instance == last.Instance {
+			next.Seq = cursor.Seq
+		}
+		for _, mutation := range mutations[:limit] {
+			if next.compare(mutation) == 0 {
+				next.Seq++
+			}
+		}
+		page.Next = next.String()
+		mutations = mutations[:limit]
+	}
+	page.Mutations = append(page.Mutations, mutations...)
+	return page, nil
+}
@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/janelia-flyem/dvid/dvid"
 	"github.com/janelia-flyem/dvid/storage"
@@ -63,6 +64,9 @@ type RepoManager interface {
 
 	Types() (map[dvid.URLString]TypeService, error)
 
+	// Shutdown stops any background work of data instances in all repos.
+	Shutdown()
+
 	gob.GobDecoder
 	gob.GobEncoder
 	json.Marshaler
@@ -115,6 +119,11 @@ type Repo interface {
 	// will specify whether the data is versioned.
 	NewData(TypeService, dvid.DataString, dvid.Config) (DataService, error)
 
+	// CloneData adds a new, named instance to repo whose properties are copied from a data
+	// instance, possibly of another repo, with any settings in 'config' applied.  The type
+	// of the copied instance must implement Cloner.
+	CloneData(DataService, dvid.DataString, dvid.Config) (DataService, error)
+
 	// ModifyData modifies a preexisting data instance with new configuration settings.
 	ModifyData(dvid.DataString, dvid.Config) error
 
@@ -132,6 +141,13 @@ type Repo interface {
 	// Lock "locks" the given node of the DAG to be read-only.
 	Lock(dvid.UUID) error
 
+	// Locked returns true if the given node is locked, along with the UUIDs of any
+	// unlocked child nodes that could be modified instead.
+	Locked(dvid.UUID) (bool, []dvid.UUID, error)
+
+	// Created returns the time the given node was created.
+	Created(dvid.UUID) (time.Time, error)
+
 	gob.GobDecoder
 	gob.GobEncoder
 	json.Marshaler
@@ -147,6 +163,7 @@ const (
 	newIDsKey
 	repoKey
 	formatKey  // Stores MetadataVersion
+	serverSettingsKey
 )
 
 // NetadataVersion is the version of the metadata so we can add new metadata 
@@ -163,6 +180,8 @@ func (t keyType) String() string {
 		return "next new local ids"
 	case repoKey:
 		return "repository metadata"
+	case serverSettingsKey:
+		return "server settings"
 	default:
 		return fmt.Sprintf("unknown metadata key: %v", t)
 	}
@@ -171,6 +190,7 @@ func (t keyType) String() string {
 type metadataIndex struct {
 	t      keyType
 	repoID dvid.RepoID // Only used for repoKey
+	name   string      // Only used for serverSettingsKey
 }
 
 func (i *metadataIndex) Duplicate() dvid.Index {
@@ -179,10 +199,16 @@ func (i *metadataIndex) Duplicate() dvid.Index {
 }
 
 func (i *metadataIndex) String() string {
+	if i.t == serverSettingsKey {
+		return fmt.Sprintf("Metadata key type %d, settings %q", i.t, i.name)
+	}
 	return fmt.Sprintf("Metadata key type %d, repo ID %d", i.t, i.repoID)
 }
 
 func (i *metadataIndex) Bytes() []byte {
+	if i.t == serverSettingsKey {
+		return append([]byte{byte(i.t)}, i.name...)
+	}
 	return append([]byte{byte(i.t)}, i.repoID.Bytes()...)
 }
 
@@ -201,5 +227,31 @@ func (i *metadataIndex) IndexFromBytes(b []byte) error {
 		}
 		i.repoID = dvid.RepoIDFromBytes(b[1 : 1+dvid.RepoIDSize])
 	}
+	if i.t == serverSettingsKey {
+		i.name = string(b[1:])
+	}
 	return nil
 }
+
+// GetServerSettings returns the persisted server-wide settings with the given name, or nil
+// if none have been persisted.
+func GetServerSettings(name string) ([]byte, error) {
+	store, err := storage.MetaDataStore()
+	if err != nil {
+		return nil, err
+	}
+	var ctx storage.MetadataContext
+	idx := metadataIndex{t: serverSettingsKey, name: name}
+	return store.Get(ctx, idx.Bytes())
+}
+
+// PutServerSettings persists server-wide settings with the given name.
+func PutServerSettings(name string, value []byte) error {
+	store, err := storage.MetaDataStore()
+	if err != nil {
+		return err
+	}
+	var ctx storage.MetadataContext
+	idx := metadataIndex{t: serverSettingsKey, name: name}
+	return store.Put(ctx, idx.Bytes(), value)
+}
@@ -141,6 +141,9 @@ func Initialize() error {
 
 	// Set the package variable.  We are good to go...
 	Manager = m
+
+	// Recover any data instance operations interrupted before the last shutdown.
+	m.recoverData()
 	return nil
 }
 
@@ -572,6 +575,53 @@ func (m *repoManager) SaveRepoByVersionID(versionID dvid.VersionID) error {
 }
 
 // Datatypes returns a list of TypeService needed for this set of repositories
+// Shutdown stops any background work of data instances in all repos.
+func (m *repoManager) Shutdown() {
+	m.Lock()
+	repos := make(map[*repoT]bool, len(m.repos))
+	for _, repo := range m.repos {
+		repos[repo] = true
+	}
+	m.Unlock()
+
+	for repo := range repos {
+		repo.mu.Lock()
+		for _, dataservice := range repo.data {
+			if s, ok := dataservice.(Shutdowner); ok {
+				s.Shutdown()
+			}
+		}
+		repo.mu.Unlock()
+	}
+}
+
+// recoverData lets data instances in all repos recover from interrupted operations.
+// Failures are logged since the data instances flag what needs repair.
+func (m *repoManager) recoverData() {
+	m.Lock()
+	repos := make(map[*repoT]bool, len(m.repos))
+	for _, repo := range m.repos {
+		repos[repo] = true
+	}
+	m.Unlock()
+
+	for repo := range repos {
+		repo.mu.Lock()
+		var recoverers []Recoverer
+		for _, dataservice := range repo.data {
+			if r, ok := dataservice.(Recoverer); ok {
+				recoverers = append(recoverers, r)
+			}
+		}
+		repo.mu.Unlock()
+		for _, r := range recoverers {
+			if err := r.Recover(); err != nil {
+				dvid.Errorf("Unable to recover data instance %q: %s\n", r.(DataService).DataName(), err.Error())
+			}
+		}
+	}
+}
+
 func (m *repoManager) Types() (map[dvid.URLString]TypeService, error) {
 	combinedMap := make(map[dvid.URLString]TypeService)
 	for _, repo := range m.repos {
@@ -858,6 +908,11 @@ func (r *repoT) NewData(t TypeService, name dvid.DataString, c dvid.Config) (Dat
 	if err != nil {
 		return nil, err
 	}
+	if checker, ok := dataservice.(ReferenceChecker); ok {
+		if err := checker.CheckReferences(r.getDataByName); err != nil {
+			return nil, fmt.Errorf("Cannot make data %q: %s", name, err.Error())
+		}
+	}
 	r.data[name] = dataservice
 	r.updated = time.Now()
 	actionMsg := fmt.Sprintf("Create new data instance %q of type %q", name, dataservice.TypeName())
@@ -867,6 +922,40 @@ func (r *repoT) NewData(t TypeService, name dvid.DataString, c dvid.Config) (Dat
 	return dataservice, r.save()
 }
 
+// CloneData adds a new, named data instance whose properties are copied from a data
+// instance, possibly of another Repo, with the settings in the 'config' argument applied.
+func (r *repoT) CloneData(src DataService, name dvid.DataString, c dvid.Config) (DataService, error) {
+	cloner, ok := src.GetType().(Cloner)
+	if !ok {
+		return nil, fmt.Errorf("Data %q of type %q can't be cloned", src.DataName(), src.TypeName())
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.data[name]; found {
+		return nil, fmt.Errorf("Data named %q already exists in repo (root %s)", name, r.rootID)
+	}
+	instanceID, err := r.manager.NewInstanceID()
+	if err != nil {
+		return nil, err
+	}
+	dataservice, err := cloner.CloneProperties(src, r.RootUUID(), instanceID, name, c)
+	if err != nil {
+		return nil, err
+	}
+	if checker, ok := dataservice.(ReferenceChecker); ok {
+		if err := checker.CheckReferences(r.getDataByName); err != nil {
+			return nil, fmt.Errorf("Cannot clone data %q: %s", name, err.Error())
+		}
+	}
+	r.data[name] = dataservice
+	r.updated = time.Now()
+	actionMsg := fmt.Sprintf("Clone data instance %q of type %q from data %q", name, dataservice.TypeName(), src.DataName())
+	if err = r.addToLog(actionMsg); err != nil {
+		return nil, err
+	}
+	return dataservice, r.save()
+}
+
 // ModifyData modifies preexisting Data within a Repo.  Settings can be passed
 // via the 'config' argument.  Only settings within the passed config are modified.
 func (r *repoT) ModifyData(name dvid.DataString, config dvid.Config) error {
@@ -889,6 +978,11 @@ func (r *repoT) DeleteDataByName(name dvid.DataString) error {
 		return err
 	}
 
+	// Stop any background work for this data instance.
+	if s, ok := dataservice.(Shutdowner); ok {
+		s.Shutdown()
+	}
+
 	// For all data tiers of storage, remove data key-value pairs that would be associated with this instance id.
 	if err = storage.DeleteDataInstance(dataservice.InstanceID()); err != nil {
 		return err
@@ -960,6 +1054,40 @@ func (r *repoT) Lock(uuid dvid.UUID) error {
 	return r.save()
 }
 
+func (r *repoT) Locked(uuid dvid.UUID) (bool, []dvid.UUID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versionID, found := r.manager.UUIDToVersion[uuid]
+	if !found {
+		return false, nil, fmt.Errorf("Could not find version (uuid %s)", uuid)
+	}
+	node, found := r.dag.nodes[versionID]
+	if !found {
+		return false, nil, fmt.Errorf("Could not find version (id %d)", versionID)
+	}
+	var openChildren []dvid.UUID
+	for _, childID := range node.children {
+		if child, found := r.dag.nodes[childID]; found && !child.locked {
+			openChildren = append(openChildren, child.uuid)
+		}
+	}
+	return node.locked, openChildren, nil
+}
+
+func (r *repoT) Created(uuid dvid.UUID) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versionID, found := r.manager.UUIDToVersion[uuid]
+	if !found {
+		return time.Time{}, fmt.Errorf("Could not find version (uuid %s)", uuid)
+	}
+	node, found := r.dag.nodes[versionID]
+	if !found {
+		return time.Time{}, fmt.Errorf("Could not find version (id %d)", versionID)
+	}
+	return node.created, nil
+}
+
 func (r *repoT) Types() (map[dvid.URLString]TypeService, error) {
 	datatypes := make(map[dvid.URLString]TypeService)
 	for _, dataservice := range r.data {
@@ -0,0 +1,284 @@
+/*
+	Package cseg encodes label volumes in the compressed segmentation format of Neuroglancer
+	and rasterizes sparse volumes into the label arrays it encodes.
+
+	A volume is divided into sub-blocks, each described by a table of its distinct labels in
+	increasing order and the index into that table of each voxel, bit-packed with 0, 1, 2,
+	4, 8, 16, or 32 bits per voxel.  Sub-blocks with the same distinct labels share a table.
+	The encoding of a channel begins with two 32-bit words per sub-block in x-fastest order:
+	the first holds the offset of the sub-block's table in its low 24 bits and the number of
+	bits per index in its high 8 bits, and the second holds the offset of its packed
+	indices.  Offsets are in 32-bit words from the start of the channel, and tables hold each
+	label as two words, low word first.  As in the chunks of Neuroglancer's precomputed
+	format, encodings here hold a single channel preceded by its offset, so the first word is
+	always 1.  All words are little endian.
+*/
+package cseg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// DefaultSubblockSize is the sub-block size Neuroglancer uses for compressed segmentation.
+var DefaultSubblockSize = [3]int{8, 8, 8}
+
+// maxOffset is the largest table offset that fits in the low 24 bits of a header word.
+const maxOffset = 1<<24 - 1
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// wordBytes returns 32-bit words as little-endian bytes.
+func wordBytes(words []uint32) []byte {
+	b := make([]byte, 4*len(words))
+	for i, word := range words {
+		binary.LittleEndian.PutUint32(b[i*4:], word)
+	}
+	return b
+}
+
+// checkSizes returns an error if the volume and sub-block sizes aren't positive or the
+// volume size doesn't match the number of labels.
+func checkSizes(numLabels int, size, subblock [3]int) error {
+	for dim := 0; dim < 3; dim++ {
+		if size[dim] <= 0 || subblock[dim] <= 0 {
+			return fmt.Errorf("volume size %v and sub-block size %v must be positive", size, subblock)
+		}
+	}
+	if numLabels != size[0]*size[1]*size[2] {
+		return fmt.Errorf("%d labels don't fill a volume of size %v", numLabels, size)
+	}
+	return nil
+}
+
+// encodedBits returns the number of bits per index needed for a table of the given size.
+func encodedBits(tableSize int) uint {
+	if tableSize <= 1 {
+		return 0
+	}
+	bits := uint(1)
+	for 1<<bits < tableSize {
+		bits *= 2
+	}
+	return bits
+}
+
+// subblockExtent returns the size of the sub-block at a grid position, which is smaller
+// than the sub-block size at the upper edges of a volume it doesn't divide.
+func subblockExtent(grid, size, subblock [3]int) [3]int {
+	var extent [3]int
+	for dim := 0; dim < 3; dim++ {
+		extent[dim] = subblock[dim]
+		if remaining := size[dim] - grid[dim]*subblock[dim]; remaining < extent[dim] {
+			extent[dim] = remaining
+		}
+	}
+	return extent
+}
+
+// gridSize returns the number of sub-blocks along each dimension of a volume.
+func gridSize(size, subblock [3]int) [3]int {
+	var grid [3]int
+	for dim := 0; dim < 3; dim++ {
+		grid[dim] = (size[dim] + subblock[dim] - 1) / subblock[dim]
+	}
+	return grid
+}
+
+// Encode returns the compressed segmentation encoding of labels given in x-fastest order
+// within a volume of the given size.  Sub-blocks at the upper edges of the volume are
+// partial if the sub-block size doesn't divide the volume size, and their indices are
+// packed as if they were whole with 0 for voxels outside the volume.
+func Encode(labels []uint64, size, subblock [3]int) ([]byte, error) {
+	if err := checkSizes(len(labels), size, subblock); err != nil {
+		return nil, err
+	}
+	grid := gridSize(size, subblock)
+	numSubblocks := grid[0] * grid[1] * grid[2]
+	subblockVoxels := subblock[0] * subblock[1] * subblock[2]
+
+	// The channel starts after its offset word.
+	const base = 1
+	words := make([]uint32, base+2*numSubblocks)
+	words[0] = base
+
+	tables := make(map[string]uint32)
+	var pos [3]int
+	for pos[2] = 0; pos[2] < grid[2]; pos[2]++ {
+		for pos[1] = 0; pos[1] < grid[1]; pos[1]++ {
+			for pos[0] = 0; pos[0] < grid[0]; pos[0]++ {
+				extent := subblockExtent(pos, size, subblock)
+				voxel := func(x, y, z int) uint64 {
+					x += pos[0] * subblock[0]
+					y += pos[1] * subblock[1]
+					z += pos[2] * subblock[2]
+					return labels[x+size[0]*(y+size[1]*z)]
+				}
+
+				// Get the distinct labels of the sub-block, which form its table.
+				seen := make(map[uint64]uint32)
+				var table uint64Slice
+				for z := 0; z < extent[2]; z++ {
+					for y := 0; y < extent[1]; y++ {
+						for x := 0; x < extent[0]; x++ {
+							label := voxel(x, y, z)
+							if _, found := seen[label]; !found {
+								seen[label] = 0
+								table = append(table, label)
+							}
+						}
+					}
+				}
+				sort.Sort(table)
+				tableWords := make([]uint32, 0, 2*len(table))
+				for i, label := range table {
+					seen[label] = uint32(i)
+					tableWords = append(tableWords, uint32(label), uint32(label>>32))
+				}
+
+				// Pack the indices, which are followed by the table unless an earlier
+				// sub-block has the same table.
+				bits := encodedBits(len(table))
+				valueOffset := len(words) - base
+				packed := make([]uint32, (int(bits)*subblockVoxels+31)/32)
+				if bits > 0 {
+					for z := 0; z < extent[2]; z++ {
+						for y := 0; y < extent[1]; y++ {
+							for x := 0; x < extent[0]; x++ {
+								bit := uint(x+subblock[0]*(y+subblock[1]*z)) * bits
+								packed[bit/32] |= seen[voxel(x, y, z)] << (bit % 32)
+							}
+						}
+					}
+				}
+				words = append(words, packed...)
+				key := string(wordBytes(tableWords))
+				tableOffset, found := tables[key]
+				if !found {
+					if len(words)-base > maxOffset {
+						return nil, fmt.Errorf("encoding of volume of size %v is too large for 24-bit table offsets", size)
+					}
+					tableOffset = uint32(len(words) - base)
+					tables[key] = tableOffset
+					words = append(words, tableWords...)
+				}
+				header := base + 2*(pos[0]+grid[0]*(pos[1]+grid[1]*pos[2]))
+				words[header] = tableOffset | uint32(bits)<<24
+				words[header+1] = uint32(valueOffset)
+			}
+		}
+	}
+	return wordBytes(words), nil
+}
+
+// Decode returns the labels in x-fastest order of a volume of the given size from its
+// compressed segmentation encoding with the given sub-block size.
+func Decode(data []byte, size, subblock [3]int) ([]uint64, error) {
+	if err := checkSizes(size[0]*size[1]*size[2], size, subblock); err != nil {
+		return nil, err
+	}
+	if len(data)%4 != 0 || len(data) < 4 {
+		return nil, fmt.Errorf("encoding of %d bytes isn't a whole number of 32-bit words", len(data))
+	}
+	words := make([]uint32, len(data)/4)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	if words[0] != 1 {
+		return nil, fmt.Errorf("expected a single channel at offset 1, got offset %d", words[0])
+	}
+	const base = 1
+	grid := gridSize(size, subblock)
+	numSubblocks := grid[0] * grid[1] * grid[2]
+	if len(words) < base+2*numSubblocks {
+		return nil, fmt.Errorf("encoding of %d words is too short for %d sub-blocks", len(words), numSubblocks)
+	}
+	word := func(offset int) (uint32, error) {
+		if offset < 0 || base+offset >= len(words) {
+			return 0, fmt.Errorf("offset %d is outside the encoding of %d words", offset, len(words))
+		}
+		return words[base+offset], nil
+	}
+
+	labels := make([]uint64, size[0]*size[1]*size[2])
+	var pos [3]int
+	for pos[2] = 0; pos[2] < grid[2]; pos[2]++ {
+		for pos[1] = 0; pos[1] < grid[1]; pos[1]++ {
+			for pos[0] = 0; pos[0] < grid[0]; pos[0]++ {
+				header := base + 2*(pos[0]+grid[0]*(pos[1]+grid[1]*pos[2]))
+				tableOffset := int(words[header] & maxOffset)
+				bits := uint(words[header] >> 24)
+				valueOffset := int(words[header+1])
+				switch bits {
+				case 0, 1, 2, 4, 8, 16, 32:
+				default:
+					return nil, fmt.Errorf("sub-block %v has %d bits per index", pos, bits)
+				}
+				extent := subblockExtent(pos, size, subblock)
+				for z := 0; z < extent[2]; z++ {
+					for y := 0; y < extent[1]; y++ {
+						for x := 0; x < extent[0]; x++ {
+							var index uint64
+							if bits > 0 {
+								bit := uint(x+subblock[0]*(y+subblock[1]*z)) * bits
+								packed, err := word(valueOffset + int(bit/32))
+								if err != nil {
+									return nil, err
+								}
+								index = uint64(packed>>(bit%32)) & (1<<bits - 1)
+							}
+							low, err := word(tableOffset + 2*int(index))
+							if err != nil {
+								return nil, err
+							}
+							high, err := word(tableOffset + 2*int(index) + 1)
+							if err != nil {
+								return nil, err
+							}
+							vx := x + pos[0]*subblock[0]
+							vy := y + pos[1]*subblock[1]
+							vz := z + pos[2]*subblock[2]
+							labels[vx+size[0]*(vy+size[1]*vz)] = uint64(high)<<32 | uint64(low)
+						}
+					}
+				}
+			}
+		}
+	}
+	return labels, nil
+}
+
+// Rasterize returns the labels in x-fastest order of a volume of the given size whose
+// first voxel is at offset, where voxels in the runs have the label and all others are 0.
+// Runs are clipped to the volume.
+func Rasterize(rles dvid.RLEs, label uint64, offset dvid.Point3d, size [3]int) []uint64 {
+	labels := make([]uint64, size[0]*size[1]*size[2])
+	for _, rle := range rles {
+		start := rle.StartPt()
+		y := int(start[1] - offset[1])
+		z := int(start[2] - offset[2])
+		if y < 0 || y >= size[1] || z < 0 || z >= size[2] {
+			continue
+		}
+		x0 := int(start[0] - offset[0])
+		x1 := x0 + int(rle.Length())
+		if x0 < 0 {
+			x0 = 0
+		}
+		if x1 > size[0] {
+			x1 = size[0]
+		}
+		row := size[0] * (y + size[1]*z)
+		for x := x0; x < x1; x++ {
+			labels[row+x] = label
+		}
+	}
+	return labels
+}
@@ -0,0 +1,136 @@
+package cseg
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func bytesToWords(b []byte) []uint32 {
+	words := make([]uint32, len(b)/4)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	return words
+}
+
+// The reference encodings follow the compressed segmentation encoder of Neuroglancer.
+func TestEncodeReference(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		labels   []uint64
+		size     [3]int
+		subblock [3]int
+		expected []uint32
+	}{
+		{
+			name:     "uniform",
+			labels:   []uint64{5, 5, 5, 5},
+			size:     [3]int{2, 2, 1},
+			subblock: [3]int{2, 2, 1},
+			expected: []uint32{1, 2, 2, 5, 0},
+		},
+		{
+			name:     "2-bit indices",
+			labels:   []uint64{0, 7, 7, 3},
+			size:     [3]int{4, 1, 1},
+			subblock: [3]int{4, 1, 1},
+			expected: []uint32{1, 0x02000003, 2, 0x68, 0, 0, 3, 0, 7, 0},
+		},
+		{
+			name:     "shared table",
+			labels:   []uint64{9, 9},
+			size:     [3]int{2, 1, 1},
+			subblock: [3]int{1, 1, 1},
+			expected: []uint32{1, 4, 4, 4, 6, 9, 0},
+		},
+		{
+			name:     "partial sub-block",
+			labels:   []uint64{1, 2, 1},
+			size:     [3]int{3, 1, 1},
+			subblock: [3]int{2, 1, 1},
+			expected: []uint32{1, 0x01000005, 4, 9, 9, 2, 1, 0, 2, 0, 1, 0},
+		},
+		{
+			name:     "64-bit labels",
+			labels:   []uint64{0x100000002, 0},
+			size:     [3]int{1, 2, 1},
+			subblock: [3]int{1, 2, 1},
+			expected: []uint32{1, 0x01000003, 2, 1, 0, 0, 2, 1},
+		},
+	} {
+		encoded, err := Encode(tc.labels, tc.size, tc.subblock)
+		if err != nil {
+			t.Fatalf("Unable to encode %s volume: %s\n", tc.name, err.Error())
+		}
+		if words := bytesToWords(encoded); !reflect.DeepEqual(words, tc.expected) {
+			t.Errorf("Bad encoding of %s volume:\n  expected %#x\n  got      %#x\n", tc.name, tc.expected, words)
+		}
+		decoded, err := Decode(encoded, tc.size, tc.subblock)
+		if err != nil {
+			t.Fatalf("Unable to decode %s volume: %s\n", tc.name, err.Error())
+		}
+		if !reflect.DeepEqual(decoded, tc.labels) {
+			t.Errorf("Bad decoding of %s volume: expected %v, got %v\n", tc.name, tc.labels, decoded)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	size := [3]int{32, 20, 9}
+	for _, numLabels := range []int{1, 2, 3, 5, 16, 17, 300, 70000} {
+		labels := make([]uint64, size[0]*size[1]*size[2])
+		for i := range labels {
+			labels[i] = uint64(r.Intn(numLabels)) * 0x0000000100000001
+		}
+		for _, subblock := range [][3]int{DefaultSubblockSize, {1, 1, 1}, {5, 3, 4}, {64, 64, 64}} {
+			encoded, err := Encode(labels, size, subblock)
+			if err != nil {
+				t.Fatalf("Unable to encode %d labels with sub-block %v: %s\n", numLabels, subblock, err.Error())
+			}
+			decoded, err := Decode(encoded, size, subblock)
+			if err != nil {
+				t.Fatalf("Unable to decode %d labels with sub-block %v: %s\n", numLabels, subblock, err.Error())
+			}
+			if !reflect.DeepEqual(decoded, labels) {
+				t.Errorf("Round trip of %d labels with sub-block %v changed labels\n", numLabels, subblock)
+			}
+		}
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	if _, err := Encode(make([]uint64, 7), [3]int{2, 2, 2}, DefaultSubblockSize); err == nil {
+		t.Errorf("Expected error encoding labels that don't fill the volume\n")
+	}
+	if _, err := Encode(make([]uint64, 8), [3]int{2, 2, 2}, [3]int{0, 8, 8}); err == nil {
+		t.Errorf("Expected error encoding with empty sub-blocks\n")
+	}
+	encoded, err := Encode(make([]uint64, 8), [3]int{2, 2, 2}, DefaultSubblockSize)
+	if err != nil {
+		t.Fatalf("Unable to encode: %s\n", err.Error())
+	}
+	if _, err := Decode(encoded[:len(encoded)-4], [3]int{2, 2, 2}, DefaultSubblockSize); err == nil {
+		t.Errorf("Expected error decoding truncated encoding\n")
+	}
+}
+
+func TestRasterize(t *testing.T) {
+	rles := dvid.RLEs{
+		dvid.NewRLE(dvid.Point3d{30, 33, 64}, 4),  // clipped at the lower x edge
+		dvid.NewRLE(dvid.Point3d{35, 34, 65}, 10), // clipped at the upper x edge
+		dvid.NewRLE(dvid.Point3d{32, 40, 64}, 2),  // outside in y
+	}
+	labels := Rasterize(rles, 23, dvid.Point3d{32, 32, 64}, [3]int{8, 4, 2})
+	expected := make([]uint64, 8*4*2)
+	for _, i := range []int{8, 9, 8*4 + 16 + 3, 8*4 + 16 + 4, 8*4 + 16 + 5, 8*4 + 16 + 6, 8*4 + 16 + 7} {
+		expected[i] = 23
+	}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Bad rasterization:\n  expected %v\n  got      %v\n", expected, labels)
+	}
+}
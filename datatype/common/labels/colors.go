@@ -0,0 +1,161 @@
+/*
+	Package labels provides support shared by label data types.  Its colormap gives every
+	label a stable pseudo-color so the same label renders identically across endpoints,
+	with optional per-instance overrides of the colors of particular labels.
+*/
+package labels
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Background is the color of the background label 0, which can't be overridden.
+var Background = color.NRGBA{0, 0, 0, 255}
+
+// HashColor returns the stable color of a label, with black for the background label 0.
+// The label is hashed into a hue spread around the color wheel with saturation and value
+// kept high enough that neighboring labels remain distinguishable on a dark background.
+func HashColor(label uint64) color.NRGBA {
+	if label == 0 {
+		return Background
+	}
+	h := label * 0x9E3779B97F4A7C15
+	h ^= h >> 29
+	h *= 0xBF58476D1CE4E5B9
+	h ^= h >> 32
+	hue := float64(h&0xFFFF) / 65536.0 * 6.0
+	saturation := 0.55 + 0.45*float64((h>>16)&0xFF)/255.0
+	value := 0.7 + 0.3*float64((h>>24)&0xFF)/255.0
+	return hsvColor(hue, saturation, value)
+}
+
+// hsvColor converts a hue in [0, 6) and saturation and value in [0, 1] to an opaque color.
+func hsvColor(hue, saturation, value float64) color.NRGBA {
+	sector := int(hue)
+	f := hue - float64(sector)
+	p := value * (1 - saturation)
+	q := value * (1 - saturation*f)
+	t := value * (1 - saturation*(1-f))
+	var r, g, b float64
+	switch sector {
+	case 0:
+		r, g, b = value, t, p
+	case 1:
+		r, g, b = q, value, p
+	case 2:
+		r, g, b = p, value, t
+	case 3:
+		r, g, b = p, q, value
+	case 4:
+		r, g, b = t, p, value
+	default:
+		r, g, b = value, p, q
+	}
+	return color.NRGBA{uint8(r*255 + 0.5), uint8(g*255 + 0.5), uint8(b*255 + 0.5), 255}
+}
+
+// ParseHexColor parses a color given as "#RRGGBB".
+func ParseHexColor(s string) (color.NRGBA, error) {
+	if len(s) != 7 || s[0] != '#' {
+		return color.NRGBA{}, fmt.Errorf("color must be given as \"#RRGGBB\", not %q", s)
+	}
+	rgb, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("color must be given as \"#RRGGBB\", not %q", s)
+	}
+	return color.NRGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 255}, nil
+}
+
+// HexColor returns a color as "#RRGGBB".
+func HexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+}
+
+// Palette holds colors of labels that override their hashed colors.
+type Palette map[uint64]color.NRGBA
+
+// Color returns the color of a label in the palette, or its hashed color if the label has
+// no override.
+func (p Palette) Color(label uint64) color.NRGBA {
+	if label != 0 {
+		if c, found := p[label]; found {
+			return c
+		}
+	}
+	return HashColor(label)
+}
+
+// Copy returns a copy of the palette, e.g., to color labels while the palette is modified.
+func (p Palette) Copy() Palette {
+	cp := make(Palette, len(p))
+	for label, c := range p {
+		cp[label] = c
+	}
+	return cp
+}
+
+// MarshalJSON returns the palette as a JSON object of label to "#RRGGBB" color.
+func (p Palette) MarshalJSON() ([]byte, error) {
+	colors := make(map[string]string, len(p))
+	for label, c := range p {
+		colors[strconv.FormatUint(label, 10)] = HexColor(c)
+	}
+	return json.Marshal(colors)
+}
+
+// PaletteChanges are overrides to apply to a palette, where a nil color removes the
+// override of a label.
+type PaletteChanges map[uint64]*color.NRGBA
+
+// ParsePaletteChanges parses a JSON object of label to "#RRGGBB" color, where an empty
+// string or null color removes a label's override.  The background label 0 can't be
+// overridden.
+func ParsePaletteChanges(data []byte) (PaletteChanges, error) {
+	var colors map[string]*string
+	if err := json.Unmarshal(data, &colors); err != nil {
+		return nil, fmt.Errorf("Expected JSON object of label to \"#RRGGBB\" color: %s", err.Error())
+	}
+	keys := make([]string, 0, len(colors))
+	for key := range colors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	changes := make(PaletteChanges, len(colors))
+	for _, key := range keys {
+		label, err := strconv.ParseUint(strings.TrimSpace(key), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad label %q in colormap", key)
+		}
+		if label == 0 {
+			return nil, fmt.Errorf("The color of the background label 0 can't be overridden")
+		}
+		if colors[key] == nil || *colors[key] == "" {
+			changes[label] = nil
+			continue
+		}
+		c, err := ParseHexColor(*colors[key])
+		if err != nil {
+			return nil, fmt.Errorf("Bad color for label %d: %s", label, err.Error())
+		}
+		changes[label] = &c
+	}
+	return changes, nil
+}
+
+// Apply returns a copy of the palette with the changes applied.
+func (p Palette) Apply(changes PaletteChanges) Palette {
+	cp := p.Copy()
+	for label, c := range changes {
+		if c == nil {
+			delete(cp, label)
+		} else {
+			cp[label] = *c
+		}
+	}
+	return cp
+}
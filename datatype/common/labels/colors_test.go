@@ -0,0 +1,48 @@
+package labels
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestHashColor(t *testing.T) {
+	if c := HashColor(0); c != Background {
+		t.Errorf("Expected black for background label, got %v\n", c)
+	}
+	seen := make(map[color.NRGBA]uint64)
+	for label := uint64(1); label <= 1000; label++ {
+		c := HashColor(label)
+		if c != HashColor(label) {
+			t.Fatalf("Color of label %d isn't stable\n", label)
+		}
+		if c.A != 255 || (c.R < 100 && c.G < 100 && c.B < 100) {
+			t.Errorf("Expected opaque, bright color for label %d, got %v\n", label, c)
+		}
+		seen[c] = label
+	}
+	if len(seen) < 990 {
+		t.Errorf("Expected distinct colors for most of 1000 labels, got %d\n", len(seen))
+	}
+}
+
+func TestPalette(t *testing.T) {
+	changes, err := ParsePaletteChanges([]byte(`{"12": "#FF8000", "13": "#00ff00", "14": ""}`))
+	if err != nil {
+		t.Fatalf("Unable to parse palette changes: %s\n", err.Error())
+	}
+	palette := Palette{14: color.NRGBA{1, 2, 3, 255}}.Apply(changes)
+	if c := palette.Color(12); c != (color.NRGBA{255, 128, 0, 255}) {
+		t.Errorf("Expected override for label 12, got %v\n", c)
+	}
+	if c := palette.Color(14); c != HashColor(14) {
+		t.Errorf("Expected removed override of label 14 to give hashed color, got %v\n", c)
+	}
+	if HexColor(palette.Color(13)) != "#00FF00" {
+		t.Errorf("Expected #00FF00 for label 13, got %s\n", HexColor(palette.Color(13)))
+	}
+	for _, bad := range []string{`{"0": "#FFFFFF"}`, `{"x": "#FFFFFF"}`, `{"5": "red"}`, `{"5": "#FFFFFFF"}`, `[1]`} {
+		if _, err := ParsePaletteChanges([]byte(bad)); err == nil {
+			t.Errorf("Expected error parsing palette changes %s\n", bad)
+		}
+	}
+}
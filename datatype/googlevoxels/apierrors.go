@@ -0,0 +1,142 @@
+/*
+	This file classifies error responses from the Google BrainMaps API so failures on
+	instance creation give actionable messages, and it implements validation of creation
+	settings without creating an instance.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Actionable descriptions of common Google API errors.
+const (
+	ErrKeyInvalid     = "authkey invalid or expired"
+	ErrVolumeNotFound = "volumeid not found or not shared with this key"
+	ErrAPIDisabled    = "BrainMaps API not enabled"
+)
+
+// maxErrorBody is the maximum number of bytes of an error response that are read.
+const maxErrorBody = 64 * 1024
+
+// googleError is the JSON body of an error response from a Google API.
+type googleError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Errors  []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Details []struct {
+			Reason string `json:"reason"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// reasons returns the reason codes of the error, including its status.
+func (e googleError) reasons() []string {
+	var reasons []string
+	for _, item := range e.Error.Errors {
+		reasons = append(reasons, item.Reason)
+	}
+	for _, detail := range e.Error.Details {
+		reasons = append(reasons, detail.Reason)
+	}
+	if e.Error.Status != "" {
+		reasons = append(reasons, e.Error.Status)
+	}
+	return reasons
+}
+
+// classifyGoogleError returns an actionable description of a Google API error response
+// with the given status and body, which is empty if the error isn't a common case, and
+// the error's own message and reason codes, which are empty if the body isn't a Google
+// error.
+func classifyGoogleError(status int, body []byte) (description, detail string) {
+	var e googleError
+	if err := json.Unmarshal(body, &e); err == nil {
+		reasons := e.reasons()
+		detail = e.Error.Message
+		if len(reasons) > 0 {
+			detail = fmt.Sprintf("%s [%s]", detail, strings.Join(reasons, ", "))
+		}
+		for _, reason := range reasons {
+			switch reason {
+			case "keyInvalid", "keyExpired", "API_KEY_INVALID", "API_KEY_EXPIRED":
+				return ErrKeyInvalid, detail
+			case "accessNotConfigured", "SERVICE_DISABLED":
+				return ErrAPIDisabled, detail
+			}
+		}
+		msg := strings.ToLower(e.Error.Message)
+		switch {
+		case strings.Contains(msg, "api key not valid"), strings.Contains(msg, "api key expired"):
+			return ErrKeyInvalid, detail
+		case strings.Contains(msg, "has not been used in project"), strings.Contains(msg, "is disabled"):
+			return ErrAPIDisabled, detail
+		}
+	}
+	switch status {
+	case http.StatusUnauthorized:
+		return ErrKeyInvalid, detail
+	case http.StatusForbidden, http.StatusNotFound:
+		return ErrVolumeNotFound, detail
+	}
+	return "", detail
+}
+
+// checkError returns the error for an unexpected response to the request made on creation
+// to check upstream.  The message includes the request URL, which never has the API key,
+// and for BrainMaps, a description of the likely cause.  Any key echoed in the response
+// is masked.
+func (p *Properties) checkError(resp *http.Response, key string) error {
+	msg := fmt.Sprintf("Unexpected status code %d returned when getting %s (%s)", resp.StatusCode, p.checkName(), p.checkURL())
+	if p.provider() != ProviderBrainMaps {
+		return errors.New(msg)
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	description, detail := classifyGoogleError(resp.StatusCode, body)
+	if description != "" {
+		msg += ": " + description
+	}
+	if detail != "" {
+		if key != "" {
+			detail = strings.Replace(detail, key, dvid.MaskedValue, -1)
+		}
+		msg += fmt.Sprintf(" (Google says: %s)", detail)
+	}
+	return errors.New(msg)
+}
+
+// ValidationResult is returned as the error of a creation with "validate-only=true" that
+// passed all checks, so no instance is created.  Its message is the JSON of the scales the
+// instance would have.
+type ValidationResult struct {
+	TileMap      GeometryMap
+	Scales       Geometries
+	HighResIndex GeometryIndex
+}
+
+func (v ValidationResult) Error() string {
+	jsonBytes, err := json.Marshal(struct {
+		ValidateOnly bool
+		TileMap      GeometryMap
+		Scales       Geometries
+		HighResIndex GeometryIndex
+	}{true, v.TileMap, v.Scales, v.HighResIndex})
+	if err != nil {
+		return fmt.Sprintf("Validated settings but couldn't encode scales: %s", err.Error())
+	}
+	return string(jsonBytes)
+}
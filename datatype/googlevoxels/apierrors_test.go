@@ -0,0 +1,149 @@
+package googlevoxels
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func TestCreationErrors(t *testing.T) {
+	cases := []struct {
+		status      int
+		body        string
+		description string
+		detail      string
+	}{
+		{
+			http.StatusBadRequest,
+			`{"error": {"code": 400, "message": "API key not valid. Please pass a valid API key.", "status": "INVALID_ARGUMENT",
+				"details": [{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "reason": "API_KEY_INVALID"}]}}`,
+			ErrKeyInvalid,
+			"API key not valid",
+		},
+		{
+			http.StatusBadRequest,
+			`{"error": {"code": 400, "message": "Bad Request", "errors": [{"reason": "keyExpired", "message": "Bad Request"}]}}`,
+			ErrKeyInvalid,
+			"keyExpired",
+		},
+		{
+			http.StatusForbidden,
+			`{"error": {"code": 403, "message": "BrainMaps API has not been used in project 1234 before or it is disabled.",
+				"status": "PERMISSION_DENIED", "errors": [{"reason": "accessNotConfigured"}]}}`,
+			ErrAPIDisabled,
+			"project 1234",
+		},
+		{
+			http.StatusForbidden,
+			`{"error": {"code": 403, "message": "The caller does not have permission", "status": "PERMISSION_DENIED"}}`,
+			ErrVolumeNotFound,
+			"PERMISSION_DENIED",
+		},
+		{
+			http.StatusNotFound,
+			`{"error": {"code": 404, "message": "Volume not found", "status": "NOT_FOUND"}}`,
+			ErrVolumeNotFound,
+			"Volume not found",
+		},
+		{
+			http.StatusUnauthorized,
+			`<html>Unauthorized</html>`,
+			ErrKeyInvalid,
+			"",
+		},
+		{
+			http.StatusInternalServerError,
+			`{"error": {"code": 500, "message": "Internal error for key secretkey", "status": "INTERNAL"}}`,
+			"",
+			"Internal error for key " + dvid.MaskedValue,
+		},
+	}
+	for _, c := range cases {
+		stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(c.status)
+			w.Write([]byte(c.body))
+		}))
+		dtype := NewType()
+		dtype.APIURL = stub.URL
+		config := dvid.NewConfig()
+		config.Set("volumeid", "123:vol")
+		config.Set("authkey", "secretkey")
+		_, err := dtype.NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config)
+		stub.Close()
+		if err == nil {
+			t.Errorf("Expected error for status %d\n", c.status)
+			continue
+		}
+		msg := err.Error()
+		if !strings.Contains(msg, stub.URL+"/volumes/123:vol") || strings.Contains(msg, "secretkey") {
+			t.Errorf("Expected error with request URL and no key for status %d, got %q\n", c.status, msg)
+		}
+		description, detail := classifyGoogleError(c.status, []byte(c.body))
+		if description != c.description || !strings.Contains(msg, c.description) || !strings.Contains(msg, c.detail) {
+			t.Errorf("Expected %q with %q for status %d, got %q from %q\n", c.description, c.detail, c.status, description, msg)
+		}
+		if c.detail == "" && detail != "" {
+			t.Errorf("Expected no detail for non-JSON body, got %q\n", detail)
+		}
+	}
+
+	// The fake's rejection of a bad key is classified.
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	dtype := NewType()
+	dtype.APIURL = fb.URL
+	config := dvid.NewConfig()
+	config.Set("volumeid", fb.volumeID)
+	config.Set("authkey", "wrongkey")
+	if _, err := dtype.NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config); err == nil || !strings.Contains(err.Error(), ErrKeyInvalid) {
+		t.Errorf("Expected invalid key error, got %v\n", err)
+	}
+}
+
+func TestValidateOnly(t *testing.T) {
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	dtype := NewType()
+	dtype.APIURL = fb.URL
+	config := dvid.NewConfig()
+	config.Set("volumeid", fb.volumeID)
+	config.Set("authkey", fakeKey)
+	config.Set("validate-only", "true")
+	service, err := dtype.NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config)
+	if service != nil {
+		t.Fatalf("Expected no instance to be created with validate-only\n")
+	}
+	result, ok := err.(ValidationResult)
+	if !ok {
+		t.Fatalf("Expected validation result, got %v\n", err)
+	}
+	if len(result.Scales) != len(fb.geoms) || result.TileMap[TileSpec{2, XY}] != 2 {
+		t.Errorf("Unexpected validation result: %v\n", result)
+	}
+	var decoded struct {
+		ValidateOnly bool
+		Scales       []struct {
+			VolumeSize dvid.Point3d
+		}
+		HighResIndex GeometryIndex
+	}
+	if jsonErr := json.Unmarshal([]byte(err.Error()), &decoded); jsonErr != nil {
+		t.Fatalf("Bad validation JSON %q: %s\n", err.Error(), jsonErr.Error())
+	}
+	if !decoded.ValidateOnly || len(decoded.Scales) != len(fb.geoms) || decoded.Scales[1].VolumeSize != fb.geoms[1].volumeSize {
+		t.Errorf("Unexpected validation JSON: %s\n", err.Error())
+	}
+
+	// Checks still fail before validation completes.
+	config.Set("background", "300")
+	if _, err := dtype.NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config); err == nil {
+		t.Errorf("Expected bad background to fail validation\n")
+	} else if _, ok := err.(ValidationResult); ok {
+		t.Errorf("Expected bad background error, got validation result\n")
+	}
+}
@@ -0,0 +1,211 @@
+/*
+	This file supports the rendering of regions outside the available volume, i.e., blank
+	tiles and the padding of edge tiles, so they can be distinguished from dark data.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/dvid"
+
+	"github.com/janelia-flyem/go/freetype-go/freetype"
+)
+
+// Styles for rendering regions outside the available volume.
+const (
+	// OOBSolid fills regions outside the volume with the background value.
+	OOBSolid = "solid"
+
+	// OOBChecker fills regions outside the volume with a checkerboard of the background
+	// value and its contrasting value.
+	OOBChecker = "checker"
+
+	// OOBBorder fills regions outside the volume with the background value and draws a
+	// 1-pixel frame of the contrasting value along the edge of the data in padded tiles.
+	OOBBorder = "border"
+)
+
+// Size in pixels of the squares in a checkerboard.
+const checkerSize = 16
+
+// Font size in points and line spacing of placeholder text.
+const (
+	placeholderFontSize = 12
+	placeholderSpacing  = 1.5
+)
+
+// checkOOBStyle returns an error if the string isn't a known out-of-bounds style.
+func checkOOBStyle(style string) error {
+	switch style {
+	case "", OOBSolid, OOBChecker, OOBBorder:
+		return nil
+	default:
+		return fmt.Errorf("Unknown out-of-bounds style %q, must be %q, %q, or %q", style, OOBSolid, OOBChecker, OOBBorder)
+	}
+}
+
+// backgroundBytes returns the little-endian bytes of a background value for a channel type.
+func backgroundBytes(value string, channelType string) ([]byte, error) {
+	if value == "" {
+		value = "0"
+	}
+	var b []byte
+	switch channelType {
+	case dvid.ChannelUint8:
+		v, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("Background %q is not a valid uint8 value", value)
+		}
+		b = []byte{byte(v)}
+	case dvid.ChannelUint16:
+		v, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Background %q is not a valid uint16 value", value)
+		}
+		b = make([]byte, 2)
+		binary.LittleEndian.PutUint16(b, uint16(v))
+	case dvid.ChannelUint64:
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Background %q is not a valid uint64 value", value)
+		}
+		b = make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, v)
+	case dvid.ChannelFloat32:
+		v, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Background %q is not a valid float value", value)
+		}
+		b = make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(v)))
+	default:
+		return nil, fmt.Errorf("Unable to set background for channel type %q", channelType)
+	}
+	return b, nil
+}
+
+// oobFill describes how voxels outside the available volume are rendered.
+type oobFill struct {
+	style      string
+	background []byte
+	contrast   []byte
+}
+
+// newOOBFill returns the rendering of out-of-bounds voxels for a channel type.  The
+// contrasting value is the bitwise complement of the background for integer voxels, and
+// for float voxels, 1 if the background is 0 or 0 otherwise.
+func newOOBFill(background, style, channelType string) (*oobFill, error) {
+	if err := checkOOBStyle(style); err != nil {
+		return nil, err
+	}
+	bg, err := backgroundBytes(background, channelType)
+	if err != nil {
+		return nil, err
+	}
+	contrast := make([]byte, len(bg))
+	if channelType == dvid.ChannelFloat32 {
+		var v float32
+		if math.Float32frombits(binary.LittleEndian.Uint32(bg)) == 0 {
+			v = 1
+		}
+		binary.LittleEndian.PutUint32(contrast, math.Float32bits(v))
+	} else {
+		for i := range bg {
+			contrast[i] = ^bg[i]
+		}
+	}
+	if style == "" {
+		style = OOBSolid
+	}
+	return &oobFill{style, bg, contrast}, nil
+}
+
+// zero returns true if the fill leaves voxels zero-valued.
+func (f *oobFill) zero() bool {
+	if f.style != OOBSolid {
+		return false
+	}
+	for _, b := range f.background {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// fill sets the voxels of a nx x ny image that lie outside the dataX x dataY voxels at
+// (x0, y0), which hold data.  A border is only drawn if the image holds some data.
+func (f *oobFill) fill(img []byte, nx, ny, x0, y0, dataX, dataY int32) {
+	if f.zero() {
+		return
+	}
+	bytesPerVoxel := int32(len(f.background))
+	hasData := dataX > 0 && dataY > 0
+	x1, y1 := x0+dataX, y0+dataY
+	for y := int32(0); y < ny; y++ {
+		inRows := y >= y0 && y < y1
+		for x := int32(0); x < nx; x++ {
+			if inRows && x >= x0 && x < x1 {
+				continue
+			}
+			value := f.background
+			switch f.style {
+			case OOBChecker:
+				if (x/checkerSize+y/checkerSize)%2 == 1 {
+					value = f.contrast
+				}
+			case OOBBorder:
+				if hasData && (((x == x0-1 || x == x1) && y >= y0-1 && y <= y1) ||
+					((y == y0-1 || y == y1) && x >= x0-1 && x <= x1)) {
+					value = f.contrast
+				}
+			}
+			copy(img[(y*nx+x)*bytesPerVoxel:], value)
+		}
+	}
+}
+
+// oobFill returns the rendering of out-of-bounds voxels for the tile.  Voxels outside
+// uint64 label volumes always get the background label since any other value would be
+// read as a label.
+func (d *Data) oobFill(tile *GoogleTileSpec) (*oobFill, error) {
+	style := d.OOBStyle
+	if tile.channelType == dvid.ChannelUint64 {
+		style = OOBSolid
+	}
+	fill, err := newOOBFill(d.Background, style, tile.channelType)
+	if err != nil {
+		return nil, fmt.Errorf("Data %q: %s", d.DataName(), err.Error())
+	}
+	return fill, nil
+}
+
+// drawPlaceholder draws lines of text with the given gray value onto a nx x ny uint8 image,
+// clipping any text that doesn't fit.
+func drawPlaceholder(data []byte, nx, ny int, lines []string, value byte) error {
+	img := &image.Gray{Pix: data, Stride: nx, Rect: image.Rect(0, 0, nx, ny)}
+	c := freetype.NewContext()
+	c.SetDPI(72)
+	c.SetFont(dvid.Font)
+	c.SetFontSize(placeholderFontSize)
+	c.SetClip(img.Bounds())
+	c.SetDst(img)
+	c.SetSrc(image.NewUniform(color.Gray{value}))
+
+	lineHeight := c.PointToFix32(placeholderFontSize * placeholderSpacing)
+	pt := freetype.Pt(10, 10)
+	for _, line := range lines {
+		pt.Y += lineHeight
+		if _, err := c.DrawString(line, pt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
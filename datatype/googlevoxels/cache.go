@@ -0,0 +1,262 @@
+/*
+	This file supports optional in-memory and disk caches of Google BrainMaps responses and
+	their administration through the "cache" endpoint.  The in-memory cache sits in front of
+	the disk cache.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+var cacheQueryParams = server.QueryParams{
+	{Name: "scale", Help: "Only evict tiles at this scale."},
+	{Name: "plane", Help: "Only evict tiles in this orientation: \"xy\", \"xz\", or \"yz\"."},
+	{Name: "warm", Help: "Path of JSON file on the server listing tiles to load into the cache."},
+}
+
+// cacheTags returns the attributes of a tile used to select cached entries for eviction.
+func (gts GoogleTileSpec) cacheTags() dvid.CacheTags {
+	return dvid.CacheTags{
+		"scale": strconv.Itoa(int(gts.scaling)),
+		"plane": strings.ToLower(gts.plane.String()),
+	}
+}
+
+// initCache creates the tile caches configured for this instance.  If the disk cache can't
+// be opened, tiles are only cached in memory.
+func (d *Data) initCache() {
+	if d.TileCacheMB > 0 && d.cache == nil {
+		d.cache = dvid.NewCache(uint64(d.TileCacheMB) * dvid.Mega)
+	}
+	if d.DiskCache != "" && d.disk == nil {
+		disk, err := newDiskCache(d.DiskCache, d.DiskCacheBytes)
+		if err != nil {
+			dvid.Errorf("Unable to use disk cache for %q: %s\n", d.DataName(), err.Error())
+			return
+		}
+		d.disk = disk
+	}
+}
+
+// cacheGet returns a cached response, checking memory before disk.  Responses found on
+// disk are added to the in-memory cache.
+func (d *Data) cacheGet(key string, tags dvid.CacheTags) ([]byte, bool) {
+	if d.cache != nil {
+		if data, found := d.cache.Get(key); found {
+			return data, true
+		}
+	}
+	if d.disk == nil {
+		return nil, false
+	}
+	data, found := d.disk.Get(key)
+	if found && d.cache != nil {
+		d.cache.Set(key, data, tags)
+	}
+	return data, found
+}
+
+// cacheSet adds a response to all cache tiers.
+func (d *Data) cacheSet(key string, data []byte, tags dvid.CacheTags) {
+	if d.cache != nil {
+		d.cache.Set(key, data, tags)
+	}
+	if d.disk != nil {
+		if err := d.disk.Set(key, data, tags); err != nil {
+			dvid.Errorf("Unable to write tile to disk cache for %q: %s\n", d.DataName(), err.Error())
+		}
+	}
+}
+
+// cacheDelete evicts a response from all cache tiers.
+func (d *Data) cacheDelete(key string) {
+	if d.cache != nil {
+		d.cache.Delete(key)
+	}
+	if d.disk != nil {
+		d.disk.Delete(key)
+	}
+}
+
+// caching returns true if the instance has any tile cache.
+func (d *Data) caching() bool {
+	return d.cache != nil || d.disk != nil
+}
+
+// CacheStats returns statistics for the in-memory tile cache or nil if there is no cache.
+func (d *Data) CacheStats() *dvid.CacheStats {
+	if d.cache == nil {
+		return nil
+	}
+	return d.cache.Stats()
+}
+
+// DiskCacheStats returns statistics for the disk tile cache or nil if there is no cache.
+func (d *Data) DiskCacheStats() *DiskCacheStats {
+	if d.disk == nil {
+		return nil
+	}
+	return d.disk.Stats()
+}
+
+// ClearCache evicts all cached tiles matching the filter from both tiers and returns the
+// number of entries evicted.
+func (d *Data) ClearCache(filter dvid.CacheTags) int {
+	memEvicted, diskEvicted := d.clearCaches(filter)
+	return memEvicted + diskEvicted
+}
+
+func (d *Data) clearCaches(filter dvid.CacheTags) (memEvicted, diskEvicted int) {
+	if d.cache != nil {
+		memEvicted = d.cache.Clear(filter)
+	}
+	if d.disk != nil {
+		diskEvicted = d.disk.Clear(filter)
+	}
+	return
+}
+
+// WarmTile specifies a tile to be loaded into the cache.
+type WarmTile struct {
+	Plane    string
+	Scale    Scaling
+	Coord    string
+	TileSize int32
+	Format   string
+}
+
+// warm loads the given tiles into the cache, returning the number of tiles fetched.  The
+// server's watchdog expects warming to take no longer than a timeout per tile.
+func (d *Data) warm(requestID string, tiles []WarmTile) (int, error) {
+	watched := server.WatchOperation("googlevoxels/warm", string(d.DataName()), time.Duration(len(tiles))*d.timeout())
+	defer watched.Done()
+	var numWarmed int
+	for i, spec := range tiles {
+		shape, err := dvid.DataShapeString(spec.Plane).DataShape()
+		if err != nil {
+			return numWarmed, server.NewError(server.BadRequestError, "tile %d has illegal plane %q: %s", i, spec.Plane, err.Error())
+		}
+		tileCoord, err := dvid.StringToPoint(spec.Coord, "_")
+		if err != nil {
+			return numWarmed, server.NewError(server.BadRequestError, "tile %d has illegal coordinate %q: %s", i, spec.Coord, err.Error())
+		}
+		tilesize := spec.TileSize
+		if tilesize == 0 {
+			tilesize = Defaults().DefaultTileSize
+		}
+		if tilesize < 0 || tilesize > MaxTileSize {
+			return numWarmed, server.NewError(server.BadRequestError, "tile %d has illegal tile size %d", i, tilesize)
+		}
+		tile, err := d.getTileSpecAt(spec.Scale, shape, tileCoord, tilesize, false)
+		if err != nil {
+			return numWarmed, err
+		}
+		formatStr := spec.Format
+		if formatStr == "" {
+			formatStr = d.planeFormat(tile.plane)
+		}
+		if tile.outside {
+			continue
+		}
+		if err := d.warmTile(requestID, tile, formatStr); err != nil {
+			return numWarmed, fmt.Errorf("Error warming tile %d: %s", i, err.Error())
+		}
+		numWarmed++
+	}
+	return numWarmed, nil
+}
+
+// warmTile fetches the same upstream data that a request for the tile in the given format
+// would use, so the data is cached.
+func (d *Data) warmTile(requestID string, tile *GoogleTileSpec, formatStr string) error {
+	if !tile.googleEncodes(formatStr) {
+		formatStr = ""
+	}
+	_, _, err := d.fetcher().FetchTile(fetchContext(requestID), *tile, formatStr)
+	return err
+}
+
+// serveCache handles the administration of the tile cache.
+func (d *Data) serveCache(w http.ResponseWriter, r *http.Request, requestID, action string) error {
+	if !d.caching() {
+		return server.NewError(server.NotFoundError, "tile caching is not enabled for %q", d.DataName())
+	}
+	query, err := server.NewQuery(r, cacheQueryParams, d.StrictQueries)
+	if err != nil {
+		return err
+	}
+
+	var result interface{}
+	switch action {
+	case "get":
+		result = struct {
+			*dvid.CacheStats
+			Disk *DiskCacheStats `json:",omitempty"`
+		}{d.CacheStats(), d.DiskCacheStats()}
+
+	case "delete":
+		filter := dvid.CacheTags{}
+		if query.Has("scale") {
+			scale, err := query.GetInt("scale", 0, 0, 255)
+			if err != nil {
+				return err
+			}
+			filter["scale"] = strconv.Itoa(scale)
+		}
+		if query.Has("plane") {
+			shape, err := dvid.DataShapeString(query.GetString("plane", "")).DataShape()
+			if err != nil {
+				return err
+			}
+			tileSpec, err := GetTileSpec(0, shape)
+			if err != nil {
+				return err
+			}
+			filter["plane"] = strings.ToLower(tileSpec.plane.String())
+		}
+		memEvicted, diskEvicted := d.clearCaches(filter)
+		result = struct {
+			Evicted     int
+			DiskEvicted int
+		}{memEvicted, diskEvicted}
+
+	case "post":
+		path := query.GetString("warm", "")
+		if path == "" {
+			return fmt.Errorf("POST to cache requires the 'warm' query string")
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return server.NewError(server.NotFoundError, "Unable to read tiles to warm: %s", err.Error())
+		}
+		var tiles []WarmTile
+		if err := json.Unmarshal(data, &tiles); err != nil {
+			return fmt.Errorf("Unable to decode tiles to warm in %q: %s", path, err.Error())
+		}
+		numWarmed, err := d.warm(requestID, tiles)
+		if err != nil {
+			return err
+		}
+		result = struct{ Warmed int }{numWarmed}
+
+	default:
+		return fmt.Errorf("cache endpoint does not support %s", strings.ToUpper(action))
+	}
+
+	jsonBytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return server.WriteJSON(w, r, jsonBytes)
+}
@@ -0,0 +1,83 @@
+/*
+	This file implements the cloning of googlevoxels instances into other repos.  A clone
+	copies the volume geometry fetched from Google when the source was created, so many repos
+	can reference the same BrainMaps volume without fetching its metadata again.
+*/
+
+package googlevoxels
+
+import (
+	"fmt"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// cloneProperties returns a deep copy of the properties.
+func (p *Properties) cloneProperties() Properties {
+	clone := *p
+	clone.TileMap = make(GeometryMap, len(p.TileMap))
+	for spec, gi := range p.TileMap {
+		clone.TileMap[spec] = gi
+	}
+	clone.Scales = append(Geometries{}, p.Scales...)
+	clone.StatsMetrics = append([]string(nil), p.StatsMetrics...)
+	if p.Timeout != nil {
+		timeout := *p.Timeout
+		clone.Timeout = &timeout
+	}
+	if p.Retries != nil {
+		retries := *p.Retries
+		clone.Retries = &retries
+	}
+	return clone
+}
+
+// CloneProperties returns a new googlevoxels instance whose properties, including the
+// scales fetched from Google when the source instance was created, are copied from the
+// source without contacting Google.  The "authkey" setting and any modifiable settings in
+// the config override those of the source.  Since each instance needs its own disk cache
+// directory and the mirror is an instance of the source's repo, the clone has neither.
+func (dtype *Type) CloneProperties(src datastore.DataService, uuid dvid.UUID, id dvid.InstanceID, name dvid.DataString, c dvid.Config) (datastore.DataService, error) {
+	source, ok := src.(*Data)
+	if !ok {
+		return nil, fmt.Errorf("Cannot clone data %q of type %q as googlevoxels data", src.DataName(), src.TypeName())
+	}
+	authkey, found, err := c.GetString("authkey")
+	if err != nil {
+		return nil, err
+	}
+	c.Remove("authkey")
+	if found && authkey == "" {
+		return nil, fmt.Errorf("Cannot clone googlevoxels data %q: setting \"authkey\" is empty", name)
+	}
+	if err := settings.Check(c, true); err != nil {
+		return nil, fmt.Errorf("Cannot clone googlevoxels data %q: %s", name, err.Error())
+	}
+
+	basedata, err := datastore.NewDataService(dtype, uuid, id, name, c)
+	if err != nil {
+		return nil, err
+	}
+	data := &Data{
+		Data:       basedata,
+		Properties: source.cloneProperties(),
+	}
+	data.DiskCache, data.DiskCacheBytes = "", 0
+	data.Mirror = ""
+	if found {
+		data.AuthKey = authkey
+	}
+	if err := data.Properties.setByConfig(c); err != nil {
+		return nil, err
+	}
+	if err := data.initClient(); err != nil {
+		return nil, err
+	}
+	dvid.Infof("Cloned googlevoxels %q of volume %q from %q without contacting Google\n", name, data.VolumeID, src.DataName())
+	data.warnGaps()
+	data.initCache()
+	data.startHealthCheck()
+	data.initStats()
+	return data, nil
+}
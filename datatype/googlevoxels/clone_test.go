@@ -0,0 +1,72 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func TestCloneProperties(t *testing.T) {
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	config := dvid.NewConfig()
+	config.Set("defaultformat", "jpeg:90")
+	d := newFakeData(t, fb, config)
+	defer d.Shutdown()
+	dtype := NewType()
+	dtype.APIURL = fb.URL
+
+	// Cloning copies the scales without contacting Google, and can override the key and
+	// modifiable settings.
+	numRequests := fb.numRequests()
+	config = dvid.NewConfig()
+	config.Set("authkey", "clonekey")
+	config.Set("defaultformat", "png")
+	service, err := dtype.CloneProperties(d, dvid.UUID("f1e2d3"), 2, "grayscale", config)
+	if err != nil {
+		t.Fatalf("Unable to clone googlevoxels instance: %s\n", err.Error())
+	}
+	clone := service.(*Data)
+	defer clone.Shutdown()
+	if n := fb.numRequests(); n != numRequests {
+		t.Errorf("Expected cloning not to contact Google, got %d requests\n", n-numRequests)
+	}
+	if clone.VolumeID != d.VolumeID || clone.AuthKey != "clonekey" || clone.defaultFormat() != "png" || d.defaultFormat() != "jpeg:90" {
+		t.Errorf("Unexpected properties of clone %+v\n", clone.Properties)
+	}
+	if len(clone.TileMap) != len(d.TileMap) || len(clone.Scales) != len(d.Scales) {
+		t.Fatalf("Expected clone to have scales of source, got %v\n", clone.TileMap)
+	}
+	clone.TileMap[TileSpec{5, XY}] = 0
+	if _, found := d.TileMap[TileSpec{5, XY}]; found {
+		t.Errorf("Expected clone not to share the tile map of source\n")
+	}
+	delete(clone.TileMap, TileSpec{5, XY})
+
+	// The clone serves tiles identical to the source's.
+	for _, endpoint := range []string{"tile/xy/0/0_0_20/png", "tile/xz/1/1_100_0/png?tilesize=256", "raw/xy/64_32/10_20_30/png"} {
+		expected := serveFake(d, endpoint)
+		if expected.Code != http.StatusOK {
+			t.Fatalf("Bad response of source to %s: %d %s\n", endpoint, expected.Code, expected.Body.String())
+		}
+		fb.setKey("clonekey")
+		got := serveFake(clone, endpoint)
+		fb.setKey(fakeKey)
+		if got.Code != http.StatusOK {
+			t.Fatalf("Bad response of clone to %s: %d %s\n", endpoint, got.Code, got.Body.String())
+		}
+		if !bytes.Equal(got.Body.Bytes(), expected.Body.Bytes()) {
+			t.Errorf("Expected clone to serve %s like its source\n", endpoint)
+		}
+	}
+
+	// Settings that can't be modified after creation can't be overridden.
+	config = dvid.NewConfig()
+	config.Set("volumeid", "123456:other")
+	if _, err := dtype.CloneProperties(d, dvid.UUID("f1e2d3"), 3, "other", config); err == nil || !strings.Contains(err.Error(), "volumeid") {
+		t.Errorf("Expected error overriding volumeid of clone, got %v\n", err)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+	This file supports server-wide defaults for googlevoxels instances, which can be changed
+	without a restart through /api/server/settings/googlevoxels and persist in the metadata
+	store.  An instance's own settings always take precedence over these defaults.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/server"
+)
+
+const (
+	// MaxDefaultTileSize is the largest server-wide default tile size.
+	MaxDefaultTileSize = 4096
+
+	// MaxRetries is the largest number of times a failed Google request can be retried.
+	MaxRetries = 10
+)
+
+// RetryBackoff is the wait before the first retry of a failed Google request.  Each
+// further retry waits an additional RetryBackoff.
+var RetryBackoff = 250 * time.Millisecond
+
+// ServerDefaults are the server-wide defaults for googlevoxels instances.  DefaultTileSize
+// seeds the tile size of new instances.  All defaults are used by instances lacking the
+// corresponding setting.  DefaultTimeout is a duration like "30s" limiting each request to
+// Google, where "0" is no limit, and DefaultRetries is the number of times a request that
+// fails to connect or returns a 429 or 5xx status is retried.
+type ServerDefaults struct {
+	DefaultTileSize   int32
+	DefaultTileFormat string
+	DefaultTimeout    string
+	DefaultRetries    int
+}
+
+var (
+	defaultsMu     sync.RWMutex
+	serverDefaults = ServerDefaults{
+		DefaultTileSize:   DefaultTileSize,
+		DefaultTileFormat: DefaultTileFormat,
+		DefaultTimeout:    "0s",
+	}
+)
+
+func init() {
+	server.RegisterSettings(TypeName, defaultsHandler{})
+}
+
+// Defaults returns the current server-wide defaults for googlevoxels instances.
+func Defaults() ServerDefaults {
+	defaultsMu.RLock()
+	defer defaultsMu.RUnlock()
+	return serverDefaults
+}
+
+// timeout returns the default timeout of Google requests, where 0 is no timeout.
+func (sd ServerDefaults) timeout() time.Duration {
+	timeout, _ := time.ParseDuration(sd.DefaultTimeout)
+	return timeout
+}
+
+// validate checks the defaults and canonicalizes the tile format.
+func (sd *ServerDefaults) validate() error {
+	if sd.DefaultTileSize < 1 || sd.DefaultTileSize > MaxDefaultTileSize {
+		return server.NewError(server.BadRequestError, "DefaultTileSize %d must be between 1 and %d", sd.DefaultTileSize, MaxDefaultTileSize)
+	}
+	format, err := canonicalFormat(sd.DefaultTileFormat)
+	if err != nil {
+		return server.NewError(server.BadRequestError, "Bad DefaultTileFormat %q: %s", sd.DefaultTileFormat, err.Error())
+	}
+	sd.DefaultTileFormat = format
+	timeout, err := time.ParseDuration(sd.DefaultTimeout)
+	if err != nil || timeout < 0 {
+		return server.NewError(server.BadRequestError, "DefaultTimeout %q must be a non-negative duration like \"30s\"", sd.DefaultTimeout)
+	}
+	sd.DefaultTimeout = timeout.String()
+	if sd.DefaultRetries < 0 || sd.DefaultRetries > MaxRetries {
+		return server.NewError(server.BadRequestError, "DefaultRetries %d must be between 0 and %d", sd.DefaultRetries, MaxRetries)
+	}
+	return nil
+}
+
+// defaultsHandler exposes the server-wide defaults through the server settings API.
+type defaultsHandler struct{}
+
+func (defaultsHandler) Settings() ([]byte, error) {
+	return json.Marshal(Defaults())
+}
+
+func (defaultsHandler) SetSettings(jsonBytes []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(jsonBytes, &fields); err != nil {
+		return server.NewError(server.BadRequestError, "Expected JSON object of googlevoxels defaults: %s", err.Error())
+	}
+	accepted := []string{"DefaultTileSize", "DefaultTileFormat", "DefaultTimeout", "DefaultRetries"}
+	for name := range fields {
+		var known bool
+		for _, field := range accepted {
+			if strings.EqualFold(name, field) {
+				known = true
+			}
+		}
+		if !known {
+			return server.NewError(server.BadRequestError, "Unknown googlevoxels default %q; accepted: %s", name, strings.Join(accepted, ", "))
+		}
+	}
+
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+	updated := serverDefaults
+	if err := json.Unmarshal(jsonBytes, &updated); err != nil {
+		return server.NewError(server.BadRequestError, "Bad googlevoxels defaults: %s", err.Error())
+	}
+	if err := updated.validate(); err != nil {
+		return err
+	}
+	serverDefaults = updated
+	return nil
+}
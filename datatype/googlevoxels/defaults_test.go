@@ -0,0 +1,174 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+// sequenceTransport returns the given statuses in order and then 200 responses.
+type sequenceTransport struct {
+	count    int64
+	statuses []int
+}
+
+func (st *sequenceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	n := atomic.AddInt64(&st.count, 1)
+	status := http.StatusOK
+	if int(n) <= len(st.statuses) {
+		status = st.statuses[n-1]
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("png tile data")),
+		Request:    r,
+	}, nil
+}
+
+func TestServerDefaults(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+	server.SetAdminToken("secret")
+	defer server.SetAdminToken("")
+	orig := Defaults()
+	defer func() {
+		defaultsMu.Lock()
+		serverDefaults = orig
+		defaultsMu.Unlock()
+	}()
+
+	apiStr := server.WebAPIPath + "server/settings/googlevoxels"
+	post := func(body, token string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", apiStr, bytes.NewBufferString(body))
+		if token != "" {
+			r.Header.Set(server.AdminTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		server.ServeSingleHTTP(w, r)
+		return w
+	}
+
+	// Changes need the admin token and valid values.
+	if w := post(`{"DefaultRetries": 2}`, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without admin token, got %d\n", w.Code)
+	}
+	for _, body := range []string{
+		`{"DefaultTileSize": 0}`,
+		`{"DefaultTileSize": 5000}`,
+		`{"DefaultTileFormat": "gif"}`,
+		`{"DefaultTimeout": "-1s"}`,
+		`{"DefaultRetries": 11}`,
+		`{"DefaultTileSize": 256, "TileSize": 256}`,
+		`[512]`,
+	} {
+		if w := post(body, "secret"); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for defaults %s, got %d %s\n", body, w.Code, w.Body.String())
+		}
+	}
+	if Defaults() != orig {
+		t.Fatalf("Expected rejected defaults to leave defaults unchanged, got %+v\n", Defaults())
+	}
+
+	// Only given defaults are changed, and GET returns them.
+	w := post(`{"defaulttileformat": "jpeg:80", "DefaultTimeout": "1m30s", "DefaultRetries": 2}`, "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad response to defaults change: %d %s\n", w.Code, w.Body.String())
+	}
+	expected := ServerDefaults{DefaultTileSize: 512, DefaultTileFormat: "jpeg:80", DefaultTimeout: "1m30s", DefaultRetries: 2}
+	var got ServerDefaults
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got != expected || Defaults() != expected {
+		t.Errorf("Expected defaults %+v, got %s\n", expected, w.Body.String())
+	}
+	if body := server.TestHTTP(t, "GET", apiStr, nil); !bytes.Equal(body, w.Body.Bytes()) {
+		t.Errorf("Expected GET of defaults %s, got %s\n", w.Body.String(), string(body))
+	}
+	r, _ := http.NewRequest("GET", server.WebAPIPath+"server/settings/unknown", nil)
+	w = httptest.NewRecorder()
+	server.ServeSingleHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown server settings, got %d\n", w.Code)
+	}
+
+	// Defaults are persisted and restored on startup.
+	if value, err := datastore.GetServerSettings(TypeName); err != nil || value == nil {
+		t.Fatalf("Expected persisted defaults, got %q, %v\n", string(value), err)
+	}
+	defaultsMu.Lock()
+	serverDefaults = orig
+	defaultsMu.Unlock()
+	if err := server.LoadSettings(); err != nil {
+		t.Fatalf("Unable to load server settings: %s\n", err.Error())
+	}
+	if Defaults() != expected {
+		t.Errorf("Expected restored defaults %+v, got %+v\n", expected, Defaults())
+	}
+
+	// Instances use the defaults unless they have their own settings.
+	d := newTestData(t)
+	d.TileSize = 0
+	if d.tileSize() != 512 || d.defaultFormat() != "jpeg:80" || d.timeout() != 90*time.Second || d.retries() != 2 {
+		t.Errorf("Expected instance to use defaults, got %d, %q, %s, %d\n", d.tileSize(), d.defaultFormat(), d.timeout(), d.retries())
+	}
+	config := dvid.NewConfig()
+	config.Set("defaultformat", "png")
+	config.Set("timeout", "0s")
+	config.Set("retries", "0")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to modify settings: %s\n", err.Error())
+	}
+	if d.defaultFormat() != "png" || d.timeout() != 0 || d.retries() != 0 {
+		t.Errorf("Expected instance settings to win, got %q, %s, %d\n", d.defaultFormat(), d.timeout(), d.retries())
+	}
+	config = dvid.NewConfig()
+	config.Set("retries", "11")
+	if err := d.ModifyConfig(config); err == nil {
+		t.Errorf("Expected error for too many retries\n")
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	defer func(backoff time.Duration) {
+		RetryBackoff = backoff
+	}(RetryBackoff)
+	RetryBackoff = 0
+
+	const tileURL = "/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20/png"
+	retries := 2
+	d := newTestData(t)
+	d.Retries = &retries
+
+	// Failures are retried up to the instance's retries.
+	transport := &sequenceTransport{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	restore := useTransport(transport)
+	if w := getTile(d, tileURL); w.Code != http.StatusOK || transport.count != 3 {
+		t.Errorf("Expected tile after 2 retries, got %d after %d requests\n", w.Code, transport.count)
+	}
+	restore()
+
+	transport = &sequenceTransport{statuses: []int{500, 502, 503, 504}}
+	restore = useTransport(transport)
+	if w := getTile(d, tileURL); w.Code != http.StatusBadGateway || transport.count != 3 {
+		t.Errorf("Expected 502 after 2 retries, got %d after %d requests\n", w.Code, transport.count)
+	}
+	restore()
+
+	// Client errors aren't retried.
+	transport = &sequenceTransport{statuses: []int{http.StatusNotFound}}
+	restore = useTransport(transport)
+	if w := getTile(d, tileURL); w.Code != http.StatusBadGateway || transport.count != 1 {
+		t.Errorf("Expected 502 without retry, got %d after %d requests\n", w.Code, transport.count)
+	}
+	restore()
+}
@@ -0,0 +1,448 @@
+/*
+	This file supports an optional disk tier of the tile cache for working sets larger than
+	memory.  Each tile is a file named by the hash of its cache key and holds a checksum, so
+	a partially corrupt cache directory only loses the bad entries.  Eviction approximates
+	least-recently-used order using file modification times, which are updated on hits.
+*/
+
+package googlevoxels
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// DefaultDiskCacheBytes is the size of a disk cache whose setting doesn't give "maxbytes".
+const DefaultDiskCacheBytes = 10 * dvid.Giga
+
+// diskCacheMagic starts every disk cache file.
+var diskCacheMagic = []byte("DVIDTC1\n")
+
+// diskHeaderSize is the size of the fixed part of a disk cache file: the magic bytes, a
+// CRC32 of the rest of the file, and the lengths of the payload, key, and tags.
+const diskHeaderSize = 8 + 4 + 8 + 2 + 2
+
+// tempPrefix starts the names of files being written, which are removed on startup.
+const tempPrefix = ".tmp-"
+
+// parseDiskCache parses a "diskcache" setting of the form "<path>[,maxbytes=<size>]".  Since
+// command-line settings can't have a second "=", "maxbytes:<size>" is also accepted.
+func parseDiskCache(value string) (dir string, maxBytes uint64, err error) {
+	parts := strings.Split(value, ",")
+	dir = strings.TrimSpace(parts[0])
+	if dir == "" {
+		return "", 0, fmt.Errorf("disk cache requires a directory")
+	}
+	maxBytes = DefaultDiskCacheBytes
+	for _, option := range parts[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			kv = strings.SplitN(option, ":", 2)
+		}
+		if len(kv) != 2 || strings.ToLower(strings.TrimSpace(kv[0])) != "maxbytes" {
+			return "", 0, fmt.Errorf("unknown disk cache option %q", option)
+		}
+		if maxBytes, err = parseByteSize(kv[1]); err != nil {
+			return "", 0, err
+		}
+	}
+	return dir, maxBytes, nil
+}
+
+// parseByteSize parses a number of bytes with an optional K, M, G, or T suffix for binary
+// multiples, e.g., "200G".
+func parseByteSize(value string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(s, "B")
+	multiplier := uint64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			multiplier = dvid.Kilo
+		case 'M':
+			multiplier = dvid.Mega
+		case 'G':
+			multiplier = dvid.Giga
+		case 'T':
+			multiplier = dvid.Tera
+		}
+		if multiplier != 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad size %q", value)
+	}
+	return uint64(n * float64(multiplier)), nil
+}
+
+// DiskCacheStats describes the usage of a disk cache.
+type DiskCacheStats struct {
+	Dir       string
+	Entries   int
+	Bytes     uint64
+	MaxBytes  uint64
+	Hits      uint64
+	Misses    uint64
+	HitRate   float64
+	Evictions uint64
+	Corrupt   uint64 // entries dropped because they failed verification
+}
+
+type diskEntry struct {
+	key     string
+	path    string
+	size    uint64
+	tags    dvid.CacheTags
+	touched time.Time
+}
+
+// diskCache is a size-bounded cache of tiles stored as files.  It is safe for concurrent
+// use.  Only the index is guarded by the lock; files are read and written outside it.
+type diskCache struct {
+	dir       string
+	maxBytes  uint64
+	mu        sync.Mutex
+	curBytes  uint64
+	lru       *list.List // front is most recently used
+	entries   map[string]*list.Element
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	corrupt   uint64
+}
+
+// newDiskCache opens the cache directory, creating it if necessary, and indexes the
+// entries already in it.  Entries that are truncated or otherwise malformed are removed.
+func newDiskCache(dir string, maxBytes uint64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create disk cache directory: %s", err.Error())
+	}
+	c := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	var found []*diskEntry
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), tempPrefix) {
+			os.Remove(path)
+			return nil
+		}
+		entry, err := readDiskHeader(path, info)
+		if err == nil && path != c.diskPath(entry.key) {
+			err = fmt.Errorf("misplaced entry")
+		}
+		if err != nil {
+			dvid.Errorf("Removing bad disk cache file %q: %s\n", path, err.Error())
+			os.Remove(path)
+			c.corrupt++
+			return nil
+		}
+		found = append(found, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read disk cache directory: %s", err.Error())
+	}
+	sort.Sort(byTouched(found))
+	for _, entry := range found {
+		c.entries[entry.key] = c.lru.PushFront(entry)
+		c.curBytes += entry.size
+	}
+	c.removeFiles(c.evict(0))
+	dvid.Infof("Disk cache %q has %d tiles totaling %d bytes\n", dir, c.lru.Len(), c.curBytes)
+	return c, nil
+}
+
+type byTouched []*diskEntry
+
+func (e byTouched) Len() int           { return len(e) }
+func (e byTouched) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byTouched) Less(i, j int) bool { return e[i].touched.Before(e[j].touched) }
+
+// diskPath returns the file for a key, spread across subdirectories by hash prefix.
+func (c *diskCache) diskPath(key string) string {
+	sum := sha1.Sum([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// readDiskHeader returns the entry described by the header of a cache file, checking that
+// the file has the expected length.  The checksum is verified when the entry is read.
+func readDiskHeader(path string, info os.FileInfo) (*diskEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, diskHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, fmt.Errorf("short header")
+	}
+	if !bytes.Equal(header[:8], diskCacheMagic) {
+		return nil, fmt.Errorf("not a cached tile")
+	}
+	payloadLen := binary.LittleEndian.Uint64(header[12:20])
+	keyLen := int(binary.LittleEndian.Uint16(header[20:22]))
+	tagsLen := int(binary.LittleEndian.Uint16(header[22:24]))
+	size := uint64(diskHeaderSize+keyLen+tagsLen) + payloadLen
+	if uint64(info.Size()) != size {
+		return nil, fmt.Errorf("expected %d bytes, found %d", size, info.Size())
+	}
+	meta := make([]byte, keyLen+tagsLen)
+	if _, err := io.ReadFull(f, meta); err != nil {
+		return nil, err
+	}
+	tags, err := decodeCacheTags(string(meta[keyLen:]))
+	if err != nil {
+		return nil, err
+	}
+	return &diskEntry{
+		key:     string(meta[:keyLen]),
+		path:    path,
+		size:    size,
+		tags:    tags,
+		touched: info.ModTime(),
+	}, nil
+}
+
+func encodeCacheTags(tags dvid.CacheTags) string {
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+func decodeCacheTags(s string) (dvid.CacheTags, error) {
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(dvid.CacheTags, len(values))
+	for k := range values {
+		tags[k] = values.Get(k)
+	}
+	return tags, nil
+}
+
+// encodeDiskEntry returns the contents of a cache file.
+func encodeDiskEntry(key string, value []byte, tags dvid.CacheTags) []byte {
+	tagStr := encodeCacheTags(tags)
+	buf := make([]byte, diskHeaderSize, diskHeaderSize+len(key)+len(tagStr)+len(value))
+	copy(buf, diskCacheMagic)
+	binary.LittleEndian.PutUint64(buf[12:20], uint64(len(value)))
+	binary.LittleEndian.PutUint16(buf[20:22], uint16(len(key)))
+	binary.LittleEndian.PutUint16(buf[22:24], uint16(len(tagStr)))
+	buf = append(buf, key...)
+	buf = append(buf, tagStr...)
+	buf = append(buf, value...)
+	binary.LittleEndian.PutUint32(buf[8:12], crc32.ChecksumIEEE(buf[12:]))
+	return buf
+}
+
+// decodeDiskEntry verifies the contents of a cache file for the key and returns its value.
+func decodeDiskEntry(key string, data []byte) ([]byte, error) {
+	if len(data) < diskHeaderSize || !bytes.Equal(data[:8], diskCacheMagic) {
+		return nil, fmt.Errorf("not a cached tile")
+	}
+	if crc32.ChecksumIEEE(data[12:]) != binary.LittleEndian.Uint32(data[8:12]) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	payloadLen := binary.LittleEndian.Uint64(data[12:20])
+	keyLen := int(binary.LittleEndian.Uint16(data[20:22]))
+	tagsLen := int(binary.LittleEndian.Uint16(data[22:24]))
+	start := diskHeaderSize + keyLen + tagsLen
+	if uint64(len(data)) != uint64(start)+payloadLen {
+		return nil, fmt.Errorf("expected %d bytes, found %d", uint64(start)+payloadLen, len(data))
+	}
+	if string(data[diskHeaderSize:diskHeaderSize+keyLen]) != key {
+		return nil, fmt.Errorf("entry is for another key")
+	}
+	return data[start:], nil
+}
+
+// Get returns the cached value for the key.  Entries that fail verification are removed.
+func (c *diskCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	elem, found := c.entries[key]
+	if !found {
+		c.misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+	entry := elem.Value.(*diskEntry)
+	path := entry.path
+	c.mu.Unlock()
+
+	data, err := ioutil.ReadFile(path)
+	var value []byte
+	if err == nil {
+		value, err = decodeDiskEntry(key, data)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.misses++
+		if !os.IsNotExist(err) {
+			dvid.Errorf("Removing bad disk cache file %q: %s\n", path, err.Error())
+			c.corrupt++
+			os.Remove(path)
+		}
+		if elem, found := c.entries[key]; found && elem.Value.(*diskEntry) == entry {
+			c.remove(elem)
+		}
+		return nil, false
+	}
+	c.hits++
+	if elem, found := c.entries[key]; found {
+		c.lru.MoveToFront(elem)
+		now := time.Now()
+		elem.Value.(*diskEntry).touched = now
+		os.Chtimes(path, now, now)
+	}
+	return value, true
+}
+
+// Set writes the value for the key, evicting least recently used entries if necessary.
+// Values larger than the cache are not stored.
+func (c *diskCache) Set(key string, value []byte, tags dvid.CacheTags) error {
+	data := encodeDiskEntry(key, value, tags)
+	size := uint64(len(data))
+	if size > c.maxBytes || len(key) > 0xFFFF {
+		return nil
+	}
+	path := c.diskPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	if elem, found := c.entries[key]; found {
+		c.remove(elem)
+	}
+	evicted := c.evict(size)
+	entry := &diskEntry{key: key, path: path, size: size, tags: tags, touched: time.Now()}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.curBytes += size
+	c.mu.Unlock()
+	c.removeFiles(evicted)
+	return nil
+}
+
+// remove deletes an element from the index.  The caller must hold the lock.
+func (c *diskCache) remove(elem *list.Element) *diskEntry {
+	entry := c.lru.Remove(elem).(*diskEntry)
+	delete(c.entries, entry.key)
+	c.curBytes -= entry.size
+	return entry
+}
+
+// evict removes least recently used entries from the index until the given number of
+// bytes fits, returning the files to be removed.  The caller must hold the lock.
+func (c *diskCache) evict(size uint64) []string {
+	var paths []string
+	for c.curBytes+size > c.maxBytes && c.lru.Len() != 0 {
+		paths = append(paths, c.remove(c.lru.Back()).path)
+		c.evictions++
+	}
+	return paths
+}
+
+func (c *diskCache) removeFiles(paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			dvid.Errorf("Unable to remove disk cache file %q: %s\n", path, err.Error())
+		}
+	}
+}
+
+// Delete evicts the entry for the key, returning false if there was none.
+func (c *diskCache) Delete(key string) bool {
+	c.mu.Lock()
+	elem, found := c.entries[key]
+	if found {
+		c.remove(elem)
+	}
+	c.mu.Unlock()
+	if found {
+		c.removeFiles([]string{c.diskPath(key)})
+	}
+	return found
+}
+
+// Clear evicts all entries whose tags match the filter and returns the number evicted.
+func (c *diskCache) Clear(filter dvid.CacheTags) int {
+	c.mu.Lock()
+	var paths []string
+	var next *list.Element
+	for elem := c.lru.Front(); elem != nil; elem = next {
+		next = elem.Next()
+		entry := elem.Value.(*diskEntry)
+		if entry.tags.Matches(filter) {
+			paths = append(paths, c.remove(elem).path)
+		}
+	}
+	c.mu.Unlock()
+	c.removeFiles(paths)
+	return len(paths)
+}
+
+// Stats returns the current disk cache statistics.
+func (c *diskCache) Stats() *DiskCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := &DiskCacheStats{
+		Dir:       c.dir,
+		Entries:   c.lru.Len(),
+		Bytes:     c.curBytes,
+		MaxBytes:  c.maxBytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Corrupt:   c.corrupt,
+	}
+	if c.hits+c.misses != 0 {
+		stats.HitRate = float64(c.hits) / float64(c.hits+c.misses)
+	}
+	return stats
+}
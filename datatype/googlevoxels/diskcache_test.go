@@ -0,0 +1,163 @@
+package googlevoxels
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func TestParseDiskCache(t *testing.T) {
+	tests := []struct {
+		value    string
+		dir      string
+		maxBytes uint64
+	}{
+		{"/data/tiles", "/data/tiles", DefaultDiskCacheBytes},
+		{"/data/tiles,maxbytes=200G", "/data/tiles", 200 * dvid.Giga},
+		{"/data/tiles,maxbytes:1.5K", "/data/tiles", 1536},
+		{"/data/tiles, MaxBytes=3TB", "/data/tiles", 3 * dvid.Tera},
+		{"/data/tiles,maxbytes=4096", "/data/tiles", 4096},
+	}
+	for _, test := range tests {
+		dir, maxBytes, err := parseDiskCache(test.value)
+		if err != nil || dir != test.dir || maxBytes != test.maxBytes {
+			t.Errorf("Expected %q to give %q and %d bytes, got %q, %d, %v\n", test.value, test.dir, test.maxBytes, dir, maxBytes, err)
+		}
+	}
+	for _, value := range []string{"", ",maxbytes=1G", "/data/tiles,size=1G", "/data/tiles,maxbytes=lots", "/data/tiles,maxbytes=-1G"} {
+		if _, _, err := parseDiskCache(value); err == nil {
+			t.Errorf("Expected error for disk cache setting %q\n", value)
+		}
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "googlevoxels-diskcache")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	transport := &countingTransport{body: []byte("png tile data")}
+	defer useTransport(transport)()
+	newData := func() *Data {
+		d := newTestData(t)
+		d.TileCacheMB = 1
+		d.DiskCache = dir
+		d.DiskCacheBytes = dvid.Mega
+		d.initCache()
+		if d.disk == nil {
+			t.Fatalf("Expected disk cache to be opened\n")
+		}
+		return d
+	}
+	const tile1 = "/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20/png"
+	const tile2 = "/api/node/a9b8c7/grayscale/tile/xy/0/0_0_21/png"
+	const tile3 = "/api/node/a9b8c7/grayscale/tile/xy/0/0_0_22/png"
+	fetch := func(d *Data, url string, expectedCount int64) {
+		if w := getTile(d, url); w.Code != http.StatusOK {
+			t.Fatalf("Bad tile response for %s: %d %s\n", url, w.Code, w.Body.String())
+		}
+		if count := atomic.LoadInt64(&transport.count); count != expectedCount {
+			t.Errorf("Expected %d upstream requests after %s, got %d\n", expectedCount, url, count)
+		}
+	}
+
+	// Tiles evicted from memory are served from disk.
+	d := newData()
+	fetch(d, tile1, 1)
+	d.cache.Clear(nil)
+	fetch(d, tile1, 1)
+	if stats := d.DiskCacheStats(); stats.Entries != 1 || stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Unexpected disk cache stats: %+v\n", stats)
+	}
+
+	// On restart, the disk cache is reloaded and bad files are dropped.
+	d.Shutdown()
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 file in disk cache, got %v\n", files)
+	}
+	tileFile := files[0]
+	if err := ioutil.WriteFile(filepath.Join(dir, "garbage"), []byte("not a tile"), 0644); err != nil {
+		t.Fatalf("Unable to write garbage file: %s\n", err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, tempPrefix+"123"), []byte("partial"), 0644); err != nil {
+		t.Fatalf("Unable to write temp file: %s\n", err.Error())
+	}
+	d = newData()
+	if stats := d.DiskCacheStats(); stats.Entries != 1 || stats.Corrupt != 1 {
+		t.Errorf("Expected 1 entry and 1 corrupt file after restart, got %+v\n", stats)
+	}
+	for _, name := range []string{"garbage", tempPrefix + "123"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed on restart\n", name)
+		}
+	}
+	fetch(d, tile1, 1)
+
+	// An entry failing its checksum is dropped and fetched again.
+	d.cache.Clear(nil)
+	data, err := ioutil.ReadFile(tileFile)
+	if err != nil {
+		t.Fatalf("Unable to read cached tile: %s\n", err.Error())
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := ioutil.WriteFile(tileFile, data, 0644); err != nil {
+		t.Fatalf("Unable to corrupt cached tile: %s\n", err.Error())
+	}
+	fetch(d, tile1, 2)
+	if stats := d.DiskCacheStats(); stats.Entries != 1 || stats.Corrupt != 2 {
+		t.Errorf("Expected corrupt entry to be replaced, got %+v\n", stats)
+	}
+
+	// The least recently used tile is evicted once the disk cache is full.
+	d.cache = nil
+	fetch(d, tile2, 3)
+	d.disk.maxBytes = d.disk.Stats().Bytes + 10
+	fetch(d, tile1, 3)
+	fetch(d, tile3, 4)
+	if stats := d.DiskCacheStats(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("Expected 2 entries and 1 eviction, got %+v\n", stats)
+	}
+	fetch(d, tile1, 4)
+	fetch(d, tile2, 5)
+
+	// Disk cache stats are in /info, and DELETE clears both tiers.
+	d.TileCacheMB = 1
+	d.initCache()
+	fetch(d, tile2, 5)
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/info", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	var info struct {
+		Stats Stats
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Bad info response %s: %s\n", w.Body.String(), err.Error())
+	}
+	if info.Stats.DiskCache == nil || info.Stats.DiskCache.Entries != 2 || info.Stats.DiskCache.Evictions != 2 {
+		t.Errorf("Expected disk cache stats in info, got %s\n", w.Body.String())
+	}
+	r, _ = http.NewRequest("DELETE", "/api/node/a9b8c7/grayscale/cache", nil)
+	w = httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	var evicted struct {
+		Evicted     int
+		DiskEvicted int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &evicted); err != nil || evicted.Evicted != 1 || evicted.DiskEvicted != 2 {
+		t.Errorf("Expected 1 tile evicted from memory and 2 from disk, got %s\n", w.Body.String())
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*", "*")); len(files) != 0 {
+		t.Errorf("Expected no files in cleared disk cache, got %v\n", files)
+	}
+	fetch(d, tile1, 6)
+}
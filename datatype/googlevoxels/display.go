@@ -0,0 +1,264 @@
+/*
+	This file supports display adjustments of image responses, e.g., windowing, gamma, and
+	inversion, which convert raw voxel values of any channel type into 8-bit pixels, and
+	colormaps, which convert labels into RGB pixels.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datatype/common/labels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+var displayQueryParams = server.QueryParams{
+	{Name: "window", Help: "Linearly rescale values in \"min,max\" to 0-255, or \"auto\" to use the min and max\nof the fetched image.  Required for 8-bit formats of float and uint64 data."},
+	{Name: "gamma", Help: "After windowing, raise values in [0,1] to the power 1/G, so G > 1 brightens midtones."},
+	{Name: "invert", Help: "If true, invert the windowed values so the window min is white."},
+	{Name: "colormap", Help: "If \"hash\", return uint64 labels as an RGB png with a stable color for each label."},
+}
+
+// displayAdjust describes how raw voxel values are converted into 8-bit pixels.
+type displayAdjust struct {
+	auto     bool // compute the window from the data
+	min, max float64
+	gamma    float64
+	invert   bool
+	colormap string // if non-empty, labels are colored instead of windowed
+}
+
+// getDisplayAdjust returns the display adjustment requested in the query string or nil
+// if no adjustment was requested.
+func getDisplayAdjust(query *server.Query) (*displayAdjust, error) {
+	if !query.Has("window") && !query.Has("gamma") && !query.Has("invert") && !query.Has("colormap") {
+		return nil, nil
+	}
+	da := &displayAdjust{gamma: 1, min: math.NaN(), max: math.NaN()}
+	if query.Has("colormap") {
+		da.colormap = query.GetString("colormap", "")
+		if da.colormap != "hash" {
+			return nil, fmt.Errorf("colormap must be \"hash\", not %q", da.colormap)
+		}
+		if query.Has("window") || query.Has("gamma") || query.Has("invert") {
+			return nil, fmt.Errorf("colormap cannot be combined with window, gamma, or invert")
+		}
+		return da, nil
+	}
+	if query.Has("window") {
+		windowStr := query.GetString("window", "")
+		if windowStr == "auto" {
+			da.auto = true
+		} else {
+			bounds := strings.Split(windowStr, ",")
+			if len(bounds) != 2 {
+				return nil, fmt.Errorf("window must be \"min,max\" or \"auto\", not %q", windowStr)
+			}
+			var err error
+			if da.min, err = strconv.ParseFloat(bounds[0], 64); err != nil {
+				return nil, fmt.Errorf("Bad window minimum %q: %s", bounds[0], err.Error())
+			}
+			if da.max, err = strconv.ParseFloat(bounds[1], 64); err != nil {
+				return nil, fmt.Errorf("Bad window maximum %q: %s", bounds[1], err.Error())
+			}
+			if da.max <= da.min {
+				return nil, fmt.Errorf("window maximum (%g) must be greater than minimum (%g)", da.max, da.min)
+			}
+		}
+	}
+	if query.Has("gamma") {
+		gammaStr := query.GetString("gamma", "")
+		gamma, err := strconv.ParseFloat(gammaStr, 64)
+		if err != nil || gamma <= 0 {
+			return nil, fmt.Errorf("gamma must be a positive number, not %q", gammaStr)
+		}
+		da.gamma = gamma
+	}
+	invert, err := query.GetBool("invert", false)
+	if err != nil {
+		return nil, err
+	}
+	da.invert = invert
+	return da, nil
+}
+
+// voxelValues returns the values of little-endian voxel data as floats.
+func voxelValues(data []byte, channelType string) ([]float64, error) {
+	bytesPerVoxel, err := dvid.ChannelBytes(channelType)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]float64, len(data)/bytesPerVoxel)
+	for i := range values {
+		b := data[i*bytesPerVoxel:]
+		switch channelType {
+		case dvid.ChannelUint8:
+			values[i] = float64(b[0])
+		case dvid.ChannelUint16:
+			values[i] = float64(binary.LittleEndian.Uint16(b))
+		case dvid.ChannelUint64:
+			values[i] = float64(binary.LittleEndian.Uint64(b))
+		case dvid.ChannelFloat32:
+			values[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		}
+	}
+	return values, nil
+}
+
+// window returns the window to apply to the given values.
+func (da *displayAdjust) window(values []float64, channelType string) (min, max float64, err error) {
+	switch {
+	case da.auto:
+		min, max = math.Inf(1), math.Inf(-1)
+		for _, v := range values {
+			if math.IsNaN(v) {
+				continue
+			}
+			min = math.Min(min, v)
+			max = math.Max(max, v)
+		}
+		if math.IsInf(min, 1) {
+			min, max = 0, 0
+		}
+		if max <= min {
+			max = min + 1
+		}
+		return min, max, nil
+	case !math.IsNaN(da.min):
+		return da.min, da.max, nil
+	case channelType == dvid.ChannelUint8:
+		return 0, math.MaxUint8, nil
+	case channelType == dvid.ChannelUint16:
+		return 0, math.MaxUint16, nil
+	default:
+		return 0, 0, fmt.Errorf("Display adjustment of %s data requires \"window=min,max\" or \"window=auto\"", channelType)
+	}
+}
+
+// apply converts voxel data into 8-bit pixels, returning the pixels and the window used.
+func (da *displayAdjust) apply(data []byte, channelType string) (pixels []byte, min, max float64, err error) {
+	values, err := voxelValues(data, channelType)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if min, max, err = da.window(values, channelType); err != nil {
+		return nil, 0, 0, err
+	}
+	pixels = make([]byte, len(values))
+	for i, v := range values {
+		scaled := (v - min) / (max - min)
+		switch {
+		case math.IsNaN(scaled) || scaled < 0:
+			scaled = 0
+		case scaled > 1:
+			scaled = 1
+		}
+		if da.gamma != 1 {
+			scaled = math.Pow(scaled, 1/da.gamma)
+		}
+		if da.invert {
+			scaled = 1 - scaled
+		}
+		pixels[i] = uint8(scaled*math.MaxUint8 + 0.5)
+	}
+	return pixels, min, max, nil
+}
+
+// hashColor returns the stable color of a label shared with other label data types, with
+// black for the background label 0.
+func hashColor(label uint64) (r, g, b uint8) {
+	c := labels.HashColor(label)
+	return c.R, c.G, c.B
+}
+
+// colorLabels returns an RGB image of little-endian uint64 labels using hashColor.
+func colorLabels(data []byte, nx, ny int) (*image.NRGBA, error) {
+	if len(data) != nx*ny*8 {
+		return nil, fmt.Errorf("Expected %d bytes for %d x %d uint64 image, got %d bytes", nx*ny*8, nx, ny, len(data))
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, nx, ny))
+	for i := 0; i < nx*ny; i++ {
+		r, g, b := hashColor(binary.LittleEndian.Uint64(data[i*8:]))
+		img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = r, g, b, 255
+	}
+	return img, nil
+}
+
+// checkFormat returns an error if voxels of the given channel type can't be returned in
+// the format with this display adjustment.  Float and uint64 data are only returned in
+// 8-bit formats if they are windowed or colored, and uint64 labels are never returned
+// as jpeg.
+func (da *displayAdjust) checkFormat(channelType, formatStr string) error {
+	if formatStr == RawFormat {
+		if da != nil {
+			return fmt.Errorf("Display options cannot be used with %q format", RawFormat)
+		}
+		return nil
+	}
+	enc, _, err := dvid.GetImageEncoder(formatStr)
+	if err != nil {
+		return err
+	}
+	switch {
+	case channelType == dvid.ChannelUint64 && enc.ContentType() == "image/jpeg":
+		return fmt.Errorf("Cannot return uint64 labels in lossy format %q: use %q, or \"png\" with \"colormap=hash\"", formatStr, RawFormat)
+	case da != nil && da.colormap != "":
+		if channelType != dvid.ChannelUint64 {
+			return fmt.Errorf("colormap requires uint64 data, not %s", channelType)
+		}
+		if enc.ContentType() != "image/png" {
+			return fmt.Errorf("colormap requires png format, not %q", formatStr)
+		}
+	case da != nil:
+		if !enc.CanEncode(dvid.ChannelUint8) {
+			return fmt.Errorf("Cannot return display-adjusted data in requested format %q", formatStr)
+		}
+	case channelType == dvid.ChannelFloat32 || channelType == dvid.ChannelUint64:
+		if enc.ContentType() != "image/tiff" {
+			return fmt.Errorf("Cannot return %s data in requested format %q: use %q or \"tiff\" format, or add \"window=min,max\", \"window=auto\", or \"colormap=hash\" (uint64) to the query string", channelType, formatStr, RawFormat)
+		}
+	case !enc.CanEncode(channelType):
+		return fmt.Errorf("Cannot return %s data in requested format %q", channelType, formatStr)
+	}
+	return nil
+}
+
+// encodeImage writes voxel data as an image in the given format, applying any display
+// adjustment.  The applied window is returned in the X-Display-Window header.  Data in
+// RawFormat is written as little-endian voxel values.
+func (da *displayAdjust) encodeImage(w http.ResponseWriter, data []byte, nx, ny int, channelType, formatStr string) error {
+	if formatStr == RawFormat {
+		w.Header().Set("Content-type", "application/octet-stream")
+		_, err := w.Write(data)
+		return err
+	}
+	if da == nil {
+		return dvid.EncodeImageHttp(w, data, nx, ny, channelType, formatStr)
+	}
+	if da.colormap != "" {
+		img, err := colorLabels(data, nx, ny)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-type", "image/png")
+		w.Header().Set("X-Display-Colormap", da.colormap)
+		return png.Encode(w, img)
+	}
+	pixels, min, max, err := da.apply(data, channelType)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("X-Display-Window", fmt.Sprintf("%g,%g", min, max))
+	w.Header().Set("X-Display-Gamma", strconv.FormatFloat(da.gamma, 'g', -1, 64))
+	w.Header().Set("X-Display-Invert", strconv.FormatBool(da.invert))
+	return dvid.EncodeImageHttp(w, pixels, nx, ny, dvid.ChannelUint8, formatStr)
+}
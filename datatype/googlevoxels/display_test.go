@@ -0,0 +1,186 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func float32Data(values ...float32) []byte {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(v))
+	}
+	return data
+}
+
+func TestDisplayAdjust(t *testing.T) {
+	data := float32Data(-1, 0, 0.25, 0.5, 1, 2, float32(math.NaN()))
+	tests := []struct {
+		display  displayAdjust
+		min, max float64
+		expected []byte
+	}{
+		{displayAdjust{gamma: 1, min: 0, max: 1}, 0, 1, []byte{0, 0, 64, 128, 255, 255, 0}},
+		{displayAdjust{gamma: 1, min: 0, max: 1, invert: true}, 0, 1, []byte{255, 255, 191, 128, 0, 0, 255}},
+		{displayAdjust{gamma: 0.5, min: 0, max: 1}, 0, 1, []byte{0, 0, 16, 64, 255, 255, 0}},
+		{displayAdjust{gamma: 1, auto: true}, -1, 2, []byte{0, 85, 106, 128, 170, 255, 0}},
+	}
+	for i, test := range tests {
+		pixels, min, max, err := test.display.apply(data, "float")
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error: %s\n", i, err.Error())
+		}
+		if min != test.min || max != test.max {
+			t.Errorf("Test %d: expected window %g,%g, got %g,%g\n", i, test.min, test.max, min, max)
+		}
+		if !bytes.Equal(pixels, test.expected) {
+			t.Errorf("Test %d: expected pixels %v, got %v\n", i, test.expected, pixels)
+		}
+	}
+
+	// Float data requires a window.
+	display := displayAdjust{gamma: 2, min: math.NaN(), max: math.NaN()}
+	if _, _, _, err := display.apply(data, "float"); err == nil {
+		t.Errorf("Expected error adjusting float data without a window\n")
+	}
+}
+
+func TestFloatTileWindow(t *testing.T) {
+	d := newTestData(t)
+	d.Scales[0].ChannelType = "float"
+	values := make([]float32, 16*16)
+	for i := range values {
+		values[i] = float32(i) / 10
+	}
+	transport := &countingTransport{body: float32Data(values...)}
+	defer useTransport(transport)()
+
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/tile/xy/0/1_1_20/png?tilesize=16", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for png of float tile without window, got %d\n", w.Code)
+	}
+
+	r, _ = http.NewRequest("GET", "/api/node/a9b8c7/grayscale/tile/xy/0/1_1_20/png?tilesize=16&window=auto", nil)
+	w = httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Windowed float tile request returned status %d: %s\n", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Display-Window"); got != "0,25.5" {
+		t.Errorf("Expected window \"0,25.5\", got %q\n", got)
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to decode windowed tile: %s\n", err.Error())
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 16 || bounds.Dy() != 16 {
+		t.Errorf("Expected 16 x 16 tile, got %s\n", bounds)
+	}
+}
+
+func TestChannelTypes(t *testing.T) {
+	tests := []struct {
+		channelType   string
+		bytesPerVoxel string
+		body          []byte
+		contentType   string // of default format
+	}{
+		{"uint8", "1", []byte{0, 1, 2, 3, 4, 5, 6, 7}, "image/png"},
+		{"uint16", "2", []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, "image/png"},
+		{"float", "4", float32Data(0, 0.5, 1, 1.5, 2, 2.5, 3, 3.5), "application/octet-stream"},
+		{"uint64", "8", uint64Data(0, 1, 2, 3, 3, 2, 1, 0), "application/octet-stream"},
+	}
+	for _, test := range tests {
+		d := newTestData(t)
+		d.Scales[0].ChannelType = test.channelType
+		transport := &countingTransport{body: test.body}
+		restore := useTransport(transport)
+
+		r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/raw/xy/4_2/10_10_10", nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s raw request returned status %d: %s\n", test.channelType, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("%s raw request: expected content type %q, got %q\n", test.channelType, test.contentType, got)
+		}
+		if w.Header().Get("X-DVID-Voxel-Type") != test.channelType || w.Header().Get("X-DVID-Bytes-Per-Voxel") != test.bytesPerVoxel {
+			t.Errorf("%s raw request: bad voxel headers %q, %q\n", test.channelType,
+				w.Header().Get("X-DVID-Voxel-Type"), w.Header().Get("X-DVID-Bytes-Per-Voxel"))
+		}
+		if test.contentType == "application/octet-stream" && !bytes.Equal(w.Body.Bytes(), test.body) {
+			t.Errorf("%s raw request: expected voxel bytes %v, got %v\n", test.channelType, test.body, w.Body.Bytes())
+		}
+
+		// Float and uint64 data aren't encoded as 8-bit images without display options.
+		r, _ = http.NewRequest("GET", "/api/node/a9b8c7/grayscale/raw/xy/4_2/10_10_10/png", nil)
+		w = httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		expected := http.StatusOK
+		if test.contentType == "application/octet-stream" {
+			expected = http.StatusBadRequest
+		}
+		if w.Code != expected {
+			t.Errorf("%s png request: expected status %d, got %d\n", test.channelType, expected, w.Code)
+		}
+		restore()
+	}
+}
+
+func uint64Data(values ...uint64) []byte {
+	data := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(data[i*8:], v)
+	}
+	return data
+}
+
+func TestHashColormap(t *testing.T) {
+	d := newTestData(t)
+	d.Scales[0].ChannelType = "uint64"
+	labels := []uint64{0, 1, 2, 3, 3, 2, 1, 0}
+	transport := &countingTransport{body: uint64Data(labels...)}
+	defer useTransport(transport)()
+
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/raw/xy/4_2/10_10_10/png?colormap=hash", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Colormap request returned status %d: %s\n", w.Code, w.Body.String())
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to decode colormap image: %s\n", err.Error())
+	}
+	for i, label := range labels {
+		r, g, b, _ := img.At(i%4, i/4).RGBA()
+		er, eg, eb := hashColor(label)
+		if uint8(r>>8) != er || uint8(g>>8) != eg || uint8(b>>8) != eb {
+			t.Errorf("Label %d: expected color %d,%d,%d, got %d,%d,%d\n", label, er, eg, eb, r>>8, g>>8, b>>8)
+		}
+	}
+	if r, g, b := hashColor(0); r != 0 || g != 0 || b != 0 {
+		t.Errorf("Expected black for label 0, got %d,%d,%d\n", r, g, b)
+	}
+	r1, g1, b1 := hashColor(1)
+	r2, g2, b2 := hashColor(2)
+	if r1 == r2 && g1 == g2 && b1 == b2 {
+		t.Errorf("Expected different colors for labels 1 and 2\n")
+	}
+
+	// Colormaps are only for uint64 data in png format.
+	r, _ = http.NewRequest("GET", "/api/node/a9b8c7/grayscale/raw/xy/4_2/10_10_10/jpeg?colormap=hash", nil)
+	w = httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for jpeg colormap, got %d\n", w.Code)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+	This file supports synthesizing lower-resolution 2d images from higher-resolution data
+	when a scaled volume is unavailable for an orientation.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// MaxFallbackLevels is the most levels a fallback tile is downsampled from an available
+// scale, which limits the region fetched to 2^MaxFallbackLevels times the requested size
+// along each dimension.
+const MaxFallbackLevels = 3
+
+// downsample reduces a 2d image of little-endian voxels by 2 along each dimension for
+// each level.  Intensities are averaged over each 2x2 block of voxels, rounding to the
+// nearest integer for integer types.  For uint64 labels, the most common label of each
+// block is used, with ties going to the first of the tied labels in row-major order.
+// Each dimension must be divisible by 2^levels.
+func downsample(data []byte, nx, ny int32, channelType string, levels Scaling) ([]byte, error) {
+	bytesPerVoxel, err := dvid.ChannelBytes(channelType)
+	if err != nil {
+		return nil, err
+	}
+	if int64(nx)*int64(ny)*int64(bytesPerVoxel) != int64(len(data)) {
+		return nil, fmt.Errorf("Can't downsample %d x %d image of %s from %d bytes", nx, ny, channelType, len(data))
+	}
+	for level := Scaling(0); level < levels; level++ {
+		if nx%2 != 0 || ny%2 != 0 {
+			return nil, fmt.Errorf("Can't downsample %d x %d image by 2", nx, ny)
+		}
+		if data, err = downsample2x(data, nx, ny, channelType, int32(bytesPerVoxel)); err != nil {
+			return nil, err
+		}
+		nx /= 2
+		ny /= 2
+	}
+	return data, nil
+}
+
+// downsample2x reduces a 2d image with even dimensions by 2 along each dimension.
+func downsample2x(data []byte, nx, ny int32, channelType string, bytesPerVoxel int32) ([]byte, error) {
+	outX, outY := nx/2, ny/2
+	out := make([]byte, outX*outY*bytesPerVoxel)
+	rowBytes := nx * bytesPerVoxel
+	for y := int32(0); y < outY; y++ {
+		for x := int32(0); x < outX; x++ {
+			i := 2*y*rowBytes + 2*x*bytesPerVoxel
+			block := [4]int32{i, i + bytesPerVoxel, i + rowBytes, i + rowBytes + bytesPerVoxel}
+			o := (y*outX + x) * bytesPerVoxel
+			switch channelType {
+			case dvid.ChannelUint8:
+				sum := uint32(data[block[0]]) + uint32(data[block[1]]) + uint32(data[block[2]]) + uint32(data[block[3]])
+				out[o] = uint8((sum + 2) / 4)
+			case dvid.ChannelUint16:
+				var sum uint32
+				for _, b := range block {
+					sum += uint32(binary.LittleEndian.Uint16(data[b:]))
+				}
+				binary.LittleEndian.PutUint16(out[o:], uint16((sum+2)/4))
+			case dvid.ChannelFloat32:
+				var sum float64
+				for _, b := range block {
+					sum += float64(math.Float32frombits(binary.LittleEndian.Uint32(data[b:])))
+				}
+				binary.LittleEndian.PutUint32(out[o:], math.Float32bits(float32(sum/4)))
+			case dvid.ChannelUint64:
+				var labels [4]uint64
+				for n, b := range block {
+					labels[n] = binary.LittleEndian.Uint64(data[b:])
+				}
+				var mode uint64
+				var modeCount int
+				for n, label := range labels {
+					var count int
+					for _, other := range labels[n:] {
+						if other == label {
+							count++
+						}
+					}
+					if count > modeCount {
+						mode, modeCount = label, count
+					}
+				}
+				binary.LittleEndian.PutUint64(out[o:], mode)
+			default:
+				return nil, server.NewError(server.BadRequestError, "Can't synthesize downsampled %s data", channelType)
+			}
+		}
+	}
+	return out, nil
+}
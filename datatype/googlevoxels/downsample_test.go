@@ -0,0 +1,144 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func TestDownsample(t *testing.T) {
+	// Intensities are averaged and rounded to the nearest integer.
+	uint8Data := []byte{
+		1, 2, 10, 10,
+		3, 5, 10, 11,
+	}
+	out, err := downsample(uint8Data, 4, 2, dvid.ChannelUint8, 1)
+	if err != nil {
+		t.Fatalf("Unable to downsample uint8 data: %s\n", err.Error())
+	}
+	// (1+2+3+5)/4 = 2.75 -> 3, (10+10+10+11)/4 = 10.25 -> 10
+	if !bytes.Equal(out, []byte{3, 10}) {
+		t.Errorf("Expected uint8 downsample [3 10], got %v\n", out)
+	}
+
+	uint16Data := make([]byte, 8)
+	for i, v := range []uint16{1000, 1001, 60000, 60001} {
+		binary.LittleEndian.PutUint16(uint16Data[i*2:], v)
+	}
+	if out, err = downsample(uint16Data, 2, 2, dvid.ChannelUint16, 1); err != nil {
+		t.Fatalf("Unable to downsample uint16 data: %s\n", err.Error())
+	}
+	// (1000+1001+60000+60001)/4 = 30500.5 -> 30501
+	if v := binary.LittleEndian.Uint16(out); v != 30501 {
+		t.Errorf("Expected uint16 downsample 30501, got %d\n", v)
+	}
+
+	floatData := make([]byte, 16)
+	for i, v := range []float32{0.5, 1.5, -2, 4} {
+		binary.LittleEndian.PutUint32(floatData[i*4:], math.Float32bits(v))
+	}
+	if out, err = downsample(floatData, 2, 2, dvid.ChannelFloat32, 1); err != nil {
+		t.Fatalf("Unable to downsample float data: %s\n", err.Error())
+	}
+	if v := math.Float32frombits(binary.LittleEndian.Uint32(out)); v != 1 {
+		t.Errorf("Expected float downsample 1, got %f\n", v)
+	}
+
+	// 4 x 4 labels downsampled twice: the first level takes the most common label of each
+	// 2 x 2 block, with ties going to the first label in row-major order.
+	labels := []uint64{
+		7, 7, 3, 4,
+		7, 2, 4, 3,
+		5, 6, 9, 9,
+		6, 5, 9, 1,
+	}
+	labelData := make([]byte, len(labels)*8)
+	for i, label := range labels {
+		binary.LittleEndian.PutUint64(labelData[i*8:], label)
+	}
+	if out, err = downsample(labelData, 4, 4, dvid.ChannelUint64, 1); err != nil {
+		t.Fatalf("Unable to downsample labels: %s\n", err.Error())
+	}
+	expected := []uint64{7, 3, 5, 9}
+	for i, label := range expected {
+		if got := binary.LittleEndian.Uint64(out[i*8:]); got != label {
+			t.Errorf("Label %d: expected %d, got %d\n", i, label, got)
+		}
+	}
+	if out, err = downsample(labelData, 4, 4, dvid.ChannelUint64, 2); err != nil {
+		t.Fatalf("Unable to downsample labels twice: %s\n", err.Error())
+	}
+	if got := binary.LittleEndian.Uint64(out); len(out) != 8 || got != 7 {
+		t.Errorf("Expected single label 7 after two levels, got %d from %d bytes\n", got, len(out))
+	}
+
+	if _, err := downsample(uint8Data, 4, 2, dvid.ChannelUint8, 2); err == nil {
+		t.Errorf("Expected error downsampling 2 x 1 image\n")
+	}
+	if _, err := downsample(uint8Data, 4, 4, dvid.ChannelUint8, 1); err == nil {
+		t.Errorf("Expected error downsampling image with wrong number of bytes\n")
+	}
+}
+
+func TestFallbackScale(t *testing.T) {
+	d := newTestData(t)
+	d.TileMap[TileSpec{1, XY}] = 0
+	transport := &cappedTransport{maxVoxels: 1000000}
+	defer useTransport(transport)()
+
+	// Without fallback, the missing XY scale is not found.
+	serve := func(url string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		return w
+	}
+	url := "/api/node/a9b8c7/grayscale/raw/xy/4_4/1_2_30/raw?scale=3"
+	if w := serve(url); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for missing scale without fallback, got %d\n", w.Code)
+	}
+
+	// Scale 3 is synthesized from scale 1 by fetching a 16 x 16 region at (4,8,30) and
+	// averaging 4 x 4 blocks.  Voxels have value x + 3y, so each block averages to
+	// its corner value plus 6.
+	w := serve(url + "&fallback=true")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Fallback request failed with status %d: %s\n", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-DVID-Synthesized-Scale") != "true" || w.Header().Get("X-DVID-Source-Scale") != "1" {
+		t.Errorf("Expected synthesized scale headers with source scale 1, got %v\n", w.Header())
+	}
+	got := w.Body.Bytes()
+	if len(got) != 16 {
+		t.Fatalf("Expected 4 x 4 synthesized image, got %d bytes\n", len(got))
+	}
+	for py := 0; py < 4; py++ {
+		for px := 0; px < 4; px++ {
+			expected := byte(4+4*px) + 3*byte(8+4*py) + 6
+			if got[py*4+px] != expected {
+				t.Errorf("Pixel (%d,%d): expected %d, got %d\n", px, py, expected, got[py*4+px])
+			}
+		}
+	}
+	if transport.count != 1 {
+		t.Errorf("Expected 1 upstream request, got %d\n", transport.count)
+	}
+
+	// The instance setting enables fallback, and scales too far from any available scale
+	// are still not found.
+	d.Fallback = true
+	if w := serve("/api/node/a9b8c7/grayscale/tile/xy/2/0_0_30/raw?tilesize=8"); w.Code != http.StatusOK || w.Body.Len() != 64 {
+		t.Errorf("Expected synthesized tile with fallback setting, got %d with %d bytes\n", w.Code, w.Body.Len())
+	}
+	if w := serve("/api/node/a9b8c7/grayscale/raw/xy/4_4/1_2_30/raw?scale=5"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for scale beyond fallback levels, got %d\n", w.Code)
+	}
+	if w := serve(url + "&fallback=false"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected query string to override fallback setting, got %d\n", w.Code)
+	}
+}
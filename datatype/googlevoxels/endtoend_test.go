@@ -0,0 +1,356 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// serveFake sends a GET request for the given endpoint and query to the instance.
+func serveFake(d *Data, endpoint string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/"+endpoint, nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	return w
+}
+
+// decodeGray decodes a png or jpeg image of the expected size from a response.
+func decodeGray(t *testing.T, w *httptest.ResponseRecorder, nx, ny int) image.Image {
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad response: %d %s\n", w.Code, w.Body.String())
+	}
+	var img image.Image
+	var err error
+	switch w.Header().Get("Content-Type") {
+	case "image/png":
+		img, err = png.Decode(bytes.NewReader(w.Body.Bytes()))
+	case "image/jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(w.Body.Bytes()))
+	default:
+		t.Fatalf("Unexpected content type %q\n", w.Header().Get("Content-Type"))
+	}
+	if err != nil {
+		t.Fatalf("Unable to decode image: %s\n", err.Error())
+	}
+	if size := img.Bounds().Size(); size.X != nx || size.Y != ny {
+		t.Fatalf("Expected %d x %d image, got %d x %d\n", nx, ny, size.X, size.Y)
+	}
+	return img
+}
+
+// grayAt returns the gray value of an image pixel.
+func grayAt(img image.Image, x, y int) byte {
+	return color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+}
+
+func TestFakeCreateAndInfo(t *testing.T) {
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+
+	// Instance creation fails for a bad key or unknown volume.
+	dtype := NewType()
+	dtype.APIURL = fb.URL
+	config := dvid.NewConfig()
+	config.Set("volumeid", fakeVolumeID)
+	config.Set("authkey", "badkey")
+	if _, err := dtype.NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected 401 error for bad key, got %v\n", err)
+	}
+	config.Set("volumeid", "123456:unknown")
+	config.Set("authkey", fakeKey)
+	if _, err := dtype.NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected 404 error for unknown volume, got %v\n", err)
+	}
+
+	d := newFakeData(t, fb, dvid.NewConfig())
+	defer d.Shutdown()
+	if d.APIURL != fb.URL {
+		t.Errorf("Expected instance to use fake at %s, got %q\n", fb.URL, d.APIURL)
+	}
+	expected := GeometryMap{
+		TileSpec{0, XY}: 0,
+		TileSpec{0, XZ}: 0,
+		TileSpec{0, YZ}: 0,
+		TileSpec{1, XY}: 1,
+		TileSpec{2, XY}: 2,
+		TileSpec{1, XZ}: 3,
+	}
+	if len(d.TileMap) != len(expected) {
+		t.Errorf("Expected tile map %v, got %v\n", expected, d.TileMap)
+	}
+	for spec, gi := range expected {
+		if got, found := d.TileMap[spec]; !found || got != gi {
+			t.Errorf("Expected scale %d %s to use geometry %d, got %d (found %t)\n", spec.scaling, spec.plane, gi, got, found)
+		}
+	}
+
+	w := serveFake(d, "info")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad info response: %d %s\n", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), fakeKey) {
+		t.Errorf("Info should not include the API key: %s\n", w.Body.String())
+	}
+	var info struct {
+		Extended struct {
+			VolumeID     string
+			HighResIndex GeometryIndex
+			Scales       []struct {
+				VolumeSize dvid.Point3d
+				PixelSize  dvid.NdFloat32
+			}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Bad info JSON %s: %s\n", w.Body.String(), err.Error())
+	}
+	if info.Extended.VolumeID != fakeVolumeID || info.Extended.HighResIndex != 0 || len(info.Extended.Scales) != len(fb.geoms) {
+		t.Fatalf("Unexpected info: %s\n", w.Body.String())
+	}
+	for i, geom := range fb.geoms {
+		scale := info.Extended.Scales[i]
+		if scale.VolumeSize != geom.volumeSize || scale.PixelSize[0] != geom.pixelSize[0] || scale.PixelSize[2] != geom.pixelSize[2] {
+			t.Errorf("Expected scale %d to be %v, got %v\n", i, geom, scale)
+		}
+	}
+}
+
+func TestFakeTiles(t *testing.T) {
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	d := newFakeData(t, fb, dvid.NewConfig())
+	defer d.Shutdown()
+
+	// Full tiles in the requested format are passed through from upstream.
+	img := decodeGray(t, serveFake(d, "tile/xy/0/0_0_20/png"), 512, 512)
+	if query := fb.lastTileQuery(); query != "corner=0%2C0%2C20&format=png&scale=0&size=512%2C512%2C1" {
+		t.Errorf("Unexpected tile request %q\n", query)
+	}
+	for _, pt := range []image.Point{{0, 0}, {100, 3}, {511, 511}} {
+		if value := grayAt(img, pt.X, pt.Y); value != fb.voxel(0, int32(pt.X), int32(pt.Y), 20) {
+			t.Errorf("Bad xy tile voxel at %v: %d\n", pt, value)
+		}
+	}
+
+	// Other scales and orientations use their scaled volumes.
+	img = decodeGray(t, serveFake(d, "tile/xy/2/0_0_20/png?tilesize=128"), 128, 128)
+	if value := grayAt(img, 10, 20); value != fb.voxel(2, 10, 20, 20) {
+		t.Errorf("Bad scale 2 xy tile voxel: %d\n", value)
+	}
+	img = decodeGray(t, serveFake(d, "tile/xz/1/1_100_0/png?tilesize=256"), 256, 256)
+	if value := grayAt(img, 5, 7); value != fb.voxel(3, 256+5, 100, 7) {
+		t.Errorf("Bad scale 1 xz tile voxel: %d\n", value)
+	}
+	img = decodeGray(t, serveFake(d, "tile/yz/0/300_1_0/png?tilesize=256"), 256, 256)
+	if value := grayAt(img, 5, 7); value != fb.voxel(0, 300, 256+5, 7) {
+		t.Errorf("Bad yz tile voxel: %d\n", value)
+	}
+
+	// Quality parameters are sent upstream.
+	decodeGray(t, serveFake(d, "tile/xy/1/0_0_20/jpeg:90?tilesize=256"), 256, 256)
+	if query := fb.lastTileQuery(); !strings.Contains(query, "format=jpeg&jpegQuality=90") {
+		t.Errorf("Expected jpeg quality in tile request, got %q\n", query)
+	}
+	decodeGray(t, serveFake(d, "tile/xy/1/0_0_20/png:9?tilesize=256"), 256, 256)
+	if query := fb.lastTileQuery(); !strings.Contains(query, "format=png&pngCompressionLevel=9") {
+		t.Errorf("Expected png compression level in tile request, got %q\n", query)
+	}
+
+	// Edge tiles are fetched raw, clipped to the volume, and padded with background.
+	img = decodeGray(t, serveFake(d, "tile/xy/1/1_1_20/png?tilesize=256"), 256, 256)
+	if query := fb.lastTileQuery(); query != "corner=256%2C256%2C20&scale=1&size=244%2C144%2C1" {
+		t.Errorf("Unexpected edge tile request %q\n", query)
+	}
+	if value := grayAt(img, 243, 143); value != fb.voxel(1, 256+243, 256+143, 20) {
+		t.Errorf("Bad edge tile voxel: %d\n", value)
+	}
+	if grayAt(img, 244, 0) != 0 || grayAt(img, 0, 144) != 0 {
+		t.Errorf("Expected background outside volume in edge tile\n")
+	}
+
+	// Tiles outside the volume are blank without any upstream request.
+	numRequests := fb.numRequests()
+	img = decodeGray(t, serveFake(d, "tile/xy/0/5_0_20/png"), 512, 512)
+	if grayAt(img, 100, 100) != 0 {
+		t.Errorf("Expected blank tile outside volume\n")
+	}
+	if w := serveFake(d, "tile/xy/0/5_0_20/png?noblanks=true"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for outside tile with noblanks, got %d\n", w.Code)
+	}
+	if fb.numRequests() != numRequests {
+		t.Errorf("Expected no upstream requests for outside tiles, got %d\n", fb.numRequests()-numRequests)
+	}
+}
+
+func TestFakeRaw(t *testing.T) {
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	d := newFakeData(t, fb, dvid.NewConfig())
+	defer d.Shutdown()
+
+	w := serveFake(d, "raw/xy/100_50/10_20_30/raw")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad raw response: %d %s\n", w.Code, w.Body.String())
+	}
+	data := w.Body.Bytes()
+	if len(data) != 100*50 {
+		t.Fatalf("Expected %d bytes of raw data, got %d\n", 100*50, len(data))
+	}
+	for y := int32(0); y < 50; y++ {
+		for x := int32(0); x < 100; x++ {
+			if data[y*100+x] != fb.voxel(0, 10+x, 20+y, 30) {
+				t.Fatalf("Bad raw voxel at (%d, %d): %d\n", x, y, data[y*100+x])
+			}
+		}
+	}
+
+	img := decodeGray(t, serveFake(d, "raw/xz/64_32/0_7_0/png?scale=1"), 64, 32)
+	if value := grayAt(img, 63, 31); value != fb.voxel(3, 63, 7, 31) {
+		t.Errorf("Bad scale 1 xz voxel: %d\n", value)
+	}
+	if w := serveFake(d, "raw/xy/64_64/0_0_0/raw?scale=3"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unavailable scale, got %d\n", w.Code)
+	}
+}
+
+func TestFakeRawCoords(t *testing.T) {
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	d := newFakeData(t, fb, dvid.NewConfig())
+	defer d.Shutdown()
+
+	tests := []struct {
+		request string
+		query   string // upstream tile query
+		size    string // X-DVID-Upstream-Size header
+	}{
+		{"raw/xy/64_32/400_200_30/raw?scale=1", "corner=400%2C200%2C30&scale=1&size=64%2C32%2C1", "64,32,1"},
+		{"raw/xy/64_32/400_200_30/raw?scale=1&coords=scaled", "corner=400%2C200%2C30&scale=1&size=64%2C32%2C1", "64,32,1"},
+		{"raw/xy/64_32/400_200_30/raw?scale=1&coords=highres", "corner=200%2C100%2C30&scale=1&size=64%2C32%2C1", "64,32,1"},
+		{"raw/xy/64_32/401_203_30/raw?scale=2&coords=highres", "corner=100%2C50%2C30&scale=2&size=64%2C32%2C1", "64,32,1"},
+		{"raw/xy/64_32/400_200_30/raw?coords=highres", "corner=400%2C200%2C30&scale=0&size=64%2C32%2C1", "64,32,1"},
+		{"raw/xz/64_32/400_200_60/raw?scale=1&coords=highres", "corner=200%2C200%2C30&scale=3&size=64%2C1%2C32", "64,1,32"},
+		{"raw/xy/64_32/960_200_30/raw?scale=1&coords=highres", "corner=480%2C100%2C30&scale=1&size=20%2C32%2C1", "20,32,1"},
+	}
+	for _, test := range tests {
+		w := serveFake(d, test.request)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Bad response to %s: %d %s\n", test.request, w.Code, w.Body.String())
+		}
+		query := fb.lastTileQuery()
+		if query != test.query {
+			t.Errorf("Expected %s to request %q, got %q\n", test.request, test.query, query)
+		}
+		values, _ := url.ParseQuery(query)
+		if corner := w.Header().Get("X-DVID-Upstream-Corner"); corner != values.Get("corner") {
+			t.Errorf("Expected %s to have upstream corner %q, got %q\n", test.request, values.Get("corner"), corner)
+		}
+		if size := w.Header().Get("X-DVID-Upstream-Size"); size != test.size {
+			t.Errorf("Expected %s to have upstream size %q, got %q\n", test.request, test.size, size)
+		}
+	}
+
+	w := serveFake(d, "raw/xy/64_32/4000_200_30/raw?scale=1&coords=highres")
+	if w.Code != http.StatusNotFound || w.Header().Get("X-DVID-Upstream-Corner") != "2000,100,30" || w.Header().Get("X-DVID-Upstream-Size") != "0,0,0" {
+		t.Errorf("Expected 404 with empty upstream region outside volume, got %d %q %q\n", w.Code,
+			w.Header().Get("X-DVID-Upstream-Corner"), w.Header().Get("X-DVID-Upstream-Size"))
+	}
+	if w := serveFake(d, "raw/xy/64_32/0_0_30/raw?coords=full"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for bad coords option, got %d\n", w.Code)
+	}
+}
+
+func TestFakeRawCoordsNonPowerOfTwo(t *testing.T) {
+	// Levels are 1.5 and 3 times the highest resolution in x and y.
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	fb.geoms = []fakeGeometry{
+		{dvid.Point3d{900, 600, 300}, dvid.NdFloat32{6, 6, 6}},
+		{dvid.Point3d{600, 400, 300}, dvid.NdFloat32{9, 9, 6}},
+		{dvid.Point3d{300, 200, 300}, dvid.NdFloat32{18, 18, 6}},
+	}
+	d := newFakeData(t, fb, dvid.NewConfig())
+	defer d.Shutdown()
+
+	tests := []struct {
+		request string
+		query   string
+		gi      int32
+		corner  dvid.Point3d
+	}{
+		{"raw/xy/16_8/300_150_20/raw?scale=1&coords=highres", "corner=200%2C100%2C20&scale=1&size=16%2C8%2C1", 1, dvid.Point3d{200, 100, 20}},
+		{"raw/xy/16_8/301_151_20/raw?scale=1&coords=highres", "corner=200%2C100%2C20&scale=1&size=16%2C8%2C1", 1, dvid.Point3d{200, 100, 20}},
+		{"raw/xy/16_8/300_150_20/raw?scale=2&coords=highres", "corner=100%2C50%2C20&scale=2&size=16%2C8%2C1", 2, dvid.Point3d{100, 50, 20}},
+	}
+	for _, test := range tests {
+		w := serveFake(d, test.request)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Bad response to %s: %d %s\n", test.request, w.Code, w.Body.String())
+		}
+		if query := fb.lastTileQuery(); query != test.query {
+			t.Errorf("Expected %s to request %q, got %q\n", test.request, test.query, query)
+		}
+		if data := w.Body.Bytes(); len(data) != 16*8 || data[0] != fb.voxel(test.gi, test.corner[0], test.corner[1], test.corner[2]) {
+			t.Errorf("Bad raw data for %s\n", test.request)
+		}
+	}
+
+	// Scaled coordinates are used as given, even when outside the scaled volume.
+	w := serveFake(d, "raw/xy/16_8/300_150_20/raw?scale=2")
+	if w.Code != http.StatusNotFound || w.Header().Get("X-DVID-Upstream-Corner") != "300,150,20" || w.Header().Get("X-DVID-Upstream-Size") != "0,0,0" {
+		t.Errorf("Expected 404 for scaled coordinates outside scale 2, got %d %q %q\n", w.Code,
+			w.Header().Get("X-DVID-Upstream-Corner"), w.Header().Get("X-DVID-Upstream-Size"))
+	}
+}
+
+func TestFakeErrors(t *testing.T) {
+	defer func(backoff time.Duration) {
+		RetryBackoff = backoff
+	}(RetryBackoff)
+	RetryBackoff = 0
+
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	d := newFakeData(t, fb, dvid.NewConfig())
+	defer d.Shutdown()
+	const tileURL = "tile/xy/0/0_0_20/png"
+
+	// A revoked key is reported as a bad gateway with Google's status.
+	fb.setKey("rotated")
+	w := serveFake(d, tileURL)
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "401") {
+		t.Errorf("Expected 502 with status 401 for bad key, got %d %s\n", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), fakeKey) {
+		t.Errorf("Error should not include the API key: %s\n", w.Body.String())
+	}
+	fb.setKey(fakeKey)
+
+	// Rate limiting fails the request unless retries are allowed.
+	fb.rateLimit(1)
+	if w := serveFake(d, tileURL); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "429") {
+		t.Errorf("Expected 502 with status 429 when rate limited, got %d %s\n", w.Code, w.Body.String())
+	}
+	config := dvid.NewConfig()
+	config.Set("retries", "1")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to modify settings: %s\n", err.Error())
+	}
+	fb.rateLimit(1)
+	numRequests := fb.numRequests()
+	decodeGray(t, serveFake(d, tileURL), 512, 512)
+	if fb.numRequests() != numRequests+2 {
+		t.Errorf("Expected tile after one retry, got %d requests\n", fb.numRequests()-numRequests)
+	}
+}
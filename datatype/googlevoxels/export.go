@@ -0,0 +1,305 @@
+/*
+	This file supports exporting a grid of tiles to disk as image files for tools that can't
+	use the HTTP API.
+*/
+
+package googlevoxels
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+const (
+	// MaxExportTiles is the largest number of tiles exported by one export-tiles command.
+	MaxExportTiles = 100000
+
+	// ExportManifestFile and ExportRetryFile are written to the output directory of an
+	// export.  The retry file lists failed tiles in the form used to warm the tile cache.
+	ExportManifestFile = "manifest.json"
+	ExportRetryFile    = "retry.json"
+)
+
+// fetchedTile holds a tile written by serveTile so tiles can be fetched without a HTTP
+// request.
+type fetchedTile struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func (ft *fetchedTile) Header() http.Header {
+	return ft.header
+}
+
+func (ft *fetchedTile) Write(data []byte) (int, error) {
+	return ft.buf.Write(data)
+}
+
+func (ft *fetchedTile) WriteHeader(status int) {
+	ft.status = status
+}
+
+// fetchTile returns the tile encoded in the given format along with the headers that
+// would accompany it in a HTTP response.  Tiles outside the volume return a not-found error.
+func (d *Data) fetchTile(requestID string, tile *GoogleTileSpec, formatStr string) ([]byte, http.Header, error) {
+	ft := &fetchedTile{header: make(http.Header)}
+	if err := d.serveTile(ft, nil, requestID, tile, formatStr, true, nil, nil); err != nil {
+		return nil, nil, err
+	}
+	return ft.buf.Bytes(), ft.header, nil
+}
+
+// ExportManifest describes the tiles written by an export-tiles command.  Offset and Size
+// give the exported region in voxels at the exported scale.
+type ExportManifest struct {
+	VolumeID  string
+	Plane     string
+	Scale     Scaling
+	TileSize  int32
+	Format    string
+	VoxelType string
+	MinTile   dvid.Point3d
+	MaxTile   dvid.Point3d
+	Offset    dvid.Point3d
+	Size      dvid.Point3d
+	PixelSize dvid.NdFloat32
+	Written   int
+	Skipped   int // tiles outside the volume
+	Failed    int
+}
+
+// ExportFailure is a tile that could not be exported.
+type ExportFailure struct {
+	WarmTile
+	Error string
+}
+
+// exportExtension returns the file extension for tiles of the given format.
+func exportExtension(formatStr string) string {
+	format := strings.Split(formatStr, ":")[0]
+	switch format {
+	case "jpeg":
+		return "jpg"
+	case "tiff":
+		return "tif"
+	default:
+		return format
+	}
+}
+
+// exportTiles fetches the tiles between the min and max tile coordinates, inclusive, and
+// writes them as files in the output directory along with a manifest and a list of failed
+// tiles.  Progress lines are written to the given writer.
+func (d *Data) exportTiles(requestID string, shape dvid.DataShape, scale Scaling, minTile, maxTile dvid.Point3d,
+	tilesize int32, formatStr, outDir string, progress *bytes.Buffer) (*ExportManifest, error) {
+
+	numTiles := int64(1)
+	for i := 0; i < 3; i++ {
+		if maxTile[i] < minTile[i] {
+			return nil, fmt.Errorf("max tile coordinate %s is less than min tile coordinate %s", maxTile, minTile)
+		}
+		numTiles *= int64(maxTile[i] - minTile[i] + 1)
+	}
+	if numTiles > MaxExportTiles {
+		return nil, fmt.Errorf("Export of %d tiles exceeds maximum of %d tiles", numTiles, MaxExportTiles)
+	}
+
+	// The first tile determines the geometry and voxel type of the export.
+	first, err := d.getTileSpecAt(scale, shape, minTile, tilesize, d.Fallback)
+	if err != nil {
+		return nil, err
+	}
+	if formatStr == "" {
+		if first.channelType == dvid.ChannelFloat32 || first.channelType == dvid.ChannelUint64 {
+			formatStr = RawFormat
+		} else {
+			formatStr = d.planeFormat(first.plane)
+		}
+	}
+	if formatStr != RawFormat {
+		if formatStr, err = canonicalFormat(formatStr); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	d0, d1 := first.dims()
+	pixelSize := make(dvid.NdFloat32, 3)
+	copy(pixelSize, d.Scales[first.gi].PixelSize)
+	pixelSize[d0] *= float32(int32(1) << first.downLevels)
+	pixelSize[d1] *= float32(int32(1) << first.downLevels)
+	manifest := &ExportManifest{
+		VolumeID:  d.VolumeID,
+		Plane:     strings.ToLower(first.plane.String()),
+		Scale:     scale,
+		TileSize:  tilesize,
+		Format:    formatStr,
+		VoxelType: first.channelType,
+		MinTile:   minTile,
+		MaxTile:   maxTile,
+		PixelSize: pixelSize,
+	}
+	for i := 0; i < 3; i++ {
+		manifest.Offset[i] = minTile[i]
+		manifest.Size[i] = maxTile[i] - minTile[i] + 1
+		if i == d0 || i == d1 {
+			manifest.Offset[i] *= tilesize
+			manifest.Size[i] *= tilesize
+		}
+	}
+	ext := exportExtension(formatStr)
+
+	// Fetch tiles concurrently, writing each as it arrives.
+	var failures []ExportFailure
+	var mu sync.Mutex
+	var done int64
+	reportEvery := numTiles / 10
+	if reportEvery == 0 {
+		reportEvery = 1
+	}
+	finish := func(coord dvid.Point3d, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err == nil:
+			manifest.Written++
+		case server.ErrorKindOf(err) == server.NotFoundError:
+			manifest.Skipped++
+		default:
+			manifest.Failed++
+			failures = append(failures, ExportFailure{
+				WarmTile: WarmTile{
+					Plane:    manifest.Plane,
+					Scale:    scale,
+					Coord:    fmt.Sprintf("%d_%d_%d", coord[0], coord[1], coord[2]),
+					TileSize: tilesize,
+					Format:   formatStr,
+				},
+				Error: err.Error(),
+			})
+		}
+		done++
+		if done%reportEvery == 0 || done == numTiles {
+			line := fmt.Sprintf("Exported %d of %d tiles: %d written, %d outside volume, %d failed\n",
+				done, numTiles, manifest.Written, manifest.Skipped, manifest.Failed)
+			progress.WriteString(line)
+			dvid.Infof("[%s] %s", requestID, line)
+		}
+	}
+
+	wg := new(sync.WaitGroup)
+	sem := make(chan struct{}, MaxFetchConcurrency)
+	for z := minTile[2]; z <= maxTile[2]; z++ {
+		for y := minTile[1]; y <= maxTile[1]; y++ {
+			for x := minTile[0]; x <= maxTile[0]; x++ {
+				coord := dvid.Point3d{x, y, z}
+				wg.Add(1)
+				sem <- struct{}{}
+				go func() {
+					defer func() {
+						<-sem
+						wg.Done()
+					}()
+					tile, err := d.getTileSpecAt(scale, shape, coord, tilesize, d.Fallback)
+					if err != nil {
+						finish(coord, err)
+						return
+					}
+					data, _, err := d.fetchTile(requestID, tile, formatStr)
+					if err != nil {
+						finish(coord, err)
+						return
+					}
+					name := fmt.Sprintf("%s_%d_%d_%d_%d.%s", manifest.Plane, scale, coord[0], coord[1], coord[2], ext)
+					finish(coord, ioutil.WriteFile(filepath.Join(outDir, name), data, 0644))
+				}()
+			}
+		}
+	}
+	wg.Wait()
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, ExportManifestFile), manifestJSON, 0644); err != nil {
+		return nil, err
+	}
+	retryPath := filepath.Join(outDir, ExportRetryFile)
+	if len(failures) == 0 {
+		if err := os.Remove(retryPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return manifest, nil
+	}
+	retryJSON, err := json.MarshalIndent(failures, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(retryPath, retryJSON, 0644); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// doExportTiles handles the export-tiles command:
+//
+//    node <UUID> <data name> export-tiles <plane> <scale> <min tile> <max tile> <dir> [format]
+func (d *Data) doExportTiles(request datastore.Request, reply *datastore.Response) error {
+	var uuidStr, dataName, cmdStr, planeStr, scaleStr, minStr, maxStr, outDir, formatStr string
+	request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &planeStr, &scaleStr, &minStr, &maxStr, &outDir, &formatStr)
+	if outDir == "" {
+		return fmt.Errorf("Poorly formatted export-tiles command.  See command-line help.")
+	}
+	shape, err := dvid.DataShapeString(planeStr).DataShape()
+	if err != nil {
+		return fmt.Errorf("Illegal tile plane: %s (%s)", planeStr, err.Error())
+	}
+	scale, err := strconv.ParseUint(scaleStr, 10, 8)
+	if err != nil {
+		return fmt.Errorf("Illegal tile scale: %s (%s)", scaleStr, err.Error())
+	}
+	minTile, err := dvid.StringToPoint3d(minStr, "_")
+	if err != nil {
+		return fmt.Errorf("Illegal min tile coordinate: %s (%s)", minStr, err.Error())
+	}
+	maxTile, err := dvid.StringToPoint3d(maxStr, "_")
+	if err != nil {
+		return fmt.Errorf("Illegal max tile coordinate: %s (%s)", maxStr, err.Error())
+	}
+	tilesize := d.TileSize
+	if tilesizeStr, found := request.Setting("tilesize"); found {
+		size, err := strconv.Atoi(tilesizeStr)
+		if err != nil || size < 1 || size > MaxTileSize {
+			return fmt.Errorf("Illegal tile size %q: must be from 1 to %d", tilesizeStr, MaxTileSize)
+		}
+		tilesize = int32(size)
+	}
+
+	var progress bytes.Buffer
+	manifest, err := d.exportTiles(server.NewRequestID(), shape, Scaling(scale), minTile, maxTile, tilesize, formatStr, outDir, &progress)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(&progress, "Wrote %d tiles and %s to %s\n", manifest.Written, ExportManifestFile, outDir)
+	if manifest.Failed != 0 {
+		fmt.Fprintf(&progress, "%d tiles failed and are listed in %s\n", manifest.Failed, ExportRetryFile)
+	}
+	reply.Text = progress.String()
+	return nil
+}
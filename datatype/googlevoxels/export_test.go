@@ -0,0 +1,117 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// failingTransport fails requests whose corner has the given y coordinate.
+type failingTransport struct {
+	cappedTransport
+	failY int32
+}
+
+func (ft *failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	corner, err := dvid.StringToPoint3d(r.URL.Query().Get("corner"), ",")
+	if err == nil && corner[1] == ft.failY {
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader("backend error")),
+			Request:    r,
+		}, nil
+	}
+	return ft.cappedTransport.RoundTrip(r)
+}
+
+func TestExportTiles(t *testing.T) {
+	d := newTestData(t)
+	defer useTransport(&failingTransport{cappedTransport{maxVoxels: 1000000}, 8})()
+
+	dir, err := ioutil.TempDir("", "export-tiles")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// Tiles at x = 124 are the last within the 1000 voxel volume, tiles at x = 125 are
+	// outside, and tiles at y = 1 fail upstream.
+	request := datastore.Request{
+		Command: dvid.Command{"node", "a9b8c7", "grayscale", "export-tiles", "xy", "0", "124_0_5", "125_1_5", dir, "raw", "tilesize=8"},
+	}
+	var reply datastore.Response
+	if err := d.DoRPC(request, &reply); err != nil {
+		t.Fatalf("Unable to export tiles: %s\n", err.Error())
+	}
+	if !strings.Contains(reply.Text, "Exported 4 of 4 tiles: 1 written, 2 outside volume, 1 failed") {
+		t.Errorf("Unexpected progress: %s\n", reply.Text)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, "xy_0_124_0_5.raw"))
+	if err != nil {
+		t.Fatalf("Unable to read exported tile: %s\n", err.Error())
+	}
+	var expected []byte
+	for y := 0; y < 8; y++ {
+		for x := 992; x < 1000; x++ {
+			expected = append(expected, byte(x+3*y))
+		}
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Exported tile has unexpected voxels: %v\n", got)
+	}
+	for _, name := range []string{"xy_0_124_1_5.raw", "xy_0_125_0_5.raw", "xy_0_125_1_5.raw"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected no file %s, got error %v\n", name, err)
+		}
+	}
+
+	var manifest ExportManifest
+	data, err := ioutil.ReadFile(filepath.Join(dir, ExportManifestFile))
+	if err != nil {
+		t.Fatalf("Unable to read manifest: %s\n", err.Error())
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("Unable to decode manifest: %s\n", err.Error())
+	}
+	if manifest.Plane != "xy" || manifest.TileSize != 8 || manifest.VoxelType != "uint8" {
+		t.Errorf("Unexpected manifest: %+v\n", manifest)
+	}
+	if manifest.Offset != (dvid.Point3d{992, 0, 5}) || manifest.Size != (dvid.Point3d{16, 16, 1}) {
+		t.Errorf("Unexpected manifest extents: offset %s, size %s\n", manifest.Offset, manifest.Size)
+	}
+	if manifest.Written != 1 || manifest.Skipped != 2 || manifest.Failed != 1 || manifest.PixelSize[0] != 8 {
+		t.Errorf("Unexpected manifest counts or pixel size: %+v\n", manifest)
+	}
+
+	var failures []ExportFailure
+	if data, err = ioutil.ReadFile(filepath.Join(dir, ExportRetryFile)); err != nil {
+		t.Fatalf("Unable to read retry list: %s\n", err.Error())
+	}
+	if err := json.Unmarshal(data, &failures); err != nil {
+		t.Fatalf("Unable to decode retry list: %s\n", err.Error())
+	}
+	if len(failures) != 1 || failures[0].Coord != "124_1_5" || failures[0].Error == "" {
+		t.Errorf("Unexpected retry list: %+v\n", failures)
+	}
+
+	// Bad arguments are rejected before fetching.
+	request.Command[6] = "125_1_5"
+	request.Command[7] = "124_0_5"
+	if err := d.DoRPC(request, &reply); err == nil {
+		t.Errorf("Expected error for max tile less than min tile\n")
+	}
+	request.Command[3] = "export"
+	if err := d.DoRPC(request, &reply); err == nil {
+		t.Errorf("Expected error for unknown command\n")
+	}
+}
@@ -0,0 +1,312 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// fakeGeometry is a scaled volume served by fakeBrainMaps.
+type fakeGeometry struct {
+	volumeSize dvid.Point3d
+	pixelSize  dvid.NdFloat32
+}
+
+// fakeBrainMaps is a test server implementing the volume metadata and tile endpoints of the
+// Google BrainMaps API for a single uint8 volume.  Tiles are synthetic gradients given by
+// voxel() for any corner, size, and scale within the scaled volumes.
+type fakeBrainMaps struct {
+	*httptest.Server
+	volumeID string
+	geoms    []fakeGeometry
+
+	mu          sync.Mutex
+	key         string
+	tileQueries []string // query strings of tile requests without the key
+
+	requests    int64 // all requests, including rejected ones
+	rateLimited int32 // number of upcoming requests to reject with 429
+}
+
+// fakeVolumeID is the volume served by newFakeBrainMaps.
+const fakeVolumeID = "123456:fake"
+
+// fakeKey is the API key accepted by newFakeBrainMaps.
+const fakeKey = "fakekey"
+
+// newFakeBrainMaps starts a fake with a 1000 x 800 x 600 volume at 8 nm, xy-downsampled
+// scales 1 and 2, and xz-downsampled scale 1.  It should be closed after use.
+func newFakeBrainMaps() *fakeBrainMaps {
+	fb := &fakeBrainMaps{
+		volumeID: fakeVolumeID,
+		key:      fakeKey,
+		geoms: []fakeGeometry{
+			{dvid.Point3d{1000, 800, 600}, dvid.NdFloat32{8, 8, 8}},
+			{dvid.Point3d{500, 400, 600}, dvid.NdFloat32{16, 16, 8}},
+			{dvid.Point3d{250, 200, 600}, dvid.NdFloat32{32, 32, 8}},
+			{dvid.Point3d{500, 800, 300}, dvid.NdFloat32{16, 8, 16}},
+		},
+	}
+	fb.Server = httptest.NewServer(http.HandlerFunc(fb.serve))
+	return fb
+}
+
+// voxel returns the value of a voxel in the scaled volume with the given index, which is
+// the scale parameter of tile requests.
+func (fb *fakeBrainMaps) voxel(gi, x, y, z int32) byte {
+	return byte(x + 2*y + 3*z + 50*gi)
+}
+
+// setKey changes the API key accepted by the fake.
+func (fb *fakeBrainMaps) setKey(key string) {
+	fb.mu.Lock()
+	fb.key = key
+	fb.mu.Unlock()
+}
+
+// rateLimit makes the next n requests fail with status 429.
+func (fb *fakeBrainMaps) rateLimit(n int) {
+	atomic.StoreInt32(&fb.rateLimited, int32(n))
+}
+
+// numRequests returns the number of requests received by the fake.
+func (fb *fakeBrainMaps) numRequests() int {
+	return int(atomic.LoadInt64(&fb.requests))
+}
+
+// lastTileQuery returns the query string, without the key, of the last tile request.
+func (fb *fakeBrainMaps) lastTileQuery() string {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if len(fb.tileQueries) == 0 {
+		return ""
+	}
+	return fb.tileQueries[len(fb.tileQueries)-1]
+}
+
+// apiError writes an error in the JSON form used by Google APIs.
+func apiError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	msg, _ := json.Marshal(fmt.Sprintf(format, args...))
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %s}}`, status, msg)
+}
+
+func (fb *fakeBrainMaps) serve(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&fb.requests, 1)
+	query := r.URL.Query()
+	fb.mu.Lock()
+	key := fb.key
+	fb.mu.Unlock()
+	if query.Get("key") != key {
+		apiError(w, http.StatusUnauthorized, "API key not valid")
+		return
+	}
+	for {
+		n := atomic.LoadInt32(&fb.rateLimited)
+		if n <= 0 {
+			break
+		}
+		if atomic.CompareAndSwapInt32(&fb.rateLimited, n, n-1) {
+			apiError(w, http.StatusTooManyRequests, "Quota exceeded")
+			return
+		}
+	}
+	if r.Method != "GET" {
+		apiError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	volume := strings.TrimPrefix(r.URL.Path, "/volumes/")
+	tile := strings.HasSuffix(volume, ":tile")
+	volume = strings.TrimSuffix(volume, ":tile")
+	if volume != fb.volumeID || volume == r.URL.Path {
+		apiError(w, http.StatusNotFound, "volume %q not found", volume)
+		return
+	}
+	if tile {
+		query.Del("key")
+		fb.mu.Lock()
+		fb.tileQueries = append(fb.tileQueries, query.Encode())
+		fb.mu.Unlock()
+		fb.serveTile(w, query)
+		return
+	}
+	fb.serveMetadata(w)
+}
+
+func (fb *fakeBrainMaps) serveMetadata(w http.ResponseWriter) {
+	type xyz struct {
+		X string `json:"x"`
+		Y string `json:"y"`
+		Z string `json:"z"`
+	}
+	type geometry struct {
+		VolumeSize   xyz     `json:"volumeSize"`
+		ChannelCount string  `json:"channelCount"`
+		ChannelType  string  `json:"channelType"`
+		PixelSize    float3d `json:"pixelSize"`
+	}
+	var m struct {
+		Geoms []geometry `json:"geometrys"`
+	}
+	for _, geom := range fb.geoms {
+		var g geometry
+		size := geom.volumeSize
+		g.VolumeSize = xyz{strconv.Itoa(int(size[0])), strconv.Itoa(int(size[1])), strconv.Itoa(int(size[2]))}
+		g.ChannelCount = "1"
+		g.ChannelType = dvid.ChannelUint8
+		g.PixelSize = float3d{geom.pixelSize[0], geom.pixelSize[1], geom.pixelSize[2]}
+		m.Geoms = append(m.Geoms, g)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(m)
+}
+
+// parseTriple parses a comma-separated triple like "0,512,20".
+func parseTriple(s string) (dvid.Point3d, error) {
+	var pt dvid.Point3d
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return pt, fmt.Errorf("expected 3 comma-separated integers, got %q", s)
+	}
+	for i, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil {
+			return pt, err
+		}
+		pt[i] = int32(v)
+	}
+	return pt, nil
+}
+
+func (fb *fakeBrainMaps) serveTile(w http.ResponseWriter, query map[string][]string) {
+	get := func(name string) string {
+		if values := query[name]; len(values) != 0 {
+			return values[0]
+		}
+		return ""
+	}
+	corner, err := parseTriple(get("corner"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "bad corner: %s", err.Error())
+		return
+	}
+	size, err := parseTriple(get("size"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "bad size: %s", err.Error())
+		return
+	}
+	scale, err := strconv.Atoi(get("scale"))
+	if err != nil || scale < 0 || scale >= len(fb.geoms) {
+		apiError(w, http.StatusBadRequest, "bad scale %q", get("scale"))
+		return
+	}
+	volumeSize := fb.geoms[scale].volumeSize
+	for i := 0; i < 3; i++ {
+		if corner[i] < 0 || size[i] < 1 || corner[i]+size[i] > volumeSize[i] {
+			apiError(w, http.StatusBadRequest, "corner %s and size %s outside volume %s", corner, size, volumeSize)
+			return
+		}
+	}
+
+	// Voxels are ordered with x varying fastest, so any 2d tile is a row-major image.
+	data := make([]byte, 0, size.Prod())
+	for z := corner[2]; z < corner[2]+size[2]; z++ {
+		for y := corner[1]; y < corner[1]+size[1]; y++ {
+			for x := corner[0]; x < corner[0]+size[0]; x++ {
+				data = append(data, fb.voxel(int32(scale), x, y, z))
+			}
+		}
+	}
+
+	format := get("format")
+	if format == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+		return
+	}
+	nx, ny := int(size[0]), int(size[1])
+	switch {
+	case size[2] == 1:
+	case size[1] == 1:
+		ny = int(size[2])
+	case size[0] == 1:
+		nx, ny = int(size[1]), int(size[2])
+	default:
+		apiError(w, http.StatusBadRequest, "encoded tiles must be 2d, not size %s", size)
+		return
+	}
+	img := &image.Gray{Pix: data, Stride: nx, Rect: image.Rect(0, 0, nx, ny)}
+	var buf bytes.Buffer
+	switch format {
+	case "png":
+		enc := png.Encoder{CompressionLevel: png.DefaultCompression}
+		if levelStr := get("pngCompressionLevel"); levelStr != "" {
+			level, err := strconv.Atoi(levelStr)
+			if err != nil || level < 0 || level > 9 {
+				apiError(w, http.StatusBadRequest, "bad pngCompressionLevel %q", levelStr)
+				return
+			}
+			switch {
+			case level == 0:
+				enc.CompressionLevel = png.NoCompression
+			case level < 5:
+				enc.CompressionLevel = png.BestSpeed
+			case level == 9:
+				enc.CompressionLevel = png.BestCompression
+			}
+		}
+		err = enc.Encode(&buf, img)
+	case "jpeg":
+		options := jpeg.Options{Quality: jpeg.DefaultQuality}
+		if qualityStr := get("jpegQuality"); qualityStr != "" {
+			quality, err := strconv.Atoi(qualityStr)
+			if err != nil || quality < 0 || quality > 100 {
+				apiError(w, http.StatusBadRequest, "bad jpegQuality %q", qualityStr)
+				return
+			}
+			options.Quality = quality
+		}
+		err = jpeg.Encode(&buf, img, &options)
+	default:
+		apiError(w, http.StatusBadRequest, "unsupported format %q", format)
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "unable to encode tile: %s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "image/"+format)
+	w.Write(buf.Bytes())
+}
+
+// newFakeData creates a googlevoxels instance backed by the fake through the type's
+// constructor, as a client's POST to create an instance would.
+func newFakeData(t *testing.T, fb *fakeBrainMaps, config dvid.Config) *Data {
+	dtype := NewType()
+	dtype.APIURL = fb.URL
+	if _, found, _ := config.GetString("volumeid"); !found {
+		config.Set("volumeid", fb.volumeID)
+	}
+	if _, found, _ := config.GetString("authkey"); !found {
+		config.Set("authkey", fakeKey)
+	}
+	service, err := dtype.NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config)
+	if err != nil {
+		t.Fatalf("Unable to create googlevoxels instance with fake BrainMaps: %s\n", err.Error())
+	}
+	return service.(*Data)
+}
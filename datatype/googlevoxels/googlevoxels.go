@@ -9,12 +9,15 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
-	"image"
-	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"code.google.com/p/go.net/context"
 
@@ -32,7 +35,9 @@ const (
 	TypeName = "googlevoxels"
 )
 
-const HelpMessage = `
+var HelpMessage = fmt.Sprintf(helpMessage, MaxTileSourceLevels, DefaultDiskCacheBytes/dvid.Giga, MirrorQueueSize, MaxFallbackLevels, MaxRetries, DefaultHedgePercent, MaxDefaultTileSize, MaxRetries, MaxFetchConcurrency, tileQueryParams.Help(), rawQueryParams.Help(), MaxValuePoints, valuesQueryParams.Help(), MaxValuePoints, labelsQueryParams.Help(), labelsQueryParams.Help(), transformQueryParams.Help(), orthoviewsQueryParams.Help())
+
+const helpMessage = `
 API for datatypes derived from googlevoxels (github.com/janelia-flyem/dvid/datatype/googlevoxels)
 =================================================================================================
 
@@ -46,49 +51,325 @@ $ dvid repo <UUID> new googlevoxels <data name> <settings...>
 
 	$ dvid repo 3f8c new googlevoxels grayscale volumeid=281930192:stanford authkey=Jna3jrna984l
 
+	Voxels can also come from an image tile server:
+
+	$ dvid repo 3f8c new googlevoxels grayscale provider=tilesource extent=20000,16000,4000 \
+	    urltemplate=https://tiles.example.com/{z}/{x}_{y}_{scale}.jpg sourcetilesize=1024 levels=5
+
     Arguments:
 
     UUID           Hexidecimal string with enough characters to uniquely identify a version node.
     data name      Name of data to create, e.g., "mygrayscale"
     settings       Configuration settings in "key=value" format separated by spaces.
 
-    Required Configuration Settings (case-insensitive keys)
+    Required Configuration Settings for the "brainmaps" provider (case-insensitive keys)
 
     volumeid       The globally unique identifier of the volume within Google BrainMaps API.
     authkey        The API key required for Google BrainMaps API requests.
 
+    Configuration Settings for the "tilesource" provider (case-insensitive keys)
+
+    urltemplate    Required URL of source tiles, where {x} and {y} are the column and row of
+                     the tile, {z} the slice, and {scale} the pyramid level with 0 the
+                     highest resolution.  Tiles may be png or jpeg and are converted to
+                     uint8 grayscale.  Tiles on the volume edge may be partial.
+    extent         Required volume size at scale 0 as "X,Y,Z" voxels.
+    sourcetilesize Width and height in pixels of source tiles.  If unspecified, 512.
+    levels         Number of scales, at most %d, each halving the x and y size of the last.
+                     If unspecified, 1.
+
+    A tile source has no metadata, so its scales are given by these settings.  Any tile or
+    raw request is assembled from the source tiles covering it, and xz and yz requests are
+    only available at scale 0.  The "authkey" setting, if given, is added to source tile
+    requests as a "key" query parameter.
+
     Optional Configuration Settings (case-insensitive keys)
 
-    tilesize       Default size in pixels along one dimension of square tile.  If unspecified, 512.
+    tilesize       Default size in pixels along one dimension of square tile.  If unspecified,
+                     the server's DefaultTileSize (see "Server-wide Defaults" below).
+    strictqueries  If "true", unknown query-string parameters in requests cause an error.
+    healthcheck    Interval between checks of Google BrainMaps API availability, e.g., "5m".
+                     If unspecified, no health checks are done.
+    healthfailfast If "true" (default), tile and raw requests immediately return 503 when
+                     health checks show the Google BrainMaps API is down.  Data with a
+                     "mirror" serves these requests from the mirror instead.
+    tilecache      Maximum megabytes of Google responses to cache in memory.  If unspecified,
+                     no caching is done.
+    diskcache      Directory and optional size of a disk tier for the tile cache, e.g.,
+                     "/data/tiles,maxbytes=200G".  Sizes can have a K, M, G, or T suffix, and
+                     on the command line "maxbytes:200G" can be used instead.  Each tile is a
+                     file with a checksum, and bad files are dropped when found.  The least
+                     recently used tiles are evicted once the size is exceeded.  The in-memory
+                     cache, if any, sits in front.  Each instance needs its own directory.
+                     If unspecified, no disk caching is done.  If no size is given, %d GB.
+    maxfetch       Maximum voxels retrieved in a single Google request.  Larger tile or raw
+                     requests are split into a grid of smaller requests whose data is
+                     assembled before encoding.  If unspecified, requests are never split.
+    defaultformat  Image format used when tile or raw requests omit a format, e.g., "jpeg:85".
+                     If unspecified, the server's DefaultTileFormat.
+    format_xy      Image format used when xy, xz, or yz tile or raw requests omit a format,
+    format_xz        e.g., "format_xy=jpeg:85 format_xz=png format_yz=png" for jpeg tiles in
+    format_yz        the stored orientation and lossless reslices.  If unspecified, the
+                     "defaultformat" setting is used.
+    proxy          URL of HTTP proxy for requests to Google, e.g., "http://proxy.example.com:3128".
+                     If unspecified, the server's outbound proxy or HTTP_PROXY/HTTPS_PROXY is used.
+    cabundle       Path of PEM file of certificate authorities trusted for requests to Google.
+                     If unspecified, the server's outbound CA bundle or the system's is used.
+    background     Voxel value for blank tiles outside the volume and the padding of edge
+                     tiles.  If unspecified, 0.
+    oob-style      How regions outside the volume are rendered: "solid" (default) fills them
+                     with the background, "checker" draws a checkerboard of the background
+                     and a contrasting value, and "border" also draws a 1-pixel frame of the
+                     contrasting value along the data edge of padded tiles.
+                     Padding of uint64 label volumes is always solid so no spurious labels
+                     are introduced.
+    placeholder    If "true", blank uint8 tiles outside the volume are labeled with the text
+                     "outside volume" and their scale and tile coordinate, like multiscale2d
+                     placeholder tiles.  Other voxel types only get the oob-style fill.
+                     If unspecified, "false".
+    mirror         Name of a local uint8 voxels instance, e.g., grayscale8, into which voxels
+                     fetched by scale 0 tile and raw requests of uint8 data are written in the
+                     background.  When health checks show the Google BrainMaps API is down, or
+                     requests have the "offline=true" query string, tile and raw requests are
+                     served from the mirror instead, returning 404 for regions never fetched.
+                     While %d fetched tiles are waiting to be written, further tiles aren't
+                     mirrored and are counted in the MirrorDropped stat.
+    fallback       If "true", tile, raw, and slice-labels requests at a scale unavailable for
+                     their orientation are synthesized from the deepest available scale
+                     up to %d levels finer, fetching the correspondingly larger region and
+                     downsampling by 2x2 averaging per level (the most common label for
+                     uint64 labels).  Such responses have an "X-DVID-Synthesized-Scale: true"
+                     header and the fetched scale in the X-DVID-Source-Scale header.
+                     Requests can override the setting with the "fallback" query string.
+                     If unspecified, "false".
+    sniffimages    If "true", png and jpeg tiles from Google must start with the magic bytes
+                     of their format.  Tiles from Google are always checked for the expected
+                     content type and, for raw data, the expected number of bytes, and
+                     invalid tiles return 502.  If unspecified, "false".
+    statspersist   Interval, at least "1m", between saves of the instance's stats to the
+                     metadata store, e.g., "10m".  Saved stats are restored when the server
+                     restarts, with counters added to those of the new run and gauges like
+                     cache size replaced.  Stats are also saved at shutdown.  If unspecified
+                     or "0", stats aren't persisted.
+    statsmetrics   Comma-separated names of persisted stats: UpstreamRequests, CoalescedRequests,
+                     PassthroughTiles, TranscodedTiles, MirroredTiles, MirrorDropped,
+                     MirrorErrors, MirrorServed, InvalidResponses, HedgedRequests, HedgesWon,
+                     CacheHits, CacheMisses, and the gauges CacheEntries and CacheBytes.  If unspecified, "all".
+    provider       Upstream source of tile data: "brainmaps", the Google BrainMaps API, or
+                     "tilesource", an image tile server (see above).  If unspecified,
+                     "brainmaps".
+    timeout        Limit on each tile or raw request to Google, e.g., "30s", where "0" is no
+                     limit.  If unspecified, the server's DefaultTimeout.
+    retries        Number of times, at most %d, a tile or raw request to Google is retried if
+                     it fails to connect or returns a 429 or 5xx status.  If unspecified, the
+                     server's DefaultRetries.
+    hedgedelay     How long a tile or raw request to Google waits for response headers before
+                     an identical hedge request is sent, e.g., "300ms".  Whichever response
+                     arrives first is used and the other request is canceled.  If unspecified
+                     or "0", requests aren't hedged.
+    hedgepercent   Maximum percentage, 1 to 100, of requests to Google that are hedges, so a
+                     systemic slowdown doesn't double quota use.  If unspecified, %d.
+    hedgequota     Number of requests to Google in a UTC day after which requests aren't
+                     hedged, e.g., a fraction of the API key's daily quota.  If unspecified
+                     or "0", there is no limit.
+    validate-only  If "true", all settings are checked and the volume metadata or a source
+                     tile is fetched, but creation fails with a message holding the JSON of
+                     the instance's scales instead of creating it:
+
+		{ "ValidateOnly": true, "TileMap": {...}, "Scales": [...], "HighResIndex": <index> }
+
+    Unknown settings, e.g., a misspelled "tilsize", cause an error listing the accepted settings.
+
+    If the BrainMaps API rejects the metadata request on creation, the error gives the
+    request URL without the key, Google's message, and for common causes, one of
+    "authkey invalid or expired", "volumeid not found or not shared with this key", or
+    "BrainMaps API not enabled".
+
+    Server-wide Defaults
+
+    Settings left unspecified fall back to defaults shared by all googlevoxels instances on
+    the server, which can be read and changed without a restart through the server API:
+
+    GET  <api URL>/server/settings/googlevoxels
+    POST <api URL>/server/settings/googlevoxels
+
+    The JSON object has the fields DefaultTileSize (1 to %d, initially 512),
+    DefaultTileFormat (initially "png"), DefaultTimeout (initially "0s", no limit), and
+    DefaultRetries (0 to %d, initially 0).  A POST needs the X-DVID-Admin-Token header,
+    changes only the given fields, and persists the defaults across restarts.
+    DefaultTileSize only seeds the tile size of instances created afterwards, while the other
+    defaults apply to subsequent requests of instances without their own setting.
+
+$ dvid repo <UUID> clone-instance <source UUID> <source name> [<data name>] <settings...>
+
+	Adds an instance whose settings, including the scales fetched from Google, are copied
+	from an instance of another repo without contacting Google, e.g., to reference one
+	BrainMaps volume from many repos.  The clone has the source's name unless a data name
+	is given.  Its "authkey" and any settings that can be modified after creation can be
+	overridden.  The clone has no "diskcache" since each instance needs its own directory,
+	and no "mirror" unless given, since the source's mirror is in the source's repo.
+
+	Example:
+
+	$ dvid repo 7b21 clone-instance 3f8c grayscale authkey=Kb71nfe02mzp
+
+$ dvid node <UUID> <data name> export-tiles <plane> <scale> <min tile> <max tile> <dir> [format] <settings...>
+
+	Writes a grid of tiles at one scale to a directory as an image stack.
+
+	Example:
+
+	$ dvid node 3f8c grayscale export-tiles xy 2 0_0_100 9_9_199 /data/export png tilesize=256
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of googlevoxels data.
+    plane         One of "xy", "xz", or "yz".
+    scale         Scaling level where 0 is the highest resolution.
+    min tile      Lowest tile coordinate in the grid, e.g., "0_0_100".
+    max tile      Highest tile coordinate in the grid, inclusive.
+    dir           Output directory, created if necessary, on the server.
+    format        Image format as in the tile endpoint.  If unspecified, the instance's
+                    default format is used ("raw" for float32 and uint64 data).
+
+    Optional Settings
+
+    tilesize      Size in pixels along one dimension of square tile.  If unspecified, the
+                    instance's tile size.
+
+    Tiles are fetched concurrently, at most %d at a time, and written as files named
+    <plane>_<scale>_<x>_<y>_<z>.<ext>, e.g., "xy_2_3_4_100.png".  Tiles outside the volume
+    are skipped.  A manifest.json file records the tile grid, the exported voxel extents at
+    the given scale, the pixel size, and the number of tiles written, skipped, and failed.
+    Failed tiles are listed in retry.json in the form accepted by the POST cache/warm
+    endpoint, with an added "Error" field.  Progress is returned in the command's response.
 
 
     ------------------
 
 HTTP API (Level 2 REST):
 
+Errors are returned as JSON of the form {"error": ..., "kind": ..., "request-id": ...} where
+kind is one of "bad-request" (400), "not-found" (404), "upstream" (502), "storage" (500),
+"conflict" (409), or "unavailable" (503).  Plain text errors are returned if the Accept header prefers text/plain.
+
 GET  <api URL>/node/<UUID>/<data name>/help
 
 	Returns data-specific help message.
 
 
 GET  <api URL>/node/<UUID>/<data name>/info
-
-    Retrieves characteristics of this data in JSON format.
+POST <api URL>/node/<UUID>/<data name>/info
+
+    Retrieves characteristics of this data in JSON format.  A POST with a JSON object in the
+    request body, e.g., {"defaultformat": "jpeg:85"}, modifies settings before returning them.
+    Only the "defaultformat", "format_xy", "format_xz", "format_yz", "proxy", "cabundle",
+    "background", "oob-style", "placeholder", "mirror", "fallback", "sniffimages",
+    "statspersist", "statsmetrics", "timeout", "retries", "hedgedelay", "hedgepercent", and
+    "hedgequota" settings can be modified after creation.  Unknown settings or settings that
+    can't be modified cause an error listing the accepted settings.
+    New "proxy" or "cabundle" settings are only accepted if a test request to Google succeeds.
+    The "Stats" object counts requests to Google and tiles that were passed through exactly
+    as Google delivered them versus tiles that DVID padded, adjusted, or encoded, along with
+    tiles written to, dropped from, or served by any mirror.  "InvalidResponses" counts tiles
+    from Google with the wrong content type or size, and after 3 such tiles in a row, the
+    "Health" status is "degraded" until a valid tile is received.  These counts are since the
+    "Since" time when this server process created or loaded the instance.  If the
+    "statspersist" setting is used, the "Persisted" object has counters accumulated across
+    restarts since its own "Since" time, gauges as of the last save at "Saved", and only the
+    stats selected by "statsmetrics".
+
+    The info is computed from cached properties without any requests to Google, so it returns
+    quickly even when Google is slow or unreachable.  "Ready" is false if the volume geometry
+    hasn't been loaded, in which case a "NotReady" object gives the reason and the error of
+    the last refresh.  "LastRefresh" gives the time and any error of the last refresh.
+    The JSON returned by GET is gzip-encoded if the Accept-Encoding header allows it.
 
     Example: 
 
-    GET <api URL>/node/3f8c/grayscale/info
+    GET <api URL>/node/3f8c/grayscale/info?refresh=true
 
     Arguments:
 
     UUID          Hexidecimal string with enough characters to uniquely identify a version node.
     data name     Name of googlevoxels data.
 
+    Query-string Options:
+
+    refresh       If "true", the volume geometry is reloaded from Google, waiting at most
+                    30 seconds, before the info is returned.  This is the only way info
+                    requests contact Google.  If the refresh fails, the current geometry
+                    is kept and an error is returned.
+
+
+GET  <api URL>/node/<UUID>/<data name>/settings
+
+    Returns a JSON list of the accepted configuration settings, each with its "Name", "Type"
+    ("string", "bool", "int", or "duration"), "Required", "Default", "Modifiable", "Secret",
+    and "Help" fields and its current "Value".  Values of secret settings like "authkey" are
+    masked, and any credentials in the "proxy" setting are omitted.
+
+
+GET  <api URL>/node/<UUID>/<data name>/neuroglancer
+
+    Returns JSON describing a ready-to-use Neuroglancer image layer for the data:
+
+	{
+		"layer": { "type": "image", "source": "dvid://<server URL>/<UUID>/<data name>", "name": <data name> },
+		"url": "<server URL>/api/node/<UUID>/<data name>",
+		"dataType": "uint8",
+		"voxelSize": [8, 8, 8],
+		"voxelUnits": "nm",
+		"bounds": { "min": [0, 0, 0], "max": <volume size> },
+		"info": {
+			"@type": "neuroglancer_multiscale_volume", "type": "image", "data_type": "uint8", "num_channels": 1,
+			"scales": [ { "key": "0", "resolution": [8, 8, 8], "size": [...], "voxel_offset": [0, 0, 0],
+			              "chunk_sizes": [[512, 512, 1]], "encoding": "raw" }, ... ]
+		}
+	}
+
+    The "layer" can be pasted into a Neuroglancer state, and "info" describes the scales in
+    the style of a precomputed volume, where each key is the "scale" of raw requests.  Voxel
+    size and bounds are those of the highest resolution scale.  The server URL is the "BaseURL"
+    of the server configuration if set.  Otherwise it's taken from the request's Host header,
+    or the X-Forwarded-Host, X-Forwarded-Proto, and X-Forwarded-Prefix headers if the server
+    is behind a proxy.  Voxel units are "voxels" for the tilesource provider.
+
+
+GET  <api URL>/node/<UUID>/<data name>/health
+
+    Returns JSON with an overall status ("healthy", "degraded", "down", or "unknown") and the
+    most recent health checks of the Google BrainMaps API.  Requires the "healthcheck" setting.
+
+
+GET  <api URL>/node/<UUID>/<data name>/cache
+DELETE  <api URL>/node/<UUID>/<data name>/cache[?options]
+POST  <api URL>/node/<UUID>/<data name>/cache?warm=<path to JSON>
 
-GET  <api URL>/node/<UUID>/<data name>/tile/<dims>/<scaling>/<tile coord>[?options]
+    Administers the in-memory and disk tile caches, which require the "tilecache" or
+    "diskcache" setting.
 
-    Retrieves a tile of named data within a version node.  The default tile size is used unless
-    the query string "tilesize" is provided.
+    GET returns JSON with the number of entries, bytes used, hit rate, and a histogram of entry
+    ages for the in-memory cache, and a "Disk" object with the entries, bytes, hit rate,
+    evictions, and dropped corrupt entries of the disk cache.
+
+    DELETE evicts cached tiles from both caches, limited to those matching the optional "scale"
+    and "plane" query strings, e.g., "?scale=2&plane=xz".  Returns JSON with the number of tiles
+    evicted from memory ("Evicted") and from disk ("DiskEvicted").
+
+    POST with the "warm" query string loads tiles into the cache.  The value is the path of a
+    JSON file on the server holding a list of tiles, e.g.,
+
+        [{"plane": "xy", "scale": 0, "coord": "10_10_20", "tilesize": 512, "format": "png"}, ...]
+
+    where "tilesize" and "format" are optional.  Returns JSON with the number of tiles warmed.
+
+
+GET  <api URL>/node/<UUID>/<data name>/tile/<dims>/<scaling>/<tile coord>[/<format>][?options]
+
+    Retrieves a tile of named data within a version node.  The instance's tile size is used
+    unless the query string "tilesize" is provided.
 
     Example: 
 
@@ -102,15 +383,73 @@ GET  <api URL>/node/<UUID>/<data name>/tile/<dims>/<scaling>/<tile coord>[?optio
                     Slice strings ("xy", "xz", or "yz") are also accepted.
     scaling       Value from 0 (original resolution) to N where each step is downres by 2.
     tile coord    The tile coordinate in "x_y_z" format.  See discussion of scaling above.
+    format        "raw", "png", "jpeg", "tiff", "bmp" (default: "defaultformat" setting or "png")
+                    jpeg allows lossy quality setting, e.g., "jpeg:80"  (0 <= quality <= 100)
+                    png allows compression levels, e.g., "png:7"  (0 <= level <= 9)
+                    raw returns little-endian voxel values as application/octet-stream.
+                    uint16 data is returned as 16-bit png.  Float and uint64 data require
+                    raw or tiff unless display options are given.  Lossy jpeg is never
+                    used for uint64 labels.
+
+    The "window", "gamma", and "invert" options convert voxel values to 8-bit pixels before
+    encoding, which allows png or jpeg images of float data and png images of uint64 data.  The applied window
+    is returned in the X-Display-Window header as "min,max", along with X-Display-Gamma and
+    X-Display-Invert headers.  The "colormap=hash" option returns uint64 labels as an RGB
+    png with a stable color for each label.  The voxel type and bytes per voxel of the data
+    are returned in the X-DVID-Voxel-Type and X-DVID-Bytes-Per-Voxel headers.  Tiles fetched
+    from Google or read from the "mirror" instance have an X-DVID-Source header of "google"
+    or "mirror".
 
   	Query-string options:
 
-    tilesize      Size in pixels along one dimension of square tile.
-  	noblanks	  If true, any tile request for tiles outside the currently stored extents
-  				  will return a placeholder.
-    format        "png", "jpeg" (default: "png")
-                    jpeg allows lossy quality setting, e.g., "jpeg:80"  (0 <= quality <= 100)
-                    png allows compression levels, e.g., "png:7"  (0 <= level <= 9)
+%s
+GET  <api URL>/node/<UUID>/<data name>/tilestream
+
+    Upgrades the request to a WebSocket that streams tiles as they are fetched.  The client
+    sends JSON text messages requesting tiles with a client-chosen ID, e.g.,
+
+        {"id": 17, "plane": "xy", "scale": 0, "coord": "10_10_20", "format": "jpeg"}
+
+    where "tilesize" is optional like the "tile" endpoint's query string, and each tile is
+    returned in a binary message holding the 4-byte big-endian length of a JSON header, the
+    header, and the encoded tile.  The header gives the "ID", tile spec, and "ContentType".
+    Failed requests, including tiles outside the volume, are returned in text messages, e.g.,
+    {"ID": 17, "Status": 404, "Error": "..."}.  A connection may have at most 64 requests
+    queued or fetching, and further requests fail with status 429.  A request is cancelled
+    by sending {"type": "cancel", "id": 17}.
+
+    Viewport hints give the inclusive range of tiles the client is viewing, e.g.,
+
+        {"type": "viewport", "plane": "xy", "scale": 0, "min": "8_8_20", "max": "12_11_20"}
+
+    Requests for tiles outside the viewport expanded by one tile, or one slice orthogonal to
+    the plane, are cancelled, and the tiles in that ring are fetched into the cache if the
+    instance caches tiles.  Cancelled requests are acknowledged with "Cancelled": true.
+    The connection is closed if no message is received for 10 minutes.
+
+
+GET  <api URL>/node/<UUID>/<data name>/tilebounds/<dims>/<scaling>[?tilesize=512]
+
+    Returns JSON with the inclusive range of valid tile coordinates at a scale and orientation,
+    computed from the scaled volume size and the tile size, e.g.,
+
+        {"Plane": "XY", "Scale": 2, "TileSize": 512, "VolumeSize": [2500, 2000, 1000],
+         "MinTile": [0, 0, 0], "MaxTile": [4, 3, 999]}
+
+    Tiled axes span ceil(volume size / tile size) tiles while the coordinate along the axis
+    orthogonal to the plane, e.g., z for XY tiles, is in voxels of the scaled volume.  The
+    instance's tile size is used unless the "tilesize" query string is provided.  If the
+    scale is unavailable for the orientation, 404 is returned with the available scales.
+    The /info "TileBounds" object gives the bounds for every available orientation and scale
+    at the instance's tile size.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of googlevoxels data.
+    dims          "xy", "xz", or "yz", or the axes in form "i_j", e.g., "0_2" for XZ.
+    scaling       Value from 0 (original resolution) to N where each step is downres by 2.
+
 
 GET  <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>][?options]
 
@@ -127,15 +466,165 @@ GET  <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>][?op
     dims          The axes of data extraction in form i_j.  Example: "0_2" can be XZ.
                     Slice strings ("xy", "xz", or "yz") are also accepted.
     size          Size in voxels along each dimension specified in <dims>.
-    offset        Gives coordinate of first voxel using dimensionality of data.
-    format        "png", "jpeg" (default: "png")
+    offset        Gives coordinate of first voxel using dimensionality of data.  By default,
+                    the offset is in voxels of the scaled volume given by the "scale" option.
+                    With "coords=highres", it is in voxels of the highest resolution volume.
+    format        "raw", "png", "jpeg", "tiff", "bmp" (default: "raw" for float and uint64 data
+                    without display options, otherwise "defaultformat" setting or "png")
                     jpeg allows lossy quality setting, e.g., "jpeg:80"  (0 <= quality <= 100)
                     png allows compression levels, e.g., "png:7"  (0 <= level <= 9)
+                    raw returns little-endian voxel values as application/octet-stream.
+                    uint16 data is returned as 16-bit png.  Float and uint64 data require
+                    raw or tiff unless display options are given.  Lossy jpeg is never
+                    used for uint64 labels.
+
+    The "window", "gamma", and "invert" options convert voxel values to 8-bit pixels before
+    encoding, which allows png or jpeg images of float data and png images of uint64 data.  The applied window
+    is returned in the X-Display-Window header as "min,max", along with X-Display-Gamma and
+    X-Display-Invert headers.  The "colormap=hash" option returns uint64 labels as an RGB
+    png with a stable color for each label.  The voxel type and bytes per voxel of the data
+    are returned in the X-DVID-Voxel-Type and X-DVID-Bytes-Per-Voxel headers.  Tiles fetched
+    from Google or read from the "mirror" instance have an X-DVID-Source header of "google"
+    or "mirror".
+
+    With "coords=highres", the offset is converted to the scaled volume by dividing each
+    coordinate by the ratio of the scaled volume's voxel size to the highest resolution
+    voxel size, so pyramids whose levels aren't exact powers of two are handled.  Either
+    way, the corner and size of the region fetched from the scaled volume are returned in
+    the X-DVID-Upstream-Corner and X-DVID-Upstream-Size headers as "x,y,z".  The size is
+    smaller than requested for regions on the volume edge and "0,0,0" outside the volume.
+
+    With "clip=true", the region is clamped to the bounds of the scaled volume, so a smaller
+    image is returned instead of one padded beyond the volume edge.  The offset and size of
+    the clipped region are returned in the X-DVID-Clipped-Offset and X-DVID-Clipped-Size
+    headers as "x,y,z", and regions entirely outside the volume return 404 with a clipped
+    size of "0,0,0".  The /info "VolumeBounds" object gives the inclusive voxel bounds of
+    every available orientation and scale so viewports can be clamped by clients too.
+
+  	Query-string options:
+
+%s
+POST <api URL>/node/<UUID>/<data name>/values[?options]
+
+    Returns the voxel values at points given as a JSON list of [x,y,z] coordinates in the
+    request body.  The response is a JSON list of values in the same order as the points,
+    with null for points outside the volume.  Points are grouped into small subvolume requests
+    to Google and the number of such requests is returned in the X-Upstream-Requests header.
+    At most %d points can be requested at once.
+
+    Example: 
+
+    POST <api URL>/node/3f8c/grayscale/values?scale=1
+
+    Body: [[10, 20, 30], [11, 20, 30], [5000, 20, 30]]
+
+  	Query-string options:
+
+%s
+GET  <api URL>/node/<UUID>/<data name>/labels-at[?options]
+
+    Returns the labels of a uint64 volume at points given as a JSON list of [x,y,z]
+    coordinates in the request body.  The response is a JSON list of labels in the same
+    order as the points, with 0 for points outside the volume.  As with the "values"
+    endpoint, the number of subvolume requests to Google is returned in the
+    X-Upstream-Requests header and at most %d points can be requested at once.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/segmentation/labels-at
+
+    Body: [[10, 20, 30], [11, 20, 30], [5000, 20, 30]]
+
+  	Query-string options:
+
+%s
+GET  <api URL>/node/<UUID>/<data name>/slice-labels/<dims>/<size>/<offset>[?options]
+
+    Returns a slice of a uint64 volume as little-endian uint64 labels, the same form as
+    labelblk raw slices.  Voxels outside the volume have the "background" label regardless
+    of the "oob-style" setting.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/segmentation/slice-labels/xy/512_256/0_0_100
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+    dims          The axes of data extraction in form i_j.  Example: "0_2" can be XZ.
+                    Slice strings ("xy", "xz", or "yz") are also accepted.
+    size          Size in voxels along each dimension specified in <dims>.
+    offset        Gives coordinate of first voxel using dimensionality of data.
+
+  	Query-string options:
+
+%s
+GET  <api URL>/node/<UUID>/<data name>/transform/<scale>/<plane>?offset=x_y_z[&size=w_h]
+
+    Returns JSON describing how a region in full resolution space maps to the scaled volume
+    used for the given scale and plane, using the actual pixel sizes of the scaled volumes.
+    The result includes the scaled offset and clipped size, the geometry index with its
+    PixelSize and VolumeSize, and whether the region is on the edge of or outside the volume.
+    No requests are made to Google.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/grayscale/transform/2/xy?offset=1024_2048_100&size=512_512
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+    scale         Value from 0 (original resolution) to N where each step is downres by 2.
+    plane         "xy", "xz", or "yz"
 
   	Query-string options:
 
-  	scale         Default is 0.  For scale N, returns an image down-sampled by a factor of 2^N.
-`
+%s
+GET  <api URL>/node/<UUID>/<data name>/orthoviews/<scaling>/<point>[?options]
+
+    Retrieves the XY, XZ, and YZ tiles containing a point as a "multipart/mixed" response,
+    fetching the tiles concurrently.  Each part is named "xy", "xz", or "yz" in its
+    Content-Disposition header and has X-Tile-Coord and X-Tile-Offset headers giving
+    the tile coordinate and voxel offset of the tile.  If there is no scaled volume for an
+    orientation at the given scaling, its part is empty and has an "X-Tile-Missing: true" header.
+
+    Example: 
+
+    GET <api URL>/node/3f8c/grayscale/orthoviews/0/1000_2000_300?format=jpeg:80
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of data.
+    scaling       Value from 0 (original resolution) to N where each step is downres by 2.
+    point         The point coordinate in "x_y_z" format at the given scaling.
+
+  	Query-string options:
+
+%s`
+
+var (
+	tileQueryParams = append(server.QueryParams{
+		{Name: "tilesize", Help: "Size in pixels along one dimension of square tile."},
+		{Name: "noblanks", Help: "If true, any tile request for tiles outside the available volume\nwill return 404 Not Found instead of a blank tile."},
+		{Name: "offline", Help: "If true, the tile is read from the \"mirror\" instance instead of Google."},
+		fallbackQueryParam,
+	}, displayQueryParams...)
+	rawQueryParams = append(server.QueryParams{
+		{Name: "scale", Help: "Default is 0.  For scale N, returns an image down-sampled by a factor of 2^N."},
+		{Name: "coords", Help: "\"scaled\" (default) if the offset is in voxels of the scaled volume, or \"highres\"\nif it is in voxels of the highest resolution volume."},
+		{Name: "offline", Help: "If true, the image is read from the \"mirror\" instance instead of Google."},
+		{Name: "clip", Help: "If true, the region is clipped to the bounds of the scaled volume instead of padded."},
+		fallbackQueryParam,
+	}, displayQueryParams...)
+
+	fallbackQueryParam = server.QueryParam{Name: "fallback", Help: "If true, a scale unavailable for the orientation is synthesized by downsampling\nthe deepest available scale.  Default is the \"fallback\" setting."}
+)
+
+// MaxTileSize is the largest tile size in pixels along one dimension that can be requested.
+const MaxTileSize = 8192
 
 func init() {
 	datastore.Register(NewType())
@@ -145,11 +634,17 @@ func init() {
 	gob.Register(&Data{})
 }
 
+// DefaultTileSize and DefaultTileFormat are the initial server-wide defaults, which can be
+// changed without a restart.  See Defaults().
 var (
 	DefaultTileSize   int32  = 512
 	DefaultTileFormat string = "png"
 )
 
+// RawFormat is the format for returning little-endian voxel values without image encoding.
+// It is the default format of raw requests for float and uint64 data.
+const RawFormat = "raw"
+
 // Type embeds the datastore's Type to create a unique type with tile functions.
 // Refinements of general tile types can be implemented by embedding this type,
 // choosing appropriate # of channels and bytes/voxel, overriding functions as
@@ -159,12 +654,16 @@ var (
 // in the Data type.
 type Type struct {
 	datastore.Type
+
+	// APIURL is the base URL of the BrainMaps API used by new instances, e.g., a fake
+	// server for testing.  If empty, DefaultAPIURL is used.
+	APIURL string
 }
 
 // NewDatatype returns a pointer to a new voxels Datatype with default values set.
 func NewType() *Type {
 	return &Type{
-		datastore.Type{
+		Type: datastore.Type{
 			Name:    "googlevoxels",
 			URL:     "github.com/janelia-flyem/dvid/datatype/googlevoxels",
 			Version: "0.1",
@@ -179,40 +678,176 @@ func NewType() *Type {
 
 // NewData returns a pointer to new googlevoxels data with default values.
 func (dtype *Type) NewDataService(uuid dvid.UUID, id dvid.InstanceID, name dvid.DataString, c dvid.Config) (datastore.DataService, error) {
-	// Make sure we have needed volumeid and authentication key.
-	volumeid, found, err := c.GetString("volumeid")
+	// Reject unknown or malformed settings.  Settings needed by the provider are checked
+	// below.
+	if err := settings.Check(c, false); err != nil {
+		return nil, fmt.Errorf("Cannot make googlevoxels data %q: %s", name, err.Error())
+	}
+	volumeid, _, err := c.GetString("volumeid")
+	if err != nil {
+		return nil, err
+	}
+	authkey, _, err := c.GetString("authkey")
+	if err != nil {
+		return nil, err
+	}
+	tileSize, found, err := c.GetInt("tilesize")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		tileSize = int(Defaults().DefaultTileSize)
+	}
+
+	strict, _, err := c.GetBool("strictqueries")
+	if err != nil {
+		return nil, err
+	}
+	var healthCheck time.Duration
+	healthCheckStr, found, err := c.GetString("healthcheck")
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		healthCheck, _ = time.ParseDuration(healthCheckStr)
+	}
+	failFast, found, err := c.GetBool("healthfailfast")
 	if err != nil {
 		return nil, err
 	}
 	if !found {
-		return nil, fmt.Errorf("Cannot make googlevoxels data without valid 'volumeid' setting.")
+		failFast = true
+	}
+	tileCacheMB, _, err := c.GetInt("tilecache")
+	if err != nil {
+		return nil, err
+	}
+	var diskCache string
+	var diskCacheBytes uint64
+	diskCacheStr, found, err := c.GetString("diskcache")
+	if err != nil {
+		return nil, err
+	}
+	if found && diskCacheStr != "" {
+		if diskCache, diskCacheBytes, err = parseDiskCache(diskCacheStr); err != nil {
+			return nil, fmt.Errorf("Bad 'diskcache' setting: %s", err.Error())
+		}
+	}
+	maxFetch, _, err := c.GetInt("maxfetch")
+	if err != nil {
+		return nil, err
 	}
-	authkey, found, err := c.GetString("authkey")
+	provider, found, err := c.GetString("provider")
 	if err != nil {
 		return nil, err
 	}
 	if !found {
-		return nil, fmt.Errorf("Cannot make googlevoxels data without valid 'authkey' setting.")
+		provider = ProviderBrainMaps
 	}
+	provider = strings.ToLower(provider)
 
-	// Make URL call to get the available scaled volumes.
-	url := fmt.Sprintf("https://www.googleapis.com/brainmaps/v1beta1/volumes/%s?key=%s", volumeid, authkey)
-	resp, err := http.Get(url)
+	// Make URL call to get the available scaled volumes, which also checks any outbound
+	// proxy and CA bundle settings.  A tile source has no metadata, so its scales are given
+	// by settings and a source tile is requested instead.
+	outbound := Properties{VolumeID: volumeid, Provider: provider, APIURL: dtype.APIURL}
+	var tileMap GeometryMap
+	var geoms Geometries
+	var highResIndex GeometryIndex
+	switch provider {
+	case ProviderTileSource:
+		var extent dvid.Point3d
+		var levels int
+		if outbound.URLTemplate, outbound.SourceTileSize, extent, levels, err = tileSourceConfig(c); err != nil {
+			return nil, fmt.Errorf("Cannot make googlevoxels data %q: %s", name, err.Error())
+		}
+		tileMap, geoms = tileSourceGeometries(extent, levels)
+	default:
+		for setting, value := range map[string]string{"volumeid": volumeid, "authkey": authkey} {
+			if value == "" {
+				return nil, fmt.Errorf("Cannot make googlevoxels data %q: Required setting %q is missing", name, setting)
+			}
+		}
+	}
+	if err := outbound.setByConfig(c); err != nil {
+		return nil, err
+	}
+	client, err := upstreamClientFor(outbound.Proxy, outbound.CABundle)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := keyedClient(client, authkey, 0).Get(outbound.checkURL())
 	if err != nil {
-		return nil, fmt.Errorf("Error getting volume metadata from Google: %s", err.Error())
+		return nil, fmt.Errorf("Error getting %s: %s", outbound.checkName(), server.OutboundErrorMessage(err))
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Unexpected status code %d returned when getting volume metadata for %q", resp.StatusCode, volumeid)
+		return nil, fmt.Errorf("Cannot make googlevoxels data %q: %s", name, outbound.checkError(resp, authkey).Error())
+	}
+	if provider == ProviderBrainMaps {
+		metadata, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if tileMap, geoms, highResIndex, err = geometriesFromMetadata(name, metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	// Initialize the googlevoxels data
+	basedata, err := datastore.NewDataService(dtype, uuid, id, name, c)
+	if err != nil {
+		return nil, err
+	}
+	data := &Data{
+		Data: basedata,
+		Properties: Properties{
+			VolumeID:       volumeid,
+			AuthKey:        authkey,
+			TileSize:       int32(tileSize),
+			TileMap:        tileMap,
+			Scales:         geoms,
+			HighResIndex:   highResIndex,
+			StrictQueries:  strict,
+			HealthCheck:    healthCheck,
+			HealthFailFast: failFast,
+			TileCacheMB:    tileCacheMB,
+			DiskCache:      diskCache,
+			DiskCacheBytes: diskCacheBytes,
+			MaxFetch:       int64(maxFetch),
+			Provider:       provider,
+			APIURL:         dtype.APIURL,
+			URLTemplate:    outbound.URLTemplate,
+			SourceTileSize: outbound.SourceTileSize,
+		},
+	}
+	if err := data.Properties.setByConfig(c); err != nil {
+		return nil, err
+	}
+	if err := data.initClient(); err != nil {
+		return nil, err
 	}
-	metadata, err := ioutil.ReadAll(resp.Body)
+	validateOnly, _, err := c.GetBool("validate-only")
 	if err != nil {
 		return nil, err
 	}
+	if validateOnly {
+		return nil, ValidationResult{tileMap, geoms, highResIndex}
+	}
+	data.warnGaps()
+	data.initCache()
+	data.startHealthCheck()
+	data.initStats()
+	return data, nil
+}
+
+// geometriesFromMetadata decodes the scaled volumes in Google volume metadata and maps each
+// tile scale and orientation to its volume.
+func geometriesFromMetadata(name dvid.DataString, metadata []byte) (GeometryMap, Geometries, GeometryIndex, error) {
 	var m struct {
 		Geoms Geometries `json:"geometrys"`
 	}
 	if err := json.Unmarshal(metadata, &m); err != nil {
-		return nil, fmt.Errorf("Error decoding volume JSON metadata: %s", err.Error())
+		return nil, nil, 0, fmt.Errorf("Error decoding volume JSON metadata: %s", err.Error())
 	}
 
 	// Compute the mapping from tile scale/orientation to scaled volume index.
@@ -268,23 +903,7 @@ func (dtype *Type) NewDataService(uuid dvid.UUID, id dvid.InstanceID, name dvid.
 		}
 	}
 
-	// Initialize the googlevoxels data
-	basedata, err := datastore.NewDataService(dtype, uuid, id, name, c)
-	if err != nil {
-		return nil, err
-	}
-	data := &Data{
-		Data: basedata,
-		Properties: Properties{
-			VolumeID:     volumeid,
-			AuthKey:      authkey,
-			TileSize:     DefaultTileSize,
-			TileMap:      tileMap,
-			Scales:       m.Geoms,
-			HighResIndex: highResIndex,
-		},
-	}
-	return data, nil
+	return tileMap, m.Geoms, highResIndex, nil
 }
 
 // log2 returns the power of 2 necessary to cover the given value.
@@ -382,6 +1001,40 @@ func (gm GeometryMap) MarshalJSON() ([]byte, error) {
 	return []byte(s), nil
 }
 
+// maxScale returns the largest scale available for any orientation.
+func (gm GeometryMap) maxScale() Scaling {
+	var maxScale Scaling
+	for tileSpec := range gm {
+		if tileSpec.scaling > maxScale {
+			maxScale = tileSpec.scaling
+		}
+	}
+	return maxScale
+}
+
+// gaps returns the orientation and scale, e.g., "XZ:3", of levels up to the maximum scale
+// that are missing for an orientation.
+func (gm GeometryMap) gaps() []string {
+	var missing []string
+	maxScale := gm.maxScale()
+	for _, plane := range []TileOrientation{XY, XZ, YZ} {
+		for scale := Scaling(0); scale <= maxScale; scale++ {
+			if _, found := gm[TileSpec{scale, plane}]; !found {
+				missing = append(missing, fmt.Sprintf("%s:%d", plane, scale))
+			}
+		}
+	}
+	return missing
+}
+
+// warnGaps logs any orientation and scale combinations missing from the tile map.
+func (d *Data) warnGaps() {
+	if missing := d.TileMap.gaps(); len(missing) != 0 {
+		dvid.Warningf("Google voxels %q (volume %q) lacks %d plane/scale levels: %s\n",
+			d.DataName(), d.VolumeID, len(missing), strings.Join(missing, ", "))
+	}
+}
+
 type GeometryIndex int
 
 // Geometry corresponds to a Volume Geometry in Google BrainMaps API
@@ -473,13 +1126,21 @@ type Geometries []Geometry
 // GoogleTileSpec encapsulates all information needed for tile retrieval (aside from authentication)
 // from the Google BrainMaps API, as well as processing the returned data.
 type GoogleTileSpec struct {
-	offset   dvid.Point3d
+	offset   dvid.Point3d // This is the offset we can retrieve, not necessarily the requested offset
 	size     dvid.Point3d // This is the size we can retrieve, not necessarily the requested size
 	sizeWant dvid.Point3d // This is the requested size.
+	pad      dvid.Point3d // Voxels of padding before the retrieved region in the requested region
 	gi       GeometryIndex
+	scaling  Scaling
+	plane    TileOrientation
 	edge     bool // Is the tile on the edge, i.e., partially outside a scaled volume?
 	outside  bool // Is the tile totally outside any scaled volume?
 
+	// downLevels is the number of times fetched data is downsampled by 2 to synthesize a
+	// scale that is unavailable for the tile's orientation.  The offset and sizes above are
+	// at the available scale.
+	downLevels Scaling
+
 	// cached data that immediately follows from the geometry index
 	channelCount  uint32
 	channelType   string
@@ -490,8 +1151,40 @@ type GoogleTileSpec struct {
 // scaled volume boundaries.  Not that the size parameter is the desired size and not what is required to fit
 // within a scaled volume.
 func (d *Data) GetGoogleSpec(scaling Scaling, plane dvid.DataShape, offset dvid.Point3d, size dvid.Point2d) (*GoogleTileSpec, error) {
+	return d.getGoogleSpec(scaling, plane, offset, size, false)
+}
+
+// getGoogleSpec returns a google-specific tile spec like GetGoogleSpec.  If fallback is true
+// and the orientation lacks the requested scaling, the spec is for the correspondingly larger
+// region at the deepest available scaling within MaxFallbackLevels, and the fetched data
+// must be downsampled to synthesize the requested scaling.
+func (d *Data) getGoogleSpec(scaling Scaling, plane dvid.DataShape, offset dvid.Point3d, size dvid.Point2d, fallback bool) (*GoogleTileSpec, error) {
+	if fallback {
+		tileSpec, err := GetTileSpec(scaling, plane)
+		if err != nil {
+			return nil, err
+		}
+		if _, found := d.TileMap[*tileSpec]; !found {
+			for levels := Scaling(1); levels <= MaxFallbackLevels && levels <= scaling; levels++ {
+				if _, found := d.TileMap[TileSpec{scaling - levels, tileSpec.plane}]; !found {
+					continue
+				}
+				f := int32(1) << levels
+				d0, d1 := GoogleTileSpec{plane: tileSpec.plane}.dims()
+				srcOffset := offset
+				srcOffset[d0] *= f
+				srcOffset[d1] *= f
+				tile, err := d.getGoogleSpec(scaling-levels, plane, srcOffset, dvid.Point2d{size[0] * f, size[1] * f}, false)
+				if err != nil {
+					return nil, err
+				}
+				tile.downLevels = levels
+				return tile, nil
+			}
+		}
+	}
+
 	tile := new(GoogleTileSpec)
-	tile.offset = offset
 
 	// Convert combination of plane and size into 3d size.
 	sizeWant, err := dvid.GetPoint3dFrom2d(plane, size, 1)
@@ -507,69 +1200,57 @@ func (d *Data) GetGoogleSpec(scaling Scaling, plane dvid.DataShape, offset dvid.
 	}
 	geomIndex, found := d.TileMap[*tileSpec]
 	if !found {
-		return nil, fmt.Errorf("Could not find scaled volume in %q for %s with scaling %d", d.DataName(), plane, scaling)
+		return nil, server.NewError(server.NotFoundError, "Could not find scaled volume in %q for %s with scaling %d", d.DataName(), plane, scaling)
 	}
 	geom := d.Scales[geomIndex]
 	tile.gi = geomIndex
+	tile.scaling = scaling
+	tile.plane = tileSpec.plane
 	tile.channelCount = geom.ChannelCount
 	tile.channelType = geom.ChannelType
 
 	// Get the # bytes for each pixel
-	switch geom.ChannelType {
-	case "uint8":
-		tile.bytesPerVoxel = 1
-	case "float":
-		tile.bytesPerVoxel = 4
-	case "uint64":
-		tile.bytesPerVoxel = 8
-	default:
+	bytesPerVoxel, err := dvid.ChannelBytes(geom.ChannelType)
+	if err != nil {
 		return nil, fmt.Errorf("Unknown volume channel type in %s: %s", d.DataName(), geom.ChannelType)
 	}
+	tile.bytesPerVoxel = int32(bytesPerVoxel)
 
-	// Check if the tile is completely outside the volume.
-	volumeSize := geom.VolumeSize
-	if offset[0] >= volumeSize[0] || offset[1] >= volumeSize[1] || offset[2] >= volumeSize[2] {
-		tile.outside = true
-		return tile, nil
-	}
-
-	// Check if the tile is on the edge and adjust size.
-	var adjSize dvid.Point3d = sizeWant
-	maxpt, err := offset.Expand2d(plane, size)
-	for i := 0; i < 3; i++ {
-		if maxpt[i] > volumeSize[i] {
-			tile.edge = true
-			adjSize[i] = volumeSize[i] - offset[i]
-		}
-	}
-	tile.size = adjSize
-
+	// Clip the tile to the volume of the geometry actually serving it, which is at the
+	// fallback scale if the requested scale is synthesized.
+	tile.setPlan(planRequest(geom.VolumeSize, offset, sizeWant))
 	return tile, nil
 }
 
-// Returns the base API URL for retrieving an image tile.  Note that the authentication key
-// or token needs to be added to the returned string to form a valid URL.  The formatStr
-// parameter is of the form "jpeg" or "jpeg:80" or "png:8" where an optional compression
-// level follows the image format and a colon.  Leave formatStr empty for default.
-func (gts GoogleTileSpec) GetURL(volumeid, formatStr string) (string, error) {
+// setPlan sets the retrievable region of the tile and whether it's on the edge of or
+// outside the volume.
+func (gts *GoogleTileSpec) setPlan(plan requestPlan) {
+	gts.offset = plan.offset
+	gts.size = plan.size
+	gts.pad = plan.padLow
+	gts.edge = plan.edge()
+	gts.outside = plan.outside
+}
+
+// Returns the URL for retrieving an image tile from the API at the given base URL.  The URL
+// lacks the authentication key, which is only added to requests by the instance's client.
+// The formatStr parameter is of the form "jpeg" or "jpeg:80" or "png:8" where an optional
+// compression level follows the image format and a colon.  Leave formatStr empty for default.
+func (gts GoogleTileSpec) GetURL(apiURL, volumeid, formatStr string) (string, error) {
 
-	url := fmt.Sprintf("https://www.googleapis.com/brainmaps/v1beta1/volumes/%s:tile?", volumeid)
+	url := fmt.Sprintf("%s/volumes/%s:tile?", apiURL, volumeid)
 	url += fmt.Sprintf("corner=%d,%d,%d&", gts.offset[0], gts.offset[1], gts.offset[2])
 	url += fmt.Sprintf("size=%d,%d,%d&", gts.size[0], gts.size[1], gts.size[2])
 	url += fmt.Sprintf("scale=%d", gts.gi)
 
 	if formatStr != "" {
-		format := strings.Split(formatStr, ":")
-		if format[0] == "jpg" {
-			format[0] = "jpeg"
-		}
-		url += fmt.Sprintf("&format=%s", format[0])
-		if len(format) > 1 {
-			level, err := strconv.Atoi(format[1])
-			if err != nil {
-				return url, err
-			}
-			switch format[0] {
+		format, level, err := parseFormat(formatStr)
+		if err != nil {
+			return url, err
+		}
+		url += fmt.Sprintf("&format=%s", format)
+		if level >= 0 {
+			switch format {
 			case "jpeg":
 				url += fmt.Sprintf("&jpegQuality=%d", level)
 			case "png":
@@ -580,28 +1261,163 @@ func (gts GoogleTileSpec) GetURL(volumeid, formatStr string) (string, error) {
 	return url, nil
 }
 
-// padTile takes returned data and pads it to full tile size.
-func (gts GoogleTileSpec) padTile(data []byte) ([]byte, error) {
+// parseFormat splits a format string like "jpg:80" into the canonical format name and
+// an optional compression level, which is -1 if not given.
+func parseFormat(formatStr string) (format string, level int, err error) {
+	parts := strings.Split(formatStr, ":")
+	format = parts[0]
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if len(parts) == 1 {
+		return format, -1, nil
+	}
+	if len(parts) > 2 {
+		return "", -1, fmt.Errorf("Bad image format %q: expected <format> or <format>:<level>", formatStr)
+	}
+	level, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return "", -1, fmt.Errorf("Bad compression level in image format %q: %s", formatStr, err.Error())
+	}
+	switch {
+	case format == "jpeg" && (level < 0 || level > 100):
+		return "", -1, fmt.Errorf("jpeg quality must be from 0 to 100, not %d", level)
+	case format == "png" && (level < 0 || level > 9):
+		return "", -1, fmt.Errorf("png compression level must be from 0 to 9, not %d", level)
+	}
+	return format, level, nil
+}
 
-	if gts.size[0]*gts.size[1]*gts.bytesPerVoxel != int32(len(data)) {
-		return nil, fmt.Errorf("Before padding, for %d x %d x %d bytes/voxel tile, received %d bytes",
-			gts.size[0], gts.size[1], gts.bytesPerVoxel, len(data))
+// canonicalFormat checks that a format string can be used for tiles, returning it with
+// any alias replaced, e.g., "jpg:85" becomes "jpeg:85".
+func canonicalFormat(formatStr string) (string, error) {
+	format, level, err := parseFormat(formatStr)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := dvid.GetImageEncoder(format); err != nil {
+		return "", err
 	}
+	if level >= 0 {
+		return fmt.Sprintf("%s:%d", format, level), nil
+	}
+	return format, nil
+}
 
-	inRowBytes := gts.size[0] * gts.bytesPerVoxel
-	outRowBytes := gts.sizeWant[0] * gts.bytesPerVoxel
-	outBytes := outRowBytes * gts.sizeWant[1]
+// dims returns the indices of the two dimensions spanned by the tile.
+func (gts GoogleTileSpec) dims() (int, int) {
+	switch gts.plane {
+	case XZ:
+		return 0, 2
+	case YZ:
+		return 1, 2
+	default:
+		return 0, 1
+	}
+}
+
+// imageSize returns the width and height of the requested tile image.
+func (gts GoogleTileSpec) imageSize() (nx, ny int) {
+	d0, d1 := gts.dims()
+	return int(gts.sizeWant[d0] >> gts.downLevels), int(gts.sizeWant[d1] >> gts.downLevels)
+}
+
+// requestedScaling returns the scaling of the requested tile, which is larger than the
+// scaling of the fetched data for synthesized scales.
+func (gts GoogleTileSpec) requestedScaling() Scaling {
+	return gts.scaling + gts.downLevels
+}
+
+// synthesize downsamples the tile's data, padded to the requested tile size, to the
+// requested scaling.
+func (gts GoogleTileSpec) synthesize(data []byte) ([]byte, error) {
+	if gts.downLevels == 0 {
+		return data, nil
+	}
+	d0, d1 := gts.dims()
+	return downsample(data, gts.sizeWant[d0], gts.sizeWant[d1], gts.channelType, gts.downLevels)
+}
+
+// receivedSize returns the width and height of edge tile data of the given length.  Google
+// sometimes clips edge tiles to a size one voxel different from the size we computed, e.g.,
+// on odd downsampled dimensions, so if the length doesn't match the expected size, a width
+// and height within one voxel of it that fit within the requested size are accepted.
+func (gts GoogleTileSpec) receivedSize(numBytes int) (nx, ny int32, err error) {
+	d0, d1 := gts.dims()
+	nx, ny = gts.size[d0], gts.size[d1]
+	if int64(nx)*int64(ny)*int64(gts.bytesPerVoxel) == int64(numBytes) {
+		return nx, ny, nil
+	}
+	// Prefer the expected width, i.e., rows of the expected length.
+	maxX, maxY := gts.sizeWant[d0]-gts.pad[d0], gts.sizeWant[d1]-gts.pad[d1]
+	for _, width := range []int32{nx, nx - 1, nx + 1} {
+		rowBytes := int(width * gts.bytesPerVoxel)
+		if width < 1 || width > maxX || numBytes%rowBytes != 0 {
+			continue
+		}
+		height := int32(numBytes / rowBytes)
+		if height >= 1 && height <= maxY && height >= ny-1 && height <= ny+1 {
+			return width, height, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("Before padding, expected %d x %d x %d bytes/voxel tile (%d bytes) but received %d bytes, which isn't a tile within a voxel of that size",
+		nx, ny, gts.bytesPerVoxel, nx*ny*gts.bytesPerVoxel, numBytes)
+}
+
+// padTile takes returned data and pads it to full tile size, placing it after any leading
+// padding and rendering the padded region with the given fill.  Data clipped to a slightly
+// different size than expected is padded from its actual size.
+func (gts GoogleTileSpec) padTile(data []byte, fill *oobFill) ([]byte, error) {
+	d0, d1 := gts.dims()
+	nx, ny, err := gts.receivedSize(len(data))
+	if err != nil {
+		return nil, err
+	}
+	if nx != gts.size[d0] || ny != gts.size[d1] {
+		dvid.Warningf("Edge tile %s at scale %d, offset %s: expected %d x %d voxels, received %d x %d\n",
+			gts.plane, gts.scaling, gts.offset, gts.size[d0], gts.size[d1], nx, ny)
+	}
+
+	inRowBytes := nx * gts.bytesPerVoxel
+	outRowBytes := gts.sizeWant[d0] * gts.bytesPerVoxel
+	outBytes := outRowBytes * gts.sizeWant[d1]
 	out := make([]byte, outBytes, outBytes)
+	x0, y0 := gts.pad[d0], gts.pad[d1]
 	inI := int32(0)
-	outI := int32(0)
-	for y := int32(0); y < gts.size[1]; y++ {
+	outI := y0*outRowBytes + x0*gts.bytesPerVoxel
+	for y := int32(0); y < ny; y++ {
 		copy(out[outI:outI+inRowBytes], data[inI:inI+inRowBytes])
 		inI += inRowBytes
 		outI += outRowBytes
 	}
+	fill.fill(out, gts.sizeWant[d0], gts.sizeWant[d1], x0, y0, nx, ny)
 	return out, nil
 }
 
+// tileCoord returns the tile coordinate of the tile, i.e., its offset in units of the
+// requested tile size.
+func (gts GoogleTileSpec) tileCoord() dvid.Point3d {
+	var coord dvid.Point3d
+	for i := 0; i < 3; i++ {
+		coord[i] = gts.offset[i] / gts.sizeWant[i]
+	}
+	return coord
+}
+
+// googleEncodes returns true if Google BrainMaps can deliver the tile in the requested
+// format, so we can proxy the response without decoding and re-encoding.
+func (gts GoogleTileSpec) googleEncodes(formatStr string) bool {
+	if gts.edge || gts.channelType != dvid.ChannelUint8 {
+		return false
+	}
+	switch strings.Split(formatStr, ":")[0] {
+	case "png", "jpg", "jpeg":
+		return true
+	default:
+		return false
+	}
+}
+
 // Properties are additional properties for keyvalue data instances beyond those
 // in standard datastore.Data.   These will be persisted to metadata storage.
 type Properties struct {
@@ -620,40 +1436,449 @@ type Properties struct {
 
 	// HighResIndex is the geometry that is the highest resolution among the available scaled volumes.
 	HighResIndex GeometryIndex
+
+	// StrictQueries rejects requests with unknown query-string parameters.
+	StrictQueries bool
+
+	// HealthCheck is the interval between upstream health checks or 0 if none are done.
+	HealthCheck time.Duration
+
+	// HealthFailFast returns errors without upstream requests when health checks show
+	// upstream is down.
+	HealthFailFast bool
+
+	// TileCacheMB is the maximum megabytes of Google responses cached in memory or 0 if
+	// there is no caching.
+	TileCacheMB int
+
+	// DiskCache is the directory of the disk tier of the tile cache, which holds at most
+	// DiskCacheBytes, or empty if there is no disk cache.
+	DiskCache      string
+	DiskCacheBytes uint64
+
+	// MaxFetch is the maximum number of voxels retrieved in a single Google request.  Larger
+	// requests are split into a grid of smaller requests.  If 0, requests are never split.
+	MaxFetch int64
+
+	// DefaultFormat is the image format used when requests don't specify one.  If empty,
+	// DefaultTileFormat is used.
+	DefaultFormat string
+
+	// FormatXY, FormatXZ, and FormatYZ override DefaultFormat for requests of their
+	// orientation if non-empty.
+	FormatXY string
+	FormatXZ string
+	FormatYZ string
+
+	// Proxy and CABundle override the server's outbound settings for requests to Google.
+	Proxy    string
+	CABundle string
+
+	// Background is the voxel value used for blank tiles and the padding of edge tiles.
+	// If empty, the background is 0.
+	Background string
+
+	// OOBStyle is how regions outside the volume are rendered: OOBSolid, OOBChecker, or
+	// OOBBorder.  If empty, OOBSolid is used.
+	OOBStyle string
+
+	// Placeholder, when true, labels blank uint8 tiles with their scale and tile coordinate.
+	Placeholder bool
+
+	// Mirror is the name of a local uint8 voxels instance holding fetched voxels, which are
+	// served when Google is unreachable.  If empty, there is no mirror.
+	Mirror dvid.DataString
+
+	// Fallback, when true, synthesizes tiles and images at scales unavailable for their
+	// orientation by downsampling the deepest available scale.
+	Fallback bool
+
+	// SniffImages, when true, rejects png and jpeg tiles from Google that don't start with
+	// the magic bytes of their format.
+	SniffImages bool
+
+	// Provider is the upstream source of tile data.  If empty, ProviderBrainMaps is used.
+	Provider string
+
+	// URLTemplate and SourceTileSize give the URLs and size of source tiles for the
+	// tilesource provider.
+	URLTemplate    string
+	SourceTileSize int32
+
+	// StatsPersist is the interval between saves of stats to the metadata store or 0 if
+	// stats aren't persisted across restarts.
+	StatsPersist time.Duration
+
+	// StatsMetrics are the names of the persisted stats.  If empty, all stats are persisted.
+	StatsMetrics []string
+
+	// Timeout limits each request to Google, where 0 is no limit, and Retries is the number
+	// of times a failed request is retried.  If nil, the server-wide defaults are used.
+	Timeout *time.Duration
+	Retries *int
+
+	// HedgeDelay is how long a request to Google waits for response headers before an
+	// identical hedge request is sent, or 0 if requests aren't hedged.  HedgePercent caps
+	// hedge requests as a percentage of all requests, where 0 is DefaultHedgePercent, and
+	// HedgeQuota is the number of requests in a day after which requests aren't hedged, where
+	// 0 is no limit.
+	HedgeDelay   time.Duration
+	HedgePercent int
+	HedgeQuota   int
+
+	// APIURL is the base URL of the BrainMaps API.  If empty, DefaultAPIURL is used.
+	APIURL string
+}
+
+// setByConfig sets the properties that can be modified after creation.
+func (p *Properties) setByConfig(c dvid.Config) error {
+	formatStr, found, err := c.GetString("defaultformat")
+	if err != nil {
+		return err
+	}
+	if found {
+		if formatStr != "" {
+			if formatStr, err = canonicalFormat(formatStr); err != nil {
+				return fmt.Errorf("Bad 'defaultformat' setting: %s", err.Error())
+			}
+		}
+		p.DefaultFormat = formatStr
+	}
+	for _, plane := range []TileOrientation{XY, XZ, YZ} {
+		name := "format_" + strings.ToLower(plane.String())
+		formatStr, found, err := c.GetString(name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		if formatStr != "" {
+			if formatStr, err = canonicalFormat(formatStr); err != nil {
+				return fmt.Errorf("Bad '%s' setting: %s", name, err.Error())
+			}
+		}
+		*p.planeFormatSetting(plane) = formatStr
+	}
+	proxy, found, err := c.GetString("proxy")
+	if err != nil {
+		return err
+	}
+	if found {
+		p.Proxy = proxy
+	}
+	caBundle, found, err := c.GetString("cabundle")
+	if err != nil {
+		return err
+	}
+	if found {
+		p.CABundle = caBundle
+	}
+	background, found, err := c.GetString("background")
+	if err != nil {
+		return err
+	}
+	if found {
+		for _, geom := range p.Scales {
+			if _, err := backgroundBytes(background, geom.ChannelType); err != nil {
+				return fmt.Errorf("Bad 'background' setting: %s", err.Error())
+			}
+		}
+		p.Background = background
+	}
+	oobStyle, found, err := c.GetString("oob-style")
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := checkOOBStyle(oobStyle); err != nil {
+			return fmt.Errorf("Bad 'oob-style' setting: %s", err.Error())
+		}
+		p.OOBStyle = oobStyle
+	}
+	placeholder, found, err := c.GetBool("placeholder")
+	if err != nil {
+		return err
+	}
+	if found {
+		p.Placeholder = placeholder
+	}
+	mirror, found, err := c.GetString("mirror")
+	if err != nil {
+		return err
+	}
+	if found {
+		p.Mirror = dvid.DataString(mirror)
+	}
+	fallback, found, err := c.GetBool("fallback")
+	if err != nil {
+		return err
+	}
+	if found {
+		p.Fallback = fallback
+	}
+	sniffImages, found, err := c.GetBool("sniffimages")
+	if err != nil {
+		return err
+	}
+	if found {
+		p.SniffImages = sniffImages
+	}
+	statsPersist, found, err := c.GetString("statspersist")
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := checkStatsPersist(statsPersist); err != nil {
+			return fmt.Errorf("Bad 'statspersist' setting: %s", err.Error())
+		}
+		p.StatsPersist = 0
+		if statsPersist != "" {
+			p.StatsPersist, _ = time.ParseDuration(statsPersist)
+		}
+	}
+	statsMetrics, found, err := c.GetString("statsmetrics")
+	if err != nil {
+		return err
+	}
+	if found {
+		if p.StatsMetrics, err = parseStatsMetrics(statsMetrics); err != nil {
+			return fmt.Errorf("Bad 'statsmetrics' setting: %s", err.Error())
+		}
+	}
+	timeoutStr, found, err := c.GetString("timeout")
+	if err != nil {
+		return err
+	}
+	if found {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("Bad 'timeout' setting %q: must be a non-negative duration", timeoutStr)
+		}
+		p.Timeout = &timeout
+	}
+	retries, found, err := c.GetInt("retries")
+	if err != nil {
+		return err
+	}
+	if found {
+		if retries < 0 || retries > MaxRetries {
+			return fmt.Errorf("Bad 'retries' setting %d: must be between 0 and %d", retries, MaxRetries)
+		}
+		p.Retries = &retries
+	}
+	hedgeDelayStr, found, err := c.GetString("hedgedelay")
+	if err != nil {
+		return err
+	}
+	if found {
+		hedgeDelay, err := time.ParseDuration(hedgeDelayStr)
+		if err != nil || hedgeDelay < 0 {
+			return fmt.Errorf("Bad 'hedgedelay' setting %q: must be a non-negative duration", hedgeDelayStr)
+		}
+		p.HedgeDelay = hedgeDelay
+	}
+	hedgePercent, found, err := c.GetInt("hedgepercent")
+	if err != nil {
+		return err
+	}
+	if found {
+		if hedgePercent < 1 || hedgePercent > 100 {
+			return fmt.Errorf("Bad 'hedgepercent' setting %d: must be between 1 and 100", hedgePercent)
+		}
+		p.HedgePercent = hedgePercent
+	}
+	hedgeQuota, found, err := c.GetInt("hedgequota")
+	if err != nil {
+		return err
+	}
+	if found {
+		if hedgeQuota < 0 {
+			return fmt.Errorf("Bad 'hedgequota' setting %d: must not be negative", hedgeQuota)
+		}
+		p.HedgeQuota = hedgeQuota
+	}
+	return nil
+}
+
+// proxyURL returns the instance's proxy URL without any credentials.
+func (p *Properties) proxyURL() string {
+	u, err := url.Parse(p.Proxy)
+	if err != nil || u.User == nil {
+		return p.Proxy
+	}
+	u.User = nil
+	return u.String()
+}
+
+// defaultFormat returns the image format to use when a request doesn't specify one.
+func (p *Properties) defaultFormat() string {
+	if p.DefaultFormat != "" {
+		return p.DefaultFormat
+	}
+	return Defaults().DefaultTileFormat
+}
+
+// planeFormatSetting returns the format setting for requests of the given orientation.
+func (p *Properties) planeFormatSetting(plane TileOrientation) *string {
+	switch plane {
+	case XZ:
+		return &p.FormatXZ
+	case YZ:
+		return &p.FormatYZ
+	default:
+		return &p.FormatXY
+	}
+}
+
+// planeFormat returns the image format to use when a request of the given orientation
+// doesn't specify one.
+func (p *Properties) planeFormat(plane TileOrientation) string {
+	if format := *p.planeFormatSetting(plane); format != "" {
+		return format
+	}
+	return p.defaultFormat()
+}
+
+// timeout returns the limit on each request to Google, where 0 is no limit.
+func (p *Properties) timeout() time.Duration {
+	if p.Timeout != nil {
+		return *p.Timeout
+	}
+	return Defaults().timeout()
+}
+
+// retries returns the number of times a failed request to Google is retried.
+func (p *Properties) retries() int {
+	if p.Retries != nil {
+		return *p.Retries
+	}
+	return Defaults().DefaultRetries
+}
+
+// apiURL returns the base URL of the BrainMaps API.
+func (p *Properties) apiURL() string {
+	if p.APIURL == "" {
+		return DefaultAPIURL
+	}
+	return p.APIURL
+}
+
+// provider returns the upstream source of tile data.
+func (p *Properties) provider() string {
+	if p.Provider == "" {
+		return ProviderBrainMaps
+	}
+	return p.Provider
+}
+
+// background returns the voxel value used outside the volume.
+func (p *Properties) background() string {
+	if p.Background != "" {
+		return p.Background
+	}
+	return "0"
+}
+
+// oobStyle returns how regions outside the volume are rendered.
+func (p *Properties) oobStyle() string {
+	if p.OOBStyle != "" {
+		return p.OOBStyle
+	}
+	return OOBSolid
 }
 
 // MarshalJSON handles JSON serialization for googlevoxels Data.  It adds "Levels" metadata equivalent
 // to multiscale2d's tile specification so clients can treat googlevoxels tile API identically to
-// multiscale2d.  Sensitive information like AuthKey are withheld.
+// multiscale2d.  "PlaneLevels" gives the same metadata for each orientation, only listing the
+// levels actually available for that orientation, "TileBounds" gives the valid tile coordinates
+// of those levels, and "VolumeBounds" their voxel bounds.  Sensitive information like AuthKey are withheld.  Levels are omitted if the
+// volume geometry hasn't been loaded.
 func (p Properties) MarshalJSON() ([]byte, error) {
+	var levels multiscale2d.TileSpec
+	var planeLevels map[string]multiscale2d.TileSpec
+	if int(p.HighResIndex) < len(p.Scales) {
+		levels = getTileSpec(p.TileSize, p.Scales[p.HighResIndex], p.TileMap)
+		planeLevels = getPlaneTileSpecs(p.TileSize, p.Scales[p.HighResIndex], p.TileMap)
+	}
 	return json.Marshal(struct {
-		VolumeID     string
-		TileSize     int32
-		TileMap      GeometryMap
-		Scales       Geometries
-		HighResIndex GeometryIndex
-		Levels       multiscale2d.TileSpec
+		VolumeID       string
+		TileSize       int32
+		TileMap        GeometryMap
+		Scales         Geometries
+		HighResIndex   GeometryIndex
+		Levels         multiscale2d.TileSpec
+		PlaneLevels    map[string]multiscale2d.TileSpec
+		TileBounds     map[string]map[string]TileBounds
+		VolumeBounds   map[string]map[string]VolumeBounds
+		StrictQueries  bool
+		HealthCheck    string
+		HealthFailFast bool
+		TileCacheMB    int
+		DiskCache      string `json:",omitempty"`
+		DiskCacheBytes uint64 `json:",omitempty"`
+		MaxFetch       int64
+		DefaultFormat  string
+		FormatXY       string `json:",omitempty"`
+		FormatXZ       string `json:",omitempty"`
+		FormatYZ       string `json:",omitempty"`
+		Proxy          string
+		CABundle       string
+		Background     string
+		OOBStyle       string
+		Placeholder    bool
+		Mirror         dvid.DataString
+		Fallback       bool
+		SniffImages    bool
+		Provider       string
+		URLTemplate    string `json:",omitempty"`
+		SourceTileSize int32  `json:",omitempty"`
+		Timeout        string
+		Retries        int
 	}{
 		p.VolumeID,
 		p.TileSize,
 		p.TileMap,
 		p.Scales,
 		p.HighResIndex,
-		getTileSpec(p.TileSize, p.Scales[p.HighResIndex], p.TileMap),
+		levels,
+		planeLevels,
+		p.allTileBounds(p.tileSize()),
+		p.allVolumeBounds(),
+		p.StrictQueries,
+		p.HealthCheck.String(),
+		p.HealthFailFast,
+		p.TileCacheMB,
+		p.DiskCache,
+		p.DiskCacheBytes,
+		p.MaxFetch,
+		p.defaultFormat(),
+		p.FormatXY,
+		p.FormatXZ,
+		p.FormatYZ,
+		p.proxyURL(),
+		p.CABundle,
+		p.background(),
+		p.oobStyle(),
+		p.Placeholder,
+		p.Mirror,
+		p.Fallback,
+		p.SniffImages,
+		p.provider(),
+		p.URLTemplate,
+		p.SourceTileSize,
+		p.timeout().String(),
+		p.retries(),
 	})
 }
 
 // Converts Google BrainMaps scaling to multiscale2d-style tile specifications.
-// This assumes that Google levels always downsample by 2.
+// This assumes that Google levels always downsample by 2.  Since orientations may have
+// different numbers of levels, this spec may advertise levels that are unavailable for
+// some orientations.  See getPlaneTileSpecs.
 func getTileSpec(tileSize int32, hires Geometry, tileMap GeometryMap) multiscale2d.TileSpec {
 	// Determine how many levels we have by the max of any orientation.
-	// TODO -- Warn user in some way if BrainMaps API has levels in one orientation but not in other.
-	var maxScale Scaling
-	for tileSpec := range tileMap {
-		if tileSpec.scaling > maxScale {
-			maxScale = tileSpec.scaling
-		}
-	}
+	maxScale := tileMap.maxScale()
 
 	// Create the levels from 0 (hires) to max level.
 	levelSpec := multiscale2d.LevelSpec{
@@ -672,10 +1897,47 @@ func getTileSpec(tileSize int32, hires Geometry, tileMap GeometryMap) multiscale
 	return ms2dTileSpec
 }
 
+// getPlaneTileSpecs returns multiscale2d-style tile specifications for each orientation,
+// keyed by orientation name, that only include levels available for that orientation.
+func getPlaneTileSpecs(tileSize int32, hires Geometry, tileMap GeometryMap) map[string]multiscale2d.TileSpec {
+	levels := getTileSpec(tileSize, hires, tileMap)
+	planeSpecs := make(map[string]multiscale2d.TileSpec, 3)
+	for _, plane := range []TileOrientation{XY, XZ, YZ} {
+		planeSpec := multiscale2d.TileSpec{}
+		for scale, levelSpec := range levels {
+			if _, found := tileMap[TileSpec{Scaling(scale), plane}]; found {
+				planeSpec[scale] = levelSpec
+			}
+		}
+		planeSpecs[plane.String()] = planeSpec
+	}
+	return planeSpecs
+}
+
 // Data embeds the datastore's Data and extends it with voxel-specific properties.
 type Data struct {
 	*datastore.Data
 	Properties
+
+	// Runtime state, which is not persisted.
+	clientMu sync.RWMutex
+	client   *http.Client
+	health   *healthChecker
+	flights  flightGroup
+	stats    instanceStats
+	cache    *dvid.Cache
+	disk     *diskCache
+	closed   int32    // set atomically when the instance is shut down
+	source   upstream // if non-nil, overrides the upstream for the instance's provider
+
+	mirrorOnce   sync.Once // starts mirrorWriter on the first write to the mirror
+	mirrorWriter *mirrorWriter
+
+	statsPersist *statsPersister // nil if stats have never been persisted by this process
+
+	refreshing int32 // set atomically while the volume geometry is being refreshed
+	refreshMu  sync.Mutex
+	refreshed  *RefreshResult
 }
 
 func (d *Data) GetVoxelSize(ts *TileSpec) (dvid.NdFloat32, error) {
@@ -696,13 +1958,25 @@ func (d *Data) GetVoxelSize(ts *TileSpec) (dvid.NdFloat32, error) {
 	return geom.PixelSize, nil
 }
 
+// MarshalJSON returns the cached properties and runtime state of the instance.  It never
+// makes requests to Google, so /info responds quickly even if Google is unreachable.
 func (d *Data) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Base     *datastore.Data
-		Extended Properties
+		Base        *datastore.Data
+		Extended    Properties
+		Ready       bool
+		NotReady    *NotReady      `json:",omitempty"`
+		LastRefresh *RefreshResult `json:",omitempty"`
+		Health      *HealthReport
+		Stats       Stats
 	}{
 		d.Data,
 		d.Properties,
+		d.ready(),
+		d.notReady(),
+		d.lastRefresh(),
+		d.Health(),
+		d.statsReport(),
 	})
 }
 
@@ -715,6 +1989,13 @@ func (d *Data) GobDecode(b []byte) error {
 	if err := dec.Decode(&(d.Properties)); err != nil {
 		return err
 	}
+	if err := d.initClient(); err != nil {
+		dvid.Errorf("Unable to use outbound settings for %q: %s\n", d.DataName(), err.Error())
+	}
+	d.warnGaps()
+	d.initCache()
+	d.startHealthCheck()
+	d.initStats()
 	return nil
 }
 
@@ -730,12 +2011,60 @@ func (d *Data) GobEncode() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// Shutdown stops background health checks and mirror writes, saves any persisted stats, and
+// releases cached tiles.  It is called when the data instance is deleted or the server shuts
+// down, after which any requests still routed to this instance return 404.
+func (d *Data) Shutdown() {
+	if !atomic.CompareAndSwapInt32(&d.closed, 0, 1) {
+		return
+	}
+	if d.health != nil {
+		d.health.close()
+		<-d.health.done
+	}
+	d.stopMirrorWriter()
+	d.stopStatsPersist()
+	if d.cache != nil {
+		d.cache.Clear(nil)
+	}
+}
+
 // --- DataService interface ---
 
 func (d *Data) Help() string {
 	return HelpMessage
 }
 
+// ModifyConfig changes settings that can be modified after creation, e.g., "defaultformat".
+// Unknown settings or those that can't be modified are rejected.  Changes to the outbound
+// proxy or CA bundle are only made if a test request to Google succeeds with the new settings.
+func (d *Data) ModifyConfig(config dvid.Config) error {
+	if err := settings.Check(config, true); err != nil {
+		return err
+	}
+	props := d.Properties
+	if err := props.setByConfig(config); err != nil {
+		return err
+	}
+	if props.Proxy != d.Proxy || props.CABundle != d.CABundle {
+		client, err := upstreamClientFor(props.Proxy, props.CABundle)
+		if err != nil {
+			return err
+		}
+		if err := d.verifyUpstream(client); err != nil {
+			return err
+		}
+		d.setClient(client)
+	}
+	restartStats := props.StatsPersist != d.StatsPersist
+	d.Properties = props
+	if restartStats {
+		d.stopStatsPersist()
+		d.startStatsPersist()
+	}
+	return nil
+}
+
 // Send transfers all key-value pairs pertinent to this data type as well as
 // the storage.DataStoreType for them.
 func (d *Data) Send(s message.Socket, roiname string, uuid dvid.UUID) error {
@@ -743,8 +2072,8 @@ func (d *Data) Send(s message.Socket, roiname string, uuid dvid.UUID) error {
 	return nil
 }
 
-// getBlankTileData returns a background 2d tile data
-func (d *Data) getBlankTileImage(tile *GoogleTileSpec) (image.Image, error) {
+// getBlankTileData returns background 2d tile data
+func (d *Data) getBlankTileData(tile *GoogleTileSpec) ([]byte, error) {
 	if tile == nil {
 		return nil, fmt.Errorf("Can't get blank tile for unknown tile spec")
 	}
@@ -752,116 +2081,172 @@ func (d *Data) getBlankTileImage(tile *GoogleTileSpec) (image.Image, error) {
 		return nil, fmt.Errorf("Scaled volumes for %d not suitable for tile spec", d.DataName())
 	}
 
+	fill, err := d.oobFill(tile)
+	if err != nil {
+		return nil, err
+	}
+
 	// Generate the blank image
-	numBytes := tile.sizeWant[0] * tile.sizeWant[1] * tile.bytesPerVoxel
+	nx, ny := tile.imageSize()
+	numBytes := int32(nx*ny) * tile.bytesPerVoxel
 	data := make([]byte, numBytes, numBytes)
-	return dvid.GoImageFromData(data, int(tile.sizeWant[0]), int(tile.sizeWant[1]))
-}
-
-func (d *Data) serveTile(w http.ResponseWriter, r *http.Request, tile *GoogleTileSpec, formatStr string, noblanks bool) error {
-	// If it's outside, write blank tile unless user wants no blanks.
-	if tile.outside {
-		if noblanks {
-			http.NotFound(w, r)
-			return fmt.Errorf("Requested tile is outside of available volume.")
+	fill.fill(data, int32(nx), int32(ny), 0, 0, 0, 0)
+	if d.Placeholder && tile.channelType == dvid.ChannelUint8 {
+		coord := tile.tileCoord()
+		lines := []string{
+			"outside volume",
+			fmt.Sprintf("scale %d, tile %d_%d_%d", tile.requestedScaling(), coord[0], coord[1], coord[2]),
 		}
-		img, err := d.getBlankTileImage(tile)
-		if err != nil {
-			return err
+		if err := drawPlaceholder(data, nx, ny, lines, fill.contrast[0]); err != nil {
+			return nil, err
 		}
-		return dvid.WriteImageHttp(w, img, formatStr)
 	}
+	return data, nil
+}
 
-	// If we are within volume, get data from Google.
-	url, err := tile.GetURL(d.VolumeID, formatStr)
+// getTileData returns the tile's raw data from upstream, padded to the requested tile size.
+func (d *Data) getTileData(requestID string, tile *GoogleTileSpec) ([]byte, error) {
+	if d.needsSplit(tile) {
+		return d.getSplitTileData(requestID, tile)
+	}
+	data, _, err := d.fetcher().FetchTile(fetchContext(requestID), *tile, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	urlSansKey := url
-	url += fmt.Sprintf("&key=%s", d.AuthKey)
-
-	timedLog := dvid.NewTimeLog()
-	resp, err := http.Get(url)
+	dvid.Infof("[%s] Got raw tile from upstream, %d bytes\n", requestID, len(data))
+	if !tile.edge {
+		return data, nil
+	}
+	fill, err := d.oobFill(tile)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	timedLog.Infof("PROXY HTTP to Google: %s, returned %d", urlSansKey, resp.StatusCode)
-	defer resp.Body.Close()
+	paddedData, err := tile.padTile(data, fill)
+	if err != nil {
+		return nil, server.NewError(server.UpstreamError, "%s", err.Error())
+	}
+	return paddedData, nil
+}
 
-	// Set the image header
-	if err := dvid.SetImageHeader(w, formatStr); err != nil {
-		return err
+// serveTile writes the tile as an image in the given format.  Tiles are served in stages:
+// fetch from the instance's upstream, optional padding and assembly of split requests,
+// optional downsampling to a synthesized scale, optional display adjustment, and encoding.
+// If upstream can deliver the requested format and no other stage is needed, upstream's
+// response is passed through untouched.  If a mirror is given, fetched data is
+// queued for the mirror or, for offline requests, read from the mirror instead of Google.
+func (d *Data) serveTile(w http.ResponseWriter, r *http.Request, requestID string, tile *GoogleTileSpec, formatStr string, noblanks bool, display *displayAdjust, mirror *mirrorTarget) error {
+	w.Header().Set("X-DVID-Voxel-Type", tile.channelType)
+	w.Header().Set("X-DVID-Bytes-Per-Voxel", strconv.Itoa(int(tile.bytesPerVoxel)))
+	w.Header().Set("X-DVID-Format", formatStr)
+
+	// Make sure we can deliver the requested format for this channel type.
+	if err := display.checkFormat(tile.channelType, formatStr); err != nil {
+		return fmt.Errorf("Data %q: %s", d.DataName(), err.Error())
+	}
+	nx, ny := tile.imageSize()
+	if tile.downLevels != 0 {
+		w.Header().Set("X-DVID-Synthesized-Scale", "true")
+		w.Header().Set("X-DVID-Source-Scale", strconv.Itoa(int(tile.scaling)))
 	}
 
-	// If it's on edge, we need to pad the tile to the tile size.
-	if tile.edge {
-		// We need to read whole thing in to pad it.
-		data, err := ioutil.ReadAll(resp.Body)
-		dvid.Infof("Got edge tile from Google, %d bytes\n", len(data))
-		if err != nil {
-			return err
+	// If it's outside, write blank tile unless user wants no blanks.
+	if tile.outside {
+		if noblanks {
+			return server.NewError(server.NotFoundError, "Requested tile is outside of available volume.")
 		}
-		paddedData, err := tile.padTile(data)
+		data, err := d.getBlankTileData(tile)
 		if err != nil {
 			return err
 		}
-		_, err = w.Write(paddedData)
-		return err
-	}
-
-	// If we aren't on edge or outside, our return status should be OK.
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Unexpected status code %d on tile request (%q, volume id %q)", resp.StatusCode, d.DataName(), d.VolumeID)
+		return display.encodeImage(w, data, nx, ny, tile.channelType, formatStr)
 	}
 
-	// Just send the data as we get it from Google in chunks.
-	respBytes := 0
-	const BufferSize = 32 * 1024
-	buf := make([]byte, BufferSize)
-	for {
-		n, err := resp.Body.Read(buf)
-		respBytes += n
-		eof := (err == io.EOF)
-		if err != nil && !eof {
+	if mirror != nil && mirror.offline {
+		data, err := d.getMirrorData(mirror, tile)
+		if err != nil {
 			return err
 		}
-		if _, err = w.Write(buf[:n]); err != nil {
+		if data, err = tile.synthesize(data); err != nil {
 			return err
 		}
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
-		}
-		if eof {
-			break
-		}
+		atomic.AddUint64(&d.stats.mirrorServed, 1)
+		w.Header().Set("X-DVID-Source", SourceMirror)
+		return display.encodeImage(w, data, nx, ny, tile.channelType, formatStr)
+	}
+	w.Header().Set("X-DVID-Source", SourceGoogle)
+
+	// Pass Google's encoding through if it matches the request and nothing else is needed.
+	// Mirrored tiles need their voxels, so they are always decoded.
+	unmodified := display == nil && !tile.edge && !d.needsSplit(tile) && tile.downLevels == 0
+	if unmodified && tile.googleEncodes(formatStr) && !d.mirrors(mirror, tile) {
+		atomic.AddUint64(&d.stats.passthroughTiles, 1)
+		return d.writeEncodedTile(w, requestID, tile, formatStr)
+	}
+
+	// Otherwise get the raw data, padded and assembled as necessary, and encode it ourselves.
+	// Raw data that needs no changes is also passed through.
+	data, err := d.getTileData(requestID, tile)
+	if err != nil {
+		return err
+	}
+	d.queueMirror(mirror, tile, data)
+	if data, err = tile.synthesize(data); err != nil {
+		return err
+	}
+	if unmodified && formatStr == RawFormat {
+		atomic.AddUint64(&d.stats.passthroughTiles, 1)
+	} else {
+		atomic.AddUint64(&d.stats.transcodedTiles, 1)
+	}
+	return display.encodeImage(w, data, nx, ny, tile.channelType, formatStr)
+}
+
+// writeEncodedTile writes a tile in the given format as it is received from upstream.
+func (d *Data) writeEncodedTile(w http.ResponseWriter, requestID string, tile *GoogleTileSpec, formatStr string) error {
+	data, mimeType, err := d.fetcher().FetchTile(fetchContext(requestID), *tile, formatStr)
+	if err != nil {
+		return err
 	}
-	dvid.Infof("Got non-edge tile from Google, %d bytes\n", respBytes)
+	w.Header().Set("Content-type", mimeType)
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	dvid.Infof("[%s] Got non-edge tile from upstream, %d bytes\n", requestID, len(data))
 	return nil
 }
 
-// ServeImage returns an image with appropriate Content-Type set.  This function differs
-// from ServeTile in the way parameters are passed to it.  ServeTile accepts a tile coordinate.
-// This function allows arbitrary offset and size, unconstrained by tile sizes.
-func (d *Data) ServeImage(w http.ResponseWriter, r *http.Request, parts []string) error {
+// parseSliceRequest returns the plane, size, and offset of a slice request given as
+// <dims>/<size>/<offset> after the endpoint.
+func parseSliceRequest(parts []string) (dvid.DataShape, dvid.Point2d, dvid.Point3d, error) {
+	var plane dvid.DataShape
+	var size dvid.Point2d
+	var offset dvid.Point3d
 	if len(parts) < 7 {
-		return fmt.Errorf("%q must be followed by shape/size/offset", parts[3])
+		return plane, size, offset, fmt.Errorf("%q must be followed by shape/size/offset", parts[3])
 	}
 	shapeStr, sizeStr, offsetStr := parts[4], parts[5], parts[6]
 	planeStr := dvid.DataShapeString(shapeStr)
 	plane, err := planeStr.DataShape()
 	if err != nil {
-		return err
+		return plane, size, offset, err
 	}
 	if plane.ShapeDimensions() != 2 {
-		return fmt.Errorf("Quadtrees can only return 2d images not %s", plane)
+		return plane, size, offset, fmt.Errorf("Quadtrees can only return 2d images not %s", plane)
 	}
-
-	size, err := dvid.StringToPoint2d(sizeStr, "_")
-	if err != nil {
-		return err
+	if size, err = dvid.StringToPoint2d(sizeStr, "_"); err != nil {
+		return plane, size, offset, err
 	}
+	if offset, err = dvid.StringToPoint3d(offsetStr, "_"); err != nil {
+		return plane, size, offset, err
+	}
+	return plane, size, offset, nil
+}
 
-	offset, err := dvid.StringToPoint3d(offsetStr, "_")
+// ServeImage returns an image with appropriate Content-Type set.  This function differs
+// from ServeTile in the way parameters are passed to it.  ServeTile accepts a tile coordinate.
+// This function allows arbitrary offset and size, unconstrained by tile sizes.
+func (d *Data) ServeImage(ctx context.Context, w http.ResponseWriter, r *http.Request, requestID string, parts []string) error {
+	plane, size, offset, err := parseSliceRequest(parts)
 	if err != nil {
 		return err
 	}
@@ -870,86 +2255,208 @@ func (d *Data) ServeImage(w http.ResponseWriter, r *http.Request, parts []string
 	if len(parts) >= 8 {
 		formatStr = parts[7]
 	}
-	if formatStr == "" {
-		formatStr = DefaultTileFormat
-	}
 
 	// See if scaling was specified in query string, otherwise use high-res (scale 0)
-	var scale Scaling
-	queryValues := r.URL.Query()
-	scalingStr := queryValues.Get("scale")
-	if scalingStr != "" {
-		scale64, err := strconv.ParseUint(scalingStr, 10, 8)
-		if err != nil {
-			return fmt.Errorf("Illegal tile scale: %s (%s)", scalingStr, err.Error())
+	query, err := server.NewQuery(r, rawQueryParams, d.StrictQueries)
+	if err != nil {
+		return err
+	}
+	scale, err := query.GetInt("scale", 0, 0, 255)
+	if err != nil {
+		return err
+	}
+	display, err := getDisplayAdjust(query)
+	if err != nil {
+		return err
+	}
+	mirror, err := d.getMirror(ctx, query)
+	if err != nil {
+		return err
+	}
+	fallback, err := query.GetBool("fallback", d.Fallback)
+	if err != nil {
+		return err
+	}
+	switch coords := query.GetString("coords", CoordsScaled); coords {
+	case CoordsScaled:
+	case CoordsHighRes:
+		if offset, err = d.scaledOffset(Scaling(scale), plane, offset, fallback); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Bad coords option %q: must be %q or %q", coords, CoordsScaled, CoordsHighRes)
+	}
+	clip, err := query.GetBool("clip", false)
+	if err != nil {
+		return err
+	}
+	if clip {
+		if offset, size, err = d.clipRaw(w, Scaling(scale), plane, offset, size, fallback); err != nil {
+			return err
 		}
-		scale = Scaling(scale64)
 	}
 
 	// Determine how this request sits in the available scaled volumes.
-	googleTile, err := d.GetGoogleSpec(scale, plane, offset, size)
+	googleTile, err := d.getGoogleSpec(Scaling(scale), plane, offset, size, fallback)
 	if err != nil {
 		return err
 	}
+	corner, fetched := googleTile.offset, googleTile.size
+	w.Header().Set("X-DVID-Upstream-Corner", fmt.Sprintf("%d,%d,%d", corner[0], corner[1], corner[2]))
+	w.Header().Set("X-DVID-Upstream-Size", fmt.Sprintf("%d,%d,%d", fetched[0], fetched[1], fetched[2]))
+
+	// Float and uint64 data default to raw voxel values unless display options are given.
+	if formatStr == "" {
+		switch {
+		case display == nil && (googleTile.channelType == dvid.ChannelFloat32 || googleTile.channelType == dvid.ChannelUint64):
+			formatStr = RawFormat
+		default:
+			formatStr = d.planeFormat(googleTile.plane)
+		}
+	}
 
 	// Send the tile.
-	return d.serveTile(w, r, googleTile, formatStr, true)
+	return d.serveTile(w, r, requestID, googleTile, formatStr, true, display, mirror)
+}
+
+// Values of the "coords" option of raw requests, which give the voxel space of the offset.
+const (
+	CoordsScaled  = "scaled"
+	CoordsHighRes = "highres"
+)
+
+// scaledOffset converts an offset in voxels of the highest resolution volume to voxels of
+// the scaled volume used for a request, dividing by the ratio of their voxel sizes.  If the
+// scale is synthesized by fallback, the ratio includes the downsampling.
+func (d *Data) scaledOffset(scaling Scaling, plane dvid.DataShape, offset dvid.Point3d, fallback bool) (dvid.Point3d, error) {
+	tileSpec, err := GetTileSpec(scaling, plane)
+	if err != nil {
+		return offset, err
+	}
+	geomIndex, downLevels, err := d.scaledGeometry(scaling, plane, fallback)
+	if err != nil {
+		return offset, err
+	}
+	if int(d.HighResIndex) >= len(d.Scales) {
+		return offset, fmt.Errorf("Data %q has no scaled volume %d", d.DataName(), d.HighResIndex)
+	}
+	highRes, scaled := d.Scales[d.HighResIndex].PixelSize, d.Scales[geomIndex].PixelSize
+	d0, d1 := GoogleTileSpec{plane: tileSpec.plane}.dims()
+	var result dvid.Point3d
+	for i := 0; i < 3; i++ {
+		if len(highRes) <= i || len(scaled) <= i || highRes[i] <= 0 || scaled[i] <= 0 {
+			return offset, fmt.Errorf("Data %q lacks voxel sizes needed for high-res coordinates", d.DataName())
+		}
+		ratio := float64(scaled[i]) / float64(highRes[i])
+		if i == d0 || i == d1 {
+			ratio *= float64(int32(1) << downLevels)
+		}
+		// Voxel sizes are float32, so allow for rounding when the ratio isn't exact.
+		result[i] = int32(math.Floor(float64(offset[i])/ratio + 1e-6))
+	}
+	return result, nil
+}
+
+// scaledGeometry returns the scaled volume used for requests at a scale and orientation.
+// If the scale is unavailable for the orientation and fallback is true, it's the deepest
+// available scale within MaxFallbackLevels, along with the number of levels its data must be
+// downsampled to synthesize the requested scale.
+func (d *Data) scaledGeometry(scaling Scaling, plane dvid.DataShape, fallback bool) (GeometryIndex, Scaling, error) {
+	tileSpec, err := GetTileSpec(scaling, plane)
+	if err != nil {
+		return 0, 0, err
+	}
+	geomIndex, found := d.TileMap[*tileSpec]
+	var downLevels Scaling
+	if !found && fallback {
+		for levels := Scaling(1); levels <= MaxFallbackLevels && levels <= scaling; levels++ {
+			if geomIndex, found = d.TileMap[TileSpec{scaling - levels, tileSpec.plane}]; found {
+				downLevels = levels
+				break
+			}
+		}
+	}
+	if !found {
+		return 0, 0, server.NewError(server.NotFoundError, "Could not find scaled volume in %q for %s with scaling %d", d.DataName(), plane, scaling)
+	}
+	if int(geomIndex) >= len(d.Scales) {
+		return 0, 0, fmt.Errorf("Data %q has no scaled volume %d", d.DataName(), geomIndex)
+	}
+	return geomIndex, downLevels, nil
 }
 
 // ServeTile returns a tile with appropriate Content-Type set.
-func (d *Data) ServeTile(w http.ResponseWriter, r *http.Request, parts []string) error {
+func (d *Data) ServeTile(ctx context.Context, w http.ResponseWriter, r *http.Request, requestID string, parts []string) error {
 
 	if len(parts) < 7 {
 		return fmt.Errorf("'tile' request must be following by plane, scale level, and tile coordinate")
 	}
 	planeStr, scalingStr, coordStr := parts[4], parts[5], parts[6]
-	queryValues := r.URL.Query()
-
-	var noblanks bool
-	noblanksStr := dvid.DataString(queryValues.Get("noblanks"))
-	if noblanksStr == "true" {
-		noblanks = true
+	query, err := server.NewQuery(r, tileQueryParams, d.StrictQueries)
+	if err != nil {
+		return err
 	}
-
-	var tilesize int32 = DefaultTileSize
-	tileSizeStr := queryValues.Get("tilesize")
-	if tileSizeStr != "" {
-		tilesizeInt, err := strconv.Atoi(tileSizeStr)
-		if err != nil {
-			return err
-		}
-		tilesize = int32(tilesizeInt)
+	noblanks, err := query.GetBool("noblanks", false)
+	if err != nil {
+		return err
+	}
+	tilesizeInt, err := query.GetInt("tilesize", int(d.tileSize()), 1, MaxTileSize)
+	if err != nil {
+		return err
+	}
+	tilesize := int32(tilesizeInt)
+	display, err := getDisplayAdjust(query)
+	if err != nil {
+		return err
+	}
+	mirror, err := d.getMirror(ctx, query)
+	if err != nil {
+		return err
+	}
+	fallback, err := query.GetBool("fallback", d.Fallback)
+	if err != nil {
+		return err
 	}
-	size := dvid.Point2d{tilesize, tilesize}
 
 	var formatStr string
 	if len(parts) >= 8 {
 		formatStr = parts[7]
 	}
-	if formatStr == "" {
-		formatStr = DefaultTileFormat
-	}
 
 	// Parse the tile specification
 	plane := dvid.DataShapeString(planeStr)
 	shape, err := plane.DataShape()
 	if err != nil {
-		err = fmt.Errorf("Illegal tile plane: %s (%s)", planeStr, err.Error())
-		server.BadRequest(w, r, err.Error())
-		return err
+		return fmt.Errorf("Illegal tile plane: %s (%s)", planeStr, err.Error())
 	}
 	scale, err := strconv.ParseUint(scalingStr, 10, 8)
 	if err != nil {
-		err = fmt.Errorf("Illegal tile scale: %s (%s)", scalingStr, err.Error())
-		server.BadRequest(w, r, err.Error())
-		return err
+		return fmt.Errorf("Illegal tile scale: %s (%s)", scalingStr, err.Error())
 	}
 	tileCoord, err := dvid.StringToPoint(coordStr, "_")
 	if err != nil {
-		err = fmt.Errorf("Illegal tile coordinate: %s (%s)", coordStr, err.Error())
-		server.BadRequest(w, r, err.Error())
+		return fmt.Errorf("Illegal tile coordinate: %s (%s)", coordStr, err.Error())
+	}
+
+	// Determine how this request sits in the available scaled volumes.
+	googleTile, err := d.getTileSpecAt(Scaling(scale), shape, tileCoord, tilesize, fallback)
+	if err != nil {
 		return err
 	}
+	if formatStr == "" {
+		formatStr = d.planeFormat(googleTile.plane)
+	}
+
+	// Send the tile.
+	return d.serveTile(w, r, requestID, googleTile, formatStr, noblanks, display, mirror)
+}
+
+// getTileSpecAt returns the google-specific tile spec for a square tile at the given tile coordinate.
+// If fallback is true, an unavailable scale is synthesized from the deepest available scale.
+func (d *Data) getTileSpecAt(scale Scaling, shape dvid.DataShape, tileCoord dvid.Point, tilesize int32, fallback bool) (*GoogleTileSpec, error) {
+	if tileCoord.NumDims() != 3 {
+		return nil, fmt.Errorf("Tile coordinate must be 3d, not %s", tileCoord)
+	}
 
 	// Convert tile coordinate to offset.
 	var ox, oy, oz int32
@@ -967,37 +2474,62 @@ func (d *Data) ServeTile(w http.ResponseWriter, r *http.Request, parts []string)
 		oy = tileCoord.Value(1) * tilesize
 		oz = tileCoord.Value(2) * tilesize
 	default:
-		return fmt.Errorf("Unknown tile orientation: %s", shape)
+		return nil, fmt.Errorf("Unknown tile orientation: %s", shape)
 	}
+	return d.getGoogleSpec(scale, shape, dvid.Point3d{ox, oy, oz}, dvid.Point2d{tilesize, tilesize}, fallback)
+}
 
-	// Determine how this request sits in the available scaled volumes.
-	googleTile, err := d.GetGoogleSpec(Scaling(scale), shape, dvid.Point3d{ox, oy, oz}, size)
-	if err != nil {
-		server.BadRequest(w, r, err.Error())
-		return err
+// DoRPC handles the 'export-tiles' command.
+func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error {
+	switch request.TypeCommand() {
+	case "export-tiles":
+		return d.doExportTiles(request, reply)
+	default:
+		return fmt.Errorf("Unknown command.  Data instance '%s' [%s] does not support '%s' command.",
+			d.DataName(), d.TypeName(), request.TypeCommand())
 	}
+}
 
-	// Send the tile.
-	return d.serveTile(w, r, googleTile, formatStr, noblanks)
+// nonGetVerbs lists endpoints that accept HTTP verbs other than GET.
+var nonGetVerbs = map[string][]string{
+	"info":   {"post"},
+	"cache":  {"delete", "post"},
+	"values": {"post"},
 }
 
-// DoRPC handles the 'generate' command.
-func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error {
-	return fmt.Errorf("Unknown command.  Data instance %q does not support any commands.  See API help.")
+func acceptsVerb(endpoint, action string) bool {
+	for _, verb := range nonGetVerbs[endpoint] {
+		if verb == action {
+			return true
+		}
+	}
+	return false
 }
 
-// ServeHTTP handles all incoming HTTP requests for this data.
+// postInfo modifies settings using JSON in the request body and persists the change.
+func (d *Data) postInfo(ctx context.Context, r *http.Request) error {
+	config, err := server.DecodeJSON(r)
+	if err != nil {
+		return err
+	}
+	repo, _, err := datastore.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err := d.ModifyConfig(config); err != nil {
+		return err
+	}
+	if err := repo.Save(); err != nil {
+		return server.NewError(server.StorageError, "Unable to save settings for %q: %s", d.DataName(), err.Error())
+	}
+	return nil
+}
+
+// ServeHTTP handles all incoming HTTP requests for this data.  Errors are returned as
+// JSON with a request id that is also included in the logs.
 func (d *Data) ServeHTTP(requestCtx context.Context, w http.ResponseWriter, r *http.Request) {
 	timedLog := dvid.NewTimeLog()
-
-	action := strings.ToLower(r.Method)
-	switch action {
-	case "get":
-		// Acceptable
-	default:
-		server.BadRequest(w, r, "googlevoxels can only handle GET HTTP verbs at this time")
-		return
-	}
+	requestID := server.NewRequestID()
 
 	// Break URL request into arguments
 	url := r.URL.Path[len(server.WebAPIPath):]
@@ -1006,7 +2538,26 @@ func (d *Data) ServeHTTP(requestCtx context.Context, w http.ResponseWriter, r *h
 		parts = parts[:len(parts)-1]
 	}
 	if len(parts) < 4 {
-		server.BadRequest(w, r, "incomplete API request")
+		server.ErrorResponse(w, r, requestID, fmt.Errorf("incomplete API request"))
+		return
+	}
+
+	// Record latencies of the main endpoints.
+	switch parts[3] {
+	case "tile", "raw", "info":
+		timer := server.TimeLatency("googlevoxels/"+parts[3], w)
+		defer timer.Done()
+		w = timer
+	}
+
+	if atomic.LoadInt32(&d.closed) != 0 {
+		server.ErrorResponse(w, r, requestID, server.NewError(server.NotFoundError, "data instance %q has been deleted", d.DataName()))
+		return
+	}
+
+	action := strings.ToLower(r.Method)
+	if action != "get" && !acceptsVerb(parts[3], action) {
+		server.ErrorResponse(w, r, requestID, fmt.Errorf("googlevoxels %q endpoint does not accept %s", parts[3], r.Method))
 		return
 	}
 
@@ -1016,28 +2567,171 @@ func (d *Data) ServeHTTP(requestCtx context.Context, w http.ResponseWriter, r *h
 		fmt.Fprintln(w, d.Help())
 
 	case "info":
+		query, err := server.NewQuery(r, infoQueryParams, d.StrictQueries)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		refresh, err := query.GetBool("refresh", false)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if refresh {
+			if err := d.refresh(); err != nil {
+				server.ErrorResponse(w, r, requestID, err)
+				return
+			}
+		}
+		if action == "post" {
+			if err := d.postInfo(requestCtx, r); err != nil {
+				server.ErrorResponse(w, r, requestID, err)
+				return
+			}
+		}
 		jsonBytes, err := d.MarshalJSON()
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, string(jsonBytes))
+		gw := server.NewGzipResponseWriter(w, r)
+		defer gw.Close()
+		gw.Header().Set("Content-Type", "application/json")
+		gw.Write(jsonBytes)
+
+	case "tilebounds":
+		if err := d.serveTileBounds(w, r, parts); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+
+	case "settings":
+		jsonBytes, err := json.Marshal(settings.Values(d.settingValues()))
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := server.WriteJSON(w, r, jsonBytes); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+
+	case "neuroglancer":
+		if err := d.serveNeuroglancer(w, r, parts); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+
+	case "health":
+		health := d.Health()
+		if health == nil {
+			server.ErrorResponse(w, r, requestID, server.NewError(server.NotFoundError, "health checks are not enabled for %q", d.DataName()))
+			return
+		}
+		jsonBytes, err := json.Marshal(health)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := server.WriteJSON(w, r, jsonBytes); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+
+	case "cache":
+		if err := d.serveCache(w, r, requestID, action); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		timedLog.Infof("[%s] HTTP %s: cache (%s)", requestID, r.Method, r.URL)
 
 	case "tile":
-		if err := d.ServeTile(w, r, parts); err != nil {
-			server.BadRequest(w, r, err.Error())
+		if err := d.checkAvailableOrMirrored(); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := d.ServeTile(requestCtx, w, r, requestID, parts); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		timedLog.Infof("[%s] HTTP %s: tile (%s)", requestID, r.Method, r.URL)
+
+	case "tilestream":
+		if err := d.checkAvailableOrMirrored(); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := d.serveTileStream(w, r, requestID); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
-		timedLog.Infof("HTTP %s: tile (%s)", r.Method, r.URL)
+		timedLog.Infof("[%s] HTTP %s: tilestream (%s)", requestID, r.Method, r.URL)
 
 	case "raw":
-		if err := d.ServeImage(w, r, parts); err != nil {
-			server.BadRequest(w, r, err.Error())
+		if err := d.checkAvailableOrMirrored(); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := d.ServeImage(requestCtx, w, r, requestID, parts); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		timedLog.Infof("[%s] HTTP %s: image (%s)", requestID, r.Method, r.URL)
+
+	case "orthoviews":
+		if err := d.checkAvailable(); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := d.ServeOrthoviews(w, r, requestID, parts); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		timedLog.Infof("[%s] HTTP %s: orthoviews (%s)", requestID, r.Method, r.URL)
+
+	case "transform":
+		if err := d.serveTransform(w, r, parts); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+
+	case "values":
+		if action != "post" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("values endpoint requires POST of points"))
+			return
+		}
+		if err := d.checkAvailable(); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := d.serveValues(w, r, requestID); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		timedLog.Infof("[%s] HTTP %s: values (%s)", requestID, r.Method, r.URL)
+
+	case "labels-at":
+		if err := d.checkAvailable(); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := d.serveLabelsAt(w, r, requestID); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		timedLog.Infof("[%s] HTTP %s: labels-at (%s)", requestID, r.Method, r.URL)
+
+	case "slice-labels":
+		if err := d.checkAvailable(); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := d.serveSliceLabels(w, r, requestID, parts); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
-		timedLog.Infof("HTTP %s: image (%s)", r.Method, r.URL)
+		timedLog.Infof("[%s] HTTP %s: slice-labels (%s)", requestID, r.Method, r.URL)
 	default:
-		server.BadRequest(w, r, "Illegal request for googlevoxels data.  See 'help' for REST API")
+		server.ErrorResponse(w, r, requestID, fmt.Errorf("Illegal request for googlevoxels data.  See 'help' for REST API"))
 	}
 }
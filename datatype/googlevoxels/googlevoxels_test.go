@@ -0,0 +1,942 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/janelia-flyem/dvid/client"
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// newTestData returns googlevoxels data with a single 8-bit 1000^3 geometry that can be
+// used without contacting Google.
+func newTestData(t *testing.T) *Data {
+	basedata, err := datastore.NewDataService(NewType(), dvid.UUID("a9b8c7"), 1, "grayscale", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create base data: %s\n", err.Error())
+	}
+	return &Data{
+		Data: basedata,
+		Properties: Properties{
+			VolumeID: "123456:test",
+			AuthKey:  "secretkey",
+			TileSize: DefaultTileSize,
+			TileMap: GeometryMap{
+				TileSpec{0, XY}: 0,
+				TileSpec{0, XZ}: 0,
+				TileSpec{0, YZ}: 0,
+			},
+			Scales: Geometries{
+				{
+					VolumeSize:   dvid.Point3d{1000, 1000, 1000},
+					ChannelCount: 1,
+					ChannelType:  "uint8",
+					PixelSize:    dvid.NdFloat32{8, 8, 8},
+				},
+			},
+		},
+	}
+}
+
+// countingTransport counts requests and returns a canned response after release is closed.
+type countingTransport struct {
+	count   int64
+	body    []byte
+	release chan struct{}
+
+	mu      sync.Mutex
+	lastURL string
+}
+
+func (ct *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&ct.count, 1)
+	ct.mu.Lock()
+	ct.lastURL = r.URL.String()
+	ct.mu.Unlock()
+	if ct.release != nil {
+		<-ct.release
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(ct.body)),
+		Request:    r,
+	}, nil
+}
+
+// newTestServer returns a server for the data's HTTP API, which should be closed after use.
+func newTestServer(d *Data) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.ServeHTTP(nil, w, r)
+	}))
+}
+
+// useTransport sets the transport for upstream requests and returns a function to restore it.
+func useTransport(rt http.RoundTripper) func() {
+	orig := upstreamClient
+	upstreamClient = &http.Client{Transport: rt}
+	return func() {
+		upstreamClient = orig
+	}
+}
+
+func TestTileCoalescing(t *testing.T) {
+	d := newTestData(t)
+	transport := &countingTransport{
+		body:    []byte("pretend this is a png"),
+		release: make(chan struct{}),
+	}
+	defer useTransport(transport)()
+
+	const numRequests = 50
+	bodies := make([][]byte, numRequests)
+	codes := make([]int, numRequests)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20", nil)
+			w := httptest.NewRecorder()
+			d.ServeHTTP(nil, w, r)
+			codes[i] = w.Code
+			bodies[i] = w.Body.Bytes()
+		}(i)
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(transport.release)
+	wg.Wait()
+
+	if transport.count != 1 {
+		t.Errorf("Expected 1 upstream request for %d identical tile requests, got %d\n", numRequests, transport.count)
+	}
+	for i := 0; i < numRequests; i++ {
+		if codes[i] != http.StatusOK {
+			t.Errorf("Request %d returned status %d\n", i, codes[i])
+		}
+		if !bytes.Equal(bodies[i], transport.body) {
+			t.Errorf("Request %d returned bad body: %q\n", i, string(bodies[i]))
+		}
+	}
+	stats := d.stats.get()
+	if stats.CoalescedRequests != numRequests-1 {
+		t.Errorf("Expected %d coalesced requests, got %d\n", numRequests-1, stats.CoalescedRequests)
+	}
+}
+
+func TestTileCoalescingOverCap(t *testing.T) {
+	d := newTestData(t)
+	transport := &countingTransport{body: bytes.Repeat([]byte{7}, 1000)}
+	defer useTransport(transport)()
+
+	orig := MaxCoalescedBytes
+	MaxCoalescedBytes = 100
+	defer func() {
+		MaxCoalescedBytes = orig
+	}()
+
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if !bytes.Equal(w.Body.Bytes(), transport.body) {
+		t.Errorf("Response larger than coalescing cap was not fully streamed: got %d bytes\n", w.Body.Len())
+	}
+}
+
+func TestTileCacheAdmin(t *testing.T) {
+	d := newTestData(t)
+	d.TileCacheMB = 1
+	d.initCache()
+	transport := &countingTransport{body: []byte("pretend this is a png")}
+	defer useTransport(transport)()
+
+	tileURLs := []string{
+		"/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20",
+		"/api/node/a9b8c7/grayscale/tile/xz/0/0_20_0",
+		"/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20",
+	}
+	for _, url := range tileURLs {
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %q returned status %d\n", url, w.Code)
+		}
+	}
+	if transport.count != 2 {
+		t.Errorf("Expected 2 upstream requests with caching, got %d\n", transport.count)
+	}
+
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/cache", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	var stats dvid.CacheStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Unable to decode cache stats %q: %s\n", w.Body.String(), err.Error())
+	}
+	if stats.Entries != 2 || stats.Hits != 1 {
+		t.Errorf("Expected 2 entries and 1 hit, got %d entries and %d hits\n", stats.Entries, stats.Hits)
+	}
+
+	r, _ = http.NewRequest("DELETE", "/api/node/a9b8c7/grayscale/cache?plane=xz", nil)
+	w = httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("DELETE cache returned status %d: %s\n", w.Code, w.Body.String())
+	}
+	if d.cache.Len() != 1 {
+		t.Errorf("Expected 1 cached tile after evicting XZ tiles, got %d\n", d.cache.Len())
+	}
+}
+
+func TestDefaultFormat(t *testing.T) {
+	d := newTestData(t)
+	transport := &countingTransport{body: []byte("pretend this is a jpeg")}
+	defer useTransport(transport)()
+
+	config := dvid.NewConfig()
+	config.Set("defaultformat", "gif")
+	if err := d.ModifyConfig(config); err == nil {
+		t.Errorf("Expected error setting unsupported default format\n")
+	}
+	config.Set("defaultformat", "jpg:101")
+	if err := d.ModifyConfig(config); err == nil {
+		t.Errorf("Expected error setting bad jpeg quality\n")
+	}
+	config.Set("defaultformat", "jpg:85")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to set default format: %s\n", err.Error())
+	}
+	if d.DefaultFormat != "jpeg:85" {
+		t.Errorf("Expected default format to be stored as %q, got %q\n", "jpeg:85", d.DefaultFormat)
+	}
+
+	tests := []struct {
+		url         string
+		contentType string
+		query       string
+	}{
+		{"/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20", "image/jpeg", "format=jpeg&jpegQuality=85"},
+		{"/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20/png", "image/png", "format=png"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %q returned status %d: %s\n", test.url, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("Request %q: expected Content-Type %q, got %q\n", test.url, test.contentType, got)
+		}
+		if !strings.Contains(transport.lastURL, test.query) {
+			t.Errorf("Request %q: expected Google request with %q, got %q\n", test.url, test.query, transport.lastURL)
+		}
+	}
+}
+
+func TestPlaneFormat(t *testing.T) {
+	d := newTestData(t)
+	transport := &countingTransport{body: []byte("pretend this is an image")}
+	defer useTransport(transport)()
+
+	config := dvid.NewConfig()
+	config.Set("format_xz", "gif")
+	if err := d.ModifyConfig(config); err == nil {
+		t.Errorf("Expected error setting unsupported xz format\n")
+	}
+
+	// Precedence is the URL's format, then the orientation's format, then the instance's
+	// default format, then the package default.
+	check := func(url, format, query string) {
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %q returned status %d: %s\n", url, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-DVID-Format"); got != format {
+			t.Errorf("Request %q: expected X-DVID-Format %q, got %q\n", url, format, got)
+		}
+		contentType := "image/" + strings.SplitN(format, ":", 2)[0]
+		if got := w.Header().Get("Content-Type"); got != contentType {
+			t.Errorf("Request %q: expected Content-Type %q, got %q\n", url, contentType, got)
+		}
+		if !strings.Contains(transport.lastURL, query) {
+			t.Errorf("Request %q: expected Google request with %q, got %q\n", url, query, transport.lastURL)
+		}
+	}
+	const xyTile, xzTile, yzTile = "/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20", "/api/node/a9b8c7/grayscale/tile/xz/0/0_20_0", "/api/node/a9b8c7/grayscale/tile/yz/0/20_0_0"
+	check(xzTile, DefaultTileFormat, "format=png")
+
+	config = dvid.NewConfig()
+	config.Set("defaultformat", "jpeg:70")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to set default format: %s\n", err.Error())
+	}
+	check(xzTile, "jpeg:70", "format=jpeg&jpegQuality=70")
+
+	config = dvid.NewConfig()
+	config.Set("format_xy", "jpg:85")
+	config.Set("format_xz", "png")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to set orientation formats: %s\n", err.Error())
+	}
+	if d.FormatXY != "jpeg:85" {
+		t.Errorf("Expected xy format to be stored as %q, got %q\n", "jpeg:85", d.FormatXY)
+	}
+	check(xyTile, "jpeg:85", "format=jpeg&jpegQuality=85")
+	check(xzTile, "png", "format=png")
+	check(yzTile, "jpeg:70", "format=jpeg&jpegQuality=70")
+	check("/api/node/a9b8c7/grayscale/raw/xz/256_256/0_20_0", "png", "format=png")
+	check(xzTile+"/jpeg:60", "jpeg:60", "format=jpeg&jpegQuality=60")
+
+	// Clearing an orientation's format restores the instance default.
+	config = dvid.NewConfig()
+	config.Set("format_xz", "")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to clear xz format: %s\n", err.Error())
+	}
+	check(xzTile, "jpeg:70", "format=jpeg&jpegQuality=70")
+}
+
+func TestPointValues(t *testing.T) {
+	d := newTestData(t)
+	block := make([]byte, valueBlockSize*valueBlockSize*valueBlockSize)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	transport := &countingTransport{body: block}
+	defer useTransport(transport)()
+
+	body := bytes.NewBufferString(`[[1,2,3], [2000,0,0], [9,0,0], [2,2,3], [-1,5,5]]`)
+	r, _ := http.NewRequest("POST", "/api/node/a9b8c7/grayscale/values", body)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("values request returned status %d: %s\n", w.Code, w.Body.String())
+	}
+	var values []interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &values); err != nil {
+		t.Fatalf("Unable to decode values %q: %s\n", w.Body.String(), err.Error())
+	}
+	expected := []interface{}{float64(209), nil, float64(1), float64(210), nil}
+	if len(values) != len(expected) {
+		t.Fatalf("Expected %d values, got %d\n", len(expected), len(values))
+	}
+	for i := range expected {
+		if values[i] != expected[i] {
+			t.Errorf("Point %d: expected value %v, got %v\n", i, expected[i], values[i])
+		}
+	}
+	if got := w.Header().Get("X-Upstream-Requests"); got != "2" {
+		t.Errorf("Expected 2 upstream requests, got %q\n", got)
+	}
+}
+
+func TestTilePassthrough(t *testing.T) {
+	d := newTestData(t)
+	transport := &cappedTransport{maxVoxels: 1000000}
+	defer useTransport(transport)()
+
+	tests := []struct {
+		url         string
+		passthrough bool
+	}{
+		{"/api/node/a9b8c7/grayscale/raw/xy/100_100/10_20_30/png", true},
+		{"/api/node/a9b8c7/grayscale/raw/xy/100_100/10_20_30/raw", true},
+		{"/api/node/a9b8c7/grayscale/raw/xy/100_100/950_20_30/png", false}, // padded edge
+		{"/api/node/a9b8c7/grayscale/raw/xy/100_100/10_20_30/tiff", false}, // Google can't encode
+		{"/api/node/a9b8c7/grayscale/raw/xy/100_100/10_20_30/png?window=0,100", false},
+		{"/api/node/a9b8c7/grayscale/tile/xy/0/0_0_30/jpeg", true},
+	}
+	for _, test := range tests {
+		before := d.stats.get()
+		r, _ := http.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %q failed with status %d: %s\n", test.url, w.Code, w.Body.String())
+		}
+		after := d.stats.get()
+		passthrough := after.PassthroughTiles - before.PassthroughTiles
+		transcoded := after.TranscodedTiles - before.TranscodedTiles
+		if test.passthrough && (passthrough != 1 || transcoded != 0) {
+			t.Errorf("Expected request %q to be passed through, got %d passthrough, %d transcoded\n", test.url, passthrough, transcoded)
+		}
+		if !test.passthrough && (passthrough != 0 || transcoded != 1) {
+			t.Errorf("Expected request %q to be transcoded, got %d passthrough, %d transcoded\n", test.url, passthrough, transcoded)
+		}
+	}
+}
+
+func TestPlaneLevels(t *testing.T) {
+	d := newTestData(t)
+	d.TileMap = GeometryMap{
+		TileSpec{0, XY}: 0,
+		TileSpec{0, XZ}: 0,
+		TileSpec{0, YZ}: 0,
+		TileSpec{1, XY}: 0,
+		TileSpec{2, XY}: 0,
+		TileSpec{1, XZ}: 0,
+	}
+	missing := d.TileMap.gaps()
+	expectedGaps := []string{"XZ:2", "YZ:1", "YZ:2"}
+	if len(missing) != len(expectedGaps) {
+		t.Fatalf("Expected gaps %v, got %v\n", expectedGaps, missing)
+	}
+	for i := range missing {
+		if missing[i] != expectedGaps[i] {
+			t.Errorf("Expected gaps %v, got %v\n", expectedGaps, missing)
+		}
+	}
+
+	jsonBytes, err := d.Properties.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Unable to marshal properties: %s\n", err.Error())
+	}
+	var props struct {
+		Levels      map[string]json.RawMessage
+		PlaneLevels map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(jsonBytes, &props); err != nil {
+		t.Fatalf("Unable to decode properties %s: %s\n", string(jsonBytes), err.Error())
+	}
+	if len(props.Levels) != 3 {
+		t.Errorf("Expected 3 levels for backward-compatible Levels, got %d\n", len(props.Levels))
+	}
+	expectedLevels := map[string][]string{
+		"XY": {"0", "1", "2"},
+		"XZ": {"0", "1"},
+		"YZ": {"0"},
+	}
+	for plane, scales := range expectedLevels {
+		levels := props.PlaneLevels[plane]
+		if len(levels) != len(scales) {
+			t.Errorf("Expected %d levels for %s, got %d: %s\n", len(scales), plane, len(levels), string(jsonBytes))
+		}
+		for _, scale := range scales {
+			if _, found := levels[scale]; !found {
+				t.Errorf("Expected level %s for %s in %s\n", scale, plane, string(jsonBytes))
+			}
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	d := newTestData(t)
+	d.Scales = append(d.Scales, Geometry{
+		VolumeSize:   dvid.Point3d{250, 250, 500},
+		ChannelCount: 1,
+		ChannelType:  "uint8",
+		PixelSize:    dvid.NdFloat32{32, 32, 16},
+	})
+	d.TileMap[TileSpec{2, XY}] = 1
+
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/transform/2/xy?offset=800_100_33&size=400_400", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("transform request returned status %d: %s\n", w.Code, w.Body.String())
+	}
+	var transform Transform
+	if err := json.Unmarshal(w.Body.Bytes(), &transform); err != nil {
+		t.Fatalf("Unable to decode transform %q: %s\n", w.Body.String(), err.Error())
+	}
+	if transform.GeometryIndex != 1 {
+		t.Errorf("Expected geometry 1, got %d\n", transform.GeometryIndex)
+	}
+	if transform.Offset != (dvid.Point3d{200, 25, 16}) {
+		t.Errorf("Expected scaled offset (200,25,16), got %s\n", transform.Offset)
+	}
+	if transform.Size != (dvid.Point3d{50, 100, 1}) || !transform.Edge || transform.Outside {
+		t.Errorf("Expected clipped edge size (50,100,1), got %s, edge %t, outside %t\n", transform.Size, transform.Edge, transform.Outside)
+	}
+
+	inv, err := d.GetTransform(2, dvid.XY, transform.Offset, dvid.Point2d{50, 100}, true)
+	if err != nil {
+		t.Fatalf("Unable to get inverse transform: %s\n", err.Error())
+	}
+	if inv.Offset != (dvid.Point3d{800, 100, 32}) || inv.Size != (dvid.Point3d{200, 400, 2}) {
+		t.Errorf("Bad inverse transform: offset %s, size %s\n", inv.Offset, inv.Size)
+	}
+
+	outside, err := d.GetTransform(2, dvid.XY, dvid.Point3d{2000, 0, 0}, dvid.Point2d{10, 10}, false)
+	if err != nil {
+		t.Fatalf("Unable to get transform: %s\n", err.Error())
+	}
+	if !outside.Outside {
+		t.Errorf("Expected region to be outside scaled volume\n")
+	}
+}
+
+func TestOrthoviews(t *testing.T) {
+	d := newTestData(t)
+	d.TileMap[TileSpec{1, XY}] = 0
+	d.TileMap[TileSpec{1, XZ}] = 0
+	transport := &countingTransport{body: []byte("pretend this is a jpeg")}
+	defer useTransport(transport)()
+
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/orthoviews/1/100_200_300?format=jpeg:80&tilesize=256", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("orthoviews request returned status %d: %s\n", w.Code, w.Body.String())
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Expected multipart/mixed response, got %q\n", w.Header().Get("Content-Type"))
+	}
+	expected := []struct {
+		name    string
+		coord   string
+		missing bool
+	}{
+		{"xy", "0_0_300", false},
+		{"xz", "0_200_1", false},
+		{"yz", "100_0_1", true},
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, exp := range expected {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("Unable to read part %q: %s\n", exp.name, err.Error())
+		}
+		_, dispParams, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if err != nil || dispParams["name"] != exp.name {
+			t.Errorf("Expected part %q, got disposition %q\n", exp.name, part.Header.Get("Content-Disposition"))
+		}
+		if got := part.Header.Get("X-Tile-Coord"); got != exp.coord {
+			t.Errorf("Part %q: expected tile coord %q, got %q\n", exp.name, exp.coord, got)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("Unable to read part %q data: %s\n", exp.name, err.Error())
+		}
+		if exp.missing {
+			if part.Header.Get("X-Tile-Missing") != "true" || len(data) != 0 {
+				t.Errorf("Expected empty missing part for %q, got %d bytes\n", exp.name, len(data))
+			}
+			continue
+		}
+		if part.Header.Get("Content-Type") != "image/jpeg" || !bytes.Equal(data, transport.body) {
+			t.Errorf("Part %q: bad content type %q or data %q\n", exp.name, part.Header.Get("Content-Type"), string(data))
+		}
+	}
+	if transport.count != 2 {
+		t.Errorf("Expected 2 upstream requests, got %d\n", transport.count)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	transport := &countingTransport{body: []byte("pretend this is a jpeg")}
+	defer useTransport(transport)()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		d := newTestData(t)
+		d.HealthCheck = 10 * time.Millisecond
+		d.TileCacheMB = 1
+		d.initCache()
+		d.startHealthCheck()
+
+		r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20", nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("tile request returned status %d: %s\n", w.Code, w.Body.String())
+		}
+		if d.CacheStats().Entries != 1 {
+			t.Fatalf("Expected 1 cached tile before shutdown, got %d\n", d.CacheStats().Entries)
+		}
+
+		d.Shutdown()
+		d.Shutdown() // must be safe to call more than once
+		if d.CacheStats().Entries != 0 {
+			t.Errorf("Expected empty cache after shutdown, got %d entries\n", d.CacheStats().Entries)
+		}
+		w = httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 after shutdown, got %d\n", w.Code)
+		}
+	}
+
+	// Allow any idle goroutines of the test transport to exit.
+	time.Sleep(50 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Leaked %d goroutines after shutdown\n", after-before)
+	}
+}
+
+func TestModifyOutbound(t *testing.T) {
+	d := newTestData(t)
+	proxy := httptest.NewServer(http.NotFoundHandler())
+	proxyURL := proxy.URL
+	proxy.Close()
+
+	config := dvid.NewConfig()
+	config.Set("proxy", proxyURL)
+	err := d.ModifyConfig(config)
+	if err == nil {
+		t.Fatalf("Expected unreachable proxy to be rejected\n")
+	}
+	if !strings.Contains(err.Error(), "connection failed") {
+		t.Errorf("Expected connection failure error, got %q\n", err.Error())
+	}
+	if d.Proxy != "" || d.httpClient() != upstreamClient {
+		t.Errorf("Rejected proxy setting was applied: %q\n", d.Proxy)
+	}
+
+	config = dvid.NewConfig()
+	config.Set("proxy", "not a url")
+	if err := d.ModifyConfig(config); err == nil {
+		t.Errorf("Expected bad proxy URL to be rejected\n")
+	}
+}
+
+// cappedTransport returns 8-bit XY data where each voxel value is a function of its
+// coordinate, rejecting requests with more than maxVoxels voxels.
+type cappedTransport struct {
+	maxVoxels int64
+	count     int64
+}
+
+func (ct *cappedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&ct.count, 1)
+	var corner, size dvid.Point3d
+	var err error
+	if corner, err = dvid.StringToPoint3d(r.URL.Query().Get("corner"), ","); err == nil {
+		size, err = dvid.StringToPoint3d(r.URL.Query().Get("size"), ",")
+	}
+	status := http.StatusOK
+	var body []byte
+	switch {
+	case err != nil:
+		status = http.StatusBadRequest
+	case int64(size[0])*int64(size[1])*int64(size[2]) > ct.maxVoxels:
+		status = http.StatusBadRequest
+		body = []byte("response too large")
+	default:
+		for y := corner[1]; y < corner[1]+size[1]; y++ {
+			for x := corner[0]; x < corner[0]+size[0]; x++ {
+				body = append(body, byte(x+3*y))
+			}
+		}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func TestSplitRequests(t *testing.T) {
+	d := newTestData(t)
+	transport := &cappedTransport{maxVoxels: 10000}
+	defer useTransport(transport)()
+
+	// Without splitting, the oversized request fails upstream.
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/raw/xy/300_250/10_20_30/png", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected oversized request to fail upstream, got status %d\n", w.Code)
+	}
+
+	d.MaxFetch = 10000
+	tests := []struct {
+		offset dvid.Point3d
+		nx, ny int32
+	}{
+		{dvid.Point3d{10, 20, 30}, 300, 250},
+		{dvid.Point3d{900, 850, 30}, 300, 250}, // edge of volume
+	}
+	for _, test := range tests {
+		transport.count = 0
+		url := fmt.Sprintf("/api/node/a9b8c7/grayscale/raw/xy/%d_%d/%d_%d_%d/png", test.nx, test.ny,
+			test.offset[0], test.offset[1], test.offset[2])
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Split request %s failed with status %d: %s\n", url, w.Code, w.Body.String())
+		}
+		if transport.count < 2 {
+			t.Errorf("Expected split request %s to make several upstream requests, got %d\n", url, transport.count)
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("Unable to decode split response: %s\n", err.Error())
+		}
+		gray, ok := img.(*image.Gray)
+		if !ok || gray.Bounds().Dx() != int(test.nx) || gray.Bounds().Dy() != int(test.ny) {
+			t.Fatalf("Expected %d x %d gray image, got %T with bounds %v\n", test.nx, test.ny, img, img.Bounds())
+		}
+		for y := int32(0); y < test.ny; y++ {
+			for x := int32(0); x < test.nx; x++ {
+				vx, vy := test.offset[0]+x, test.offset[1]+y
+				var expected byte
+				if vx < 1000 && vy < 1000 {
+					expected = byte(vx + 3*vy)
+				}
+				if got := gray.GrayAt(int(x), int(y)).Y; got != expected {
+					t.Fatalf("Request %s: expected %d at (%d,%d), got %d\n", url, expected, x, y, got)
+				}
+			}
+		}
+	}
+}
+
+func TestOutOfBounds(t *testing.T) {
+	d := newTestData(t)
+	transport := &cappedTransport{maxVoxels: 1000000}
+	defer useTransport(transport)()
+
+	config := dvid.NewConfig()
+	config.Set("background", "256")
+	if err := d.ModifyConfig(config); err == nil {
+		t.Errorf("Expected error setting background outside uint8 range\n")
+	}
+	config = dvid.NewConfig()
+	config.Set("oob-style", "stripes")
+	if err := d.ModifyConfig(config); err == nil {
+		t.Errorf("Expected error setting unknown oob-style\n")
+	}
+	config.Set("background", "7")
+	config.Set("oob-style", "border")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to set background and oob-style: %s\n", err.Error())
+	}
+	jsonBytes, err := json.Marshal(d.Properties)
+	if err != nil {
+		t.Fatalf("Unable to marshal properties: %s\n", err.Error())
+	}
+	if !strings.Contains(string(jsonBytes), `"Background":"7","OOBStyle":"border"`) {
+		t.Errorf("Expected background and oob-style in properties, got %s\n", string(jsonBytes))
+	}
+
+	// Padding of an edge request is background except for a frame along the data edge.
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/raw/xy/200_200/900_900_30/png", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Edge request failed with status %d: %s\n", w.Code, w.Body.String())
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to decode edge response: %s\n", err.Error())
+	}
+	gray := img.(*image.Gray)
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			var expected byte
+			switch {
+			case x < 100 && y < 100:
+				expected = byte(900 + x + 3*(900+y))
+			case (x == 100 && y <= 100) || (y == 100 && x <= 100):
+				expected = ^byte(7)
+			default:
+				expected = 7
+			}
+			if got := gray.GrayAt(x, y).Y; got != expected {
+				t.Fatalf("Expected %d at (%d,%d) of edge request, got %d\n", expected, x, y, got)
+			}
+		}
+	}
+
+	// Tiles outside the volume get a checkerboard.
+	config = dvid.NewConfig()
+	config.Set("oob-style", "checker")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to set oob-style: %s\n", err.Error())
+	}
+	ts := newTestServer(d)
+	defer ts.Close()
+	spec := client.TileReq{Plane: "xy", Coord: dvid.Point3d{5, 5, 20}, Format: "png"}
+	if img, err = client.GetTile(ts.URL, "a9b8c7", "grayscale", spec); err != nil {
+		t.Fatalf("Blank tile request failed: %s\n", err.Error())
+	}
+	gray = img.(*image.Gray)
+	for _, pt := range []struct {
+		x, y     int
+		expected byte
+	}{
+		{0, 0, 7}, {15, 15, 7}, {16, 0, ^byte(7)}, {0, 16, ^byte(7)}, {16, 16, 7},
+	} {
+		if got := gray.GrayAt(pt.x, pt.y).Y; got != pt.expected {
+			t.Errorf("Expected %d at (%d,%d) of blank tile, got %d\n", pt.expected, pt.x, pt.y, got)
+		}
+	}
+
+	// Tiles outside the volume can be refused instead.
+	spec.Query = url.Values{"noblanks": {"true"}}
+	_, err = client.GetTile(ts.URL, "a9b8c7", "grayscale", spec)
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusNotFound || e.Kind != "not-found" || e.RequestID == "" {
+		t.Errorf("Expected not-found error with request ID for blank tile, got %v\n", err)
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	// countPixels returns the number of blank tile pixels with the given value.
+	countPixels := func(d *Data, value uint8) int {
+		ts := newTestServer(d)
+		defer ts.Close()
+		spec := client.TileReq{Plane: "xy", Coord: dvid.Point3d{5, 6, 20}, Format: "png", TileSize: 256}
+		img, err := client.GetTile(ts.URL, "a9b8c7", "grayscale", spec)
+		if err != nil {
+			t.Fatalf("Blank tile request failed: %s\n", err.Error())
+		}
+		if img.Bounds().Dx() != 256 || img.Bounds().Dy() != 256 {
+			t.Fatalf("Expected 256 x 256 blank tile, got %s\n", img.Bounds())
+		}
+		var n int
+		for y := 0; y < 256; y++ {
+			for x := 0; x < 256; x++ {
+				if gray, _, _, _ := img.At(x, y).RGBA(); uint8(gray>>8) == value {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	d := newTestData(t)
+	config := dvid.NewConfig()
+	config.Set("placeholder", "maybe")
+	if err := d.ModifyConfig(config); err == nil {
+		t.Errorf("Expected error on bad placeholder setting\n")
+	}
+	if n := countPixels(d, 255); n != 0 {
+		t.Errorf("Expected no text without placeholder setting, got %d text pixels\n", n)
+	}
+
+	config.Set("placeholder", "true")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to set placeholder: %s\n", err.Error())
+	}
+	if n := countPixels(d, 255); n == 0 || n > 256*256/2 {
+		t.Errorf("Expected placeholder text in part of blank tile, got %d text pixels\n", n)
+	}
+
+	// The tile coordinate is part of the text.
+	tile, err := d.getTileSpecAt(0, dvid.XY, dvid.Point3d{5, 6, 20}, 256, false)
+	if err != nil {
+		t.Fatalf("Unable to get tile spec: %s\n", err.Error())
+	}
+	if coord := tile.tileCoord(); coord != (dvid.Point3d{5, 6, 20}) {
+		t.Errorf("Expected tile coordinate (5,6,20), got %s\n", coord)
+	}
+
+	// Other voxel types only get the background fill.
+	d.Scales[0].ChannelType = dvid.ChannelUint16
+	if n := countPixels(d, 0); n != 256*256 {
+		t.Errorf("Expected only background for uint16 placeholder, got %d of %d background pixels\n", n, 256*256)
+	}
+}
+
+func TestBackgroundBytes(t *testing.T) {
+	tests := []struct {
+		value       string
+		channelType string
+		expected    []byte
+	}{
+		{"", dvid.ChannelUint8, []byte{0}},
+		{"255", dvid.ChannelUint8, []byte{255}},
+		{"258", dvid.ChannelUint16, []byte{2, 1}},
+		{"18446744073709551615", dvid.ChannelUint64, []byte{255, 255, 255, 255, 255, 255, 255, 255}},
+		{"1", dvid.ChannelFloat32, []byte{0, 0, 0x80, 0x3f}},
+	}
+	for _, test := range tests {
+		b, err := backgroundBytes(test.value, test.channelType)
+		if err != nil {
+			t.Errorf("Error on background %q for %s: %s\n", test.value, test.channelType, err.Error())
+		} else if !bytes.Equal(b, test.expected) {
+			t.Errorf("Expected background %q for %s to be %v, got %v\n", test.value, test.channelType, test.expected, b)
+		}
+	}
+	for _, bad := range []string{"-1", "1.5", "abc"} {
+		if _, err := backgroundBytes(bad, dvid.ChannelUint16); err == nil {
+			t.Errorf("Expected error on uint16 background %q\n", bad)
+		}
+	}
+}
+
+func TestPadClippedTile(t *testing.T) {
+	// A 5 x 4 edge tile within an 8 x 8 requested tile.
+	tile := GoogleTileSpec{
+		size:          dvid.Point3d{5, 4, 1},
+		sizeWant:      dvid.Point3d{8, 8, 1},
+		plane:         XY,
+		edge:          true,
+		channelType:   "uint8",
+		bytesPerVoxel: 1,
+	}
+	fill, err := newOOBFill("9", OOBSolid, "uint8")
+	if err != nil {
+		t.Fatalf("Unable to make fill: %s\n", err.Error())
+	}
+	tests := []struct {
+		name   string
+		nx, ny int
+	}{
+		{"exact", 5, 4},
+		{"one row short", 5, 3},
+		{"one column short", 4, 4},
+		{"one column extra", 6, 4},
+	}
+	for _, test := range tests {
+		data := make([]byte, test.nx*test.ny)
+		for i := range data {
+			data[i] = byte(100 + i)
+		}
+		out, err := tile.padTile(data, fill)
+		if err != nil {
+			t.Errorf("Unable to pad %s tile: %s\n", test.name, err.Error())
+			continue
+		}
+		if len(out) != 64 {
+			t.Fatalf("Expected 64 bytes for padded %s tile, got %d\n", test.name, len(out))
+		}
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				expected := byte(9)
+				if x < test.nx && y < test.ny {
+					expected = byte(100 + y*test.nx + x)
+				}
+				if out[y*8+x] != expected {
+					t.Fatalf("Padded %s tile has %d at (%d, %d), expected %d\n", test.name, out[y*8+x], x, y, expected)
+				}
+			}
+		}
+	}
+
+	// Lengths with no consistent tile size are rejected with expected and received sizes.
+	for _, numBytes := range []int{7, 0, 35, 100} {
+		_, err := tile.padTile(make([]byte, numBytes), fill)
+		if err == nil {
+			t.Errorf("Expected error padding tile of %d bytes\n", numBytes)
+			continue
+		}
+		if !strings.Contains(err.Error(), "5 x 4") || !strings.Contains(err.Error(), fmt.Sprintf("received %d bytes", numBytes)) {
+			t.Errorf("Expected error with expected and received sizes, got %q\n", err.Error())
+		}
+	}
+}
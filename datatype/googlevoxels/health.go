@@ -0,0 +1,218 @@
+/*
+	This file supports periodic checks of the Google BrainMaps API so that expired credentials
+	or outages are visible before users encounter failed tile requests.
+*/
+
+package googlevoxels
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+const (
+	// HealthHistory is the number of recent health check results that are kept.
+	HealthHistory = 20
+
+	// Number of consecutive failed checks before upstream is considered down.
+	healthDownAfter = 3
+
+	// Checks slower than this mark the upstream as degraded.
+	healthSlowLatency = 5 * time.Second
+
+	// Maximum time to wait for a health check response.
+	healthTimeout = 30 * time.Second
+)
+
+// Verdicts for the health of the upstream Google BrainMaps API.
+const (
+	HealthUnknown  = "unknown"
+	HealthHealthy  = "healthy"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+// HealthCheck is the result of a single request to the Google BrainMaps API.
+type HealthCheck struct {
+	Time       time.Time
+	LatencyMs  float64
+	StatusCode int
+	Error      string `json:",omitempty"`
+}
+
+func (hc HealthCheck) ok() bool {
+	return hc.Error == "" && hc.StatusCode == http.StatusOK
+}
+
+// HealthReport summarizes recent health checks with most recent check first.
+// ConsecutiveInvalid is the number of invalid tiles received from Google since the last
+// valid one.
+type HealthReport struct {
+	Status             string
+	Interval           string
+	Checks             []HealthCheck
+	ConsecutiveInvalid int64 `json:",omitempty"`
+}
+
+// healthChecker keeps a ring buffer of recent health checks.
+type healthChecker struct {
+	sync.RWMutex
+	checks    [HealthHistory]HealthCheck
+	numChecks int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{} // closed when the checking goroutine exits
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (hc *healthChecker) record(check HealthCheck) {
+	hc.Lock()
+	hc.checks[hc.numChecks%HealthHistory] = check
+	hc.numChecks++
+	hc.Unlock()
+}
+
+// recent returns the stored health checks with the most recent first.
+func (hc *healthChecker) recent() []HealthCheck {
+	hc.RLock()
+	defer hc.RUnlock()
+	n := hc.numChecks
+	if n > HealthHistory {
+		n = HealthHistory
+	}
+	checks := make([]HealthCheck, n)
+	for i := 0; i < n; i++ {
+		checks[i] = hc.checks[(hc.numChecks-1-i)%HealthHistory]
+	}
+	return checks
+}
+
+// verdict returns the overall health given recent checks, most recent first.
+func verdict(checks []HealthCheck) string {
+	if len(checks) == 0 {
+		return HealthUnknown
+	}
+	var failures int
+	for _, check := range checks {
+		if !check.ok() {
+			failures++
+		}
+	}
+	var consecutive int
+	for _, check := range checks {
+		if check.ok() {
+			break
+		}
+		consecutive++
+	}
+	switch {
+	case consecutive >= healthDownAfter || consecutive == len(checks):
+		return HealthDown
+	case failures > 0 || checks[0].LatencyMs > float64(healthSlowLatency/time.Millisecond):
+		return HealthDegraded
+	default:
+		return HealthHealthy
+	}
+}
+
+func (hc *healthChecker) close() {
+	hc.stopOnce.Do(func() {
+		close(hc.stop)
+	})
+}
+
+// startHealthCheck starts periodic health checks if they are configured for this instance.
+func (d *Data) startHealthCheck() {
+	if d.HealthCheck <= 0 || d.health != nil {
+		return
+	}
+	d.health = newHealthChecker()
+	go d.runHealthCheck(d.health)
+}
+
+func (d *Data) runHealthCheck(hc *healthChecker) {
+	ticker := time.NewTicker(d.HealthCheck)
+	defer func() {
+		ticker.Stop()
+		close(hc.done)
+	}()
+	for {
+		hc.record(d.checkUpstream())
+		select {
+		case <-hc.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkUpstream issues a cheap request upstream: volume metadata for Google or a single
+// source tile for a tile source.
+func (d *Data) checkUpstream() HealthCheck {
+	timeout := healthTimeout
+	if d.HealthCheck < timeout {
+		timeout = d.HealthCheck
+	}
+	check := HealthCheck{Time: time.Now()}
+	resp, err := d.googleClient(timeout).Get(d.checkURL())
+	check.LatencyMs = float64(time.Since(check.Time)) / float64(time.Millisecond)
+	if err != nil {
+		check.Error = server.OutboundErrorMessage(err)
+	} else {
+		resp.Body.Close()
+		check.StatusCode = resp.StatusCode
+	}
+	if !check.ok() {
+		dvid.Errorf("Health check of %s for %q failed: status %d %s\n", d.upstreamName(), d.DataName(), check.StatusCode, check.Error)
+	}
+	return check
+}
+
+// Health returns a report of recent health checks or nil if health checks are not enabled
+// and Google hasn't been returning invalid tiles.  Repeated invalid tiles degrade an
+// otherwise healthy status.
+func (d *Data) Health() *HealthReport {
+	invalid := atomic.LoadInt64(&d.stats.invalidStreak)
+	if d.health == nil && invalid < invalidDegradedAfter {
+		return nil
+	}
+	report := &HealthReport{Status: HealthUnknown, ConsecutiveInvalid: invalid}
+	if d.health != nil {
+		report.Checks = d.health.recent()
+		report.Status = verdict(report.Checks)
+		report.Interval = d.HealthCheck.String()
+	}
+	if invalid >= invalidDegradedAfter && report.Status != HealthDown {
+		report.Status = HealthDegraded
+	}
+	return report
+}
+
+// checkAvailable returns an error if upstream is down and requests should fail fast.
+func (d *Data) checkAvailable() error {
+	if !d.HealthFailFast || d.health == nil {
+		return nil
+	}
+	if verdict(d.health.recent()) == HealthDown {
+		return server.NewError(server.UnavailableError, "Google BrainMaps API is down for %q per health checks", d.DataName())
+	}
+	return nil
+}
+
+// checkAvailableOrMirrored is checkAvailable for requests that can be served from a mirror
+// when upstream is down.
+func (d *Data) checkAvailableOrMirrored() error {
+	if d.Mirror != "" {
+		return nil
+	}
+	return d.checkAvailable()
+}
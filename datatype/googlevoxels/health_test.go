@@ -0,0 +1,52 @@
+package googlevoxels
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHealthVerdict(t *testing.T) {
+	good := HealthCheck{StatusCode: http.StatusOK, LatencyMs: 20}
+	slow := HealthCheck{StatusCode: http.StatusOK, LatencyMs: 10000}
+	bad := HealthCheck{StatusCode: http.StatusForbidden, LatencyMs: 20}
+	failed := HealthCheck{Error: "connection refused"}
+
+	tests := []struct {
+		checks  []HealthCheck
+		verdict string
+	}{
+		{nil, HealthUnknown},
+		{[]HealthCheck{good, good, good}, HealthHealthy},
+		{[]HealthCheck{slow, good, good}, HealthDegraded},
+		{[]HealthCheck{good, bad, good}, HealthDegraded},
+		{[]HealthCheck{bad, failed, good, good}, HealthDegraded},
+		{[]HealthCheck{bad, failed, bad, good}, HealthDown},
+		{[]HealthCheck{failed}, HealthDown},
+	}
+	for i, test := range tests {
+		if got := verdict(test.checks); got != test.verdict {
+			t.Errorf("Test %d: expected verdict %q, got %q\n", i, test.verdict, got)
+		}
+	}
+}
+
+func TestHealthRingBuffer(t *testing.T) {
+	hc := newHealthChecker()
+	start := time.Now()
+	for i := 0; i < HealthHistory+5; i++ {
+		hc.record(HealthCheck{Time: start.Add(time.Duration(i) * time.Second), StatusCode: http.StatusOK})
+	}
+	checks := hc.recent()
+	if len(checks) != HealthHistory {
+		t.Fatalf("Expected %d checks, got %d\n", HealthHistory, len(checks))
+	}
+	for i, check := range checks {
+		expected := start.Add(time.Duration(HealthHistory+4-i) * time.Second)
+		if !check.Time.Equal(expected) {
+			t.Errorf("Check %d: expected time %s, got %s\n", i, expected, check.Time)
+		}
+	}
+	hc.close()
+	hc.close() // closing twice should be safe
+}
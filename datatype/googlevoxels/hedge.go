@@ -0,0 +1,174 @@
+/*
+	This file implements hedged requests to Google.  The BrainMaps API occasionally takes
+	seconds to respond, so if the response headers of a request haven't arrived within the
+	instance's hedge delay, an identical request is sent and whichever responds first is used.
+	Hedges are capped as a percentage of all requests and stop once the day's requests pass
+	the instance's quota threshold, so a systemic slowdown doesn't double quota use.
+*/
+
+package googlevoxels
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// DefaultHedgePercent is the maximum percentage of requests to Google that are hedges for
+// instances without a hedgepercent setting.
+const DefaultHedgePercent = 10
+
+// hedgePercent returns the maximum percentage of requests to Google that are hedges.
+func (p *Properties) hedgePercent() int {
+	if p.HedgePercent == 0 {
+		return DefaultHedgePercent
+	}
+	return p.HedgePercent
+}
+
+// utcDay returns the number of days since the epoch of the UTC day of t.
+func utcDay(t time.Time) int64 {
+	return t.Unix() / (24 * 60 * 60)
+}
+
+// countDaily adds a request to the count of the UTC day of now, resetting the count when a
+// new day starts, and returns the count.
+func (s *instanceStats) countDaily(now time.Time) uint64 {
+	day := utcDay(now)
+	if old := atomic.LoadInt64(&s.quotaDay); old != day && atomic.CompareAndSwapInt64(&s.quotaDay, old, day) {
+		atomic.StoreUint64(&s.dailyRequests, 0)
+	}
+	return atomic.AddUint64(&s.dailyRequests, 1)
+}
+
+// daily returns the number of requests in the UTC day of now.
+func (s *instanceStats) daily(now time.Time) uint64 {
+	if atomic.LoadInt64(&s.quotaDay) != utcDay(now) {
+		return 0
+	}
+	return atomic.LoadUint64(&s.dailyRequests)
+}
+
+// countRequest counts a request to Google.
+func (d *Data) countRequest() {
+	atomic.AddUint64(&d.stats.upstreamRequests, 1)
+	d.stats.countDaily(time.Now())
+}
+
+// mayHedge returns true and counts a hedge request if one can be sent without exceeding the
+// instance's hedge percentage or daily quota threshold.
+func (d *Data) mayHedge() bool {
+	if d.HedgeQuota > 0 && d.stats.daily(time.Now()) >= uint64(d.HedgeQuota) {
+		return false
+	}
+	requests := atomic.LoadUint64(&d.stats.upstreamRequests) + 1
+	hedged := atomic.AddUint64(&d.stats.hedgedRequests, 1)
+	if hedged*100 > uint64(d.hedgePercent())*requests {
+		atomic.AddUint64(&d.stats.hedgedRequests, ^uint64(0))
+		return false
+	}
+	return true
+}
+
+// cancelingBody cancels the request of a response body when the body is closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb cancelingBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
+
+// hedgeResult is the outcome of one of the identical requests of a hedged request.
+type hedgeResult struct {
+	hedge bool
+	resp  *http.Response
+	err   error
+}
+
+// hedgedGet requests a Google URL that lacks the authentication key with the given timeout,
+// where 0 is no timeout.  If the instance hedges requests and the response headers haven't
+// arrived within the hedge delay, an identical request is sent.  The first response is
+// returned and the other request is canceled.  An error is only returned if all requests
+// fail.
+func (d *Data) hedgedGet(requestID, urlSansKey string, timeout time.Duration) (*http.Response, error) {
+	client := d.googleClient(timeout)
+	delay := d.HedgeDelay
+	if delay == 0 {
+		d.countRequest()
+		return client.Get(urlSansKey)
+	}
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	send := func(hedge bool) error {
+		req, err := http.NewRequest("GET", urlSansKey, nil)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(fetchContext(requestID))
+		req.Cancel = ctx.Done()
+		cancels = append(cancels, cancel)
+		d.countRequest()
+		go func() {
+			resp, err := client.Do(req)
+			results <- hedgeResult{hedge, resp, err}
+		}()
+		return nil
+	}
+	if err := send(false); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending := 1
+	for {
+		select {
+		case <-timer.C:
+			if !d.mayHedge() {
+				continue
+			}
+			dvid.Infof("[%s] Hedging request to Google after no response in %s: %s\n", requestID, delay, urlSansKey)
+			if err := send(true); err == nil {
+				pending++
+			}
+		case result := <-results:
+			pending--
+			if result.err != nil && pending > 0 {
+				continue // the other request may still succeed
+			}
+			winner := 0
+			if result.hedge {
+				winner = 1
+				atomic.AddUint64(&d.stats.hedgesWon, 1)
+			}
+			for i, cancel := range cancels {
+				if i != winner || result.err != nil {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if loser := <-results; loser.resp != nil {
+							loser.resp.Body.Close()
+						}
+					}
+				}(pending)
+			}
+			if result.err != nil {
+				return nil, result.err
+			}
+			result.resp.Body = cancelingBody{result.resp.Body, cancels[winner]}
+			return result.resp, nil
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowFirstTransport holds its first request until it's canceled and responds to later
+// requests immediately.
+type slowFirstTransport struct {
+	count    int64
+	body     []byte
+	canceled chan struct{}
+}
+
+func (st *slowFirstTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if atomic.AddInt64(&st.count, 1) == 1 {
+		select {
+		case <-r.Cancel:
+			close(st.canceled)
+			return nil, fmt.Errorf("request canceled")
+		case <-time.After(10 * time.Second):
+		}
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(st.body)),
+		Request:    r,
+	}, nil
+}
+
+func TestHedgedRequest(t *testing.T) {
+	d := newTestData(t)
+	transport := &slowFirstTransport{body: []byte("hedged tile"), canceled: make(chan struct{})}
+	defer useTransport(transport)()
+	d.HedgeDelay = 20 * time.Millisecond
+	d.HedgePercent = 100
+
+	start := time.Now()
+	up, err := d.getUpstream("hedge", "http://example.com/tile")
+	if err != nil {
+		t.Fatalf("Unable to get hedged request: %s\n", err.Error())
+	}
+	defer up.close()
+	if string(up.data) != "hedged tile" {
+		t.Errorf("Expected response of hedge, got %q\n", up.data)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected hedge to respond quickly, took %s\n", elapsed)
+	}
+	select {
+	case <-transport.canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected slow first request to be canceled\n")
+	}
+	stats := d.stats.get()
+	if stats.UpstreamRequests != 2 || stats.HedgedRequests != 1 || stats.HedgesWon != 1 || stats.DailyRequests != 2 {
+		t.Errorf("Unexpected stats after hedged request: %+v\n", stats)
+	}
+
+	// Hedges are capped as a percentage of requests and stop past the daily quota threshold.
+	d.HedgePercent = 40
+	if d.mayHedge() {
+		t.Errorf("Expected hedge to be refused past the hedge percentage\n")
+	}
+	d.HedgePercent = 100
+	d.HedgeQuota = 2
+	if d.mayHedge() {
+		t.Errorf("Expected hedge to be refused past the daily quota threshold\n")
+	}
+	if hedged := d.stats.get().HedgedRequests; hedged != 1 {
+		t.Errorf("Expected refused hedges to be uncounted, got %d hedges\n", hedged)
+	}
+	d.HedgeQuota = 3
+	if !d.mayHedge() {
+		t.Errorf("Expected hedge to be allowed under the daily quota threshold\n")
+	}
+}
+
+func TestDailyRequests(t *testing.T) {
+	var s instanceStats
+	now := time.Date(2015, 3, 1, 23, 59, 0, 0, time.UTC)
+	s.countDaily(now)
+	s.countDaily(now)
+	if n := s.daily(now); n != 2 {
+		t.Errorf("Expected 2 requests today, got %d\n", n)
+	}
+	tomorrow := now.Add(2 * time.Minute)
+	if n := s.daily(tomorrow); n != 0 {
+		t.Errorf("Expected no requests at start of next day, got %d\n", n)
+	}
+	if n := s.countDaily(tomorrow); n != 1 {
+		t.Errorf("Expected count to restart on next day, got %d\n", n)
+	}
+}
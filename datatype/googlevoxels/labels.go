@@ -0,0 +1,114 @@
+/*
+	This file supports the use of uint64 volumes hosted by Google as read-only label sources,
+	e.g., a base segmentation.  Label ids are never image-encoded, so they are returned
+	bit-exactly as JSON integers or little-endian uint64 slices.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+var labelsQueryParams = server.QueryParams{
+	{Name: "scale", Help: "Default is 0.  For scale N, coordinates are in the volume down-sampled by a factor of 2^N."},
+	fallbackQueryParam,
+}
+
+// checkLabels returns an error if voxels of the given channel type aren't uint64 labels.
+func (d *Data) checkLabels(channelType string) error {
+	if channelType != dvid.ChannelUint64 {
+		return fmt.Errorf("Data %q holds %s voxels, not uint64 labels", d.DataName(), channelType)
+	}
+	return nil
+}
+
+// getLabels returns the labels at the given points, using 0 for points outside the scaled
+// volume.  The number of subvolume requests is also returned.
+func (d *Data) getLabels(requestID string, scale Scaling, points []dvid.Point3d) ([]uint64, int, error) {
+	if geomIndex, found := d.TileMap[TileSpec{scale, XY}]; found {
+		if err := d.checkLabels(d.Scales[geomIndex].ChannelType); err != nil {
+			return nil, 0, err
+		}
+	}
+	values, numRequests, err := d.getValues(requestID, scale, points)
+	if err != nil {
+		return nil, numRequests, err
+	}
+	labels := make([]uint64, len(values))
+	for i, value := range values {
+		if value != nil {
+			labels[i] = value.(uint64)
+		}
+	}
+	return labels, numRequests, nil
+}
+
+// serveLabelsAt returns a JSON list of labels for a JSON list of points in the request body.
+func (d *Data) serveLabelsAt(w http.ResponseWriter, r *http.Request, requestID string) error {
+	query, err := server.NewQuery(r, labelsQueryParams, d.StrictQueries)
+	if err != nil {
+		return err
+	}
+	scale, err := query.GetInt("scale", 0, 0, 255)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	var points []dvid.Point3d
+	if err := json.Unmarshal(body, &points); err != nil {
+		return fmt.Errorf("Expected JSON list of [x,y,z] points: %s", err.Error())
+	}
+	if len(points) > MaxValuePoints {
+		return fmt.Errorf("Requested %d points, which exceeds the maximum of %d per request", len(points), MaxValuePoints)
+	}
+	labels, numRequests, err := d.getLabels(requestID, Scaling(scale), points)
+	w.Header().Set("X-Upstream-Requests", strconv.Itoa(numRequests))
+	if err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	return server.WriteJSON(w, r, jsonBytes)
+}
+
+// serveSliceLabels returns a slice of labels as little-endian uint64 values.  Regions outside
+// the volume hold the background label.
+func (d *Data) serveSliceLabels(w http.ResponseWriter, r *http.Request, requestID string, parts []string) error {
+	plane, size, offset, err := parseSliceRequest(parts)
+	if err != nil {
+		return err
+	}
+	query, err := server.NewQuery(r, labelsQueryParams, d.StrictQueries)
+	if err != nil {
+		return err
+	}
+	scale, err := query.GetInt("scale", 0, 0, 255)
+	if err != nil {
+		return err
+	}
+	fallback, err := query.GetBool("fallback", d.Fallback)
+	if err != nil {
+		return err
+	}
+	tile, err := d.getGoogleSpec(Scaling(scale), plane, offset, size, fallback)
+	if err != nil {
+		return err
+	}
+	if err := d.checkLabels(tile.channelType); err != nil {
+		return err
+	}
+	return d.serveTile(w, r, requestID, tile, RawFormat, false, nil, nil)
+}
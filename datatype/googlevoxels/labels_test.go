@@ -0,0 +1,146 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// testLabel returns a label for a voxel that uses all 64 bits.
+func testLabel(x, y, z int32) uint64 {
+	return math.MaxUint64 - uint64(x) - uint64(y)<<20 - uint64(z)<<40
+}
+
+// labelTransport returns testLabel values for the subvolume given by the corner and size
+// of each request.
+type labelTransport struct{}
+
+func (lt labelTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var corner, size dvid.Point3d
+	var err error
+	if corner, err = dvid.StringToPoint3d(r.URL.Query().Get("corner"), ","); err == nil {
+		size, err = dvid.StringToPoint3d(r.URL.Query().Get("size"), ",")
+	}
+	status := http.StatusOK
+	var body []byte
+	if err != nil {
+		status = http.StatusBadRequest
+	} else {
+		for z := corner[2]; z < corner[2]+size[2]; z++ {
+			for y := corner[1]; y < corner[1]+size[1]; y++ {
+				for x := corner[0]; x < corner[0]+size[0]; x++ {
+					body = append(body, uint64Data(testLabel(x, y, z))...)
+				}
+			}
+		}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func TestLabelsAt(t *testing.T) {
+	d := newTestData(t)
+	defer useTransport(labelTransport{})()
+
+	// Only uint64 volumes are label sources.
+	body := `[[1,2,3], [999,998,997], [2000,0,0], [9,8,7]]`
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/labels-at", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected labels-at on uint8 data to fail, got status %d\n", w.Code)
+	}
+
+	d.Scales[0].ChannelType = dvid.ChannelUint64
+	r, _ = http.NewRequest("GET", "/api/node/a9b8c7/grayscale/labels-at", bytes.NewBufferString(body))
+	w = httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("labels-at request returned status %d: %s\n", w.Code, w.Body.String())
+	}
+	var labels []uint64
+	if err := json.Unmarshal(w.Body.Bytes(), &labels); err != nil {
+		t.Fatalf("Unable to decode labels %q: %s\n", w.Body.String(), err.Error())
+	}
+	expected := []uint64{testLabel(1, 2, 3), testLabel(999, 998, 997), 0, testLabel(9, 8, 7)}
+	if len(labels) != len(expected) {
+		t.Fatalf("Expected %d labels, got %d\n", len(expected), len(labels))
+	}
+	for i := range expected {
+		if labels[i] != expected[i] {
+			t.Errorf("Point %d: expected label %d, got %d\n", i, expected[i], labels[i])
+		}
+	}
+	if got := w.Header().Get("X-Upstream-Requests"); got != "3" {
+		t.Errorf("Expected 3 upstream requests, got %q\n", got)
+	}
+}
+
+func TestSliceLabels(t *testing.T) {
+	d := newTestData(t)
+	d.Scales[0].ChannelType = dvid.ChannelUint64
+	d.Background = "18446744073709551615"
+	d.OOBStyle = OOBChecker
+	defer useTransport(labelTransport{})()
+
+	// An edge slice is padded with the background label, not a checkerboard.
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/slice-labels/xz/200_50/900_30_980", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("slice-labels request returned status %d: %s\n", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("Expected raw labels, got content type %q\n", got)
+	}
+	data := w.Body.Bytes()
+	if len(data) != 200*50*8 {
+		t.Fatalf("Expected %d bytes of labels, got %d\n", 200*50*8, len(data))
+	}
+	for z := int32(0); z < 50; z++ {
+		for x := int32(0); x < 200; x++ {
+			expected := uint64(math.MaxUint64)
+			if x < 100 && z < 20 {
+				expected = testLabel(900+x, 30, 980+z)
+			}
+			if got := binary.LittleEndian.Uint64(data[(z*200+x)*8:]); got != expected {
+				t.Fatalf("Expected label %d at (%d,%d) of edge slice, got %d\n", expected, x, z, got)
+			}
+		}
+	}
+
+	// Slices outside the volume are all background.
+	r, _ = http.NewRequest("GET", "/api/node/a9b8c7/grayscale/slice-labels/xy/4_4/1000_0_0", nil)
+	w = httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Outside slice-labels request returned status %d: %s\n", w.Code, w.Body.String())
+	}
+	if !bytes.Equal(w.Body.Bytes(), bytes.Repeat([]byte{255}, 4*4*8)) {
+		t.Errorf("Expected outside slice to be background labels, got %v\n", w.Body.Bytes())
+	}
+
+	// Tiles of labels can't be jpeg, even if windowed.
+	for _, url := range []string{
+		"/api/node/a9b8c7/grayscale/tile/xy/0/0_0_0/jpeg?window=auto",
+		"/api/node/a9b8c7/grayscale/raw/xy/4_4/0_0_0/jpg:90",
+	} {
+		r, _ = http.NewRequest("GET", url, nil)
+		w = httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		if w.Code != http.StatusBadRequest || !bytes.Contains(w.Body.Bytes(), []byte("png")) {
+			t.Errorf("Expected jpeg request %q to be refused with png suggestion, got status %d: %s\n", url, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,308 @@
+/*
+	This file persists selected instance stats to the metadata store so counts like cache
+	hits and upstream requests accumulate across server restarts.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// MinStatsPersist is the shortest allowed interval between saves of persisted stats, which
+// keeps the single metadata write per save from competing with data traffic.
+const MinStatsPersist = time.Minute
+
+// statsKey is the reserved index under the instance's unversioned context that holds
+// persisted stats.
+var statsKey = []byte{0xFF}
+
+// persistableStat is a stat that can be persisted.  Counters only increase and are summed
+// across server runs while gauges like cache size are replaced by the latest value.
+type persistableStat struct {
+	name  string
+	gauge bool
+	value func(s *Stats, cache *dvid.CacheStats) uint64
+}
+
+var persistableStats = []persistableStat{
+	{"UpstreamRequests", false, func(s *Stats, _ *dvid.CacheStats) uint64 { return s.UpstreamRequests }},
+	{"CoalescedRequests", false, func(s *Stats, _ *dvid.CacheStats) uint64 { return s.CoalescedRequests }},
+	{"PassthroughTiles", false, func(s *Stats, _ *dvid.CacheStats) uint64 { return s.PassthroughTiles }},
+	{"TranscodedTiles", false, func(s *Stats, _ *dvid.CacheStats) uint64 { return s.TranscodedTiles }},
+	{"MirroredTiles", false, func(s *Stats, _ *dvid.CacheStats) uint64 { return s.MirroredTiles }},
+	{"MirrorDropped", false, func(s *Stats, _ *dvid.CacheStats) uint64 { return s.MirrorDropped }},
+	{"MirrorErrors", false, func(s *Stats, _ *dvid.CacheStats) uint64 { return s.MirrorErrors }},
+	{"MirrorServed", false, func(s *Stats, _ *dvid.CacheStats) uint64 { return s.MirrorServed }},
+	{"InvalidResponses", false, func(s *Stats, _ *dvid.CacheStats) uint64 { return s.InvalidResponses }},
+	{"HedgedRequests", false, func(s *Stats, _ *dvid.CacheStats) uint64 { return s.HedgedRequests }},
+	{"HedgesWon", false, func(s *Stats, _ *dvid.CacheStats) uint64 { return s.HedgesWon }},
+	{"CacheHits", false, func(_ *Stats, cs *dvid.CacheStats) uint64 { return cs.Hits }},
+	{"CacheMisses", false, func(_ *Stats, cs *dvid.CacheStats) uint64 { return cs.Misses }},
+	{"CacheEntries", true, func(_ *Stats, cs *dvid.CacheStats) uint64 { return uint64(cs.Entries) }},
+	{"CacheBytes", true, func(_ *Stats, cs *dvid.CacheStats) uint64 { return cs.Bytes }},
+}
+
+// persistableStatNames returns the names of all stats that can be persisted.
+func persistableStatNames() []string {
+	names := make([]string, len(persistableStats))
+	for i, stat := range persistableStats {
+		names[i] = stat.name
+	}
+	return names
+}
+
+// parseStatsMetrics returns the canonical names of the comma-separated stats, which are
+// matched without regard to case.  An empty list or "all" selects every stat.
+func parseStatsMetrics(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.ToLower(value) == "all" {
+		return nil, nil
+	}
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		var found bool
+		for _, stat := range persistableStats {
+			if strings.EqualFold(name, stat.name) {
+				names = append(names, stat.name)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown stat %q.  Persistable stats are: %s", name, strings.Join(persistableStatNames(), ", "))
+		}
+	}
+	return names, nil
+}
+
+// checkStatsPersist validates the interval between saves of persisted stats, where "0"
+// disables persistence.
+func checkStatsPersist(value string) error {
+	if value == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if interval != 0 && interval < MinStatsPersist {
+		return fmt.Errorf("interval %s must be at least %s", interval, MinStatsPersist)
+	}
+	return nil
+}
+
+// PersistedStats are stats accumulated over all server runs since persistence began at Since.
+// Counters include counts from the current run while Gauges are as of the last save at Saved,
+// which is zero if nothing has been saved since the instance was loaded.
+type PersistedStats struct {
+	Since    time.Time
+	Saved    time.Time
+	Counters map[string]uint64
+	Gauges   map[string]uint64
+}
+
+// statsPersister holds persisted stats restored when the instance was loaded and controls
+// the goroutine that periodically saves them.
+type statsPersister struct {
+	sync.Mutex
+	restored PersistedStats // counters from previous runs, which current counts are added to
+	saved    time.Time
+	gauges   map[string]uint64
+
+	stop chan struct{} // nil if periodic saves aren't running
+	done chan struct{} // closed when the saving goroutine exits
+}
+
+// initStats marks the start of the instance's process-lifetime stats and restores persisted
+// stats if persistence is configured.
+func (d *Data) initStats() {
+	d.stats.since = time.Now()
+	d.startStatsPersist()
+}
+
+// startStatsPersist starts periodic saves of stats if they are configured for this instance.
+// Persisted stats are only restored the first time so counts of this run aren't added twice.
+func (d *Data) startStatsPersist() {
+	if d.StatsPersist <= 0 || atomic.LoadInt32(&d.closed) == 1 {
+		return
+	}
+	p := d.statsPersist
+	if p == nil {
+		restored, err := d.loadStats()
+		if err != nil {
+			dvid.Errorf("Unable to restore persisted stats for %q: %s\n", d.DataName(), err.Error())
+			restored = PersistedStats{Since: time.Now()}
+		}
+		p = &statsPersister{restored: restored, gauges: restored.Gauges}
+		d.statsPersist = p
+	}
+	if p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go d.runStatsPersist(d.StatsPersist, p.stop, p.done)
+}
+
+func (d *Data) runStatsPersist(interval time.Duration, stop, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+		close(done)
+	}()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := d.saveStats(); err != nil {
+				dvid.Errorf("Unable to persist stats for %q: %s\n", d.DataName(), err.Error())
+			}
+		}
+	}
+}
+
+// stopStatsPersist stops periodic saves of stats, if running, after a final save.
+func (d *Data) stopStatsPersist() {
+	p := d.statsPersist
+	if p == nil || p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+	if err := d.saveStats(); err != nil {
+		dvid.Errorf("Unable to persist stats for %q: %s\n", d.DataName(), err.Error())
+	}
+}
+
+// loadStats returns the persisted stats of the instance or empty stats starting now if
+// none have been persisted.
+func (d *Data) loadStats() (PersistedStats, error) {
+	stats := PersistedStats{Since: time.Now()}
+	db, err := storage.MetaDataStore()
+	if err != nil {
+		return stats, err
+	}
+	value, err := db.Get(storage.NewDataContext(d, 0), statsKey)
+	if err != nil || value == nil {
+		return stats, err
+	}
+	if err := json.Unmarshal(value, &stats); err != nil {
+		return PersistedStats{Since: time.Now()}, fmt.Errorf("bad persisted stats: %s", err.Error())
+	}
+	// Persisted values are a snapshot, not a time of save in this run.
+	stats.Saved = time.Time{}
+	return stats, nil
+}
+
+// saveStats writes the selected stats in a single metadata write.  Stats that were persisted
+// before but are no longer selected keep their persisted values.
+func (d *Data) saveStats() error {
+	p := d.statsPersist
+	if p == nil {
+		return nil
+	}
+	db, err := storage.MetaDataStore()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	current := d.persistedStats()
+	for name, value := range p.restored.Counters {
+		if _, found := current.Counters[name]; !found {
+			current.Counters[name] = value
+		}
+	}
+	for name, value := range p.restored.Gauges {
+		if _, found := current.Gauges[name]; !found {
+			current.Gauges[name] = value
+		}
+	}
+	current.Saved = time.Now()
+	value, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	if err := db.Put(storage.NewDataContext(d, 0), statsKey, value); err != nil {
+		return err
+	}
+	p.saved = current.Saved
+	p.gauges = current.Gauges
+	return nil
+}
+
+// persistedStats returns the selected stats accumulated over all runs with restored counters
+// added to the current counts.  Gauges are the current values.  Callers must hold the lock
+// of the instance's persister.
+func (d *Data) persistedStats() *PersistedStats {
+	p := d.statsPersist
+	stats := d.stats.get()
+	cache := d.CacheStats()
+	if cache == nil {
+		cache = &dvid.CacheStats{}
+	}
+	persisted := &PersistedStats{
+		Since:    p.restored.Since,
+		Saved:    p.saved,
+		Counters: make(map[string]uint64),
+		Gauges:   make(map[string]uint64),
+	}
+	for _, stat := range persistableStats {
+		if !d.persistsStat(stat.name) {
+			continue
+		}
+		value := stat.value(&stats, cache)
+		if stat.gauge {
+			persisted.Gauges[stat.name] = value
+		} else {
+			persisted.Counters[stat.name] = p.restored.Counters[stat.name] + value
+		}
+	}
+	return persisted
+}
+
+// persistsStat returns true if the named stat is selected for persistence.
+func (p *Properties) persistsStat(name string) bool {
+	if len(p.StatsMetrics) == 0 {
+		return true
+	}
+	for _, selected := range p.StatsMetrics {
+		if selected == name {
+			return true
+		}
+	}
+	return false
+}
+
+// statsReport returns the stats for /info, including any disk cache, with persisted stats if they are configured.  Persisted gauges are
+// reported as last saved rather than the current values given by the process stats.
+func (d *Data) statsReport() Stats {
+	stats := d.stats.get()
+	stats.DiskCache = d.DiskCacheStats()
+	p := d.statsPersist
+	if p == nil || d.StatsPersist <= 0 {
+		return stats
+	}
+	p.Lock()
+	stats.Persisted = d.persistedStats()
+	stats.Persisted.Gauges = make(map[string]uint64, len(p.gauges))
+	for name, value := range p.gauges {
+		if d.persistsStat(name) {
+			stats.Persisted.Gauges[name] = value
+		}
+	}
+	p.Unlock()
+	return stats
+}
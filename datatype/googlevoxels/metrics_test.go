@@ -0,0 +1,110 @@
+package googlevoxels
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestStatsPersistence(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, _ := tests.NewRepo()
+	uuid := repo.RootUUID()
+
+	newData := func() *Data {
+		d := newTestData(t)
+		var err error
+		if d.Data, err = datastore.NewDataService(NewType(), uuid, 1001, "grayscale", dvid.NewConfig()); err != nil {
+			t.Fatalf("Unable to create base data: %s\n", err.Error())
+		}
+		d.TileCacheMB = 1
+		d.StatsPersist = time.Hour
+		d.StatsMetrics = []string{"UpstreamRequests", "CacheMisses", "CacheEntries"}
+		d.initCache()
+		d.initStats()
+		return d
+	}
+
+	d := newData()
+	atomic.AddUint64(&d.stats.upstreamRequests, 5)
+	atomic.AddUint64(&d.stats.passthroughTiles, 3)
+	d.cache.Get("missing")
+	d.cache.Set("tile", []byte{1, 2, 3}, nil)
+	d.Shutdown()
+
+	// Counters are added to those of the new run while gauges are restored as last saved.
+	d = newData()
+	defer d.Shutdown()
+	atomic.AddUint64(&d.stats.upstreamRequests, 2)
+	stats := d.statsReport()
+	if stats.UpstreamRequests != 2 || stats.Since.IsZero() {
+		t.Errorf("Expected 2 upstream requests since restart, got %+v\n", stats)
+	}
+	if stats.Persisted == nil {
+		t.Fatalf("Expected persisted stats\n")
+	}
+	expected := map[string]uint64{"UpstreamRequests": 7, "CacheMisses": 1}
+	if len(stats.Persisted.Counters) != len(expected) {
+		t.Errorf("Expected only selected counters to be persisted, got %v\n", stats.Persisted.Counters)
+	}
+	for name, value := range expected {
+		if stats.Persisted.Counters[name] != value {
+			t.Errorf("Expected persisted %s %d, got %d\n", name, value, stats.Persisted.Counters[name])
+		}
+	}
+	if stats.Persisted.Gauges["CacheEntries"] != 1 || !stats.Persisted.Saved.IsZero() {
+		t.Errorf("Expected restored gauge before first save, got %+v\n", stats.Persisted)
+	}
+	if !stats.Persisted.Since.Before(stats.Since) {
+		t.Errorf("Expected persisted stats to start before this run: %s vs %s\n", stats.Persisted.Since, stats.Since)
+	}
+
+	// Saving replaces gauges with current values and reports the save time in /info.
+	if err := d.saveStats(); err != nil {
+		t.Fatalf("Unable to save stats: %s\n", err.Error())
+	}
+	jsonBytes, err := d.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Unable to marshal info: %s\n", err.Error())
+	}
+	var info struct {
+		Stats Stats
+	}
+	if err := json.Unmarshal(jsonBytes, &info); err != nil {
+		t.Fatalf("Unable to decode info: %s\n", err.Error())
+	}
+	persisted := info.Stats.Persisted
+	if persisted == nil || persisted.Saved.IsZero() || persisted.Gauges["CacheEntries"] != 0 || persisted.Counters["UpstreamRequests"] != 7 {
+		t.Errorf("Unexpected persisted stats in info after save: %+v\n", persisted)
+	}
+
+	// Unknown stats and overly frequent saves are rejected.
+	config := dvid.NewConfig()
+	config.Set("statsmetrics", "UpstreamRequests,QuotaUsed")
+	if err := d.ModifyConfig(config); err == nil || !strings.Contains(err.Error(), "QuotaUsed") {
+		t.Errorf("Expected error for unknown stat, got %v\n", err)
+	}
+	config = dvid.NewConfig()
+	config.Set("statspersist", "1s")
+	if err := d.ModifyConfig(config); err == nil {
+		t.Errorf("Expected error for stats persist interval below minimum\n")
+	}
+
+	// Disabling persistence removes the persisted stats from /info.
+	config = dvid.NewConfig()
+	config.Set("statspersist", "0")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to disable stats persistence: %s\n", err.Error())
+	}
+	if stats := d.statsReport(); stats.Persisted != nil {
+		t.Errorf("Expected no persisted stats after disabling, got %+v\n", stats.Persisted)
+	}
+}
@@ -0,0 +1,367 @@
+/*
+	This file supports mirroring voxels fetched from Google into a local uint8 voxels instance,
+	e.g., grayscale8, so regions already viewed can be served when Google is unreachable.
+
+	Mirrored regions are recorded in this instance's key space so offline requests can tell
+	never-fetched regions from mirrored regions that happen to hold zero voxels.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// MirrorQueueSize is the number of fetched tiles that can wait to be written to the mirror.
+// Tiles fetched while the queue is full are dropped rather than delaying responses.
+const MirrorQueueSize = 64
+
+// Values of the X-DVID-Source header, which tells clients where tile data came from.
+const (
+	SourceGoogle = "google"
+	SourceMirror = "mirror"
+)
+
+// mirrorTarget is the mirror instance at the version of a request.
+type mirrorTarget struct {
+	data      *voxels.Data
+	versionID dvid.VersionID
+	offline   bool // true if the request should be served from the mirror
+}
+
+// mirrorWrite is a fetched tile waiting to be written to the mirror.
+type mirrorWrite struct {
+	target *mirrorTarget
+	tile   *GoogleTileSpec
+	data   []byte // the tile's voxels without padding
+}
+
+// mirrorWriter writes queued tiles to mirrors in the background.
+type mirrorWriter struct {
+	queue chan mirrorWrite
+	stop  chan struct{}
+	done  chan struct{} // closed when the writing goroutine exits
+}
+
+// getMirror returns the mirror for a request or nil if the data has no mirror.  Requests
+// are served from the mirror if they have the "offline=true" query string or health checks
+// show Google is down.
+func (d *Data) getMirror(ctx context.Context, query *server.Query) (*mirrorTarget, error) {
+	offline, err := query.GetBool("offline", false)
+	if err != nil {
+		return nil, err
+	}
+	if d.Mirror == "" {
+		if offline {
+			return nil, fmt.Errorf("Offline requests require a 'mirror' setting for %q", d.DataName())
+		}
+		return nil, nil
+	}
+	_, versions, err := datastore.FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var versionID dvid.VersionID
+	if len(versions) > 0 {
+		versionID = versions[0]
+	}
+	dataservice, err := datastore.GetData(versionID, d.Mirror)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get mirror %q for %q: %s", d.Mirror, d.DataName(), err.Error())
+	}
+	mirror, ok := dataservice.(*voxels.Data)
+	if !ok || len(mirror.Values()) != 1 || mirror.Values().BytesPerElement() != 1 {
+		return nil, fmt.Errorf("Mirror %q for %q is not a uint8 voxels instance like grayscale8", d.Mirror, d.DataName())
+	}
+	if !offline && d.health != nil && verdict(d.health.recent()) == HealthDown {
+		offline = true
+	}
+	return &mirrorTarget{mirror, versionID, offline}, nil
+}
+
+// mirrors returns true if the tile can be stored in a mirror, which only holds uint8
+// voxels at the highest resolution.
+func (d *Data) mirrors(mirror *mirrorTarget, tile *GoogleTileSpec) bool {
+	return mirror != nil && tile.scaling == 0 && tile.gi == d.HighResIndex && tile.channelType == dvid.ChannelUint8
+}
+
+// sliceGeometry returns the geometry of the part of the tile within the volume.
+func (gts GoogleTileSpec) sliceGeometry() (dvid.Geometry, error) {
+	var shape dvid.DataShape
+	switch gts.plane {
+	case XZ:
+		shape = dvid.XZ
+	case YZ:
+		shape = dvid.YZ
+	default:
+		shape = dvid.XY
+	}
+	d0, d1 := gts.dims()
+	return dvid.NewOrthogSlice(shape, gts.offset, dvid.Point2d{gts.size[d0], gts.size[d1]})
+}
+
+// cropTile returns the part of padded tile data that lies within the volume.
+func (gts GoogleTileSpec) cropTile(data []byte) []byte {
+	if !gts.edge {
+		return data
+	}
+	d0, d1 := gts.dims()
+	inRowBytes := gts.sizeWant[d0] * gts.bytesPerVoxel
+	outRowBytes := gts.size[d0] * gts.bytesPerVoxel
+	start := gts.pad[d1]*inRowBytes + gts.pad[d0]*gts.bytesPerVoxel
+	out := make([]byte, outRowBytes*gts.size[d1])
+	for y := int32(0); y < gts.size[d1]; y++ {
+		copy(out[y*outRowBytes:(y+1)*outRowBytes], data[start+y*inRowBytes:])
+	}
+	return out
+}
+
+// queueMirror queues fetched tile data, padded to the requested tile size, to be written
+// to the mirror.  It never blocks, dropping the tile if the queue is full.
+func (d *Data) queueMirror(mirror *mirrorTarget, tile *GoogleTileSpec, data []byte) {
+	if !d.mirrors(mirror, tile) || atomic.LoadInt32(&d.closed) != 0 {
+		return
+	}
+	d.mirrorOnce.Do(d.startMirrorWriter)
+	select {
+	case d.mirrorWriter.queue <- mirrorWrite{mirror, tile, tile.cropTile(data)}:
+	default:
+		atomic.AddUint64(&d.stats.mirrorDropped, 1)
+	}
+}
+
+func (d *Data) startMirrorWriter() {
+	d.mirrorWriter = &mirrorWriter{
+		queue: make(chan mirrorWrite, MirrorQueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go d.runMirrorWriter(d.mirrorWriter)
+}
+
+func (d *Data) runMirrorWriter(mw *mirrorWriter) {
+	defer close(mw.done)
+	for {
+		select {
+		case <-mw.stop:
+			return
+		case write := <-mw.queue:
+			if err := d.writeMirror(write); err != nil {
+				atomic.AddUint64(&d.stats.mirrorErrors, 1)
+				dvid.Errorf("Unable to mirror tile of %q into %q: %s\n", d.DataName(), d.Mirror, err.Error())
+				continue
+			}
+			atomic.AddUint64(&d.stats.mirroredTiles, 1)
+		}
+	}
+}
+
+// stopMirrorWriter stops background writes to the mirror, discarding any queued tiles.
+func (d *Data) stopMirrorWriter() {
+	d.mirrorOnce.Do(func() {})
+	if d.mirrorWriter != nil {
+		close(d.mirrorWriter.stop)
+		<-d.mirrorWriter.done
+	}
+}
+
+// writeMirror stores tile data in the mirror through its standard voxel ingestion, then
+// records the region as mirrored.
+func (d *Data) writeMirror(write mirrorWrite) error {
+	geom, err := write.tile.sliceGeometry()
+	if err != nil {
+		return err
+	}
+	mirror := write.target.data
+	e, err := mirror.NewExtHandler(geom, write.data)
+	if err != nil {
+		return err
+	}
+	ctx := datastore.NewVersionedContext(mirror, write.target.versionID)
+	if err := voxels.PutVoxels(ctx, mirror, e, voxels.OpOptions{}); err != nil {
+		return err
+	}
+	return d.putMirrored(write.target.versionID, write.tile)
+}
+
+// getMirrorData returns tile data from the mirror, padded to the requested tile size, or
+// a not found error if the tile has not been completely mirrored.
+func (d *Data) getMirrorData(mirror *mirrorTarget, tile *GoogleTileSpec) ([]byte, error) {
+	if !d.mirrors(mirror, tile) {
+		return nil, server.NewError(server.NotFoundError, "Only uint8 tiles at scale 0 are mirrored, so %q can't serve this tile offline", d.DataName())
+	}
+	mirrored, err := d.isMirrored(mirror.versionID, tile)
+	if err != nil {
+		return nil, server.NewError(server.StorageError, "Unable to check mirrored regions of %q: %s", d.DataName(), err.Error())
+	}
+	if !mirrored {
+		return nil, server.NewError(server.NotFoundError, "Requested region of %q has not been fetched into mirror %q", d.DataName(), d.Mirror)
+	}
+	geom, err := tile.sliceGeometry()
+	if err != nil {
+		return nil, err
+	}
+	e, err := mirror.data.NewExtHandler(geom, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx := datastore.NewVersionedContext(mirror.data, mirror.versionID)
+	data, err := voxels.GetVolume(ctx, mirror.data, e, nil)
+	if err != nil {
+		return nil, server.NewError(server.StorageError, "Unable to read mirror %q: %s", d.Mirror, err.Error())
+	}
+	if !tile.edge {
+		return data, nil
+	}
+	fill, err := d.oobFill(tile)
+	if err != nil {
+		return nil, err
+	}
+	return tile.padTile(data, fill)
+}
+
+// mirrorRect is a mirrored region given by the orientation and fixed coordinate of its
+// plane and the inclusive minimum and maximum in-plane coordinates.
+type mirrorRect struct {
+	plane    TileOrientation
+	fixed    int32
+	min, max [2]int32
+}
+
+func (gts GoogleTileSpec) mirrorRect() mirrorRect {
+	d0, d1 := gts.dims()
+	return mirrorRect{
+		plane: gts.plane,
+		fixed: gts.offset[3-d0-d1],
+		min:   [2]int32{gts.offset[d0], gts.offset[d1]},
+		max:   [2]int32{gts.offset[d0] + gts.size[d0] - 1, gts.offset[d1] + gts.size[d1] - 1},
+	}
+}
+
+// Mirrored region keys are the plane, fixed coordinate, and in-plane bounds with each
+// coordinate's sign bit flipped so keys sort by coordinate.
+const mirrorKeySize = 1 + 5*4
+
+func (mr mirrorRect) prefix() []byte {
+	key := make([]byte, 5, mirrorKeySize)
+	key[0] = byte(mr.plane)
+	binary.BigEndian.PutUint32(key[1:5], uint32(mr.fixed)^0x80000000)
+	return key
+}
+
+func (mr mirrorRect) key() []byte {
+	key := mr.prefix()[:mirrorKeySize]
+	for i, v := range []int32{mr.min[0], mr.min[1], mr.max[0], mr.max[1]} {
+		binary.BigEndian.PutUint32(key[5+4*i:], uint32(v)^0x80000000)
+	}
+	return key
+}
+
+func mirrorRectFromKey(key []byte) (mirrorRect, error) {
+	var mr mirrorRect
+	if len(key) != mirrorKeySize {
+		return mr, fmt.Errorf("Bad mirrored region key of %d bytes", len(key))
+	}
+	coord := func(i int) int32 {
+		return int32(binary.BigEndian.Uint32(key[1+4*i:]) ^ 0x80000000)
+	}
+	mr.plane = TileOrientation(key[0])
+	mr.fixed = coord(0)
+	mr.min = [2]int32{coord(1), coord(2)}
+	mr.max = [2]int32{coord(3), coord(4)}
+	return mr, nil
+}
+
+// putMirrored records the tile's region as mirrored.
+func (d *Data) putMirrored(versionID dvid.VersionID, tile *GoogleTileSpec) error {
+	db, err := storage.BigDataStore()
+	if err != nil {
+		return err
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	return db.Put(ctx, tile.mirrorRect().key(), []byte{1})
+}
+
+// isMirrored returns true if the tile's region is covered by mirrored regions.
+func (d *Data) isMirrored(versionID dvid.VersionID, tile *GoogleTileSpec) (bool, error) {
+	db, err := storage.BigDataStore()
+	if err != nil {
+		return false, err
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	want := tile.mirrorRect()
+	first := append(want.prefix(), make([]byte, mirrorKeySize-5)...)
+	last := want.prefix()
+	for len(last) < mirrorKeySize {
+		last = append(last, 0xFF)
+	}
+	keys, err := db.KeysInRange(ctx, first, last)
+	if err != nil {
+		return false, err
+	}
+	var rects []mirrorRect
+	for _, key := range keys {
+		index, err := ctx.IndexFromKey(key)
+		if err != nil {
+			return false, err
+		}
+		rect, err := mirrorRectFromKey(index)
+		if err != nil {
+			return false, err
+		}
+		rects = append(rects, rect)
+	}
+	return want.coveredBy(rects), nil
+}
+
+// coveredBy returns true if the union of the rectangles, which must be in the same plane,
+// covers the receiver.  The in-plane coordinates are divided at every rectangle edge and
+// each resulting cell must lie within some rectangle.
+func (mr mirrorRect) coveredBy(rects []mirrorRect) bool {
+	var edges [2][]int
+	for dim := 0; dim < 2; dim++ {
+		edges[dim] = []int{int(mr.min[dim]), int(mr.max[dim]) + 1}
+		for _, rect := range rects {
+			for _, edge := range []int{int(rect.min[dim]), int(rect.max[dim]) + 1} {
+				if edge > int(mr.min[dim]) && edge <= int(mr.max[dim]) {
+					edges[dim] = append(edges[dim], edge)
+				}
+			}
+		}
+		sort.Ints(edges[dim])
+	}
+	for i := 0; i+1 < len(edges[0]); i++ {
+		x := int32(edges[0][i])
+		if edges[0][i] == edges[0][i+1] {
+			continue
+		}
+		for j := 0; j+1 < len(edges[1]); j++ {
+			y := int32(edges[1][j])
+			if edges[1][j] == edges[1][j+1] {
+				continue
+			}
+			var covered bool
+			for _, rect := range rects {
+				if x >= rect.min[0] && x <= rect.max[0] && y >= rect.min[1] && y <= rect.max[1] {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				return false
+			}
+		}
+	}
+	return true
+}
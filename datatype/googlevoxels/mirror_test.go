@@ -0,0 +1,170 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestMirrorCoverage(t *testing.T) {
+	rect := func(x0, y0, x1, y1 int32) mirrorRect {
+		return mirrorRect{XY, 20, [2]int32{x0, y0}, [2]int32{x1, y1}}
+	}
+	mirrored := []mirrorRect{rect(0, 0, 99, 49), rect(0, 50, 49, 99), rect(50, 50, 99, 99)}
+	tests := []struct {
+		want    mirrorRect
+		covered bool
+	}{
+		{rect(0, 0, 99, 99), true},
+		{rect(10, 40, 60, 60), true},
+		{rect(99, 99, 99, 99), true},
+		{rect(0, 0, 100, 99), false},
+		{rect(-1, 0, 10, 10), false},
+	}
+	for _, test := range tests {
+		if covered := test.want.coveredBy(mirrored); covered != test.covered {
+			t.Errorf("Expected coverage of %v to be %t, got %t\n", test.want, test.covered, covered)
+		}
+	}
+	if rect(0, 0, 0, 0).coveredBy(nil) {
+		t.Errorf("Expected no coverage without mirrored regions\n")
+	}
+
+	want := mirrorRect{YZ, -5, [2]int32{-100, 3}, [2]int32{2000, 4}}
+	got, err := mirrorRectFromKey(want.key())
+	if err != nil || got != want {
+		t.Errorf("Expected mirrored region %v from key, got %v (%v)\n", want, got, err)
+	}
+	if !bytes.HasPrefix(want.key(), want.prefix()) {
+		t.Errorf("Mirrored region key doesn't start with its plane prefix\n")
+	}
+}
+
+func TestMirrorQueueDrops(t *testing.T) {
+	d := newTestData(t)
+
+	// A writer that never reads leaves no room in the queue.
+	d.mirrorOnce.Do(func() {
+		d.mirrorWriter = &mirrorWriter{queue: make(chan mirrorWrite)}
+	})
+	tile, err := d.GetGoogleSpec(0, dvid.XY, dvid.Point3d{0, 0, 20}, dvid.Point2d{10, 10})
+	if err != nil {
+		t.Fatalf("Unable to get tile spec: %s\n", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		d.queueMirror(&mirrorTarget{}, tile, make([]byte, 100))
+	}
+	if dropped := d.stats.get().MirrorDropped; dropped != 3 {
+		t.Errorf("Expected 3 dropped mirror writes, got %d\n", dropped)
+	}
+
+	// Tiles that can't be mirrored are never queued.
+	tile.scaling = 1
+	d.queueMirror(&mirrorTarget{}, tile, make([]byte, 100))
+	if dropped := d.stats.get().MirrorDropped; dropped != 3 {
+		t.Errorf("Expected scaled tile to be skipped, got %d dropped\n", dropped)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := tests.NewRepo()
+	grayscaleT, err := datastore.TypeServiceByName("grayscale8")
+	if err != nil {
+		t.Fatalf("Can't get grayscale8 type: %s\n", err.Error())
+	}
+	// The instance is added to the repo even if saving the repo's metadata fails.
+	if _, err := repo.NewData(grayscaleT, "mirror", dvid.NewConfig()); err != nil {
+		t.Logf("Error creating mirror: %s\n", err.Error())
+	}
+	if _, err := repo.GetDataByName("mirror"); err != nil {
+		t.Fatalf("Unable to create mirror: %s\n", err.Error())
+	}
+	uuid := repo.RootUUID()
+	ctx := datastore.NewServerContext(context.Background(), repo, versionID)
+
+	d := newTestData(t)
+	if d.Data, err = datastore.NewDataService(NewType(), uuid, 1000, "grayscale", dvid.NewConfig()); err != nil {
+		t.Fatalf("Unable to create base data: %s\n", err.Error())
+	}
+	d.Mirror = "mirror"
+	defer d.Shutdown()
+
+	transport := &cappedTransport{maxVoxels: 1000000}
+	defer useTransport(transport)()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", fmt.Sprintf("/api/node/%s/grayscale/%s", uuid, path), nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(ctx, w, r)
+		return w
+	}
+
+	online := get("raw/xy/64_32/950_200_20/raw")
+	if online.Code != http.StatusOK {
+		t.Fatalf("Raw request failed with status %d: %s\n", online.Code, online.Body.String())
+	}
+	if source := online.Header().Get("X-DVID-Source"); source != SourceGoogle {
+		t.Errorf("Expected X-DVID-Source %q, got %q\n", SourceGoogle, source)
+	}
+	for i := 0; d.stats.get().MirroredTiles == 0; i++ {
+		if i == 100 {
+			t.Fatalf("Fetched tile was not mirrored: %+v\n", d.stats.get())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The same region, including its padding outside the volume, is served offline.
+	numRequests := transport.count
+	offline := get("raw/xy/64_32/950_200_20/raw?offline=true")
+	if offline.Code != http.StatusOK {
+		t.Fatalf("Offline request failed with status %d: %s\n", offline.Code, offline.Body.String())
+	}
+	if source := offline.Header().Get("X-DVID-Source"); source != SourceMirror {
+		t.Errorf("Expected X-DVID-Source %q, got %q\n", SourceMirror, source)
+	}
+	if !bytes.Equal(offline.Body.Bytes(), online.Body.Bytes()) {
+		t.Errorf("Offline data differs from data fetched from Google\n")
+	}
+
+	// Part of the region is also served, but regions never fetched are not found.
+	if w := get("raw/xy/10_10/960_210_20/raw?offline=true"); w.Code != http.StatusOK {
+		t.Errorf("Expected mirrored part of region to be served, got status %d: %s\n", w.Code, w.Body.String())
+	}
+	for _, path := range []string{
+		"raw/xy/64_32/900_200_20/raw?offline=true",
+		"raw/xy/64_32/950_200_21/raw?offline=true",
+		"raw/xy/64_32/950_200_20/raw?offline=true&scale=1",
+	} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %q, got %d: %s\n", path, w.Code, w.Body.String())
+		}
+	}
+
+	// Health checks showing Google is down switch requests to the mirror.
+	d.health = newHealthChecker()
+	for i := 0; i < healthDownAfter; i++ {
+		d.health.record(HealthCheck{Time: time.Now(), Error: "down"})
+	}
+	if w := get("raw/xy/64_32/950_200_20/png"); w.Code != http.StatusOK || w.Header().Get("X-DVID-Source") != SourceMirror {
+		t.Errorf("Expected request to be served from mirror while Google is down, got status %d from %q\n", w.Code, w.Header().Get("X-DVID-Source"))
+	}
+	d.health = nil // no checking goroutine to stop on shutdown
+	if transport.count != numRequests {
+		t.Errorf("Expected no Google requests for offline requests, got %d\n", transport.count-numRequests)
+	}
+	if served := d.stats.get().MirrorServed; served != 3 {
+		t.Errorf("Expected 3 tiles served from mirror, got %d\n", served)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+	This file implements the "neuroglancer" endpoint, which describes a ready-to-use
+	Neuroglancer image layer for the instance so users don't assemble source URLs and layer
+	JSON from the /info fields.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// NeuroglancerLayer is a Neuroglancer layer with a "dvid" data source, whose URL is of
+// the form dvid://<server URL>/<UUID>/<data name>.
+type NeuroglancerLayer struct {
+	Type   string `json:"type"`
+	Source string `json:"source"`
+	Name   string `json:"name"`
+}
+
+// NeuroglancerScale is a scaled volume in the style of a Neuroglancer precomputed info.
+// The key is the scale's geometry index, which is the "scale" of raw requests.
+type NeuroglancerScale struct {
+	Key         string         `json:"key"`
+	Resolution  dvid.NdFloat32 `json:"resolution"`
+	Size        dvid.Point3d   `json:"size"`
+	VoxelOffset dvid.Point3d   `json:"voxel_offset"`
+	ChunkSizes  []dvid.Point3d `json:"chunk_sizes"`
+	Encoding    string         `json:"encoding"`
+}
+
+// NeuroglancerInfo describes the instance's volume in the style of a Neuroglancer
+// precomputed info.
+type NeuroglancerInfo struct {
+	Type        string              `json:"@type"`
+	VolumeType  string              `json:"type"`
+	DataType    string              `json:"data_type"`
+	NumChannels uint32              `json:"num_channels"`
+	Scales      []NeuroglancerScale `json:"scales"`
+}
+
+// NeuroglancerBounds is the volume extent in voxels at the highest resolution, where Max
+// is exclusive.
+type NeuroglancerBounds struct {
+	Min dvid.Point3d `json:"min"`
+	Max dvid.Point3d `json:"max"`
+}
+
+// NeuroglancerDescriptor is the response of the "neuroglancer" endpoint.
+type NeuroglancerDescriptor struct {
+	Layer      NeuroglancerLayer  `json:"layer"`
+	URL        string             `json:"url"`
+	DataType   string             `json:"dataType"`
+	VoxelSize  dvid.NdFloat32     `json:"voxelSize"`
+	VoxelUnits string             `json:"voxelUnits"`
+	Bounds     NeuroglancerBounds `json:"bounds"`
+	Info       NeuroglancerInfo   `json:"info"`
+}
+
+// neuroglancer returns the Neuroglancer descriptor of the instance as served at the given
+// server URL and version.
+func (d *Data) neuroglancer(serverURL string, uuid dvid.UUID) (*NeuroglancerDescriptor, error) {
+	if int(d.HighResIndex) >= len(d.Scales) {
+		return nil, server.NewError(server.NotFoundError, "data %q has no scales", d.DataName())
+	}
+	highRes := d.Scales[d.HighResIndex]
+	units := "nm"
+	if d.provider() == ProviderTileSource {
+		units = "voxels"
+	}
+	tileSize := d.tileSize()
+	desc := &NeuroglancerDescriptor{
+		Layer: NeuroglancerLayer{
+			Type:   "image",
+			Source: fmt.Sprintf("dvid://%s/%s/%s", serverURL, uuid, d.DataName()),
+			Name:   string(d.DataName()),
+		},
+		URL:        fmt.Sprintf("%s%snode/%s/%s", serverURL, server.WebAPIPath, uuid, d.DataName()),
+		DataType:   highRes.ChannelType,
+		VoxelSize:  highRes.PixelSize,
+		VoxelUnits: units,
+		Bounds:     NeuroglancerBounds{Max: highRes.VolumeSize},
+		Info: NeuroglancerInfo{
+			Type:        "neuroglancer_multiscale_volume",
+			VolumeType:  "image",
+			DataType:    highRes.ChannelType,
+			NumChannels: highRes.ChannelCount,
+			Scales:      make([]NeuroglancerScale, len(d.Scales)),
+		},
+	}
+	for i, geom := range d.Scales {
+		desc.Info.Scales[i] = NeuroglancerScale{
+			Key:        fmt.Sprintf("%d", i),
+			Resolution: geom.PixelSize,
+			Size:       geom.VolumeSize,
+			ChunkSizes: []dvid.Point3d{{tileSize, tileSize, 1}},
+			Encoding:   "raw",
+		}
+	}
+	return desc, nil
+}
+
+// serveNeuroglancer handles GET requests of the Neuroglancer descriptor.  The server URL is
+// the base URL of the request, and the UUID is the full UUID of the requested version if it
+// can be resolved.
+func (d *Data) serveNeuroglancer(w http.ResponseWriter, r *http.Request, parts []string) error {
+	uuid := dvid.UUID(parts[1])
+	if matched, _, err := datastore.MatchingUUID(parts[1]); err == nil {
+		uuid = matched
+	}
+	desc, err := d.neuroglancer(server.BaseURL(r), uuid)
+	if err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(desc)
+	if err != nil {
+		return err
+	}
+	return server.WriteJSON(w, r, jsonBytes)
+}
@@ -0,0 +1,69 @@
+package googlevoxels
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// serveNeuroglancerWith requests the Neuroglancer descriptor with the given request headers.
+func serveNeuroglancerWith(d *Data, host string, headers map[string]string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/neuroglancer", nil)
+	r.Host = host
+	for header, value := range headers {
+		r.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	return w
+}
+
+func TestNeuroglancer(t *testing.T) {
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	d := newFakeData(t, fb, dvid.NewConfig())
+	defer d.Shutdown()
+
+	expected := `{"layer":{"type":"image","source":"dvid://http://dvid.example.org:8000/a9b8c7/grayscale","name":"grayscale"},` +
+		`"url":"http://dvid.example.org:8000/api/node/a9b8c7/grayscale","dataType":"uint8","voxelSize":[8,8,8],"voxelUnits":"nm",` +
+		`"bounds":{"min":[0,0,0],"max":[1000,800,600]},"info":{"@type":"neuroglancer_multiscale_volume","type":"image",` +
+		`"data_type":"uint8","num_channels":1,"scales":[` +
+		`{"key":"0","resolution":[8,8,8],"size":[1000,800,600],"voxel_offset":[0,0,0],"chunk_sizes":[[512,512,1]],"encoding":"raw"},` +
+		`{"key":"1","resolution":[16,16,8],"size":[500,400,600],"voxel_offset":[0,0,0],"chunk_sizes":[[512,512,1]],"encoding":"raw"},` +
+		`{"key":"2","resolution":[32,32,8],"size":[250,200,600],"voxel_offset":[0,0,0],"chunk_sizes":[[512,512,1]],"encoding":"raw"},` +
+		`{"key":"3","resolution":[16,8,16],"size":[500,800,300],"voxel_offset":[0,0,0],"chunk_sizes":[[512,512,1]],"encoding":"raw"}]}}`
+	w := serveNeuroglancerWith(d, "dvid.example.org:8000", nil)
+	if w.Code != http.StatusOK || w.Body.String() != expected {
+		t.Errorf("Expected descriptor:\n%s\ngot %d:\n%s\n", expected, w.Code, w.Body.String())
+	}
+
+	// Proxied deployments use the forwarded host, scheme, and path prefix.
+	ts := newFakeTileSource()
+	defer ts.Close()
+	d = newTileSourceData(t, ts)
+	defer d.Shutdown()
+	expected = `{"layer":{"type":"image","source":"dvid://https://emdata.example.org/dvid/a9b8c7/grayscale","name":"grayscale"},` +
+		`"url":"https://emdata.example.org/dvid/api/node/a9b8c7/grayscale","dataType":"uint8","voxelSize":[1,1,1],"voxelUnits":"voxels",` +
+		`"bounds":{"min":[0,0,0],"max":[1000,700,50]},"info":{"@type":"neuroglancer_multiscale_volume","type":"image",` +
+		`"data_type":"uint8","num_channels":1,"scales":[` +
+		`{"key":"0","resolution":[1,1,1],"size":[1000,700,50],"voxel_offset":[0,0,0],"chunk_sizes":[[512,512,1]],"encoding":"raw"},` +
+		`{"key":"1","resolution":[2,2,1],"size":[500,350,50],"voxel_offset":[0,0,0],"chunk_sizes":[[512,512,1]],"encoding":"raw"},` +
+		`{"key":"2","resolution":[4,4,1],"size":[250,175,50],"voxel_offset":[0,0,0],"chunk_sizes":[[512,512,1]],"encoding":"raw"}]}}`
+	w = serveNeuroglancerWith(d, "10.0.0.5:8000", map[string]string{
+		"X-Forwarded-Host":   "emdata.example.org, internal-proxy:80",
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Prefix": "/dvid/",
+	})
+	if w.Code != http.StatusOK || w.Body.String() != expected {
+		t.Errorf("Expected proxied descriptor:\n%s\ngot %d:\n%s\n", expected, w.Code, w.Body.String())
+	}
+
+	r, _ := http.NewRequest("POST", "/api/node/a9b8c7/grayscale/neuroglancer", nil)
+	w = httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code == http.StatusOK {
+		t.Errorf("Expected POST of neuroglancer descriptor to fail\n")
+	}
+}
@@ -0,0 +1,171 @@
+/*
+	This file supports fetching the XY, XZ, and YZ tiles containing a point in one request
+	for orthogonal viewers.
+*/
+
+package googlevoxels
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+var orthoviewsQueryParams = append(server.QueryParams{
+	{Name: "tilesize", Help: "Size in pixels along one dimension of square tile."},
+	{Name: "format", Help: "Image format of each tile, e.g., \"jpeg:80\".  Default is the instance's default format."},
+}, displayQueryParams...)
+
+// bufferedResponse is an http.ResponseWriter that holds a response in memory.  Status codes
+// are ignored since serveTile returns errors instead of writing error responses.
+type bufferedResponse struct {
+	header http.Header
+	bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {}
+
+// orthoview is the tile for one orientation of an orthoviews request.
+type orthoview struct {
+	name      string
+	shape     dvid.DataShape
+	tileCoord dvid.Point3d
+	tile      *GoogleTileSpec
+	missing   bool
+	resp      *bufferedResponse
+	err       error
+}
+
+// orthoTileCoord returns the coordinate of the tile in the given orientation that contains
+// the point.
+func orthoTileCoord(shape dvid.DataShape, pt dvid.Point3d, tilesize int32) dvid.Point3d {
+	switch {
+	case shape.Equals(dvid.XY):
+		return dvid.Point3d{pt[0] / tilesize, pt[1] / tilesize, pt[2]}
+	case shape.Equals(dvid.XZ):
+		return dvid.Point3d{pt[0] / tilesize, pt[1], pt[2] / tilesize}
+	default:
+		return dvid.Point3d{pt[0], pt[1] / tilesize, pt[2] / tilesize}
+	}
+}
+
+// ServeOrthoviews returns a multipart response with the XY, XZ, and YZ tiles containing
+// a point.  Tiles are fetched concurrently.  Orientations without a scaled volume at the
+// requested scale are returned as empty parts.
+func (d *Data) ServeOrthoviews(w http.ResponseWriter, r *http.Request, requestID string, parts []string) error {
+	if len(parts) < 6 {
+		return fmt.Errorf("'orthoviews' request must be followed by scale level and point coordinate")
+	}
+	scale, err := strconv.ParseUint(parts[4], 10, 8)
+	if err != nil {
+		return fmt.Errorf("Illegal scale: %s (%s)", parts[4], err.Error())
+	}
+	pt, err := dvid.StringToPoint3d(parts[5], "_")
+	if err != nil {
+		return fmt.Errorf("Illegal point coordinate: %s (%s)", parts[5], err.Error())
+	}
+	query, err := server.NewQuery(r, orthoviewsQueryParams, d.StrictQueries)
+	if err != nil {
+		return err
+	}
+	tilesizeInt, err := query.GetInt("tilesize", int(d.tileSize()), 1, MaxTileSize)
+	if err != nil {
+		return err
+	}
+	tilesize := int32(tilesizeInt)
+	formatStr := query.GetString("format", "")
+	display, err := getDisplayAdjust(query)
+	if err != nil {
+		return err
+	}
+
+	// Get the tile specs for each orientation.
+	views := []*orthoview{{name: "xy", shape: dvid.XY}, {name: "xz", shape: dvid.XZ}, {name: "yz", shape: dvid.YZ}}
+	for _, view := range views {
+		view.tileCoord = orthoTileCoord(view.shape, pt, tilesize)
+		tileSpec, err := GetTileSpec(Scaling(scale), view.shape)
+		if err != nil {
+			return err
+		}
+		if _, found := d.TileMap[*tileSpec]; !found {
+			view.missing = true
+			continue
+		}
+		view.tile, err = d.getTileSpecAt(Scaling(scale), view.shape, view.tileCoord, tilesize, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Fetch the tiles concurrently.
+	wg := new(sync.WaitGroup)
+	for _, view := range views {
+		if view.missing {
+			continue
+		}
+		wg.Add(1)
+		go func(view *orthoview) {
+			defer wg.Done()
+			view.resp = newBufferedResponse()
+			format := formatStr
+			if format == "" {
+				format = d.planeFormat(view.tile.plane)
+			}
+			view.err = d.serveTile(view.resp, r, requestID, view.tile, format, false, display, nil)
+		}(view)
+	}
+	wg.Wait()
+	for _, view := range views {
+		if view.err != nil {
+			return view.err
+		}
+	}
+
+	// Write the multipart response.
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for _, view := range views {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf("inline; name=%q", view.name))
+		header.Set("X-Tile-Coord", fmt.Sprintf("%d_%d_%d", view.tileCoord[0], view.tileCoord[1], view.tileCoord[2]))
+		if view.missing {
+			header.Set("X-Tile-Missing", "true")
+			header.Set("Content-Length", "0")
+			if _, err := mw.CreatePart(header); err != nil {
+				return err
+			}
+			continue
+		}
+		offset := view.tile.offset
+		header.Set("X-Tile-Offset", fmt.Sprintf("%d_%d_%d", offset[0], offset[1], offset[2]))
+		for key, values := range view.resp.header {
+			if key == "Content-Type" || strings.HasPrefix(key, "X-Display-") || strings.HasPrefix(key, "X-Dvid-") {
+				header[key] = values
+			}
+		}
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(view.resp.Bytes()); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
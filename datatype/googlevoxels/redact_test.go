@@ -0,0 +1,125 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// echoTransport fails with an error that echoes the full request URL, like some proxies.
+type echoTransport struct {
+	keys []string // keys received by the transport
+}
+
+func (et *echoTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	et.keys = append(et.keys, r.URL.Query().Get("key"))
+	return nil, fmt.Errorf("proxy refused %s", r.URL)
+}
+
+// statusTransport responds with the given status and, for errors, a body echoing the request
+// URL.  A negative status gives a 200 response whose body fails partway through.
+type statusTransport struct {
+	status int
+}
+
+func (st statusTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: st.status,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(r.URL.String())),
+		Request:    r,
+	}
+	switch {
+	case st.status == http.StatusOK:
+		resp.Body = ioutil.NopCloser(strings.NewReader("not a tile"))
+	case st.status < 0:
+		resp.StatusCode = http.StatusOK
+		resp.Body = ioutil.NopCloser(io.MultiReader(strings.NewReader("partial"), failingReader{r.URL.String()}))
+	}
+	return resp, nil
+}
+
+// failingReader fails with an error that echoes the request URL.
+type failingReader struct {
+	url string
+}
+
+func (fr failingReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("connection reset reading %s", fr.url)
+}
+
+func TestKeyRedaction(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	defer func(timeout time.Duration) { RefreshTimeout = timeout }(RefreshTimeout)
+	RefreshTimeout = 100 * time.Millisecond
+
+	const key = "secretkey"
+	var messages []string
+	requests := []string{
+		"/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20/png",
+		"/api/node/a9b8c7/grayscale/tile/xy/0/1_1_20/jpeg",
+		"/api/node/a9b8c7/grayscale/raw/xy/512_512/0_0_20/raw",
+		"/api/node/a9b8c7/grayscale/raw/xy/300_250/10_20_30/png",
+		"/api/node/a9b8c7/grayscale/info?refresh=true",
+	}
+	echo := &echoTransport{}
+	transports := []http.RoundTripper{
+		echo,
+		statusTransport{http.StatusForbidden},
+		statusTransport{http.StatusOK},
+		statusTransport{-1},
+		&typedTransport{"text/html", []byte("<html>error</html>")},
+	}
+	for i, transport := range transports {
+		restore := useTransport(transport)
+		d := newTestData(t)
+		for _, request := range requests {
+			r, _ := http.NewRequest("GET", request, nil)
+			w := httptest.NewRecorder()
+			d.ServeHTTP(nil, w, r)
+			messages = append(messages, w.Body.String())
+		}
+		if err := d.verifyUpstream(nil); err != nil {
+			messages = append(messages, err.Error())
+		}
+		d.HealthCheck = 100 * time.Millisecond
+		messages = append(messages, d.checkUpstream().Error)
+
+		config := dvid.NewConfig()
+		config.Set("volumeid", "123456:test")
+		config.Set("authkey", key)
+		if _, err := NewType().NewDataService("a9b8c7", dvid.InstanceID(10+i), "fresh", config); err != nil {
+			messages = append(messages, err.Error())
+		}
+		restore()
+	}
+	messages = append(messages, strings.Split(logs.String(), "\n")...)
+
+	if len(echo.keys) == 0 || echo.keys[0] != key {
+		t.Fatalf("Expected key to be added to requests, got %v\n", echo.keys)
+	}
+	var numErrors int
+	for _, msg := range messages {
+		if strings.Contains(msg, key) {
+			t.Errorf("Message includes the API key: %s\n", msg)
+		}
+		if strings.Contains(msg, "rror") {
+			numErrors++
+		}
+	}
+	if numErrors < len(transports)*len(requests) {
+		t.Errorf("Expected errors from every failure path, got %d\n", numErrors)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+	This file supports explicit refreshes of the volume geometry from Google and the readiness
+	reported in /info, which never waits on requests to Google.
+*/
+
+package googlevoxels
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// RefreshTimeout is the maximum time a refresh of the volume geometry waits on Google.
+var RefreshTimeout = 30 * time.Second
+
+var infoQueryParams = server.QueryParams{
+	{Name: "refresh", Help: "If true, the volume geometry is reloaded from Google before returning info."},
+}
+
+// RefreshResult is the outcome of the last refresh of the volume geometry.
+type RefreshResult struct {
+	Time  time.Time
+	Error string `json:",omitempty"`
+}
+
+// NotReady explains why an instance can't serve tiles.  LastError is the error of the last
+// refresh, if any.
+type NotReady struct {
+	Reason    string
+	LastError string `json:",omitempty"`
+}
+
+// ready returns true if the volume geometry has been loaded.
+func (p *Properties) ready() bool {
+	return len(p.Scales) != 0 && len(p.TileMap) != 0
+}
+
+// notReady returns the reason the instance isn't ready or nil if it is ready.
+func (d *Data) notReady() *NotReady {
+	if d.ready() {
+		return nil
+	}
+	notReady := &NotReady{Reason: "volume geometry has not been loaded from Google"}
+	if last := d.lastRefresh(); last != nil {
+		notReady.LastError = last.Error
+	}
+	return notReady
+}
+
+// lastRefresh returns the result of the last refresh or nil if there has been none.
+func (d *Data) lastRefresh() *RefreshResult {
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+	if d.refreshed == nil {
+		return nil
+	}
+	result := *d.refreshed
+	return &result
+}
+
+func (d *Data) setRefreshed(err error) {
+	result := &RefreshResult{Time: time.Now()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	d.refreshMu.Lock()
+	d.refreshed = result
+	d.refreshMu.Unlock()
+}
+
+// refresh reloads the volume geometry from Google, waiting at most RefreshTimeout.  Only one
+// refresh runs at a time, and current geometry is kept if the refresh fails.
+func (d *Data) refresh() error {
+	if !atomic.CompareAndSwapInt32(&d.refreshing, 0, 1) {
+		return server.NewError(server.UnavailableError, "Refresh of %q from Google already in progress", d.DataName())
+	}
+	defer atomic.StoreInt32(&d.refreshing, 0)
+
+	err := d.loadGeometry()
+	d.setRefreshed(err)
+	return err
+}
+
+func (d *Data) loadGeometry() error {
+	if d.provider() == ProviderTileSource {
+		return server.NewError(server.BadRequestError, "Scales of %q are given by its tilesource settings and can't be refreshed", d.DataName())
+	}
+	resp, err := d.googleClient(RefreshTimeout).Get(volumeURL(d.apiURL(), d.VolumeID))
+	if err != nil {
+		return server.NewError(server.UpstreamError, "Error getting volume metadata from Google: %s", server.OutboundErrorMessage(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return server.NewError(server.UpstreamError, "Unexpected status code %d returned when getting volume metadata for %q", resp.StatusCode, d.VolumeID)
+	}
+	metadata, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return server.NewError(server.UpstreamError, "Error reading volume metadata from Google: %s", err.Error())
+	}
+	tileMap, geoms, highResIndex, err := geometriesFromMetadata(d.DataName(), metadata)
+	if err != nil {
+		return server.NewError(server.UpstreamError, "%s", err.Error())
+	}
+	if len(geoms) == 0 {
+		return server.NewError(server.UpstreamError, "Google returned no scaled volumes for %q", d.VolumeID)
+	}
+	props := d.Properties
+	props.TileMap = tileMap
+	props.Scales = geoms
+	props.HighResIndex = highResIndex
+	d.Properties = props
+	d.warnGaps()
+	return nil
+}
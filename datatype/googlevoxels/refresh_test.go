@@ -0,0 +1,108 @@
+package googlevoxels
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hangingTransport never responds, like a hung Google endpoint, until the request is canceled.
+type hangingTransport struct {
+	count int64
+}
+
+func (ht *hangingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&ht.count, 1)
+	<-r.Cancel
+	return nil, fmt.Errorf("request canceled")
+}
+
+type infoReport struct {
+	Ready       bool
+	NotReady    *NotReady
+	LastRefresh *RefreshResult
+	Extended    struct {
+		Scales []json.RawMessage
+	}
+}
+
+func getInfo(t *testing.T, d *Data, query string) (*httptest.ResponseRecorder, infoReport, time.Duration) {
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/info"+query, nil)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	d.ServeHTTP(nil, w, r)
+	elapsed := time.Since(start)
+	var info infoReport
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatalf("Unable to decode info: %s\n", err.Error())
+		}
+	}
+	return w, info, elapsed
+}
+
+func TestInfoWithoutUpstream(t *testing.T) {
+	d := newTestData(t)
+	transport := &hangingTransport{}
+	defer useTransport(transport)()
+	defer func(timeout time.Duration) { RefreshTimeout = timeout }(RefreshTimeout)
+	RefreshTimeout = 200 * time.Millisecond
+
+	// Info never waits on Google, whether or not the geometry has been loaded.
+	w, info, elapsed := getInfo(t, d, "")
+	if w.Code != http.StatusOK || !info.Ready || info.NotReady != nil || info.LastRefresh != nil {
+		t.Errorf("Expected ready instance, got %d: %s\n", w.Code, w.Body.String())
+	}
+	if elapsed > 100*time.Millisecond {
+		t.Errorf("Info took %s with hung upstream\n", elapsed)
+	}
+	scales, tileMap := d.Scales, d.TileMap
+	d.Scales, d.TileMap = nil, nil
+	w, info, elapsed = getInfo(t, d, "")
+	if w.Code != http.StatusOK || info.Ready || info.NotReady == nil || info.NotReady.Reason == "" {
+		t.Errorf("Expected not ready instance, got %d: %s\n", w.Code, w.Body.String())
+	}
+	if elapsed > 100*time.Millisecond {
+		t.Errorf("Info took %s with hung upstream\n", elapsed)
+	}
+	if atomic.LoadInt64(&transport.count) != 0 {
+		t.Errorf("Expected no requests to Google for info, got %d\n", transport.count)
+	}
+
+	// Refreshes are bounded by the timeout, and the error is reported in later info.
+	w, _, elapsed = getInfo(t, d, "?refresh=true")
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for refresh with hung upstream, got %d: %s\n", w.Code, w.Body.String())
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("Refresh took %s despite %s timeout\n", elapsed, RefreshTimeout)
+	}
+	w, info, _ = getInfo(t, d, "")
+	if info.Ready || info.NotReady == nil || info.NotReady.LastError == "" || info.LastRefresh == nil || info.LastRefresh.Error == "" {
+		t.Errorf("Expected refresh error in info, got %s\n", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), d.AuthKey) {
+		t.Errorf("Refresh error in info includes the API key: %s\n", w.Body.String())
+	}
+
+	// A successful refresh loads the geometry.
+	defer useTransport(&countingTransport{body: []byte(testVolumeMetadata)})()
+	w, info, _ = getInfo(t, d, "?refresh=true")
+	if w.Code != http.StatusOK || !info.Ready || info.NotReady != nil || info.LastRefresh == nil || info.LastRefresh.Error != "" {
+		t.Errorf("Expected ready instance after refresh, got %d: %s\n", w.Code, w.Body.String())
+	}
+	if len(info.Extended.Scales) != 1 || len(d.TileMap) != len(tileMap) || d.Scales[0].VolumeSize != scales[0].VolumeSize {
+		t.Errorf("Unexpected geometry after refresh: %v\n", info.Extended.Scales)
+	}
+
+	// Unknown query strings are rejected with strict queries.
+	d.StrictQueries = true
+	if w, _, _ = getInfo(t, d, "?refesh=true"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "refesh") {
+		t.Errorf("Expected bad request for misspelled refresh, got %d: %s\n", w.Code, w.Body.String())
+	}
+}
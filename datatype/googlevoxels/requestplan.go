@@ -0,0 +1,57 @@
+/*
+	This file computes how a region requested from a scaled volume is fetched from Google,
+	so tiles, raw requests, and the pieces of split requests agree on which voxels lie in
+	the volume and which are padding.
+*/
+
+package googlevoxels
+
+import "github.com/janelia-flyem/dvid/dvid"
+
+// requestPlan is the part of a requested region that lies within a scaled volume and the
+// padding before and after it along each axis, which together span the requested size.
+type requestPlan struct {
+	offset  dvid.Point3d // offset of the part within the volume, or the requested offset if outside
+	size    dvid.Point3d // size of the part within the volume, or 0 if outside
+	padLow  dvid.Point3d // voxels of the request before the volume's minimum
+	padHigh dvid.Point3d // voxels of the request past the volume's maximum
+	outside bool         // Is no voxel of the request within the volume?
+}
+
+// edge returns true if the request is partially outside the volume, so fetched data must
+// be padded to the requested size.
+func (p requestPlan) edge() bool {
+	if p.outside {
+		return false
+	}
+	for i := 0; i < 3; i++ {
+		if p.padLow[i] != 0 || p.padHigh[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// planRequest returns how a region of the given offset and size is fetched from a scaled
+// volume of the given size, e.g., the VolumeSize of the geometry serving the request.  A
+// region with an empty dimension is outside the volume.
+func planRequest(volumeSize, offset, sizeWant dvid.Point3d) requestPlan {
+	plan := requestPlan{offset: offset}
+	for i := 0; i < 3; i++ {
+		lo, hi := offset[i], offset[i]+sizeWant[i]
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > volumeSize[i] {
+			hi = volumeSize[i]
+		}
+		if hi <= lo {
+			return requestPlan{offset: offset, padHigh: sizeWant, outside: true}
+		}
+		plan.offset[i] = lo
+		plan.size[i] = hi - lo
+		plan.padLow[i] = lo - offset[i]
+		plan.padHigh[i] = offset[i] + sizeWant[i] - hi
+	}
+	return plan
+}
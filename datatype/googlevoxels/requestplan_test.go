@@ -0,0 +1,113 @@
+package googlevoxels
+
+import (
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func TestPlanRequest(t *testing.T) {
+	volumeSize := dvid.Point3d{100, 50, 10}
+	tests := []struct {
+		name     string
+		offset   dvid.Point3d
+		sizeWant dvid.Point3d
+		expected requestPlan
+	}{
+		{"interior", dvid.Point3d{10, 10, 5}, dvid.Point3d{20, 20, 1},
+			requestPlan{offset: dvid.Point3d{10, 10, 5}, size: dvid.Point3d{20, 20, 1}}},
+		{"exact fit", dvid.Point3d{0, 0, 0}, dvid.Point3d{100, 50, 10},
+			requestPlan{size: dvid.Point3d{100, 50, 10}}},
+		{"ends at maximum", dvid.Point3d{80, 30, 9}, dvid.Point3d{20, 20, 1},
+			requestPlan{offset: dvid.Point3d{80, 30, 9}, size: dvid.Point3d{20, 20, 1}}},
+		{"one past maximum", dvid.Point3d{81, 31, 9}, dvid.Point3d{20, 20, 1},
+			requestPlan{offset: dvid.Point3d{81, 31, 9}, size: dvid.Point3d{19, 19, 1}, padHigh: dvid.Point3d{1, 1, 0}}},
+		{"offset at maximum", dvid.Point3d{99, 49, 9}, dvid.Point3d{20, 20, 1},
+			requestPlan{offset: dvid.Point3d{99, 49, 9}, size: dvid.Point3d{1, 1, 1}, padHigh: dvid.Point3d{19, 19, 0}}},
+		{"single voxel at maximum", dvid.Point3d{99, 49, 9}, dvid.Point3d{1, 1, 1},
+			requestPlan{offset: dvid.Point3d{99, 49, 9}, size: dvid.Point3d{1, 1, 1}}},
+		{"single voxel at minimum", dvid.Point3d{0, 0, 0}, dvid.Point3d{1, 1, 1},
+			requestPlan{size: dvid.Point3d{1, 1, 1}}},
+		{"larger than volume", dvid.Point3d{-5, -5, 0}, dvid.Point3d{200, 100, 10},
+			requestPlan{size: dvid.Point3d{100, 50, 10}, padLow: dvid.Point3d{5, 5, 0}, padHigh: dvid.Point3d{95, 45, 0}}},
+		{"before minimum", dvid.Point3d{-3, 0, 2}, dvid.Point3d{8, 8, 1},
+			requestPlan{offset: dvid.Point3d{0, 0, 2}, size: dvid.Point3d{5, 8, 1}, padLow: dvid.Point3d{3, 0, 0}}},
+		{"last voxel before minimum", dvid.Point3d{-8, 0, 0}, dvid.Point3d{8, 8, 1},
+			requestPlan{offset: dvid.Point3d{-8, 0, 0}, padHigh: dvid.Point3d{8, 8, 1}, outside: true}},
+		{"first voxel before minimum", dvid.Point3d{-7, 0, 0}, dvid.Point3d{8, 8, 1},
+			requestPlan{size: dvid.Point3d{1, 8, 1}, padLow: dvid.Point3d{7, 0, 0}}},
+		{"offset past maximum", dvid.Point3d{100, 0, 0}, dvid.Point3d{8, 8, 1},
+			requestPlan{offset: dvid.Point3d{100, 0, 0}, padHigh: dvid.Point3d{8, 8, 1}, outside: true}},
+		{"plane past maximum", dvid.Point3d{0, 0, 10}, dvid.Point3d{8, 8, 1},
+			requestPlan{offset: dvid.Point3d{0, 0, 10}, padHigh: dvid.Point3d{8, 8, 1}, outside: true}},
+		{"plane before minimum", dvid.Point3d{0, 0, -1}, dvid.Point3d{8, 8, 1},
+			requestPlan{offset: dvid.Point3d{0, 0, -1}, padHigh: dvid.Point3d{8, 8, 1}, outside: true}},
+		{"empty size", dvid.Point3d{0, 0, 0}, dvid.Point3d{8, 0, 1},
+			requestPlan{padHigh: dvid.Point3d{8, 0, 1}, outside: true}},
+	}
+	for _, test := range tests {
+		plan := planRequest(volumeSize, test.offset, test.sizeWant)
+		if plan != test.expected {
+			t.Errorf("Bad plan for %s request:\n  expected %+v\n  got      %+v\n", test.name, test.expected, plan)
+		}
+		expectEdge := !test.expected.outside && (test.expected.padLow != dvid.Point3d{} || test.expected.padHigh != dvid.Point3d{})
+		if plan.edge() != expectEdge {
+			t.Errorf("Expected edge %t for %s request, got %t\n", expectEdge, test.name, plan.edge())
+		}
+		if !plan.outside {
+			for i := 0; i < 3; i++ {
+				if plan.padLow[i]+plan.size[i]+plan.padHigh[i] != test.sizeWant[i] {
+					t.Errorf("Plan for %s request doesn't span the requested size: %+v\n", test.name, plan)
+				}
+			}
+		}
+	}
+
+	// Every offset along an axis near the volume boundary gives a consistent plan.
+	for offset := int32(-12); offset <= 102; offset++ {
+		for _, size := range []int32{1, 2, 7, 100, 120} {
+			plan := planRequest(volumeSize, dvid.Point3d{offset, 0, 0}, dvid.Point3d{size, 1, 1})
+			inside := offset+size > 0 && offset < 100
+			if plan.outside == inside {
+				t.Fatalf("Expected outside %t for offset %d, size %d: %+v\n", !inside, offset, size, plan)
+			}
+			if inside && (plan.offset[0] < 0 || plan.offset[0]+plan.size[0] > 100 ||
+				plan.padLow[0]+plan.size[0]+plan.padHigh[0] != size || plan.offset[0]-plan.padLow[0] != offset) {
+				t.Fatalf("Bad plan for offset %d, size %d: %+v\n", offset, size, plan)
+			}
+		}
+	}
+}
+
+func TestPadTileLeading(t *testing.T) {
+	d := newTestData(t)
+	d.Scales[0].VolumeSize = dvid.Point3d{6, 6, 4}
+	tile, err := d.GetGoogleSpec(0, dvid.XY, dvid.Point3d{-2, 3, 3}, dvid.Point2d{4, 4})
+	if err != nil {
+		t.Fatalf("Unable to get tile spec: %s\n", err.Error())
+	}
+	if !tile.edge || tile.outside || tile.offset != (dvid.Point3d{0, 3, 3}) || tile.size != (dvid.Point3d{2, 3, 1}) ||
+		tile.pad != (dvid.Point3d{2, 0, 0}) {
+		t.Fatalf("Bad spec for tile before the volume: %+v\n", tile)
+	}
+	fill, err := newOOBFill("9", OOBSolid, dvid.ChannelUint8)
+	if err != nil {
+		t.Fatalf("Unable to make fill: %s\n", err.Error())
+	}
+	out, err := tile.padTile([]byte{1, 2, 3, 4, 5, 6}, fill)
+	if err != nil {
+		t.Fatalf("Unable to pad tile: %s\n", err.Error())
+	}
+	expected := []byte{
+		9, 9, 1, 2,
+		9, 9, 3, 4,
+		9, 9, 5, 6,
+		9, 9, 9, 9,
+	}
+	if string(out) != string(expected) {
+		t.Errorf("Bad padded tile: expected %v, got %v\n", expected, out)
+	}
+	if cropped := tile.cropTile(out); string(cropped) != string([]byte{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("Bad cropped tile: %v\n", cropped)
+	}
+}
@@ -0,0 +1,372 @@
+/*
+	This file declares the configuration settings of googlevoxels data, which are used to
+	validate settings on creation and modification and to report them.
+*/
+
+package googlevoxels
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// settings is the schema for googlevoxels configuration.  The "background" setting is
+// further checked against the voxel types of the volume's scales when it is applied.
+var settings = dvid.Settings{
+	{
+		Name: "volumeid",
+		Type: dvid.SettingString,
+		Help: "The globally unique identifier of the volume within Google BrainMaps API.  Required for the brainmaps provider.",
+	},
+	{
+		Name:   "authkey",
+		Type:   dvid.SettingString,
+		Secret: true,
+		Help:   "The API key required for Google BrainMaps API requests.  Required for the brainmaps provider.",
+	},
+	{
+		Name:     "tilesize",
+		Type:     dvid.SettingInt,
+		Default:  strconv.Itoa(int(DefaultTileSize)),
+		Help:     "Default size in pixels along one dimension of square tile.",
+		Validate: checkRange("tile size", 1, MaxTileSize),
+	},
+	{
+		Name: "strictqueries",
+		Type: dvid.SettingBool,
+		Help: "If true, unknown query-string parameters in requests cause an error.",
+	},
+	{
+		Name: "healthcheck",
+		Type: dvid.SettingDuration,
+		Help: "Interval between checks of Google BrainMaps API availability.  If empty, no health checks are done.",
+	},
+	{
+		Name:    "healthfailfast",
+		Type:    dvid.SettingBool,
+		Default: "true",
+		Help:    "If true, tile and raw requests immediately return 503 when health checks show upstream is down.",
+	},
+	{
+		Name:     "tilecache",
+		Type:     dvid.SettingInt,
+		Default:  "0",
+		Help:     "Maximum megabytes of Google responses to cache in memory.",
+		Validate: checkRange("tile cache", 0, -1),
+	},
+	{
+		Name: "diskcache",
+		Type: dvid.SettingString,
+		Help: `Directory and optional size of a disk tier for the tile cache, e.g., "/data/tiles,maxbytes=200G".`,
+		Validate: func(value string) error {
+			if value == "" {
+				return nil
+			}
+			_, _, err := parseDiskCache(value)
+			return err
+		},
+	},
+	{
+		Name:     "maxfetch",
+		Type:     dvid.SettingInt,
+		Default:  "0",
+		Help:     "Maximum voxels retrieved in a single Google request, or 0 if requests are never split.",
+		Validate: checkRange("max fetch", 0, -1),
+	},
+	{
+		Name:       "defaultformat",
+		Type:       dvid.SettingString,
+		Default:    DefaultTileFormat,
+		Modifiable: true,
+		Help:       "Image format used when tile or raw requests omit a format.",
+		Validate: func(value string) error {
+			if value == "" {
+				return nil
+			}
+			_, err := canonicalFormat(value)
+			return err
+		},
+	},
+	{
+		Name:       "proxy",
+		Type:       dvid.SettingString,
+		Modifiable: true,
+		Help:       "URL of HTTP proxy for requests to Google.  Credentials are not reported.",
+	},
+	{
+		Name:       "cabundle",
+		Type:       dvid.SettingString,
+		Modifiable: true,
+		Help:       "Path of PEM file of certificate authorities trusted for requests to Google.",
+	},
+	{
+		Name:       "background",
+		Type:       dvid.SettingString,
+		Default:    "0",
+		Modifiable: true,
+		Help:       "Voxel value for blank tiles outside the volume and the padding of edge tiles.",
+	},
+	{
+		Name:       "oob-style",
+		Type:       dvid.SettingString,
+		Default:    OOBSolid,
+		Modifiable: true,
+		Help:       fmt.Sprintf("How regions outside the volume are rendered: %q, %q, or %q.", OOBSolid, OOBChecker, OOBBorder),
+		Validate:   checkOOBStyle,
+	},
+	{
+		Name:       "placeholder",
+		Type:       dvid.SettingBool,
+		Default:    "false",
+		Modifiable: true,
+		Help:       "If true, blank uint8 tiles outside the volume are labeled with their scale and tile coordinate.",
+	},
+	{
+		Name:       "mirror",
+		Type:       dvid.SettingString,
+		Modifiable: true,
+		Help:       "Name of a local uint8 voxels instance holding fetched voxels.",
+	},
+	{
+		Name:       "fallback",
+		Type:       dvid.SettingBool,
+		Default:    "false",
+		Modifiable: true,
+		Help:       "If true, tiles at unavailable scales are synthesized by downsampling.",
+	},
+	{
+		Name:       "sniffimages",
+		Type:       dvid.SettingBool,
+		Default:    "false",
+		Modifiable: true,
+		Help:       "If true, png and jpeg tiles from Google must start with the magic bytes of their format.",
+	},
+	{
+		Name:       "statspersist",
+		Type:       dvid.SettingDuration,
+		Modifiable: true,
+		Help:       fmt.Sprintf("Interval between saves of stats that persist across restarts, at least %s.  If empty or \"0\", stats aren't persisted.", MinStatsPersist),
+		Validate:   checkStatsPersist,
+	},
+	{
+		Name:       "statsmetrics",
+		Type:       dvid.SettingString,
+		Default:    "all",
+		Modifiable: true,
+		Help:       "Comma-separated names of stats that persist across restarts: " + strings.Join(persistableStatNames(), ", ") + ".",
+		Validate: func(value string) error {
+			_, err := parseStatsMetrics(value)
+			return err
+		},
+	},
+	{
+		Name:       "timeout",
+		Type:       dvid.SettingDuration,
+		Modifiable: true,
+		Help:       "Limit on each request to Google, where \"0\" is no limit.  If unset, the server's default is used.",
+		Validate: func(value string) error {
+			if timeout, _ := time.ParseDuration(value); timeout < 0 {
+				return fmt.Errorf("timeout %s must not be negative", value)
+			}
+			return nil
+		},
+	},
+	{
+		Name:       "retries",
+		Type:       dvid.SettingInt,
+		Modifiable: true,
+		Help:       "Number of times a failed request to Google is retried.  If unset, the server's default is used.",
+		Validate:   checkRange("retries", 0, MaxRetries),
+	},
+	{
+		Name:       "hedgedelay",
+		Type:       dvid.SettingDuration,
+		Default:    "0s",
+		Modifiable: true,
+		Help:       "How long a request to Google waits for response headers before an identical hedge request is sent.  If \"0\", requests aren't hedged.",
+		Validate: func(value string) error {
+			if delay, _ := time.ParseDuration(value); delay < 0 {
+				return fmt.Errorf("hedgedelay %s must not be negative", value)
+			}
+			return nil
+		},
+	},
+	{
+		Name:       "hedgepercent",
+		Type:       dvid.SettingInt,
+		Default:    strconv.Itoa(DefaultHedgePercent),
+		Modifiable: true,
+		Help:       "Maximum percentage of requests to Google that are hedges.",
+		Validate:   checkRange("hedgepercent", 1, 100),
+	},
+	{
+		Name:       "hedgequota",
+		Type:       dvid.SettingInt,
+		Default:    "0",
+		Modifiable: true,
+		Help:       "Number of requests to Google in a UTC day after which requests aren't hedged.  If \"0\", there is no limit.",
+		Validate:   checkRange("hedgequota", 0, -1),
+	},
+	planeFormatSetting(XY),
+	planeFormatSetting(XZ),
+	planeFormatSetting(YZ),
+	{
+		Name:    "provider",
+		Type:    dvid.SettingString,
+		Default: ProviderBrainMaps,
+		Help:    fmt.Sprintf("Upstream source of tile data: %q or %q.", ProviderBrainMaps, ProviderTileSource),
+		Validate: func(value string) error {
+			switch strings.ToLower(value) {
+			case ProviderBrainMaps, ProviderTileSource:
+				return nil
+			}
+			return fmt.Errorf("provider %q must be %q or %q", value, ProviderBrainMaps, ProviderTileSource)
+		},
+	},
+	{
+		Name: "urltemplate",
+		Type: dvid.SettingString,
+		Help: "URL of source tiles with {x}, {y}, {z}, and {scale} placeholders.  Required for the tilesource provider.",
+		Validate: func(value string) error {
+			if value == "" {
+				return nil
+			}
+			return checkURLTemplate(value)
+		},
+	},
+	{
+		Name:     "sourcetilesize",
+		Type:     dvid.SettingInt,
+		Default:  strconv.Itoa(int(DefaultTileSize)),
+		Help:     "Width and height in pixels of the tilesource provider's tiles.",
+		Validate: checkRange("source tile size", 1, MaxTileSize),
+	},
+	{
+		Name: "extent",
+		Type: dvid.SettingString,
+		Help: `Volume size at scale 0 as "X,Y,Z" voxels.  Required for the tilesource provider.`,
+		Validate: func(value string) error {
+			if value == "" {
+				return nil
+			}
+			_, err := parseExtent(value)
+			return err
+		},
+	},
+	{
+		Name:    "validate-only",
+		Type:    dvid.SettingBool,
+		Default: "false",
+		Help:    "If true, creation performs all checks and fails with the JSON of the instance's scales instead of creating it.",
+	},
+	{
+		Name:     "levels",
+		Type:     dvid.SettingInt,
+		Default:  "1",
+		Help:     "Number of scales of the tilesource provider, each halving the x and y size of the last.",
+		Validate: checkRange("levels", 1, MaxTileSourceLevels),
+	},
+}
+
+// planeFormatSetting returns the setting for the default format of requests of the given
+// orientation.
+func planeFormatSetting(plane TileOrientation) dvid.Setting {
+	orientation := strings.ToLower(plane.String())
+	return dvid.Setting{
+		Name:       "format_" + orientation,
+		Type:       dvid.SettingString,
+		Modifiable: true,
+		Help:       fmt.Sprintf("Image format used when %s tile or raw requests omit a format.  If empty, \"defaultformat\" is used.", orientation),
+		Validate: func(value string) error {
+			if value == "" {
+				return nil
+			}
+			_, err := canonicalFormat(value)
+			return err
+		},
+	}
+}
+
+// checkRange returns a validator for integer settings that must be at least min and, if max
+// is non-negative, at most max.
+func checkRange(what string, min, max int) func(string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < min || (max >= 0 && n > max) {
+			if max < 0 {
+				return fmt.Errorf("%s %d must be at least %d", what, n, min)
+			}
+			return fmt.Errorf("%s %d must be between %d and %d", what, n, min, max)
+		}
+		return nil
+	}
+}
+
+// settingValues returns the current values of the instance's settings by name.
+func (d *Data) settingValues() map[string]interface{} {
+	var healthCheck, statsPersist string
+	if d.HealthCheck > 0 {
+		healthCheck = d.HealthCheck.String()
+	}
+	if d.StatsPersist > 0 {
+		statsPersist = d.StatsPersist.String()
+	}
+	var diskCache string
+	if d.DiskCache != "" {
+		diskCache = fmt.Sprintf("%s,maxbytes=%d", d.DiskCache, d.DiskCacheBytes)
+	}
+	statsMetrics := "all"
+	if len(d.StatsMetrics) > 0 {
+		statsMetrics = strings.Join(d.StatsMetrics, ",")
+	}
+	var extent string
+	var levels int
+	if d.provider() == ProviderTileSource && len(d.Scales) > 0 {
+		size := d.Scales[0].VolumeSize
+		extent = fmt.Sprintf("%d,%d,%d", size[0], size[1], size[2])
+		levels = len(d.Scales)
+	}
+	return map[string]interface{}{
+		"volumeid":       d.VolumeID,
+		"authkey":        d.AuthKey,
+		"tilesize":       d.TileSize,
+		"strictqueries":  d.StrictQueries,
+		"healthcheck":    healthCheck,
+		"healthfailfast": d.HealthFailFast,
+		"tilecache":      d.TileCacheMB,
+		"diskcache":      diskCache,
+		"maxfetch":       d.MaxFetch,
+		"defaultformat":  d.defaultFormat(),
+		"format_xy":      d.FormatXY,
+		"format_xz":      d.FormatXZ,
+		"format_yz":      d.FormatYZ,
+		"proxy":          d.proxyURL(),
+		"cabundle":       d.CABundle,
+		"background":     d.background(),
+		"oob-style":      d.oobStyle(),
+		"placeholder":    d.Placeholder,
+		"mirror":         string(d.Mirror),
+		"fallback":       d.Fallback,
+		"sniffimages":    d.SniffImages,
+		"statspersist":   statsPersist,
+		"statsmetrics":   statsMetrics,
+		"provider":       d.provider(),
+		"timeout":        d.timeout().String(),
+		"retries":        d.retries(),
+		"hedgedelay":     d.HedgeDelay.String(),
+		"hedgepercent":   d.hedgePercent(),
+		"hedgequota":     d.HedgeQuota,
+		"urltemplate":    d.URLTemplate,
+		"sourcetilesize": d.SourceTileSize,
+		"extent":         extent,
+		"levels":         levels,
+		"validate-only":  false,
+	}
+}
@@ -0,0 +1,150 @@
+/*
+	This file supports splitting requests larger than Google will return in a single
+	response into a grid of smaller requests whose data is assembled into one image.
+*/
+
+package googlevoxels
+
+import (
+	"math"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// MaxFetchConcurrency is the maximum number of simultaneous Google requests used to
+// fetch the pieces of a split request.
+const MaxFetchConcurrency = 8
+
+// tilePiece is a portion of a split tile and its position within the tile's image.
+type tilePiece struct {
+	spec   *GoogleTileSpec
+	x0, y0 int32
+}
+
+// needsSplit returns true if the tile is larger than the maximum voxels per Google request.
+func (d *Data) needsSplit(tile *GoogleTileSpec) bool {
+	if d.MaxFetch <= 0 || tile.outside {
+		return false
+	}
+	d0, d1 := tile.dims()
+	return int64(tile.size[d0])*int64(tile.size[d1]) > d.MaxFetch
+}
+
+// pieceSize returns the dimensions of the pieces used to split a tile so each piece has
+// at most maxVoxels voxels.
+func (gts GoogleTileSpec) pieceSize(maxVoxels int64) (int32, int32) {
+	d0, d1 := gts.dims()
+	nx, ny := gts.size[d0], gts.size[d1]
+	side := int32(math.Sqrt(float64(maxVoxels)))
+	if side < 1 {
+		side = 1
+	}
+	px := side
+	if nx < px {
+		px = nx
+	}
+	py := int32(maxVoxels / int64(px))
+	if ny < py {
+		py = ny
+	}
+	return px, py
+}
+
+// split returns the pieces of the tile's retrievable area.  Piece boundaries are aligned
+// to multiples of the piece size in volume coordinates, so pieces of overlapping requests
+// are identical and can be shared through the tile cache and request coalescing.
+func (gts GoogleTileSpec) split(maxVoxels int64) []tilePiece {
+	d0, d1 := gts.dims()
+	px, py := gts.pieceSize(maxVoxels)
+	begX, endX := gts.offset[d0], gts.offset[d0]+gts.size[d0]
+	begY, endY := gts.offset[d1], gts.offset[d1]+gts.size[d1]
+
+	var pieces []tilePiece
+	for y := begY; y < endY; y = (y/py + 1) * py {
+		pieceY := (y/py+1)*py - y
+		if y+pieceY > endY {
+			pieceY = endY - y
+		}
+		for x := begX; x < endX; x = (x/px + 1) * px {
+			pieceX := (x/px+1)*px - x
+			if x+pieceX > endX {
+				pieceX = endX - x
+			}
+			spec := gts
+			spec.offset[d0] = x
+			spec.offset[d1] = y
+			spec.size[d0] = pieceX
+			spec.size[d1] = pieceY
+			spec.sizeWant = spec.size
+			spec.pad = dvid.Point3d{}
+			spec.edge = false
+			pieces = append(pieces, tilePiece{&spec, x - begX, y - begY})
+		}
+	}
+	return pieces
+}
+
+// getSplitTileData returns the tile's raw data, padded to the requested tile size, by
+// fetching its pieces concurrently and copying them into place.
+func (d *Data) getSplitTileData(requestID string, tile *GoogleTileSpec) ([]byte, error) {
+	pieces := tile.split(d.MaxFetch)
+	dvid.Infof("[%s] Splitting %s request into %d pieces of at most %d voxels\n", requestID, tile.size, len(pieces), d.MaxFetch)
+
+	d0, d1 := tile.dims()
+	rowBytes := tile.size[d0] * tile.bytesPerVoxel
+	data := make([]byte, rowBytes*tile.size[d1])
+
+	var firstErr error
+	var errMu sync.Mutex
+	wg := new(sync.WaitGroup)
+	sem := make(chan struct{}, MaxFetchConcurrency)
+	for _, piece := range pieces {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(piece tilePiece) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			pieceData, err := d.getTileData(requestID, piece.spec)
+			if err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+				return
+			}
+			pieceRowBytes := piece.spec.size[d0] * tile.bytesPerVoxel
+			if int32(len(pieceData)) != pieceRowBytes*piece.spec.size[d1] {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = server.NewError(server.UpstreamError, "Expected %d bytes for %s piece of split request, received %d bytes", pieceRowBytes*piece.spec.size[d1], piece.spec.size, len(pieceData))
+				}
+				errMu.Unlock()
+				return
+			}
+			inI := int32(0)
+			outI := piece.y0*rowBytes + piece.x0*tile.bytesPerVoxel
+			for y := int32(0); y < piece.spec.size[d1]; y++ {
+				copy(data[outI:outI+pieceRowBytes], pieceData[inI:inI+pieceRowBytes])
+				inI += pieceRowBytes
+				outI += rowBytes
+			}
+		}(piece)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if !tile.edge {
+		return data, nil
+	}
+	fill, err := d.oobFill(tile)
+	if err != nil {
+		return nil, err
+	}
+	return tile.padTile(data, fill)
+}
@@ -0,0 +1,145 @@
+/*
+	This file computes the range of valid tile coordinates for each scale and orientation so
+	clients can size scroll bars without trial requests.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+var tileboundsQueryParams = server.QueryParams{
+	{Name: "tilesize", Help: "Size in pixels along one dimension of square tile.  Default is the instance's tile size."},
+}
+
+// TileBounds gives the inclusive range of tile coordinates within the scaled volume for an
+// orientation and scale.  The coordinate along the axis orthogonal to the plane is in voxels
+// of the scaled volume, e.g., the z coordinate of XY tiles.
+type TileBounds struct {
+	Plane      string
+	Scale      Scaling
+	TileSize   int32
+	VolumeSize dvid.Point3d
+	MinTile    dvid.Point3d
+	MaxTile    dvid.Point3d
+}
+
+// tileSize returns the tile size used when requests don't specify one.
+func (p *Properties) tileSize() int32 {
+	if p.TileSize > 0 {
+		return p.TileSize
+	}
+	return Defaults().DefaultTileSize
+}
+
+// tileBounds returns the tile coordinate bounds of an orientation and scale in the tile map.
+func (p *Properties) tileBounds(ts TileSpec, tilesize int32) (TileBounds, error) {
+	gi, found := p.TileMap[ts]
+	if !found {
+		scales := p.TileMap.scales(ts.plane)
+		return TileBounds{}, server.NewError(server.NotFoundError, "No %s tiles at scale %d.  Available %s scales: %v",
+			ts.plane, ts.scaling, ts.plane, scales)
+	}
+	if int(gi) >= len(p.Scales) {
+		return TileBounds{}, fmt.Errorf("Tile map references unknown geometry %d for %s at scale %d", gi, ts.plane, ts.scaling)
+	}
+	size := p.Scales[gi].VolumeSize
+	bounds := TileBounds{
+		Plane:      ts.plane.String(),
+		Scale:      ts.scaling,
+		TileSize:   tilesize,
+		VolumeSize: size,
+	}
+	// Tiled axes span ceil(size/tilesize) tiles while the orthogonal axis spans voxels.
+	var tiled [3]bool
+	switch ts.plane {
+	case XY:
+		tiled = [3]bool{true, true, false}
+	case XZ:
+		tiled = [3]bool{true, false, true}
+	case YZ:
+		tiled = [3]bool{false, true, true}
+	}
+	for i := 0; i < 3; i++ {
+		if tiled[i] {
+			bounds.MaxTile[i] = (size[i]+tilesize-1)/tilesize - 1
+		} else {
+			bounds.MaxTile[i] = size[i] - 1
+		}
+	}
+	return bounds, nil
+}
+
+// scales returns the sorted scales available in the tile map for an orientation.
+func (gm GeometryMap) scales(plane TileOrientation) []int {
+	var scales []int
+	for ts := range gm {
+		if ts.plane == plane {
+			scales = append(scales, int(ts.scaling))
+		}
+	}
+	sort.Ints(scales)
+	return scales
+}
+
+// allTileBounds returns the bounds of tiles of the given size for every orientation and scale
+// in the tile map, keyed by orientation and then scale, like "PlaneLevels" in /info.
+func (p *Properties) allTileBounds(tilesize int32) map[string]map[string]TileBounds {
+	all := make(map[string]map[string]TileBounds, 3)
+	for _, plane := range []TileOrientation{XY, XZ, YZ} {
+		planeBounds := make(map[string]TileBounds)
+		for _, scale := range p.TileMap.scales(plane) {
+			bounds, err := p.tileBounds(TileSpec{Scaling(scale), plane}, tilesize)
+			if err != nil {
+				continue
+			}
+			planeBounds[strconv.Itoa(scale)] = bounds
+		}
+		all[plane.String()] = planeBounds
+	}
+	return all
+}
+
+// serveTileBounds handles GET requests for the tile coordinate bounds of an orientation and scale.
+func (d *Data) serveTileBounds(w http.ResponseWriter, r *http.Request, parts []string) error {
+	if len(parts) < 6 {
+		return fmt.Errorf("'tilebounds' request must be followed by plane and scale level")
+	}
+	query, err := server.NewQuery(r, tileboundsQueryParams, d.StrictQueries)
+	if err != nil {
+		return err
+	}
+	tilesize, err := query.GetInt("tilesize", int(d.tileSize()), 1, MaxTileSize)
+	if err != nil {
+		return err
+	}
+	shape, err := dvid.DataShapeString(parts[4]).DataShape()
+	if err != nil {
+		return fmt.Errorf("Illegal tile plane: %s (%s)", parts[4], err.Error())
+	}
+	scale, err := strconv.ParseUint(parts[5], 10, 8)
+	if err != nil {
+		return fmt.Errorf("Illegal tile scale: %s (%s)", parts[5], err.Error())
+	}
+	ts, err := GetTileSpec(Scaling(scale), shape)
+	if err != nil {
+		return err
+	}
+	bounds, err := d.tileBounds(*ts, int32(tilesize))
+	if err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(bounds)
+	if err != nil {
+		return err
+	}
+	return server.WriteJSON(w, r, jsonBytes)
+}
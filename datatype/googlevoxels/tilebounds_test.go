@@ -0,0 +1,88 @@
+package googlevoxels
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func TestTileBounds(t *testing.T) {
+	d := newTestData(t)
+	d.Scales = append(d.Scales, Geometry{
+		VolumeSize:   dvid.Point3d{500, 500, 1000},
+		ChannelCount: 1,
+		ChannelType:  "uint8",
+		PixelSize:    dvid.NdFloat32{16, 16, 8},
+	})
+	d.TileMap[TileSpec{1, XY}] = 1
+
+	tests := []struct {
+		url     string
+		maxTile dvid.Point3d
+		shape   dvid.DataShape
+	}{
+		{"/api/node/a9b8c7/grayscale/tilebounds/xy/0", dvid.Point3d{1, 1, 999}, dvid.XY},
+		{"/api/node/a9b8c7/grayscale/tilebounds/0_2/0?tilesize=300", dvid.Point3d{3, 999, 3}, dvid.XZ},
+		{"/api/node/a9b8c7/grayscale/tilebounds/yz/0?tilesize=100", dvid.Point3d{999, 9, 9}, dvid.YZ},
+		{"/api/node/a9b8c7/grayscale/tilebounds/xy/1", dvid.Point3d{0, 0, 999}, dvid.XY},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Bad status %d for %s: %s\n", w.Code, test.url, w.Body.String())
+		}
+		var bounds TileBounds
+		if err := json.Unmarshal(w.Body.Bytes(), &bounds); err != nil {
+			t.Fatalf("Unable to decode tile bounds for %s: %s\n", test.url, err.Error())
+		}
+		if bounds.MinTile != (dvid.Point3d{0, 0, 0}) || bounds.MaxTile != test.maxTile {
+			t.Errorf("Expected tiles from 0 to %s for %s, got %s to %s\n", test.maxTile, test.url, bounds.MinTile, bounds.MaxTile)
+		}
+
+		// The max tile lies within the volume while tiles beyond it along a tiled axis don't.
+		tile, err := d.getTileSpecAt(bounds.Scale, test.shape, bounds.MaxTile, bounds.TileSize, false)
+		if err != nil || tile.outside {
+			t.Errorf("Expected max tile %s to be inside volume for %s: %v\n", bounds.MaxTile, test.url, err)
+		}
+		beyond := bounds.MaxTile
+		for i := range beyond {
+			beyond[i]++
+		}
+		if tile, err = d.getTileSpecAt(bounds.Scale, test.shape, beyond, bounds.TileSize, false); err != nil || !tile.outside {
+			t.Errorf("Expected tile %s to be outside volume for %s: %v\n", beyond, test.url, err)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/api/node/a9b8c7/grayscale/tilebounds/xz/1", nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "Available XZ scales: [0]") {
+		t.Errorf("Expected 404 listing available scales, got %d: %s\n", w.Code, w.Body.String())
+	}
+
+	// The /info metadata includes the bounds at the instance's tile size.
+	jsonBytes, err := d.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Unable to marshal info: %s\n", err.Error())
+	}
+	var info struct {
+		Extended struct {
+			TileBounds map[string]map[string]TileBounds
+		}
+	}
+	if err := json.Unmarshal(jsonBytes, &info); err != nil {
+		t.Fatalf("Unable to decode info: %s\n", err.Error())
+	}
+	if len(info.Extended.TileBounds["XY"]) != 2 || len(info.Extended.TileBounds["XZ"]) != 1 {
+		t.Errorf("Expected bounds for 2 XY scales and 1 XZ scale, got %v\n", info.Extended.TileBounds)
+	}
+	if info.Extended.TileBounds["XY"]["1"].MaxTile != (dvid.Point3d{0, 0, 999}) {
+		t.Errorf("Unexpected XY scale 1 bounds in info: %+v\n", info.Extended.TileBounds["XY"]["1"])
+	}
+}
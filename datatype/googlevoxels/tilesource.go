@@ -0,0 +1,284 @@
+/*
+	This file implements the tilesource provider, which serves tiles from a CATMAID-style
+	image tile server instead of the Google BrainMaps API.  Such servers have no metadata
+	endpoint, so the volume extent, source tile size, and pyramid depth are given as settings.
+	Any region is assembled from the source tiles covering it.
+*/
+
+package googlevoxels
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// ProviderTileSource is the provider setting for an image tile server whose tiles are
+// addressed by a URL template.
+const ProviderTileSource = "tilesource"
+
+// MaxTileSourceLevels is the maximum number of scales of a tilesource provider.
+const MaxTileSourceLevels = 16
+
+// checkURLTemplate checks that a tilesource URL template is an http or https URL with
+// {x}, {y}, and {z} placeholders.  The {scale} placeholder is optional for single-scale
+// sources.
+func checkURLTemplate(template string) error {
+	for _, field := range []string{"{x}", "{y}", "{z}"} {
+		if !strings.Contains(template, field) {
+			return fmt.Errorf("URL template %q lacks a %s placeholder", template, field)
+		}
+	}
+	u, err := url.Parse(fillURLTemplate(template, 0, 0, 0, 0))
+	if err != nil {
+		return fmt.Errorf("Bad URL template %q: %s", template, err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("URL template %q must be an http or https URL", template)
+	}
+	return nil
+}
+
+// fillURLTemplate returns the URL of the source tile at column x and row y of slice z at
+// the given scale.
+func fillURLTemplate(template string, x, y, z int32, scale Scaling) string {
+	return strings.NewReplacer(
+		"{x}", strconv.Itoa(int(x)),
+		"{y}", strconv.Itoa(int(y)),
+		"{z}", strconv.Itoa(int(z)),
+		"{scale}", strconv.Itoa(int(scale)),
+	).Replace(template)
+}
+
+// parseExtent parses a volume size given as "X,Y,Z" voxels.
+func parseExtent(s string) (dvid.Point3d, error) {
+	var extent dvid.Point3d
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return extent, fmt.Errorf("extent %q must be given as X,Y,Z voxels", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 1 {
+			return extent, fmt.Errorf("extent %q must be given as positive X,Y,Z voxels", s)
+		}
+		extent[i] = int32(n)
+	}
+	return extent, nil
+}
+
+// tileSourceGeometries returns the scaled volumes of a tile pyramid with the given extent
+// at scale 0, where each further level halves x and y.  Like BrainMaps volumes, all
+// orientations are available at the highest resolution.
+func tileSourceGeometries(extent dvid.Point3d, levels int) (GeometryMap, Geometries) {
+	tileMap := GeometryMap{
+		TileSpec{0, XZ}: 0,
+		TileSpec{0, YZ}: 0,
+	}
+	geoms := make(Geometries, levels)
+	for level := 0; level < levels; level++ {
+		f := int32(1) << uint(level)
+		geoms[level] = Geometry{
+			VolumeSize:   dvid.Point3d{(extent[0] + f - 1) / f, (extent[1] + f - 1) / f, extent[2]},
+			ChannelCount: 1,
+			ChannelType:  dvid.ChannelUint8,
+			PixelSize:    dvid.NdFloat32{float32(f), float32(f), 1},
+		}
+		tileMap[TileSpec{Scaling(level), XY}] = GeometryIndex(level)
+	}
+	return tileMap, geoms
+}
+
+// tileSourceConfig returns the tilesource settings of a new instance.
+func tileSourceConfig(c dvid.Config) (urlTemplate string, tileSize int32, extent dvid.Point3d, levels int, err error) {
+	urlTemplate, found, err := c.GetString("urltemplate")
+	if err != nil {
+		return
+	}
+	if !found || urlTemplate == "" {
+		err = fmt.Errorf("Required setting %q is missing for the %q provider", "urltemplate", ProviderTileSource)
+		return
+	}
+	extentStr, found, err := c.GetString("extent")
+	if err != nil {
+		return
+	}
+	if !found || extentStr == "" {
+		err = fmt.Errorf("Required setting %q is missing for the %q provider", "extent", ProviderTileSource)
+		return
+	}
+	if extent, err = parseExtent(extentStr); err != nil {
+		return
+	}
+	size, found, err := c.GetInt("sourcetilesize")
+	if err != nil {
+		return
+	}
+	if !found {
+		size = int(DefaultTileSize)
+	}
+	tileSize = int32(size)
+	levels, found, err = c.GetInt("levels")
+	if err != nil {
+		return
+	}
+	if !found {
+		levels = 1
+	}
+	return
+}
+
+// sourceTileURL returns the URL of a tile from the instance's tile source.
+func (p *Properties) sourceTileURL(x, y, z int32, scale Scaling) string {
+	return fillURLTemplate(p.URLTemplate, x, y, z, scale)
+}
+
+// tileSource fetches tile data from an image tile server, assembling the voxels of a
+// requested region from the source tiles covering it.  Source tiles are cached and
+// identical concurrent requests coalesced like Google responses.
+type tileSource struct {
+	d *Data
+}
+
+// sourceTile is the column, row, and slice of a source tile.
+type sourceTile struct {
+	x, y, z int32
+}
+
+func (ts tileSource) FetchTile(ctx context.Context, spec GoogleTileSpec, format string) ([]byte, string, error) {
+	d := ts.d
+	mimeType, err := contentType(format)
+	if err != nil {
+		return nil, "", err
+	}
+	size := d.SourceTileSize
+	if size <= 0 {
+		return nil, "", fmt.Errorf("Data %q has no source tile size", d.DataName())
+	}
+	beg := spec.offset
+	end := dvid.Point3d{beg[0] + spec.size[0], beg[1] + spec.size[1], beg[2] + spec.size[2]}
+	var tiles []sourceTile
+	for z := beg[2]; z < end[2]; z++ {
+		for y := beg[1] / size; y <= (end[1]-1)/size; y++ {
+			for x := beg[0] / size; x <= (end[0]-1)/size; x++ {
+				tiles = append(tiles, sourceTile{x, y, z})
+			}
+		}
+	}
+
+	// Each source tile is copied into its own part of the region, so tiles are fetched
+	// and copied concurrently.
+	nx, ny := spec.size[0], spec.size[1]
+	data := make([]byte, int64(nx)*int64(ny)*int64(spec.size[2]))
+	requestID := requestIDFrom(ctx)
+	var firstErr error
+	var errMu sync.Mutex
+	wg := new(sync.WaitGroup)
+	sem := make(chan struct{}, MaxFetchConcurrency)
+	for _, tile := range tiles {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(tile sourceTile) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			img, err := ts.getSourceTile(requestID, tile, spec)
+			if err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+				return
+			}
+			x0, y0 := tile.x*size, tile.y*size
+			for y := y0; y < y0+size && y < end[1]; y++ {
+				if y < beg[1] || y-y0 >= int32(img.Rect.Dy()) {
+					continue
+				}
+				xBeg, xEnd := x0, x0+size
+				if xBeg < beg[0] {
+					xBeg = beg[0]
+				}
+				if xEnd > end[0] {
+					xEnd = end[0]
+				}
+				if xEnd > x0+int32(img.Rect.Dx()) {
+					xEnd = x0 + int32(img.Rect.Dx())
+				}
+				if xBeg >= xEnd {
+					continue
+				}
+				inI := (y-y0)*int32(img.Stride) + xBeg - x0
+				outI := ((tile.z-beg[2])*ny+y-beg[1])*nx + xBeg - beg[0]
+				copy(data[outI:outI+xEnd-xBeg], img.Pix[inI:inI+xEnd-xBeg])
+			}
+		}(tile)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, "", firstErr
+	}
+	if format == "" || format == RawFormat {
+		return data, mimeType, nil
+	}
+
+	// Encoded requests are always for 2d tiles.
+	d0, d1 := spec.dims()
+	enc, options, err := dvid.GetImageEncoder(format)
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, data, int(spec.size[d0]), int(spec.size[d1]), dvid.ChannelUint8, options); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mimeType, nil
+}
+
+// getSourceTile returns a decoded tile from the tile source.
+func (ts tileSource) getSourceTile(requestID string, tile sourceTile, spec GoogleTileSpec) (*image.Gray, error) {
+	d := ts.d
+	url := d.sourceTileURL(tile.x, tile.y, tile.z, spec.scaling)
+	resp, err := d.fetchUpstream(requestID, url, spec.cacheTags())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.close()
+	if resp.statusCode != http.StatusOK {
+		return nil, server.NewError(server.UpstreamError, "Unexpected status code %d on source tile request (%q, tile %d_%d_%d at scale %d)",
+			resp.statusCode, d.DataName(), tile.x, tile.y, tile.z, spec.scaling)
+	}
+	encoded, err := resp.readAll()
+	if err != nil {
+		return nil, server.NewError(server.UpstreamError, "Error reading source tile: %s", err.Error())
+	}
+	img, _, err := image.Decode(bytes.NewReader(encoded))
+	d.stats.recordValidation(err)
+	if err != nil {
+		d.cacheDelete(url)
+		return nil, server.NewError(server.UpstreamError, "Invalid source tile for %q (tile %d_%d_%d at scale %d): %s",
+			d.DataName(), tile.x, tile.y, tile.z, spec.scaling, err.Error())
+	}
+	if gray, ok := img.(*image.Gray); ok && gray.Rect.Min == (image.Point{}) {
+		return gray, nil
+	}
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(gray, gray.Rect, img, bounds.Min, draw.Src)
+	return gray, nil
+}
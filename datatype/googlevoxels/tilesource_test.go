@@ -0,0 +1,265 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// fakeTileSource is a test image tile server with png tiles of a synthetic gradient given
+// by voxel() at URLs like /{z}/{x}_{y}_{scale}.png.  Tiles on the edge of a scaled volume
+// are partial, and tiles outside it are not found.
+type fakeTileSource struct {
+	*httptest.Server
+	extent   dvid.Point3d
+	tileSize int32
+	levels   int32
+
+	requests int64
+	missingZ int32 // if positive, tiles of this slice are not found
+}
+
+// newFakeTileSource starts a tile server with a 1000 x 700 x 50 volume at scale 0, 3 scales,
+// and 256 x 256 tiles.  It should be closed after use.
+func newFakeTileSource() *fakeTileSource {
+	ts := &fakeTileSource{extent: dvid.Point3d{1000, 700, 50}, tileSize: 256, levels: 3}
+	ts.Server = httptest.NewServer(http.HandlerFunc(ts.serve))
+	return ts
+}
+
+// voxel returns the value of a voxel in the volume at the given scale.
+func (ts *fakeTileSource) voxel(scale, x, y, z int32) byte {
+	return byte(x + 3*y + 7*z + 40*scale)
+}
+
+// numRequests returns the number of requests received by the fake.
+func (ts *fakeTileSource) numRequests() int {
+	return int(atomic.LoadInt64(&ts.requests))
+}
+
+func (ts *fakeTileSource) serve(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&ts.requests, 1)
+	var x, y, z, scale int32
+	if _, err := fmt.Sscanf(r.URL.Path, "/%d/%d_%d_%d.png", &z, &x, &y, &scale); err != nil {
+		http.Error(w, "bad tile path "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	nx := (ts.extent[0] + 1<<uint(scale) - 1) >> uint(scale)
+	ny := (ts.extent[1] + 1<<uint(scale) - 1) >> uint(scale)
+	x0, y0 := x*ts.tileSize, y*ts.tileSize
+	if scale < 0 || scale >= ts.levels || z < 0 || z >= ts.extent[2] || x0 < 0 || x0 >= nx || y0 < 0 || y0 >= ny ||
+		(z > 0 && z == atomic.LoadInt32(&ts.missingZ)) {
+		http.NotFound(w, r)
+		return
+	}
+	width, height := ts.tileSize, ts.tileSize
+	if x0+width > nx {
+		width = nx - x0
+	}
+	if y0+height > ny {
+		height = ny - y0
+	}
+	img := image.NewGray(image.Rect(0, 0, int(width), int(height)))
+	for j := int32(0); j < height; j++ {
+		for i := int32(0); i < width; i++ {
+			img.Pix[j*int32(img.Stride)+i] = ts.voxel(scale, x0+i, y0+j, z)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// config returns settings for an instance backed by the fake.
+func (ts *fakeTileSource) config() dvid.Config {
+	config := dvid.NewConfig()
+	config.Set("provider", ProviderTileSource)
+	config.Set("urltemplate", ts.URL+"/{z}/{x}_{y}_{scale}.png")
+	config.Set("extent", fmt.Sprintf("%d,%d,%d", ts.extent[0], ts.extent[1], ts.extent[2]))
+	config.Set("sourcetilesize", fmt.Sprintf("%d", ts.tileSize))
+	config.Set("levels", fmt.Sprintf("%d", ts.levels))
+	return config
+}
+
+// newTileSourceData creates a googlevoxels instance backed by the fake tile server.
+func newTileSourceData(t *testing.T, ts *fakeTileSource) *Data {
+	service, err := NewType().NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", ts.config())
+	if err != nil {
+		t.Fatalf("Unable to create googlevoxels instance with fake tile source: %s\n", err.Error())
+	}
+	return service.(*Data)
+}
+
+func TestTileSourceCreate(t *testing.T) {
+	ts := newFakeTileSource()
+	defer ts.Close()
+
+	bad := map[string]string{
+		"urltemplate": "",
+		"extent":      "",
+	}
+	for setting, value := range bad {
+		config := ts.config()
+		config.Set(setting, value)
+		if _, err := NewType().NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config); err == nil || !strings.Contains(err.Error(), setting) {
+			t.Errorf("Expected error for missing %q, got %v\n", setting, err)
+		}
+	}
+	invalid := map[string]string{
+		"urltemplate": "https://tiles.example.com/{z}/{x}.png",
+		"extent":      "1000,700",
+		"levels":      "17",
+	}
+	for setting, value := range invalid {
+		config := ts.config()
+		config.Set(setting, value)
+		if _, err := NewType().NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config); err == nil {
+			t.Errorf("Expected error for %s=%s\n", setting, value)
+		}
+	}
+	config := ts.config()
+	config.Set("extent", "1000,700,50")
+	config.Set("urltemplate", ts.URL+"/{z}/{x}_{y}_9.png")
+	if _, err := NewType().NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected 404 error for unreachable tiles, got %v\n", err)
+	}
+	config = dvid.NewConfig()
+	config.Set("authkey", "secretkey")
+	if _, err := NewType().NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config); err == nil || !strings.Contains(err.Error(), "volumeid") {
+		t.Errorf("Expected error for missing volumeid with brainmaps provider, got %v\n", err)
+	}
+
+	d := newTileSourceData(t, ts)
+	defer d.Shutdown()
+	if _, ok := d.fetcher().(tileSource); !ok {
+		t.Errorf("Expected tile source upstream, got %T\n", d.fetcher())
+	}
+	if len(d.TileMap) != 5 || d.TileMap[TileSpec{2, XY}] != 2 || d.TileMap[TileSpec{0, YZ}] != 0 {
+		t.Errorf("Unexpected tile map: %v\n", d.TileMap)
+	}
+	if err := d.refresh(); err == nil {
+		t.Errorf("Expected error refreshing tile source scales\n")
+	}
+
+	w := serveFake(d, "info")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad info response: %d %s\n", w.Code, w.Body.String())
+	}
+	var info struct {
+		Extended struct {
+			Provider       string
+			URLTemplate    string
+			SourceTileSize int32
+			Scales         []struct {
+				VolumeSize dvid.Point3d
+				PixelSize  dvid.NdFloat32
+			}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Bad info JSON %s: %s\n", w.Body.String(), err.Error())
+	}
+	if info.Extended.Provider != ProviderTileSource || info.Extended.SourceTileSize != 256 || len(info.Extended.Scales) != 3 {
+		t.Fatalf("Unexpected info: %s\n", w.Body.String())
+	}
+	expected := []dvid.Point3d{{1000, 700, 50}, {500, 350, 50}, {250, 175, 50}}
+	for i, size := range expected {
+		scale := info.Extended.Scales[i]
+		if scale.VolumeSize != size || scale.PixelSize[0] != float32(int(1)<<uint(i)) || scale.PixelSize[2] != 1 {
+			t.Errorf("Expected scale %d with size %s, got %v\n", i, size, scale)
+		}
+	}
+}
+
+func TestTileSourceTiles(t *testing.T) {
+	ts := newFakeTileSource()
+	defer ts.Close()
+	d := newTileSourceData(t, ts)
+	defer d.Shutdown()
+
+	// A tile spanning several source tiles is stitched together.
+	img := decodeGray(t, serveFake(d, "tile/xy/0/0_0_10/png"), 512, 512)
+	for _, pt := range []image.Point{{0, 0}, {255, 256}, {300, 260}, {511, 511}} {
+		if value := grayAt(img, pt.X, pt.Y); value != ts.voxel(0, int32(pt.X), int32(pt.Y), 10) {
+			t.Errorf("Bad xy tile voxel at %v: %d\n", pt, value)
+		}
+	}
+
+	// Edge tiles use partial source tiles and are padded with background.
+	img = decodeGray(t, serveFake(d, "tile/xy/1/1_1_10/png?tilesize=256"), 256, 256)
+	if value := grayAt(img, 243, 93); value != ts.voxel(1, 256+243, 256+93, 10) {
+		t.Errorf("Bad edge tile voxel: %d\n", value)
+	}
+	if grayAt(img, 244, 0) != 0 || grayAt(img, 0, 94) != 0 {
+		t.Errorf("Expected background outside volume in edge tile\n")
+	}
+
+	// Orthogonal views at scale 0 are assembled across slices.
+	img = decodeGray(t, serveFake(d, "tile/xz/0/1_300_0/png?tilesize=64"), 64, 64)
+	for _, pt := range []image.Point{{0, 0}, {5, 7}, {63, 49}} {
+		if value := grayAt(img, pt.X, pt.Y); value != ts.voxel(0, 64+int32(pt.X), 300, int32(pt.Y)) {
+			t.Errorf("Bad xz tile voxel at %v: %d\n", pt, value)
+		}
+	}
+	img = decodeGray(t, serveFake(d, "tile/yz/0/600_3_0/png?tilesize=64"), 64, 64)
+	if value := grayAt(img, 60, 20); value != ts.voxel(0, 600, 192+60, 20) {
+		t.Errorf("Bad yz tile voxel: %d\n", value)
+	}
+
+	// Tiles outside the volume are blank without any upstream request.
+	numRequests := ts.numRequests()
+	img = decodeGray(t, serveFake(d, "tile/xy/2/5_0_10/png?tilesize=256"), 256, 256)
+	if grayAt(img, 100, 100) != 0 || ts.numRequests() != numRequests {
+		t.Errorf("Expected blank tile outside volume without upstream requests\n")
+	}
+	if w := serveFake(d, "tile/xy/3/0_0_10/png?tilesize=256"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unavailable scale, got %d\n", w.Code)
+	}
+}
+
+func TestTileSourceRaw(t *testing.T) {
+	ts := newFakeTileSource()
+	defer ts.Close()
+	d := newTileSourceData(t, ts)
+	defer d.Shutdown()
+
+	w := serveFake(d, "raw/xy/300_200/200_100_7/raw")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad raw response: %d %s\n", w.Code, w.Body.String())
+	}
+	data := w.Body.Bytes()
+	if len(data) != 300*200 {
+		t.Fatalf("Expected %d bytes of raw data, got %d\n", 300*200, len(data))
+	}
+	for y := int32(0); y < 200; y++ {
+		for x := int32(0); x < 300; x++ {
+			if data[y*300+x] != ts.voxel(0, 200+x, 100+y, 7) {
+				t.Fatalf("Bad raw voxel at (%d, %d): %d\n", x, y, data[y*300+x])
+			}
+		}
+	}
+
+	img := decodeGray(t, serveFake(d, "raw/xy/100_100/200_100_3/png?scale=2"), 100, 100)
+	if value := grayAt(img, 49, 74); value != ts.voxel(2, 249, 174, 3) {
+		t.Errorf("Bad scale 2 raw voxel: %d\n", value)
+	}
+
+	// Missing source tiles are upstream errors.
+	atomic.StoreInt32(&ts.missingZ, 20)
+	if w := serveFake(d, "raw/xy/10_10/0_0_20/raw"); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "404") {
+		t.Errorf("Expected 502 with status 404 for missing source tile, got %d %s\n", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,492 @@
+/*
+	This file supports streaming tiles over a WebSocket so viewers can have tiles pushed as
+	soon as they are fetched.  Clients send JSON tile requests and viewport hints, and tiles
+	are returned in binary messages with a header identifying the request.  Tiles are
+	fetched through the same provider and caches as tile requests, and viewports load the
+	ring of tiles around them into the cache.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// Limits of tile streams, which apply to each connection.
+const (
+	// MaxStreamInFlight is the maximum number of tile requests that can be queued or
+	// fetching.  Further requests are refused with a 429 status until tiles are sent.
+	MaxStreamInFlight = 64
+
+	// MaxStreamFetches is the maximum number of tiles fetched concurrently.
+	MaxStreamFetches = 4
+
+	// MaxStreamPrefetch is the maximum number of tiles around a viewport fetched
+	// speculatively.
+	MaxStreamPrefetch = 128
+
+	// MaxViewportTiles is the maximum number of tiles in a viewport hint.
+	MaxViewportTiles = 1024
+
+	// MaxStreamMessage is the maximum size of a message sent by a client.
+	MaxStreamMessage = 64 * 1024
+)
+
+// StreamIdleTimeout is how long a tile stream waits for a client message before closing.
+var StreamIdleTimeout = 10 * time.Minute
+
+// TileStreamMessage is a message sent by tile stream clients.  A Type of "tile" or none
+// requests the tile given by the embedded WarmTile with a client-chosen ID, "cancel"
+// cancels the request with the ID, and "viewport" gives the tiles between the Min and
+// Max tile coordinates, inclusive, that the client is viewing.
+type TileStreamMessage struct {
+	Type string
+	ID   uint64
+	WarmTile
+	Min string
+	Max string
+}
+
+// TileStreamHeader identifies the tile in a binary tile stream message.
+type TileStreamHeader struct {
+	ID uint64
+	WarmTile
+	ContentType string
+}
+
+// TileStreamStatus is sent in a text message for tile requests that fail or are cancelled,
+// and for bad messages, where ID is the message's ID if any.
+type TileStreamStatus struct {
+	ID        uint64
+	Status    int
+	Error     string `json:",omitempty"`
+	Cancelled bool   `json:",omitempty"`
+}
+
+// streamTile is a tile requested by a client or fetched speculatively for a viewport.
+type streamTile struct {
+	id          uint64
+	spec        WarmTile
+	tile        *GoogleTileSpec
+	coord       dvid.Point3d
+	speculative bool
+	cancelled   bool
+}
+
+// tileViewport is a box of tile coordinates in a plane, scale, and tile size.
+type tileViewport struct {
+	plane    TileOrientation
+	scale    Scaling
+	tilesize int32
+	min, max dvid.Point3d
+}
+
+// contains returns true if the viewport has the tile.
+func (v *tileViewport) contains(st *streamTile) bool {
+	if st.tile.plane != v.plane || st.spec.Scale != v.scale || st.spec.TileSize != v.tilesize {
+		return false
+	}
+	for i := 0; i < 3; i++ {
+		if st.coord[i] < v.min[i] || st.coord[i] > v.max[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ring returns the viewport expanded by one tile, or one voxel orthogonal to its plane.
+func (v *tileViewport) ring() *tileViewport {
+	ring := *v
+	for i := 0; i < 3; i++ {
+		ring.min[i]--
+		ring.max[i]++
+	}
+	return &ring
+}
+
+// tileStream is the state of a tile stream connection.  Requested tiles are fetched
+// before speculative ones.
+type tileStream struct {
+	d         *Data
+	ws        *server.WebSocket
+	requestID string
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	closed   bool
+	requests map[uint64]*streamTile // requested tiles queued or fetching
+	queue    []*streamTile          // requested tiles waiting to be fetched
+	prefetch []*streamTile          // tiles around the viewport waiting to be fetched
+	wg       sync.WaitGroup
+}
+
+// serveTileStream upgrades a request to a WebSocket and streams tiles until the client
+// closes the connection or is idle for StreamIdleTimeout.
+func (d *Data) serveTileStream(w http.ResponseWriter, r *http.Request, requestID string) error {
+	ws, err := server.UpgradeWebSocket(w, r)
+	if err != nil {
+		return err
+	}
+	ws.MaxMessageSize = MaxStreamMessage
+	s := &tileStream{
+		d:         d,
+		ws:        ws,
+		requestID: requestID,
+		requests:  make(map[uint64]*streamTile),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for i := 0; i < MaxStreamFetches; i++ {
+		s.wg.Add(1)
+		go s.work()
+	}
+	s.run()
+	return nil
+}
+
+// run handles client messages until the connection ends, then waits for fetches to finish.
+func (s *tileStream) run() {
+	var requests, viewports int
+	for {
+		if atomic.LoadInt32(&s.d.closed) != 0 {
+			s.ws.WriteClose(server.CloseNormal, "data instance deleted")
+			break
+		}
+		s.ws.SetReadDeadline(time.Now().Add(StreamIdleTimeout))
+		messageType, data, err := s.ws.ReadMessage()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				s.ws.WriteClose(server.CloseNormal, "idle")
+			} else if err != io.EOF {
+				dvid.Infof("[%s] Closing tile stream of %q after error: %s\n", s.requestID, s.d.DataName(), err.Error())
+			}
+			break
+		}
+		if messageType != server.TextMessage {
+			s.sendStatus(0, server.NewError(server.BadRequestError, "tile stream messages must be JSON text"))
+			continue
+		}
+		var msg TileStreamMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			s.sendStatus(0, server.NewError(server.BadRequestError, "bad tile stream message: %s", err.Error()))
+			continue
+		}
+		switch strings.ToLower(msg.Type) {
+		case "", "tile":
+			requests++
+			s.request(msg)
+		case "cancel":
+			s.cancel(msg.ID)
+		case "viewport":
+			viewports++
+			s.setViewport(msg)
+		default:
+			s.sendStatus(msg.ID, server.NewError(server.BadRequestError, "unknown tile stream message type %q", msg.Type))
+		}
+	}
+
+	s.mu.Lock()
+	s.closed = true
+	s.queue, s.prefetch = nil, nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+	s.ws.Close()
+	dvid.Infof("[%s] Tile stream of %q from %s closed after %d tile requests and %d viewports\n",
+		s.requestID, s.d.DataName(), s.ws.RemoteAddr(), requests, viewports)
+}
+
+// resolve returns the tile of a spec, where a missing tile size is the instance's.
+func (s *tileStream) resolve(spec WarmTile) (*streamTile, error) {
+	shape, err := dvid.DataShapeString(spec.Plane).DataShape()
+	if err != nil {
+		return nil, server.NewError(server.BadRequestError, "illegal tile plane %q: %s", spec.Plane, err.Error())
+	}
+	coord, err := dvid.StringToPoint3d(spec.Coord, "_")
+	if err != nil {
+		return nil, server.NewError(server.BadRequestError, "illegal tile coordinate %q: %s", spec.Coord, err.Error())
+	}
+	if spec.TileSize == 0 {
+		spec.TileSize = s.d.tileSize()
+	}
+	if spec.TileSize < 0 || spec.TileSize > MaxTileSize {
+		return nil, server.NewError(server.BadRequestError, "illegal tile size %d", spec.TileSize)
+	}
+	tile, err := s.d.getTileSpecAt(spec.Scale, shape, coord, spec.TileSize, s.d.Fallback)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Format == "" {
+		spec.Format = s.d.planeFormat(tile.plane)
+	}
+	return &streamTile{spec: spec, tile: tile, coord: coord}, nil
+}
+
+// request queues a requested tile unless the connection's in-flight limit is reached.
+func (s *tileStream) request(msg TileStreamMessage) {
+	st, err := s.resolve(msg.WarmTile)
+	if err != nil {
+		s.sendStatus(msg.ID, err)
+		return
+	}
+	st.id = msg.ID
+
+	s.mu.Lock()
+	if _, found := s.requests[msg.ID]; found {
+		s.mu.Unlock()
+		s.sendStatus(msg.ID, server.NewError(server.BadRequestError, "tile request %d is already in flight", msg.ID))
+		return
+	}
+	if len(s.requests) >= MaxStreamInFlight {
+		s.mu.Unlock()
+		s.send(server.TextMessage, TileStreamStatus{
+			ID:     msg.ID,
+			Status: http.StatusTooManyRequests,
+			Error:  "too many tile requests in flight",
+		}, nil)
+		return
+	}
+	s.requests[msg.ID] = st
+	s.queue = append(s.queue, st)
+	s.cond.Signal()
+	s.mu.Unlock()
+}
+
+// cancel cancels a requested tile.  Tiles already being fetched are fetched but not sent.
+func (s *tileStream) cancel(id uint64) {
+	s.mu.Lock()
+	st, found := s.requests[id]
+	found = found && !st.cancelled
+	if found {
+		s.cancelLocked(st)
+	}
+	s.mu.Unlock()
+	if found {
+		s.send(server.TextMessage, TileStreamStatus{ID: id, Status: http.StatusOK, Cancelled: true}, nil)
+	}
+}
+
+// cancelLocked marks a requested tile as cancelled and removes it from the queue.  The
+// stream's mutex must be held.
+func (s *tileStream) cancelLocked(st *streamTile) {
+	st.cancelled = true
+	for i, queued := range s.queue {
+		if queued == st {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			delete(s.requests, st.id)
+			break
+		}
+	}
+}
+
+// setViewport cancels requested tiles outside the viewport and its ring, and replaces
+// any speculative fetches with the ring's tiles if tiles are cached.
+func (s *tileStream) setViewport(msg TileStreamMessage) {
+	msg.Coord = msg.Min
+	st, err := s.resolve(msg.WarmTile)
+	if err != nil {
+		s.sendStatus(msg.ID, err)
+		return
+	}
+	max, err := dvid.StringToPoint3d(msg.Max, "_")
+	if err != nil {
+		s.sendStatus(msg.ID, server.NewError(server.BadRequestError, "illegal viewport max %q: %s", msg.Max, err.Error()))
+		return
+	}
+	viewport := &tileViewport{
+		plane:    st.tile.plane,
+		scale:    st.spec.Scale,
+		tilesize: st.spec.TileSize,
+		min:      st.coord,
+		max:      max,
+	}
+	numTiles := int64(1)
+	for i := 0; i < 3; i++ {
+		if max[i] < st.coord[i] {
+			s.sendStatus(msg.ID, server.NewError(server.BadRequestError, "viewport max %s is less than min %s", msg.Max, msg.Min))
+			return
+		}
+		numTiles *= int64(max[i]-st.coord[i]) + 1
+	}
+	if numTiles > MaxViewportTiles {
+		s.sendStatus(msg.ID, server.NewError(server.BadRequestError, "viewport of %d tiles exceeds maximum of %d", numTiles, MaxViewportTiles))
+		return
+	}
+	ring := viewport.ring()
+
+	var prefetch []*streamTile
+	if s.d.caching() {
+		prefetch = s.ringTiles(viewport, ring, st.spec)
+	}
+
+	var cancelled []uint64
+	s.mu.Lock()
+	for id, requested := range s.requests {
+		if !requested.cancelled && !ring.contains(requested) {
+			s.cancelLocked(requested)
+			cancelled = append(cancelled, id)
+		}
+	}
+	s.prefetch = prefetch
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	for _, id := range cancelled {
+		s.send(server.TextMessage, TileStreamStatus{ID: id, Status: http.StatusOK, Cancelled: true}, nil)
+	}
+}
+
+// ringTiles returns the tiles within the ring but outside the viewport, up to
+// MaxStreamPrefetch tiles.  Tiles in the viewport's slices come first, followed by the
+// adjacent slices.  Tiles outside the volume are skipped.
+func (s *tileStream) ringTiles(viewport, ring *tileViewport, spec WarmTile) []*streamTile {
+	shape, _ := dvid.DataShapeString(spec.Plane).DataShape()
+	orthogonal := 2
+	switch {
+	case shape.Equals(dvid.XZ):
+		orthogonal = 1
+	case shape.Equals(dvid.YZ):
+		orthogonal = 0
+	}
+	slices := [][2]int32{
+		{viewport.min[orthogonal], viewport.max[orthogonal]},
+		{ring.min[orthogonal], ring.min[orthogonal]},
+		{ring.max[orthogonal], ring.max[orthogonal]},
+	}
+	var tiles []*streamTile
+	for _, slice := range slices {
+		box := *ring
+		box.min[orthogonal], box.max[orthogonal] = slice[0], slice[1]
+		for z := box.min[2]; z <= box.max[2]; z++ {
+			for y := box.min[1]; y <= box.max[1]; y++ {
+				for x := box.min[0]; x <= box.max[0]; x++ {
+					coord := dvid.Point3d{x, y, z}
+					tile, err := s.d.getTileSpecAt(spec.Scale, shape, coord, spec.TileSize, s.d.Fallback)
+					if err != nil || tile.outside {
+						continue
+					}
+					candidate := &streamTile{spec: spec, tile: tile, coord: coord, speculative: true}
+					if viewport.contains(candidate) {
+						continue
+					}
+					candidate.spec.Coord = fmt.Sprintf("%d_%d_%d", x, y, z)
+					tiles = append(tiles, candidate)
+					if len(tiles) == MaxStreamPrefetch {
+						return tiles
+					}
+				}
+			}
+		}
+	}
+	return tiles
+}
+
+// next returns the next tile to fetch, waiting for one if necessary, or nil if the
+// connection is closed.
+func (s *tileStream) next() *streamTile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed && len(s.queue) == 0 && len(s.prefetch) == 0 {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil
+	}
+	var st *streamTile
+	if len(s.queue) != 0 {
+		st, s.queue = s.queue[0], s.queue[1:]
+	} else {
+		st, s.prefetch = s.prefetch[0], s.prefetch[1:]
+	}
+	return st
+}
+
+// work fetches queued tiles until the connection is closed.
+func (s *tileStream) work() {
+	defer s.wg.Done()
+	for {
+		st := s.next()
+		if st == nil {
+			return
+		}
+		if st.speculative {
+			s.prefetchTile(st)
+		} else {
+			s.sendTile(st)
+		}
+	}
+}
+
+// prefetchTile loads a tile around the viewport into the cache.  Since upstream failures
+// include rate limiting, the remaining speculative fetches are dropped after a failure.
+func (s *tileStream) prefetchTile(st *streamTile) {
+	if err := s.d.warmTile(s.requestID, st.tile, st.spec.Format); err != nil {
+		dvid.Infof("[%s] Stopping speculative fetches of tile stream after error on tile %s: %s\n",
+			s.requestID, st.spec.Coord, err.Error())
+		s.mu.Lock()
+		s.prefetch = nil
+		s.mu.Unlock()
+	}
+}
+
+// sendTile fetches a requested tile and sends it unless the request was cancelled.
+func (s *tileStream) sendTile(st *streamTile) {
+	data, header, err := s.d.fetchTile(s.requestID, st.tile, st.spec.Format)
+
+	s.mu.Lock()
+	cancelled := st.cancelled || s.closed
+	delete(s.requests, st.id)
+	s.mu.Unlock()
+	if cancelled {
+		return
+	}
+	if err != nil {
+		s.sendStatus(st.id, err)
+		return
+	}
+	s.send(server.BinaryMessage, TileStreamHeader{
+		ID:          st.id,
+		WarmTile:    st.spec,
+		ContentType: header.Get("Content-Type"),
+	}, data)
+}
+
+// sendStatus sends the status of a failed request or bad message.
+func (s *tileStream) sendStatus(id uint64, err error) {
+	s.send(server.TextMessage, TileStreamStatus{
+		ID:     id,
+		Status: server.ErrorKindOf(err).StatusCode(),
+		Error:  err.Error(),
+	}, nil)
+}
+
+// send writes a JSON status in a text message, or a JSON header preceded by its 4-byte
+// big-endian length and followed by tile data in a binary message.
+func (s *tileStream) send(messageType int, v interface{}, data []byte) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		dvid.Errorf("[%s] Unable to encode tile stream message: %s\n", s.requestID, err.Error())
+		return
+	}
+	msg := jsonBytes
+	if messageType == server.BinaryMessage {
+		msg = make([]byte, 4, 4+len(jsonBytes)+len(data))
+		binary.BigEndian.PutUint32(msg, uint32(len(jsonBytes)))
+		msg = append(msg, jsonBytes...)
+		msg = append(msg, data...)
+	}
+	if err := s.ws.WriteMessage(messageType, msg); err != nil && err != server.ErrWebSocketClosed {
+		dvid.Infof("[%s] Unable to write to tile stream: %s\n", s.requestID, err.Error())
+	}
+}
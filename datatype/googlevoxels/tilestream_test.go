@@ -0,0 +1,283 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// gatedTransport holds upstream requests until released and counts them by the z of their
+// corner.
+type gatedTransport struct {
+	mu      sync.Mutex
+	release chan struct{}
+	byZ     map[int32]int
+}
+
+func (gt *gatedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if corner, err := dvid.StringToPoint3d(r.URL.Query().Get("corner"), ","); err == nil {
+		gt.mu.Lock()
+		gt.byZ[corner[2]]++
+		gt.mu.Unlock()
+	}
+	<-gt.release
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func (gt *gatedTransport) requests(z int32) int {
+	gt.mu.Lock()
+	defer gt.mu.Unlock()
+	return gt.byZ[z]
+}
+
+// streamReply is a tile or status received from a tile stream.
+type streamReply struct {
+	header TileStreamHeader
+	status *TileStreamStatus
+	tile   []byte
+}
+
+func readStreamReply(t *testing.T, ws *server.WebSocket) streamReply {
+	messageType, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("Unable to read tile stream message: %s\n", err.Error())
+	}
+	var reply streamReply
+	if messageType == server.TextMessage {
+		reply.status = new(TileStreamStatus)
+		if err := json.Unmarshal(data, reply.status); err != nil {
+			t.Fatalf("Bad tile stream status %q: %s\n", data, err.Error())
+		}
+		return reply
+	}
+	if len(data) < 4 || int(binary.BigEndian.Uint32(data)) > len(data)-4 {
+		t.Fatalf("Bad tile stream frame of %d bytes\n", len(data))
+	}
+	headerLen := int(binary.BigEndian.Uint32(data))
+	if err := json.Unmarshal(data[4:4+headerLen], &reply.header); err != nil {
+		t.Fatalf("Bad tile stream header: %s\n", err.Error())
+	}
+	reply.tile = data[4+headerLen:]
+	return reply
+}
+
+func sendStreamMessage(t *testing.T, ws *server.WebSocket, format string, args ...interface{}) {
+	if err := ws.WriteMessage(server.TextMessage, []byte(fmt.Sprintf(format, args...))); err != nil {
+		t.Fatalf("Unable to send tile stream message: %s\n", err.Error())
+	}
+}
+
+// serveTileStreams serves an instance's API, sending to done when a request returns.
+func serveTileStreams(d *Data, done chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.ServeHTTP(nil, w, r)
+		done <- struct{}{}
+	}))
+}
+
+func TestTileStream(t *testing.T) {
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	config := dvid.NewConfig()
+	config.Set("tilecache", "10")
+	d := newFakeData(t, fb, config)
+	defer d.Shutdown()
+
+	done := make(chan struct{}, 10)
+	ts := serveTileStreams(d, done)
+	defer ts.Close()
+	ws, err := server.DialWebSocket(ts.URL + "/api/node/a9b8c7/grayscale/tilestream")
+	if err != nil {
+		t.Fatalf("Unable to open tile stream: %s\n", err.Error())
+	}
+	defer ws.Close()
+
+	// Requested tiles are sent with a header identifying them.
+	sendStreamMessage(t, ws, `{"id": 1, "plane": "xy", "scale": 0, "coord": "1_0_5", "tilesize": 64, "format": "png"}`)
+	reply := readStreamReply(t, ws)
+	if reply.status != nil || reply.header.ID != 1 || reply.header.Coord != "1_0_5" || reply.header.ContentType != "image/png" {
+		t.Fatalf("Bad tile stream reply: %+v\n", reply)
+	}
+	img, err := png.Decode(bytes.NewReader(reply.tile))
+	if err != nil {
+		t.Fatalf("Unable to decode streamed tile: %s\n", err.Error())
+	}
+	if value := grayAt(img, 3, 7); value != fb.voxel(0, 64+3, 7, 5) {
+		t.Errorf("Bad streamed tile voxel: %d\n", value)
+	}
+
+	// Bad requests and tiles outside the volume return statuses.
+	sendStreamMessage(t, ws, `{"id": 2, "plane": "ab", "coord": "1_0_5"}`)
+	if reply := readStreamReply(t, ws); reply.status == nil || reply.status.ID != 2 || reply.status.Status != http.StatusBadRequest {
+		t.Errorf("Expected bad request status for bad plane, got %+v\n", reply)
+	}
+	sendStreamMessage(t, ws, `{"id": 3, "plane": "xy", "coord": "100_0_5", "tilesize": 64}`)
+	if reply := readStreamReply(t, ws); reply.status == nil || reply.status.ID != 3 || reply.status.Status != http.StatusNotFound {
+		t.Errorf("Expected not found status for tile outside volume, got %+v\n", reply)
+	}
+	sendStreamMessage(t, ws, `{"type": "subscribe"}`)
+	if reply := readStreamReply(t, ws); reply.status == nil || reply.status.Status != http.StatusBadRequest {
+		t.Errorf("Expected bad request status for unknown message, got %+v\n", reply)
+	}
+
+	// Viewports load the ring of tiles around them into the cache: 4 x 4 tiles around the
+	// 2 x 2 viewport in its slice and the 2 adjacent slices.
+	sendStreamMessage(t, ws, `{"type": "viewport", "plane": "xy", "scale": 0, "min": "2_2_5", "max": "3_3_5", "tilesize": 64, "format": "png"}`)
+	const ringTiles = 4*4*3 - 4
+	entries := d.CacheStats().Entries
+	for i := 0; i < 100 && entries < 1+ringTiles; i++ {
+		time.Sleep(50 * time.Millisecond)
+		entries = d.CacheStats().Entries
+	}
+	if entries != 1+ringTiles {
+		t.Fatalf("Expected %d cached tiles after viewport, got %d\n", 1+ringTiles, entries)
+	}
+	numRequests := fb.numRequests()
+	for i, coord := range []string{"1_1_5", "4_4_5", "2_3_4", "3_2_6"} {
+		sendStreamMessage(t, ws, `{"id": %d, "plane": "xy", "coord": "%s", "tilesize": 64, "format": "png"}`, 10+i, coord)
+		if reply := readStreamReply(t, ws); reply.status != nil || reply.header.ID != uint64(10+i) {
+			t.Errorf("Bad reply for ring tile %s: %+v\n", coord, reply)
+		}
+	}
+	if fb.numRequests() != numRequests {
+		t.Errorf("Expected ring tiles to be cached, got %d upstream requests\n", fb.numRequests()-numRequests)
+	}
+
+	// Requests beyond the in-flight limit are refused, and requests outside a new viewport
+	// and its ring are cancelled, whether they are fetching or queued.
+	gate := &gatedTransport{release: make(chan struct{}), byZ: make(map[int32]int)}
+	restore := useTransport(gate)
+	defer restore()
+	for i := 0; i <= MaxStreamInFlight; i++ {
+		sendStreamMessage(t, ws, `{"id": %d, "plane": "xy", "coord": "%d_%d_50", "tilesize": 64, "format": "png"}`, 100+i, i%10, i/10)
+	}
+	reply = readStreamReply(t, ws)
+	if reply.status == nil || reply.status.ID != 100+MaxStreamInFlight || reply.status.Status != http.StatusTooManyRequests {
+		t.Fatalf("Expected request over in-flight limit to be refused, got %+v\n", reply)
+	}
+	for i := 0; i < 100 && gate.requests(50) < MaxStreamFetches; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sendStreamMessage(t, ws, `{"id": 100, "plane": "xy", "coord": "0_0_50", "tilesize": 64}`)
+	if reply := readStreamReply(t, ws); reply.status == nil || reply.status.ID != 100 || reply.status.Status != http.StatusBadRequest {
+		t.Errorf("Expected duplicate request to be refused, got %+v\n", reply)
+	}
+	sendStreamMessage(t, ws, `{"type": "cancel", "id": 101}`)
+	if reply := readStreamReply(t, ws); reply.status == nil || reply.status.ID != 101 || !reply.status.Cancelled {
+		t.Errorf("Expected cancelled status, got %+v\n", reply)
+	}
+	sendStreamMessage(t, ws, `{"type": "viewport", "plane": "xy", "min": "0_0_200", "max": "1_1_200", "tilesize": 64, "format": "png"}`)
+	cancelled := make(map[uint64]bool)
+	for len(cancelled) < MaxStreamInFlight-1 {
+		reply := readStreamReply(t, ws)
+		if reply.status == nil || !reply.status.Cancelled || cancelled[reply.status.ID] || reply.status.ID < 100 || reply.status.ID == 101 {
+			t.Fatalf("Expected cancelled status after viewport moved, got %+v\n", reply)
+		}
+		cancelled[reply.status.ID] = true
+	}
+	close(gate.release)
+
+	// Cancelled tiles being fetched are never sent, and queued ones are never fetched.
+	sendStreamMessage(t, ws, `{"id": 2000, "plane": "xy", "coord": "1_0_5", "tilesize": 64, "format": "png"}`)
+	if reply := readStreamReply(t, ws); reply.status != nil || reply.header.ID != 2000 {
+		t.Errorf("Expected tile after cancellation, got %+v\n", reply)
+	}
+	if n := gate.requests(50); n != MaxStreamFetches {
+		t.Errorf("Expected only %d tiles fetched before cancellation, got %d\n", MaxStreamFetches, n)
+	}
+
+	// Closing the connection ends the request.
+	if err := ws.WriteClose(server.CloseNormal, ""); err != nil {
+		t.Fatalf("Unable to close tile stream: %s\n", err.Error())
+	}
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Expected close of tile stream, got %v\n", err)
+		}
+		if messageType == server.BinaryMessage {
+			t.Fatalf("Unexpected tile after cancellation: %d bytes\n", len(data))
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Tile stream request didn't end after connection was closed\n")
+	}
+}
+
+func TestTileStreamLifecycle(t *testing.T) {
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	d := newFakeData(t, fb, dvid.NewConfig())
+	defer d.Shutdown()
+
+	done := make(chan struct{}, 10)
+	ts := serveTileStreams(d, done)
+	defer ts.Close()
+
+	// Requests that aren't WebSocket upgrades are refused.
+	resp, err := http.Get(ts.URL + "/api/node/a9b8c7/grayscale/tilestream")
+	if err != nil {
+		t.Fatalf("Unable to GET tile stream: %s\n", err.Error())
+	}
+	resp.Body.Close()
+	<-done
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad request for plain GET of tile stream, got %d\n", resp.StatusCode)
+	}
+
+	// Idle connections are closed.
+	saved := StreamIdleTimeout
+	StreamIdleTimeout = 100 * time.Millisecond
+	ws, err := server.DialWebSocket(ts.URL + "/api/node/a9b8c7/grayscale/tilestream")
+	if err != nil {
+		t.Fatalf("Unable to open tile stream: %s\n", err.Error())
+	}
+	defer ws.Close()
+	_, _, err = ws.ReadMessage()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Idle tile stream request didn't end\n")
+	}
+	StreamIdleTimeout = saved
+	if err != io.EOF {
+		t.Errorf("Expected idle tile stream to be closed, got %v\n", err)
+	}
+
+	// Viewports without caching cancel requests but don't fetch tiles.
+	ws2, err := server.DialWebSocket(ts.URL + "/api/node/a9b8c7/grayscale/tilestream")
+	if err != nil {
+		t.Fatalf("Unable to open tile stream: %s\n", err.Error())
+	}
+	defer ws2.Close()
+	numRequests := fb.numRequests()
+	sendStreamMessage(t, ws2, `{"type": "viewport", "plane": "xy", "min": "2_2_5", "max": "3_3_5", "tilesize": 64}`)
+	sendStreamMessage(t, ws2, `{"type": "viewport", "plane": "xy", "min": "3_3_5", "max": "2_2_5", "tilesize": 64}`)
+	if reply := readStreamReply(t, ws2); reply.status == nil || reply.status.Status != http.StatusBadRequest {
+		t.Errorf("Expected bad request for inverted viewport, got %+v\n", reply)
+	}
+	if fb.numRequests() != numRequests {
+		t.Errorf("Expected no speculative fetches without caching, got %d\n", fb.numRequests()-numRequests)
+	}
+	ws2.WriteClose(server.CloseNormal, "")
+	if _, _, err := ws2.ReadMessage(); err != io.EOF {
+		t.Errorf("Expected close of tile stream, got %v\n", err)
+	}
+	<-done
+}
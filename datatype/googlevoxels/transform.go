@@ -0,0 +1,163 @@
+/*
+	This file supports transforming coordinates between full resolution voxel space and the
+	space of the scaled volumes (Google geometries) that fulfill requests.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+var transformQueryParams = server.QueryParams{
+	{Name: "offset", Help: "Offset in \"x_y_z\" format.  Required."},
+	{Name: "size", Help: "Size in \"w_h\" format along the plane's dimensions.  Default is the tile size."},
+	{Name: "inverse", Help: "If true, offset and size are in the scaled volume and are transformed to full resolution."},
+}
+
+// Transform describes how a region maps between full resolution and a scaled volume.
+type Transform struct {
+	Scale         Scaling
+	Plane         string
+	GeometryIndex GeometryIndex
+	PixelSize     dvid.NdFloat32
+	VolumeSize    dvid.Point3d
+
+	// Offset and Size are the transformed region.  For forward transforms, Size is clipped
+	// to the scaled volume.
+	Offset dvid.Point3d
+	Size   dvid.Point3d
+
+	Edge    bool // region is partially outside the scaled volume
+	Outside bool // region is totally outside the scaled volume
+}
+
+// scaleFactors returns the ratio of full resolution pixel size to the given geometry's
+// pixel size along each dimension.
+func (d *Data) scaleFactors(geom Geometry) ([3]float64, error) {
+	var factors [3]float64
+	hires := d.Scales[d.HighResIndex].PixelSize
+	for i := 0; i < 3; i++ {
+		if geom.PixelSize[i] == 0 {
+			return factors, fmt.Errorf("Geometry of %q has zero pixel size: %s", d.DataName(), geom.PixelSize)
+		}
+		factors[i] = float64(hires[i]) / float64(geom.PixelSize[i])
+	}
+	return factors, nil
+}
+
+// GetTransform returns the transform of a region given by an offset and 2d size in the
+// plane.  If inverse is false, the region is in full resolution space and is transformed
+// to the scaled volume for the given scale.  If inverse is true, the region is in the
+// scaled volume and is transformed to full resolution.  No requests are made to Google.
+func (d *Data) GetTransform(scale Scaling, plane dvid.DataShape, offset dvid.Point3d, size dvid.Point2d, inverse bool) (*Transform, error) {
+	tileSpec, err := GetTileSpec(scale, plane)
+	if err != nil {
+		return nil, err
+	}
+	geomIndex, found := d.TileMap[*tileSpec]
+	if !found {
+		return nil, server.NewError(server.NotFoundError, "Could not find scaled volume in %q for %s with scaling %d", d.DataName(), plane, scale)
+	}
+	geom := d.Scales[geomIndex]
+	factors, err := d.scaleFactors(geom)
+	if err != nil {
+		return nil, err
+	}
+	size3d, err := dvid.GetPoint3dFrom2d(plane, size, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the region in the scaled volume.
+	scaledOffset := offset
+	scaledSize := size3d
+	if !inverse {
+		for i := 0; i < 3; i++ {
+			scaledOffset[i] = int32(math.Floor(float64(offset[i]) * factors[i]))
+			end := int32(math.Ceil(float64(offset[i]+size3d[i]) * factors[i]))
+			scaledSize[i] = end - scaledOffset[i]
+		}
+	}
+	d0, d1 := GoogleTileSpec{plane: tileSpec.plane}.dims()
+	tile, err := d.GetGoogleSpec(scale, plane, scaledOffset, dvid.Point2d{scaledSize[d0], scaledSize[d1]})
+	if err != nil {
+		return nil, err
+	}
+
+	transform := &Transform{
+		Scale:         scale,
+		Plane:         tileSpec.plane.String(),
+		GeometryIndex: geomIndex,
+		PixelSize:     geom.PixelSize,
+		VolumeSize:    geom.VolumeSize,
+		Offset:        scaledOffset,
+		Size:          tile.size,
+		Edge:          tile.edge,
+		Outside:       tile.outside,
+	}
+	if inverse {
+		for i := 0; i < 3; i++ {
+			transform.Offset[i] = int32(math.Floor(float64(offset[i]) / factors[i]))
+			end := int32(math.Ceil(float64(offset[i]+tile.size[i]) / factors[i]))
+			transform.Size[i] = end - transform.Offset[i]
+			if tile.size[i] == 0 {
+				transform.Size[i] = 0
+			}
+		}
+	}
+	return transform, nil
+}
+
+// serveTransform handles requests of the form transform/<scale>/<plane>?offset=x_y_z&size=w_h
+func (d *Data) serveTransform(w http.ResponseWriter, r *http.Request, parts []string) error {
+	if len(parts) < 6 {
+		return fmt.Errorf("'transform' request must be followed by scale and plane")
+	}
+	scale, err := strconv.ParseUint(parts[4], 10, 8)
+	if err != nil {
+		return fmt.Errorf("Illegal scale: %s (%s)", parts[4], err.Error())
+	}
+	plane, err := dvid.DataShapeString(parts[5]).DataShape()
+	if err != nil {
+		return fmt.Errorf("Illegal plane: %s (%s)", parts[5], err.Error())
+	}
+	query, err := server.NewQuery(r, transformQueryParams, d.StrictQueries)
+	if err != nil {
+		return err
+	}
+	if !query.Has("offset") {
+		return fmt.Errorf("'transform' request requires 'offset' query string")
+	}
+	offset, err := dvid.StringToPoint3d(query.GetString("offset", ""), "_")
+	if err != nil {
+		return err
+	}
+	size := dvid.Point2d{d.TileSize, d.TileSize}
+	if query.Has("size") {
+		if size, err = dvid.StringToPoint2d(query.GetString("size", ""), "_"); err != nil {
+			return err
+		}
+	}
+	inverse, err := query.GetBool("inverse", false)
+	if err != nil {
+		return err
+	}
+
+	transform, err := d.GetTransform(Scaling(scale), plane, offset, size, inverse)
+	if err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(transform)
+	if err != nil {
+		return err
+	}
+	return server.WriteJSON(w, r, jsonBytes)
+}
@@ -0,0 +1,527 @@
+/*
+	This file handles requests to upstream providers of tile data: the Google BrainMaps API
+	or an image tile server (see tilesource.go).  Identical concurrent requests upstream are
+	coalesced so only one request is sent and its response is shared.
+*/
+
+package googlevoxels
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// MaxCoalescedBytes is the largest response body that will be buffered and shared among
+// identical concurrent requests.  Larger responses are only returned to the first requestor
+// and any waiting requestors issue their own requests.
+var MaxCoalescedBytes = 4 * dvid.Mega
+
+// ProviderBrainMaps is the provider setting for the Google BrainMaps API, the default.
+const ProviderBrainMaps = "brainmaps"
+
+// DefaultAPIURL is the base URL of the Google BrainMaps API.
+const DefaultAPIURL = "https://www.googleapis.com/brainmaps/v1beta1"
+
+// upstream is a provider of tile data.  FetchTile returns the voxels at the spec's offset
+// and size within the spec's scaled volume, either as little-endian raw voxels if format is
+// empty or encoded in the given format, along with the data's content type.  Padding of
+// edge tiles, splitting of large requests, and synthesis of unavailable scales are done
+// by the caller, so the spec's region always lies within the scaled volume.
+type upstream interface {
+	FetchTile(ctx context.Context, spec GoogleTileSpec, format string) (data []byte, contentType string, err error)
+}
+
+// fetcher returns the upstream for the instance's provider.
+func (d *Data) fetcher() upstream {
+	if d.source != nil {
+		return d.source
+	}
+	if d.provider() == ProviderTileSource {
+		return tileSource{d}
+	}
+	return brainMaps{d}
+}
+
+type requestIDKey struct{}
+
+// fetchContext returns a context for upstream fetches that carries the request ID for logging.
+func fetchContext(requestID string) context.Context {
+	return context.WithValue(context.Background(), requestIDKey{}, requestID)
+}
+
+// requestIDFrom returns the request ID carried by a fetch context, if any.
+func requestIDFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// contentType returns the MIME type of data in the given format, where an empty format is
+// raw voxels.
+func contentType(format string) (string, error) {
+	if format == "" || format == RawFormat {
+		return "application/octet-stream", nil
+	}
+	enc, _, err := dvid.GetImageEncoder(format)
+	if err != nil {
+		return "", err
+	}
+	return enc.ContentType(), nil
+}
+
+// brainMaps fetches tile data from the Google BrainMaps API.  Identical concurrent requests
+// are coalesced and responses are cached if the instance has a tile cache.
+type brainMaps struct {
+	d *Data
+}
+
+func (bm brainMaps) FetchTile(ctx context.Context, spec GoogleTileSpec, format string) ([]byte, string, error) {
+	d := bm.d
+	mimeType, err := contentType(format)
+	if err != nil {
+		return nil, "", err
+	}
+	url, err := spec.GetURL(d.apiURL(), d.VolumeID, format)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := d.fetchUpstream(requestIDFrom(ctx), url, spec.cacheTags())
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.close()
+	if resp.statusCode != http.StatusOK {
+		return nil, "", server.NewError(server.UpstreamError, "Unexpected status code %d on tile request (%q, volume id %q)", resp.statusCode, d.DataName(), d.VolumeID)
+	}
+	data, err := resp.readAll()
+	if err != nil {
+		return nil, "", server.NewError(server.UpstreamError, "Error reading tile from Google: %s", err.Error())
+	}
+	err = spec.validate(data, resp.contentType, mimeType, d.SniffImages)
+	d.stats.recordValidation(err)
+	if err != nil {
+		d.cacheDelete(url)
+		return nil, "", server.NewError(server.UpstreamError, "Invalid tile from Google for %q (volume id %q): %s", d.DataName(), d.VolumeID, err.Error())
+	}
+	return data, mimeType, nil
+}
+
+// upstreamClient is used for requests to Google unless a proxy or CA bundle is configured
+// for the instance or server.  It uses any proxy given by the environment.
+var upstreamClient = &http.Client{}
+
+// volumeURL returns the URL of a Google volume's metadata given the base URL of the API.
+// Like all URLs built in this package, it lacks the API key, which is only added by
+// keyTransport.
+func volumeURL(apiURL, volumeID string) string {
+	return fmt.Sprintf("%s/volumes/%s", apiURL, volumeID)
+}
+
+// keyTransport adds the API key, if any, to each request on its way to the base transport,
+// so URLs in errors and logs never include the key.  Errors from the base transport that
+// echo the keyed URL are redacted.
+type keyTransport struct {
+	base http.RoundTripper
+	key  string
+}
+
+func (kt keyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	keyed := new(http.Request)
+	*keyed = *r
+	u := *r.URL
+	if kt.key != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += "key=" + url.QueryEscape(kt.key)
+	}
+	keyed.URL = &u
+	base := kt.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(keyed)
+	if err != nil {
+		return nil, kt.redact(err)
+	}
+	resp.Body = redactingBody{resp.Body, kt}
+	return resp, nil
+}
+
+// redact returns the error with any API key in its message masked.
+func (kt keyTransport) redact(err error) error {
+	if err == nil || kt.key == "" {
+		return err
+	}
+	msg := strings.Replace(err.Error(), kt.key, dvid.MaskedValue, -1)
+	msg = strings.Replace(msg, url.QueryEscape(kt.key), dvid.MaskedValue, -1)
+	if msg == err.Error() {
+		return err
+	}
+	return redactedError{err, msg}
+}
+
+// redactedError is an error whose message has the API key masked.
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e redactedError) Error() string {
+	return e.msg
+}
+
+// redactingBody masks the API key in errors from reading a response body.
+type redactingBody struct {
+	io.ReadCloser
+	kt keyTransport
+}
+
+func (rb redactingBody) Read(p []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(p)
+	if err == io.EOF {
+		return n, err
+	}
+	return n, rb.kt.redact(err)
+}
+
+// keyedClient returns a client that uses the given client's transport, or upstreamClient's
+// if nil, and adds the API key to each request.  A zero timeout means no timeout.
+func keyedClient(client *http.Client, key string, timeout time.Duration) *http.Client {
+	if client == nil {
+		client = upstreamClient
+	}
+	return &http.Client{Transport: keyTransport{client.Transport, key}, Timeout: timeout}
+}
+
+// upstreamClientFor returns a client for requests to Google given instance settings, which
+// override any server-wide outbound settings.  A nil client is returned if neither sets a
+// proxy or CA bundle, in which case upstreamClient should be used.
+func upstreamClientFor(proxy, caBundle string) (*http.Client, error) {
+	defaults := server.Outbound()
+	if proxy == "" {
+		proxy = defaults.Proxy
+	}
+	if caBundle == "" {
+		caBundle = defaults.CABundle
+	}
+	if proxy == "" && caBundle == "" {
+		return nil, nil
+	}
+	transport, err := server.NewOutboundTransport(proxy, caBundle)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// googleClient returns a client for this instance's requests to Google that adds the API
+// key to each request.  A zero timeout means no timeout.
+func (d *Data) googleClient(timeout time.Duration) *http.Client {
+	return keyedClient(d.httpClient(), d.AuthKey, timeout)
+}
+
+// httpClient returns the client, without the API key, used for this instance's requests
+// to Google.
+func (d *Data) httpClient() *http.Client {
+	d.clientMu.RLock()
+	defer d.clientMu.RUnlock()
+	if d.client == nil {
+		return upstreamClient
+	}
+	return d.client
+}
+
+func (d *Data) setClient(client *http.Client) {
+	d.clientMu.Lock()
+	d.client = client
+	d.clientMu.Unlock()
+}
+
+// initClient sets the client for requests to Google from the instance's settings.
+func (d *Data) initClient() error {
+	client, err := upstreamClientFor(d.Proxy, d.CABundle)
+	if err != nil {
+		return err
+	}
+	d.setClient(client)
+	return nil
+}
+
+// verifyUpstream checks that Google can be reached using the given client, or upstreamClient
+// if nil, by requesting the volume metadata.
+func (d *Data) verifyUpstream(client *http.Client) error {
+	resp, err := keyedClient(client, d.AuthKey, healthTimeout).Get(d.checkURL())
+	if err != nil {
+		return server.NewError(server.UpstreamError, "Unable to reach %s: %s", d.upstreamName(), server.OutboundErrorMessage(err))
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return server.NewError(server.UpstreamError, "Unexpected status code %d from %s for %q", resp.StatusCode, d.upstreamName(), d.DataName())
+	}
+	return nil
+}
+
+// checkURL returns the URL requested to check that upstream can be reached: the volume
+// metadata for BrainMaps or the first tile at scale 0 for a tile source.
+func (p *Properties) checkURL() string {
+	if p.provider() == ProviderTileSource {
+		return p.sourceTileURL(0, 0, 0, 0)
+	}
+	return volumeURL(p.apiURL(), p.VolumeID)
+}
+
+// checkName describes the request to checkURL for messages.
+func (p *Properties) checkName() string {
+	if p.provider() == ProviderTileSource {
+		return fmt.Sprintf("source tile %q", p.checkURL())
+	}
+	return fmt.Sprintf("volume metadata for %q", p.VolumeID)
+}
+
+// upstreamName returns a description of the upstream for messages.
+func (p *Properties) upstreamName() string {
+	if p.provider() == ProviderTileSource {
+		return "tile source"
+	}
+	return "Google BrainMaps API"
+}
+
+// upstreamResponse holds the response to a Google request.
+type upstreamResponse struct {
+	statusCode  int
+	contentType string // empty for cached responses
+	data        []byte
+
+	// If the response exceeded MaxCoalescedBytes, rest holds the remainder of the body
+	// and data holds the first part.  Only the requestor that issued the request gets
+	// a non-nil rest.
+	rest io.ReadCloser
+}
+
+// readAll returns the entire response body.
+func (up *upstreamResponse) readAll() ([]byte, error) {
+	if up.rest == nil {
+		return up.data, nil
+	}
+	rest, err := ioutil.ReadAll(up.rest)
+	if err != nil {
+		return nil, err
+	}
+	return append(up.data, rest...), nil
+}
+
+func (up *upstreamResponse) close() {
+	if up.rest != nil {
+		up.rest.Close()
+	}
+}
+
+// instanceStats holds counters for a googlevoxels instance.
+type instanceStats struct {
+	upstreamRequests  uint64
+	coalescedRequests uint64
+	passthroughTiles  uint64
+	transcodedTiles   uint64
+	mirroredTiles     uint64
+	mirrorDropped     uint64
+	mirrorErrors      uint64
+	mirrorServed      uint64
+	invalidResponses  uint64
+	invalidStreak     int64 // invalid responses since the last valid one
+	hedgedRequests    uint64
+	hedgesWon         uint64
+	quotaDay          int64 // UTC day, in days since the epoch, of dailyRequests
+	dailyRequests     uint64
+
+	since time.Time // when the instance was created or loaded by this server process
+}
+
+// Stats are the counters exposed in /info.  PassthroughTiles counts tiles returned exactly
+// as delivered by Google, while TranscodedTiles counts tiles that were padded, assembled,
+// adjusted, or encoded by DVID.  MirroredTiles, MirrorDropped, and MirrorErrors count
+// fetched tiles written to the mirror, dropped because the write queue was full, or whose
+// writes failed, while MirrorServed counts tiles served from the mirror.  InvalidResponses
+// counts tiles from Google with the wrong content type or size.  HedgedRequests counts
+// requests sent because Google was slow to respond to an identical one, and HedgesWon
+// those whose response arrived first.  DailyRequests counts requests since midnight UTC.
+// The counts are since the time given by Since, when this server process created or loaded
+// the instance, while Persisted has any stats accumulated across server restarts.
+type Stats struct {
+	Since             time.Time
+	UpstreamRequests  uint64
+	CoalescedRequests uint64
+	PassthroughTiles  uint64
+	TranscodedTiles   uint64
+	MirroredTiles     uint64
+	MirrorDropped     uint64
+	MirrorErrors      uint64
+	MirrorServed      uint64
+	InvalidResponses  uint64
+	HedgedRequests    uint64
+	HedgesWon         uint64
+	DailyRequests     uint64
+	DiskCache         *DiskCacheStats `json:",omitempty"`
+	Persisted         *PersistedStats `json:",omitempty"`
+}
+
+func (s *instanceStats) get() Stats {
+	return Stats{
+		Since:             s.since,
+		UpstreamRequests:  atomic.LoadUint64(&s.upstreamRequests),
+		CoalescedRequests: atomic.LoadUint64(&s.coalescedRequests),
+		PassthroughTiles:  atomic.LoadUint64(&s.passthroughTiles),
+		TranscodedTiles:   atomic.LoadUint64(&s.transcodedTiles),
+		MirroredTiles:     atomic.LoadUint64(&s.mirroredTiles),
+		MirrorDropped:     atomic.LoadUint64(&s.mirrorDropped),
+		MirrorErrors:      atomic.LoadUint64(&s.mirrorErrors),
+		MirrorServed:      atomic.LoadUint64(&s.mirrorServed),
+		InvalidResponses:  atomic.LoadUint64(&s.invalidResponses),
+		HedgedRequests:    atomic.LoadUint64(&s.hedgedRequests),
+		HedgesWon:         atomic.LoadUint64(&s.hedgesWon),
+		DailyRequests:     s.daily(time.Now()),
+	}
+}
+
+// flightCall is an in-progress or completed request to Google.
+type flightCall struct {
+	wg   sync.WaitGroup
+	resp *upstreamResponse
+	err  error
+}
+
+// flightGroup coalesces identical concurrent requests.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do executes and returns the results of fn, making sure only one execution for a given
+// key is in-flight at a time.  If a duplicate comes in, the duplicate caller waits for the
+// original to complete and receives the same results.  The return value shared reports
+// whether the results came from another caller's execution.
+func (g *flightGroup) do(key string, fn func() (*upstreamResponse, error)) (resp *upstreamResponse, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, found := g.calls[key]; found {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.resp, c.err, true
+	}
+	c := new(flightCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.resp, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return c.resp, c.err, false
+}
+
+// fetchUpstream returns the response for a Google URL that lacks the authentication key.
+// Identical concurrent requests are coalesced and, if tile caches are enabled, successful
+// responses are cached with the given tags.  The caller must close the returned response.
+func (d *Data) fetchUpstream(requestID, urlSansKey string, tags dvid.CacheTags) (*upstreamResponse, error) {
+	if data, found := d.cacheGet(urlSansKey, tags); found {
+		return &upstreamResponse{statusCode: http.StatusOK, data: data}, nil
+	}
+	resp, err, shared := d.flights.do(urlSansKey, func() (*upstreamResponse, error) {
+		return d.getUpstream(requestID, urlSansKey)
+	})
+	if !shared {
+		if err == nil && resp.statusCode == http.StatusOK && resp.rest == nil {
+			d.cacheSet(urlSansKey, resp.data, tags)
+		}
+		return resp, err
+	}
+	atomic.AddUint64(&d.stats.coalescedRequests, 1)
+	if err != nil {
+		return nil, err
+	}
+	if resp.rest != nil {
+		// Response was too large to share so do our own request.
+		return d.getUpstream(requestID, urlSansKey)
+	}
+	return &upstreamResponse{statusCode: resp.statusCode, contentType: resp.contentType, data: resp.data}, nil
+}
+
+// getUpstream does a request to Google, buffering up to MaxCoalescedBytes of the response.
+// Requests that fail to connect or return a 429 or 5xx status are retried up to the
+// instance's retries setting, each limited by its timeout setting.
+func (d *Data) getUpstream(requestID, urlSansKey string) (*upstreamResponse, error) {
+	timeout, retries := d.timeout(), d.retries()
+	for attempt := 1; ; attempt++ {
+		up, err := d.tryUpstream(requestID, urlSansKey, timeout)
+		if attempt > retries || !retryable(up, err) {
+			return up, err
+		}
+		if err != nil {
+			dvid.Infof("[%s] Retrying request %d of %d to Google after error: %s\n", requestID, attempt, retries, err.Error())
+		} else {
+			up.close()
+			dvid.Infof("[%s] Retrying request %d of %d to Google after status %d\n", requestID, attempt, retries, up.statusCode)
+		}
+		time.Sleep(time.Duration(attempt) * RetryBackoff)
+	}
+}
+
+// retryable returns true if a Google request failed in a way that may succeed if retried.
+func retryable(up *upstreamResponse, err error) bool {
+	if err != nil {
+		return true
+	}
+	return up.statusCode == http.StatusTooManyRequests || up.statusCode >= 500
+}
+
+// tryUpstream does a single request to Google, which may be hedged, with the given timeout,
+// where 0 is no timeout.  The request is watched by the server's watchdog, which expects
+// it to finish within the timeout.
+func (d *Data) tryUpstream(requestID, urlSansKey string, timeout time.Duration) (*upstreamResponse, error) {
+	watched := server.WatchOperation("googlevoxels/fetch", string(d.DataName()), timeout)
+	defer watched.Done()
+	timedLog := dvid.NewTimeLog()
+	resp, err := d.hedgedGet(requestID, urlSansKey, timeout)
+	if err != nil {
+		return nil, server.NewError(server.UpstreamError, "Error getting data from Google: %s", server.OutboundErrorMessage(err))
+	}
+	timedLog.Infof("[%s] PROXY HTTP to Google: %s, returned %d", requestID, urlSansKey, resp.StatusCode)
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, resp.Body, int64(MaxCoalescedBytes)+1)
+	if err != nil && err != io.EOF {
+		resp.Body.Close()
+		return nil, server.NewError(server.UpstreamError, "Error reading data from Google: %s", err.Error())
+	}
+	up := &upstreamResponse{
+		statusCode:  resp.StatusCode,
+		contentType: resp.Header.Get("Content-Type"),
+		data:        buf.Bytes(),
+	}
+	if n > int64(MaxCoalescedBytes) {
+		up.rest = resp.Body
+	} else {
+		resp.Body.Close()
+	}
+	return up, nil
+}
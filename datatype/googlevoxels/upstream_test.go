@@ -0,0 +1,140 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// mockUpstream serves uint8 data with the same values as cappedTransport, x + 3y, without
+// any HTTP requests.  Only raw data and png encoding are supported.
+type mockUpstream struct {
+	count      int64
+	requestIDs chan string
+}
+
+func (m *mockUpstream) FetchTile(ctx context.Context, spec GoogleTileSpec, format string) ([]byte, string, error) {
+	atomic.AddInt64(&m.count, 1)
+	if m.requestIDs != nil {
+		m.requestIDs <- requestIDFrom(ctx)
+	}
+	var data []byte
+	for y := spec.offset[1]; y < spec.offset[1]+spec.size[1]; y++ {
+		for x := spec.offset[0]; x < spec.offset[0]+spec.size[0]; x++ {
+			data = append(data, byte(x+3*y))
+		}
+	}
+	switch format {
+	case "":
+		return data, "application/octet-stream", nil
+	case "png":
+		img := &image.Gray{
+			Pix:    data,
+			Stride: int(spec.size[0]),
+			Rect:   image.Rect(0, 0, int(spec.size[0]), int(spec.size[1])),
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/png", nil
+	default:
+		return nil, "", fmt.Errorf("mock upstream doesn't support format %q", format)
+	}
+}
+
+func TestUpstreamProvider(t *testing.T) {
+	// Requests that DVID decodes or encodes itself give the same responses whether the
+	// data comes from Google or another provider.
+	google := newTestData(t)
+	defer useTransport(&cappedTransport{maxVoxels: 1000000})()
+	mock := &mockUpstream{}
+	provided := newTestData(t)
+	provided.source = mock
+
+	serve := func(d *Data, url string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(nil, w, r)
+		return w
+	}
+	urls := []string{
+		"/api/node/a9b8c7/grayscale/tile/xy/0/3_4_5/raw?tilesize=8",
+		"/api/node/a9b8c7/grayscale/tile/xy/0/111_3_5/png?tilesize=9",
+		"/api/node/a9b8c7/grayscale/tile/xy/0/200_0_5/png?tilesize=8",
+		"/api/node/a9b8c7/grayscale/raw/xy/16_16/10_20_30/raw",
+		"/api/node/a9b8c7/grayscale/raw/xy/16_16/10_20_30/png?invert=true",
+		"/api/node/a9b8c7/grayscale/raw/xy/16_16/990_20_30/png",
+	}
+	for _, maxFetch := range []int64{0, 64} {
+		google.MaxFetch = maxFetch
+		provided.MaxFetch = maxFetch
+		for _, url := range urls {
+			expected := serve(google, url)
+			got := serve(provided, url)
+			if expected.Code != http.StatusOK {
+				t.Fatalf("Request %s with max fetch %d failed with status %d: %s\n", url, maxFetch, expected.Code, expected.Body.String())
+			}
+			if got.Code != expected.Code || got.Header().Get("Content-type") != expected.Header().Get("Content-type") {
+				t.Errorf("Request %s: expected status %d and content type %q, got %d and %q\n", url, expected.Code,
+					expected.Header().Get("Content-type"), got.Code, got.Header().Get("Content-type"))
+			}
+			if !bytes.Equal(got.Body.Bytes(), expected.Body.Bytes()) {
+				t.Errorf("Request %s with max fetch %d: provider response differs from Google response\n", url, maxFetch)
+			}
+		}
+	}
+	if mock.count == 0 {
+		t.Fatalf("Expected requests to the mock upstream\n")
+	}
+
+	// Tiles that need no processing are passed through from the provider.
+	provided.MaxFetch = 0
+	mock.count = 0
+	passthrough := provided.stats.get().PassthroughTiles
+	mock.requestIDs = make(chan string, 1)
+	w := serve(provided, "/api/node/a9b8c7/grayscale/tile/xy/0/3_4_5/png?tilesize=8")
+	if w.Code != http.StatusOK || w.Header().Get("Content-type") != "image/png" {
+		t.Fatalf("Expected png tile, got status %d, content type %q\n", w.Code, w.Header().Get("Content-type"))
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to decode passed through tile: %s\n", err.Error())
+	}
+	if gray, ok := img.(*image.Gray); !ok || gray.Pix[0] != byte(24+3*32) {
+		t.Errorf("Unexpected passed through tile: %v\n", img)
+	}
+	if mock.count != 1 || provided.stats.get().PassthroughTiles != passthrough+1 {
+		t.Errorf("Expected 1 passed through request to the provider, got %d requests and stats %v\n", mock.count, provided.stats.get())
+	}
+	if requestID := <-mock.requestIDs; requestID == "" {
+		t.Errorf("Expected request ID in fetch context\n")
+	}
+}
+
+func TestProviderSetting(t *testing.T) {
+	config := dvid.NewConfig()
+	config.Set("volumeid", "123456:test")
+	config.Set("authkey", "secretkey")
+	config.Set("provider", "s3")
+	if _, err := NewType().NewDataService(dvid.UUID("a9b8c7"), 1, "grayscale", config); err == nil {
+		t.Errorf("Expected error for unsupported provider\n")
+	}
+
+	d := newTestData(t)
+	if d.provider() != ProviderBrainMaps {
+		t.Errorf("Expected default provider %q, got %q\n", ProviderBrainMaps, d.provider())
+	}
+	if _, ok := d.fetcher().(brainMaps); !ok {
+		t.Errorf("Expected BrainMaps upstream by default, got %T\n", d.fetcher())
+	}
+}
@@ -0,0 +1,76 @@
+/*
+	This file validates tile responses from Google before they are forwarded, since Google or
+	an intervening proxy can return an error page or a tile of the wrong size with status 200.
+*/
+
+package googlevoxels
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"sync/atomic"
+)
+
+// Number of consecutive invalid responses from Google before the instance is degraded.
+const invalidDegradedAfter = 3
+
+// imageMagic gives the leading bytes of images in each format Google can encode.
+var imageMagic = map[string][]byte{
+	"image/png":  []byte("\x89PNG\r\n\x1a\n"),
+	"image/jpeg": []byte("\xff\xd8\xff"),
+}
+
+// validate returns an error if a tile received from Google with the given Content-Type
+// doesn't match the expected MIME type or, for raw data, the tile size.  An empty received
+// type, e.g., for a cached response, isn't checked.  If sniff is true, encoded images must
+// start with the magic bytes of their format.
+func (gts GoogleTileSpec) validate(data []byte, receivedType, mimeType string, sniff bool) error {
+	if receivedType != "" {
+		mediaType, _, err := mime.ParseMediaType(receivedType)
+		if err != nil || mediaType != mimeType {
+			return fmt.Errorf("expected content type %q, received %q", mimeType, receivedType)
+		}
+	}
+	if mimeType == "application/octet-stream" {
+		return gts.validateRaw(len(data))
+	}
+	if magic, found := imageMagic[mimeType]; found && sniff && !bytes.HasPrefix(data, magic) {
+		n := len(data)
+		if n > 16 {
+			n = 16
+		}
+		return fmt.Errorf("expected %s image, received %d bytes starting with %q", mimeType, len(data), data[:n])
+	}
+	return nil
+}
+
+// validateRaw checks the length of raw tile or subvolume data, which has bytesPerVoxel bytes for each
+// channel of each voxel.  Edge tiles may be clipped to within a voxel of the expected size.
+func (gts GoogleTileSpec) validateRaw(numBytes int) error {
+	if gts.edge {
+		_, _, err := gts.receivedSize(numBytes)
+		return err
+	}
+	channels := int64(gts.channelCount)
+	if channels < 1 {
+		channels = 1
+	}
+	expected := gts.size.Prod() * int64(gts.bytesPerVoxel) * channels
+	if expected != int64(numBytes) {
+		return fmt.Errorf("expected %d x %d x %d voxels with %d channels of %d bytes (%d bytes), received %d bytes",
+			gts.size[0], gts.size[1], gts.size[2], channels, gts.bytesPerVoxel, expected, numBytes)
+	}
+	return nil
+}
+
+// recordValidation counts invalid responses from Google and tracks how many have been
+// received in a row.
+func (s *instanceStats) recordValidation(err error) {
+	if err == nil {
+		atomic.StoreInt64(&s.invalidStreak, 0)
+		return
+	}
+	atomic.AddUint64(&s.invalidResponses, 1)
+	atomic.AddInt64(&s.invalidStreak, 1)
+}
@@ -0,0 +1,100 @@
+package googlevoxels
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// typedTransport returns the body with the given Content-Type and status 200, like a proxy
+// returning an error page.
+type typedTransport struct {
+	contentType string
+	body        []byte
+}
+
+func (tt *typedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	header := make(http.Header)
+	header.Set("Content-Type", tt.contentType)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(tt.body)),
+		Request:    r,
+	}, nil
+}
+
+func getTile(d *Data, url string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", url, nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(nil, w, r)
+	return w
+}
+
+func TestUpstreamValidation(t *testing.T) {
+	d := newTestData(t)
+	d.TileCacheMB = 10
+	d.initCache()
+	const pngURL = "/api/node/a9b8c7/grayscale/tile/xy/0/0_0_20/png"
+	const rawURL = "/api/node/a9b8c7/grayscale/raw/xy/512_512/0_0_20/raw"
+
+	// A JSON error delivered with status 200 is rejected and not cached.
+	restore := useTransport(&typedTransport{"application/json; charset=UTF-8", []byte(`{"error": "quota exceeded"}`)})
+	w := getTile(d, pngURL)
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), `expected content type \"image/png\"`) {
+		t.Errorf("Expected 502 for JSON tile, got %d: %s\n", w.Code, w.Body.String())
+	}
+	if d.cache.Len() != 0 {
+		t.Errorf("Expected invalid tile to be evicted from cache, have %d entries\n", d.cache.Len())
+	}
+	restore()
+
+	// Raw data of the wrong size is rejected with the expected and received sizes.
+	restore = useTransport(&typedTransport{"application/octet-stream", make([]byte, 100)})
+	w = getTile(d, rawURL)
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "(262144 bytes), received 100 bytes") {
+		t.Errorf("Expected 502 for short raw tile, got %d: %s\n", w.Code, w.Body.String())
+	}
+	if d.Health() != nil {
+		t.Errorf("Expected no health report before repeated invalid tiles\n")
+	}
+
+	// Repeated invalid tiles degrade the instance until a valid tile is received.
+	getTile(d, rawURL)
+	if health := d.Health(); health == nil || health.Status != HealthDegraded || health.ConsecutiveInvalid != 3 {
+		t.Errorf("Expected degraded health after 3 invalid tiles, got %v\n", health)
+	}
+	if invalid := atomic.LoadUint64(&d.stats.invalidResponses); invalid != 3 {
+		t.Errorf("Expected 3 invalid responses, got %d\n", invalid)
+	}
+	restore()
+	restore = useTransport(&typedTransport{"application/octet-stream", make([]byte, 512*512)})
+	if w = getTile(d, rawURL); w.Code != http.StatusOK {
+		t.Errorf("Expected valid raw tile, got %d: %s\n", w.Code, w.Body.String())
+	}
+	if health := d.Health(); health != nil {
+		t.Errorf("Expected no health report after valid tile, got %v\n", health)
+	}
+	restore()
+
+	// Image magic bytes are only checked if sniffing is enabled.
+	d.cache.Clear(nil)
+	restore = useTransport(&typedTransport{"image/png", []byte("<html>not a png</html>")})
+	if w = getTile(d, pngURL); w.Code != http.StatusOK {
+		t.Errorf("Expected unsniffed png tile, got %d: %s\n", w.Code, w.Body.String())
+	}
+	d.cache.Clear(nil)
+	d.SniffImages = true
+	if w = getTile(d, pngURL); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "expected image/png image") {
+		t.Errorf("Expected 502 for sniffed png tile, got %d: %s\n", w.Code, w.Body.String())
+	}
+	restore()
+	defer useTransport(&typedTransport{"image/png", []byte("\x89PNG\r\n\x1a\nrest of png")})()
+	if w = getTile(d, pngURL); w.Code != http.StatusOK {
+		t.Errorf("Expected sniffed png tile, got %d: %s\n", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,187 @@
+/*
+	This file supports lookups of voxel values at arbitrary points.  Points are grouped into
+	small blocks so only the minimal set of subvolumes is requested from Google.
+*/
+
+package googlevoxels
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+const (
+	// MaxValuePoints is the maximum number of points in a single values request.
+	MaxValuePoints = 10000
+
+	// Size of the cubic subvolumes requested from Google for point lookups.
+	valueBlockSize = 8
+
+	// Maximum number of concurrent subvolume requests for a single values request.
+	maxValueFetches = 8
+)
+
+var valuesQueryParams = server.QueryParams{
+	{Name: "scale", Help: "Default is 0.  For scale N, points are in the volume down-sampled by a factor of 2^N."},
+}
+
+// voxelValue returns the value of a voxel given its little-endian bytes and channel type.
+func voxelValue(b []byte, channelType string) (interface{}, error) {
+	switch channelType {
+	case dvid.ChannelUint8:
+		return b[0], nil
+	case dvid.ChannelUint16:
+		return binary.LittleEndian.Uint16(b), nil
+	case dvid.ChannelUint64:
+		return binary.LittleEndian.Uint64(b), nil
+	case dvid.ChannelFloat32:
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)), nil
+	default:
+		return nil, fmt.Errorf("Unable to interpret voxel values of channel type %q", channelType)
+	}
+}
+
+// getValues returns the voxel values at the given points, using nil for points outside
+// the scaled volume.  The number of subvolume requests is also returned.
+func (d *Data) getValues(requestID string, scale Scaling, points []dvid.Point3d) ([]interface{}, int, error) {
+	geomIndex, found := d.TileMap[TileSpec{scale, XY}]
+	if !found {
+		return nil, 0, server.NewError(server.NotFoundError, "Could not find scaled volume in %q with scaling %d", d.DataName(), scale)
+	}
+	geom := d.Scales[geomIndex]
+	bytesPerVoxel, err := dvid.ChannelBytes(geom.ChannelType)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unknown volume channel type in %s: %s", d.DataName(), geom.ChannelType)
+	}
+
+	// Group the points by block.
+	blocks := make(map[dvid.Point3d][]int)
+	for i, pt := range points {
+		outside := false
+		for dim := 0; dim < 3; dim++ {
+			if pt[dim] < 0 || pt[dim] >= geom.VolumeSize[dim] {
+				outside = true
+			}
+		}
+		if outside {
+			continue
+		}
+		blockCoord := dvid.Point3d{pt[0] / valueBlockSize, pt[1] / valueBlockSize, pt[2] / valueBlockSize}
+		blocks[blockCoord] = append(blocks[blockCoord], i)
+	}
+
+	// Fetch the blocks concurrently and fill in the values.
+	values := make([]interface{}, len(points))
+	var mu sync.Mutex
+	var firstErr error
+	wg := new(sync.WaitGroup)
+	sem := make(chan struct{}, maxValueFetches)
+	for blockCoord, indices := range blocks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(blockCoord dvid.Point3d, indices []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			tile := &GoogleTileSpec{
+				gi:            geomIndex,
+				scaling:       scale,
+				plane:         XY,
+				channelCount:  geom.ChannelCount,
+				channelType:   geom.ChannelType,
+				bytesPerVoxel: int32(bytesPerVoxel),
+			}
+			offset := dvid.Point3d{blockCoord[0] * valueBlockSize, blockCoord[1] * valueBlockSize, blockCoord[2] * valueBlockSize}
+			blockSize := dvid.Point3d{valueBlockSize, valueBlockSize, valueBlockSize}
+			plan := planRequest(geom.VolumeSize, offset, blockSize)
+			tile.offset, tile.size, tile.sizeWant = plan.offset, plan.size, plan.size
+			blockValues, err := d.getBlockValues(requestID, tile, points, indices)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			for j, i := range indices {
+				values[i] = blockValues[j]
+			}
+		}(blockCoord, indices)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, len(blocks), firstErr
+	}
+	return values, len(blocks), nil
+}
+
+// getBlockValues fetches a subvolume from upstream and returns the values of the points
+// with the given indices.
+func (d *Data) getBlockValues(requestID string, tile *GoogleTileSpec, points []dvid.Point3d, indices []int) ([]interface{}, error) {
+	data, _, err := d.fetcher().FetchTile(fetchContext(requestID), *tile, "")
+	if err != nil {
+		return nil, err
+	}
+	size := tile.size
+	expected := int(size[0]*size[1]*size[2]) * int(tile.bytesPerVoxel)
+	if len(data) != expected {
+		return nil, server.NewError(server.UpstreamError, "Expected %d bytes for %s subvolume from upstream, got %d bytes", expected, size, len(data))
+	}
+
+	values := make([]interface{}, len(indices))
+	for j, i := range indices {
+		x := points[i][0] - tile.offset[0]
+		y := points[i][1] - tile.offset[1]
+		z := points[i][2] - tile.offset[2]
+		pos := int((z*size[1]+y)*size[0]+x) * int(tile.bytesPerVoxel)
+		if values[j], err = voxelValue(data[pos:pos+int(tile.bytesPerVoxel)], tile.channelType); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// serveValues returns JSON voxel values for a JSON list of points in the request body.
+func (d *Data) serveValues(w http.ResponseWriter, r *http.Request, requestID string) error {
+	query, err := server.NewQuery(r, valuesQueryParams, d.StrictQueries)
+	if err != nil {
+		return err
+	}
+	scale, err := query.GetInt("scale", 0, 0, 255)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	var points []dvid.Point3d
+	if err := json.Unmarshal(body, &points); err != nil {
+		return fmt.Errorf("Expected JSON list of [x,y,z] points: %s", err.Error())
+	}
+	if len(points) > MaxValuePoints {
+		return fmt.Errorf("Requested %d points, which exceeds the maximum of %d per request", len(points), MaxValuePoints)
+	}
+	values, numRequests, err := d.getValues(requestID, Scaling(scale), points)
+	w.Header().Set("X-Upstream-Requests", strconv.Itoa(numRequests))
+	if err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return server.WriteJSON(w, r, jsonBytes)
+}
@@ -0,0 +1,120 @@
+/*
+	This file gives the voxel bounds of each scaled volume so clients can build viewports that
+	stay within the data at deep scales, and clips raw requests to those bounds on request.
+*/
+
+package googlevoxels
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// VolumeBounds gives the inclusive range of voxel coordinates of the scaled volume for an
+// orientation and scale.
+type VolumeBounds struct {
+	Plane     string
+	Scale     Scaling
+	MinPoint  dvid.Point3d
+	MaxPoint  dvid.Point3d
+	PixelSize dvid.NdFloat32
+}
+
+// allVolumeBounds returns the voxel bounds of every orientation and scale in the tile map,
+// keyed by orientation and then scale like "TileBounds" in /info.
+func (p *Properties) allVolumeBounds() map[string]map[string]VolumeBounds {
+	all := make(map[string]map[string]VolumeBounds, 3)
+	for _, plane := range []TileOrientation{XY, XZ, YZ} {
+		planeBounds := make(map[string]VolumeBounds)
+		for _, scale := range p.TileMap.scales(plane) {
+			gi := p.TileMap[TileSpec{Scaling(scale), plane}]
+			if int(gi) >= len(p.Scales) {
+				continue
+			}
+			geom := p.Scales[gi]
+			planeBounds[strconv.Itoa(scale)] = VolumeBounds{
+				Plane:     plane.String(),
+				Scale:     Scaling(scale),
+				MaxPoint:  geom.VolumeSize.Sub(dvid.Point3d{1, 1, 1}).(dvid.Point3d),
+				PixelSize: geom.PixelSize,
+			}
+		}
+		all[plane.String()] = planeBounds
+	}
+	return all
+}
+
+// scaledVolumeSize returns the size of the scaled volume used for requests at a scale and
+// orientation.  If the scale is synthesized by fallback, the size is that of the source
+// volume downsampled along the plane.
+func (d *Data) scaledVolumeSize(scaling Scaling, plane dvid.DataShape, fallback bool) (dvid.Point3d, error) {
+	gi, downLevels, err := d.scaledGeometry(scaling, plane, fallback)
+	if err != nil {
+		return dvid.Point3d{}, err
+	}
+	size := d.Scales[gi].VolumeSize
+	if downLevels != 0 {
+		tileSpec, err := GetTileSpec(scaling, plane)
+		if err != nil {
+			return size, err
+		}
+		f := int32(1) << downLevels
+		d0, d1 := GoogleTileSpec{plane: tileSpec.plane}.dims()
+		size[d0] = (size[d0] + f - 1) / f
+		size[d1] = (size[d1] + f - 1) / f
+	}
+	return size, nil
+}
+
+// clipRegion clamps a 2d region of the given plane to a volume of the given size.  It
+// returns false if no voxel of the region lies within the volume.
+func clipRegion(plane dvid.DataShape, offset dvid.Point3d, size dvid.Point2d, volumeSize dvid.Point3d) (dvid.Point3d, dvid.Point2d, bool) {
+	size3d, err := dvid.GetPoint3dFrom2d(plane, size, 1)
+	if err != nil {
+		return offset, size, false
+	}
+	plan := planRequest(volumeSize, offset, size3d)
+	if plan.outside {
+		return offset, size, false
+	}
+	clipped, size3d := plan.offset, plan.size
+	d0, err := plane.ShapeDimension(0)
+	if err != nil {
+		return offset, size, false
+	}
+	d1, err := plane.ShapeDimension(1)
+	if err != nil {
+		return offset, size, false
+	}
+	return clipped, dvid.Point2d{size3d[d0], size3d[d1]}, true
+}
+
+// clipRaw clamps a raw request to the bounds of the scaled volume and describes the applied
+// clip in the X-DVID-Clipped-Offset and X-DVID-Clipped-Size headers as "x,y,z".  Requests
+// entirely outside the volume get a 404 with a size of "0,0,0".
+func (d *Data) clipRaw(w http.ResponseWriter, scaling Scaling, plane dvid.DataShape, offset dvid.Point3d,
+	size dvid.Point2d, fallback bool) (dvid.Point3d, dvid.Point2d, error) {
+
+	volumeSize, err := d.scaledVolumeSize(scaling, plane, fallback)
+	if err != nil {
+		return offset, size, err
+	}
+	clippedOffset, clippedSize, inside := clipRegion(plane, offset, size, volumeSize)
+	size3d := dvid.Point3d{}
+	if inside {
+		if size3d, err = dvid.GetPoint3dFrom2d(plane, clippedSize, 1); err != nil {
+			return offset, size, err
+		}
+	}
+	w.Header().Set("X-DVID-Clipped-Offset", fmt.Sprintf("%d,%d,%d", clippedOffset[0], clippedOffset[1], clippedOffset[2]))
+	w.Header().Set("X-DVID-Clipped-Size", fmt.Sprintf("%d,%d,%d", size3d[0], size3d[1], size3d[2]))
+	if !inside {
+		return offset, size, server.NewError(server.NotFoundError, "Requested region is outside the %s volume of size %s at scale %d",
+			plane, volumeSize, scaling)
+	}
+	return clippedOffset, clippedSize, nil
+}
@@ -0,0 +1,111 @@
+package googlevoxels
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+func TestVolumeBoundsInfo(t *testing.T) {
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	d := newFakeData(t, fb, dvid.NewConfig())
+	defer d.Shutdown()
+
+	jsonBytes, err := d.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Unable to marshal info: %s\n", err.Error())
+	}
+	var info struct {
+		Extended struct {
+			VolumeBounds map[string]map[string]VolumeBounds
+		}
+	}
+	if err := json.Unmarshal(jsonBytes, &info); err != nil {
+		t.Fatalf("Unable to decode info: %s\n", err.Error())
+	}
+	bounds := info.Extended.VolumeBounds
+	if len(bounds["XY"]) != 3 || len(bounds["XZ"]) != 2 || len(bounds["YZ"]) != 1 {
+		t.Fatalf("Expected bounds for 3 XY, 2 XZ, and 1 YZ scales, got %v\n", bounds)
+	}
+	expected := map[string]map[string]dvid.Point3d{
+		"XY": {"0": {999, 799, 599}, "1": {499, 399, 599}, "2": {249, 199, 599}},
+		"XZ": {"0": {999, 799, 599}, "1": {499, 799, 299}},
+	}
+	for plane, scales := range expected {
+		for scale, maxPt := range scales {
+			b := bounds[plane][scale]
+			if b.MinPoint != (dvid.Point3d{0, 0, 0}) || b.MaxPoint != maxPt {
+				t.Errorf("Expected %s scale %s bounds from 0 to %s, got %s to %s\n", plane, scale, maxPt, b.MinPoint, b.MaxPoint)
+			}
+		}
+	}
+	if b := bounds["XY"]["2"]; b.Plane != "XY" || b.Scale != 2 || b.PixelSize[0] != 32 {
+		t.Errorf("Unexpected XY scale 2 bounds: %+v\n", b)
+	}
+}
+
+func TestFakeRawClip(t *testing.T) {
+	fb := newFakeBrainMaps()
+	defer fb.Close()
+	d := newFakeData(t, fb, dvid.NewConfig())
+	defer d.Shutdown()
+
+	// Scale 0 is 1000 x 800 x 600 and scale 2 is 250 x 200 x 600.
+	tests := []struct {
+		request string
+		status  int
+		offset  string // X-DVID-Clipped-Offset header
+		size    string // X-DVID-Clipped-Size header
+	}{
+		{"raw/xy/100_50/10_20_30/raw?clip=true", http.StatusOK, "10,20,30", "100,50,1"},
+		{"raw/xy/100_50/950_-20_30/raw?clip=true", http.StatusOK, "950,0,30", "50,30,1"},
+		{"raw/xz/64_32/-10_5_590/raw?clip=true", http.StatusOK, "0,5,590", "54,1,10"},
+		{"raw/xy/100_50/1000_20_30/raw?clip=true", http.StatusNotFound, "1000,20,30", "0,0,0"},
+		{"raw/xy/100_50/10_20_600/raw?clip=true", http.StatusNotFound, "10,20,600", "0,0,0"},
+		{"raw/xy/64_64/100_100_30/raw?scale=2&clip=true", http.StatusOK, "100,100,30", "64,64,1"},
+		{"raw/xy/64_64/200_180_30/raw?scale=2&clip=true", http.StatusOK, "200,180,30", "50,20,1"},
+		{"raw/xy/64_64/-100_-100_30/raw?scale=2&clip=true", http.StatusNotFound, "-100,-100,30", "0,0,0"},
+		{"raw/xy/64_64/260_100_30/raw?scale=2&clip=true", http.StatusNotFound, "260,100,30", "0,0,0"},
+	}
+	for _, test := range tests {
+		w := serveFake(d, test.request)
+		if w.Code != test.status {
+			t.Fatalf("Expected status %d for %s, got %d: %s\n", test.status, test.request, w.Code, w.Body.String())
+		}
+		offset, size := w.Header().Get("X-DVID-Clipped-Offset"), w.Header().Get("X-DVID-Clipped-Size")
+		if offset != test.offset || size != test.size {
+			t.Errorf("Expected clip %s of size %s for %s, got %s of size %s\n", test.offset, test.size, test.request, offset, size)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if upstream := w.Header().Get("X-DVID-Upstream-Size"); upstream != test.size {
+			t.Errorf("Expected upstream size %s for %s, got %s\n", test.size, test.request, upstream)
+		}
+		clipped, _ := dvid.StringToPoint3d(test.size, ",")
+		if w.Body.Len() != int(clipped.Prod()) {
+			t.Errorf("Expected %d voxels of clipped region for %s, got %d bytes\n", clipped.Prod(), test.request, w.Body.Len())
+		}
+	}
+
+	// Partially outside regions have the voxels of the clipped region without padding.
+	w := serveFake(d, "raw/xy/64_64/200_180_30/raw?scale=2&clip=true")
+	data := w.Body.Bytes()
+	for y := int32(0); y < 20; y++ {
+		for x := int32(0); x < 50; x++ {
+			if data[y*50+x] != fb.voxel(2, 200+x, 180+y, 30) {
+				t.Fatalf("Bad clipped voxel at (%d, %d): %d\n", x, y, data[y*50+x])
+			}
+		}
+	}
+
+	// Without clip, edge regions are padded and the clip headers are absent.
+	w = serveFake(d, "raw/xy/64_64/200_180_30/raw?scale=2")
+	if w.Code != http.StatusOK || w.Body.Len() != 64*64 || w.Header().Get("X-DVID-Clipped-Size") != "" {
+		t.Errorf("Expected padded region without clip, got %d with %d bytes and clip %q\n", w.Code, w.Body.Len(),
+			w.Header().Get("X-DVID-Clipped-Size"))
+	}
+}
@@ -0,0 +1,286 @@
+/*
+	This file supports finding the labels that touch a label and their contact areas.  The
+	label's blocks are processed one at a time: each block and a one-voxel halo are painted
+	from the sparse volumes of the labels found in the block and its face neighbors, and
+	face-adjacent voxel pairs between the label and its neighbors are counted.
+*/
+
+package labels64
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// LabelContact gives the number of face-adjacent voxel pairs between a label and a
+// neighboring label.
+type LabelContact struct {
+	Label         uint64 `json:"label"`
+	ContactVoxels uint64 `json:"contactVoxels"`
+}
+
+// byContact orders contacts by decreasing contact and then increasing label.
+type byContact []LabelContact
+
+func (c byContact) Len() int      { return len(c) }
+func (c byContact) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byContact) Less(i, j int) bool {
+	if c[i].ContactVoxels != c[j].ContactVoxels {
+		return c[i].ContactVoxels > c[j].ContactVoxels
+	}
+	return c[i].Label < c[j].Label
+}
+
+type adjacencyKey struct {
+	version dvid.VersionID
+	label   uint64
+}
+
+// adjacencyMu guards the adjacency caches of all data instances.
+var adjacencyMu sync.Mutex
+
+// faceOffsets are the block offsets of the 6-neighborhood.
+var faceOffsets = []dvid.IndexZYX{{-1, 0, 0}, {1, 0, 0}, {0, -1, 0}, {0, 1, 0}, {0, 0, -1}, {0, 0, 1}}
+
+// haloGrid holds the labels of a block and a one-voxel halo around it.
+type haloGrid struct {
+	min    dvid.Point3d // first voxel of the halo
+	size   dvid.Point3d
+	labels []uint64
+}
+
+func newHaloGrid(block dvid.IndexZYX, blockSize dvid.Point3d) *haloGrid {
+	g := &haloGrid{
+		min:  dvid.Point3d{block[0]*blockSize[0] - 1, block[1]*blockSize[1] - 1, block[2]*blockSize[2] - 1},
+		size: dvid.Point3d{blockSize[0] + 2, blockSize[1] + 2, blockSize[2] + 2},
+	}
+	g.labels = make([]uint64, g.size.Prod())
+	return g
+}
+
+func (g *haloGrid) index(x, y, z int32) int {
+	return int(((z-g.min[2])*g.size[1]+(y-g.min[1]))*g.size[0] + (x - g.min[0]))
+}
+
+// paint sets the label for the voxels of the runs within the grid.
+func (g *haloGrid) paint(label uint64, rles dvid.RLEs) {
+	maxX := g.min[0] + g.size[0] - 1
+	for _, rle := range rles {
+		start := rle.StartPt()
+		y, z := start[1], start[2]
+		if y < g.min[1] || y >= g.min[1]+g.size[1] || z < g.min[2] || z >= g.min[2]+g.size[2] {
+			continue
+		}
+		x0, x1 := start[0], start[0]+rle.Length()-1
+		if x0 < g.min[0] {
+			x0 = g.min[0]
+		}
+		if x1 > maxX {
+			x1 = maxX
+		}
+		for x := x0; x <= x1; x++ {
+			g.labels[g.index(x, y, z)] = label
+		}
+	}
+}
+
+// blockLabels returns the non-zero labels of a stored label block within the grid, or
+// nil if the block isn't stored.
+func (d *Data) blockLabels(ctx storage.Context, bigdata storage.BigDataStorer, block dvid.IndexZYX, g *haloGrid) (map[uint64]bool, error) {
+	serialization, err := bigdata.Get(ctx, voxels.NewVoxelBlockIndex(&block))
+	if err != nil || serialization == nil {
+		return nil, err
+	}
+	blockData, _, err := dvid.DeserializeData(serialization, true)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to deserialize block %v in %q: %s", block, d.DataName(), err.Error())
+	}
+	blockSize := d.BlockSize().(dvid.Point3d)
+	if int64(len(blockData)) != blockSize.Prod()*8 {
+		return nil, fmt.Errorf("Block %v in %q has %d bytes, expected %d", block, d.DataName(), len(blockData), blockSize.Prod()*8)
+	}
+	var min, max dvid.Point3d
+	for i := 0; i < 3; i++ {
+		min[i] = block[i] * blockSize[i]
+		max[i] = min[i] + blockSize[i] - 1
+		if min[i] < g.min[i] {
+			min[i] = g.min[i]
+		}
+		if last := g.min[i] + g.size[i] - 1; max[i] > last {
+			max[i] = last
+		}
+	}
+	labels := make(map[uint64]bool)
+	for z := min[2]; z <= max[2]; z++ {
+		for y := min[1]; y <= max[1]; y++ {
+			for x := min[0]; x <= max[0]; x++ {
+				i := (((z-block[2]*blockSize[2])*blockSize[1]+(y-block[1]*blockSize[1]))*blockSize[0] + (x - block[0]*blockSize[0])) * 8
+				if label := d.Properties.ByteOrder.Uint64(blockData[i : i+8]); label != 0 {
+					labels[label] = true
+				}
+			}
+		}
+	}
+	return labels, nil
+}
+
+// blockContacts adds the contacts between the label's voxels in the block and the voxels
+// of other labels in the block and its halo.  The labels in each block come from the
+// stored label blocks, and their voxels from their sparse volumes.
+func (d *Data) blockContacts(ctx storage.Context, smalldata storage.SmallDataStorer, bigdata storage.BigDataStorer,
+	label uint64, block dvid.IndexZYX, contacts map[uint64]uint64) error {
+
+	blockSize := d.BlockSize().(dvid.Point3d)
+	g := newHaloGrid(block, blockSize)
+	blocks := []dvid.IndexZYX{block}
+	for _, offset := range faceOffsets {
+		blocks = append(blocks, dvid.IndexZYX{block[0] + offset[0], block[1] + offset[1], block[2] + offset[2]})
+	}
+	paintLabel := func(l uint64, b dvid.IndexZYX) error {
+		value, err := smalldata.Get(ctx, voxels.NewLabelSpatialMapIndex(l, b.Bytes()))
+		if err != nil || value == nil {
+			return err
+		}
+		rles, err := decodeBlockRLEs(value, b, blockSize)
+		if err != nil {
+			return fmt.Errorf("Unable to unmarshal RLEs of label %d in block %v: %s", l, b, err.Error())
+		}
+		g.paint(l, rles)
+		return nil
+	}
+	for _, b := range blocks {
+		labels, err := d.blockLabels(ctx, bigdata, b, g)
+		if err != nil {
+			return err
+		}
+		for l := range labels {
+			if l == label {
+				continue
+			}
+			if err := paintLabel(l, b); err != nil {
+				return err
+			}
+		}
+		// The label's own sparse volume is always used, since label blocks are relabeled
+		// after the sparse volumes of a merge are written.
+		if err := paintLabel(label, b); err != nil {
+			return err
+		}
+	}
+
+	neighbors := []int{1, -1, int(g.size[0]), -int(g.size[0]), int(g.size[0] * g.size[1]), -int(g.size[0] * g.size[1])}
+	for z := int32(1); z <= blockSize[2]; z++ {
+		for y := int32(1); y <= blockSize[1]; y++ {
+			i := int((z*g.size[1] + y) * g.size[0])
+			for x := int32(1); x <= blockSize[0]; x++ {
+				if g.labels[i+int(x)] != label {
+					continue
+				}
+				for _, offset := range neighbors {
+					if neighbor := g.labels[i+int(x)+offset]; neighbor != label && neighbor != 0 {
+						contacts[neighbor]++
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// computeAdjacency returns the labels touching the label with their contacts, ordered by
+// decreasing contact.
+func (d *Data) computeAdjacency(ctx *datastore.VersionedContext, label uint64) ([]LabelContact, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	bigdata, err := storage.BigDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles big data: %s\n", err.Error())
+	}
+	var blocks []dvid.IndexZYX
+	err = ForEachBlock(ctx, label, &BlockOptions{KeysOnly: true}, func(block dvid.IndexZYX, _ dvid.RLEs) error {
+		blocks = append(blocks, block)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	contacts := make(map[uint64]uint64)
+	for _, block := range blocks {
+		if err := d.blockContacts(ctx, smalldata, bigdata, label, block, contacts); err != nil {
+			return nil, err
+		}
+	}
+	adjacency := make([]LabelContact, 0, len(contacts))
+	for neighbor, contact := range contacts {
+		adjacency = append(adjacency, LabelContact{neighbor, contact})
+	}
+	sort.Sort(byContact(adjacency))
+	return adjacency, nil
+}
+
+// GetAdjacency returns the labels touching the label with at least minContact
+// face-adjacent voxel pairs, ordered by decreasing contact.  Results are cached by version
+// and label until a merge or voxel write that could change them.
+func (d *Data) GetAdjacency(ctx *datastore.VersionedContext, label uint64, minContact uint64) ([]LabelContact, error) {
+	key := adjacencyKey{ctx.VersionID(), label}
+	adjacencyMu.Lock()
+	adjacency, found := d.adjacency[key]
+	generation := d.adjacencyGen
+	adjacencyMu.Unlock()
+
+	if !found {
+		var err error
+		if adjacency, err = d.computeAdjacency(ctx, label); err != nil {
+			return nil, err
+		}
+		// Results computed while a merge or write is updating labels in the background or
+		// across an invalidation may be stale, so they aren't kept.
+		adjacencyMu.Lock()
+		if generation == d.adjacencyGen && !d.mergesFinishing() {
+			if d.adjacency == nil {
+				d.adjacency = make(map[adjacencyKey][]LabelContact)
+			}
+			d.adjacency[key] = adjacency
+		}
+		adjacencyMu.Unlock()
+	}
+
+	filtered := []LabelContact{}
+	for _, contact := range adjacency {
+		if contact.ContactVoxels >= minContact {
+			filtered = append(filtered, contact)
+		}
+	}
+	return filtered, nil
+}
+
+// invalidateAdjacency drops the cached adjacency at the version of any of the labels or
+// their neighbors.  If labels is nil, all cached adjacency at the version is dropped.
+func (d *Data) invalidateAdjacency(version dvid.VersionID, labels map[uint64]bool) {
+	adjacencyMu.Lock()
+	defer adjacencyMu.Unlock()
+	d.adjacencyGen++
+	for key, adjacency := range d.adjacency {
+		if key.version != version {
+			continue
+		}
+		drop := labels == nil || labels[key.label]
+		for _, contact := range adjacency {
+			if drop {
+				break
+			}
+			drop = labels[contact.Label]
+		}
+		if drop {
+			delete(d.adjacency, key)
+		}
+	}
+}
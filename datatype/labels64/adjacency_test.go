@@ -0,0 +1,98 @@
+package labels64
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestAdjacency(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 330, "adjlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	defer d.waitFinishing()
+	serve := func(method, endpoint string, payload []byte) *httptest.ResponseRecorder {
+		apiStr := fmt.Sprintf("%snode/%s/adjlabels/%s", server.WebAPIPath, uuid, endpoint)
+		r, _ := http.NewRequest(method, apiStr, bytes.NewBuffer(payload))
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+		return w
+	}
+
+	// Label 1 spans several blocks and touches label 2 along x and label 3 along y.
+	// Label 4 doesn't touch label 1.
+	volume := newTestVolume(64, 64, 64)
+	volume.add(testBody{label: 1, offset: dvid.Point3d{20, 20, 20}, size: dvid.Point3d{20, 20, 20}}, 0)
+	volume.add(testBody{label: 2, offset: dvid.Point3d{40, 20, 20}, size: dvid.Point3d{10, 20, 20}}, 0)
+	volume.add(testBody{label: 3, offset: dvid.Point3d{20, 40, 20}, size: dvid.Point3d{20, 5, 10}}, 0)
+	volume.add(testBody{label: 4, offset: dvid.Point3d{45, 45, 45}, size: dvid.Point3d{5, 5, 5}}, 0)
+	if w := serve("POST", "raw/0_1_2/64_64_64/0_0_0", volume.data); w.Code != http.StatusOK {
+		t.Fatalf("Unable to post label volume: %d %s\n", w.Code, w.Body.String())
+	}
+
+	getAdjacency := func(endpoint string) []LabelContact {
+		w := serve("GET", endpoint, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Bad response for %s: %d %s\n", endpoint, w.Code, w.Body.String())
+		}
+		var adjacency []LabelContact
+		if err := json.Unmarshal(w.Body.Bytes(), &adjacency); err != nil {
+			t.Fatalf("Bad adjacency response %q: %s\n", w.Body.String(), err.Error())
+		}
+		return adjacency
+	}
+	// Wait until the sparse volumes are written in the background.
+	waitAdjacency := func(endpoint string, expected []LabelContact) {
+		var adjacency []LabelContact
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+			if adjacency = getAdjacency(endpoint); reflect.DeepEqual(adjacency, expected) {
+				return
+			}
+		}
+		t.Errorf("Expected adjacency %v for %s, got %v\n", expected, endpoint, adjacency)
+	}
+	waitAdjacency("adjacency/1", []LabelContact{{2, 400}, {3, 200}})
+	waitAdjacency("adjacency/2", []LabelContact{{1, 400}})
+	waitAdjacency("adjacency/4", []LabelContact{})
+
+	if adjacency := getAdjacency("adjacency/1?mincontact=300"); !reflect.DeepEqual(adjacency, []LabelContact{{2, 400}}) {
+		t.Errorf("Expected only label 2 with mincontact, got %v\n", adjacency)
+	}
+	adjacencyMu.Lock()
+	_, cached := d.adjacency[adjacencyKey{versionID, 1}]
+	adjacencyMu.Unlock()
+	if !cached {
+		t.Errorf("Expected adjacency of label 1 to be cached\n")
+	}
+	if w := serve("GET", "adjacency/notalabel", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request for illegal label, got %d\n", w.Code)
+	}
+	if w := serve("GET", "adjacency/1?mincontact=-1", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request for illegal mincontact, got %d\n", w.Code)
+	}
+
+	// Merging a neighbor invalidates the cached adjacency.
+	if w := serve("POST", "merge", []byte("[[2, 3]]")); w.Code != http.StatusOK {
+		t.Fatalf("Bad merge response: %d %s\n", w.Code, w.Body.String())
+	}
+	waitAdjacency("adjacency/1", []LabelContact{{2, 600}})
+	waitAdjacency("adjacency/2", []LabelContact{{1, 600}})
+}
@@ -0,0 +1,171 @@
+/*
+	This file supports body annotations, e.g., names and statuses, stored as JSON objects
+	keyed by label in an associated keyvalue instance.  Annotations follow labels through
+	merges so they don't dangle on labels that no longer exist.
+*/
+
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/keyvalue"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// AnnotationMergedFrom is the annotation field that lists the annotations of labels merged
+// into a label.
+const AnnotationMergedFrom = "merged-from"
+
+// Annotation is a JSON object describing a label.  Values are kept as given.
+type Annotation map[string]json.RawMessage
+
+// MergedAnnotation is the annotation of a label merged into another label.
+type MergedAnnotation struct {
+	Label      uint64     `json:"label"`
+	Annotation Annotation `json:"annotation"`
+}
+
+// annotationStore returns the keyvalue instance holding annotations or nil if the data
+// has no associated annotations.
+func (d *Data) annotationStore(versionID dvid.VersionID) (*keyvalue.Data, error) {
+	if d.Annotations == "" {
+		return nil, nil
+	}
+	dataservice, err := datastore.GetData(versionID, d.Annotations)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get annotations %q for %q: %s", d.Annotations, d.DataName(), err.Error())
+	}
+	kv, ok := dataservice.(*keyvalue.Data)
+	if !ok {
+		return nil, fmt.Errorf("Annotations %q for %q is not a keyvalue instance", d.Annotations, d.DataName())
+	}
+	return kv, nil
+}
+
+// GetAnnotation returns the annotation of a label or nil if there is none.
+func (d *Data) GetAnnotation(versionID dvid.VersionID, label uint64) (Annotation, error) {
+	kv, err := d.annotationStore(versionID)
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, server.NewError(server.NotFoundError, "Data %q has no Annotations setting", d.DataName())
+	}
+	return getAnnotation(kv, datastore.NewVersionedContext(kv, versionID), label)
+}
+
+// PutAnnotation stores the annotation of a label.
+func (d *Data) PutAnnotation(versionID dvid.VersionID, label uint64, annotation Annotation) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	kv, err := d.annotationStore(versionID)
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return server.NewError(server.NotFoundError, "Data %q has no Annotations setting", d.DataName())
+	}
+	return putAnnotation(kv, datastore.NewVersionedContext(kv, versionID), label, annotation)
+}
+
+func getAnnotation(kv *keyvalue.Data, ctx *datastore.VersionedContext, label uint64) (Annotation, error) {
+	data, found, err := kv.GetData(ctx, strconv.FormatUint(label, 10))
+	if err != nil || !found {
+		return nil, err
+	}
+	var annotation Annotation
+	if err := json.Unmarshal(data, &annotation); err != nil {
+		return nil, fmt.Errorf("Annotation of label %d is not a JSON object: %s", label, err.Error())
+	}
+	return annotation, nil
+}
+
+func putAnnotation(kv *keyvalue.Data, ctx *datastore.VersionedContext, label uint64, annotation Annotation) error {
+	data, err := json.Marshal(annotation)
+	if err != nil {
+		return err
+	}
+	return kv.PutData(ctx, strconv.FormatUint(label, 10), data)
+}
+
+// mergeAnnotation adds the annotation of a merged label to the target label's annotation.
+// Fields of the target are kept, fields only in the merged annotation are copied, and the
+// merged annotation is appended to the target's AnnotationMergedFrom list.  Since a label
+// already in the list isn't added again, merging the same annotation twice changes nothing.
+func mergeAnnotation(target Annotation, label uint64, merged Annotation) (Annotation, error) {
+	var mergedFrom []MergedAnnotation
+	if data, found := target[AnnotationMergedFrom]; found {
+		if err := json.Unmarshal(data, &mergedFrom); err != nil {
+			return nil, fmt.Errorf("Bad %q field in annotation: %s", AnnotationMergedFrom, err.Error())
+		}
+	}
+	for _, prev := range mergedFrom {
+		if prev.Label == label {
+			return target, nil
+		}
+	}
+	if target == nil {
+		target = Annotation{}
+	}
+	for field, value := range merged {
+		if _, found := target[field]; !found && field != AnnotationMergedFrom {
+			target[field] = value
+		}
+	}
+	mergedFrom = append(mergedFrom, MergedAnnotation{label, merged})
+	data, err := json.Marshal(mergedFrom)
+	if err != nil {
+		return nil, err
+	}
+	target[AnnotationMergedFrom] = data
+	return target, nil
+}
+
+// mergeAnnotations moves the annotations of merged labels onto their targets, storing each
+// target's annotation before deleting the annotations of the labels merged into it.
+func (d *Data) mergeAnnotations(versionID dvid.VersionID, tuples MergeTuples) error {
+	kv, err := d.annotationStore(versionID)
+	if err != nil || kv == nil {
+		return err
+	}
+	ctx := datastore.NewVersionedContext(kv, versionID)
+	for _, tuple := range tuples {
+		toLabel := tuple[0]
+		target, err := getAnnotation(kv, ctx, toLabel)
+		if err != nil {
+			return err
+		}
+		var fromLabels []uint64
+		for _, fromLabel := range tuple[1:] {
+			merged, err := getAnnotation(kv, ctx, fromLabel)
+			if err != nil {
+				return err
+			}
+			if merged == nil {
+				continue
+			}
+			if target, err = mergeAnnotation(target, fromLabel, merged); err != nil {
+				return fmt.Errorf("Unable to merge annotation of label %d into label %d: %s", fromLabel, toLabel, err.Error())
+			}
+			fromLabels = append(fromLabels, fromLabel)
+		}
+		if len(fromLabels) == 0 {
+			continue
+		}
+		if err := putAnnotation(kv, ctx, toLabel, target); err != nil {
+			return err
+		}
+		for _, fromLabel := range fromLabels {
+			if err := kv.DeleteData(ctx, strconv.FormatUint(fromLabel, 10)); err != nil {
+				return fmt.Errorf("Unable to delete annotation of merged label %d: %s", fromLabel, err.Error())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,474 @@
+/*
+	This file supports backfilling the label RLEs of a labels64 instance from the label
+	blocks of a source labels64 instance, e.g., itself after denormalization was broken for
+	a while, without re-ingesting the segmentation.  Blocks are scanned in index order and
+	written in batches along with a cursor, so an interrupted backfill resumes after the
+	last written batch.
+*/
+
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+const (
+	BackfillRunning = "running"
+	BackfillDone    = "done"
+	BackfillFailed  = "failed"
+)
+
+// backfillBatchBlocks is the number of blocks written in each batch along with the cursor.
+var backfillBatchBlocks = 64
+
+// backfillFailpoint, if non-nil, is called after each batch of a backfill is written and
+// can return an error to simulate a crash after that many blocks.
+var backfillFailpoint func(blocks uint64) error
+
+// backfillMu guards the backfill status of all data instances.
+var backfillMu sync.Mutex
+
+// BackfillOptions modify a backfill.  If ROI is given, only blocks whose centers are within
+// the roi instance are written.  Rate is the maximum number of blocks scanned per second,
+// or 0 for no limit.
+type BackfillOptions struct {
+	ROI  dvid.DataString
+	Rate float64
+}
+
+// LabelCount is the number of voxels of a label.
+type LabelCount struct {
+	Label  uint64
+	Voxels uint64
+}
+
+// BackfillStatus reports the progress of a backfill.  Counts include those of earlier
+// interrupted runs that were resumed.  Labels gives the backfilled voxels of each label
+// once the backfill is done.
+type BackfillStatus struct {
+	Source    dvid.DataString
+	ROI       dvid.DataString `json:",omitempty"`
+	UUID      dvid.UUID
+	State     string
+	Resumed   bool
+	Blocks    uint64 // source blocks scanned
+	Written   uint64 // blocks whose RLEs were replaced
+	NumLabels int
+	Voxels    uint64
+	Started   time.Time
+	Finished  time.Time
+	Error     string       `json:",omitempty"`
+	Labels    []LabelCount `json:",omitempty"`
+}
+
+// backfillCursor is the stored progress of a backfill.  Cleared holds labels whose RLEs were
+// removed from written blocks, so their sizes are updated when the backfill is done.
+type backfillCursor struct {
+	Source  dvid.DataString
+	ROI     dvid.DataString
+	Block   dvid.IndexZYX // last written block
+	Blocks  uint64
+	Written uint64
+	Counts  []LabelCount
+	Cleared []uint64
+}
+
+// backfillState is the progress of a backfill held in memory.
+type backfillState struct {
+	cursor  backfillCursor
+	counts  map[uint64]uint64
+	cleared map[uint64]bool
+}
+
+func newBackfillState(cursor backfillCursor) *backfillState {
+	state := &backfillState{cursor: cursor, counts: make(map[uint64]uint64), cleared: make(map[uint64]bool)}
+	for _, count := range cursor.Counts {
+		state.counts[count.Label] = count.Voxels
+	}
+	for _, label := range cursor.Cleared {
+		state.cleared[label] = true
+	}
+	return state
+}
+
+// labelCounts returns the voxel counts sorted by label.
+func (state *backfillState) labelCounts() []LabelCount {
+	counts := make([]LabelCount, 0, len(state.counts))
+	for label, voxels := range state.counts {
+		counts = append(counts, LabelCount{label, voxels})
+	}
+	sort.Sort(byLabel(counts))
+	return counts
+}
+
+// marshalCursor returns the serialized cursor with the current counts.
+func (state *backfillState) marshalCursor() ([]byte, error) {
+	state.cursor.Counts = state.labelCounts()
+	state.cursor.Cleared = state.cursor.Cleared[:0]
+	for label := range state.cleared {
+		state.cursor.Cleared = append(state.cursor.Cleared, label)
+	}
+	sort.Sort(labelSlice(state.cursor.Cleared))
+	return json.Marshal(state.cursor)
+}
+
+type byLabel []LabelCount
+
+func (c byLabel) Len() int           { return len(c) }
+func (c byLabel) Less(i, j int) bool { return c[i].Label < c[j].Label }
+func (c byLabel) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// getBackfillCursor returns the stored cursor of an unfinished backfill at the context's
+// version or nil if there is none.
+func getBackfillCursor(ctx *datastore.VersionedContext) (*backfillCursor, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	value, err := smalldata.Get(ctx, voxels.NewLabelBackfillIndex())
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var cursor backfillCursor
+	if err := json.Unmarshal(value, &cursor); err != nil {
+		return nil, fmt.Errorf("Bad backfill cursor: %s", err.Error())
+	}
+	return &cursor, nil
+}
+
+// BackfillStatus returns the status of the last backfill since the server started, or nil
+// if there was none.
+func (d *Data) BackfillStatus() *BackfillStatus {
+	backfillMu.Lock()
+	defer backfillMu.Unlock()
+	if d.backfill == nil {
+		return nil
+	}
+	status := *d.backfill
+	return &status
+}
+
+// backfillRunning returns true if a backfill of the data is in progress.
+func (d *Data) backfillRunning() bool {
+	backfillMu.Lock()
+	defer backfillMu.Unlock()
+	return d.backfill != nil && d.backfill.State == BackfillRunning
+}
+
+// updateBackfill applies a change to the backfill status.
+func (d *Data) updateBackfill(f func(status *BackfillStatus)) {
+	backfillMu.Lock()
+	f(d.backfill)
+	backfillMu.Unlock()
+}
+
+// Backfill replaces the label RLEs of the data at the context's version with those
+// computed from the label blocks of the source at the same version, and updates the sizes
+// and surfaces of the affected labels.  An unfinished backfill from the same source and
+// ROI is resumed after its last written block.
+func (d *Data) Backfill(ctx *datastore.VersionedContext, source *Data, opts BackfillOptions) (*BackfillStatus, error) {
+	state, err := d.startBackfill(ctx, source, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = d.runBackfill(ctx, source, opts, state)
+	return d.BackfillStatus(), err
+}
+
+// startBackfill checks that a backfill can run and marks it running, returning its
+// progress so far.  Backfills are refused while merges are in flight.
+func (d *Data) startBackfill(ctx *datastore.VersionedContext, source *Data, opts BackfillOptions) (*backfillState, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	sourceSize, ok1 := source.BlockSize().(dvid.Point3d)
+	blockSize, ok2 := d.BlockSize().(dvid.Point3d)
+	if !ok1 || !ok2 || !sourceSize.Equals(blockSize) {
+		return nil, fmt.Errorf("Source %q has block size %s, incompatible with data %q block size %s",
+			source.DataName(), source.BlockSize(), d.DataName(), d.BlockSize())
+	}
+	if opts.Rate < 0 {
+		return nil, fmt.Errorf("Backfill rate %g can't be negative", opts.Rate)
+	}
+	if d.mergesFinishing() || len(d.pendingIntents()) != 0 || d.limiter(MutationClass).utilization().Active != 0 {
+		return nil, server.NewError(server.ConflictError, "Can't backfill data %q while merges are in flight", d.DataName())
+	}
+	uuid, err := datastore.UUIDFromVersion(ctx.VersionID())
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := getBackfillCursor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resumed := cursor != nil && cursor.Source == source.DataName() && cursor.ROI == opts.ROI
+	if !resumed {
+		if cursor != nil {
+			dvid.Infof("Discarding unfinished backfill of %q from %q for new backfill from %q\n",
+				d.DataName(), cursor.Source, source.DataName())
+		}
+		cursor = &backfillCursor{Source: source.DataName(), ROI: opts.ROI}
+	}
+
+	backfillMu.Lock()
+	defer backfillMu.Unlock()
+	if d.backfill != nil && d.backfill.State == BackfillRunning {
+		return nil, server.NewError(server.ConflictError, "Backfill of data %q from %q is already running",
+			d.DataName(), d.backfill.Source)
+	}
+	state := newBackfillState(*cursor)
+	d.backfill = &BackfillStatus{
+		Source:    source.DataName(),
+		ROI:       opts.ROI,
+		UUID:      uuid,
+		State:     BackfillRunning,
+		Resumed:   resumed,
+		Blocks:    cursor.Blocks,
+		Written:   cursor.Written,
+		NumLabels: len(state.counts),
+		Started:   time.Now(),
+	}
+	for _, count := range cursor.Counts {
+		d.backfill.Voxels += count.Voxels
+	}
+	return state, nil
+}
+
+// runBackfill scans the source blocks after the cursor, writes their RLEs, and then
+// updates the affected labels.  The status is set to done or failed on return.
+func (d *Data) runBackfill(ctx *datastore.VersionedContext, source *Data, opts BackfillOptions, state *backfillState) (err error) {
+	defer func() {
+		d.updateBackfill(func(status *BackfillStatus) {
+			status.Finished = time.Now()
+			if err != nil {
+				status.State = BackfillFailed
+				status.Error = err.Error()
+				return
+			}
+			status.State = BackfillDone
+			status.Labels = state.labelCounts()
+		})
+		if err != nil {
+			dvid.Errorf("Backfill of %q from %q failed: %s\n", d.DataName(), source.DataName(), err.Error())
+		}
+	}()
+	if err = d.scanBackfill(ctx, source, opts, state); err != nil {
+		return err
+	}
+	if err = d.finishBackfill(ctx, state); err != nil {
+		return err
+	}
+	dvid.Infof("Backfilled %d blocks of %q from %q\n", state.cursor.Written, d.DataName(), source.DataName())
+	return nil
+}
+
+// scanBackfill writes the RLEs of source blocks after the cursor in batches, each stored
+// with the updated cursor.
+func (d *Data) scanBackfill(ctx *datastore.VersionedContext, source *Data, opts BackfillOptions, state *backfillState) error {
+	bigdata, err := storage.BigDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles big data: %s\n", err.Error())
+	}
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	smallBatcher, ok := smalldata.(storage.KeyValueBatcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in Backfill()")
+	}
+	var region *roiSpans
+	if opts.ROI != "" {
+		if region, err = loadROISpans(ctx.VersionID(), opts.ROI); err != nil {
+			return err
+		}
+	}
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	if !ok {
+		return fmt.Errorf("Can't backfill data %q with non-3d block size %s", d.DataName(), d.BlockSize())
+	}
+
+	begBlock := dvid.MinIndexZYX
+	if state.cursor.Blocks != 0 {
+		begBlock = state.cursor.Block
+		begBlock[0]++
+	}
+	begIndex := voxels.NewVoxelBlockIndex(&begBlock)
+	endIndex := voxels.NewVoxelBlockIndex(&dvid.MaxIndexZYX)
+
+	var batch storage.Batch
+	var batchBlocks int
+	var scanned uint64
+	start := time.Now()
+	commit := func() error {
+		if batch == nil {
+			return nil
+		}
+		serialization, err := state.marshalCursor()
+		if err != nil {
+			return err
+		}
+		batch.Put(voxels.NewLabelBackfillIndex(), serialization)
+		rleMu.RLock()
+		err = batch.Commit()
+		rleMu.RUnlock()
+		batch, batchBlocks = nil, 0
+		if err != nil {
+			return fmt.Errorf("Unable to write backfill batch: %s", err.Error())
+		}
+		d.invalidateAdjacency(ctx.VersionID(), nil)
+		d.invalidateCompartments(ctx.VersionID(), nil)
+		var numVoxels uint64
+		for _, voxels := range state.counts {
+			numVoxels += voxels
+		}
+		d.updateBackfill(func(status *BackfillStatus) {
+			status.Blocks, status.Written = state.cursor.Blocks, state.cursor.Written
+			status.NumLabels, status.Voxels = len(state.counts), numVoxels
+		})
+		if backfillFailpoint != nil {
+			return backfillFailpoint(state.cursor.Blocks)
+		}
+		return nil
+	}
+
+	sourceCtx := datastore.NewVersionedContext(source, ctx.VersionID())
+	err = bigdata.ProcessRange(sourceCtx, begIndex, endIndex, &storage.ChunkOp{}, func(chunk *storage.Chunk) error {
+		server.BlockOnInteractiveRequests("labels64 [backfill]")
+		if opts.Rate > 0 {
+			due := start.Add(time.Duration(float64(scanned) / opts.Rate * float64(time.Second)))
+			if wait := due.Sub(time.Now()); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		scanned++
+
+		zyx, err := voxels.DecodeVoxelBlockKey(chunk.K)
+		if err != nil {
+			return err
+		}
+		state.cursor.Block = *zyx
+		state.cursor.Blocks++
+		if batch == nil {
+			batch = smallBatcher.NewBatch(ctx)
+		}
+		batchBlocks++
+		if region == nil || region.containsBlock(*zyx, blockSize) {
+			if err := d.backfillBlock(ctx, bigdata, batch, source, zyx, chunk.V, state); err != nil {
+				return err
+			}
+			state.cursor.Written++
+		}
+		if batchBlocks >= backfillBatchBlocks {
+			return commit()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return commit()
+}
+
+// backfillBlock adds to a batch the RLEs of each label in a source block, replacing the
+// RLEs of labels in the data's own block at the same index.
+func (d *Data) backfillBlock(ctx *datastore.VersionedContext, bigdata storage.KeyValueGetter, batch storage.Batch,
+	source *Data, zyx *dvid.IndexZYX, serialization []byte, state *backfillState) error {
+
+	blockData, _, err := dvid.DeserializeData(serialization, true)
+	if err != nil {
+		return fmt.Errorf("Unable to deserialize block %s of %q: %s", zyx, source.DataName(), err.Error())
+	}
+	labelRLEs, err := source.blockLabelRLEs(zyx, blockData)
+	if err != nil {
+		return err
+	}
+	blockBytes := zyx.Bytes()
+
+	// Labels of the data's own block that aren't in the source block lose their RLEs.
+	if source != d {
+		stored, err := bigdata.Get(ctx, voxels.NewVoxelBlockIndex(zyx))
+		if err != nil {
+			return err
+		}
+		if stored != nil {
+			removed := make(map[uint64]bool)
+			if blockData, _, err = dvid.DeserializeData(stored, true); err != nil {
+				return fmt.Errorf("Unable to deserialize block %s of %q: %s", zyx, d.DataName(), err.Error())
+			}
+			for i := 0; i+8 <= len(blockData); i += 8 {
+				label := d.Properties.ByteOrder.Uint64(blockData[i : i+8])
+				if _, found := labelRLEs[label]; !found && label != 0 && !removed[label] {
+					batch.Delete(voxels.NewLabelSpatialMapIndex(label, blockBytes))
+					removed[label] = true
+					state.cleared[label] = true
+				}
+			}
+		}
+	}
+
+	for label, rles := range labelRLEs {
+		runsBytes, err := encodeLabelBlock(d, blockBytes, rles)
+		if err != nil {
+			return err
+		}
+		batch.Put(voxels.NewLabelSpatialMapIndex(label, blockBytes), runsBytes)
+		numVoxels, _ := rles.Stats()
+		state.counts[label] += uint64(numVoxels)
+	}
+	return nil
+}
+
+// finishBackfill updates the sizes, surfaces, and last mutations of the backfilled and
+// cleared labels, then deletes the cursor.
+func (d *Data) finishBackfill(ctx *datastore.VersionedContext, state *backfillState) error {
+	labels := make(map[uint64]bool, len(state.counts)+len(state.cleared))
+	for label := range state.counts {
+		labels[label] = true
+	}
+	for label := range state.cleared {
+		labels[label] = true
+	}
+	oldSizes, err := getAllLabelSizes(ctx)
+	if err != nil {
+		return err
+	}
+	sizeMods := make(map[uint64]sizeChange)
+	m := labelMutation{newIntentID(), time.Now()}
+	for label := range labels {
+		rles, err := getLabelRLEs(ctx, label)
+		if err != nil {
+			return err
+		}
+		if newSize := rles.numVoxels(); newSize != oldSizes[label] {
+			sizeMods[label] = sizeChange{oldSizes[label], newSize}
+		}
+		if len(rles) != 0 {
+			d.recomputeSurface(ctx, label, rles)
+		}
+		if err := putLastMutation(ctx, label, m); err != nil {
+			return err
+		}
+	}
+	if len(sizeMods) != 0 {
+		updateLabelSizes(ctx, sizeMods, "backfill")
+	}
+	d.invalidateAdjacency(ctx.VersionID(), nil)
+	d.invalidateCompartments(ctx.VersionID(), nil)
+
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	return smalldata.Delete(ctx, voxels.NewLabelBackfillIndex())
+}
@@ -0,0 +1,198 @@
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/roi"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+// putLabelBlock stores a block of labels given by a function of the voxel offset within the
+// block without computing RLEs.
+func putLabelBlock(t *testing.T, ctx *datastore.VersionedContext, d *Data, block dvid.IndexZYX, label func(x, y, z int32) uint64) {
+	blockSize := d.BlockSize().(dvid.Point3d)
+	data := make([]byte, blockSize.Prod()*8)
+	var i int
+	for z := int32(0); z < blockSize[2]; z++ {
+		for y := int32(0); y < blockSize[1]; y++ {
+			for x := int32(0); x < blockSize[0]; x++ {
+				d.Properties.ByteOrder.PutUint64(data[i:i+8], label(x, y, z))
+				i += 8
+			}
+		}
+	}
+	serialization, err := dvid.SerializeData(data, d.Compression(), d.Checksum())
+	if err != nil {
+		t.Fatalf("Unable to serialize block: %s\n", err.Error())
+	}
+	bigdata, err := storage.BigDataStore()
+	if err != nil {
+		t.Fatalf("Unable to get big data store: %s\n", err.Error())
+	}
+	if err := bigdata.Put(ctx, voxels.NewVoxelBlockIndex(&block), serialization); err != nil {
+		t.Fatalf("Unable to put block %s: %s\n", &block, err.Error())
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	newLabels := func(id dvid.InstanceID, name string) (*Data, *datastore.VersionedContext) {
+		d, err := NewData(uuid, id, dvid.DataString(name), dvid.NewConfig())
+		if err != nil {
+			t.Fatalf("Unable to create labels64 %q: %s\n", name, err.Error())
+		}
+		return d, datastore.NewVersionedContext(d, versionID)
+	}
+	source, sourceCtx := newLabels(410, "backfillsource")
+	target, ctx := newLabels(411, "backfilltarget")
+
+	// Label 1 fills the lower half of blocks 0-3 along x, and label 2 fills the upper half
+	// of blocks 2-3.  Label 3 only fills the first row of block 1.
+	for x := int32(0); x < 4; x++ {
+		x := x
+		putLabelBlock(t, sourceCtx, source, dvid.IndexZYX{x, 0, 0}, func(_, y, z int32) uint64 {
+			switch {
+			case x == 1 && y == 0 && z == 0:
+				return 3
+			case y < 16:
+				return 1
+			case x >= 2:
+				return 2
+			}
+			return 0
+		})
+	}
+	expected := map[uint64]uint64{1: 4*16*32*32 - 32, 2: 2 * 16 * 32 * 32, 3: 32}
+
+	// The target has a stale label 9 in its own block 3 with RLEs that should be replaced.
+	stale := dvid.IndexZYX{3, 0, 0}
+	putLabelBlock(t, ctx, target, stale, func(x, y, z int32) uint64 { return 9 })
+	putSyntheticRLEs(t, ctx, 9, blockRLEs{string(stale.Bytes()): {dvid.NewRLE(dvid.Point3d{96, 0, 0}, 32)}})
+
+	// Backfills are refused while merges are in flight.
+	target.setFinishing(1, true)
+	if _, err := target.Backfill(ctx, source, BackfillOptions{}); err == nil || server.ErrorKindOf(err) != server.ConflictError {
+		t.Errorf("Expected conflict backfilling while a merge finishes, got %v\n", err)
+	}
+	target.setFinishing(1, false)
+
+	// Interrupt the backfill after the second block, then resume it.
+	defer func(batch int) {
+		backfillBatchBlocks = batch
+		backfillFailpoint = nil
+	}(backfillBatchBlocks)
+	backfillBatchBlocks = 1
+	backfillFailpoint = func(blocks uint64) error {
+		if blocks == 2 {
+			return fmt.Errorf("simulated crash")
+		}
+		return nil
+	}
+	status, err := target.Backfill(ctx, source, BackfillOptions{})
+	if err == nil || status.State != BackfillFailed || status.Blocks != 2 {
+		t.Fatalf("Expected backfill to fail after 2 blocks, got %+v, %v\n", status, err)
+	}
+	cursor, err := getBackfillCursor(ctx)
+	if err != nil || cursor == nil || cursor.Block != (dvid.IndexZYX{1, 0, 0}) {
+		t.Fatalf("Expected cursor after block 1, got %+v, %v\n", cursor, err)
+	}
+	backfillFailpoint = nil
+	status, err = target.Backfill(ctx, source, BackfillOptions{})
+	if err != nil {
+		t.Fatalf("Unable to resume backfill: %s\n", err.Error())
+	}
+	if !status.Resumed || status.State != BackfillDone || status.Blocks != 4 || status.Written != 4 || len(status.Labels) != 3 {
+		t.Errorf("Unexpected status of resumed backfill: %+v\n", status)
+	}
+	for _, count := range status.Labels {
+		if count.Voxels != expected[count.Label] {
+			t.Errorf("Expected %d voxels of label %d, got %d\n", expected[count.Label], count.Label, count.Voxels)
+		}
+	}
+	if cursor, err := getBackfillCursor(ctx); err != nil || cursor != nil {
+		t.Errorf("Expected cursor to be deleted after backfill, got %+v, %v\n", cursor, err)
+	}
+	sizes, err := getAllLabelSizes(ctx)
+	if err != nil {
+		t.Fatalf("Unable to get label sizes: %s\n", err.Error())
+	}
+	for label, size := range expected {
+		if numVoxels, _, _, err := CountLabel(ctx, label); err != nil || numVoxels != size || sizes[label] != size {
+			t.Errorf("Expected %d voxels of label %d, got %d with size %d, %v\n", size, label, numVoxels, sizes[label], err)
+		}
+	}
+	if rles, err := getLabelRLEs(ctx, 9); err != nil || len(rles) != 0 || sizes[9] != 0 {
+		t.Errorf("Expected stale label 9 to be replaced, got %d blocks of size %d, %v\n", len(rles), sizes[9], err)
+	}
+
+	// Backfills can be restricted to an ROI and run in the background with their status
+	// given by the backfill endpoint.
+	roiT, err := datastore.TypeServiceByName("roi")
+	if err != nil {
+		t.Fatalf("Can't get roi type: %s\n", err.Error())
+	}
+	dataservice, err := repo.NewData(roiT, "backfillroi", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create roi: %s\n", err.Error())
+	}
+	if err := dataservice.(*roi.Data).PutSpans(versionID, []dvid.Span{{0, 0, 2, 2}}, true); err != nil {
+		t.Fatalf("Unable to put roi: %s\n", err.Error())
+	}
+	partial, partialCtx := newLabels(412, "backfillpartial")
+	opts := BackfillOptions{ROI: "backfillroi", Rate: 1000}
+	state, err := partial.startBackfill(partialCtx, source, opts)
+	if err != nil {
+		t.Fatalf("Unable to start ROI backfill: %s\n", err.Error())
+	}
+	go partial.runBackfill(partialCtx, source, opts, state)
+	serverCtx := datastore.NewServerContext(context.Background(), repo, versionID)
+	var endpointStatus BackfillStatus
+	for i := 0; i < 200; i++ {
+		r, _ := http.NewRequest("GET", fmt.Sprintf("/api/node/%s/backfillpartial/backfill", uuid), nil)
+		w := httptest.NewRecorder()
+		partial.ServeHTTP(serverCtx, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected backfill status, got %d: %s\n", w.Code, w.Body.String())
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &endpointStatus); err != nil {
+			t.Fatalf("Bad backfill status: %s\n", err.Error())
+		}
+		if endpointStatus.State != BackfillRunning {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if endpointStatus.State != BackfillDone || endpointStatus.Blocks != 4 || endpointStatus.Written != 1 ||
+		endpointStatus.ROI != "backfillroi" || endpointStatus.Voxels != 32*32*32 {
+		t.Errorf("Unexpected status of ROI backfill: %+v\n", endpointStatus)
+	}
+	for label, numBlocks := range map[uint64]uint64{1: 1, 2: 1, 3: 0} {
+		if _, _, n, err := CountLabel(partialCtx, label); err != nil || n != numBlocks {
+			t.Errorf("Expected %d blocks of label %d within ROI, got %d, %v\n", numBlocks, label, n, err)
+		}
+	}
+
+	// Data that was never backfilled has no status.
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/api/node/%s/backfillsource/backfill", uuid), nil)
+	w := httptest.NewRecorder()
+	source.ServeHTTP(serverCtx, w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for status of data without backfill, got %d\n", w.Code)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+	This file implements the "blocks-cseg" endpoint, which returns blocks of a label in the
+	compressed segmentation format of Neuroglancer so clients needn't rasterize RLEs.
+*/
+
+package labels64
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/janelia-flyem/dvid/datatype/common/cseg"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// MaxCsegBlocks is the largest number of blocks in a ranged "blocks-cseg" request.
+const MaxCsegBlocks = 4096
+
+// csegBlockRange returns the blocks from a minimum to a maximum block coordinate, inclusive,
+// in block order, i.e., with x varying fastest and z slowest.
+func csegBlockRange(minBlock, maxBlock dvid.ChunkPoint3d) ([]dvid.IndexZYX, error) {
+	numBlocks := int64(1)
+	for dim := 0; dim < 3; dim++ {
+		if maxBlock[dim] < minBlock[dim] {
+			return nil, fmt.Errorf("Block range %s to %s is empty", minBlock, maxBlock)
+		}
+		numBlocks *= int64(maxBlock[dim]) - int64(minBlock[dim]) + 1
+	}
+	if numBlocks > MaxCsegBlocks {
+		return nil, fmt.Errorf("Block range %s to %s has %d blocks, more than the maximum of %d",
+			minBlock, maxBlock, numBlocks, MaxCsegBlocks)
+	}
+	blocks := make([]dvid.IndexZYX, 0, numBlocks)
+	for z := minBlock[2]; z <= maxBlock[2]; z++ {
+		for y := minBlock[1]; y <= maxBlock[1]; y++ {
+			for x := minBlock[0]; x <= maxBlock[0]; x++ {
+				blocks = append(blocks, dvid.IndexZYX{x, y, z})
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// WriteCsegBlocks writes a frame for each of the given blocks holding the compressed
+// segmentation encoding of the block, where voxels of the label have the label and all
+// others are 0.  Blocks without the label are encoded as all 0.  Each frame is the block
+// coordinate as three little-endian int32, the length of the encoding as a little-endian
+// uint32, and the encoding with Neuroglancer's default 8x8x8 sub-blocks.
+func (d *Data) WriteCsegBlocks(ctx storage.Context, w io.Writer, label uint64, blocks []dvid.IndexZYX) error {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	if !ok {
+		return fmt.Errorf("Data %q has no 3d block size", d.DataName())
+	}
+	size := [3]int{int(blockSize[0]), int(blockSize[1]), int(blockSize[2])}
+	var empty []byte
+	header := make([]byte, 16)
+	for _, block := range blocks {
+		value, err := smalldata.Get(ctx, voxels.NewLabelSpatialMapIndex(label, block.Bytes()))
+		if err != nil {
+			return err
+		}
+		var encoded []byte
+		if value == nil {
+			if empty == nil {
+				if empty, err = cseg.Encode(make([]uint64, size[0]*size[1]*size[2]), size, cseg.DefaultSubblockSize); err != nil {
+					return err
+				}
+			}
+			encoded = empty
+		} else {
+			rles, err := decodeBlockRLEs(value, block, blockSize)
+			if err != nil {
+				return fmt.Errorf("Unable to unmarshal RLEs of label %d in block %v: %s", label, block, err.Error())
+			}
+			offset := dvid.Point3d{block[0] * blockSize[0], block[1] * blockSize[1], block[2] * blockSize[2]}
+			if encoded, err = cseg.Encode(cseg.Rasterize(rles, label, offset, size), size, cseg.DefaultSubblockSize); err != nil {
+				return err
+			}
+		}
+		for dim := 0; dim < 3; dim++ {
+			binary.LittleEndian.PutUint32(header[dim*4:], uint32(block[dim]))
+		}
+		binary.LittleEndian.PutUint32(header[12:], uint32(len(encoded)))
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(encoded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package labels64
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/common/cseg"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestCsegBlocks(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 462, "csegblocks", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	block := dvid.IndexZYX{1, 0, 0}
+	blockStr := string(block.Bytes())
+	rles := blockRLEs{blockStr: dvid.RLEs{
+		dvid.NewRLE(dvid.Point3d{32, 0, 0}, 10),
+		dvid.NewRLE(dvid.Point3d{40, 5, 7}, 24),
+	}}
+	if err := putLabelRLEs(ctx, 3, rles, rles.blocks()); err != nil {
+		t.Fatalf("Unable to store label 3: %s\n", err.Error())
+	}
+
+	size := [3]int{32, 32, 32}
+	occupied := make([]uint64, 32*32*32)
+	for x := 0; x < 10; x++ {
+		occupied[x] = 3
+	}
+	for x := 8; x < 32; x++ {
+		occupied[x+32*(5+32*7)] = 3
+	}
+	empty := make([]uint64, 32*32*32)
+
+	get := func(endpoint string, expected int) []byte {
+		apiStr := fmt.Sprintf("%snode/%s/csegblocks/%s", server.WebAPIPath, uuid, endpoint)
+		r, _ := http.NewRequest("GET", apiStr, nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+		if w.Code != expected {
+			t.Fatalf("Expected status %d from %s, got %d: %s\n", expected, endpoint, w.Code, w.Body.String())
+		}
+		return w.Body.Bytes()
+	}
+	check := func(endpoint string, blocks []dvid.IndexZYX, volumes [][]uint64) {
+		body := get(endpoint, http.StatusOK)
+		for i, block := range blocks {
+			if len(body) < 16 {
+				t.Fatalf("Expected frame of block %v from %s, got %d bytes\n", block, endpoint, len(body))
+			}
+			var coord dvid.IndexZYX
+			for dim := 0; dim < 3; dim++ {
+				coord[dim] = int32(binary.LittleEndian.Uint32(body[dim*4:]))
+			}
+			length := int(binary.LittleEndian.Uint32(body[12:]))
+			if coord != block || len(body) < 16+length {
+				t.Fatalf("Bad frame header from %s: block %v, length %d\n", endpoint, coord, length)
+			}
+			labels, err := cseg.Decode(body[16:16+length], size, cseg.DefaultSubblockSize)
+			if err != nil {
+				t.Fatalf("Unable to decode block %v from %s: %s\n", block, endpoint, err.Error())
+			}
+			if !reflect.DeepEqual(labels, volumes[i]) {
+				t.Errorf("Bad labels in block %v from %s\n", block, endpoint)
+			}
+			body = body[16+length:]
+		}
+		if len(body) != 0 {
+			t.Errorf("Expected %d frames from %s, got %d extra bytes\n", len(blocks), endpoint, len(body))
+		}
+	}
+
+	// Blocks the label doesn't occupy are all zero.
+	check("blocks-cseg/3/1_0_0/2_0_0", []dvid.IndexZYX{{1, 0, 0}, {2, 0, 0}}, [][]uint64{occupied, empty})
+	check("blocks-cseg/3?minblock=0_0_0&maxblock=1_0_1",
+		[]dvid.IndexZYX{{0, 0, 0}, {1, 0, 0}, {0, 0, 1}, {1, 0, 1}}, [][]uint64{empty, occupied, empty, empty})
+	check("blocks-cseg/4/1_0_0", []dvid.IndexZYX{{1, 0, 0}}, [][]uint64{empty})
+
+	get("blocks-cseg/3", http.StatusBadRequest)
+	get("blocks-cseg/3/1_0_0?minblock=0_0_0&maxblock=1_0_0", http.StatusBadRequest)
+	get("blocks-cseg/3?minblock=1_0_0&maxblock=0_0_0", http.StatusBadRequest)
+	get("blocks-cseg/3?minblock=0_0_0&maxblock=100_100_100", http.StatusBadRequest)
+}
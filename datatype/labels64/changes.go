@@ -0,0 +1,294 @@
+/*
+	This file supports finding the labels that changed between a version and one of its
+	ancestors by diffing the label block RLEs of the two versions.
+*/
+
+package labels64
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Kinds of label changes between versions.
+const (
+	LabelCreated  = "created"
+	LabelDeleted  = "deleted"
+	LabelModified = "modified"
+)
+
+// LabelChange describes how a label changed between an ancestor and a descendant version.
+// The block counts are of blocks whose RLEs for the label were added, removed, or modified,
+// and Ops are the label's size records at versions after the ancestor, oldest first.
+type LabelChange struct {
+	Label          uint64       `json:"label"`
+	Change         string       `json:"change"`
+	BlocksAdded    int          `json:"blocks_added"`
+	BlocksRemoved  int          `json:"blocks_removed"`
+	BlocksModified int          `json:"blocks_modified"`
+	Ops            []SizeRecord `json:"ops"`
+}
+
+// LabelChanges lists the labels that changed at a version since an ancestor version.
+type LabelChanges struct {
+	Since  dvid.UUID     `json:"since"`
+	UUID   dvid.UUID     `json:"uuid"`
+	Labels []LabelChange `json:"labels"`
+}
+
+// blockKV is a label block RLE read from one version.
+type blockKV struct {
+	label uint64
+	block []byte
+	rles  []byte
+}
+
+// blockStream reads the label block RLEs of a version in key order without holding them
+// in memory.  The stream is closed after the last block, and any read error is sent on
+// errc.
+type blockStream struct {
+	blocks chan blockKV
+	errc   chan error
+	done   chan struct{}
+}
+
+func newBlockStream(ctx *datastore.VersionedContext, smalldata storage.SmallDataStorer, done chan struct{}) *blockStream {
+	s := &blockStream{
+		blocks: make(chan blockKV, 100),
+		errc:   make(chan error, 1),
+		done:   done,
+	}
+	begIndex := voxels.NewLabelSpatialMapIndex(0, dvid.MinIndexZYX.Bytes())
+	endIndex := voxels.NewLabelSpatialMapIndex(math.MaxUint64, dvid.MaxIndexZYX.Bytes())
+	go func() {
+		defer close(s.blocks)
+		var f storage.ChunkProcessor = func(chunk *storage.Chunk) error {
+			label, block, err := voxels.DecodeLabelSpatialMapKey(chunk.K)
+			if err != nil {
+				return fmt.Errorf("Can't recover label with chunk key %v: %s\n", chunk.K, err.Error())
+			}
+			rles, err := expandStoredRLEs(ctx, chunk.K, chunk.V)
+			if err != nil {
+				return err
+			}
+			// After an abort, keep consuming the range so the store's iterator finishes.
+			select {
+			case s.blocks <- blockKV{label, block, rles}:
+			case <-s.done:
+			}
+			return nil
+		}
+		if err := smalldata.ProcessRange(ctx, begIndex, endIndex, &storage.ChunkOp{}, f); err != nil {
+			s.errc <- err
+		}
+	}()
+	return s
+}
+
+// next returns the next block or nil after the last block.
+func (s *blockStream) next() (*blockKV, error) {
+	kv, ok := <-s.blocks
+	if !ok {
+		select {
+		case err := <-s.errc:
+			return nil, err
+		default:
+			return nil, nil
+		}
+	}
+	return &kv, nil
+}
+
+// compareBlocks orders blocks by label and then block coordinate, with nil blocks last.
+func compareBlocks(a, b *blockKV) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	case a.label < b.label:
+		return -1
+	case a.label > b.label:
+		return 1
+	default:
+		return bytes.Compare(a.block, b.block)
+	}
+}
+
+// diffLabels walks the label block RLEs of the two versions in lockstep and returns the
+// labels whose RLEs differ, in label order, without reading either version into memory.
+func (d *Data) diffLabels(sinceCtx, ctx *datastore.VersionedContext) ([]LabelChange, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	done := make(chan struct{})
+	defer close(done)
+	oldBlocks := newBlockStream(sinceCtx, smalldata, done)
+	newBlocks := newBlockStream(ctx, smalldata, done)
+
+	var changes []LabelChange
+	var cur *LabelChange
+	var inOld, inNew bool // whether the current label has any blocks in each version
+	finish := func() {
+		if cur == nil {
+			return
+		}
+		if cur.BlocksAdded+cur.BlocksRemoved+cur.BlocksModified != 0 {
+			switch {
+			case !inOld:
+				cur.Change = LabelCreated
+			case !inNew:
+				cur.Change = LabelDeleted
+			default:
+				cur.Change = LabelModified
+			}
+			changes = append(changes, *cur)
+		}
+		cur = nil
+	}
+
+	oldKV, err := oldBlocks.next()
+	if err != nil {
+		return nil, err
+	}
+	newKV, err := newBlocks.next()
+	if err != nil {
+		return nil, err
+	}
+	for oldKV != nil || newKV != nil {
+		cmp := compareBlocks(oldKV, newKV)
+		label := newKV
+		if cmp < 0 {
+			label = oldKV
+		}
+		if cur == nil || cur.Label != label.label {
+			finish()
+			cur = &LabelChange{Label: label.label}
+			inOld, inNew = false, false
+		}
+		switch {
+		case cmp < 0:
+			inOld = true
+			cur.BlocksRemoved++
+		case cmp > 0:
+			inNew = true
+			cur.BlocksAdded++
+		default:
+			inOld, inNew = true, true
+			if !bytes.Equal(oldKV.rles, newKV.rles) {
+				cur.BlocksModified++
+			}
+		}
+		if cmp <= 0 {
+			if oldKV, err = oldBlocks.next(); err != nil {
+				return nil, err
+			}
+		}
+		if cmp >= 0 {
+			if newKV, err = newBlocks.next(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	finish()
+	return changes, nil
+}
+
+// versionsSince returns the versions after the ancestor up to the context's version,
+// oldest first, or nil if the ancestor isn't a strict ancestor of the version.
+func versionsSince(ctx *datastore.VersionedContext, ancestor dvid.VersionID) ([]dvid.VersionID, error) {
+	versions, err := ancestry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range versions {
+		if v != ancestor {
+			continue
+		}
+		if i == 0 {
+			break
+		}
+		since := make([]dvid.VersionID, i)
+		for j := 0; j < i; j++ {
+			since[j] = versions[i-1-j]
+		}
+		return since, nil
+	}
+	return nil, nil
+}
+
+// GetChangedLabels returns the labels whose RLEs differ between the given ancestor
+// version and the context's version, along with any size history recorded for them in
+// between.
+func (d *Data) GetChangedLabels(ctx *datastore.VersionedContext, since dvid.UUID) (*LabelChanges, error) {
+	sinceVersion, err := datastore.VersionFromUUID(since)
+	if err != nil {
+		return nil, err
+	}
+	uuid, err := datastore.UUIDFromVersion(ctx.VersionID())
+	if err != nil {
+		return nil, err
+	}
+	versions, err := versionsSince(ctx, sinceVersion)
+	if err != nil {
+		return nil, err
+	}
+	if versions == nil {
+		return nil, server.NewError(server.BadRequestError, "Version %s is not an ancestor of version %s", since, uuid)
+	}
+	changes, err := d.diffLabels(datastore.NewVersionedContext(d, sinceVersion), ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range changes {
+		if changes[i].Ops, err = d.sizeRecordsAt(versions, changes[i].Label); err != nil {
+			return nil, err
+		}
+	}
+	if changes == nil {
+		changes = []LabelChange{}
+	}
+	return &LabelChanges{Since: since, UUID: uuid, Labels: changes}, nil
+}
+
+// sizeRecordsAt returns the size records written for a label at the given versions.
+func (d *Data) sizeRecordsAt(versions []dvid.VersionID, label uint64) ([]SizeRecord, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	index := voxels.NewLabelSizeHistoryIndex(label)
+	records := []SizeRecord{}
+	for _, v := range versions {
+		value, err := smalldata.Get(datastore.NewVersionedContext(d, v), index)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		var entry sizeEntry
+		if err := entry.UnmarshalBinary(value); err != nil {
+			return nil, err
+		}
+		if entry.version != v {
+			continue
+		}
+		uuid, err := datastore.UUIDFromVersion(v)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, SizeRecord{uuid, entry.size, entry.op})
+	}
+	return records, nil
+}
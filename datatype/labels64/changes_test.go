@@ -0,0 +1,159 @@
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/client"
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func putSyntheticRLEs(t *testing.T, ctx *datastore.VersionedContext, label uint64, rles blockRLEs) {
+	blocks := make(map[string]bool, len(rles))
+	for blockStr := range rles {
+		blocks[blockStr] = true
+	}
+	if err := putLabelRLEs(ctx, label, rles, blocks); err != nil {
+		t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+	}
+}
+
+func TestChangedLabels(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, rootVersion := initTestRepo()
+	root := repo.RootUUID()
+	config := dvid.NewConfig()
+	config.SetVersioned(true)
+	d, err := NewData(root, 302, "changedlabels", config)
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	rootCtx := datastore.NewVersionedContext(d, rootVersion)
+	putSyntheticRLEs(t, rootCtx, 1, syntheticLabel(2, 4))
+	putSyntheticRLEs(t, rootCtx, 2, syntheticLabel(2, 4))
+
+	if err := repo.Lock(root); err != nil {
+		t.Fatalf("Unable to lock root: %s\n", err.Error())
+	}
+	child, err := repo.NewVersion(root)
+	if err != nil {
+		t.Fatalf("Unable to create child version: %s\n", err.Error())
+	}
+	childVersion, err := datastore.VersionFromUUID(child)
+	if err != nil {
+		t.Fatalf("Unable to get child version: %s\n", err.Error())
+	}
+
+	// In the child, label 2 grows a block and label 3 is created with a size record.
+	childCtx := datastore.NewVersionedContext(d, childVersion)
+	block0 := dvid.IndexZYX{0, 0, 0}
+	label2 := syntheticLabel(3, 4)
+	label2[string(block0.Bytes())] = syntheticLabel(1, 6)[string(block0.Bytes())]
+	putSyntheticRLEs(t, childCtx, 2, label2)
+	putSyntheticRLEs(t, childCtx, 3, syntheticLabel(1, 2))
+	smalldata, err := storage.SmallDataStore()
+	if err != nil {
+		t.Fatalf("Unable to get small data store: %s\n", err.Error())
+	}
+	batch := smalldata.(storage.KeyValueBatcher).NewBatch(childCtx)
+	if err := putSizeHistory(batch, childCtx, map[uint64]uint64{3: 6}, "split"); err != nil {
+		t.Fatalf("Unable to add size history: %s\n", err.Error())
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("Unable to commit size history: %s\n", err.Error())
+	}
+
+	get := func(version dvid.VersionID, uuid dvid.UUID, endpoint string, since dvid.UUID) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", fmt.Sprintf("%snode/%s/changedlabels/%s?since=%s", server.WebAPIPath, uuid, endpoint, since), nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, version), w, r)
+		return w
+	}
+
+	w := get(childVersion, child, "changed-labels", root)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad changed-labels response %d: %s\n", w.Code, w.Body.String())
+	}
+	var changes LabelChanges
+	if err := json.Unmarshal(w.Body.Bytes(), &changes); err != nil {
+		t.Fatalf("Unable to decode changed labels: %s\n", err.Error())
+	}
+	if changes.Since != root || changes.UUID != child || len(changes.Labels) != 2 {
+		t.Fatalf("Unexpected changed labels: %s\n", w.Body.String())
+	}
+	expected := []LabelChange{
+		{Label: 2, Change: LabelModified, BlocksAdded: 1, BlocksModified: 1},
+		{Label: 3, Change: LabelCreated, BlocksAdded: 1, Ops: []SizeRecord{{child, 6, "split"}}},
+	}
+	for i, change := range changes.Labels {
+		exp := expected[i]
+		if change.Label != exp.Label || change.Change != exp.Change || change.BlocksAdded != exp.BlocksAdded ||
+			change.BlocksRemoved != exp.BlocksRemoved || change.BlocksModified != exp.BlocksModified ||
+			len(change.Ops) != len(exp.Ops) {
+			t.Errorf("Expected change %v, got %v\n", exp, change)
+		}
+		for j := range exp.Ops {
+			if j < len(change.Ops) && change.Ops[j] != exp.Ops[j] {
+				t.Errorf("Expected op %v for label %d, got %v\n", exp.Ops[j], change.Label, change.Ops[j])
+			}
+		}
+	}
+
+	// The reverse diff finds the same blocks, with the created label deleted.
+	changes2, err := d.diffLabels(childCtx, rootCtx)
+	if err != nil {
+		t.Fatalf("Unable to diff labels: %s\n", err.Error())
+	}
+	if len(changes2) != 2 || changes2[0].BlocksRemoved != 1 || changes2[1].Change != LabelDeleted {
+		t.Errorf("Unexpected reverse diff: %v\n", changes2)
+	}
+
+	// Sparse volumes of the changed labels are streamed at the child version.
+	w = get(childVersion, child, "changed-sparsevols", root)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad changed-sparsevols response %d: %s\n", w.Code, w.Body.String())
+	}
+	reader := client.NewSparseVolReader(w.Body)
+	for _, label := range []uint64{2, 3} {
+		got, rles, err := reader.Next()
+		if err != nil || got != label {
+			t.Fatalf("Expected label %d in stream, got %d, err %v\n", label, got, err)
+		}
+		childRLEs, err := getLabelRLEs(childCtx, label)
+		if err != nil {
+			t.Fatalf("Unable to get RLEs of label %d: %s\n", label, err.Error())
+		}
+		var numRuns int
+		for _, blockRLEs := range childRLEs {
+			numRuns += len(blockRLEs)
+		}
+		if len(rles) != numRuns {
+			t.Errorf("Expected %d runs for label %d, got %d\n", numRuns, label, len(rles))
+		}
+	}
+	if _, _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected end of changed-sparsevols stream, got %v\n", err)
+	}
+
+	// The since version must be a strict ancestor.
+	for _, since := range []dvid.UUID{child, root} {
+		if w = get(rootVersion, root, "changed-labels", since); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected bad request for changes at root since %s, got %d\n", since, w.Code)
+		}
+	}
+	if w = get(childVersion, child, "changed-labels", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request without since, got %d\n", w.Code)
+	}
+}
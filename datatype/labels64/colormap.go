@@ -0,0 +1,103 @@
+/*
+	This file supports the colors of labels used by colorized endpoints, e.g., projections
+	with colormap=hash and composites.  Each label's color is its override in the instance's
+	palette, if any, else the shared hashed color of the labels package.
+*/
+
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/common/labels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// paletteMu guards the palettes of all data instances.  Palettes are replaced rather than
+// modified, so a palette can be used after it's returned without holding the lock.
+var paletteMu sync.RWMutex
+
+// LabelColor is the response of a colormap lookup.
+type LabelColor struct {
+	Label    uint64 `json:"label"`
+	Color    string `json:"color"`
+	Override bool   `json:"override"`
+}
+
+// colors returns the palette used to color labels.
+func (d *Data) colors() labels.Palette {
+	paletteMu.RLock()
+	defer paletteMu.RUnlock()
+	return d.Palette
+}
+
+// setColors applies changes to the palette and saves them to the repo.
+func (d *Data) setColors(repo datastore.Repo, changes labels.PaletteChanges) error {
+	paletteMu.Lock()
+	old := d.Palette
+	d.Palette = old.Apply(changes)
+	paletteMu.Unlock()
+	if err := repo.Save(); err != nil {
+		paletteMu.Lock()
+		d.Palette = old
+		paletteMu.Unlock()
+		return err
+	}
+	dvid.Infof("Changed %d color overrides of labels64 %q\n", len(changes), d.DataName())
+	return nil
+}
+
+// serveColormap handles requests for the palette overrides and color lookups of labels.
+func (d *Data) serveColormap(repo datastore.Repo, w http.ResponseWriter, r *http.Request, requestID string, parts []string) {
+	var result interface{}
+	switch {
+	case r.Method == "POST" && len(parts) == 0:
+		if err := d.checkWritable(); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		changes, err := labels.ParsePaletteChanges(data)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := d.setColors(repo, changes); err != nil {
+			server.ErrorResponse(w, r, requestID, server.NewError(server.StorageError, "%s", err.Error()))
+			return
+		}
+		result = d.colors()
+	case r.Method == "GET" && len(parts) == 0:
+		result = d.colors()
+	case r.Method == "GET" && len(parts) == 1:
+		label, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Bad label %q in colormap request", parts[0]))
+			return
+		}
+		palette := d.colors()
+		_, override := palette[label]
+		result = LabelColor{label, labels.HexColor(palette.Color(label)), override}
+	default:
+		server.ErrorResponse(w, r, requestID, fmt.Errorf("colormap endpoint only accepts POST of overrides or GET of overrides or a label's color"))
+		return
+	}
+	jsonBytes, err := json.Marshal(result)
+	if err != nil {
+		server.ErrorResponse(w, r, requestID, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,105 @@
+package labels64
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/common/labels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestColormap(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 420, "coloredbodies", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewServerContext(context.Background(), repo, versionID)
+	serve := func(method, endpoint string, body []byte) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, fmt.Sprintf("%snode/%s/coloredbodies/%s", server.WebAPIPath, uuid, endpoint), bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		d.ServeHTTP(ctx, w, r)
+		return w
+	}
+
+	// Label 5 fills x < 20 and label 7 the rest.
+	vol := newTestVolume(40, 40, 8)
+	vol.add(testBody{label: 5, offset: dvid.Point3d{0, 0, 0}, size: dvid.Point3d{20, 40, 8}}, 0)
+	vol.add(testBody{label: 7, offset: dvid.Point3d{20, 0, 0}, size: dvid.Point3d{20, 40, 8}}, 0)
+	if w := serve("POST", "raw/0_1_2/40_40_8/0_0_0", vol.data); w.Code != http.StatusOK {
+		t.Fatalf("Unable to post label volume: %d %s\n", w.Code, w.Body.String())
+	}
+
+	// The projection and the colormap lookup give the same color for each label.
+	lookup := func(label uint64) LabelColor {
+		w := serve("GET", fmt.Sprintf("colormap/%d", label), nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Bad colormap lookup of label %d: %d %s\n", label, w.Code, w.Body.String())
+		}
+		var lc LabelColor
+		if err := json.Unmarshal(w.Body.Bytes(), &lc); err != nil {
+			t.Fatalf("Unable to decode colormap lookup: %s\n", err.Error())
+		}
+		return lc
+	}
+	checkProjection := func() {
+		w := serve("GET", "projection/xy/40_40/0_0_0/8?colormap=hash", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Bad colormapped projection response: %d %s\n", w.Code, w.Body.String())
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("Unable to decode projection PNG: %s\n", err.Error())
+		}
+		for label, x := range map[uint64]int{5: 10, 7: 30} {
+			c := color.NRGBAModel.Convert(img.At(x, 10)).(color.NRGBA)
+			if expected := lookup(label).Color; labels.HexColor(c) != expected {
+				t.Errorf("Expected projected label %d to have color %s, got %s\n", label, expected, labels.HexColor(c))
+			}
+		}
+	}
+	if lc := lookup(5); lc.Override || lc.Color != labels.HexColor(labels.HashColor(5)) {
+		t.Errorf("Expected hashed color for label 5, got %+v\n", lc)
+	}
+	checkProjection()
+
+	// Overrides are consulted before the hash by all colorized endpoints.
+	if w := serve("POST", "colormap", []byte(`{"7": "#FF8000"}`)); w.Code != http.StatusOK {
+		t.Fatalf("Unable to post colormap: %d %s\n", w.Code, w.Body.String())
+	}
+	if lc := lookup(7); !lc.Override || lc.Color != "#FF8000" {
+		t.Errorf("Expected override for label 7, got %+v\n", lc)
+	}
+	checkProjection()
+	w := serve("GET", "colormap", nil)
+	var overrides map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &overrides); err != nil || len(overrides) != 1 || overrides["7"] != "#FF8000" {
+		t.Errorf("Expected override of label 7, got %s, %v\n", w.Body.String(), err)
+	}
+
+	// Overrides can be removed.
+	if w := serve("POST", "colormap", []byte(`{"7": ""}`)); w.Code != http.StatusOK {
+		t.Fatalf("Unable to remove override: %d %s\n", w.Code, w.Body.String())
+	}
+	if lc := lookup(7); lc.Override || lc.Color != labels.HexColor(labels.HashColor(7)) {
+		t.Errorf("Expected hashed color after removing override of label 7, got %+v\n", lc)
+	}
+	if w := serve("POST", "colormap", []byte(`{"0": "#FFFFFF"}`)); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 overriding background color, got %d\n", w.Code)
+	}
+}
@@ -0,0 +1,287 @@
+/*
+	This file implements the compaction of label block RLEs.  Splits and merges can leave a
+	label's RLEs in a block as many small, unordered runs, some adjacent or overlapping,
+	which inflate storage and slow reads.  Compaction rewrites such values with sorted,
+	coalesced runs, which doesn't change the voxels of any label.
+*/
+
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// CompactBatchSize is the number of blocks examined between commits of a compaction.
+var CompactBatchSize = 1000
+
+// compactFailpoint, if set, is called after each committed batch of a compaction with the
+// number of blocks examined so far, so tests can interrupt a compaction.
+var compactFailpoint func(examined uint64) error
+
+// compactMu guards compacting, the data instances with a compaction running.
+var (
+	compactMu  sync.Mutex
+	compacting = make(map[dvid.InstanceID]bool)
+)
+
+// CompactReport summarizes a compaction of label RLEs.  Counts include those of earlier
+// interrupted runs that were resumed.
+type CompactReport struct {
+	Label      uint64 // 0 if RLEs of all labels were compacted
+	Resumed    bool
+	Examined   uint64
+	Rewritten  uint64
+	BytesSaved uint64
+	Retried    uint64 // blocks of labels being merged that were retried at the end
+	Skipped    uint64 // blocks of labels still being merged after the retry
+}
+
+// compactCursor is the stored progress of a compaction.  Key is the last examined key and
+// Deferred holds the keys of blocks to retry once their labels are no longer being merged.
+type compactCursor struct {
+	CompactReport
+	Key      []byte
+	Deferred [][]byte
+}
+
+// compactionKey returns the full key of the compaction cursor, which covers all versions.
+func (d *Data) compactionKey() []byte {
+	return storage.NewDataContext(d, 0).ConstructKey(voxels.NewLabelCompactionIndex())
+}
+
+// getCompactCursor returns the cursor of an interrupted compaction, or nil if there is none.
+func (d *Data) getCompactCursor(smalldata storage.SmallDataStorer) (*compactCursor, error) {
+	value, err := smalldata.Get(nil, d.compactionKey())
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var cursor compactCursor
+	if err := json.Unmarshal(value, &cursor); err != nil {
+		return nil, fmt.Errorf("Bad compaction cursor: %s", err.Error())
+	}
+	return &cursor, nil
+}
+
+// dirtyLabels returns the labels of merges whose intents are stored, i.e., merges that are
+// in flight or need repair.
+func (d *Data) dirtyLabels() (map[uint64]bool, error) {
+	intents, err := d.getIntents()
+	if err != nil {
+		return nil, err
+	}
+	dirty := make(map[uint64]bool)
+	for _, stored := range intents {
+		for label := range stored.intent.labels() {
+			dirty[label] = true
+		}
+	}
+	return dirty, nil
+}
+
+// compactValue returns the value that should replace the stored block RLEs with the given
+// full key, or nil if the value is missing, a sentinel, or wouldn't shrink.
+func (d *Data) compactValue(key, value []byte, blockSize dvid.Point3d) ([]byte, error) {
+	if value == nil || isRLESentinel(value) {
+		return nil, nil
+	}
+	_, blockBytes, err := voxels.DecodeLabelSpatialMapKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var rles dvid.RLEs
+	if err := rles.UnmarshalBinary(value); err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal RLEs with key %v: %s", key, err.Error())
+	}
+	compacted, err := encodeLabelBlock(d, blockBytes, rles.Normalize())
+	if err != nil || len(compacted) >= len(value) {
+		return nil, err
+	}
+	return compacted, nil
+}
+
+// Compact rewrites the stored block RLEs of all versions, or only those of the given label
+// if it isn't 0, with sorted and coalesced runs if that shrinks them.  Blocks are examined
+// in batches of CompactBatchSize, after each of which the rewrites and a cursor are
+// committed, so an interrupted compaction of the same label resumes where it left off.
+// Blocks of labels being merged are retried at the end.
+func (d *Data) Compact(label uint64) (*CompactReport, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	compactMu.Lock()
+	if compacting[d.InstanceID()] {
+		compactMu.Unlock()
+		return nil, server.NewError(server.ConflictError, "A compaction of %q is already running", d.DataName())
+	}
+	compacting[d.InstanceID()] = true
+	compactMu.Unlock()
+	defer func() {
+		compactMu.Lock()
+		delete(compacting, d.InstanceID())
+		compactMu.Unlock()
+	}()
+
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	batcher, ok := smalldata.(storage.KeyValueBatcher)
+	if !ok {
+		return nil, fmt.Errorf("Database doesn't support Batch ops in Compact()")
+	}
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	if !ok {
+		return nil, fmt.Errorf("Data %q doesn't have a 3d block size", d.DataName())
+	}
+
+	// Read the full keys of all versions without a versioned context.
+	begIndex := voxels.NewLabelSpatialMapIndex(0, dvid.MinIndexZYX.Bytes())
+	endIndex := voxels.NewLabelSpatialMapIndex(math.MaxUint64, dvid.MaxIndexZYX.Bytes())
+	if label != 0 {
+		begIndex, endIndex = voxels.LabelRange(label)
+	}
+	dataCtx := storage.NewDataContext(d, 0)
+	minKey, err := dataCtx.MinVersionKey(begIndex)
+	if err != nil {
+		return nil, err
+	}
+	maxKey, err := dataCtx.MaxVersionKey(endIndex)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := d.getCompactCursor(smalldata)
+	if err != nil {
+		return nil, err
+	}
+	if cursor != nil && cursor.Label == label {
+		minKey = append(append([]byte{}, cursor.Key...), 0)
+		cursor.Resumed = true
+		dvid.Infof("Resuming compaction of %q after %d blocks\n", d.DataName(), cursor.Examined)
+	} else {
+		cursor = &compactCursor{CompactReport: CompactReport{Label: label}}
+	}
+	dirty, err := d.dirtyLabels()
+	if err != nil {
+		return nil, err
+	}
+
+	// The values of pending keys are read again and checked while writes are excluded,
+	// since they may have changed since they were examined.
+	var pending [][]byte
+	rewrite := func(batch storage.Batch, keys [][]byte) error {
+		for _, key := range keys {
+			value, err := smalldata.Get(nil, key)
+			if err != nil {
+				return err
+			}
+			compacted, err := d.compactValue(key, value, blockSize)
+			if err != nil {
+				return err
+			}
+			if compacted != nil {
+				batch.Put(key, compacted)
+				cursor.Rewritten++
+				cursor.BytesSaved += uint64(len(value) - len(compacted))
+			}
+		}
+		return nil
+	}
+	var batchBlocks int
+	commit := func() error {
+		rleMu.Lock()
+		defer rleMu.Unlock()
+		batch := batcher.NewBatch(nil)
+		if err := rewrite(batch, pending); err != nil {
+			return err
+		}
+		serialization, err := json.Marshal(cursor)
+		if err != nil {
+			return err
+		}
+		batch.Put(d.compactionKey(), serialization)
+		if err := batch.Commit(); err != nil {
+			return fmt.Errorf("Unable to write compaction batch: %s", err.Error())
+		}
+		pending, batchBlocks = pending[:0], 0
+		if dirty, err = d.dirtyLabels(); err != nil {
+			return err
+		}
+		if compactFailpoint != nil {
+			return compactFailpoint(cursor.Examined)
+		}
+		return nil
+	}
+	var f storage.ChunkProcessor = func(chunk *storage.Chunk) error {
+		server.BlockOnInteractiveRequests("labels64 [compact]")
+		cursor.Examined++
+		cursor.Key = append(cursor.Key[:0], chunk.K...)
+		batchBlocks++
+		chunkLabel, _, err := voxels.DecodeLabelSpatialMapKey(chunk.K)
+		if err != nil {
+			return err
+		}
+		if dirty[chunkLabel] {
+			cursor.Deferred = append(cursor.Deferred, append([]byte{}, chunk.K...))
+		} else {
+			compacted, err := d.compactValue(chunk.K, chunk.V, blockSize)
+			if err != nil {
+				return err
+			}
+			if compacted != nil {
+				pending = append(pending, append([]byte{}, chunk.K...))
+			}
+		}
+		if batchBlocks >= CompactBatchSize {
+			return commit()
+		}
+		return nil
+	}
+	if err := smalldata.ProcessRange(nil, minKey, maxKey, &storage.ChunkOp{}, f); err != nil {
+		return nil, err
+	}
+	if batchBlocks > 0 {
+		if err := commit(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Retry the blocks of labels that were being merged, skipping those still being merged.
+	rleMu.Lock()
+	defer rleMu.Unlock()
+	if dirty, err = d.dirtyLabels(); err != nil {
+		return nil, err
+	}
+	var retry [][]byte
+	for _, key := range cursor.Deferred {
+		chunkLabel, _, err := voxels.DecodeLabelSpatialMapKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if dirty[chunkLabel] {
+			cursor.Skipped++
+		} else {
+			retry = append(retry, key)
+		}
+	}
+	cursor.Retried += uint64(len(retry))
+	batch := batcher.NewBatch(nil)
+	if err := rewrite(batch, retry); err != nil {
+		return nil, err
+	}
+	batch.Delete(d.compactionKey())
+	if err := batch.Commit(); err != nil {
+		return nil, fmt.Errorf("Unable to write compaction batch: %s", err.Error())
+	}
+	report := cursor.CompactReport
+	dvid.Infof("Compacted RLEs of %q: rewrote %d of %d blocks, saving %d bytes, skipped %d blocks being merged\n",
+		d.DataName(), report.Rewritten, report.Examined, report.BytesSaved, report.Skipped)
+	return &report, nil
+}
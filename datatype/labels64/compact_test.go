@@ -0,0 +1,167 @@
+package labels64
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+// fragmentedLabel returns RLEs of a label in blocks along x whose rows of each block are
+// split into single-voxel runs in reverse order.
+func fragmentedLabel(numBlocks, rowsPerBlock int32) blockRLEs {
+	rles := make(blockRLEs, numBlocks)
+	for b := int32(0); b < numBlocks; b++ {
+		block := dvid.IndexZYX{b, 0, 0}
+		var blockRLEs dvid.RLEs
+		for row := rowsPerBlock - 1; row >= 0; row-- {
+			for x := int32(7); x >= 0; x-- {
+				blockRLEs = append(blockRLEs, dvid.NewRLE(dvid.Point3d{b*32 + x, row % 32, row / 32}, 1))
+			}
+		}
+		rles[string(block.Bytes())] = blockRLEs
+	}
+	return rles
+}
+
+func TestCompact(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 430, "compactlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	putSyntheticRLEs(t, ctx, 7, fragmentedLabel(4, 4))
+	putSyntheticRLEs(t, ctx, 8, syntheticLabel(2, 4))
+	putSyntheticRLEs(t, ctx, 9, fragmentedLabel(2, 4))
+	count := func(label uint64) (numVoxels, numSpans uint64) {
+		numVoxels, numSpans, _, err := CountLabel(ctx, label)
+		if err != nil {
+			t.Fatalf("Unable to count label %d: %s\n", label, err.Error())
+		}
+		return numVoxels, numSpans
+	}
+	if numVoxels, numSpans := count(7); numVoxels != 4*4*8 || numSpans != 4*4*8 {
+		t.Fatalf("Expected fragmented label 7, got %d voxels in %d spans\n", numVoxels, numSpans)
+	}
+
+	// Label 9 is being merged, so its blocks are retried at the end and skipped.
+	intent := &mergeIntent{ID: newIntentID(), Op: "merge", Phase: intentMergeRLEs, Tuples: MergeTuples{{9, 10}}}
+	if err := d.putIntent(ctx, intent); err != nil {
+		t.Fatalf("Unable to store intent: %s\n", err.Error())
+	}
+
+	// Interrupt the compaction after the second batch, then resume it.
+	defer func(batchSize int) {
+		CompactBatchSize = batchSize
+		compactFailpoint = nil
+	}(CompactBatchSize)
+	CompactBatchSize = 2
+	compactFailpoint = func(examined uint64) error {
+		if examined == 4 {
+			return fmt.Errorf("simulated crash")
+		}
+		return nil
+	}
+	if _, err := d.Compact(0); err == nil {
+		t.Fatalf("Expected interrupted compaction to fail\n")
+	}
+	smalldata, err := smallDataStore()
+	if err != nil {
+		t.Fatalf("Unable to get small data store: %s\n", err.Error())
+	}
+	if cursor, err := d.getCompactCursor(smalldata); err != nil || cursor == nil || cursor.Examined != 4 {
+		t.Fatalf("Expected cursor after 4 blocks, got %+v, %v\n", cursor, err)
+	}
+	compactFailpoint = nil
+	report, err := d.Compact(0)
+	if err != nil {
+		t.Fatalf("Unable to resume compaction: %s\n", err.Error())
+	}
+	if !report.Resumed || report.Examined != 8 || report.Rewritten != 4 || report.Skipped != 2 || report.BytesSaved == 0 {
+		t.Errorf("Unexpected report of resumed compaction: %+v\n", report)
+	}
+	if cursor, err := d.getCompactCursor(smalldata); err != nil || cursor != nil {
+		t.Errorf("Expected cursor to be deleted after compaction, got %+v, %v\n", cursor, err)
+	}
+	if numVoxels, numSpans := count(7); numVoxels != 4*4*8 || numSpans != 4*4 {
+		t.Errorf("Expected compacted label 7, got %d voxels in %d spans\n", numVoxels, numSpans)
+	}
+	if numVoxels, numSpans := count(9); numVoxels != 2*4*8 || numSpans != 2*4*8 {
+		t.Errorf("Expected label 9 being merged to be untouched, got %d voxels in %d spans\n", numVoxels, numSpans)
+	}
+	rles, err := getLabelRLEs(ctx, 7)
+	if err != nil {
+		t.Fatalf("Unable to get label 7: %s\n", err.Error())
+	}
+	for blockStr, blockRLEs := range rles {
+		expected := fragmentedLabel(4, 4)[blockStr].Normalize()
+		if fmt.Sprintf("%v", blockRLEs) != fmt.Sprintf("%v", expected) {
+			t.Errorf("Expected sorted, coalesced RLEs %v, got %v\n", expected, blockRLEs)
+		}
+	}
+
+	// Once the merge is done, a single label can be compacted through the command.
+	if err := d.deleteIntent(ctx, intent.ID); err != nil {
+		t.Fatalf("Unable to delete intent: %s\n", err.Error())
+	}
+	request := datastore.Request{Command: dvid.Command{"node", string(uuid), "compactlabels", "compact", "9"}}
+	var reply datastore.Response
+	if err := d.DoRPC(request, &reply); err != nil || !strings.Contains(reply.Text, "examined 2 blocks, rewrote 2 blocks") {
+		t.Errorf("Unexpected reply to compact command: %q, %v\n", reply.Text, err)
+	}
+	if numVoxels, numSpans := count(9); numVoxels != 2*4*8 || numSpans != 2*4 {
+		t.Errorf("Expected compacted label 9, got %d voxels in %d spans\n", numVoxels, numSpans)
+	}
+
+	// Compacted RLEs aren't rewritten again, and read-only data isn't compacted.
+	if report, err := d.Compact(0); err != nil || report.Examined != 8 || report.Rewritten != 0 || report.Resumed {
+		t.Errorf("Expected nothing to compact, got %+v, %v\n", report, err)
+	}
+	d.ReadOnly = true
+	if _, err := d.Compact(0); server.ErrorKindOf(err) != server.ReadOnlyError {
+		t.Errorf("Expected read-only error compacting frozen data, got %v\n", err)
+	}
+	d.ReadOnly = false
+}
+
+// benchReadFragmented times reading a label whose block RLEs are fragmented, optionally
+// after compacting them.
+func benchReadFragmented(b *testing.B, id dvid.InstanceID, compact bool) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	ctx := putSyntheticLabel(b, id, 7, fragmentedLabel(benchBlocks, 250))
+	if compact {
+		if _, err := ctx.Data().(*Data).Compact(7); err != nil {
+			b.Fatalf("Unable to compact label: %s\n", err.Error())
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rles, err := getLabelRLEs(ctx, 7)
+		if err != nil {
+			b.Fatalf("Unable to get label RLEs: %s\n", err.Error())
+		}
+		if rles.numVoxels() != benchBlocks*250*8 {
+			b.Fatalf("Bad label size\n")
+		}
+	}
+}
+
+func BenchmarkReadFragmentedLabel(b *testing.B) {
+	benchReadFragmented(b, 431, false)
+}
+
+func BenchmarkReadCompactedLabel(b *testing.B) {
+	benchReadFragmented(b, 432, true)
+}
@@ -0,0 +1,250 @@
+/*
+	This file limits the number of concurrent requests of each class of label endpoints so a
+	burst of expensive requests, e.g., sparse volumes for hundreds of bodies, can't starve
+	other traffic.  Requests of a saturated class wait up to MaxQueueWait for a slot and then
+	get a 503 with a Retry-After header.
+*/
+
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// ConcurrencyClass is a class of requests whose concurrency is limited together.
+type ConcurrencyClass string
+
+const (
+	// MutationClass is the class of requests that modify labels, e.g., merges and splits.
+	MutationClass ConcurrencyClass = "mutation"
+
+	// LargeReadClass is the class of reads whose cost grows with the size of labels,
+	// e.g., sparse volumes, surfaces, adjacency, and projections.
+	LargeReadClass ConcurrencyClass = "large-read"
+
+	// SmallReadClass is the class of cheap reads, e.g., label sizes and lookups.
+	SmallReadClass ConcurrencyClass = "small-read"
+)
+
+// concurrencyClasses are the limited classes in the order they are reported.
+var concurrencyClasses = []ConcurrencyClass{MutationClass, LargeReadClass, SmallReadClass}
+
+const (
+	DefaultMaxMutations  = 4
+	DefaultMaxLargeReads = 8
+	DefaultMaxSmallReads = 64
+	DefaultMaxQueueWait  = 5 * time.Second
+)
+
+// concurrencyMu guards the limiters of all data instances.
+var concurrencyMu sync.Mutex
+
+// limiter allows up to limit concurrent requests and queues the rest in arrival order.
+type limiter struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiters []chan struct{}
+}
+
+// acquire waits up to the given duration for a slot and returns false if none was free.
+func (l *limiter) acquire(wait time.Duration) bool {
+	l.mu.Lock()
+	if l.active < l.limit {
+		l.active++
+		l.mu.Unlock()
+		return true
+	}
+	if wait <= 0 {
+		l.mu.Unlock()
+		return false
+	}
+	granted := make(chan struct{})
+	l.waiters = append(l.waiters, granted)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-granted:
+		return true
+	case <-timer.C:
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, waiter := range l.waiters {
+		if waiter == granted {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return false
+		}
+	}
+	// The slot was granted as the wait expired.
+	return true
+}
+
+// release frees a slot for the next waiting request.
+func (l *limiter) release() {
+	l.mu.Lock()
+	l.active--
+	l.grant()
+	l.mu.Unlock()
+}
+
+// setLimit changes the limit, granting slots to waiting requests if it was raised.
+func (l *limiter) setLimit(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.grant()
+	l.mu.Unlock()
+}
+
+// grant gives free slots to waiting requests.  The caller must hold the lock.
+func (l *limiter) grant() {
+	for l.active < l.limit && len(l.waiters) > 0 {
+		l.active++
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+	}
+}
+
+// Utilization is the use of a class's slots.
+type Utilization struct {
+	Limit  int
+	Active int
+	Queued int
+}
+
+func (l *limiter) utilization() Utilization {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Utilization{l.limit, l.active, len(l.waiters)}
+}
+
+// maxConcurrency returns the maximum number of concurrent requests of a class.
+func (d *Data) maxConcurrency(class ConcurrencyClass) int {
+	var limit, defaultLimit int
+	switch class {
+	case MutationClass:
+		limit, defaultLimit = d.MaxMutations, DefaultMaxMutations
+	case LargeReadClass:
+		limit, defaultLimit = d.MaxLargeReads, DefaultMaxLargeReads
+	case SmallReadClass:
+		limit, defaultLimit = d.MaxSmallReads, DefaultMaxSmallReads
+	}
+	if limit <= 0 {
+		return defaultLimit
+	}
+	return limit
+}
+
+// maxQueueWait returns how long requests of a saturated class wait for a slot.
+func (d *Data) maxQueueWait() time.Duration {
+	if d.MaxQueueWait <= 0 {
+		return DefaultMaxQueueWait
+	}
+	return d.MaxQueueWait
+}
+
+// limiter returns the limiter of a class, creating it if necessary.
+func (d *Data) limiter(class ConcurrencyClass) *limiter {
+	concurrencyMu.Lock()
+	defer concurrencyMu.Unlock()
+	if d.limiters == nil {
+		d.limiters = make(map[ConcurrencyClass]*limiter, len(concurrencyClasses))
+	}
+	l, found := d.limiters[class]
+	if !found {
+		l = &limiter{limit: d.maxConcurrency(class)}
+		d.limiters[class] = l
+	}
+	return l
+}
+
+// updateLimits applies changed concurrency settings to the limiters.
+func (d *Data) updateLimits() {
+	for _, class := range concurrencyClasses {
+		d.limiter(class).setLimit(d.maxConcurrency(class))
+	}
+}
+
+// utilization returns the use of each class's slots.
+func (d *Data) utilization() map[ConcurrencyClass]Utilization {
+	util := make(map[ConcurrencyClass]Utilization, len(concurrencyClasses))
+	for _, class := range concurrencyClasses {
+		util[class] = d.limiter(class).utilization()
+	}
+	return util
+}
+
+// requestClass returns the concurrency class of a request for the given endpoint and
+// whether the request is limited.  Help, info, settings, and other administrative
+// endpoints are never limited, so utilization can be checked and limits raised when
+// classes are saturated.  Raw voxel requests have their own server-wide throttle.
+func requestClass(endpoint, action string) (ConcurrencyClass, bool) {
+	switch endpoint {
+	case "merge", "split", "repair", "restore":
+		return MutationClass, true
+	case "sparsevol", "sparsevols", "sparsevol-by-point", "sparsevol-coarse",
+		"surface", "surface-by-point", "adjacency", "projection", "blocks-cseg", "changed-sparsevols":
+		return LargeReadClass, true
+	case "label", "labels", "sizerange", "size-history", "lastmod", "block-history", "mapping", "changed-labels":
+		return SmallReadClass, true
+	case "annotation", "trash":
+		if action == "post" {
+			return MutationClass, true
+		}
+		return SmallReadClass, true
+	}
+	return "", false
+}
+
+// SaturatedError is returned when a class's slots stayed full for the maximum queue wait.
+type SaturatedError struct {
+	Class ConcurrencyClass
+	Utilization
+	Wait time.Duration
+}
+
+func (e *SaturatedError) Error() string {
+	return fmt.Sprintf("Server busy: all %d %s slots in use after waiting %s", e.Limit, e.Class, e.Wait)
+}
+
+// acquireSlot waits for a slot of the given class and returns the function that releases
+// it, or an error if no slot became free within the maximum queue wait.
+func (d *Data) acquireSlot(class ConcurrencyClass) (func(), *SaturatedError) {
+	l := d.limiter(class)
+	wait := d.maxQueueWait()
+	if !l.acquire(wait) {
+		return nil, &SaturatedError{class, l.utilization(), wait}
+	}
+	return l.release, nil
+}
+
+// busyResponse writes a 503 Service Unavailable with a Retry-After header and a JSON body
+// naming the saturated class.
+func busyResponse(w http.ResponseWriter, r *http.Request, requestID string, err *SaturatedError) {
+	dvid.Errorf("ERROR [%s] %s (%s).", requestID, err.Error(), r.URL.Path)
+	w.Header().Set("X-Request-Id", requestID)
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int64((err.Wait+time.Second-1)/time.Second)))
+	jsonBytes, jsonErr := json.Marshal(struct {
+		Error     string           `json:"error"`
+		Class     ConcurrencyClass `json:"class"`
+		Limit     int              `json:"limit"`
+		Active    int              `json:"active"`
+		Queued    int              `json:"queued"`
+		RequestID string           `json:"request-id"`
+	}{err.Error(), err.Class, err.Limit, err.Active, err.Queued, requestID})
+	if jsonErr != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(jsonBytes)
+}
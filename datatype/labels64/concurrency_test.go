@@ -0,0 +1,195 @@
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestLimiter(t *testing.T) {
+	l := &limiter{limit: 2}
+	if !l.acquire(0) || !l.acquire(0) {
+		t.Fatalf("Expected two free slots\n")
+	}
+	if l.acquire(10 * time.Millisecond) {
+		t.Fatalf("Expected saturated limiter to time out\n")
+	}
+	if util := l.utilization(); util != (Utilization{2, 2, 0}) {
+		t.Errorf("Expected timed out request to leave the queue, got %v\n", util)
+	}
+
+	// Queued requests get slots in arrival order as they are released or the limit is raised.
+	granted := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			if l.acquire(time.Minute) {
+				granted <- i
+			}
+		}(i)
+		for l.utilization().Queued != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	l.release()
+	if i := <-granted; i != 0 {
+		t.Errorf("Expected first queued request to get the released slot, got %d\n", i)
+	}
+	l.setLimit(3)
+	if i := <-granted; i != 1 {
+		t.Errorf("Expected second queued request to get the added slot, got %d\n", i)
+	}
+	if util := l.utilization(); util != (Utilization{3, 3, 0}) {
+		t.Errorf("Unexpected utilization after granting queued requests: %v\n", util)
+	}
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	config := dvid.NewConfig()
+	config.Set("MaxMutations", "1")
+	config.Set("MaxLargeReads", "1")
+	config.Set("MaxQueueWait", "200ms")
+	d, err := NewData(uuid, 360, "limitedlabels", config)
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	defer d.waitFinishing()
+	ctx := datastore.NewServerContext(context.Background(), repo, versionID)
+	serve := func(method, endpoint, body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, fmt.Sprintf("/api/node/%s/limitedlabels/%s", uuid, endpoint), strings.NewReader(body))
+		w := httptest.NewRecorder()
+		d.ServeHTTP(ctx, w, r)
+		return w
+	}
+	burst := func(n int, method, endpoint, body string) []*httptest.ResponseRecorder {
+		responses := make([]*httptest.ResponseRecorder, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				responses[i] = serve(method, endpoint, body)
+			}(i)
+		}
+		wg.Wait()
+		return responses
+	}
+	checkBusy := func(w *httptest.ResponseRecorder, class ConcurrencyClass) {
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+			t.Errorf("Expected 503 with Retry-After for saturated %s, got %d %q\n", class, w.Code, w.Header().Get("Retry-After"))
+			return
+		}
+		var body struct {
+			Class  ConcurrencyClass `json:"class"`
+			Limit  int              `json:"limit"`
+			Active int              `json:"active"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Class != class || body.Limit != 1 || body.Active != 1 {
+			t.Errorf("Expected JSON naming saturated %s, got %s\n", class, w.Body.String())
+		}
+	}
+
+	// While the large read slot is held, a burst of large reads queues and then fails,
+	// but small reads are served without waiting.
+	release, busy := d.acquireSlot(LargeReadClass)
+	if busy != nil {
+		t.Fatalf("Unable to get large read slot: %s\n", busy.Error())
+	}
+	var small []*httptest.ResponseRecorder
+	var smallElapsed time.Duration
+	done := make(chan struct{})
+	go func() {
+		start := time.Now()
+		small = burst(20, "GET", "mapping/5", "")
+		smallElapsed = time.Since(start)
+		close(done)
+	}()
+	start := time.Now()
+	for _, w := range burst(5, "GET", "sparsevol/5", "") {
+		checkBusy(w, LargeReadClass)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected large reads to queue for the maximum wait, failed after %s\n", elapsed)
+	}
+	<-done
+	for _, w := range small {
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected small read to succeed, got %d: %s\n", w.Code, w.Body.String())
+		}
+	}
+	if smallElapsed >= 200*time.Millisecond {
+		t.Errorf("Expected small reads to be served without queueing, took %s\n", smallElapsed)
+	}
+
+	// Utilization is reported in /info.
+	w := serve("GET", "info", "")
+	var info struct {
+		Extended struct {
+			Concurrency map[ConcurrencyClass]Utilization
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Unable to decode info: %s\n", err.Error())
+	}
+	if util := info.Extended.Concurrency[LargeReadClass]; util != (Utilization{1, 1, 0}) {
+		t.Errorf("Expected held large read slot in info, got %v\n", info.Extended.Concurrency)
+	}
+	if util := info.Extended.Concurrency[SmallReadClass]; util != (Utilization{DefaultMaxSmallReads, 0, 0}) {
+		t.Errorf("Expected idle small reads in info, got %v\n", info.Extended.Concurrency)
+	}
+
+	// A queued large read proceeds when the limit is raised through the settings endpoint.
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() {
+		queued <- serve("GET", "sparsevol/5", "")
+	}()
+	for d.limiter(LargeReadClass).utilization().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if w := serve("POST", "settings", `{"MaxLargeReads": "2", "MaxQueueWait": "1s"}`); w.Code != http.StatusOK {
+		t.Fatalf("Unable to change limits: %d %s\n", w.Code, w.Body.String())
+	}
+	if w := <-queued; w.Code == http.StatusServiceUnavailable {
+		t.Errorf("Expected queued large read to proceed after raising the limit: %s\n", w.Body.String())
+	}
+	if d.MaxLargeReads != 2 || d.maxQueueWait() != time.Second {
+		t.Errorf("Expected changed settings, got %d large reads and %s wait\n", d.MaxLargeReads, d.maxQueueWait())
+	}
+	release()
+
+	// Mutations are limited separately.
+	config = dvid.NewConfig()
+	config.Set("MaxQueueWait", "200ms")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to change queue wait: %s\n", err.Error())
+	}
+	release, busy = d.acquireSlot(MutationClass)
+	if busy != nil {
+		t.Fatalf("Unable to get mutation slot: %s\n", busy.Error())
+	}
+	for _, w := range burst(3, "POST", "merge", "[[1, 2]]") {
+		checkBusy(w, MutationClass)
+	}
+	if w := serve("GET", "sparsevol/5", ""); w.Code == http.StatusServiceUnavailable {
+		t.Errorf("Expected large read while mutations are saturated, got %s\n", w.Body.String())
+	}
+	release()
+	if util := d.limiter(MutationClass).utilization(); util != (Utilization{1, 0, 0}) {
+		t.Errorf("Expected released mutation slot, got %v\n", util)
+	}
+}
@@ -0,0 +1,341 @@
+/*
+	This file implements the deduplication of label block RLEs.  Agglomerated labels fill
+	many blocks completely or by halves, and the RLEs of such blocks are replaced by a
+	2-byte sentinel naming the pattern if the data's DedupRLEs setting is on.  Sentinels
+	are always expanded on reads using the block coordinate of the key and the data's block
+	size, so the setting can be changed at any time.
+*/
+
+package labels64
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// rlePattern is a canonical pattern of voxels within a block.
+type rlePattern byte
+
+const (
+	fullBlock rlePattern = iota + 1
+	lowerHalfX
+	upperHalfX
+	lowerHalfY
+	upperHalfY
+	lowerHalfZ
+	upperHalfZ
+)
+
+// rlePatterns are the patterns tried, in order, when deduplicating.
+var rlePatterns = []rlePattern{fullBlock, lowerHalfX, upperHalfX, lowerHalfY, upperHalfY, lowerHalfZ, upperHalfZ}
+
+// rleSentinelMarker is the first byte of a sentinel, whose second byte is the pattern.
+// Since serialized RLEs are multiples of 16 bytes, a 2-byte value is always a sentinel.
+const rleSentinelMarker = 0xFF
+
+// DedupBatchSize is the number of block RLEs rewritten in each batch of a migration.
+var DedupBatchSize = 1000
+
+// rleMu orders writes of label block RLEs with the rewrites of a deduplication migration,
+// which hold it exclusively so values aren't replaced by sentinels of stale RLEs.
+var rleMu sync.RWMutex
+
+// box returns the voxel bounds of the pattern in the given block, where max is exclusive.
+func (p rlePattern) box(block dvid.IndexZYX, blockSize dvid.Point3d) (min, max dvid.Point3d, err error) {
+	for dim := 0; dim < 3; dim++ {
+		min[dim] = block[dim] * blockSize[dim]
+		max[dim] = min[dim] + blockSize[dim]
+	}
+	var dim int
+	switch p {
+	case fullBlock:
+		return
+	case lowerHalfX, upperHalfX:
+		dim = 0
+	case lowerHalfY, upperHalfY:
+		dim = 1
+	case lowerHalfZ, upperHalfZ:
+		dim = 2
+	default:
+		err = fmt.Errorf("Unknown RLE sentinel pattern %d", p)
+		return
+	}
+	mid := min[dim] + blockSize[dim]/2
+	switch p {
+	case lowerHalfX, lowerHalfY, lowerHalfZ:
+		max[dim] = mid
+	default:
+		min[dim] = mid
+	}
+	return
+}
+
+// rles returns the RLEs of the pattern in the given block in z, y order.
+func (p rlePattern) rles(block dvid.IndexZYX, blockSize dvid.Point3d) (dvid.RLEs, error) {
+	min, max, err := p.box(block, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	rles := make(dvid.RLEs, 0, (max[1]-min[1])*(max[2]-min[2]))
+	for z := min[2]; z < max[2]; z++ {
+		for y := min[1]; y < max[1]; y++ {
+			rles = append(rles, dvid.NewRLE(dvid.Point3d{min[0], y, z}, max[0]-min[0]))
+		}
+	}
+	return rles, nil
+}
+
+// matchPattern returns the pattern whose voxels are exactly those of the RLEs.  Runs of
+// a label never overlap, so RLEs fill a pattern if they are within its bounds and have
+// as many voxels.
+func matchPattern(rles dvid.RLEs, block dvid.IndexZYX, blockSize dvid.Point3d) (rlePattern, bool) {
+	if len(rles) == 0 {
+		return 0, false
+	}
+	var numVoxels int64
+	var min, max dvid.Point3d
+	for i, rle := range rles {
+		start, length := rle.StartPt(), rle.Length()
+		if length <= 0 {
+			return 0, false
+		}
+		end := dvid.Point3d{start[0] + length, start[1] + 1, start[2] + 1}
+		for dim := 0; dim < 3; dim++ {
+			if i == 0 || start[dim] < min[dim] {
+				min[dim] = start[dim]
+			}
+			if i == 0 || end[dim] > max[dim] {
+				max[dim] = end[dim]
+			}
+		}
+		numVoxels += int64(length)
+	}
+	for _, p := range rlePatterns {
+		pmin, pmax, err := p.box(block, blockSize)
+		if err != nil || pmin != min || pmax != max {
+			continue
+		}
+		if numVoxels == int64(max[0]-min[0])*int64(max[1]-min[1])*int64(max[2]-min[2]) {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+// isRLESentinel returns true if a stored value of block RLEs is a sentinel.
+func isRLESentinel(value []byte) bool {
+	return len(value) == 2 && value[0] == rleSentinelMarker
+}
+
+// encodeBlockRLEs returns the value stored for a label's RLEs in a block, which is a
+// sentinel if the RLEs fill a pattern.
+func encodeBlockRLEs(rles dvid.RLEs, block dvid.IndexZYX, blockSize dvid.Point3d) ([]byte, error) {
+	if p, found := matchPattern(rles, block, blockSize); found {
+		return []byte{rleSentinelMarker, byte(p)}, nil
+	}
+	return rles.MarshalBinary()
+}
+
+// decodeBlockRLEs returns the RLEs of a stored value in a block, expanding sentinels.
+func decodeBlockRLEs(value []byte, block dvid.IndexZYX, blockSize dvid.Point3d) (dvid.RLEs, error) {
+	if isRLESentinel(value) {
+		return rlePattern(value[1]).rles(block, blockSize)
+	}
+	var rles dvid.RLEs
+	if err := rles.UnmarshalBinary(value); err != nil {
+		return nil, err
+	}
+	return rles, nil
+}
+
+// contextBlockSize returns the block size of the labels data of a storage context.
+func contextBlockSize(ctx storage.Context) (dvid.Point3d, error) {
+	dataCtx, ok := ctx.(interface {
+		Data() dvid.Data
+	})
+	if !ok {
+		return dvid.Point3d{}, fmt.Errorf("Context %s has no data to expand RLE sentinels", ctx)
+	}
+	data, ok := dataCtx.Data().(interface {
+		BlockSize() dvid.Point
+	})
+	if !ok {
+		return dvid.Point3d{}, fmt.Errorf("Data %q has no block size to expand RLE sentinels", dataCtx.Data().DataName())
+	}
+	blockSize, ok := data.BlockSize().(dvid.Point3d)
+	if !ok {
+		return dvid.Point3d{}, fmt.Errorf("Data %q has no 3d block size to expand RLE sentinels", dataCtx.Data().DataName())
+	}
+	return blockSize, nil
+}
+
+// expandStoredRLEs returns the serialized RLEs of a label block key and its stored value,
+// which is returned as is unless it's a sentinel.
+func expandStoredRLEs(ctx storage.Context, key, value []byte) ([]byte, error) {
+	if !isRLESentinel(value) {
+		return value, nil
+	}
+	_, blockBytes, err := voxels.DecodeLabelSpatialMapKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var block dvid.IndexZYX
+	if err := block.IndexFromBytes(blockBytes); err != nil {
+		return nil, err
+	}
+	blockSize, err := contextBlockSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rles, err := rlePattern(value[1]).rles(block, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	return rles.MarshalBinary()
+}
+
+// DedupReport summarizes a deduplication migration.
+type DedupReport struct {
+	Scanned    uint64
+	Rewritten  uint64
+	BytesSaved uint64
+}
+
+// DeduplicateRLEs rewrites the stored block RLEs of all versions that fill a pattern as
+// sentinels, in batches of DedupBatchSize.  Rewrites don't change the voxels of any
+// label, so all versions are migrated, including locked ones.
+func (d *Data) DeduplicateRLEs() (*DedupReport, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	if !d.DedupRLEs {
+		return nil, fmt.Errorf("Data %q must have DedupRLEs=true before its RLEs are deduplicated", d.DataName())
+	}
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	batcher, ok := smalldata.(storage.KeyValueBatcher)
+	if !ok {
+		return nil, fmt.Errorf("Database doesn't support Batch ops in DeduplicateRLEs()")
+	}
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	if !ok {
+		return nil, fmt.Errorf("Data %q doesn't have a 3d block size", d.DataName())
+	}
+
+	// Read the full keys of all versions without a versioned context.
+	dataCtx := storage.NewDataContext(d, 0)
+	minKey, err := dataCtx.MinVersionKey(voxels.NewLabelSpatialMapIndex(0, dvid.MinIndexZYX.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	maxKey, err := dataCtx.MaxVersionKey(voxels.NewLabelSpatialMapIndex(math.MaxUint64, dvid.MaxIndexZYX.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	// The values of pending keys are read again and checked while writes are excluded,
+	// since they may have changed since they were scanned.
+	report := new(DedupReport)
+	var pending [][]byte
+	flush := func() error {
+		rleMu.Lock()
+		defer rleMu.Unlock()
+		batch := batcher.NewBatch(nil)
+		for _, key := range pending {
+			value, err := smalldata.Get(nil, key)
+			if err != nil {
+				return err
+			}
+			sentinel, err := d.dedupValue(key, value, blockSize)
+			if err != nil {
+				return err
+			}
+			if sentinel != nil {
+				batch.Put(key, sentinel)
+				report.Rewritten++
+				report.BytesSaved += uint64(len(value) - len(sentinel))
+			}
+		}
+		pending = pending[:0]
+		return batch.Commit()
+	}
+	var f storage.ChunkProcessor = func(chunk *storage.Chunk) error {
+		report.Scanned++
+		sentinel, err := d.dedupValue(chunk.K, chunk.V, blockSize)
+		if err != nil || sentinel == nil {
+			return err
+		}
+		pending = append(pending, append([]byte{}, chunk.K...))
+		if len(pending) >= DedupBatchSize {
+			return flush()
+		}
+		return nil
+	}
+	if err := smalldata.ProcessRange(nil, minKey, maxKey, &storage.ChunkOp{}, f); err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	dvid.Infof("Deduplicated RLEs of %q: rewrote %d of %d blocks, saving %d bytes\n", d.DataName(),
+		report.Rewritten, report.Scanned, report.BytesSaved)
+	return report, nil
+}
+
+// dedupValue returns the sentinel that should replace the stored block RLEs with the
+// given full key, or nil if the value is missing, already a sentinel, or fills no pattern.
+func (d *Data) dedupValue(key, value []byte, blockSize dvid.Point3d) ([]byte, error) {
+	if value == nil || isRLESentinel(value) {
+		return nil, nil
+	}
+	_, blockBytes, err := voxels.DecodeLabelSpatialMapKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var block dvid.IndexZYX
+	if err := block.IndexFromBytes(blockBytes); err != nil {
+		return nil, err
+	}
+	var rles dvid.RLEs
+	if err := rles.UnmarshalBinary(value); err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal RLEs with key %v: %s", key, err.Error())
+	}
+	if p, found := matchPattern(rles, block, blockSize); found {
+		return []byte{rleSentinelMarker, byte(p)}, nil
+	}
+	return nil, nil
+}
+
+// dedupBlockSize returns the block size of labels data and true if it stores sentinels
+// for block RLEs.
+func dedupBlockSize(data dvid.Data) (dvid.Point3d, bool) {
+	d, ok := data.(*Data)
+	if !ok || !d.DedupRLEs {
+		return dvid.Point3d{}, false
+	}
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	return blockSize, ok
+}
+
+// encodeLabelBlock returns the value stored for a label's RLEs in the block with the
+// given bytes, which is a sentinel if the data stores sentinels and the RLEs fill a pattern.
+func encodeLabelBlock(data dvid.Data, blockBytes []byte, rles dvid.RLEs) ([]byte, error) {
+	blockSize, dedup := dedupBlockSize(data)
+	if !dedup {
+		return rles.MarshalBinary()
+	}
+	var block dvid.IndexZYX
+	if err := block.IndexFromBytes(blockBytes); err != nil {
+		return nil, err
+	}
+	return encodeBlockRLEs(rles, block, blockSize)
+}
@@ -0,0 +1,215 @@
+package labels64
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestRLEPatterns(t *testing.T) {
+	blockSize := dvid.Point3d{8, 6, 4}
+	for _, block := range []dvid.IndexZYX{{0, 0, 0}, {3, -2, 5}} {
+		for _, p := range rlePatterns {
+			rles, err := p.rles(block, blockSize)
+			if err != nil {
+				t.Fatalf("Unable to get RLEs of pattern %d: %s\n", p, err.Error())
+			}
+			numVoxels, _ := rles.Stats()
+			expected := blockSize.Prod()
+			if p != fullBlock {
+				expected /= 2
+			}
+			if int64(numVoxels) != expected {
+				t.Errorf("Expected %d voxels in pattern %d, got %d\n", expected, p, numVoxels)
+			}
+			value, err := encodeBlockRLEs(rles, block, blockSize)
+			if err != nil || !isRLESentinel(value) || rlePattern(value[1]) != p {
+				t.Errorf("Expected sentinel of pattern %d in block %v, got %v, %v\n", p, block, value, err)
+			}
+			decoded, err := decodeBlockRLEs(value, block, blockSize)
+			if err != nil || !reflect.DeepEqual(decoded, rles) {
+				t.Errorf("Bad round trip of pattern %d in block %v: %v, %v\n", p, block, decoded, err)
+			}
+
+			// Runs split and reordered still match, but missing a voxel doesn't.
+			var split dvid.RLEs
+			for i := len(rles) - 1; i >= 0; i-- {
+				start, length := rles[i].StartPt(), rles[i].Length()
+				split = append(split, dvid.NewRLE(start, 1), dvid.NewRLE(dvid.Point3d{start[0] + 1, start[1], start[2]}, length-1))
+			}
+			if found, ok := matchPattern(split, block, blockSize); !ok || found != p {
+				t.Errorf("Expected split runs to match pattern %d, got %d\n", p, found)
+			}
+			split[0] = dvid.NewRLE(split[0].StartPt(), 0)
+			if _, ok := matchPattern(split, block, blockSize); ok {
+				t.Errorf("Expected runs missing a voxel not to match pattern %d\n", p)
+			}
+		}
+	}
+
+	// Runs in the wrong block or stored without dedup are serialized as is.
+	rles, _ := fullBlock.rles(dvid.IndexZYX{1, 0, 0}, blockSize)
+	if value, err := encodeBlockRLEs(rles, dvid.IndexZYX{0, 0, 0}, blockSize); err != nil || len(value) != 16*len(rles) {
+		t.Errorf("Expected serialized RLEs for runs outside block, got %d bytes, %v\n", len(value), err)
+	}
+	if _, err := decodeBlockRLEs([]byte{rleSentinelMarker, 99}, dvid.IndexZYX{0, 0, 0}, blockSize); err == nil {
+		t.Errorf("Expected error for unknown sentinel pattern\n")
+	}
+}
+
+func TestDedupRLEs(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	config := dvid.NewConfig()
+	config.Set("BlockSize", "8,8,8")
+	d, err := NewData(uuid, 370, "deduplabels", config)
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	blockSize := dvid.Point3d{8, 8, 8}
+	smalldata, err := smallDataStore()
+	if err != nil {
+		t.Fatalf("Unable to get small data store: %s\n", err.Error())
+	}
+
+	// Label 1 fills block (0,0,0), 2 and 3 fill halves of block (1,0,0), 4 fills the
+	// lower half of block (2,0,0) in Z, and 5 has a single run in block (3,0,0).
+	blocks := []dvid.IndexZYX{{0, 0, 0}, {1, 0, 0}, {2, 0, 0}, {3, 0, 0}}
+	pattern := func(p rlePattern, block dvid.IndexZYX) dvid.RLEs {
+		rles, err := p.rles(block, blockSize)
+		if err != nil {
+			t.Fatalf("Unable to get RLEs of pattern %d: %s\n", p, err.Error())
+		}
+		return rles
+	}
+	labels := map[uint64]blockRLEs{
+		1: {string(blocks[0].Bytes()): pattern(fullBlock, blocks[0])},
+		2: {string(blocks[1].Bytes()): pattern(lowerHalfX, blocks[1])},
+		3: {string(blocks[1].Bytes()): pattern(upperHalfX, blocks[1])},
+		4: {string(blocks[2].Bytes()): pattern(lowerHalfZ, blocks[2])},
+		5: {string(blocks[3].Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{24, 0, 0}, 5)}},
+	}
+	stored := func(label uint64, block dvid.IndexZYX) []byte {
+		value, err := smalldata.Get(ctx, voxels.NewLabelSpatialMapIndex(label, block.Bytes()))
+		if err != nil {
+			t.Fatalf("Unable to get RLEs of label %d: %s\n", label, err.Error())
+		}
+		return value
+	}
+	checkLabel := func(label uint64, expected blockRLEs) {
+		rles, err := getLabelRLEs(ctx, label)
+		if err != nil {
+			t.Fatalf("Unable to get RLEs of label %d: %s\n", label, err.Error())
+		}
+		if len(rles) != len(expected) {
+			t.Fatalf("Expected %d blocks for label %d, got %d\n", len(expected), label, len(rles))
+		}
+		for blockStr, expectedRLEs := range expected {
+			expectedVoxels, _ := expectedRLEs.Stats()
+			if numVoxels, _ := rles[blockStr].Stats(); numVoxels != expectedVoxels {
+				t.Errorf("Expected %d voxels for label %d in block %v, got %d\n", expectedVoxels, label, []byte(blockStr), numVoxels)
+			}
+		}
+		numVoxels, _, numBlocks, err := CountLabel(ctx, label)
+		if err != nil || numVoxels != expected.numVoxels() || numBlocks != uint64(len(expected)) {
+			t.Errorf("Expected %d voxels in %d blocks for label %d, got %d in %d, %v\n",
+				expected.numVoxels(), len(expected), label, numVoxels, numBlocks, err)
+		}
+		sparseVol, err := GetSparseVol(ctx, label, Bounds{})
+		if err != nil {
+			t.Fatalf("Unable to get sparse volume of label %d: %s\n", label, err.Error())
+		}
+		var vol dvid.RLEs
+		if err := vol.UnmarshalBinary(sparseVol[12:]); err != nil {
+			t.Fatalf("Bad sparse volume of label %d: %s\n", label, err.Error())
+		}
+		if numVoxels, _ := vol.Stats(); uint64(numVoxels) != expected.numVoxels() {
+			t.Errorf("Expected %d voxels in sparse volume of label %d, got %d\n", expected.numVoxels(), label, numVoxels)
+		}
+	}
+
+	// Without dedup, RLEs are stored as is.
+	for label, rles := range labels {
+		putSyntheticRLEs(t, ctx, label, rles)
+	}
+	if value := stored(1, blocks[0]); isRLESentinel(value) {
+		t.Fatalf("Expected RLEs stored without dedup\n")
+	}
+	if _, err := d.DeduplicateRLEs(); err == nil || !strings.Contains(err.Error(), "DedupRLEs=true") {
+		t.Errorf("Expected migration to require DedupRLEs, got %v\n", err)
+	}
+
+	// The migration rewrites filled blocks in batches and reports the bytes saved.
+	config = dvid.NewConfig()
+	config.Set("DedupRLEs", "true")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to enable dedup: %s\n", err.Error())
+	}
+	oldBatchSize := DedupBatchSize
+	DedupBatchSize = 2
+	defer func() {
+		DedupBatchSize = oldBatchSize
+	}()
+	report, err := d.DeduplicateRLEs()
+	if err != nil {
+		t.Fatalf("Unable to deduplicate RLEs: %s\n", err.Error())
+	}
+	expectedSaved := uint64(16*(64+64+64+32) - 4*2)
+	if report.Scanned != 5 || report.Rewritten != 4 || report.BytesSaved != expectedSaved {
+		t.Errorf("Expected 4 of 5 blocks rewritten saving %d bytes, got %+v\n", expectedSaved, *report)
+	}
+	for label, block := range map[uint64]dvid.IndexZYX{1: blocks[0], 2: blocks[1], 3: blocks[1], 4: blocks[2]} {
+		if value := stored(label, block); !isRLESentinel(value) {
+			t.Errorf("Expected sentinel for label %d, got %d bytes\n", label, len(value))
+		}
+	}
+	if value := stored(5, blocks[3]); len(value) != 16 {
+		t.Errorf("Expected RLEs of partial block, got %d bytes\n", len(value))
+	}
+	for label, rles := range labels {
+		checkLabel(label, rles)
+	}
+	if report, err = d.DeduplicateRLEs(); err != nil || report.Rewritten != 0 {
+		t.Errorf("Expected nothing to rewrite after migration, got %v, %v\n", report, err)
+	}
+
+	// Merging the halves of a block stores a full block sentinel, and merging labels with
+	// sentinels gives the same voxels.
+	merge := func(tuples MergeTuples) {
+		if _, err := d.MergeLabels(ctx, tuples, MergeOptions{}); err != nil {
+			t.Fatalf("Unable to merge %v: %s\n", tuples, err.Error())
+		}
+		d.waitFinishing()
+	}
+	merge(MergeTuples{{2, 3}})
+	if value := stored(2, blocks[1]); !isRLESentinel(value) || rlePattern(value[1]) != fullBlock {
+		t.Errorf("Expected full block sentinel after merging halves, got %v\n", value)
+	}
+	merged := blockRLEs{string(blocks[1].Bytes()): pattern(fullBlock, blocks[1])}
+	checkLabel(2, merged)
+	merge(MergeTuples{{1, 2, 4, 5}})
+	merged = blockRLEs{
+		string(blocks[0].Bytes()): pattern(fullBlock, blocks[0]),
+		string(blocks[1].Bytes()): pattern(fullBlock, blocks[1]),
+		string(blocks[2].Bytes()): pattern(lowerHalfZ, blocks[2]),
+		string(blocks[3].Bytes()): labels[5][string(blocks[3].Bytes())],
+	}
+	checkLabel(1, merged)
+	for _, label := range []uint64{2, 3, 4, 5} {
+		if rles, err := getLabelRLEs(ctx, label); err != nil || len(rles) != 0 {
+			t.Errorf("Expected no blocks for merged label %d, got %d, %v\n", label, len(rles), err)
+		}
+	}
+	if sizes, err := getAllLabelSizes(ctx); err != nil || sizes[1] != merged.numVoxels() {
+		t.Errorf("Expected size %d for label 1 from all sizes, got %v, %v\n", merged.numVoxels(), sizes, err)
+	}
+}
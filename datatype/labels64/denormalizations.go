@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"math"
 	"sync"
+	"time"
 
 	"github.com/janelia-flyem/dvid/datastore"
 	"github.com/janelia-flyem/dvid/datatype/voxels"
@@ -86,7 +87,7 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 		dvid.Errorf("Cannot get datastore that handles big data: %s\n", err.Error())
 		return
 	}
-	smalldata, err := storage.SmallDataStore()
+	smalldata, err := smallDataStore()
 	if err != nil {
 		dvid.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
 		return
@@ -157,6 +158,9 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 			return fmt.Errorf("Could not get %q index bytes from chunk key: %s\n", d.DataName(), err.Error())
 		}
 		label := binary.BigEndian.Uint64(indexBytes[1:9])
+		if chunk.V, err = expandStoredRLEs(ctx, chunk.K, chunk.V); err != nil {
+			return err
+		}
 		chunk.ChunkOp = &storage.ChunkOp{label, nil}
 
 		// Send RLE of label to size indexer and surface calculator.
@@ -181,14 +185,37 @@ func (d *Data) ProcessSpatially(uuid dvid.UUID) {
 	timedLog.Infof("Finished reading all RLEs for labels '%s'", d.DataName())
 }
 
+// startDenorm starts denormalization of the label blocks sent down the channel and notes
+// it as finishing in the background until label sizes and surfaces are written.  The
+// returned id is passed to endDenorm once all blocks are sent.
+func (d *Data) startDenorm(versionID dvid.VersionID, mods voxels.BlockChannel) uint64 {
+	id := newIntentID()
+	d.setFinishing(id, true)
+	go d.denormFunc(versionID, mods, id)
+	return id
+}
+
+// endDenorm closes the channel of label blocks after a write so sizes and surfaces of
+// the written labels are computed.  If the write failed, blocks may still be sent by chunk
+// handlers, so the channel is left open and the denormalization is no longer waited on.
+func (d *Data) endDenorm(mods voxels.BlockChannel, id uint64, err error) {
+	if err != nil {
+		d.setFinishing(id, false)
+		return
+	}
+	close(mods)
+}
+
 // denormFunc handles denormalization for label blocks sent down a channel.  When channel is
-// closed, batch denormalizations are handled.
+// closed, batch denormalizations are handled.  All labels in the blocks get the write as
+// their last mutation, with the given id.
 // On return from this function, block-level RLEs have been written but size and surface
 // data are handled asynchronously.
-func (d *Data) denormFunc(versionID dvid.VersionID, mods voxels.BlockChannel) {
-	smalldata, err := storage.SmallDataStore()
+func (d *Data) denormFunc(versionID dvid.VersionID, mods voxels.BlockChannel, id uint64) {
+	smalldata, err := smallDataStore()
 	if err != nil {
 		dvid.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+		d.setFinishing(id, false)
 		return
 	}
 
@@ -197,6 +224,7 @@ func (d *Data) denormFunc(versionID dvid.VersionID, mods voxels.BlockChannel) {
 	// TODO: Limit re-denormalization on actually modified labels, but figure merge/split
 	// is primary calls for these more specific edits.
 	labels := make(map[uint64]bool, 1000)
+	m := labelMutation{id, time.Now()}
 
 	// Accept modified label blocks and change LabelSpatialMapIndex key/values.
 	for {
@@ -207,6 +235,7 @@ func (d *Data) denormFunc(versionID dvid.VersionID, mods voxels.BlockChannel) {
 		if len(block.Data)%8 != 0 {
 			dvid.Errorf("Received block label data with size not-aligned with uint64: %d bytes\n",
 				len(block.Data))
+			d.setFinishing(id, false)
 			return
 		}
 		for i := 0; i < len(block.Data); i += 8 {
@@ -215,7 +244,7 @@ func (d *Data) denormFunc(versionID dvid.VersionID, mods voxels.BlockChannel) {
 				labels[label] = true
 			}
 		}
-		d.createChunkRLEs(versionID, block.Index, block.Data)
+		d.createChunkRLEs(versionID, block.Index, block.Data, &m)
 	}
 
 	// Setup goroutines for processing label size and surface.
@@ -225,6 +254,7 @@ func (d *Data) denormFunc(versionID dvid.VersionID, mods voxels.BlockChannel) {
 	wg.Add(1)
 	go ComputeSizes(ctx, sizeCh, wg)
 	surfaceCh := make(chan *storage.Chunk, 1000)
+	<-server.HandlerToken
 	wg.Add(1)
 	go ComputeSurface(ctx, d, surfaceCh, wg)
 
@@ -235,6 +265,9 @@ func (d *Data) denormFunc(versionID dvid.VersionID, mods voxels.BlockChannel) {
 			return fmt.Errorf("Could not get %q index bytes from chunk key: %s\n", d.DataName(), err.Error())
 		}
 		label := binary.BigEndian.Uint64(indexBytes[1:9])
+		if chunk.V, err = expandStoredRLEs(ctx, chunk.K, chunk.V); err != nil {
+			return err
+		}
 		chunk.ChunkOp = &storage.ChunkOp{label, nil}
 
 		// Send RLE of label to size indexer and surface calculator.
@@ -247,11 +280,11 @@ func (d *Data) denormFunc(versionID dvid.VersionID, mods voxels.BlockChannel) {
 
 	// Given all blocks modified, process body RLEs for label sizes and surfaces.
 	for label := range labels {
-		begIndex := voxels.NewLabelSpatialMapIndex(label, dvid.MinIndexZYX.Bytes())
-		endIndex := voxels.NewLabelSpatialMapIndex(label, dvid.MaxIndexZYX.Bytes())
+		begIndex, endIndex := voxels.LabelRange(label)
 		err := smalldata.ProcessRange(ctx, begIndex, endIndex, &storage.ChunkOp{}, f)
 		if err != nil {
 			dvid.Errorf("Error denormalizing %s: %s\n", d.DataName(), err.Error())
+			d.setFinishing(id, false)
 			return
 		}
 	}
@@ -264,6 +297,7 @@ func (d *Data) denormFunc(versionID dvid.VersionID, mods voxels.BlockChannel) {
 		wg.Wait()
 		dvid.Debugf("Finished processing denormalization for labels '%s'\n", d.DataName())
 		d.Ready = true
+		d.setFinishing(id, false)
 		// TODO -- should use metadata store for this kind of mutex
 	}()
 }
@@ -297,17 +331,42 @@ func (d *Data) CreateChunkRLEs(chunk *storage.Chunk) error {
 			dvid.Infof("Unable to deserialize block in '%s': %s\n", d.DataName(), err.Error())
 			return
 		}
-		d.createChunkRLEs(op.versionID, zyx, blockData)
+		d.createChunkRLEs(op.versionID, zyx, blockData, nil)
 	}()
 	return nil
 }
 
-func (d *Data) createChunkRLEs(versionID dvid.VersionID, zyx *dvid.IndexZYX, blockData []byte) {
+// createChunkRLEs stores the RLEs of each label in a block, recording the mutation as the
+// last mutation of the labels if it's not nil.
+func (d *Data) createChunkRLEs(versionID dvid.VersionID, zyx *dvid.IndexZYX, blockData []byte, m *labelMutation) {
+	labelRLEs, err := d.blockLabelRLEs(zyx, blockData)
+	if err != nil {
+		dvid.Infof("Unable to denormalize block in %q: %s\n", d.DataName(), err.Error())
+		return
+	}
+
+	// Store the KeyLabelSpatialMap keys (index = b + s) with slice of runs for value.
+	db, err := smallDataStore()
+	if err != nil {
+		dvid.Errorf("Error in %s.createChunkRLEs(): %s\n", d.DataName(), err.Error())
+		return
+	}
+	batcher, ok := db.(storage.KeyValueBatcher)
+	if !ok {
+		dvid.Errorf("Database doesn't support Batch ops in %s.denormalizeChunk()", d.DataName())
+		return
+	}
+	storeLabelSpatialMap(versionID, d, batcher, zyx.Bytes(), labelRLEs, m)
+	d.invalidateAdjacency(versionID, nil)
+	d.invalidateCompartments(versionID, nil)
+}
+
+// blockLabelRLEs returns the RLEs of each non-zero label in a deserialized block of labels.
+func (d *Data) blockLabelRLEs(zyx *dvid.IndexZYX, blockData []byte) (map[uint64]dvid.RLEs, error) {
 	// Iterate through this block of labels.
 	blockBytes := len(blockData)
-	if blockBytes%8 != 0 {
-		dvid.Infof("Retrieved, deserialized block is wrong size: %d bytes\n", blockBytes)
-		return
+	if blockBytes%8 != 0 || int64(blockBytes) != d.BlockSize().Prod()*8 {
+		return nil, fmt.Errorf("Block %s has %d bytes, not %d uint64 labels", zyx, blockBytes, d.BlockSize().Prod())
 	}
 	labelRLEs := make(map[uint64]dvid.RLEs, 10)
 	firstPt := zyx.MinPoint(d.BlockSize())
@@ -349,17 +408,5 @@ func (d *Data) createChunkRLEs(versionID dvid.VersionID, zyx *dvid.IndexZYX, blo
 			}
 		}
 	}
-
-	// Store the KeyLabelSpatialMap keys (index = b + s) with slice of runs for value.
-	db, err := storage.SmallDataStore()
-	if err != nil {
-		dvid.Errorf("Error in %s.createChunkRLEs(): %s\n", d.DataName(), err.Error())
-		return
-	}
-	batcher, ok := db.(storage.KeyValueBatcher)
-	if !ok {
-		dvid.Errorf("Database doesn't support Batch ops in %s.denormalizeChunk()", d.DataName())
-		return
-	}
-	StoreKeyLabelSpatialMap(versionID, d, batcher, zyx.Bytes(), labelRLEs)
+	return labelRLEs, nil
 }
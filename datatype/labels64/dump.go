@@ -0,0 +1,283 @@
+/*
+	This file supports dumping the stored RLEs of a single label to a file and restoring
+	them, e.g., to capture a label reported as wrong for a bug report and load it into a
+	test instance.
+
+	A dump starts with a magic string and a length-prefixed JSON header describing the data
+	instance, version, label, and block size.  Each block follows as a record, where
+	integers are little endian:
+
+	    uint32   Length of block index
+	    bytes    Block index
+	    uint32   Length of serialized RLEs
+	    bytes    Serialized RLEs of the label within the block
+	    uint32   CRC32 (IEEE) checksum of the block index and RLEs
+
+	The dump ends with a uint32 0 and the uint64 number of block records, so truncated
+	dumps are detected.
+*/
+
+package labels64
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// labelDumpMagic starts every label dump.
+const labelDumpMagic = "DVIDRLE1"
+
+// maxDumpRecordBytes bounds the lengths read from a dump so corrupt files fail fast.
+const maxDumpRecordBytes = 1 << 30
+
+// LabelDumpHeader describes the label and data instance of a dump.
+type LabelDumpHeader struct {
+	Data      dvid.DataString
+	TypeName  dvid.TypeString
+	UUID      dvid.UUID
+	Label     uint64
+	BlockSize dvid.Point3d
+}
+
+// LabelRestore summarizes a restore of a dumped label.
+type LabelRestore struct {
+	DumpLabel uint64 // label in the dump
+	Label     uint64 // label the RLEs were restored to
+	Blocks    uint64
+	Voxels    uint64
+	Replaced  bool // true if an existing label was overwritten
+}
+
+// DumpLabel writes the stored RLEs of a label at the context's version to a dump.  The
+// blocks are streamed from storage, so memory use doesn't grow with the label size.
+func (d *Data) DumpLabel(ctx *datastore.VersionedContext, label uint64, w io.Writer) (uint64, error) {
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	if !ok {
+		return 0, fmt.Errorf("Can't dump label of data %q with non-3d block size %s", d.DataName(), d.BlockSize())
+	}
+	uuid, err := datastore.UUIDFromVersion(ctx.VersionID())
+	if err != nil {
+		return 0, err
+	}
+	header, err := json.Marshal(LabelDumpHeader{d.DataName(), d.TypeName(), uuid, label, blockSize})
+	if err != nil {
+		return 0, err
+	}
+	out := bufio.NewWriter(w)
+	if _, err := out.WriteString(labelDumpMagic); err != nil {
+		return 0, err
+	}
+	if err := writeDumpBytes(out, header); err != nil {
+		return 0, err
+	}
+	var numBlocks uint64
+	err = ForEachBlock(ctx, label, nil, func(block dvid.IndexZYX, rles dvid.RLEs) error {
+		serialization, err := rles.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		blockBytes := block.Bytes()
+		if err := writeDumpBytes(out, blockBytes); err != nil {
+			return err
+		}
+		if err := writeDumpBytes(out, serialization); err != nil {
+			return err
+		}
+		checksum := crc32.NewIEEE()
+		checksum.Write(blockBytes)
+		checksum.Write(serialization)
+		if err := binary.Write(out, binary.LittleEndian, checksum.Sum32()); err != nil {
+			return err
+		}
+		numBlocks++
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Unable to dump label %d: %s", label, err.Error())
+	}
+	if err := binary.Write(out, binary.LittleEndian, uint32(0)); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(out, binary.LittleEndian, numBlocks); err != nil {
+		return 0, err
+	}
+	return numBlocks, out.Flush()
+}
+
+// writeDumpBytes writes a length-prefixed byte slice.
+func writeDumpBytes(w io.Writer, b []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readDumpBytes reads a length-prefixed byte slice.
+func readDumpBytes(r io.Reader, length uint32) ([]byte, error) {
+	if length > maxDumpRecordBytes {
+		return nil, fmt.Errorf("Bad record length %d in label dump", length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readLabelDump reads and validates a dump, returning its header and the RLEs of each block.
+func readLabelDump(r io.Reader) (*LabelDumpHeader, blockRLEs, error) {
+	in := bufio.NewReader(r)
+	magic := make([]byte, len(labelDumpMagic))
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic) != labelDumpMagic {
+		return nil, nil, fmt.Errorf("File is not a label dump")
+	}
+	var length uint32
+	if err := binary.Read(in, binary.LittleEndian, &length); err != nil {
+		return nil, nil, fmt.Errorf("Unable to read label dump header: %s", err.Error())
+	}
+	headerBytes, err := readDumpBytes(in, length)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read label dump header: %s", err.Error())
+	}
+	var header LabelDumpHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, nil, fmt.Errorf("Bad label dump header: %s", err.Error())
+	}
+
+	rles := blockRLEs{}
+	for {
+		if err := binary.Read(in, binary.LittleEndian, &length); err != nil {
+			return nil, nil, fmt.Errorf("Label dump is truncated after %d blocks", len(rles))
+		}
+		if length == 0 {
+			break
+		}
+		blockBytes, err := readDumpBytes(in, length)
+		if err == nil {
+			err = binary.Read(in, binary.LittleEndian, &length)
+		}
+		var serialization []byte
+		if err == nil {
+			serialization, err = readDumpBytes(in, length)
+		}
+		var stored uint32
+		if err == nil {
+			err = binary.Read(in, binary.LittleEndian, &stored)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Label dump is truncated after %d blocks", len(rles))
+		}
+		checksum := crc32.NewIEEE()
+		checksum.Write(blockBytes)
+		checksum.Write(serialization)
+		if checksum.Sum32() != stored {
+			return nil, nil, fmt.Errorf("Checksum mismatch in block %d of label dump", len(rles))
+		}
+		var block dvid.IndexZYX
+		if err := block.IndexFromBytes(blockBytes); err != nil {
+			return nil, nil, fmt.Errorf("Bad block index in label dump: %s", err.Error())
+		}
+		var blockRLE dvid.RLEs
+		if err := blockRLE.UnmarshalBinary(serialization); err != nil {
+			return nil, nil, fmt.Errorf("Bad RLEs in block %s of label dump: %s", &block, err.Error())
+		}
+		rles[string(blockBytes)] = blockRLE
+	}
+	var numBlocks uint64
+	if err := binary.Read(in, binary.LittleEndian, &numBlocks); err != nil {
+		return nil, nil, fmt.Errorf("Label dump is missing its block count")
+	}
+	if numBlocks != uint64(len(rles)) {
+		return nil, nil, fmt.Errorf("Label dump has %d blocks, expected %d", len(rles), numBlocks)
+	}
+	return &header, rles, nil
+}
+
+// RestoreLabel loads a dump into the data at the context's version.  The RLEs are stored
+// under the dumped label unless a non-zero new label is given.  An existing label is only
+// overwritten if force is true.  The dump must have the same block size as the data.
+func (d *Data) RestoreLabel(ctx *datastore.VersionedContext, r io.Reader, newLabel uint64, force bool) (*LabelRestore, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	header, rles, err := readLabelDump(r)
+	if err != nil {
+		return nil, err
+	}
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	if !ok || !blockSize.Equals(header.BlockSize) {
+		return nil, fmt.Errorf("Label dump has block size %s, incompatible with data %q block size %s",
+			header.BlockSize, d.DataName(), d.BlockSize())
+	}
+	label := header.Label
+	if newLabel != 0 {
+		label = newLabel
+	}
+	restore := &LabelRestore{DumpLabel: header.Label, Label: label, Blocks: uint64(len(rles)), Voxels: rles.numVoxels()}
+
+	existing, err := getLabelRLEs(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) != 0 {
+		if !force {
+			return nil, fmt.Errorf("Label %d already exists in data %q; use --force to overwrite it", label, d.DataName())
+		}
+		blocks := make(map[string]bool, len(existing))
+		for blockStr := range existing {
+			blocks[blockStr] = true
+		}
+		if err := deleteLabelBlocks(ctx, label, blocks); err != nil {
+			return nil, err
+		}
+		restore.Replaced = true
+	}
+
+	blocks := make(map[string]bool, len(rles))
+	for blockStr := range rles {
+		blocks[blockStr] = true
+	}
+	if err := putLabelRLEs(ctx, label, rles, blocks); err != nil {
+		return nil, err
+	}
+	updateLabelSizes(ctx, map[uint64]sizeChange{label: {existing.numVoxels(), restore.Voxels}}, "restore")
+	d.invalidateCompartments(ctx.VersionID(), map[uint64]bool{label: true})
+	d.recomputeSurface(ctx, label, rles)
+	if err := putLastMutation(ctx, label, labelMutation{newIntentID(), time.Now()}); err != nil {
+		return nil, err
+	}
+	return restore, nil
+}
+
+// dumpLabelFile writes the dump of a label to a file.
+func (d *Data) dumpLabelFile(ctx *datastore.VersionedContext, label uint64, filename string) (uint64, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return 0, err
+	}
+	numBlocks, err := d.DumpLabel(ctx, label, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return numBlocks, err
+}
+
+// restoreLabelFile restores a label from a dump file.
+func (d *Data) restoreLabelFile(ctx *datastore.VersionedContext, filename string, newLabel uint64, force bool) (*LabelRestore, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return d.RestoreLabel(ctx, f, newLabel, force)
+}
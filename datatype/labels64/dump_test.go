@@ -0,0 +1,167 @@
+package labels64
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestDumpRestoreLabel(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	source, err := NewData(uuid, 390, "reportedlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	target, err := NewData(uuid, 391, "testlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	sourceCtx := datastore.NewVersionedContext(source, versionID)
+	targetCtx := datastore.NewVersionedContext(target, versionID)
+
+	// Label 4123 spans three blocks with several runs each.
+	rles := blockRLEs{}
+	for x := int32(0); x < 3; x++ {
+		block := dvid.IndexZYX{x, 1, -2}
+		start := dvid.Point3d{x * 32, 32, -64}
+		rles[string(block.Bytes())] = dvid.RLEs{
+			dvid.NewRLE(start, 5),
+			dvid.NewRLE(dvid.Point3d{start[0] + 3, start[1] + 1, start[2]}, 20),
+			dvid.NewRLE(dvid.Point3d{start[0], start[1], start[2] + 7}, 32),
+		}
+	}
+	putSyntheticRLEs(t, sourceCtx, 4123, rles)
+	other := dvid.IndexZYX{5, 5, 5}
+	putSyntheticRLEs(t, targetCtx, 17, blockRLEs{string(other.Bytes()): {dvid.NewRLE(dvid.Point3d{160, 160, 160}, 3)}})
+
+	var dump bytes.Buffer
+	numBlocks, err := source.DumpLabel(sourceCtx, 4123, &dump)
+	if err != nil || numBlocks != 3 {
+		t.Fatalf("Expected dump of 3 blocks, got %d, %v\n", numBlocks, err)
+	}
+	header, _, err := readLabelDump(bytes.NewReader(dump.Bytes()))
+	if err != nil {
+		t.Fatalf("Unable to read dump: %s\n", err.Error())
+	}
+	if header.Data != "reportedlabels" || header.UUID != uuid || header.Label != 4123 || !header.BlockSize.Equals(dvid.Point3d{32, 32, 32}) {
+		t.Errorf("Bad dump header: %+v\n", *header)
+	}
+
+	// Stored RLEs of the restored label are identical to the dumped ones.
+	checkRestored := func(label uint64) {
+		for blockStr, expected := range rles {
+			var block dvid.IndexZYX
+			if err := block.IndexFromBytes([]byte(blockStr)); err != nil {
+				t.Fatalf("Bad block: %s\n", err.Error())
+			}
+			dumped, _ := expected.MarshalBinary()
+			var restored []byte
+			ForEachBlock(targetCtx, label, nil, func(b dvid.IndexZYX, blockRLE dvid.RLEs) error {
+				if b == block {
+					restored, _ = blockRLE.MarshalBinary()
+				}
+				return nil
+			})
+			if !bytes.Equal(dumped, restored) {
+				t.Errorf("Restored RLEs of label %d in block %s differ from dumped ones\n", label, &block)
+			}
+		}
+		numVoxels, _, numBlocks, err := CountLabel(targetCtx, label)
+		if err != nil || numVoxels != rles.numVoxels() || numBlocks != 3 {
+			t.Errorf("Expected %d voxels in 3 blocks for label %d, got %d in %d, %v\n", rles.numVoxels(), label, numVoxels, numBlocks, err)
+		}
+		if sizes, err := getAllLabelSizes(targetCtx); err != nil || sizes[label] != rles.numVoxels() {
+			t.Errorf("Expected size %d of restored label %d, got %v, %v\n", rles.numVoxels(), label, sizes, err)
+		}
+	}
+	restore, err := target.RestoreLabel(targetCtx, bytes.NewReader(dump.Bytes()), 0, false)
+	if err != nil {
+		t.Fatalf("Unable to restore label: %s\n", err.Error())
+	}
+	if *restore != (LabelRestore{4123, 4123, 3, rles.numVoxels(), false}) {
+		t.Errorf("Unexpected restore: %+v\n", *restore)
+	}
+	checkRestored(4123)
+
+	// Dumping the restored label gives the same records.
+	var redump bytes.Buffer
+	if _, err := target.DumpLabel(targetCtx, 4123, &redump); err != nil {
+		t.Fatalf("Unable to dump restored label: %s\n", err.Error())
+	}
+	records := func(b []byte) []byte {
+		headerLength := binary.LittleEndian.Uint32(b[len(labelDumpMagic):])
+		return b[len(labelDumpMagic)+4+int(headerLength):]
+	}
+	if !bytes.Equal(records(dump.Bytes()), records(redump.Bytes())) {
+		t.Errorf("Expected dump of restored label to have the same records\n")
+	}
+
+	// Existing labels aren't overwritten without force, and ids can be remapped.
+	if _, err := target.RestoreLabel(targetCtx, bytes.NewReader(dump.Bytes()), 17, false); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("Expected error restoring over existing label, got %v\n", err)
+	}
+	if restore, err = target.RestoreLabel(targetCtx, bytes.NewReader(dump.Bytes()), 17, true); err != nil || !restore.Replaced {
+		t.Fatalf("Expected forced restore over label 17, got %v, %v\n", restore, err)
+	}
+	checkRestored(17)
+
+	// Corrupt, truncated, and incompatible dumps are refused.
+	corrupt := append([]byte{}, dump.Bytes()...)
+	corrupt[len(corrupt)-30] ^= 0xFF
+	if _, err := target.RestoreLabel(targetCtx, bytes.NewReader(corrupt), 99, false); err == nil || !strings.Contains(err.Error(), "Checksum") {
+		t.Errorf("Expected checksum error, got %v\n", err)
+	}
+	if _, err := target.RestoreLabel(targetCtx, bytes.NewReader(dump.Bytes()[:dump.Len()-12]), 99, false); err == nil {
+		t.Errorf("Expected error restoring truncated dump\n")
+	}
+	config := dvid.NewConfig()
+	config.Set("BlockSize", "16,16,16")
+	small, err := NewData(uuid, 392, "smallblocks", config)
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	smallCtx := datastore.NewVersionedContext(small, versionID)
+	if _, err := small.RestoreLabel(smallCtx, bytes.NewReader(dump.Bytes()), 0, false); err == nil || !strings.Contains(err.Error(), "block size") {
+		t.Errorf("Expected block size error, got %v\n", err)
+	}
+	if rles, err := getLabelRLEs(targetCtx, 99); err != nil || len(rles) != 0 {
+		t.Errorf("Expected failed restores to store nothing, got %d blocks, %v\n", len(rles), err)
+	}
+
+	// The commands dump and restore through files on the server.
+	dir, err := ioutil.TempDir("", "labeldump")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "body-4123.rles")
+	command := func(d *Data, args ...string) (string, error) {
+		request := datastore.Request{Command: append(dvid.Command{"node", string(uuid), string(d.DataName())}, args...)}
+		var reply datastore.Response
+		err := d.DoRPC(request, &reply)
+		return reply.Text, err
+	}
+	if _, err := command(source, "dump-label", "4123", filename); err != nil {
+		t.Fatalf("Unable to dump label to file: %s\n", err.Error())
+	}
+	if _, err := command(target, "restore-label", filename); err == nil {
+		t.Errorf("Expected restore-label to refuse existing label without --force\n")
+	}
+	text, err := command(target, "restore-label", filename, "8000", "--force")
+	if err != nil || !strings.Contains(text, "to label 8000") {
+		t.Fatalf("Unable to restore label from file: %q, %v\n", text, err)
+	}
+	checkRestored(8000)
+}
@@ -0,0 +1,71 @@
+package labels64
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+// Make sure JSON responses are only compressed when the client accepts gzip and that
+// the decompressed body matches the identity-encoded one.
+func TestInfoGzip(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+
+	config := dvid.NewConfig()
+	config.Set("BlockSize", "16,16,16")
+	d, err := NewData(uuid, 401, "gziplabels", config)
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewServerContext(context.Background(), repo, versionID)
+
+	get := func(acceptGzip bool) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", fmt.Sprintf("/api/node/%s/gziplabels/info", uuid), nil)
+		if acceptGzip {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		d.ServeHTTP(ctx, w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Bad status %d for info: %s\n", w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	identity := get(false)
+	if enc := identity.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expected no content encoding without Accept-Encoding, got %q\n", enc)
+	}
+	compressed := get(true)
+	if enc := compressed.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Expected gzip content encoding, got %q\n", enc)
+	}
+	if ct := compressed.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type for compressed info, got %q\n", ct)
+	}
+	zr, err := gzip.NewReader(compressed.Body)
+	if err != nil {
+		t.Fatalf("Unable to read gzip info response: %s\n", err.Error())
+	}
+	decoded, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Unable to decompress info response: %s\n", err.Error())
+	}
+	if !bytes.Equal(decoded, identity.Body.Bytes()) {
+		t.Errorf("Decompressed info differs from identity response:\n%s\n%s\n", decoded, identity.Body.Bytes())
+	}
+}
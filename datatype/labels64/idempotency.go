@@ -0,0 +1,167 @@
+/*
+	This file supports idempotency keys that make retries of label operations safe.  The
+	result of an operation submitted with a key is stored, and a retry with the same key
+	returns the stored result instead of executing the operation again.
+*/
+
+package labels64
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// DefaultOpKeyWindow is how long the results of keyed operations are kept for data
+// without an OpKeyWindow setting.
+const DefaultOpKeyWindow = 24 * time.Hour
+
+// MaxOpKeyLength is the longest idempotency key accepted.
+const MaxOpKeyLength = 255
+
+// opKeyRecord is the stored result of an operation submitted with an idempotency key.
+// Digest identifies the request so a key reused for a different request is refused.
+type opKeyRecord struct {
+	Key     string
+	Version dvid.VersionID
+	Time    time.Time
+	Digest  string
+	Result  json.RawMessage
+}
+
+// opCall is an operation in progress for an idempotency key.  Duplicate submissions
+// wait on done and then share its outcome.
+type opCall struct {
+	done   chan struct{}
+	result []byte
+	err    error
+}
+
+var (
+	// opCallsMu guards opCalls.
+	opCallsMu sync.Mutex
+
+	// opCalls holds the keyed operations in progress by data instance, version, and key.
+	opCalls = make(map[string]*opCall)
+)
+
+func (d *Data) opKeyWindow() time.Duration {
+	if d.OpKeyWindow <= 0 {
+		return DefaultOpKeyWindow
+	}
+	return d.OpKeyWindow
+}
+
+// requestDigest returns a digest of a request's payload and the options that change how
+// it is executed.
+func requestDigest(payload []byte, options ...string) string {
+	h := sha1.New()
+	h.Write(payload)
+	for _, option := range options {
+		h.Write([]byte{0})
+		h.Write([]byte(option))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getOpKey returns the unexpired record stored for the key at the context's version or nil
+// if there is none.
+func (d *Data) getOpKey(ctx *datastore.VersionedContext, key string) (*opKeyRecord, error) {
+	smalldata, err := acquireSmallData()
+	if err != nil {
+		return nil, err
+	}
+	value, err := smalldata.Get(ctx, voxels.NewLabelOpKeyIndex(key))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	var record opKeyRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, fmt.Errorf("Bad record for idempotency key %q: %s", key, err.Error())
+	}
+	// Records of ancestor versions were for operations on other versions.
+	if record.Version != ctx.VersionID() || time.Since(record.Time) > d.opKeyWindow() {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+func (d *Data) putOpKey(ctx *datastore.VersionedContext, record *opKeyRecord) error {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return smalldata.Put(ctx, voxels.NewLabelOpKeyIndex(record.Key), value)
+}
+
+// doKeyedOp executes op unless an operation with the same idempotency key already
+// completed at the context's version within the key window, in which case the earlier
+// result is returned and replayed is true.  Submissions of a key that is in progress wait
+// for it and share its outcome.  Only successful results are stored, so an operation that
+// failed is executed again on retry.  A key reused for a request with a different digest
+// returns a conflict error.  An empty key always executes op.
+func (d *Data) doKeyedOp(ctx *datastore.VersionedContext, key, digest string, op func() ([]byte, error)) (result []byte, replayed bool, err error) {
+	if key == "" {
+		result, err = op()
+		return
+	}
+	if len(key) > MaxOpKeyLength {
+		return nil, false, server.NewError(server.BadRequestError, "Idempotency key is longer than %d bytes", MaxOpKeyLength)
+	}
+	callKey := fmt.Sprintf("%d/%d/%s", d.InstanceID(), ctx.VersionID(), key)
+	opCallsMu.Lock()
+	if call, found := opCalls[callKey]; found {
+		opCallsMu.Unlock()
+		<-call.done
+		return call.result, call.err == nil, call.err
+	}
+	call := &opCall{done: make(chan struct{})}
+	opCalls[callKey] = call
+	opCallsMu.Unlock()
+
+	defer func() {
+		call.result, call.err = result, err
+		opCallsMu.Lock()
+		delete(opCalls, callKey)
+		opCallsMu.Unlock()
+		close(call.done)
+	}()
+
+	record, err := d.getOpKey(ctx, key)
+	if err != nil {
+		return nil, false, storeUnavailable(err)
+	}
+	if record != nil {
+		if record.Digest != digest {
+			return nil, false, server.NewError(server.ConflictError,
+				"Idempotency key %q was already used for a different request", key)
+		}
+		return record.Result, true, nil
+	}
+	if result, err = op(); err != nil {
+		return nil, false, err
+	}
+	record = &opKeyRecord{
+		Key:     key,
+		Version: ctx.VersionID(),
+		Time:    time.Now(),
+		Digest:  digest,
+		Result:  json.RawMessage(result),
+	}
+	if err := d.putOpKey(ctx, record); err != nil {
+		dvid.Errorf("Unable to store result for idempotency key %q of data %q: %s\n", key, d.DataName(), err.Error())
+	}
+	return result, false, nil
+}
@@ -0,0 +1,145 @@
+package labels64
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestMergeIdempotency(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+	defer func() {
+		mergeFailpoint = nil
+	}()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 320, "keyedlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	defer d.waitFinishing()
+	ctx := datastore.NewVersionedContext(d, versionID)
+	putLabel := func(label uint64) {
+		block := dvid.IndexZYX{int32(label), 0, 0}
+		rles := blockRLEs{string(block.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{int32(label) * 32, 0, 0}, 10)}}
+		if err := putLabelRLEs(ctx, label, rles, map[string]bool{string(block.Bytes()): true}); err != nil {
+			t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+		}
+	}
+	for label := uint64(1); label <= 4; label++ {
+		putLabel(label)
+	}
+
+	// Strict merges fail if repeated, so only replayed results succeed.
+	merge := func(body, key string) *httptest.ResponseRecorder {
+		apiStr := fmt.Sprintf("%snode/%s/keyedlabels/merge?strict=true", server.WebAPIPath, uuid)
+		r, _ := http.NewRequest("POST", apiStr, strings.NewReader(body))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+		return w
+	}
+
+	// A retry after success returns the original result without merging again.
+	w := merge("[[1, 2]]", "merge-a")
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("Bad merge response: %d %s\n", w.Code, w.Body.String())
+	}
+	original := w.Body.String()
+	w = merge("[[1, 2]]", "merge-a")
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "true" || w.Body.String() != original {
+		t.Errorf("Expected replayed merge result %s, got %d %s\n", original, w.Code, w.Body.String())
+	}
+	if w = merge("[[1, 2]]", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected unkeyed repeat of strict merge to fail, got %d\n", w.Code)
+	}
+
+	// A key can't be reused for a different merge.
+	if w = merge("[[1, 3]]", "merge-a"); w.Code != http.StatusConflict {
+		t.Errorf("Expected conflict for reused key, got %d %s\n", w.Code, w.Body.String())
+	}
+
+	// A retry after failure executes the merge again.
+	if w = merge("[[3, 5]]", "merge-b"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected strict merge with missing label to fail, got %d %s\n", w.Code, w.Body.String())
+	}
+	putLabel(5)
+	if w = merge("[[3, 5]]", "merge-b"); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Expected retry of failed merge to execute, got %d %s\n", w.Code, w.Body.String())
+	}
+
+	// Concurrent duplicate submissions wait for the first and share its result.
+	var executed int32
+	release := make(chan struct{})
+	mergeFailpoint = func(step string) error {
+		if step == "intent" {
+			atomic.AddInt32(&executed, 1)
+			<-release
+		}
+		return nil
+	}
+	const numDuplicates = 4
+	responses := make([]*httptest.ResponseRecorder, numDuplicates)
+	var wg sync.WaitGroup
+	for i := 0; i < numDuplicates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = merge("[[4, 1]]", "merge-c")
+		}(i)
+	}
+	for atomic.LoadInt32(&executed) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	mergeFailpoint = nil
+	if n := atomic.LoadInt32(&executed); n != 1 {
+		t.Errorf("Expected duplicate merges to execute once, executed %d times\n", n)
+	}
+	var numReplayed int
+	for _, w := range responses {
+		if w.Code != http.StatusOK || w.Body.String() != responses[0].Body.String() {
+			t.Errorf("Expected identical results for duplicate merges, got %d %s\n", w.Code, w.Body.String())
+		}
+		if w.Header().Get("Idempotent-Replayed") == "true" {
+			numReplayed++
+		}
+	}
+	if numReplayed != numDuplicates-1 {
+		t.Errorf("Expected %d replayed duplicate merges, got %d\n", numDuplicates-1, numReplayed)
+	}
+
+	// Keys expire after the window.
+	d.OpKeyWindow = time.Nanosecond
+	if w = merge("[[1, 2]]", "merge-a"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected expired key to execute the merge again, got %d %s\n", w.Code, w.Body.String())
+	}
+
+	config := dvid.NewConfig()
+	config.Set("OpKeyWindow", "-1h")
+	if err := d.ModifyConfig(config); err == nil {
+		t.Errorf("Expected error for negative OpKeyWindow\n")
+	}
+	config.Set("OpKeyWindow", "2h")
+	if err := d.ModifyConfig(config); err != nil || d.opKeyWindow() != 2*time.Hour {
+		t.Errorf("Unable to modify OpKeyWindow: %v\n", err)
+	}
+}
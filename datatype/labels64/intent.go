@@ -0,0 +1,438 @@
+/*
+	This file supports write-ahead intent records that make label operations crash-safe.
+	An intent is stored before an operation first modifies data and deleted after its last
+	modification, so intents remaining when an instance is loaded mark interrupted
+	operations, which are rolled forward or flagged for repair.
+*/
+
+package labels64
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Phases of a merge recorded in its intent.
+const (
+	// intentMergeRLEs is the phase where target label RLEs are extended by the merged
+	// labels' RLEs and then the merged labels' RLEs and surfaces are deleted.  Since
+	// target RLEs are written first, an interrupted merge may have RLEs for both merged
+	// and target labels but never loses voxels.
+	intentMergeRLEs = "merge-rles"
+
+	// intentRelabel is the phase where the sparse volumes are complete and the label
+	// sizes and label blocks are being updated.
+	intentRelabel = "relabel"
+)
+
+// mergeFailpoint, if non-nil, is called after each step of a merge and can return an
+// error to simulate a crash at that step.
+var mergeFailpoint func(step string) error
+
+func checkMergeFailpoint(step string) error {
+	if mergeFailpoint == nil {
+		return nil
+	}
+	return mergeFailpoint(step)
+}
+
+// intentSize is a label size change recorded in an intent.
+type intentSize struct {
+	Label   uint64
+	OldSize uint64
+	NewSize uint64
+}
+
+// mergeIntent is the write-ahead record of a merge.  It holds everything needed to roll
+// the merge forward: the flattened merge tuples, the changed blocks, and the size changes,
+// along with the user who requested it and the summary of each target for the merge log.
+// Intents stored before users or targets were recorded decode with them empty.
+type mergeIntent struct {
+	ID       uint64
+	Op       string
+	Phase    string
+	Tuples   MergeTuples
+	Blocks   []dvid.IndexZYX
+	Sizes    []intentSize
+	User     string        `json:",omitempty"`
+	Override bool          `json:",omitempty"`
+	Targets  []MergeTarget `json:",omitempty"`
+}
+
+var lastIntentID uint64
+
+// intentMu guards the intent state of all data instances.
+var intentMu sync.Mutex
+
+// newIntentID returns a unique id for an intent that increases with time.
+func newIntentID() uint64 {
+	for {
+		last := atomic.LoadUint64(&lastIntentID)
+		id := uint64(time.Now().UnixNano())
+		if id <= last {
+			id = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&lastIntentID, last, id) {
+			return id
+		}
+	}
+}
+
+func (intent *mergeIntent) setBlocks(blocksChanged map[string]bool) error {
+	intent.Blocks = make([]dvid.IndexZYX, 0, len(blocksChanged))
+	for blockStr := range blocksChanged {
+		var block dvid.IndexZYX
+		if err := block.IndexFromBytes([]byte(blockStr)); err != nil {
+			return err
+		}
+		intent.Blocks = append(intent.Blocks, block)
+	}
+	return nil
+}
+
+func (intent *mergeIntent) blocksChanged() map[string]bool {
+	blocksChanged := make(map[string]bool, len(intent.Blocks))
+	for _, block := range intent.Blocks {
+		blocksChanged[string(block.Bytes())] = true
+	}
+	return blocksChanged
+}
+
+func (intent *mergeIntent) setSizes(sizeMods map[uint64]sizeChange) {
+	intent.Sizes = make([]intentSize, 0, len(sizeMods))
+	for label, change := range sizeMods {
+		intent.Sizes = append(intent.Sizes, intentSize{label, change.oldSize, change.newSize})
+	}
+}
+
+func (intent *mergeIntent) sizeMods() map[uint64]sizeChange {
+	sizeMods := make(map[uint64]sizeChange, len(intent.Sizes))
+	for _, size := range intent.Sizes {
+		sizeMods[size.Label] = sizeChange{size.OldSize, size.NewSize}
+	}
+	return sizeMods
+}
+
+func (intent *mergeIntent) remapping() map[uint64]uint64 {
+	remapping := make(map[uint64]uint64)
+	for _, tuple := range intent.Tuples {
+		for _, fromLabel := range tuple[1:] {
+			remapping[fromLabel] = tuple[0]
+		}
+	}
+	return remapping
+}
+
+// labels returns all labels of the merge tuples.
+func (intent *mergeIntent) labels() map[uint64]bool {
+	labels := make(map[uint64]bool)
+	for _, tuple := range intent.Tuples {
+		for _, label := range tuple {
+			labels[label] = true
+		}
+	}
+	return labels
+}
+
+// PendingIntent describes an interrupted label operation that needs repair.
+type PendingIntent struct {
+	ID    uint64
+	UUID  dvid.UUID
+	Op    string
+	Phase string
+	Error string
+	User  string `json:",omitempty"`
+}
+
+// RepairResult summarizes an attempt to repair interrupted label operations.
+type RepairResult struct {
+	Recovered    int
+	RepairNeeded []PendingIntent
+}
+
+// putIntent stores an intent at the context's version.
+func (d *Data) putIntent(ctx *datastore.VersionedContext, intent *mergeIntent) error {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	serialization, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+	if err := smalldata.Put(ctx, voxels.NewLabelIntentIndex(intent.ID), serialization); err != nil {
+		return fmt.Errorf("Unable to store intent of %s op: %s", intent.Op, err.Error())
+	}
+	return nil
+}
+
+// deleteIntent removes a completed operation's intent.
+func (d *Data) deleteIntent(ctx *datastore.VersionedContext, id uint64) error {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	return smalldata.Delete(ctx, voxels.NewLabelIntentIndex(id))
+}
+
+// storedIntent is an intent and the version it was stored at.
+type storedIntent struct {
+	versionID dvid.VersionID
+	intent    *mergeIntent
+	err       error // set if the intent couldn't be decoded
+}
+
+// getIntents returns the intents stored at every version of the data instance.
+func (d *Data) getIntents() ([]storedIntent, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	// Read the full keys for all versions without a versioned context.
+	ctx := storage.NewDataContext(d, 0)
+	minKey, err := ctx.MinVersionKey(voxels.NewLabelIntentIndex(0))
+	if err != nil {
+		return nil, err
+	}
+	maxKey, err := ctx.MaxVersionKey(voxels.NewLabelIntentIndex(math.MaxUint64))
+	if err != nil {
+		return nil, err
+	}
+	kvs, err := smalldata.GetRange(nil, minKey, maxKey)
+	if err != nil {
+		return nil, err
+	}
+	intents := make([]storedIntent, len(kvs))
+	for i, kv := range kvs {
+		_, versionID, err := storage.KeyToLocalIDs(kv.K)
+		if err != nil {
+			return nil, err
+		}
+		intents[i].versionID = versionID
+		intents[i].intent = new(mergeIntent)
+		if err := json.Unmarshal(kv.V, intents[i].intent); err != nil {
+			indexBytes, err := ctx.IndexFromKey(kv.K)
+			if err != nil || len(indexBytes) != 9 {
+				return nil, fmt.Errorf("Bad intent key %v", kv.K)
+			}
+			intents[i].intent.ID = binary.BigEndian.Uint64(indexBytes[1:9])
+			intents[i].err = fmt.Errorf("Unable to decode intent: %s", err.Error())
+		}
+	}
+	return intents, nil
+}
+
+// needsRepair flags an interrupted operation for repair.
+func (d *Data) needsRepair(versionID dvid.VersionID, intent *mergeIntent, err error) {
+	uuid, _ := datastore.UUIDFromVersion(versionID)
+	intentMu.Lock()
+	if d.repairNeeded == nil {
+		d.repairNeeded = make(map[uint64]PendingIntent)
+	}
+	d.repairNeeded[intent.ID] = PendingIntent{intent.ID, uuid, intent.Op, intent.Phase, err.Error(), intent.User}
+	intentMu.Unlock()
+	dvid.Errorf("Labels64 %q %s op (intent %d) by %q on version %s needs repair: %s\n", d.DataName(), intent.Op, intent.ID,
+		intent.User, uuid, err.Error())
+}
+
+// pendingIntents returns the interrupted operations that need repair.
+func (d *Data) pendingIntents() []PendingIntent {
+	intentMu.Lock()
+	defer intentMu.Unlock()
+	var pending []PendingIntent
+	for _, p := range d.repairNeeded {
+		pending = append(pending, p)
+	}
+	return pending
+}
+
+// setFinishing notes whether an operation is finishing in the background, so repairs
+// don't roll it forward concurrently.
+func (d *Data) setFinishing(id uint64, finishing bool) {
+	intentMu.Lock()
+	if d.finishing == nil {
+		d.finishing = make(map[uint64]bool)
+	}
+	if finishing {
+		if len(d.finishing) == 0 {
+			d.finished = make(chan struct{})
+		}
+		d.finishing[id] = true
+	} else if d.finishing[id] {
+		delete(d.finishing, id)
+		if len(d.finishing) == 0 {
+			close(d.finished)
+		}
+	}
+	intentMu.Unlock()
+}
+
+func (d *Data) isFinishing(id uint64) bool {
+	intentMu.Lock()
+	defer intentMu.Unlock()
+	return d.finishing[id]
+}
+
+// mergesFinishing returns true if any operation is finishing in the background.
+func (d *Data) mergesFinishing() bool {
+	intentMu.Lock()
+	defer intentMu.Unlock()
+	return len(d.finishing) != 0
+}
+
+// waitFinishing blocks until no operations are finishing in the background.
+func (d *Data) waitFinishing() {
+	intentMu.Lock()
+	finished := d.finished
+	busy := len(d.finishing) != 0
+	intentMu.Unlock()
+	if busy {
+		<-finished
+	}
+}
+
+// rollForward completes an interrupted operation from its intent.
+func (d *Data) rollForward(ctx *datastore.VersionedContext, intent *mergeIntent) error {
+	switch intent.Op {
+	case "merge":
+	case "trash":
+		return d.finishTrash(ctx, intent)
+	case "restore":
+		_, err := d.finishRestore(ctx, intent)
+		return err
+	default:
+		return fmt.Errorf("Unable to roll forward unknown %q op", intent.Op)
+	}
+	switch intent.Phase {
+	case intentMergeRLEs:
+		for _, tuple := range intent.Tuples {
+			if len(tuple) == 0 {
+				return fmt.Errorf("Empty merge tuple in intent")
+			}
+			if err := d.remergeRLEs(ctx, tuple, d.journalOp(intent)); err != nil {
+				return err
+			}
+		}
+		intent.Phase = intentRelabel
+		if err := d.putIntent(ctx, intent); err != nil {
+			return err
+		}
+		fallthrough
+	case intentRelabel:
+		return d.finishMerge(ctx, intent)
+	default:
+		return fmt.Errorf("Unable to roll forward merge in unknown phase %q", intent.Phase)
+	}
+}
+
+// remergeRLEs adds any remaining RLEs of a tuple's merged labels to its target label and
+// deletes the merged labels.  Since adding RLEs already in the target changes nothing,
+// this can be repeated.  Block mutations are journaled if the journal op isn't nil.
+func (d *Data) remergeRLEs(ctx *datastore.VersionedContext, tuple MergeTuple, op *journalOp) error {
+	toLabel := tuple[0]
+	toLabelRLEs, err := getLabelRLEs(ctx, toLabel)
+	if err != nil {
+		return err
+	}
+	blocksChanged := make(map[string]bool)
+	var fromLabels []uint64
+	fromBlocks := make(map[uint64]map[string]bool)
+	for _, fromLabel := range tuple[1:] {
+		fromLabelRLEs, err := getLabelRLEs(ctx, fromLabel)
+		if err != nil {
+			return err
+		}
+		if len(fromLabelRLEs) == 0 {
+			continue
+		}
+		for blockStr, fromRLEs := range fromLabelRLEs {
+			toRLEs := toLabelRLEs[blockStr]
+			toRLEs.Add(fromRLEs)
+			toLabelRLEs[blockStr] = toRLEs
+			blocksChanged[blockStr] = true
+		}
+		fromLabels = append(fromLabels, fromLabel)
+		fromBlocks[fromLabel] = fromLabelRLEs.blocks()
+	}
+	if err := putJournaledRLEs(ctx, toLabel, toLabelRLEs, blocksChanged, op); err != nil {
+		return err
+	}
+	for _, fromLabel := range fromLabels {
+		if err := deleteJournaledBlocks(ctx, fromLabel, fromBlocks[fromLabel], op); err != nil {
+			return err
+		}
+	}
+	if len(fromLabels) != 0 {
+		d.recomputeSurface(ctx, toLabel, toLabelRLEs)
+	}
+	return nil
+}
+
+// Recover rolls forward label operations interrupted before the instance was loaded.
+// Operations that can't be rolled forward are flagged for repair.
+func (d *Data) Recover() error {
+	result, err := d.Repair()
+	if err != nil {
+		return err
+	}
+	if result.Recovered != 0 {
+		dvid.Infof("Recovered %d interrupted label operations for labels64 %q\n", result.Recovered, d.DataName())
+	}
+	if len(result.RepairNeeded) != 0 {
+		return fmt.Errorf("%d interrupted label operations need repair", len(result.RepairNeeded))
+	}
+	return nil
+}
+
+// Repair tries to roll forward all interrupted label operations, except those still
+// finishing in the background, and returns the operations that still need repair.
+func (d *Data) Repair() (*RepairResult, error) {
+	intents, err := d.getIntents()
+	if err != nil {
+		return nil, err
+	}
+	// Operations flagged earlier but no longer stored have been completed.
+	stored := make(map[uint64]bool, len(intents))
+	for _, s := range intents {
+		stored[s.intent.ID] = true
+	}
+	intentMu.Lock()
+	for id := range d.repairNeeded {
+		if !stored[id] {
+			delete(d.repairNeeded, id)
+		}
+	}
+	intentMu.Unlock()
+
+	result := new(RepairResult)
+	for _, stored := range intents {
+		if d.isFinishing(stored.intent.ID) {
+			continue
+		}
+		err := stored.err
+		if err == nil {
+			ctx := datastore.NewVersionedContext(d, stored.versionID)
+			err = d.rollForward(ctx, stored.intent)
+		}
+		if err != nil {
+			d.needsRepair(stored.versionID, stored.intent, err)
+			continue
+		}
+		intentMu.Lock()
+		delete(d.repairNeeded, stored.intent.ID)
+		intentMu.Unlock()
+		result.Recovered++
+	}
+	result.RepairNeeded = d.pendingIntents()
+	return result, nil
+}
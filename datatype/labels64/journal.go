@@ -0,0 +1,276 @@
+/*
+	This file supports the optional journal of label block RLE mutations.  When the Journal
+	setting is true, each put or delete of a label's RLEs in a block by a merge is written
+	in the same batch as an entry giving the merge's id, the kind of operation, and a hash
+	of the block's prior RLEs, so how a label's block evolved can be inspected when a body's
+	shape is wrong.  If JournalValues is also true, entries keep the prior RLEs until they
+	are pruned after the JournalRetention period.
+*/
+
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// DefaultJournalRetention is how long journal entries keep prior RLEs if the
+// JournalRetention setting is 0.
+const DefaultJournalRetention = 7 * 24 * time.Hour
+
+// JournalPruneInterval is the shortest time between background prunes of the prior RLEs
+// of expired journal entries of a data instance.
+var JournalPruneInterval = time.Hour
+
+// journalMu guards lastJournalPrune, the time each data instance's journal was last pruned.
+var (
+	journalMu        sync.Mutex
+	lastJournalPrune = make(map[dvid.InstanceID]time.Time)
+)
+
+// Actions of journaled block mutations.
+const (
+	JournalPut    = "put"
+	JournalDelete = "delete"
+)
+
+// JournalEntry is the journal record of a mutation of a label's RLEs in a block.  Mutation
+// is the id of the operation, which for merges is also the id of its merge log record, and
+// PriorHash is the FNV-1a hash of the block's RLEs before the mutation, or empty if the
+// label had no RLEs in the block.  Prior holds those RLEs if values are journaled and the
+// entry hasn't been pruned.
+type JournalEntry struct {
+	Mutation  uint64    `json:"mutation"`
+	Op        string    `json:"op"`
+	Action    string    `json:"action"`
+	Time      time.Time `json:"time"`
+	PriorHash string    `json:"prior_hash,omitempty"`
+	Prior     []byte    `json:"prior,omitempty"`
+}
+
+// BlockMutation is a journaled mutation and, if the operation was logged, e.g., a
+// completed merge, its record in the merge log.
+type BlockMutation struct {
+	JournalEntry
+	Merge *mergeRecord `json:"merge,omitempty"`
+}
+
+// BlockHistory lists the journaled mutations of a label's RLEs in a block at a version and
+// its ancestors, oldest first.
+type BlockHistory struct {
+	Label     uint64          `json:"label"`
+	Block     dvid.IndexZYX   `json:"block"`
+	Mutations []BlockMutation `json:"mutations"`
+}
+
+// journalOp is an operation whose block mutations are journaled.
+type journalOp struct {
+	id         uint64
+	op         string
+	keepValues bool
+}
+
+// journalOp returns the journal op of a label operation, or nil if the data instance
+// doesn't journal mutations.
+func (d *Data) journalOp(intent *mergeIntent) *journalOp {
+	if !d.Journal {
+		return nil
+	}
+	return &journalOp{intent.ID, intent.Op, d.JournalValues}
+}
+
+// journalRetention returns how long journal entries keep prior RLEs.
+func (d *Data) journalRetention() time.Duration {
+	if d.JournalRetention > 0 {
+		return d.JournalRetention
+	}
+	return DefaultJournalRetention
+}
+
+// hashRLEs returns the FNV-1a hash of serialized RLEs in hexadecimal.
+func hashRLEs(rles []byte) string {
+	h := fnv.New64a()
+	h.Write(rles)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// journal adds to the batch the entry of a mutation of a label's RLEs in a block, so it's
+// written with the mutation itself.  Mutations already journaled, e.g., by a merge being
+// rolled forward, aren't journaled again so their prior RLEs are kept.
+func (op *journalOp) journal(ctx *datastore.VersionedContext, smalldata storage.SmallDataStorer,
+	batch storage.Batch, label uint64, blockBytes []byte, action string) error {
+
+	if op == nil {
+		return nil
+	}
+	index := voxels.NewLabelBlockJournalIndex(label, blockBytes, op.id)
+	existing, err := smalldata.Get(ctx, index)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return nil
+	}
+	rleIndex := voxels.NewLabelSpatialMapIndex(label, blockBytes)
+	prior, err := smalldata.Get(ctx, rleIndex)
+	if err != nil {
+		return err
+	}
+	entry := JournalEntry{Mutation: op.id, Op: op.op, Action: action, Time: time.Now()}
+	if prior != nil {
+		if prior, err = expandStoredRLEs(ctx, ctx.ConstructKey(rleIndex), prior); err != nil {
+			return err
+		}
+		entry.PriorHash = hashRLEs(prior)
+		if op.keepValues {
+			entry.Prior = prior
+		}
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	batch.Put(index, value)
+	return nil
+}
+
+// GetBlockHistory returns the journaled mutations of a label's RLEs in a block at the
+// context's version and its ancestors.
+func (d *Data) GetBlockHistory(ctx *datastore.VersionedContext, label uint64, block dvid.IndexZYX) (*BlockHistory, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	blockBytes := block.Bytes()
+	begIndex := voxels.NewLabelBlockJournalIndex(label, blockBytes, 0)
+	endIndex := voxels.NewLabelBlockJournalIndex(label, blockBytes, math.MaxUint64)
+	history := &BlockHistory{Label: label, Block: block, Mutations: []BlockMutation{}}
+	var f storage.ChunkProcessor = func(chunk *storage.Chunk) error {
+		var mutation BlockMutation
+		if err := json.Unmarshal(chunk.V, &mutation.JournalEntry); err != nil {
+			return fmt.Errorf("Bad journal entry %v: %s", chunk.K, err.Error())
+		}
+		history.Mutations = append(history.Mutations, mutation)
+		return nil
+	}
+	if err := smalldata.ProcessRange(ctx, begIndex, endIndex, &storage.ChunkOp{}, f); err != nil {
+		return nil, err
+	}
+	for i, mutation := range history.Mutations {
+		value, err := smalldata.Get(ctx, voxels.NewLabelMergeLogIndex(mutation.Mutation))
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		var record mergeRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return nil, fmt.Errorf("Bad merge log record %d: %s", mutation.Mutation, err.Error())
+		}
+		history.Mutations[i].Merge = &record
+	}
+	return history, nil
+}
+
+// PruneJournal drops the prior RLEs of the journal entries of all versions that were
+// written before the retention period ending at the given time, returning the number of
+// entries pruned.
+func (d *Data) PruneJournal(now time.Time) (int, error) {
+	if err := d.checkWritable(); err != nil {
+		return 0, err
+	}
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return 0, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	batcher, ok := smalldata.(storage.KeyValueBatcher)
+	if !ok {
+		return 0, fmt.Errorf("Database doesn't support Batch ops in PruneJournal()")
+	}
+
+	// Read the full keys of all versions without a versioned context.
+	dataCtx := storage.NewDataContext(d, 0)
+	minKey, err := dataCtx.MinVersionKey(voxels.NewLabelBlockJournalIndex(0, dvid.MinIndexZYX.Bytes(), 0))
+	if err != nil {
+		return 0, err
+	}
+	maxKey, err := dataCtx.MaxVersionKey(voxels.NewLabelBlockJournalIndex(math.MaxUint64, dvid.MaxIndexZYX.Bytes(), math.MaxUint64))
+	if err != nil {
+		return 0, err
+	}
+	cutoff := uint64(now.Add(-d.journalRetention()).UnixNano())
+	var pruned, batched int
+	batch := batcher.NewBatch(nil)
+	var f storage.ChunkProcessor = func(chunk *storage.Chunk) error {
+		_, _, id, err := voxels.DecodeLabelBlockJournalKey(chunk.K)
+		if err != nil {
+			return err
+		}
+		if id >= cutoff {
+			return nil
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(chunk.V, &entry); err != nil {
+			return fmt.Errorf("Bad journal entry %v: %s", chunk.K, err.Error())
+		}
+		if entry.Prior == nil {
+			return nil
+		}
+		entry.Prior = nil
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		batch.Put(append([]byte{}, chunk.K...), value)
+		pruned++
+		if batched++; batched >= CompactBatchSize {
+			if err := batch.Commit(); err != nil {
+				return fmt.Errorf("Unable to write journal batch: %s", err.Error())
+			}
+			batch, batched = batcher.NewBatch(nil), 0
+		}
+		return nil
+	}
+	if err := smalldata.ProcessRange(nil, minKey, maxKey, &storage.ChunkOp{}, f); err != nil {
+		return pruned, err
+	}
+	if err := batch.Commit(); err != nil {
+		return pruned, fmt.Errorf("Unable to write journal batch: %s", err.Error())
+	}
+	return pruned, nil
+}
+
+// pruneJournalInBackground prunes the journal in a goroutine if values are journaled and
+// the journal wasn't pruned within the last JournalPruneInterval.
+func (d *Data) pruneJournalInBackground() {
+	if !d.JournalValues || d.ReadOnly {
+		return
+	}
+	journalMu.Lock()
+	if time.Since(lastJournalPrune[d.InstanceID()]) < JournalPruneInterval {
+		journalMu.Unlock()
+		return
+	}
+	lastJournalPrune[d.InstanceID()] = time.Now()
+	journalMu.Unlock()
+	go func() {
+		pruned, err := d.PruneJournal(time.Now())
+		if err != nil {
+			dvid.Errorf("Unable to prune journal of labels64 %q: %s\n", d.DataName(), err.Error())
+			return
+		}
+		if pruned != 0 {
+			dvid.Infof("Pruned prior RLEs of %d journal entries of labels64 %q\n", pruned, d.DataName())
+		}
+	}()
+}
@@ -0,0 +1,118 @@
+package labels64
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestBlockJournal(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	config := dvid.NewConfig()
+	config.Set("Journal", "true")
+	config.Set("JournalValues", "true")
+	d, err := NewData(uuid, 440, "journaledlabels", config)
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	if !d.Journal || !d.JournalValues || d.journalRetention() != DefaultJournalRetention {
+		t.Fatalf("Bad journal settings: %v %v %s\n", d.Journal, d.JournalValues, d.journalRetention())
+	}
+	journalMu.Lock()
+	lastJournalPrune[d.InstanceID()] = time.Now()
+	journalMu.Unlock()
+
+	ctx := datastore.NewVersionedContext(d, versionID)
+	block := dvid.IndexZYX{1, 0, 0}
+	blockStr := string(block.Bytes())
+	rles1 := blockRLEs{blockStr: dvid.RLEs{dvid.NewRLE(dvid.Point3d{32, 0, 0}, 10)}}
+	rles2 := blockRLEs{blockStr: dvid.RLEs{dvid.NewRLE(dvid.Point3d{32, 1, 0}, 10)}}
+	if err := putLabelRLEs(ctx, 1, rles1, rles1.blocks()); err != nil {
+		t.Fatalf("Unable to store label 1: %s\n", err.Error())
+	}
+	if err := putLabelRLEs(ctx, 2, rles2, rles2.blocks()); err != nil {
+		t.Fatalf("Unable to store label 2: %s\n", err.Error())
+	}
+	prior1, err := encodeLabelBlock(d, []byte(blockStr), rles1[blockStr])
+	if err != nil {
+		t.Fatalf("Unable to encode label 1 RLEs: %s\n", err.Error())
+	}
+	prior2, err := encodeLabelBlock(d, []byte(blockStr), rles2[blockStr])
+	if err != nil {
+		t.Fatalf("Unable to encode label 2 RLEs: %s\n", err.Error())
+	}
+
+	if _, err := d.MergeLabels(ctx, MergeTuples{{1, 2}}, MergeOptions{}); err != nil {
+		t.Fatalf("Unable to merge: %s\n", err.Error())
+	}
+	d.waitFinishing()
+
+	// The merge's put of label 1 and delete of label 2 are journaled with the prior RLEs and
+	// linked to the merge log.
+	check := func(label uint64, action string, prior []byte, keepValues bool) {
+		history, err := d.GetBlockHistory(ctx, label, block)
+		if err != nil {
+			t.Fatalf("Unable to get history of label %d: %s\n", label, err.Error())
+		}
+		if len(history.Mutations) != 1 {
+			t.Fatalf("Expected 1 journaled mutation of label %d, got %v\n", label, history.Mutations)
+		}
+		mutation := history.Mutations[0]
+		if mutation.Op != "merge" || mutation.Action != action || mutation.PriorHash != hashRLEs(prior) {
+			t.Errorf("Bad journal entry of label %d: %+v\n", label, mutation.JournalEntry)
+		}
+		if keepValues && !bytes.Equal(mutation.Prior, prior) {
+			t.Errorf("Expected prior RLEs of label %d to be kept, got %v\n", label, mutation.Prior)
+		}
+		if !keepValues && mutation.Prior != nil {
+			t.Errorf("Expected prior RLEs of label %d to be pruned\n", label)
+		}
+		if mutation.Merge == nil || mutation.Merge.ID != mutation.Mutation || len(mutation.Merge.Tuples) != 1 {
+			t.Errorf("Expected journal entry of label %d to link merge record, got %+v\n", label, mutation.Merge)
+		}
+	}
+	check(1, JournalPut, prior1, true)
+	check(2, JournalDelete, prior2, true)
+
+	apiStr := fmt.Sprintf("%snode/%s/journaledlabels/block-history/1/1_0_0", server.WebAPIPath, uuid)
+	r, _ := http.NewRequest("GET", apiStr, nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad response to block-history: %d %s\n", w.Code, w.Body.String())
+	}
+	var history BlockHistory
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatalf("Bad block-history JSON: %s\n", err.Error())
+	}
+	if history.Label != 1 || history.Block != block || len(history.Mutations) != 1 {
+		t.Errorf("Bad block-history response: %s\n", w.Body.String())
+	}
+
+	// Prior RLEs are dropped after the retention period while hashes are kept.
+	pruned, err := d.PruneJournal(time.Now())
+	if err != nil || pruned != 0 {
+		t.Fatalf("Expected nothing pruned within retention period, got %d, %v\n", pruned, err)
+	}
+	pruned, err = d.PruneJournal(time.Now().Add(DefaultJournalRetention + time.Hour))
+	if err != nil || pruned != 2 {
+		t.Fatalf("Expected 2 journal entries pruned, got %d, %v\n", pruned, err)
+	}
+	check(1, JournalPut, prior1, false)
+	check(2, JournalDelete, prior2, false)
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"sync"
 
@@ -30,15 +31,31 @@ func ZeroBytes() []byte {
 
 // Store the KeyLabelSpatialMap keys (index = b + s) with slice of runs for value.
 // The parameter 'blockBytes' is the byte slice representation of the block coordinate.
+// Runs that fill a block pattern are stored as sentinels if the data has DedupRLEs set.
 func StoreKeyLabelSpatialMap(versionID dvid.VersionID, data dvid.Data, batcher storage.KeyValueBatcher,
 	blockBytes []byte, labelRLEs map[uint64]dvid.RLEs) {
 
+	storeLabelSpatialMap(versionID, data, batcher, blockBytes, labelRLEs, nil)
+}
+
+// storeLabelSpatialMap stores the RLEs of labels in a block like StoreKeyLabelSpatialMap,
+// and if the mutation isn't nil, records it as the last mutation of each label in the
+// same batch.
+func storeLabelSpatialMap(versionID dvid.VersionID, data dvid.Data, batcher storage.KeyValueBatcher,
+	blockBytes []byte, labelRLEs map[uint64]dvid.RLEs, m *labelMutation) {
+
+	var mutation []byte
+	if m != nil {
+		mutation, _ = m.MarshalBinary()
+	}
 	ctx := datastore.NewVersionedContext(data, versionID)
 	batch := batcher.NewBatch(ctx)
+	rleMu.RLock()
 	defer func() {
 		if err := batch.Commit(); err != nil {
 			dvid.Infof("Error on batch PUT of KeyLabelSpatialMap: %s\n", err.Error())
 		}
+		rleMu.RUnlock()
 	}()
 	bsIndex := make([]byte, 1+8+dvid.IndexZYXSize)
 	bsIndex[0] = byte(voxels.KeyLabelSpatialMap)
@@ -46,12 +63,15 @@ func StoreKeyLabelSpatialMap(versionID dvid.VersionID, data dvid.Data, batcher s
 	for b, rles := range labelRLEs {
 		binary.BigEndian.PutUint64(bsIndex[1:9], b)
 		key := dvid.IndexBytes(bsIndex)
-		runsBytes, err := rles.MarshalBinary()
+		runsBytes, err := encodeLabelBlock(data, blockBytes, rles)
 		if err != nil {
 			dvid.Infof("Error encoding KeyLabelSpatialMap keys for mapped label %d: %s\n", b, err.Error())
 			return
 		}
 		batch.Put(key, runsBytes)
+		if mutation != nil {
+			batch.Put(voxels.NewLabelLastMutationIndex(b), mutation)
+		}
 	}
 }
 
@@ -165,37 +185,100 @@ func (brles blockRLEs) numVoxels() uint64 {
 	return size
 }
 
-// Returns RLEs for a given label where the key of the returned map is the block index
-// in string format.
-func getLabelRLEs(ctx *datastore.VersionedContext, label uint64) (blockRLEs, error) {
-	smalldata, err := storage.SmallDataStore()
-	if err != nil {
-		return nil, fmt.Errorf("Cannot get datastore that handles big data: %s\n", err.Error())
+// blocks returns the set of blocks with RLEs.
+func (brles blockRLEs) blocks() map[string]bool {
+	blocks := make(map[string]bool, len(brles))
+	for blockStr := range brles {
+		blocks[blockStr] = true
 	}
+	return blocks
+}
 
-	// Get the start/end indices for this body's KeyLabelSpatialMap (b + s) keys.
-	begIndex := voxels.NewLabelSpatialMapIndex(label, dvid.MinIndexZYX.Bytes())
-	endIndex := voxels.NewLabelSpatialMapIndex(label, dvid.MaxIndexZYX.Bytes())
+// BlockOptions restricts and configures iteration over a label's blocks by ForEachBlock.
+type BlockOptions struct {
+	// If ZBounded, only blocks with Z coordinates from MinZ to MaxZ, inclusive, are visited.
+	ZBounded   bool
+	MinZ, MaxZ int32
 
-	// Process all the b+s keys and their values, which contain RLE runs for that label.
+	// KeysOnly skips reading the RLEs of each block, which are passed as nil.
+	KeysOnly bool
+}
 
-	labelRLEs := blockRLEs{}
-	var f storage.ChunkProcessor = func(chunk *storage.Chunk) error {
-		// Get the block index where the fromLabel is present
-		_, blockBytes, err := voxels.DecodeLabelSpatialMapKey(chunk.K)
+// ForEachBlock calls f with the block coordinate and RLEs of every block containing the
+// label, in block order.  Options may be nil to visit all blocks.  Iteration stops at
+// the first error returned by f.
+func ForEachBlock(ctx storage.Context, label uint64, opts *BlockOptions, f func(block dvid.IndexZYX, rles dvid.RLEs) error) error {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	if opts == nil {
+		opts = &BlockOptions{}
+	}
+	var begIndex, endIndex dvid.IndexBytes
+	if opts.ZBounded {
+		begIndex, endIndex = voxels.LabelZRange(label, opts.MinZ, opts.MaxZ)
+	} else {
+		begIndex, endIndex = voxels.LabelRange(label)
+	}
+
+	// Get the block coordinate from a b+s key.
+	decodeBlock := func(key []byte) (dvid.IndexZYX, error) {
+		var block dvid.IndexZYX
+		_, blockBytes, err := voxels.DecodeLabelSpatialMapKey(key)
 		if err != nil {
-			return fmt.Errorf("Can't recover block index with chunk key %v: %s\n", chunk.K, err.Error())
+			return block, fmt.Errorf("Can't recover block index with chunk key %v: %s\n", key, err.Error())
 		}
-		blockStr := string(blockBytes)
+		if err := block.IndexFromBytes(blockBytes); err != nil {
+			return block, fmt.Errorf("Error decoding block coordinate (%v) for label %d: %s\n", blockBytes, label, err.Error())
+		}
+		return block, nil
+	}
 
-		var blockRLEs dvid.RLEs
-		if err := blockRLEs.UnmarshalBinary(chunk.V); err != nil {
-			return fmt.Errorf("Unable to unmarshal RLE for label in block %v", chunk.K)
+	if opts.KeysOnly {
+		keys, err := smalldata.KeysInRange(ctx, begIndex, endIndex)
+		if err != nil {
+			return fmt.Errorf("Cannot get block keys for label %d: %s", label, err.Error())
+		}
+		for _, key := range keys {
+			block, err := decodeBlock(key)
+			if err != nil {
+				return err
+			}
+			if err := f(block, nil); err != nil {
+				return err
+			}
 		}
-		labelRLEs[blockStr] = blockRLEs
 		return nil
 	}
-	err = smalldata.ProcessRange(ctx, begIndex, endIndex, &storage.ChunkOp{}, f)
+
+	// Process all the b+s keys and their values, which contain RLE runs for that label.
+	var processor storage.ChunkProcessor = func(chunk *storage.Chunk) error {
+		block, err := decodeBlock(chunk.K)
+		if err != nil {
+			return err
+		}
+		value, err := expandStoredRLEs(ctx, chunk.K, chunk.V)
+		if err != nil {
+			return err
+		}
+		var rles dvid.RLEs
+		if err := rles.UnmarshalBinary(value); err != nil {
+			return fmt.Errorf("Unable to unmarshal RLE for label in block %v", chunk.K)
+		}
+		return f(block, rles)
+	}
+	return smalldata.ProcessRange(ctx, begIndex, endIndex, &storage.ChunkOp{}, processor)
+}
+
+// Returns RLEs for a given label where the key of the returned map is the block index
+// in string format.
+func getLabelRLEs(ctx *datastore.VersionedContext, label uint64) (blockRLEs, error) {
+	labelRLEs := blockRLEs{}
+	err := ForEachBlock(ctx, label, nil, func(block dvid.IndexZYX, rles dvid.RLEs) error {
+		labelRLEs[string(block.Bytes())] = rles
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -203,6 +286,104 @@ func getLabelRLEs(ctx *datastore.VersionedContext, label uint64) (blockRLEs, err
 	return labelRLEs, nil
 }
 
+// DefaultLabelListCount is the number of labels returned by a label listing if no count
+// is given.
+const DefaultLabelListCount = 1000
+
+// LabelList is a page of label ids in ascending order.  If more labels remain, Next is
+// the label id that should be used to start the next page.
+type LabelList struct {
+	Labels []uint64 `json:"labels"`
+	Next   uint64   `json:"next,omitempty"`
+}
+
+// CountLabel returns the number of voxels, RLE spans, and blocks in a label.  The stored
+// RLEs are scanned in place, so unlike getLabelRLEs, memory use doesn't grow with the
+// size of the label.
+func CountLabel(ctx storage.Context, label uint64) (numVoxels, numSpans, numBlocks uint64, err error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	begIndex, endIndex := voxels.LabelRange(label)
+
+	// Each span is serialized as 16 bytes ending with its int32 length.
+	var processor storage.ChunkProcessor = func(chunk *storage.Chunk) error {
+		value, err := expandStoredRLEs(ctx, chunk.K, chunk.V)
+		if err != nil {
+			return err
+		}
+		if len(value)%16 != 0 {
+			return fmt.Errorf("RLE encoding # bytes is not divisible by 16 for label %d in block %v", label, chunk.K)
+		}
+		for pos := 12; pos < len(value); pos += 16 {
+			numVoxels += uint64(binary.LittleEndian.Uint32(value[pos : pos+4]))
+		}
+		numSpans += uint64(len(value) / 16)
+		numBlocks++
+		return nil
+	}
+	err = smalldata.ProcessRange(ctx, begIndex, endIndex, &storage.ChunkOp{}, processor)
+	return
+}
+
+// labelSize returns the number of voxels in a label.
+func labelSize(ctx storage.Context, label uint64) (uint64, error) {
+	size, _, _, err := CountLabel(ctx, label)
+	return size, err
+}
+
+// ListLabels returns up to count labels, starting with the given label, that have at least
+// minSize voxels.  The key space is traversed by seeking to the first block of the next
+// label, so huge labels are not read block by block.  A minSize above 1 requires reading
+// the RLEs of every label and is much slower.
+func ListLabels(ctx storage.Context, start uint64, count int, minSize uint64) (*LabelList, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	seeker, ok := smalldata.(storage.KeyValueSeeker)
+	if !ok {
+		return nil, fmt.Errorf("Database doesn't support seeking keys in ListLabels()")
+	}
+	_, endIndex := voxels.LabelRange(math.MaxUint64)
+
+	list := &LabelList{Labels: []uint64{}}
+	label := start
+	for {
+		begIndex, _ := voxels.LabelRange(label)
+		key, err := seeker.FirstKeyInRange(ctx, begIndex, endIndex)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return list, nil
+		}
+		if label, _, err = voxels.DecodeLabelSpatialMapKey(key); err != nil {
+			return nil, fmt.Errorf("Can't recover label with key %v: %s\n", key, err.Error())
+		}
+		if len(list.Labels) == count {
+			list.Next = label
+			return list, nil
+		}
+		keep := true
+		if minSize > 1 {
+			size, err := labelSize(ctx, label)
+			if err != nil {
+				return nil, err
+			}
+			keep = size >= minSize
+		}
+		if keep {
+			list.Labels = append(list.Labels, label)
+		}
+		if label == math.MaxUint64 {
+			return list, nil
+		}
+		label++
+	}
+}
+
 // Alter serialized RLEs by the bounds.
 func boundRLEs(b []byte, bounds *dvid.Bounds) ([]byte, error) {
 	var oldRLEs dvid.RLEs
@@ -234,7 +415,7 @@ func boundRLEs(b []byte, bounds *dvid.Bounds) ([]byte, error) {
 //        bytes   Optional payload dependent on first byte descriptor
 //
 func GetSparseVol(ctx storage.Context, label uint64, bounds Bounds) ([]byte, error) {
-	smalldata, err := storage.SmallDataStore()
+	smalldata, err := smallDataStore()
 	if err != nil {
 		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
 	}
@@ -249,20 +430,18 @@ func GetSparseVol(ctx storage.Context, label uint64, bounds Bounds) ([]byte, err
 	binary.Write(buf, binary.LittleEndian, uint32(0)) // Placeholder for # spans
 
 	// Get the start/end indices for this body's KeyLabelSpatialMap (b + s) keys.
-	minZYX := dvid.MinIndexZYX
-	maxZYX := dvid.MaxIndexZYX
+	minZ, maxZ := dvid.MinIndexZYX[2], dvid.MaxIndexZYX[2]
 	blockBounds := bounds.BlockBounds
 	if blockBounds == nil {
 		blockBounds = new(dvid.Bounds)
 	}
-	if minZ, ok := blockBounds.MinZ(); ok {
-		minZYX[2] = minZ
+	if z, ok := blockBounds.MinZ(); ok {
+		minZ = z
 	}
-	if maxZ, ok := blockBounds.MaxZ(); ok {
-		maxZYX[2] = maxZ
+	if z, ok := blockBounds.MaxZ(); ok {
+		maxZ = z
 	}
-	begIndex := voxels.NewLabelSpatialMapIndex(label, minZYX.Bytes())
-	endIndex := voxels.NewLabelSpatialMapIndex(label, maxZYX.Bytes())
+	begIndex, endIndex := voxels.LabelZRange(label, minZ, maxZ)
 
 	// Process all the b+s keys and their values, which contain RLE runs for that label.
 	// TODO -- Make processing asynchronous so can overlap with range disk read now that
@@ -289,21 +468,21 @@ func GetSparseVol(ctx storage.Context, label uint64, bounds Bounds) ([]byte, err
 		}
 
 		// Adjust RLEs within block if we are bounded.
-		var rles []byte
-		var err error
+		rles, err := expandStoredRLEs(ctx, chunk.K, chunk.V)
+		if err != nil {
+			return err
+		}
 		if bounds.Exact && bounds.VoxelBounds.IsSet() {
-			rles, err = boundRLEs(chunk.V, bounds.VoxelBounds)
+			rles, err = boundRLEs(rles, bounds.VoxelBounds)
 			if err != nil {
 				return fmt.Errorf("Error in adjusting RLEs to bounds: %s\n", err.Error())
 			}
-		} else {
-			rles = chunk.V
 		}
 
 		numRuns += uint32(len(rles) / 16)
 		numBlocks++
 		if int64(len(encoding))+int64(len(rles)) > server.MaxDataRequest {
-			return fmt.Errorf("Sparse volume read aborted because length exceeds %d bytes", server.MaxDataRequest)
+			return server.NewError(server.BadRequestError, "Sparse volume read aborted because length exceeds %d bytes", server.MaxDataRequest)
 		}
 		encoding = append(encoding, rles...)
 		return nil
@@ -318,6 +497,57 @@ func GetSparseVol(ctx storage.Context, label uint64, bounds Bounds) ([]byte, err
 	return encoding, nil
 }
 
+// WriteSparseVols writes the sparse volumes of the given labels in the framed format of the
+// sparsevols endpoint: for each label, its uint64 id, the uint64 length of its sparse
+// volume, then the sparse volume as returned by GetSparseVol, all little-endian.  Labels
+// without voxels have a zero length.  The next label's sparse volume is read while the
+// current one is written, so at most two sparse volumes are held in memory.  If a read
+// fails, writing stops and the error is returned.
+func WriteSparseVols(ctx storage.Context, w io.Writer, labels []uint64) error {
+	type labelVol struct {
+		label uint64
+		data  []byte
+		err   error
+	}
+	volCh := make(chan labelVol)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(volCh)
+		for _, label := range labels {
+			data, err := GetSparseVol(ctx, label, Bounds{})
+			select {
+			case volCh <- labelVol{label, data, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	frame := make([]byte, 16)
+	for vol := range volCh {
+		if vol.err != nil {
+			return fmt.Errorf("Error reading sparse volume for label %d: %s", vol.label, vol.err.Error())
+		}
+		data := vol.data
+		if binary.LittleEndian.Uint32(data[8:12]) == 0 {
+			data = nil
+		}
+		binary.LittleEndian.PutUint64(frame[0:8], vol.label)
+		binary.LittleEndian.PutUint64(frame[8:16], uint64(len(data)))
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // PutSparseVol stores an encoded sparse volume that stays within a given forward label.
 // This function handles modification/deletion of all denormalized data touched by this
 // sparse label volume.
@@ -360,11 +590,6 @@ func PutSparseVol(ctx storage.Context, label uint64, data []byte) error {
 //     		int32   Length of run
 //
 func GetSparseCoarseVol(ctx storage.Context, label uint64) ([]byte, error) {
-	smalldata, err := storage.SmallDataStore()
-	if err != nil {
-		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
-	}
-
 	// Create the sparse volume header
 	buf := new(bytes.Buffer)
 	buf.WriteByte(dvid.EncodingBinary)
@@ -374,39 +599,23 @@ func GetSparseCoarseVol(ctx storage.Context, label uint64) ([]byte, error) {
 	binary.Write(buf, binary.LittleEndian, uint32(0)) // Placeholder for # blocks
 	encoding := buf.Bytes()
 
-	// Get the start/end indices for this body's KeyLabelSpatialMap (b + s) keys.
-	begIndex := voxels.NewLabelSpatialMapIndex(label, dvid.MinIndexZYX.Bytes())
-	endIndex := voxels.NewLabelSpatialMapIndex(label, dvid.MaxIndexZYX.Bytes())
-
-	// Process all the b+s keys and their values, which contain RLE runs for that label.
+	// Process all the b+s keys, which give the blocks containing the label.
 	var numBlocks uint32
 	var span *dvid.Span
 	var spans dvid.Spans
-	keys, err := smalldata.KeysInRange(ctx, begIndex, endIndex)
-	if err != nil {
-		return nil, fmt.Errorf("Cannot get keys for coarse sparse volume: %s", err.Error())
-	}
-	for _, key := range keys {
+	err := ForEachBlock(ctx, label, &BlockOptions{KeysOnly: true}, func(block dvid.IndexZYX, rles dvid.RLEs) error {
 		numBlocks++
-		_, blockBytes, err := voxels.DecodeLabelSpatialMapKey(key)
-		if err != nil {
-			return nil, fmt.Errorf("Error retrieving RLE runs for label %d: %s", label, err.Error())
-		}
-		var indexZYX dvid.IndexZYX
-		if err := indexZYX.IndexFromBytes(blockBytes); err != nil {
-			return nil, fmt.Errorf("Error decoding block coordinate (%v) for coarse sparse volume: %s",
-				blockBytes, err.Error())
-		}
-		x, y, z := indexZYX.Unpack()
+		x, y, z := block.Unpack()
 		if span == nil {
 			span = &dvid.Span{z, y, x, x}
 		} else if !span.Extends(x, y, z) {
 			spans = append(spans, *span)
 			span = &dvid.Span{z, y, x, x}
 		}
-	}
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Cannot get blocks for coarse sparse volume: %s", err.Error())
 	}
 	if span != nil {
 		spans = append(spans, *span)
@@ -426,7 +635,7 @@ func GetSparseCoarseVol(ctx storage.Context, label uint64) ([]byte, error) {
 func ComputeSizes(ctx storage.Context, sizeCh chan *storage.Chunk, wg *sync.WaitGroup) {
 
 	// Make sure our small data store can do batching.
-	smalldata, err := storage.SmallDataStore()
+	smalldata, err := smallDataStore()
 	if err != nil {
 		dvid.Criticalf("Cannot get datastore that handles small data: %s\n", err.Error())
 		return
@@ -491,7 +700,7 @@ func ComputeSizes(ctx storage.Context, sizeCh chan *storage.Chunk, wg *sync.Wait
 // GetSizeRange returns a JSON list of mapped labels that have volumes within the given range.
 // If maxSize is 0, all mapped labels are returned >= minSize.
 func GetSizeRange(data dvid.Data, versionID dvid.VersionID, minSize, maxSize uint64) (string, error) {
-	store, err := storage.SmallDataStore()
+	store, err := smallDataStore()
 	if err != nil {
 		return "{}", err
 	}
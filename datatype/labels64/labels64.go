@@ -7,11 +7,13 @@ package labels64
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"image"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -21,6 +23,7 @@ import (
 	"code.google.com/p/go.net/context"
 
 	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/common/labels"
 	"github.com/janelia-flyem/dvid/datatype/roi"
 	"github.com/janelia-flyem/dvid/datatype/voxels"
 	"github.com/janelia-flyem/dvid/dvid"
@@ -35,7 +38,9 @@ const (
 	TypeName = "labels64"
 )
 
-const HelpMessage = `
+var HelpMessage = fmt.Sprintf(helpMessage, mergeQueryParams.Help(), splitQueryParams.Help())
+
+const helpMessage = `
 API for datatypes derived from labels64 (github.com/janelia-flyem/dvid/datatype/labels64)
 =========================================================================
 
@@ -63,10 +68,48 @@ $ dvid repo <UUID> new labels64 <data name> <settings...>
     Configuration Settings (case-insensitive keys)
 
     LabelType      "standard" (default) or "raveler" 
+    StrictMerge    "true" if merges should fail when any label doesn't exist, or "false" (default)
+    AllowForce     "true" if merges with "force=true" may modify locked nodes, or "false" (default)
+    Annotations    Name of a keyvalue instance holding JSON object annotations keyed by label.
+                     Annotations follow labels through merges.  See the "annotation" endpoint.
+    MaxPostBytes   Largest POSTed merge, split, or annotation payload in bytes (default: 268435456)
+                     Larger payloads are refused with a 413 status.
+    ReadOnly       "true" if the data should be created frozen against modifications, or "false"
+                     (default).  See the "readonly" endpoint.
+    OpKeyWindow    How long results of merges with idempotency keys are kept (default: 24h)
+    MaxMutations   Maximum concurrent merges, splits, repairs, and annotation POSTs (default: 4)
+    MaxLargeReads  Maximum concurrent sparse volume, surface, adjacency, and projection
+                     requests (default: 8)
+    MaxSmallReads  Maximum concurrent label, size, mapping, and annotation GETs (default: 64)
+    MaxQueueWait   How long requests wait when their class is at its maximum (default: 5s)
+                     See "Concurrency limits" below.
+    DedupRLEs      "true" if the RLEs of blocks filled by a label, completely or by half along
+                     an axis, should be stored as 2-byte sentinels, or "false" (default).
+                     See the "dedup-rles" command.
+    MergeGuardROI  Comma-separated names of roi instances for compartments, e.g., brain
+                     hemispheres, that merges may not cross.  See the "merge" endpoint.
+    Journal        "true" if each merge's changes to label block RLEs should be journaled with a
+                     hash of the prior RLEs, or "false" (default).  See "block-history".
+    JournalValues  "true" if journal entries should also keep the prior RLEs, or "false"
+                     (default).
+    JournalRetention  How long journal entries keep prior RLEs (default: 168h)
+    TrashRetention    How long trashed labels are kept before they are purged (default: 720h)
+                        See the "trash" endpoint.
+    MergeConflict  "fail" (default) if merges whose blocks are changed by concurrent writes
+                     should recombine those blocks and fail with 409 if they keep changing,
+                     or "last-writer-wins" if merges should overwrite the concurrent writes.
+    MergeRetries   How many times changed blocks are recombined before a merge fails
+                     (default: 3)
     Versioned      "true" or "false" (default)
-    BlockSize      Size in pixels  (default: %s)
+    BlockSize      Size in pixels  (default: %%s)
     VoxelSize      Resolution of voxels (default: 8.0, 8.0, 8.0)
     VoxelUnits     Resolution units (default: "nanometers")
+    Background     Integer value that signifies background in any element (default: 0)
+
+    Unknown settings, e.g., a misspelled "BlkSize", cause an error listing the accepted settings.
+    BlockSize must be 3d, and the Annotations and MergeGuardROI instances must exist in the repo
+    with the keyvalue and roi datatypes, respectively, when the data is created or its settings
+    are POSTed.
 
 $ dvid node <UUID> <data name> load <offset> <image glob> <settings...>
 
@@ -98,8 +141,8 @@ $ dvid node <UUID> <data name> load <offset> <image glob> <settings...>
 
 $ dvid node <UUID> <data name> composite <grayscale8 data name> <new rgba8 data name>
 
-    Creates a RGBA8 image where the RGB is a hash of the labels and the A is the
-    grayscale intensity.
+    Creates a RGBA8 image where the RGB is the color of each label, as given by the
+    "colormap" endpoint, scaled by the grayscale intensity.
 
     Example: 
 
@@ -109,12 +152,186 @@ $ dvid node <UUID> <data name> composite <grayscale8 data name> <new rgba8 data
 
     UUID          Hexidecimal string with enough characters to uniquely identify a version node.
     data name     Name of data to add.
+
+$ dvid node <UUID> <data name> backfill-sizes
+
+    Records label sizes for the "size-history" endpoint by scanning the sparse volumes of
+    the given version node and each of its ancestors.  This is only necessary for labels
+    modified before size history was recorded.  Existing records are not modified.
+
+    Example: 
+
+    $ dvid node 3f8c bodies backfill-sizes
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+
+$ dvid node <UUID> <data name> rebuild-mapping
+
+    Rebuilds the label mapping of the "mapping" endpoint at the given version node from
+    the log of merges at that node and its ancestors.  This is only necessary if the
+    mapping and the merge log have diverged.
+
+    Example: 
+
+    $ dvid node 3f8c bodies rebuild-mapping
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+
+$ dvid node <UUID> <data name> dedup-rles
+
+    Rewrites the stored RLEs of blocks filled by a label, completely or by half along an
+    axis, as 2-byte sentinels and reports the bytes saved.  RLEs of all version nodes are
+    rewritten in batches, which doesn't change the voxels of any label.  The data must have
+    "DedupRLEs=true", which makes later writes store sentinels too.  Sentinels are expanded
+    on reads using the data's block size.
+
+    Example: 
+
+    $ dvid node 3f8c bodies dedup-rles
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+
+$ dvid node <UUID> <data name> compact [label]
+
+    Rewrites the stored RLEs of blocks whose runs are unsorted, adjacent, or overlapping,
+    e.g., after many splits, with sorted and coalesced runs if that shrinks them, and
+    reports the blocks examined, blocks rewritten, and bytes saved.  RLEs of all version
+    nodes are examined, or only those of the given label, which doesn't change the voxels of
+    any label.  Blocks are committed in batches, and an interrupted compaction of the same
+    label resumes where it left off.  Blocks of labels with merges in flight are retried
+    at the end.
+
+    Example: 
+
+    $ dvid node 3f8c bodies compact 4123
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         Optional label whose RLEs are compacted.  All labels are compacted if omitted.
+
+$ dvid node <UUID> <data name> dump-label <label> <file>
+
+    Writes the stored RLEs of a label at the given version to a file on the server, e.g.,
+    to attach the exact state of a label that looks wrong to a bug report.  The file holds
+    the data name, version, label, and block size, followed by the RLEs of each block with
+    a checksum.  See "restore-label".
+
+    Example: 
+
+    $ dvid node 3f8c bodies dump-label 4123 /tmp/body-4123.rles
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         Label to dump.
+    file          Name of the dump file on the server.
+
+$ dvid node <UUID> <data name> restore-label <file> [<new label>] [--force]
+
+    Loads a label dumped by "dump-label" into the data at the given version, updating its
+    size and surface.  The dump's checksums are verified and its block size must match the
+    data's.  The label keeps its dumped id unless a new label is given.  An existing label
+    isn't overwritten unless "--force" is given.
+
+    Example: 
+
+    $ dvid node 7a21 testbodies restore-label /tmp/body-4123.rles 90000001
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    file          Name of the dump file on the server.
+    new label     Optional label to store the dumped RLEs under.
+
+$ dvid node <UUID> <data name> backfill <source> [roi=<roi name>] [rate=<blocks/sec>]
+
+    Replaces the label RLEs of the data at the given version with those computed from the
+    label blocks of a labels64 source, e.g., the data itself after its RLEs fell out of sync
+    with its blocks, then updates the sizes and surfaces of the affected labels.  The RLEs
+    of each scanned block replace those of the labels in the data's own block at the same
+    index.  Blocks are written in batches along with a cursor, so running the same backfill
+    after an interruption continues after the last written batch.  Backfills are refused
+    while merges are in flight, and merges are refused while a backfill runs.
+
+    The command returns once the backfill starts.  See the "backfill" endpoint for progress
+    and the voxel count of each label once it's done.
+
+    Example: 
+
+    $ dvid node 3f8c bodies backfill bodies roi=medulla rate=500
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    source        Name of labels64 data with the same block size whose blocks are scanned.
+    roi           Optional roi instance restricting the written blocks to those whose centers
+                    are within the ROI.
+    rate          Optional maximum number of blocks scanned per second.
+
+$ dvid node <UUID> <data name> generate-test-data [--labels=<n>] [--mean-size=<voxels>]
+      [--distribution=<fixed|uniform|zipf>] [--seed=<n>] [--force]
+
+    Writes synthetic labels with ids 1 to n at the given version for load testing, along
+    with their sizes but not their surfaces.  Each label is a spatially coherent blob grown
+    by a random walk in its own region of the volume, so labels don't overlap, and the same
+    arguments always give the same labels.  The reply gives the generation throughput and
+    statistics of the resulting label blocks.  Data that already has labels is refused
+    unless "--force" is given, in which case existing labels with the generated ids are
+    replaced.
+
+    Example: 
+
+    $ dvid node 3f8c loadtest generate-test-data --labels=10000 --mean-size=50000 --distribution=zipf --seed=42
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    labels        Number of labels (default: 1000)
+    mean-size     Mean number of voxels per label (default: 50000)
+    distribution  Distribution of label sizes: "fixed" gives all labels the mean size,
+                    "uniform" draws sizes up to twice the mean, and "zipf" (default) gives
+                    the label of rank k a size proportional to 1/k.
+    seed          Seed of the generator (default: 0)
+
+$ dvid node <UUID> <data name> readonly <true|false>
+
+    Freezes the data against all modifications or makes it writable again.  See the
+    "readonly" endpoint below.
+
+    Example: 
+
+    $ dvid node 3f8c bodies readonly true
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
 	
 	
     ------------------
 
 HTTP API (Level 2 REST):
 
+Errors are returned as JSON of the form {"error": ..., "kind": ..., "request-id": ...} where
+kind is one of "bad-request" (400), "not-found" (404), "storage" (500), "conflict" (409),
+"unavailable" (503), or "readonly" (403).  Plain text errors are returned if the Accept
+header prefers text/plain.
+
 GET  <api URL>/node/<UUID>/<data name>/help
 
 	Returns data-specific help message.
@@ -123,7 +340,12 @@ GET  <api URL>/node/<UUID>/<data name>/help
 GET  <api URL>/node/<UUID>/<data name>/info
 POST <api URL>/node/<UUID>/<data name>/info
 
-    Retrieves or puts DVID-specific data properties for these voxels.
+    Retrieves or puts DVID-specific data properties for these voxels.  Only the "Annotations",
+    "MaxPostBytes", "OpKeyWindow", "MaxMutations", "MaxLargeReads", "MaxSmallReads", "MaxQueueWait",
+    "DedupRLEs", "MergeGuardROI", "Journal", "JournalValues", "JournalRetention",
+    "TrashRetention", "MergeConflict", "MergeRetries", "BlockSize", "VoxelSize", "VoxelUnits",
+    and "Background" settings can be modified after creation.  Unknown settings or those that can't be modified are rejected.
+    The JSON returned by GET is gzip-encoded if the Accept-Encoding header allows it.
 
     Example: 
 
@@ -138,6 +360,97 @@ POST <api URL>/node/<UUID>/<data name>/info
     data name     Name of voxels data.
 
 
+GET  <api URL>/node/<UUID>/<data name>/settings
+POST <api URL>/node/<UUID>/<data name>/settings
+
+    Returns a JSON list of the accepted configuration settings, each with its "Name", "Type",
+    "Required", "Default", "Modifiable", "Secret", and "Help" fields and its current "Value".
+
+    A POST takes a JSON object of modifiable settings, e.g., {"MaxLargeReads": "4"}, applies
+    them immediately, and returns the list with the new values.  Settings can be changed even
+    if the data is frozen.
+
+    Concurrency limits
+
+    Requests are limited per data instance in three classes, each with its own maximum
+    number of concurrent requests:
+
+    mutation      merge, split, repair, trash, restore, and POST annotation (MaxMutations)
+    large-read    sparsevol, sparsevols, sparsevol-by-point, sparsevol-coarse, surface,
+                    surface-by-point, adjacency, projection, blocks-cseg, and changed-sparsevols
+                    (MaxLargeReads)
+    small-read    label, labels, sizerange, size-history, lastmod, block-history, mapping,
+                    changed-labels, GET trash, and GET annotation (MaxSmallReads)
+
+    Requests of a class at its maximum wait in arrival order for up to MaxQueueWait and then
+    get a 503 (Service Unavailable) with a Retry-After header and a JSON body naming the
+    class:
+
+	{ "error": <message>, "class": "large-read", "limit": 8, "active": 8, "queued": 20, "request-id": <id> }
+
+    The "Concurrency" field of /info gives the current "Limit", "Active", and "Queued" counts
+    of each class.  Other endpoints are not limited, and raw voxel requests use the server's
+    "throttle" option instead.
+
+
+GET  <api URL>/node/<UUID>/<data name>/neuroglancer
+
+    Returns JSON describing a ready-to-use Neuroglancer segmentation layer for the labels
+    and the endpoints of their sparse volumes:
+
+	{
+		"layer": { "type": "segmentation", "source": "dvid://<server URL>/<UUID>/<data name>", "name": <data name> },
+		"url": "<server URL>/api/node/<UUID>/<data name>",
+		"dataType": "uint64",
+		"voxelSize": [8, 8, 8],
+		"voxelUnits": ["nanometers", "nanometers", "nanometers"],
+		"blockSize": [32, 32, 32],
+		"bounds": { "min": [0, 0, 0], "max": [...] },
+		"sparsevol": "<server URL>/api/node/<UUID>/<data name>/sparsevol/{label}",
+		"sparsevolCoarse": "<server URL>/api/node/<UUID>/<data name>/sparsevol-coarse/{label}"
+	}
+
+    The "layer" can be pasted into a Neuroglancer state, and {label} in the sparse volume
+    URLs is replaced by a label.  The bounds, where "max" is exclusive, are omitted if no
+    labels have been stored.  The server URL is the "BaseURL" of the server configuration if
+    set.  Otherwise it's taken from the request's Host header, or the X-Forwarded-Host,
+    X-Forwarded-Proto, and X-Forwarded-Prefix headers if the server is behind a proxy.
+
+
+GET  <api URL>/node/<UUID>/<data name>/readonly
+POST <api URL>/node/<UUID>/<data name>/readonly
+
+    Returns or sets whether the data is frozen against all modifications, e.g., after a
+    segmentation is released, regardless of whether version nodes are locked:
+
+        { "readonly": true }
+
+    A POST requires the server's admin token, which is the "admintoken" server configuration
+    setting, in the X-DVID-Admin-Token header.  Without a configured token, the flag can only
+    be changed by the "readonly" command.
+
+    While the flag is set, POSTs to raw, isotropic, merge, split, and annotation endpoints,
+    as well as the "load" command, return 403 Forbidden with a JSON error of kind "readonly".
+    Repairs of merges interrupted before the data was frozen are still allowed.  The flag is
+    the "ReadOnly" field of the data instance's info.
+
+
+GET  <api URL>/node/<UUID>/<data name>/colormap[/<label>]
+POST <api URL>/node/<UUID>/<data name>/colormap
+
+    Labels are colored by a stable hash of each label, with black for label 0, unless the
+    label's color is overridden.  All colorized responses, e.g., projections with
+    colormap=hash and composites, use the same colors.  A POST sets overrides given by
+    JSON like the following, where an empty color removes a label's override:
+
+        { "12": "#FF8000", "13": "#00FF00", "14": "" }
+
+    A GET without a label returns all overrides in the same form.  A GET with a label
+    returns the color used for the label:
+
+        { "label": 12, "color": "#FF8000", "override": true }
+
+
 GET  <api URL>/node/<UUID>/<data name>/metadata
 
 	Retrieves a JSON schema (application/vnd.dvid-nd-data+json) that describes the layout
@@ -178,6 +491,63 @@ POST <api URL>/node/<UUID>/<data name>/raw/<dims>/<size>/<offset>[/<format>][?th
 
     roi       	  Name of roi data instance used to mask the requested data.
 
+GET  <api URL>/node/<UUID>/<data name>/projection/xy/<size>/<offset>/<depth>[?<options>]
+
+    Returns a 2d XY image where each pixel is the label with the most voxels in the Z column
+    of <depth> slices starting at the offset.  The background label 0 is only returned for
+    columns without any other label, and ties go to the lowest label.  Projections are
+    computed a column of blocks at a time, so large areas don't need a large amount of memory.
+
+    The default response is packed little-endian uint64 labels ("application/octet-stream")
+    in row-major order.  Projections are throttled; if the server is already running its
+    maximum number of throttled operations, a 503 (Service Unavailable) is returned.
+
+    Example:
+
+    GET <api URL>/node/3f8c/bodies/projection/xy/1024_1024/0_0_100/50?scale=2&colormap=hash
+
+    Returns a 256 x 256 PNG showing the dominant label in each 4 x 4 voxel column from
+    (0,0,100) through (1023,1023,149).
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    size          Size in voxels of the projected area in form "nx_ny".
+    offset        Gives coordinate of first voxel in form "x_y_z".
+    depth         Number of Z slices projected.
+
+    Query-string Options:
+
+    scale         Each pixel covers 2^scale x 2^scale voxel columns, where scale is at most 10.
+    colormap      "hash" returns a PNG with the color of each label given by the "colormap"
+                    endpoint, with black for label 0.
+    async         "true" computes the projection in the background once the throttle allows,
+                    returning 202 (Accepted) with JSON like {"id": "<job id>", "status": "running"}.
+
+GET  <api URL>/node/<UUID>/<data name>/projection-job/<job id>
+
+    Returns the result of an asynchronous projection, or 202 (Accepted) with JSON status
+    while it is still running.  Results are kept for 10 minutes after a projection finishes,
+    after which a 404 is returned.
+
+GET  <api URL>/node/<UUID>/<data name>/backfill
+
+    Returns JSON with the status of the last backfill started by the "backfill" command
+    since the server started, or 404 if there was none:
+
+	{
+		"Source": <source data name>, "ROI": <roi name>, "UUID": <UUID>,
+		"State": <"running", "done", or "failed">, "Resumed": <true if continuing>,
+		"Blocks": <# scanned blocks>, "Written": <# written blocks>, "NumLabels": <# labels>,
+		"Voxels": <# voxels>, "Started": <time>, "Finished": <time>, "Error": <message>,
+		"Labels": [ { "Label": <label>, "Voxels": <# voxels> }, ... ]
+	}
+
+    Counts include blocks of earlier runs that were resumed.  "Labels" is given once the
+    backfill is done.
+
+
 (Assumes labels were loaded using without "proc=noindex")
 
 GET <api URL>/node/<UUID>/<data name>/sparsevol/<label>?<options>
@@ -215,6 +585,38 @@ GET <api URL>/node/<UUID>/<data name>/sparsevol/<label>?<options>
     exact   "true" if all RLEs should respect voxel bounds.
             "false" if RLEs can extend a bit outside voxel bounds within border blocks.   
 
+    Sparse volume responses, including those of "sparsevol-by-point" and "sparsevol-coarse",
+    support the HTTP Range header so large downloads can be resumed.  Each response carries a
+    strong ETag that should be sent back in an If-Range header; if the volume has changed,
+    the full volume is returned instead of the requested range.
+
+    Responses of "sparsevol" and "sparsevol-coarse" also carry a Last-Modified header, the
+    later of the label's last merge and the creation of the version node.  Their ETag is
+    derived from the version, label, and the label's last merge, so polling clients can
+    send it in an If-None-Match header, or the Last-Modified time in an If-Modified-Since
+    header, and get a 304 Not Modified without the volume being read if the label hasn't
+    been modified since.  Merges, deletions and restores through the trash, and voxel writes
+    change these validators, which are also served by the "lastmod" endpoint.  Voxel writes
+    change them only once the written blocks are indexed, so conditional requests shouldn't
+    be used for labels whose voxels are still being written at a version.
+
+
+POST <api URL>/node/<UUID>/<data name>/sparsevols
+
+	Returns the sparse volumes of many labels in one response, avoiding the overhead of a
+	request per label.  The request body is a JSON array of label ids, e.g., [23, 1045, 7].
+	The response is a stream with the following unit repeated for each label in the order
+	given, where integers are little endian:
+
+	    uint64   Label id
+	    uint64   Length of sparse volume in bytes, 0 if the label has no voxels
+	    bytes    Sparse volume in the encoding of the "sparsevol" request above
+
+	The next label is read from storage while the current one is sent.  The response is
+	gzip-encoded if the Accept-Encoding header allows it.  If a label can't be read, the
+	stream ends early, so clients should treat a truncated unit as an error.  Unlike other
+	POST requests, this is allowed on read-only data.
+
 
 GET <api URL>/node/<UUID>/<data name>/sparsevol-by-point/<coord>
 
@@ -289,7 +691,7 @@ GET <api URL>/node/<UUID>/<data name>/label/<coord>
 GET <api URL>/node/<UUID>/<data name>/sizerange/<min size>/<optional max size>
 
     Returns JSON list of labels that have # voxels that fall within the given range
-    of sizes.
+    of sizes.  The response is gzip-encoded if the Accept-Encoding header allows it.
 	
     Arguments:
 
@@ -299,6 +701,218 @@ GET <api URL>/node/<UUID>/<data name>/sizerange/<min size>/<optional max size>
     max size      Optional maximum # of voxels.  If not specified, all labels with volume above minimum
                    are returned.
 
+GET <api URL>/node/<UUID>/<data name>/labels[?queryargs]
+
+    Returns JSON giving a page of label ids in ascending order:
+
+		{ "labels": [<label>, ...], "next": <label> }
+
+    The "next" label is only given if more labels remain and should be used as the "start"
+    of the next request, so all labels can be listed a page at a time.  The response is
+    gzip-encoded if the Accept-Encoding header allows it.
+
+    Query-string Options:
+
+    start         Smallest label id to list.  Default is 0.
+    count         Maximum number of labels to list.  Default is 1000.
+    minsize       Only list labels with at least this many voxels.  This requires reading
+                    the sparse volume of every label and is much slower.
+
+GET <api URL>/node/<UUID>/<data name>/size-history/<label>
+
+    Returns JSON list of the label's size at the given version node and each ancestor
+    back to the root:
+
+		[ { "uuid": <UUID>, "size": <# voxels>, "op": <operation> }, ... ]
+
+    The op is the operation that changed the size at that version, e.g., "merge" or
+    "backfill", and is empty if the size is inherited from an ancestor.  Ancestors before
+    the first recorded size of the label are omitted.  Sizes of labels last modified before
+    size history was recorded require the "backfill-sizes" command.  The response is
+    gzip-encoded if the Accept-Encoding header allows it.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         The label ID.
+
+GET  <api URL>/node/<UUID>/<data name>/lastmod/<label>
+POST <api URL>/node/<UUID>/<data name>/lastmod
+
+    Returns JSON for the last modification of a label at the given version node, so clients
+    caching meshes or skeletons can cheaply check whether a label changed:
+
+		{ "label": <label>, "mutation": <mutation id>, "modified": <time> }
+
+    The mutation is the id of the last merge, deletion, restore, or voxel write that changed
+    the label at the version or an ancestor, or 0 if the label was never changed.  The
+    modified time is the later of that mutation and the creation of the version node, and
+    is the Last-Modified time of the label's sparse volume.  A POST takes a JSON array of up
+    to 10000 label ids and returns a JSON array of these objects in the same order.  Like
+    batch sparse volume requests, the POST is allowed on read-only data.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         The label ID.
+
+GET <api URL>/node/<UUID>/<data name>/blocks-cseg/<label>/<block coord>[/<block coord>...]
+GET <api URL>/node/<UUID>/<data name>/blocks-cseg/<label>?minblock=<block coord>&maxblock=<block coord>
+
+    Returns blocks of a label in the compressed segmentation format of Neuroglancer, so clients
+    can display a label without rasterizing its sparse volume.  Each block is a uint64 array
+    where voxels of the label have the label and all other voxels are 0.  Blocks the label
+    doesn't occupy are returned as all 0.  The blocks are either those given in the path or
+    all blocks from minblock to maxblock, inclusive, with x varying fastest and z slowest, up
+    to 4096 blocks.  The response is a stream with the following unit repeated for each
+    block, where integers are little endian:
+
+	    int32    Block coordinate (dimension 0)
+	    int32    Block coordinate (dimension 1)
+	    int32    Block coordinate (dimension 2)
+	    uint32   Length of the encoded block in bytes
+	    bytes    Encoded block with 8x8x8 sub-blocks, beginning with its single channel offset
+
+    If a block can't be read, the stream ends early, so clients should treat a truncated unit
+    as an error.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         The label ID.
+    block coord   The block coordinate as "x_y_z", e.g., "10_4_-2".
+
+GET <api URL>/node/<UUID>/<data name>/block-history/<label>/<block coord>
+
+    Returns JSON of the journaled changes to the label's RLEs in a block at the given version
+    node and its ancestors, oldest first, if the data instance has the "Journal" setting:
+
+		{ "label": <label>, "block": [x, y, z], "mutations": [ { "mutation": <id>, "op": "merge",
+		  "action": "put" or "delete", "time": <time>, "prior_hash": <hash>, "prior": <RLEs>,
+		  "merge": <merge log record> }, ... ] }
+
+    The prior hash is the hexadecimal FNV-1a hash of the block's serialized RLEs before the
+    change and is omitted if the label had no RLEs in the block.  The base64 prior RLEs are
+    only given with the "JournalValues" setting and are dropped after "JournalRetention".
+    The mutation id is the id of the operation's merge log record, which is included once
+    the merge finishes.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         The label ID.
+    block coord   The block coordinate as "x_y_z", e.g., "10_4_-2".
+
+GET <api URL>/node/<UUID>/<data name>/mapping[?format=<format>]
+
+    Returns the label that each merged label was merged into at the given version node,
+    including merges at its ancestors.  Chains of merges are resolved, so each merged
+    label maps directly to the label now holding its voxels.  Labels that were never
+    merged are omitted.  The format may be:
+
+    json      (default) JSON list of [ <merged label>, <mapped label> ] pairs.
+    csv       Lines of "<merged label>,<mapped label>" after a "label,mapped" header.
+    binary    Little-endian uint64 pairs of merged and mapped labels.
+
+    All formats are ordered by increasing merged label.  The mapping is updated as each
+    merge completes and can be rebuilt from the merge log with the "rebuild-mapping"
+    command.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+
+GET <api URL>/node/<UUID>/<data name>/mapping/<label>
+
+    Returns JSON giving the label now holding the voxels of the given label, which is
+    the label itself if it was never merged:
+
+		{ "label": <label>, "mapped": <mapped label> }
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         The label ID.
+
+GET <api URL>/node/<UUID>/<data name>/adjacency/<label>[?mincontact=<# voxels>]
+
+    Returns JSON listing the labels that touch the given label, ordered by decreasing contact:
+
+		[ { "label": <label>, "contactVoxels": <# voxel pairs> }, ... ]
+
+    Contact is the number of face-adjacent voxel pairs between the two labels.  Only labels
+    with at least "mincontact" voxel pairs are listed (default: all).  The label's blocks are
+    processed one at a time with a one-voxel halo, so memory use doesn't grow with the size
+    of the label.  Neighboring labels are found in the label blocks, which are relabeled in
+    the background after merges.  Results are cached per version and label until a merge
+    involving the label or a neighbor, or a write of voxels, invalidates them.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         The label ID.
+
+GET <api URL>/node/<UUID>/<data name>/changed-labels?since=<ancestor UUID>
+
+    Returns JSON describing every label whose sparse volume differs between the ancestor
+    version and the given version, in label order:
+
+		{
+			"since": <ancestor UUID>,
+			"uuid": <UUID>,
+			"labels": [
+				{
+					"label": <label>,
+					"change": <"created", "deleted", or "modified">,
+					"blocks_added": <# blocks>,
+					"blocks_removed": <# blocks>,
+					"blocks_modified": <# blocks>,
+					"ops": [ { "uuid": <UUID>, "size": <# voxels>, "op": <operation> }, ... ]
+				}, ...
+			]
+		}
+
+    The block counts are of blocks where the label's voxels appeared, disappeared, or
+    changed.  The ops are the size history records of the label at versions after the
+    ancestor up to the given version, oldest first.  The label blocks of both versions are
+    compared in key order without reading either version into memory.  It is an error if
+    the "since" version is not an ancestor of the given version.
+
+GET <api URL>/node/<UUID>/<data name>/changed-sparsevols?since=<ancestor UUID>
+
+    Returns the current sparse volumes of the labels returned by "changed-labels" in the
+    framed format of the "sparsevols" request.  Deleted labels have zero-length sparse
+    volumes.  The response is gzip-encoded if the Accept-Encoding header allows it.
+
+GET  <api URL>/node/<UUID>/<data name>/annotation/<label>
+POST <api URL>/node/<UUID>/<data name>/annotation/<label>
+
+    Gets or sets the annotation of a label, e.g., {"name": "KC-alpha", "status": "traced"},
+    in the keyvalue instance given by the Annotations setting.  Annotations must be JSON
+    objects.  A GET of a label without an annotation returns an empty object.
+
+    When labels are merged, the target label's annotation keeps its fields, fields only in
+    the annotations of merged labels are copied to it in tuple order, and the annotation of
+    each merged label is appended to the target's "merged-from" list:
+
+		"merged-from": [ { "label": <merged label>, "annotation": { ... } }, ... ]
+
+    The annotations of merged labels are then deleted.  Annotations are moved as part of
+    the merge, so an interrupted merge also finishes moving its annotations.
+
+    Arguments:
+
+    UUID          Hexidecimal string with enough characters to uniquely identify a version node.
+    data name     Name of labels64 data.
+    label         The label ID.
+
 POST <api URL>/node/<UUID>/<data name>/merge
 
 	Merges labels.  Requires JSON in request body using the following format:
@@ -308,7 +922,142 @@ POST <api URL>/node/<UUID>/<data name>/merge
 	  ... ]
 
 	Each element of the JSON array is another array specifying all the labels that
-	should be merged into the label specified by the first element.
+	should be merged into the label specified by the first element.  Returns JSON
+	summarizing the merge:
+
+		{
+			"User": <user>,
+			"Targets": [
+				{
+					"Label": <toLabel>,
+					"OldSize": <# voxels>,
+					"VoxelsAdded": <# voxels>,
+					"NewSize": <# voxels>,
+					"Contributions": { "<fromLabel>": <# voxels>, ... },
+					"BlocksAppended": <# blocks>,
+					"BlocksCreated": <# blocks>
+				}, ...
+			],
+			"BlocksChanged": <# blocks>,
+			"MinBlock": [x, y, z],
+			"MaxBlock": [x, y, z],
+			"ElapsedMs": <milliseconds>
+		}
+
+	Block coordinates are in block space.  "Contributions" gives the voxels each merged
+	label added to the target, which can reveal a large body merged by accident.  Blocks
+	where the target already had voxels are counted in "BlocksAppended" and the others in
+	"BlocksCreated".  The targets are also recorded in the merge's log record.  If the query string "terse=true" is given,
+	the response body is empty.
+
+	The user making the merge is given by the X-DVID-User header, or "anonymous" if the
+	header is absent.  The user is recorded with the merge's write-ahead intent, so merges
+	needing repair are attributed, and is logged and echoed in the "User" field.
+
+	If the query string "timing=true" is given, the response includes a "Timing" object
+	giving the milliseconds spent in each phase of the merge: "parse" (reading the request),
+	"read-existing" (label sizes and sparse volumes), "compute", "write" with nested
+	"write/intent" and "write/rles" phases, and "notify" (starting the background updates
+	of label sizes and blocks).  The same breakdown is appended to the server's log line for
+	every merge.  Split requests log the time spent parsing the posted sparse volume.
+
+	Labels without any voxels are listed in the "Missing" field and are skipped.  If the
+	query string "strict=true" is given, the merge fails with no changes if any label is
+	missing.  The default is the StrictMerge setting of the data instance.  As on other
+	endpoints, "strict=true" also makes unknown query-string parameters an error, but the
+	StrictMerge setting only applies to missing labels.
+
+	If the query string "target=largest" is given, each tuple's labels are merged into
+	the label with the most voxels instead of the first label, with ties going to the
+	lowest label id.  If "target=lowest-id" is given, the label with the lowest id is
+	the target.  Missing labels are never chosen, and a tuple with all labels missing is
+	left unchanged.  The chosen target of each tuple is the "Label" in the response.
+
+	Merges on a locked node return 409 Conflict with JSON giving the locked node's UUID and
+	any unlocked child nodes that could be used instead:
+
+		{ "error": <message>, "uuid": <locked UUID>, "open-children": [<UUID>, ...] }
+
+	For administrative repairs, the query string "force=true" allows merges on a locked node
+	if the data instance has the AllowForce setting.
+
+	If the data instance has the MergeGuardROI setting, each label belongs to the compartment
+	of the named roi instance holding the center of the blocks with most of its voxels, or
+	"none" if those blocks are outside all of the ROIs.  Merges of labels in different
+	compartments return 409 Conflict with a message giving each label's compartment.  Labels
+	in "none" may be merged with any label.  If the query string "override=true" is given,
+	such merges are allowed and recorded as overrides in the merge log.
+
+	Each merge stores a write-ahead intent before modifying any data.  If the server stops
+	before a merge is complete, the merge is finished when the server restarts.  Merges that
+	can't be finished are listed in the "RepairNeeded" field of the data instance's info.
+
+	Before modifying any data, a merge checks whether the blocks it overwrites or deletes
+	were changed by concurrent writes, e.g., from a synced labelblk instance, since it read
+	them.  With the default MergeConflict setting, changed blocks are recombined from their
+	new contents up to MergeRetries times, after which the merge returns 409 Conflict
+	without modifying any data.  With "last-writer-wins", merges don't check and overwrite
+	the concurrent writes.
+
+	If storage is temporarily unavailable, e.g., while the storage backend is reinitialized,
+	a merge that fails before modifying any data returns 503 Service Unavailable with a
+	"Retry-After" header giving the seconds to wait before retrying.  A merge interrupted
+	after data was modified returns 500 Internal Server Error and needs repair.
+
+	To make retries safe, a client can give a unique key for the merge in an
+	"Idempotency-Key" header or the "opid" query string.  The response of a completed merge
+	is kept for the data instance's OpKeyWindow, and a retry with the same key on the same
+	version returns it with an "Idempotent-Replayed: true" header instead of merging again.
+	Retries of a merge that is still in progress wait for it to finish.  Failed merges are
+	not kept, so they are executed again on retry.  Reusing a key for a different merge
+	returns 409 Conflict.
+
+	Query-string options:
+
+%s
+
+POST <api URL>/node/<UUID>/<data name>/repair
+
+	Retries any interrupted merges listed in the "RepairNeeded" field of the data instance's
+	info, along with any other interrupted merges that haven't been finished.  Returns JSON
+	giving the number of merges finished and those that still need repair:
+
+		{
+			"Recovered": <# operations>,
+			"RepairNeeded": [ { "ID": <intent id>, "UUID": <UUID>, "Op": "merge",
+			                    "Phase": <phase>, "Error": <message>, "User": <user> }, ... ]
+		}
+
+
+POST <api URL>/node/<UUID>/<data name>/trash/<label>
+
+	Moves the label's sparse volume into the trash, recording the requesting user and the
+	time, and returns JSON describing the trashed label:
+
+		{ "label": <label>, "size": <# voxels>, "user": <user>, "time": <time> }
+
+	The label's size becomes zero and its surface is deleted, and the "changed-labels"
+	endpoint lists it as changed by a "trash" op.  Label blocks still give the label for its
+	voxels.  Labels are purged from the trash once they have been there for the data's
+	TrashRetention period.  Labels already in the trash or without voxels are refused.
+
+GET  <api URL>/node/<UUID>/<data name>/trash
+
+	Returns a JSON list of the labels in the trash, with how long they have been there and
+	when they will be purged:
+
+		[ { "label": <label>, "size": <# voxels>, "user": <user>, "time": <time>,
+		    "age": <duration>, "expires": <time> }, ... ]
+
+POST <api URL>/node/<UUID>/<data name>/restore/<label>[?label=<new label>]
+
+	Moves a trashed label's sparse volume out of the trash, under the new label if given,
+	and returns JSON describing the restored label:
+
+		{ "label": <restored label>, "trashed_label": <label>, "size": <# voxels>, "blocks": <# blocks> }
+
+	If the label's id has been reused since it was trashed, the restore is refused with a 409
+	(Conflict) status and the label must be restored under a new id.
 
 
 POST <api URL>/node/<UUID>/<data name>/split
@@ -337,6 +1086,12 @@ POST <api URL>/node/<UUID>/<data name>/split
 			  ...
 	        int32   Length of run
 
+	The # Spans must agree with the Content-Length of the request if one is given.  Sparse
+	volumes larger than the MaxPostBytes setting are refused with a 413 status.
+
+	Query-string options:
+
+%s
 PROPOSED API CURRENTLY NOT IMPLEMENTED
 
 GET  <api URL>/node/<UUID>/<data name>/alias/<alias string>
@@ -415,28 +1170,16 @@ type Type struct {
 
 // NewData returns a pointer to labels64 data.
 func NewData(uuid dvid.UUID, id dvid.InstanceID, name dvid.DataString, c dvid.Config) (*Data, error) {
+	var s Settings
+	if err := s.Parse(c, false, nil); err != nil {
+		return nil, fmt.Errorf("Cannot make labels64 data %q: %s", name, err.Error())
+	}
 	voxelData, err := dtype.Type.NewData(uuid, id, name, c)
 	if err != nil {
 		return nil, err
 	}
-
-	var labelType LabelType = Standard64bit
-	s, found, err := c.GetString("LabelType")
-	if found {
-		switch strings.ToLower(s) {
-		case "raveler":
-			labelType = RavelerLabel
-		case "standard":
-		default:
-			return nil, fmt.Errorf("unknown label type specified '%s'", s)
-		}
-	}
-	dvid.Infof("Creating labels64 '%s' with %s", voxelData.DataName(), labelType)
-	data := &Data{
-		Data:     voxelData,
-		Labeling: labelType,
-	}
-	return data, nil
+	dvid.Infof("Creating labels64 '%s' with %s", voxelData.DataName(), s.Labeling)
+	return &Data{Data: voxelData, Settings: s}, nil
 }
 
 // --- TypeService interface ---
@@ -510,14 +1253,56 @@ func (l *Labels) Interpolable() bool {
 // Data of labels64 type just uses voxels.Data.
 type Data struct {
 	*voxels.Data
-	Labeling LabelType
-	Ready    bool
+	Settings
+	Ready bool
+
+	// Palette overrides the hashed colors of labels, guarded by paletteMu.
+	Palette labels.Palette
+
+	// Interrupted label operations that need repair and operations finishing in the
+	// background, keyed by intent id.  Both are guarded by intentMu.
+	repairNeeded map[uint64]PendingIntent
+	finishing    map[uint64]bool
+
+	// Closed once no operations are finishing in the background, guarded by intentMu.
+	finished chan struct{}
+
+	// Cached label adjacency and a count of invalidations, guarded by adjacencyMu.
+	adjacency    map[adjacencyKey][]LabelContact
+	adjacencyGen uint64
+
+	// Cached compartments of labels and a count of invalidations, guarded by compartmentMu.
+	compartments   map[compartmentKey]string
+	compartmentGen uint64
+
+	// Status of the last backfill since the server started, guarded by backfillMu.
+	backfill *BackfillStatus
+
+	// Limiters of each concurrency class, guarded by concurrencyMu.
+	limiters map[ConcurrencyClass]*limiter
 }
 
 type propertiesT struct {
 	voxels.Properties
-	Labeling LabelType
-	Ready    bool
+	Labeling         LabelType
+	Ready            bool
+	StrictMerge      bool
+	AllowForce       bool
+	Annotations      dvid.DataString `json:",omitempty"`
+	MaxPostBytes     int64
+	ReadOnly         bool
+	OpKeyWindow      string
+	RepairNeeded     []PendingIntent `json:",omitempty"`
+	Concurrency      map[ConcurrencyClass]Utilization
+	MaxQueueWait     string
+	DedupRLEs        bool
+	MergeGuardROI    string `json:",omitempty"`
+	Journal          bool
+	JournalValues    bool
+	JournalRetention string
+	TrashRetention   string
+	MergeConflict    string
+	MergeRetries     int
 }
 
 func (d *Data) MarshalJSON() ([]byte, error) {
@@ -530,6 +1315,23 @@ func (d *Data) MarshalJSON() ([]byte, error) {
 			d.Data.Properties,
 			d.Labeling,
 			d.Ready,
+			d.StrictMerge,
+			d.AllowForce,
+			d.Annotations,
+			d.maxPostBytes(),
+			d.ReadOnly,
+			d.opKeyWindow().String(),
+			d.pendingIntents(),
+			d.utilization(),
+			d.maxQueueWait().String(),
+			d.DedupRLEs,
+			d.MergeGuardROI,
+			d.Journal,
+			d.JournalValues,
+			d.journalRetention().String(),
+			d.trashRetention().String(),
+			d.mergeConflict(),
+			d.mergeRetries(),
 		},
 	})
 }
@@ -546,11 +1348,75 @@ func (d *Data) GobDecode(b []byte) error {
 	if err := dec.Decode(&(d.Ready)); err != nil {
 		return err
 	}
-	return nil
-}
-
-func (d *Data) GobEncode() ([]byte, error) {
-	var buf bytes.Buffer
+	// Data saved before StrictMerge and AllowForce were added ends here.
+	if err := dec.Decode(&(d.StrictMerge)); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	if err := dec.Decode(&(d.AllowForce)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.Annotations)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.MaxPostBytes)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.ReadOnly)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.OpKeyWindow)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.MaxMutations)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.MaxLargeReads)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.MaxSmallReads)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.MaxQueueWait)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.DedupRLEs)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.MergeGuardROI)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.Palette)); err != nil && err != io.EOF {
+		return err
+	}
+	if len(d.Palette) == 0 {
+		d.Palette = nil
+	}
+	if err := dec.Decode(&(d.Journal)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.JournalValues)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.JournalRetention)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.TrashRetention)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.MergeConflict)); err != nil && err != io.EOF {
+		return err
+	}
+	if err := dec.Decode(&(d.MergeRetries)); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (d *Data) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
 	if err := enc.Encode(d.Data); err != nil {
 		return nil, err
@@ -561,9 +1427,91 @@ func (d *Data) GobEncode() ([]byte, error) {
 	if err := enc.Encode(d.Ready); err != nil {
 		return nil, err
 	}
+	if err := enc.Encode(d.StrictMerge); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.AllowForce); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.Annotations); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.MaxPostBytes); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.ReadOnly); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.OpKeyWindow); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.MaxMutations); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.MaxLargeReads); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.MaxSmallReads); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.MaxQueueWait); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.DedupRLEs); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.MergeGuardROI); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.Palette); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.Journal); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.JournalValues); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.JournalRetention); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.TrashRetention); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.MergeConflict); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(d.MergeRetries); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
+// ModifyConfig changes the voxel settings and the modifiable labels64 settings.  Unknown
+// settings or those that can't be modified are rejected.  Instances named by the settings
+// are only checked when modified through the HTTP API, which knows the repo.
+func (d *Data) ModifyConfig(config dvid.Config) error {
+	return d.modifyConfig(config, nil)
+}
+
+// modifyConfig changes settings, checking the instances they name with getData if it
+// isn't nil.
+func (d *Data) modifyConfig(config dvid.Config, getData func(dvid.DataString) (datastore.DataService, error)) error {
+	s := d.Settings
+	if err := s.Parse(config, true, getData); err != nil {
+		return err
+	}
+	if err := d.Data.ModifyConfig(config); err != nil {
+		return err
+	}
+	d.Settings = s
+	if _, found := config.Get("MergeGuardROI"); found {
+		d.resetCompartments()
+	}
+	d.updateLimits()
+	return nil
+}
+
 // --- voxels.IntData interface -------------
 
 // NewExtHandler returns a labels64 ExtData given some geometry and optional image data.
@@ -784,6 +1732,9 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 		if len(request.Command) < 5 {
 			return fmt.Errorf("Poorly formatted load command.  See command-line help.")
 		}
+		if err := d.checkWritable(); err != nil {
+			return err
+		}
 		// Parse the request
 		var uuidStr, dataName, cmdStr, offsetStr string
 		filenames, err := request.FilenameArgs(1, &uuidStr, &dataName, &cmdStr, &offsetStr)
@@ -847,6 +1798,238 @@ func (d *Data) DoRPC(request datastore.Request, reply *datastore.Response) error
 		}
 		return d.CreateComposite(request, reply)
 
+	case "readonly":
+		var uuidStr, dataName, cmdStr, flagStr string
+		request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &flagStr)
+		readOnly, err := strconv.ParseBool(flagStr)
+		if err != nil {
+			return fmt.Errorf("Expected \"true\" or \"false\" after readonly command, got %q", flagStr)
+		}
+		uuid, _, err := datastore.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		repo, err := datastore.RepoFromUUID(uuid)
+		if err != nil {
+			return err
+		}
+		if err := d.setReadOnly(repo, readOnly); err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Set read-only flag of data %q to %t\n", d.DataName(), readOnly)
+
+	case "backfill-sizes":
+		var uuidStr, dataName, cmdStr string
+		request.CommandArgs(1, &uuidStr, &dataName, &cmdStr)
+		_, versionID, err := datastore.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		if err := d.BackfillSizeHistory(datastore.NewVersionedContext(d, versionID)); err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Backfilled size history for data %q from node %s to root\n", d.DataName(), uuidStr)
+
+	case "rebuild-mapping":
+		var uuidStr, dataName, cmdStr string
+		request.CommandArgs(1, &uuidStr, &dataName, &cmdStr)
+		_, versionID, err := datastore.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		repair, err := d.RebuildLabelMapping(datastore.NewVersionedContext(d, versionID))
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Rebuilt label mapping for data %q at node %s from %d merges: %d merged labels, %d changed\n",
+			d.DataName(), uuidStr, repair.Merges, repair.Labels, repair.Changed)
+
+	case "dedup-rles":
+		report, err := d.DeduplicateRLEs()
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Deduplicated RLEs of data %q: rewrote %d of %d blocks as sentinels, saving %d bytes\n",
+			d.DataName(), report.Rewritten, report.Scanned, report.BytesSaved)
+
+	case "compact":
+		var uuidStr, dataName, cmdStr, labelStr string
+		request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &labelStr)
+		var label uint64
+		if labelStr != "" {
+			var err error
+			if label, err = strconv.ParseUint(labelStr, 10, 64); err != nil || label == 0 {
+				return fmt.Errorf("Illegal label %q in compact command", labelStr)
+			}
+		}
+		report, err := d.Compact(label)
+		if err != nil {
+			return err
+		}
+		var resumed string
+		if report.Resumed {
+			resumed = " (resumed)"
+		}
+		reply.Text = fmt.Sprintf("Compacted RLEs of data %q%s: examined %d blocks, rewrote %d blocks, saving %d bytes",
+			d.DataName(), resumed, report.Examined, report.Rewritten, report.BytesSaved)
+		if report.Skipped > 0 {
+			reply.Text += fmt.Sprintf(", and skipped %d blocks of labels still being merged", report.Skipped)
+		}
+		reply.Text += "\n"
+
+	case "dump-label":
+		var uuidStr, dataName, cmdStr, labelStr, filename string
+		request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &labelStr, &filename)
+		if filename == "" {
+			return fmt.Errorf("Poorly formatted dump-label command.  See command-line help.")
+		}
+		label, err := strconv.ParseUint(labelStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Illegal label %q in dump-label command", labelStr)
+		}
+		_, versionID, err := datastore.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		numBlocks, err := d.dumpLabelFile(datastore.NewVersionedContext(d, versionID), label, filename)
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Dumped %d blocks of label %d in data %q to %s\n", numBlocks, label, d.DataName(), filename)
+
+	case "restore-label":
+		var uuidStr, dataName, cmdStr string
+		args := request.CommandArgs(1, &uuidStr, &dataName, &cmdStr)
+		var filename string
+		var newLabel uint64
+		var force bool
+		for _, arg := range args {
+			switch {
+			case arg == "--force":
+				force = true
+			case filename == "":
+				filename = arg
+			case newLabel == 0:
+				label, err := strconv.ParseUint(arg, 10, 64)
+				if err != nil || label == 0 {
+					return fmt.Errorf("Illegal new label %q in restore-label command", arg)
+				}
+				newLabel = label
+			default:
+				return fmt.Errorf("Poorly formatted restore-label command.  See command-line help.")
+			}
+		}
+		if filename == "" {
+			return fmt.Errorf("Poorly formatted restore-label command.  See command-line help.")
+		}
+		uuid, versionID, err := datastore.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		repo, err := datastore.RepoFromUUID(uuid)
+		if err != nil {
+			return err
+		}
+		if err = repo.AddToLog(request.Command.String()); err != nil {
+			return err
+		}
+		restore, err := d.restoreLabelFile(datastore.NewVersionedContext(d, versionID), filename, newLabel, force)
+		if err != nil {
+			return err
+		}
+		reply.Text = fmt.Sprintf("Restored %d voxels in %d blocks of dumped label %d to label %d in data %q\n",
+			restore.Voxels, restore.Blocks, restore.DumpLabel, restore.Label, d.DataName())
+
+	case "backfill":
+		var uuidStr, dataName, cmdStr, sourceName string
+		args := request.CommandArgs(1, &uuidStr, &dataName, &cmdStr, &sourceName)
+		if sourceName == "" {
+			return fmt.Errorf("Poorly formatted backfill command.  See command-line help.")
+		}
+		var opts BackfillOptions
+		for _, arg := range args {
+			switch {
+			case strings.HasPrefix(arg, "roi="):
+				opts.ROI = dvid.DataString(strings.TrimPrefix(arg, "roi="))
+			case strings.HasPrefix(arg, "rate="):
+				rate, err := strconv.ParseFloat(strings.TrimPrefix(arg, "rate="), 64)
+				if err != nil {
+					return fmt.Errorf("Illegal rate %q in backfill command", arg)
+				}
+				opts.Rate = rate
+			default:
+				return fmt.Errorf("Poorly formatted backfill command.  See command-line help.")
+			}
+		}
+		uuid, versionID, err := datastore.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		dataservice, err := datastore.GetData(versionID, dvid.DataString(sourceName))
+		if err != nil {
+			return err
+		}
+		source, ok := dataservice.(*Data)
+		if !ok {
+			return fmt.Errorf("Backfill source %q is not labels64 data", sourceName)
+		}
+		repo, err := datastore.RepoFromUUID(uuid)
+		if err != nil {
+			return err
+		}
+		if err = repo.AddToLog(request.Command.String()); err != nil {
+			return err
+		}
+		ctx := datastore.NewVersionedContext(d, versionID)
+		state, err := d.startBackfill(ctx, source, opts)
+		if err != nil {
+			return err
+		}
+		go d.runBackfill(ctx, source, opts, state)
+		reply.Text = fmt.Sprintf("Started backfill of data %q from %q after %d blocks.  See the backfill endpoint for progress.\n",
+			d.DataName(), source.DataName(), state.cursor.Blocks)
+
+	case "generate-test-data":
+		var uuidStr, dataName, cmdStr string
+		args := request.CommandArgs(1, &uuidStr, &dataName, &cmdStr)
+		var opts TestDataOptions
+		for _, arg := range args {
+			var err error
+			switch {
+			case arg == "--force":
+				opts.Force = true
+			case strings.HasPrefix(arg, "--labels="):
+				opts.Labels, err = strconv.Atoi(strings.TrimPrefix(arg, "--labels="))
+			case strings.HasPrefix(arg, "--mean-size="):
+				opts.MeanSize, err = strconv.ParseUint(strings.TrimPrefix(arg, "--mean-size="), 10, 64)
+			case strings.HasPrefix(arg, "--distribution="):
+				opts.Distribution = strings.TrimPrefix(arg, "--distribution=")
+			case strings.HasPrefix(arg, "--seed="):
+				opts.Seed, err = strconv.ParseInt(strings.TrimPrefix(arg, "--seed="), 10, 64)
+			default:
+				return fmt.Errorf("Poorly formatted generate-test-data command.  See command-line help.")
+			}
+			if err != nil {
+				return fmt.Errorf("Illegal argument %q in generate-test-data command", arg)
+			}
+		}
+		uuid, versionID, err := datastore.MatchingUUID(uuidStr)
+		if err != nil {
+			return err
+		}
+		repo, err := datastore.RepoFromUUID(uuid)
+		if err != nil {
+			return err
+		}
+		if err = repo.AddToLog(request.Command.String()); err != nil {
+			return err
+		}
+		report, err := d.GenerateTestData(datastore.NewVersionedContext(d, versionID), opts)
+		if err != nil {
+			return err
+		}
+		reply.Text = report.String()
+
 	default:
 		return fmt.Errorf("Unknown command.  Data type '%s' [%s] does not support '%s' command.",
 			d.DataName(), d.TypeName(), request.TypeCommand())
@@ -860,15 +2043,16 @@ type Bounds struct {
 	Exact       bool // All RLEs must respect the voxel bounds.  If false, just screen on blocks.
 }
 
-// ServeHTTP handles all incoming HTTP requests for this data.
+// ServeHTTP handles all incoming HTTP requests for this data.  Errors are returned as
+// JSON with a request id that is also included in the logs.
 func (d *Data) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	timedLog := dvid.NewTimeLog()
+	requestID := server.NewRequestID()
 
 	// Get repo and version ID of this request
 	repo, versions, err := datastore.FromContext(ctx)
 	if err != nil {
-		server.BadRequest(w, r, "Error: %q ServeHTTP has invalid context: %s\n",
-			d.DataName, err.Error())
+		server.ErrorResponse(w, r, requestID, fmt.Errorf("%q ServeHTTP has invalid context: %s", d.DataName(), err.Error()))
 		return
 	}
 
@@ -888,7 +2072,7 @@ func (d *Data) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Req
 	case "post":
 		op = voxels.PutOp
 	default:
-		server.BadRequest(w, r, "Can only handle GET or POST HTTP verbs")
+		server.ErrorResponse(w, r, requestID, fmt.Errorf("Can only handle GET or POST HTTP verbs"))
 		return
 	}
 
@@ -911,15 +2095,15 @@ func (d *Data) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Req
 	if len(parts) == 3 && op == voxels.PutOp {
 		config, err := server.DecodeJSON(r)
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
-		if err := d.ModifyConfig(config); err != nil {
-			server.BadRequest(w, r, err.Error())
+		if err := d.modifyConfig(config, repo.GetDataByName); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
 		if err := repo.Save(); err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, storageError(err))
 			return
 		}
 		fmt.Fprintf(w, "Changed '%s' based on received configuration:\n%s\n", d.DataName(), config)
@@ -927,10 +2111,39 @@ func (d *Data) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Req
 	}
 
 	if len(parts) < 4 {
-		server.BadRequest(w, r, "Incomplete API request")
+		server.ErrorResponse(w, r, requestID, fmt.Errorf("Incomplete API request"))
 		return
 	}
 
+	// Refuse modifications of frozen data.  Repairs only finish merges begun before the
+	// data was frozen, batches of sparse volumes and last modifications are only read, and
+	// settings only configure the instance.
+	if op == voxels.PutOp && parts[3] != "readonly" && parts[3] != "repair" && parts[3] != "sparsevols" &&
+		parts[3] != "lastmod" && parts[3] != "settings" {
+		if err := d.checkWritable(); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+	}
+
+	// Wait for a slot of the request's concurrency class.
+	if class, limited := requestClass(parts[3], action); limited {
+		release, err := d.acquireSlot(class)
+		if err != nil {
+			busyResponse(w, r, requestID, err)
+			return
+		}
+		defer release()
+	}
+
+	// Record latencies of label modification and sparse volume endpoints.
+	switch parts[3] {
+	case "merge", "split", "sparsevol", "sparsevols":
+		timer := server.TimeLatency("labels64/"+parts[3], w)
+		defer timer.Done()
+		w = timer
+	}
+
 	// Process help and info.
 	switch parts[3] {
 	case "help":
@@ -940,24 +2153,81 @@ func (d *Data) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Req
 	case "metadata":
 		jsonStr, err := d.NdDataMetadata()
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/vnd.dvid-nd-data+json")
 		fmt.Fprintln(w, jsonStr)
 
+	case "readonly":
+		// GET  <api URL>/node/<UUID>/<data name>/readonly
+		// POST <api URL>/node/<UUID>/<data name>/readonly
+		d.serveReadOnly(repo, w, r, requestID)
+
+	case "colormap":
+		// GET  <api URL>/node/<UUID>/<data name>/colormap[/<label>]
+		// POST <api URL>/node/<UUID>/<data name>/colormap
+		d.serveColormap(repo, w, r, requestID, parts[4:])
+
+	case "trash", "restore":
+		// GET  <api URL>/node/<UUID>/<data name>/trash
+		// POST <api URL>/node/<UUID>/<data name>/trash/<label>
+		// POST <api URL>/node/<UUID>/<data name>/restore/<label>[?label=<new label>]
+		d.serveTrash(repo, storeCtx, w, r, requestID, parts)
+
 	case "info":
 		jsonBytes, err := d.MarshalJSON()
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		gw := server.NewGzipResponseWriter(w, r)
+		defer gw.Close()
+		gw.Header().Set("Content-Type", "application/json")
+		gw.Write(jsonBytes)
+
+	case "settings":
+		// GET  <api URL>/node/<UUID>/<data name>/settings
+		// POST <api URL>/node/<UUID>/<data name>/settings
+		if action == "post" {
+			config, err := server.DecodeJSON(r)
+			if err != nil {
+				server.ErrorResponse(w, r, requestID, err)
+				return
+			}
+			if err := d.modifyConfig(config, repo.GetDataByName); err != nil {
+				server.ErrorResponse(w, r, requestID, err)
+				return
+			}
+			if err := repo.Save(); err != nil {
+				server.ErrorResponse(w, r, requestID, storageError(err))
+				return
+			}
+		}
+		jsonBytes, err := json.Marshal(settings.Values(d.settingValues()))
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, string(jsonBytes))
 
+	case "neuroglancer":
+		// GET <api URL>/node/<UUID>/<data name>/neuroglancer
+		if action != "get" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Neuroglancer requests must be GET actions."))
+			return
+		}
+		uuid, err := datastore.UUIDFromVersion(versionID)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		d.serveNeuroglancer(w, r, requestID, uuid)
+
 	case "raw", "isotropic":
 		if len(parts) < 7 {
-			server.BadRequest(w, r, "'%s' must be followed by shape/size/offset", parts[3])
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("'%s' must be followed by shape/size/offset", parts[3]))
 			return
 		}
 		var isotropic bool = (parts[3] == "isotropic")
@@ -965,66 +2235,70 @@ func (d *Data) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Req
 		planeStr := dvid.DataShapeString(shapeStr)
 		plane, err := planeStr.DataShape()
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
 		switch plane.ShapeDimensions() {
 		case 2:
 			slice, err := dvid.NewSliceFromStrings(planeStr, offsetStr, sizeStr, "_")
 			if err != nil {
-				server.BadRequest(w, r, err.Error())
+				server.ErrorResponse(w, r, requestID, err)
 				return
 			}
 			if op == voxels.PutOp {
 				if isotropic {
-					server.BadRequest(w, r, "can only PUT 'raw' not 'isotropic' images")
+					server.ErrorResponse(w, r, requestID, fmt.Errorf("can only PUT 'raw' not 'isotropic' images"))
 					return
 				}
 				// TODO -- Put in format checks for POSTed image.
 				postedImg, _, err := image.Decode(r.Body)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, err)
 					return
 				}
 				e, err := d.NewExtHandler(slice, postedImg)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, err)
 					return
 				}
 				if roiptr != nil {
 					roiptr.Iter, err = roi.NewIterator(roiname, versionID, e)
 					if err != nil {
-						server.BadRequest(w, r, err.Error())
+						server.ErrorResponse(w, r, requestID, err)
 						return
 					}
 				}
 				modsChan := make(voxels.BlockChannel)
-				go d.denormFunc(versionID, modsChan)
+				denormID := d.startDenorm(versionID, modsChan)
 				var opts voxels.OpOptions
 				opts.SetROI(roiptr)
 				opts.SetModsChannel(modsChan)
 				err = voxels.PutVoxels(storeCtx, d, e, opts)
+				d.endDenorm(modsChan, denormID, err)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, storageError(err))
 					return
 				}
+				// Label blocks are stored after they are sent for denormalization.
+				d.invalidateAdjacency(versionID, nil)
+				d.invalidateCompartments(versionID, nil)
 			} else {
 				rawSlice, err := dvid.Isotropy2D(d.Properties.VoxelSize, slice, isotropic)
 				e, err := d.NewExtHandler(rawSlice, nil)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, err)
 					return
 				}
 				if roiptr != nil {
 					roiptr.Iter, err = roi.NewIterator(roiname, versionID, e)
 					if err != nil {
-						server.BadRequest(w, r, err.Error())
+						server.ErrorResponse(w, r, requestID, err)
 						return
 					}
 				}
 				img, err := voxels.GetImage(storeCtx, d, e, roiptr)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, storageError(err))
 					return
 				}
 				if isotropic {
@@ -1032,7 +2306,7 @@ func (d *Data) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Req
 					dstH := int(slice.Size().Value(1))
 					img, err = img.ScaleImage(dstW, dstH)
 					if err != nil {
-						server.BadRequest(w, r, err.Error())
+						server.ErrorResponse(w, r, requestID, err)
 						return
 					}
 				}
@@ -1043,11 +2317,11 @@ func (d *Data) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Req
 				//dvid.ElapsedTime(dvid.Normal, startTime, "%s %s upto image formatting", op, slice)
 				err = dvid.WriteImageHttp(w, img.Get(), formatStr)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, err)
 					return
 				}
 			}
-			timedLog.Infof("HTTP %s: %s (%s)", r.Method, plane, r.URL)
+			timedLog.Infof("[%s] HTTP %s: %s (%s)", requestID, r.Method, plane, r.URL)
 		case 3:
 			queryStrings := r.URL.Query()
 			throttle := queryStrings.Get("throttle")
@@ -1059,317 +2333,942 @@ func (d *Data) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Req
 						server.Throttle <- 1
 					}()
 				default:
-					throttleMsg := fmt.Sprintf("Server already running maximum of %d throttled operations",
-						server.MaxThrottledOps)
-					http.Error(w, throttleMsg, http.StatusServiceUnavailable)
+					server.ErrorResponse(w, r, requestID, server.NewError(server.UnavailableError,
+						"Server already running maximum of %d throttled operations", server.MaxThrottledOps))
 					return
 				}
 			}
 			subvol, err := dvid.NewSubvolumeFromStrings(offsetStr, sizeStr, "_")
 			if err != nil {
-				server.BadRequest(w, r, err.Error())
+				server.ErrorResponse(w, r, requestID, err)
 				return
 			}
 			if op == voxels.GetOp {
 				e, err := d.NewExtHandler(subvol, nil)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, err)
 					return
 				}
 				if roiptr != nil {
 					roiptr.Iter, err = roi.NewIterator(roiname, versionID, e)
 					if err != nil {
-						server.BadRequest(w, r, err.Error())
+						server.ErrorResponse(w, r, requestID, err)
 						return
 					}
 				}
 				data, err := voxels.GetVolume(storeCtx, d, e, roiptr)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, storageError(err))
 					return
 				}
 				w.Header().Set("Content-type", "application/octet-stream")
 				_, err = w.Write(data)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, err)
 					return
 				}
 			} else {
 				if isotropic {
-					server.BadRequest(w, r, "can only PUT 'raw' not 'isotropic' images")
+					server.ErrorResponse(w, r, requestID, fmt.Errorf("can only PUT 'raw' not 'isotropic' images"))
 					return
 				}
 				data, err := ioutil.ReadAll(r.Body)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, err)
 					return
 				}
 				e, err := d.NewExtHandler(subvol, data)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, err)
 					return
 				}
 				if roiptr != nil {
 					roiptr.Iter, err = roi.NewIterator(roiname, versionID, e)
 					if err != nil {
-						server.BadRequest(w, r, err.Error())
+						server.ErrorResponse(w, r, requestID, err)
 						return
 					}
 				}
 				modsChan := make(voxels.BlockChannel)
-				go d.denormFunc(versionID, modsChan)
+				denormID := d.startDenorm(versionID, modsChan)
 				var opts voxels.OpOptions
 				opts.SetROI(roiptr)
 				opts.SetModsChannel(modsChan)
 				err = voxels.PutVoxels(storeCtx, d, e, opts)
+				d.endDenorm(modsChan, denormID, err)
 				if err != nil {
-					server.BadRequest(w, r, err.Error())
+					server.ErrorResponse(w, r, requestID, storageError(err))
 					return
 				}
+				// Label blocks are stored after they are sent for denormalization.
+				d.invalidateAdjacency(versionID, nil)
+				d.invalidateCompartments(versionID, nil)
 			}
-			timedLog.Infof("HTTP %s: %s (%s)", r.Method, subvol, r.URL)
+			timedLog.Infof("[%s] HTTP %s: %s (%s)", requestID, r.Method, subvol, r.URL)
 		default:
-			server.BadRequest(w, r, "DVID currently supports shapes of only 2 and 3 dimensions")
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID currently supports shapes of only 2 and 3 dimensions"))
 			return
 		}
 
 	case "sparsevol":
 		// GET <api URL>/node/<UUID>/<data name>/sparsevol/<label>
 		if len(parts) < 5 {
-			server.BadRequest(w, r, "ERROR: DVID requires label ID to follow 'sparsevol' command")
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires label ID to follow 'sparsevol' command"))
 			return
 		}
 		label, err := strconv.ParseUint(parts[4], 10, 64)
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
 		queryValues := r.URL.Query()
 		var b Bounds
 		b.VoxelBounds, err = dvid.BoundsFromQueryString(r)
 		if err != nil {
-			server.BadRequest(w, r, "Error parsing bounds from query string: %s\n", err.Error())
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Error parsing bounds from query string: %s", err.Error()))
 			return
 		}
 		blockSize, ok := d.BlockSize().(dvid.Point3d)
 		if !ok {
-			server.BadRequest(w, r, "sparsevol tried to get 3d block failed")
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("sparsevol tried to get 3d block failed"))
 			return
 		}
 		b.BlockBounds = b.VoxelBounds.Divide(blockSize)
 		b.Exact = queryValues.Get("exact") == "true"
+		etag, notModified := d.labelNotModified(w, r, storeCtx, repo, "sparsevol", label)
+		if notModified {
+			timedLog.Infof("[%s] HTTP %s: sparsevol on label %d not modified (%s)", requestID, r.Method, label, r.URL)
+			return
+		}
 		data, err := GetSparseVol(storeCtx, label, b)
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, storageError(err))
 			return
 		}
-		w.Header().Set("Content-type", "application/octet-stream")
-		_, err = w.Write(data)
+		if etag == "" {
+			etag = server.ContentETag(data, versionID, d.DataName(), "sparsevol", label, r.URL.RawQuery)
+		}
+		server.ServeRanged(w, r, "application/octet-stream", etag, data)
+		timedLog.Infof("[%s] HTTP %s: sparsevol on label %d (%s)", requestID, r.Method, label, r.URL)
+
+	case "sparsevols":
+		// POST <api URL>/node/<UUID>/<data name>/sparsevols
+		if action != "post" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Batch sparse volume requests must be POST actions."))
+			return
+		}
+		var labelList []uint64
+		if err := json.NewDecoder(r.Body).Decode(&labelList); err != nil {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Expected JSON array of label ids: %s", err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		var out io.Writer = w
+		var gz *gzip.Writer
+		if dvid.SupportsGzipEncoding(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Add("Vary", "Accept-Encoding")
+			gz = gzip.NewWriter(w)
+			out = gz
+		}
+		err := WriteSparseVols(storeCtx, out, labelList)
+		if gz != nil {
+			gz.Close()
+		}
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			// The response has been started, so the client sees a truncated stream.
+			dvid.Errorf("[%s] Aborted sparsevols response after error: %s\n", requestID, err.Error())
 			return
 		}
-		timedLog.Infof("HTTP %s: sparsevol on label %d (%s)", r.Method, label, r.URL)
+		timedLog.Infof("[%s] HTTP %s: sparsevols for %d labels (%s)", requestID, r.Method, len(labelList), r.URL)
 
 	case "sparsevol-by-point":
 		// GET <api URL>/node/<UUID>/<data name>/sparsevol-by-point/<coord>
 		if len(parts) < 5 {
-			server.BadRequest(w, r, "ERROR: DVID requires coord to follow 'sparsevol-by-point' command")
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires coord to follow 'sparsevol-by-point' command"))
 			return
 		}
 		coord, err := dvid.StringToPoint(parts[4], "_")
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
 		label, err := d.GetLabelAtPoint(storeCtx, coord)
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, storageError(err))
 			return
 		}
 		data, err := GetSparseVol(storeCtx, label, Bounds{})
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
-			return
-		}
-		w.Header().Set("Content-type", "application/octet-stream")
-		_, err = w.Write(data)
-		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, storageError(err))
 			return
 		}
-		timedLog.Infof("HTTP %s: sparsevol-by-point at %s (%s)", r.Method, coord, r.URL)
+		etag := server.ContentETag(data, versionID, d.DataName(), "sparsevol-by-point", label, r.URL.RawQuery)
+		server.ServeRanged(w, r, "application/octet-stream", etag, data)
+		timedLog.Infof("[%s] HTTP %s: sparsevol-by-point at %s (%s)", requestID, r.Method, coord, r.URL)
 
 	case "sparsevol-coarse":
 		// GET <api URL>/node/<UUID>/<data name>/sparsevol-coarse/<label>
 		if len(parts) < 5 {
-			server.BadRequest(w, r, "ERROR: DVID requires label ID to follow 'sparsevol-coarse' command")
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires label ID to follow 'sparsevol-coarse' command"))
 			return
 		}
 		label, err := strconv.ParseUint(parts[4], 10, 64)
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		etag, notModified := d.labelNotModified(w, r, storeCtx, repo, "sparsevol-coarse", label)
+		if notModified {
+			timedLog.Infof("[%s] HTTP %s: sparsevol-coarse on label %d not modified (%s)", requestID, r.Method, label, r.URL)
 			return
 		}
 		data, err := GetSparseCoarseVol(storeCtx, label)
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, storageError(err))
 			return
 		}
-		w.Header().Set("Content-type", "application/octet-stream")
-		_, err = w.Write(data)
-		if err != nil {
-			server.BadRequest(w, r, err.Error())
-			return
+		if etag == "" {
+			etag = server.ContentETag(data, versionID, d.DataName(), "sparsevol-coarse", label, r.URL.RawQuery)
 		}
-		timedLog.Infof("HTTP %s: sparsevol-coarse on label %d (%s)", r.Method, label, r.URL)
+		server.ServeRanged(w, r, "application/octet-stream", etag, data)
+		timedLog.Infof("[%s] HTTP %s: sparsevol-coarse on label %d (%s)", requestID, r.Method, label, r.URL)
 
 	case "surface":
 		// GET <api URL>/node/<UUID>/<data name>/surface/<label>
 		if len(parts) < 5 {
-			server.BadRequest(w, r, "ERROR: DVID requires label ID to follow 'surface' command")
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires label ID to follow 'surface' command"))
 			return
 		}
 		label, err := strconv.ParseUint(parts[4], 10, 64)
 		fmt.Printf("Getting surface for label %d\n", label)
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
 		gzipData, found, err := GetSurface(storeCtx, label)
 		if err != nil {
-			server.BadRequest(w, r, "Error on getting surface for label %d: %s", label, err.Error())
+			server.ErrorResponse(w, r, requestID, server.NewError(server.StorageError,
+				"Error on getting surface for label %d: %s", label, err.Error()))
 			return
 		}
 		if !found {
-			http.Error(w, fmt.Sprintf("Surface for label '%d' not found", label), http.StatusNotFound)
+			server.ErrorResponse(w, r, requestID, server.NewError(server.NotFoundError, "Surface for label %d not found", label))
 			return
 		}
 		w.Header().Set("Content-type", "application/octet-stream")
 		if err := dvid.WriteGzip(gzipData, w, r); err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
-		timedLog.Infof("HTTP %s: surface on label %d (%s)", r.Method, label, r.URL)
+		timedLog.Infof("[%s] HTTP %s: surface on label %d (%s)", requestID, r.Method, label, r.URL)
 
 	case "surface-by-point":
 		// GET <api URL>/node/<UUID>/<data name>/surface-by-point/<coord>
 		if len(parts) < 5 {
-			server.BadRequest(w, r, "ERROR: DVID requires coord to follow 'surface-by-point' command")
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires coord to follow 'surface-by-point' command"))
 			return
 		}
 		coord, err := dvid.StringToPoint(parts[4], "_")
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
 		label, err := d.GetLabelAtPoint(storeCtx, coord)
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, storageError(err))
 			return
 		}
 		gzipData, found, err := GetSurface(storeCtx, label)
 		if err != nil {
-			server.BadRequest(w, r, "Error on getting surface for label %d: %s", label, err.Error())
+			server.ErrorResponse(w, r, requestID, server.NewError(server.StorageError,
+				"Error on getting surface for label %d: %s", label, err.Error()))
 			return
 		}
 		if !found {
-			http.Error(w, fmt.Sprintf("Surface for label '%d' not found", label), http.StatusNotFound)
+			server.ErrorResponse(w, r, requestID, server.NewError(server.NotFoundError, "Surface for label %d not found", label))
 			return
 		}
 		fmt.Printf("Found surface for label %d: %d bytes (gzip payload)\n", label, len(gzipData))
 		w.Header().Set("Content-type", "application/octet-stream")
 		if err := dvid.WriteGzip(gzipData, w, r); err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
-		timedLog.Infof("HTTP %s: surface-by-point at %s (%s)", r.Method, coord, r.URL)
+		timedLog.Infof("[%s] HTTP %s: surface-by-point at %s (%s)", requestID, r.Method, coord, r.URL)
 
 	case "label":
 		// GET <api URL>/node/<UUID>/<data name>/label/<coord>
 		if len(parts) < 5 {
-			server.BadRequest(w, r, "ERROR: DVID requires coord to follow 'label' command")
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires coord to follow 'label' command"))
 			return
 		}
 		coord, err := dvid.StringToPoint(parts[4], "_")
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
 		label, err := d.GetLabelAtPoint(storeCtx, coord)
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, storageError(err))
 			return
 		}
 		w.Header().Set("Content-type", "application/json")
 		jsonStr := fmt.Sprintf(`{"Label": %d}`, label)
 		fmt.Fprintf(w, jsonStr)
-		timedLog.Infof("HTTP %s: label at %s (%s)", r.Method, coord, r.URL)
+		timedLog.Infof("[%s] HTTP %s: label at %s (%s)", requestID, r.Method, coord, r.URL)
 
 	case "sizerange":
 		// GET <api URL>/node/<UUID>/<data name>/sizerange/<min size>/<optional max size>
 		if len(parts) < 5 {
-			server.BadRequest(w, r, "ERROR: DVID requires at least the minimum size to follow 'sizerange' command")
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires at least the minimum size to follow 'sizerange' command"))
 			return
 		}
 		minSize, err := strconv.ParseUint(parts[4], 10, 64)
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
 		var maxSize uint64
 		if len(parts) >= 6 {
 			maxSize, err = strconv.ParseUint(parts[5], 10, 64)
 			if err != nil {
-				server.BadRequest(w, r, err.Error())
+				server.ErrorResponse(w, r, requestID, err)
 				return
 			}
 		}
 		jsonStr, err := GetSizeRange(d, versionID, minSize, maxSize)
 		if err != nil {
-			server.BadRequest(w, r, err.Error())
+			server.ErrorResponse(w, r, requestID, storageError(err))
+			return
+		}
+		gw := server.NewGzipResponseWriter(w, r)
+		defer gw.Close()
+		gw.Header().Set("Content-type", "application/json")
+		gw.Write([]byte(jsonStr))
+		timedLog.Infof("[%s] HTTP %s: get labels with volume > %d and < %d (%s)", requestID, r.Method, minSize, maxSize, r.URL)
+
+	case "labels":
+		// GET <api URL>/node/<UUID>/<data name>/labels?start=<label>&count=<count>
+		if action != "get" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Label listing requests must be GET actions."))
+			return
+		}
+		queryValues := r.URL.Query()
+		var start, minSize uint64
+		count := DefaultLabelListCount
+		if s := queryValues.Get("start"); s != "" {
+			if start, err = strconv.ParseUint(s, 10, 64); err != nil {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("Bad start label %q: %s", s, err.Error()))
+				return
+			}
+		}
+		if s := queryValues.Get("count"); s != "" {
+			if count, err = strconv.Atoi(s); err != nil || count < 1 {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("Bad count %q: must be a positive integer", s))
+				return
+			}
+		}
+		if s := queryValues.Get("minsize"); s != "" {
+			if minSize, err = strconv.ParseUint(s, 10, 64); err != nil {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("Bad minsize %q: %s", s, err.Error()))
+				return
+			}
+		}
+		list, err := ListLabels(storeCtx, start, count, minSize)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, storageError(err))
+			return
+		}
+		jsonBytes, err := json.Marshal(list)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		gw := server.NewGzipResponseWriter(w, r)
+		defer gw.Close()
+		gw.Header().Set("Content-type", "application/json")
+		gw.Write(jsonBytes)
+		timedLog.Infof("[%s] HTTP %s: list %d labels starting at %d (%s)", requestID, r.Method, len(list.Labels), start, r.URL)
+
+	case "projection":
+		// GET <api URL>/node/<UUID>/<data name>/projection/xy/<size>/<offset>/<depth>
+		if action != "get" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Projection requests must be GET actions."))
+			return
+		}
+		d.serveProjection(storeCtx, w, r, requestID, parts[4:])
+		timedLog.Infof("[%s] HTTP %s: label projection (%s)", requestID, r.Method, r.URL)
+
+	case "projection-job":
+		// GET <api URL>/node/<UUID>/<data name>/projection-job/<id>
+		if action != "get" || len(parts) < 5 {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Projection job requests must be GET actions followed by a job id."))
+			return
+		}
+		d.serveProjectionJob(w, r, requestID, parts[4])
+
+	case "backfill":
+		// GET <api URL>/node/<UUID>/<data name>/backfill
+		if action != "get" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Backfill status requests must be GET actions."))
+			return
+		}
+		status := d.BackfillStatus()
+		if status == nil {
+			server.ErrorResponse(w, r, requestID, server.NewError(server.NotFoundError,
+				"No backfill of %q since the server started", d.DataName()))
+			return
+		}
+		jsonBytes, err := json.Marshal(status)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
 		w.Header().Set("Content-type", "application/json")
-		fmt.Fprintf(w, jsonStr)
-		timedLog.Infof("HTTP %s: get labels with volume > %d and < %d (%s)", r.Method, minSize, maxSize, r.URL)
+		w.Write(jsonBytes)
+
+	case "size-history":
+		// GET <api URL>/node/<UUID>/<data name>/size-history/<label>
+		if len(parts) < 5 {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires a label ID to follow 'size-history' command"))
+			return
+		}
+		if action != "get" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Size history requests must be GET actions."))
+			return
+		}
+		label, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		history, err := d.GetSizeHistory(storeCtx, label)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, storageError(err))
+			return
+		}
+		jsonBytes, err := json.Marshal(history)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		gw := server.NewGzipResponseWriter(w, r)
+		defer gw.Close()
+		gw.Header().Set("Content-type", "application/json")
+		gw.Write(jsonBytes)
+		timedLog.Infof("[%s] HTTP %s: size history of label %d (%s)", requestID, r.Method, label, r.URL)
+
+	case "lastmod":
+		// GET <api URL>/node/<UUID>/<data name>/lastmod/<label>
+		// POST <api URL>/node/<UUID>/<data name>/lastmod
+		var labelList []uint64
+		switch action {
+		case "get":
+			if len(parts) < 5 {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires a label ID to follow 'lastmod' command"))
+				return
+			}
+			label, err := strconv.ParseUint(parts[4], 10, 64)
+			if err != nil {
+				server.ErrorResponse(w, r, requestID, err)
+				return
+			}
+			labelList = []uint64{label}
+		case "post":
+			if err := json.NewDecoder(r.Body).Decode(&labelList); err != nil {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("Expected JSON array of label ids: %s", err.Error()))
+				return
+			}
+			if len(labelList) > MaxLastModLabels {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("Batch lastmod request has %d labels, more than the maximum of %d", len(labelList), MaxLastModLabels))
+				return
+			}
+		default:
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Last modification requests must be GET or POST actions."))
+			return
+		}
+		lastMods, err := d.GetLastMods(storeCtx, repo, labelList)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, storageError(err))
+			return
+		}
+		var jsonBytes []byte
+		if action == "get" {
+			jsonBytes, err = json.Marshal(lastMods[0])
+		} else {
+			jsonBytes, err = json.Marshal(lastMods)
+		}
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		w.Header().Set("Content-type", "application/json")
+		w.Write(jsonBytes)
+		timedLog.Infof("[%s] HTTP %s: last modification of %d labels (%s)", requestID, r.Method, len(labelList), r.URL)
+
+	case "blocks-cseg":
+		// GET <api URL>/node/<UUID>/<data name>/blocks-cseg/<label>/<block coord>[/<block coord>...]
+		// GET <api URL>/node/<UUID>/<data name>/blocks-cseg/<label>?minblock=<block coord>&maxblock=<block coord>
+		if len(parts) < 5 {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires a label ID to follow 'blocks-cseg' command"))
+			return
+		}
+		if action != "get" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Compressed segmentation block requests must be GET actions."))
+			return
+		}
+		label, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		var blocks []dvid.IndexZYX
+		for _, part := range parts[5:] {
+			if part == "" {
+				continue
+			}
+			blockCoord, err := dvid.StringToChunkPoint3d(part, "_")
+			if err != nil {
+				server.ErrorResponse(w, r, requestID, err)
+				return
+			}
+			blocks = append(blocks, dvid.IndexZYX(blockCoord))
+		}
+		minStr, maxStr := queryValues.Get("minblock"), queryValues.Get("maxblock")
+		if minStr != "" || maxStr != "" {
+			if len(blocks) != 0 {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("Give either block coordinates or a block range, not both"))
+				return
+			}
+			minBlock, err := dvid.StringToChunkPoint3d(minStr, "_")
+			if err != nil {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("Bad minblock: %s", err.Error()))
+				return
+			}
+			maxBlock, err := dvid.StringToChunkPoint3d(maxStr, "_")
+			if err != nil {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("Bad maxblock: %s", err.Error()))
+				return
+			}
+			if blocks, err = csegBlockRange(minBlock, maxBlock); err != nil {
+				server.ErrorResponse(w, r, requestID, err)
+				return
+			}
+		}
+		if len(blocks) == 0 {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires block coordinates or a block range for 'blocks-cseg' command"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := d.WriteCsegBlocks(storeCtx, w, label, blocks); err != nil {
+			// The response may have been started, so the client sees a truncated stream.
+			dvid.Errorf("[%s] Aborted blocks-cseg response after error: %s\n", requestID, err.Error())
+			return
+		}
+		timedLog.Infof("[%s] HTTP %s: %d compressed segmentation blocks of label %d (%s)", requestID, r.Method, len(blocks), label, r.URL)
+
+	case "block-history":
+		// GET <api URL>/node/<UUID>/<data name>/block-history/<label>/<block coord>
+		if len(parts) < 6 {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires a label ID and block coordinate to follow 'block-history' command"))
+			return
+		}
+		if action != "get" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Block history requests must be GET actions."))
+			return
+		}
+		label, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		blockCoord, err := dvid.StringToChunkPoint3d(parts[5], "_")
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		history, err := d.GetBlockHistory(storeCtx, label, dvid.IndexZYX(blockCoord))
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, storageError(err))
+			return
+		}
+		jsonBytes, err := json.Marshal(history)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		w.Header().Set("Content-type", "application/json")
+		w.Write(jsonBytes)
+		timedLog.Infof("[%s] HTTP %s: history of label %d in block %s (%s)", requestID, r.Method, label, blockCoord, r.URL)
+
+	case "mapping":
+		// GET <api URL>/node/<UUID>/<data name>/mapping[?format=csv|json|binary]
+		// GET <api URL>/node/<UUID>/<data name>/mapping/<label>
+		if action != "get" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Mapping requests must be GET actions."))
+			return
+		}
+		mapping, err := d.GetLabelMapping(storeCtx)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, storageError(err))
+			return
+		}
+		if len(parts) >= 5 && parts[4] != "" {
+			label, err := strconv.ParseUint(parts[4], 10, 64)
+			if err != nil {
+				server.ErrorResponse(w, r, requestID, err)
+				return
+			}
+			w.Header().Set("Content-type", "application/json")
+			fmt.Fprintf(w, `{"label": %d, "mapped": %d}`, label, mapping.Mapped(label))
+			timedLog.Infof("[%s] HTTP %s: mapping of label %d (%s)", requestID, r.Method, label, r.URL)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		switch format {
+		case "", MappingJSON:
+			pairs := make([][2]uint64, 0, len(mapping))
+			for _, label := range mapping.Labels() {
+				pairs = append(pairs, [2]uint64{label, mapping[label]})
+			}
+			jsonBytes, err := json.Marshal(pairs)
+			if err != nil {
+				server.ErrorResponse(w, r, requestID, err)
+				return
+			}
+			w.Header().Set("Content-type", "application/json")
+			w.Write(jsonBytes)
+		case MappingCSV:
+			w.Header().Set("Content-type", "text/csv")
+			fmt.Fprintf(w, "label,mapped\n")
+			for _, label := range mapping.Labels() {
+				fmt.Fprintf(w, "%d,%d\n", label, mapping[label])
+			}
+		case MappingBinary:
+			serialization, err := mapping.MarshalBinary()
+			if err != nil {
+				server.ErrorResponse(w, r, requestID, err)
+				return
+			}
+			w.Header().Set("Content-type", "application/octet-stream")
+			w.Write(serialization)
+		default:
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Unknown mapping format %q: use %q, %q, or %q", format, MappingJSON, MappingCSV, MappingBinary))
+			return
+		}
+		timedLog.Infof("[%s] HTTP %s: mapping of %d merged labels (%s)", requestID, r.Method, len(mapping), r.URL)
+
+	case "adjacency":
+		// GET <api URL>/node/<UUID>/<data name>/adjacency/<label>?mincontact=<# voxels>
+		if len(parts) < 5 {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires a label ID to follow 'adjacency' command"))
+			return
+		}
+		if action != "get" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Adjacency requests must be GET actions."))
+			return
+		}
+		label, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		var minContact uint64
+		if s := queryValues.Get("mincontact"); s != "" {
+			if minContact, err = strconv.ParseUint(s, 10, 64); err != nil {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("Bad mincontact %q: %s", s, err.Error()))
+				return
+			}
+		}
+		adjacency, err := d.GetAdjacency(storeCtx, label, minContact)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, storageError(err))
+			return
+		}
+		jsonBytes, err := json.Marshal(adjacency)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		w.Header().Set("Content-type", "application/json")
+		w.Write(jsonBytes)
+		timedLog.Infof("[%s] HTTP %s: %d labels adjacent to label %d (%s)", requestID, r.Method, len(adjacency), label, r.URL)
+
+	case "changed-labels", "changed-sparsevols":
+		// GET <api URL>/node/<UUID>/<data name>/changed-labels?since=<UUID>
+		// GET <api URL>/node/<UUID>/<data name>/changed-sparsevols?since=<UUID>
+		if action != "get" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Changed label requests must be GET actions."))
+			return
+		}
+		sinceStr := queryValues.Get("since")
+		if sinceStr == "" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("%s requires a 'since' query string with an ancestor UUID", parts[3]))
+			return
+		}
+		since, _, err := datastore.MatchingUUID(sinceStr)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, server.NewError(server.NotFoundError, "%s", err.Error()))
+			return
+		}
+		changes, err := d.GetChangedLabels(storeCtx, since)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, storageError(err))
+			return
+		}
+		if parts[3] == "changed-labels" {
+			jsonBytes, err := json.Marshal(changes)
+			if err != nil {
+				server.ErrorResponse(w, r, requestID, err)
+				return
+			}
+			w.Header().Set("Content-type", "application/json")
+			w.Write(jsonBytes)
+			timedLog.Infof("[%s] HTTP %s: %d labels changed since %s (%s)", requestID, r.Method, len(changes.Labels), since, r.URL)
+			return
+		}
+		labelList := make([]uint64, len(changes.Labels))
+		for i, change := range changes.Labels {
+			labelList[i] = change.Label
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		var out io.Writer = w
+		var gz *gzip.Writer
+		if dvid.SupportsGzipEncoding(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Add("Vary", "Accept-Encoding")
+			gz = gzip.NewWriter(w)
+			out = gz
+		}
+		err = WriteSparseVols(storeCtx, out, labelList)
+		if gz != nil {
+			gz.Close()
+		}
+		if err != nil {
+			dvid.Errorf("[%s] Aborted changed-sparsevols response after error: %s\n", requestID, err.Error())
+			return
+		}
+		timedLog.Infof("[%s] HTTP %s: sparsevols for %d labels changed since %s (%s)", requestID, r.Method, len(labelList), since, r.URL)
+
+	case "annotation":
+		// GET  <api URL>/node/<UUID>/<data name>/annotation/<label>
+		// POST <api URL>/node/<UUID>/<data name>/annotation/<label>
+		if len(parts) < 5 {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("DVID requires a label ID to follow 'annotation' command"))
+			return
+		}
+		label, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if action == "post" {
+			data, err := d.readPostBody(w, r)
+			if err != nil {
+				payloadErrorResponse(w, r, requestID, err)
+				return
+			}
+			var annotation Annotation
+			if err := json.Unmarshal(data, &annotation); err != nil {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("Annotation must be a JSON object: %s", err.Error()))
+				return
+			}
+			if err := d.PutAnnotation(versionID, label, annotation); err != nil {
+				server.ErrorResponse(w, r, requestID, storageError(err))
+				return
+			}
+			timedLog.Infof("[%s] HTTP %s: annotation of label %d (%s)", requestID, r.Method, label, r.URL)
+			return
+		}
+		annotation, err := d.GetAnnotation(versionID, label)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, storageError(err))
+			return
+		}
+		if annotation == nil {
+			annotation = Annotation{}
+		}
+		jsonBytes, err := json.Marshal(annotation)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		w.Header().Set("Content-type", "application/json")
+		w.Write(jsonBytes)
+		timedLog.Infof("[%s] HTTP %s: annotation of label %d (%s)", requestID, r.Method, label, r.URL)
 
 	case "split":
 		// POST <api URL>/node/<UUID>/<data name>/split
 		if action != "post" {
-			server.BadRequest(w, r, "Split requests must be POST actions.")
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Split requests must be POST actions."))
+			return
+		}
+		if _, err := server.NewQuery(r, splitQueryParams, false); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		timer := dvid.NewPhaseTimer()
+		timer.Start("parse")
+		rles, err := d.readSparseVol(w, r)
+		if err != nil {
+			payloadErrorResponse(w, r, requestID, err)
+			return
+		}
+		timer.StopAll()
+		timedLog.Infof("[%s] HTTP split request with %d spans (%s) [%s]", requestID, len(rles), r.URL, timer)
+
+	case "repair":
+		// POST <api URL>/node/<UUID>/<data name>/repair
+		if action != "post" {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Repair requests must be POST actions."))
+			return
+		}
+		result, err := d.Repair()
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, storageError(err))
+			return
+		}
+		jsonBytes, err := json.Marshal(result)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
-		timedLog.Infof("HTTP split request (%s)", r.URL)
+		w.Header().Set("Content-type", "application/json")
+		w.Write(jsonBytes)
+		timedLog.Infof("[%s] HTTP repair request recovered %d operations (%s)", requestID, result.Recovered, r.URL)
 
 	case "merge":
 		// POST <api URL>/node/<UUID>/<data name>/merge
 		if action != "post" {
-			server.BadRequest(w, r, "Merge requests must be POST actions.")
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Merge requests must be POST actions."))
 			return
 		}
-		data, err := ioutil.ReadAll(r.Body)
+		query, err := server.NewQuery(r, mergeQueryParams, false)
 		if err != nil {
-			server.BadRequest(w, r, "Bad POSTed data for merge.  Should be JSON.")
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		force, err := query.GetBool("force", false)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		timer := dvid.NewPhaseTimer()
+		timer.Start("parse")
+		if force {
+			if !d.AllowForce {
+				server.ErrorResponse(w, r, requestID, fmt.Errorf("Forced merges require the AllowForce setting for data %q", d.DataName()))
+				return
+			}
+			dvid.Infof("Forcing merge on version %d of labels64 %q\n", versionID, d.DataName())
+		} else if err := checkUnlocked(repo, versionID); err != nil {
+			lockedResponse(w, r, requestID, err)
+			return
+		}
+		data, err := d.readPostBody(w, r)
+		if err != nil {
+			payloadErrorResponse(w, r, requestID, err)
 			return
 		}
 		var tuples MergeTuples
 		if err := json.Unmarshal(data, &tuples); err != nil {
-			server.BadRequest(w, r, fmt.Sprintf("Bad merge op JSON: %s", err.Error()))
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Bad merge op JSON: %s", err.Error()))
+			return
+		}
+		opts := MergeOptions{
+			Target: query.GetString("target", ""),
+			User:   server.RequestUser(r),
+		}
+		if opts.Strict, err = query.GetBool("strict", d.StrictMerge); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if opts.Override, err = query.GetBool("override", false); err != nil {
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
-		if err := d.MergeLabels(storeCtx, tuples); err != nil {
-			server.BadRequest(w, r, fmt.Sprintf("Error on merge: %s", err.Error()))
+		timing, err := query.GetBool("timing", false)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		terse, err := query.GetBool("terse", false)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
 			return
 		}
-		timedLog.Infof("HTTP merge request (%s)", r.URL)
+		opKey := r.Header.Get("Idempotency-Key")
+		if opKey == "" {
+			opKey = query.GetString("opid", "")
+		}
+		digest := requestDigest(data, opts.Target, fmt.Sprintf("%t", opts.Strict), fmt.Sprintf("%t", force),
+			fmt.Sprintf("%t", opts.Override))
+		timer.Stop()
+		jsonBytes, replayed, err := d.doKeyedOp(storeCtx, opKey, digest, func() ([]byte, error) {
+			result, err := d.mergeLabels(storeCtx, tuples, opts, timer)
+			if err != nil {
+				return nil, err
+			}
+			if timing {
+				result.Timing = timer.Millis()
+			}
+			return json.Marshal(result)
+		})
+		if err != nil {
+			if _, ok := err.(*server.Error); !ok {
+				err = fmt.Errorf("Error on merge: %s", err.Error())
+			}
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+		if !terse {
+			w.Header().Set("Content-type", "application/json")
+			w.Write(jsonBytes)
+		}
+		if replayed {
+			timedLog.Infof("[%s] HTTP merge request by %q replayed result for idempotency key %q (%s)", requestID, opts.User, opKey, r.URL)
+		} else {
+			timedLog.Infof("[%s] HTTP merge request by %q (%s) [%s]", requestID, opts.User, r.URL, timer)
+		}
 
 	default:
-		server.BadRequest(w, r, "Unrecognized API call '%s' for labels64 data '%s'.  See API help.",
-			parts[3], d.DataName())
+		server.ErrorResponse(w, r, requestID, fmt.Errorf("Unrecognized API call '%s' for labels64 data '%s'.  See API help.",
+			parts[3], d.DataName()))
 	}
 }
 
+// lockedResponse writes a 409 Conflict with JSON describing a locked node error or an
+// error response for other errors.
+func lockedResponse(w http.ResponseWriter, r *http.Request, requestID string, err error) {
+	lockedErr, ok := err.(*LockedNodeError)
+	if !ok {
+		server.ErrorResponse(w, r, requestID, err)
+		return
+	}
+	dvid.Errorf("ERROR [%s] %s (%s).", requestID, err.Error(), r.URL.Path)
+	w.Header().Set("X-Request-Id", requestID)
+	jsonBytes, jsonErr := json.Marshal(struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request-id"`
+		*LockedNodeError
+	}{
+		err.Error(),
+		requestID,
+		lockedErr,
+	})
+	if jsonErr != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	w.Write(jsonBytes)
+}
+
 // GetLabelBytesAtPoint returns the 8 byte slice corresponding to a 64-bit label at a point.
 func (d *Data) GetLabelBytesAtPoint(ctx storage.Context, pt dvid.Point) ([]byte, error) {
 	store, err := storage.BigDataStore()
@@ -1392,6 +3291,9 @@ func (d *Data) GetLabelBytesAtPoint(ctx storage.Context, pt dvid.Point) ([]byte,
 	if err != nil {
 		return nil, fmt.Errorf("Error getting '%s' block for index %s\n", d.DataName(), blockCoord)
 	}
+	if serialization == nil {
+		return nil, server.NewError(server.NotFoundError, "No labels stored in '%s' at point %s", d.DataName(), pt)
+	}
 	labelData, _, err := dvid.DeserializeData(serialization, true)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to deserialize block %s in '%s': %s\n",
@@ -1419,6 +3321,7 @@ type blockOp struct {
 	grayscale *voxels.Data
 	composite *voxels.Data
 	versionID dvid.VersionID
+	colors    labels.Palette
 }
 
 // CreateComposite creates a new rgba8 image by combining hash of labels + the grayscale
@@ -1476,7 +3379,7 @@ func (d *Data) CreateComposite(request datastore.Request, reply *datastore.Respo
 
 	// Iterate through all labels and grayscale chunks incrementally in Z, a layer at a time.
 	wg := new(sync.WaitGroup)
-	op := &blockOp{grayscale, composite, versionID}
+	op := &blockOp{grayscale, composite, versionID, d.colors()}
 	chunkOp := &storage.ChunkOp{op, wg}
 
 	store, err := storage.BigDataStore()
@@ -1579,12 +3482,12 @@ func (d *Data) createCompositeChunk(chunk *storage.Chunk) {
 	compositeData := make([]byte, compositeBytes, compositeBytes)
 	compositeI := 0
 	labelI := 0
-	hashBuf := make([]byte, 4, 4)
 	for _, grayscale := range grayscaleData {
-		//murmurhash3(labelData[labelI:labelI+8], hashBuf)
-		//hashBuf[3] = grayscale
-		writePseudoColor(grayscale, labelData[labelI:labelI+8], hashBuf)
-		copy(compositeData[compositeI:compositeI+4], hashBuf)
+		c := op.colors.Color(d.Properties.ByteOrder.Uint64(labelData[labelI : labelI+8]))
+		compositeData[compositeI] = uint8(uint16(c.R) * uint16(grayscale) >> 8)
+		compositeData[compositeI+1] = uint8(uint16(c.G) * uint16(grayscale) >> 8)
+		compositeData[compositeI+2] = uint8(uint16(c.B) * uint16(grayscale) >> 8)
+		compositeData[compositeI+3] = 255
 		compositeI += 4
 		labelI += 8
 	}
@@ -1602,58 +3505,3 @@ func (d *Data) createCompositeChunk(chunk *storage.Chunk) {
 		return
 	}
 }
-
-func writePseudoColor(grayscale uint8, in64bits, out32bits []byte) {
-	murmurhash3(in64bits, out32bits)
-	var t uint64
-	t = uint64(out32bits[0]) * uint64(grayscale)
-	t >>= 8
-	out32bits[0] = uint8(t)
-	t = uint64(out32bits[1]) * uint64(grayscale)
-	t >>= 8
-	out32bits[1] = uint8(t)
-	t = uint64(out32bits[2]) * uint64(grayscale)
-	t >>= 8
-	out32bits[2] = uint8(t)
-	out32bits[3] = 255
-}
-
-func murmurhash3(in64bits, out32bits []byte) {
-	length := len(in64bits)
-	var c1, c2 uint32 = 0xcc9e2d51, 0x1b873593
-	nblocks := length / 4
-	var h, k uint32
-	buf := bytes.NewBuffer(in64bits)
-	for i := 0; i < nblocks; i++ {
-		binary.Read(buf, binary.LittleEndian, &k)
-		k *= c1
-		k = (k << 15) | (k >> (32 - 15))
-		k *= c2
-		h ^= k
-		h = (h << 13) | (h >> (32 - 13))
-		h = (h * 5) + 0xe6546b64
-	}
-	k = 0
-	tailIndex := nblocks * 4
-	switch length & 3 {
-	case 3:
-		k ^= uint32(in64bits[tailIndex+2]) << 16
-		fallthrough
-	case 2:
-		k ^= uint32(in64bits[tailIndex+1]) << 8
-		fallthrough
-	case 1:
-		k ^= uint32(in64bits[tailIndex])
-		k *= c1
-		k = (k << 15) | (k >> (32 - 15))
-		k *= c2
-		h ^= k
-	}
-	h ^= uint32(length)
-	h ^= h >> 16
-	h *= 0x85ebca6b
-	h ^= h >> 13
-	h *= 0xc2b2ae35
-	h ^= h >> 16
-	binary.BigEndian.PutUint32(out32bits, h)
-}
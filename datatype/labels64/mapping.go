@@ -0,0 +1,371 @@
+/*
+	This file supports the merged label mapping, which gives the label each merged label
+	was merged into.  A log record of each completed merge is stored with the mapping at
+	that version, and since the mapping is fully determined by the log of the version and
+	its ancestors, it can be rebuilt from the log if the two ever diverge.
+*/
+
+package labels64
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Formats of an exported label mapping.
+const (
+	MappingJSON   = "json"
+	MappingCSV    = "csv"
+	MappingBinary = "binary"
+)
+
+// mappingMu guards the read-modify-write of label mappings of all data instances.
+var mappingMu sync.Mutex
+
+// LabelMapping maps each merged label to the label that now holds its voxels.  Chains of
+// merges are resolved, so an original label always maps directly to its final label.
+type LabelMapping map[uint64]uint64
+
+// Mapped returns the label now holding the voxels of the given label, which is the label
+// itself if it was never merged.
+func (m LabelMapping) Mapped(label uint64) uint64 {
+	if mapped, found := m[label]; found {
+		return mapped
+	}
+	return label
+}
+
+// Labels returns the merged labels in increasing order.
+func (m LabelMapping) Labels() []uint64 {
+	labels := make(labelSlice, 0, len(m))
+	for label := range m {
+		labels = append(labels, label)
+	}
+	sort.Sort(labels)
+	return labels
+}
+
+// addMerges updates the mapping with merge tuples, where each tuple's first label is the
+// target of the others.
+func (m LabelMapping) addMerges(tuples MergeTuples) {
+	for _, tuple := range tuples {
+		target := m.Mapped(tuple[0])
+		merged := make(map[uint64]bool, len(tuple)-1)
+		for _, fromLabel := range tuple[1:] {
+			if fromLabel != target {
+				merged[fromLabel] = true
+				m[fromLabel] = target
+			}
+		}
+		for label, mapped := range m {
+			if merged[mapped] {
+				m[label] = target
+			}
+		}
+	}
+}
+
+// MarshalBinary returns the mapping as little-endian uint64 pairs of merged and mapped
+// labels in increasing order of merged label.
+func (m LabelMapping) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 16*len(m))
+	for i, label := range m.Labels() {
+		binary.LittleEndian.PutUint64(buf[i*16:i*16+8], label)
+		binary.LittleEndian.PutUint64(buf[i*16+8:i*16+16], m[label])
+	}
+	return buf, nil
+}
+
+func (m *LabelMapping) UnmarshalBinary(b []byte) error {
+	if len(b)%16 != 0 {
+		return fmt.Errorf("Label mapping has %d bytes, which is not a multiple of 16", len(b))
+	}
+	*m = make(LabelMapping, len(b)/16)
+	for i := 0; i < len(b); i += 16 {
+		(*m)[binary.LittleEndian.Uint64(b[i:i+8])] = binary.LittleEndian.Uint64(b[i+8 : i+16])
+	}
+	return nil
+}
+
+// labelSlice sorts labels in increasing order.
+type labelSlice []uint64
+
+func (s labelSlice) Len() int           { return len(s) }
+func (s labelSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s labelSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// mergeRecord is the log record of a completed merge.  Override is true for merges allowed
+// across merge guard compartments.  Targets give the contributions of the merged labels to
+// each target and are absent for merges logged before they were recorded.
+type mergeRecord struct {
+	ID       uint64
+	Tuples   MergeTuples
+	User     string `json:",omitempty"`
+	Time     time.Time
+	Override bool          `json:",omitempty"`
+	Targets  []MergeTarget `json:",omitempty"`
+}
+
+// GetLabelMapping returns the mapping of merged labels at the context's version, which
+// includes merges at its ancestors.  A version without merges has the mapping of its
+// nearest ancestor with one.
+func (d *Data) GetLabelMapping(ctx *datastore.VersionedContext) (LabelMapping, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	versions, err := ancestry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	for _, v := range versions {
+		if value, err = smalldata.Get(datastore.NewVersionedContext(d, v), voxels.NewLabelMappingIndex()); err != nil {
+			return nil, err
+		}
+		if value != nil {
+			break
+		}
+	}
+	var mapping LabelMapping
+	if err := mapping.UnmarshalBinary(value); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// logMerge stores the log record of a completed merge and updates the label mapping and
+// the last mutation of the merged labels at the context's version.  All are written in
+// one batch so they stay consistent, and logging the same merge again, e.g., when an
+// interrupted merge is rolled forward, does not change the mapping.
+func (d *Data) logMerge(ctx *datastore.VersionedContext, intent *mergeIntent) error {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	smallBatcher, ok := smalldata.(storage.KeyValueBatcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in logMerge()")
+	}
+	now := time.Now()
+	record, err := json.Marshal(mergeRecord{intent.ID, intent.Tuples, intent.User, now, intent.Override, intent.Targets})
+	if err != nil {
+		return err
+	}
+
+	mappingMu.Lock()
+	defer mappingMu.Unlock()
+	mapping, err := d.GetLabelMapping(ctx)
+	if err != nil {
+		return err
+	}
+	mapping.addMerges(intent.Tuples)
+	serialization, err := mapping.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	batch := smallBatcher.NewBatch(ctx)
+	batch.Put(voxels.NewLabelMergeLogIndex(intent.ID), record)
+	batch.Put(voxels.NewLabelMappingIndex(), serialization)
+	if err := putLastMutations(batch, intent.Tuples, labelMutation{intent.ID, now}); err != nil {
+		return err
+	}
+	if err := batch.Commit(); err != nil {
+		return fmt.Errorf("Unable to log merge %d: %s", intent.ID, err.Error())
+	}
+	return nil
+}
+
+// getMergeLog returns the log records of merges at the context's version and its
+// ancestors in the order they were applied, i.e., from the root down and by increasing
+// id within a version.
+func (d *Data) getMergeLog(ctx *datastore.VersionedContext) ([]mergeRecord, error) {
+	versions, err := ancestry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	depth := make(map[dvid.VersionID]int, len(versions))
+	for i, v := range versions {
+		depth[v] = len(versions) - i
+	}
+
+	versionRecords, err := d.scanMergeLog()
+	if err != nil {
+		return nil, err
+	}
+	var log mergeLog
+	for _, vr := range versionRecords {
+		if depth[vr.version] == 0 {
+			continue
+		}
+		log = append(log, loggedMerge{depth[vr.version], vr.record})
+	}
+	sort.Sort(log)
+	records := make([]mergeRecord, len(log))
+	for i, logged := range log {
+		records[i] = logged.record
+	}
+	return records, nil
+}
+
+// versionedMerge is a merge log record and the version it was logged at.
+type versionedMerge struct {
+	version dvid.VersionID
+	record  mergeRecord
+}
+
+// scanMergeLog returns the merge log records of all versions in key order.
+func (d *Data) scanMergeLog() ([]versionedMerge, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+
+	// Read the full keys for all versions without a versioned context.
+	dataCtx := storage.NewDataContext(d, 0)
+	minKey, err := dataCtx.MinVersionKey(voxels.NewLabelMergeLogIndex(0))
+	if err != nil {
+		return nil, err
+	}
+	maxKey, err := dataCtx.MaxVersionKey(voxels.NewLabelMergeLogIndex(math.MaxUint64))
+	if err != nil {
+		return nil, err
+	}
+	kvs, err := smalldata.GetRange(nil, minKey, maxKey)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]versionedMerge, len(kvs))
+	for i, kv := range kvs {
+		_, versionID, err := storage.KeyToLocalIDs(kv.K)
+		if err != nil {
+			return nil, err
+		}
+		records[i].version = versionID
+		if err := json.Unmarshal(kv.V, &records[i].record); err != nil {
+			return nil, fmt.Errorf("Bad merge log record %v: %s", kv.K, err.Error())
+		}
+	}
+	return records, nil
+}
+
+// ListMutations returns a mutation for each tuple of the merges logged at any version at
+// or after the given time, with the target label first.  Mutations of one merge share its
+// ID.  Data without logged merges, e.g., created before merges were logged, has none.
+func (d *Data) ListMutations(since time.Time) ([]datastore.LabelMutation, error) {
+	records, err := d.scanMergeLog()
+	if err != nil {
+		return nil, err
+	}
+	uuids := make(map[dvid.VersionID]dvid.UUID)
+	var mutations []datastore.LabelMutation
+	for _, vr := range records {
+		if vr.record.Time.Before(since) {
+			continue
+		}
+		uuid, found := uuids[vr.version]
+		if !found {
+			if uuid, err = datastore.UUIDFromVersion(vr.version); err != nil {
+				return nil, err
+			}
+			uuids[vr.version] = uuid
+		}
+		for _, tuple := range vr.record.Tuples {
+			mutations = append(mutations, datastore.LabelMutation{
+				UUID:   uuid,
+				ID:     vr.record.ID,
+				Op:     "merge",
+				Labels: append([]uint64{}, tuple...),
+				User:   vr.record.User,
+				Time:   vr.record.Time,
+			})
+		}
+	}
+	return mutations, nil
+}
+
+// loggedMerge is a merge log record and the depth of its version in the version DAG.
+type loggedMerge struct {
+	depth  int
+	record mergeRecord
+}
+
+// mergeLog sorts merge log records in the order they were applied.
+type mergeLog []loggedMerge
+
+func (l mergeLog) Len() int      { return len(l) }
+func (l mergeLog) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l mergeLog) Less(i, j int) bool {
+	if l[i].depth != l[j].depth {
+		return l[i].depth < l[j].depth
+	}
+	return l[i].record.ID < l[j].record.ID
+}
+
+// MappingRepair summarizes a rebuild of a label mapping from the merge log.
+type MappingRepair struct {
+	Merges  int // number of logged merges applied
+	Labels  int // number of merged labels in the rebuilt mapping
+	Changed int // number of labels whose mapping differed from the stored one
+}
+
+// RebuildLabelMapping replaces the label mapping at the context's version with one
+// computed from the merge log of the version and its ancestors.
+func (d *Data) RebuildLabelMapping(ctx *datastore.VersionedContext) (*MappingRepair, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+
+	mappingMu.Lock()
+	defer mappingMu.Unlock()
+	records, err := d.getMergeLog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rebuilt := make(LabelMapping)
+	for _, record := range records {
+		rebuilt.addMerges(record.Tuples)
+	}
+	stored, err := d.GetLabelMapping(ctx)
+	if err != nil {
+		return nil, err
+	}
+	repair := &MappingRepair{Merges: len(records), Labels: len(rebuilt)}
+	for label, mapped := range rebuilt {
+		if stored.Mapped(label) != mapped {
+			repair.Changed++
+		}
+	}
+	for label := range stored {
+		if _, found := rebuilt[label]; !found {
+			repair.Changed++
+		}
+	}
+	if repair.Changed == 0 {
+		return repair, nil
+	}
+	serialization, err := rebuilt.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if err := smalldata.Put(ctx, voxels.NewLabelMappingIndex(), serialization); err != nil {
+		return nil, fmt.Errorf("Unable to store rebuilt label mapping: %s", err.Error())
+	}
+	dvid.Infof("Rebuilt label mapping of %q from %d merges: %d labels changed\n",
+		d.DataName(), repair.Merges, repair.Changed)
+	return repair, nil
+}
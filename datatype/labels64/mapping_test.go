@@ -0,0 +1,164 @@
+package labels64
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestLabelMappingAddMerges(t *testing.T) {
+	mapping := make(LabelMapping)
+	mapping.addMerges(MergeTuples{{2, 3, 4}, {10, 11}})
+	mapping.addMerges(MergeTuples{{1, 2}})
+	mapping.addMerges(MergeTuples{{3, 5}})
+	expected := LabelMapping{2: 1, 3: 1, 4: 1, 5: 1, 11: 10}
+	if !reflect.DeepEqual(mapping, expected) {
+		t.Errorf("Expected mapping %v, got %v\n", expected, mapping)
+	}
+	if mapping.Mapped(3) != 1 || mapping.Mapped(10) != 10 {
+		t.Errorf("Bad mapped labels: 3 -> %d, 10 -> %d\n", mapping.Mapped(3), mapping.Mapped(10))
+	}
+
+	serialization, err := mapping.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unable to serialize mapping: %s\n", err.Error())
+	}
+	if len(serialization) != 16*len(expected) || binary.LittleEndian.Uint64(serialization[0:8]) != 2 {
+		t.Errorf("Bad mapping serialization: %v\n", serialization)
+	}
+	var decoded LabelMapping
+	if err := decoded.UnmarshalBinary(serialization); err != nil || !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("Expected decoded mapping %v, got %v, %v\n", expected, decoded, err)
+	}
+}
+
+func TestLabelMapping(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 350, "mappedlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	for label := uint64(1); label <= 6; label++ {
+		block := dvid.IndexZYX{int32(label), 0, 0}
+		rles := blockRLEs{string(block.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{int32(label) * 32, 0, 0}, 10)}}
+		if err := putLabelRLEs(ctx, label, rles, map[string]bool{string(block.Bytes()): true}); err != nil {
+			t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+		}
+	}
+	merge := func(ctx *datastore.VersionedContext, tuples MergeTuples) {
+		if _, err := d.MergeLabels(ctx, tuples, MergeOptions{}); err != nil {
+			t.Fatalf("Unable to merge %v: %s\n", tuples, err.Error())
+		}
+		d.waitFinishing()
+	}
+	get := func(v dvid.VersionID, endpoint string) *httptest.ResponseRecorder {
+		uuid, err := datastore.UUIDFromVersion(v)
+		if err != nil {
+			t.Fatalf("Unable to get UUID of version %d: %s\n", v, err.Error())
+		}
+		apiStr := fmt.Sprintf("%snode/%s/mappedlabels/%s", server.WebAPIPath, uuid, endpoint)
+		r, _ := http.NewRequest("GET", apiStr, nil)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, v), w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Bad response to %s: %d %s\n", endpoint, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	// Chains of merges across versions are resolved.
+	merge(ctx, MergeTuples{{2, 3}, {5, 6}})
+	if err := repo.Lock(uuid); err != nil {
+		t.Fatalf("Unable to lock root node: %s\n", err.Error())
+	}
+	child, err := repo.NewVersion(uuid)
+	if err != nil {
+		t.Fatalf("Unable to create child node: %s\n", err.Error())
+	}
+	_, childVersion, err := datastore.MatchingUUID(string(child))
+	if err != nil {
+		t.Fatalf("Unable to get child version: %s\n", err.Error())
+	}
+	childCtx := datastore.NewVersionedContext(d, childVersion)
+	merge(childCtx, MergeTuples{{1, 2, 4}})
+
+	var pairs [][2]uint64
+	if err := json.Unmarshal(get(childVersion, "mapping").Body.Bytes(), &pairs); err != nil {
+		t.Fatalf("Bad mapping JSON: %s\n", err.Error())
+	}
+	expected := [][2]uint64{{2, 1}, {3, 1}, {4, 1}, {6, 5}}
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("Expected child mapping %v, got %v\n", expected, pairs)
+	}
+	if csv := get(versionID, "mapping?format=csv").Body.String(); csv != "label,mapped\n3,2\n6,5\n" {
+		t.Errorf("Bad root mapping CSV: %q\n", csv)
+	}
+	w := get(childVersion, "mapping?format=binary")
+	var binaryMapping LabelMapping
+	if err := binaryMapping.UnmarshalBinary(w.Body.Bytes()); err != nil || len(binaryMapping) != 4 || binaryMapping[3] != 1 {
+		t.Errorf("Bad binary mapping: %v, %v\n", binaryMapping, err)
+	}
+	var lookup struct {
+		Label  uint64
+		Mapped uint64
+	}
+	for label, mapped := range map[uint64]uint64{3: 1, 1: 1, 6: 5, 7: 7} {
+		if err := json.Unmarshal(get(childVersion, fmt.Sprintf("mapping/%d", label)).Body.Bytes(), &lookup); err != nil {
+			t.Fatalf("Bad mapping lookup JSON: %s\n", err.Error())
+		}
+		if lookup.Label != label || lookup.Mapped != mapped {
+			t.Errorf("Expected label %d to map to %d, got %v\n", label, mapped, lookup)
+		}
+	}
+
+	// The merge log is recorded at each version.
+	records, err := d.getMergeLog(childCtx)
+	if err != nil || len(records) != 2 || !reflect.DeepEqual(records[1].Tuples, MergeTuples{{1, 2, 4}}) {
+		t.Fatalf("Bad merge log: %v, %v\n", records, err)
+	}
+
+	// A diverged mapping is rebuilt from the merge log.
+	smalldata, err := storage.SmallDataStore()
+	if err != nil {
+		t.Fatalf("Unable to get small data store: %s\n", err.Error())
+	}
+	corrupted, _ := LabelMapping{2: 9, 7: 1}.MarshalBinary()
+	if err := smalldata.Put(childCtx, voxels.NewLabelMappingIndex(), corrupted); err != nil {
+		t.Fatalf("Unable to corrupt mapping: %s\n", err.Error())
+	}
+	request := datastore.Request{Command: dvid.Command{"node", string(child), "mappedlabels", "rebuild-mapping"}}
+	var reply datastore.Response
+	if err := d.DoRPC(request, &reply); err != nil {
+		t.Fatalf("Unable to rebuild mapping: %s\n", err.Error())
+	}
+	mapping, err := d.GetLabelMapping(childCtx)
+	if err != nil || !reflect.DeepEqual(mapping, LabelMapping{2: 1, 3: 1, 4: 1, 6: 5}) {
+		t.Errorf("Bad rebuilt mapping: %v, %v\n", mapping, err)
+	}
+	repair, err := d.RebuildLabelMapping(childCtx)
+	if err != nil || repair.Merges != 2 || repair.Labels != 4 || repair.Changed != 0 {
+		t.Errorf("Expected consistent mapping after rebuild, got %v, %v\n", repair, err)
+	}
+	if !bytes.Contains([]byte(reply.Text), []byte("5 changed")) {
+		t.Errorf("Unexpected rebuild reply: %s\n", reply.Text)
+	}
+}
@@ -7,7 +7,7 @@ package labels64
 
 import (
 	"fmt"
-	"sync"
+	"time"
 
 	"github.com/janelia-flyem/dvid/datastore"
 	"github.com/janelia-flyem/dvid/datatype/voxels"
@@ -16,6 +16,33 @@ import (
 	"github.com/janelia-flyem/dvid/storage"
 )
 
+const (
+	// blockShards is the number of workers processing blocks in merges, or one per CPU if 0.
+	blockShards = 0
+
+	// maxBlockBatch is the maximum number of blocks whose RLEs are written in one batch.
+	maxBlockBatch = 1000
+
+	// expectedMergeTime is how long a merge is expected to take, after a multiple of which
+	// the server's watchdog reports it as wedged.
+	expectedMergeTime = 30 * time.Second
+)
+
+// mergeQueryParams are the query-string parameters of the merge endpoint.  On merges,
+// "strict" both refuses missing labels and rejects unknown parameters.
+var mergeQueryParams = server.QueryParams{
+	{Name: "target", Help: "\"largest\" or \"lowest-id\" to choose each tuple's target label.  Default is\nthe first label of each tuple."},
+	{Name: "strict", Help: "If \"true\", the merge fails with no changes if any label is missing, and unknown\nquery-string parameters cause an error.  Default for missing labels is the\nStrictMerge setting."},
+	{Name: "force", Help: "If \"true\", allows merges on a locked node if the AllowForce setting is set."},
+	{Name: "override", Help: "If \"true\", allows merges of labels in different MergeGuardROI compartments."},
+	{Name: "opid", Help: "Idempotency key for the merge if no \"Idempotency-Key\" header is given."},
+	{Name: "timing", Help: "If \"true\", the response includes the milliseconds spent in each phase."},
+	{Name: "terse", Help: "If \"true\", the response body is empty."},
+}
+
+// splitQueryParams are the query-string parameters of the split endpoint.
+var splitQueryParams = server.QueryParams{}
+
 type MergeTuple []uint64
 
 type MergeTuples []MergeTuple
@@ -30,28 +57,264 @@ func (mt *MergeTuples) addMerge(fromLabel, toLabel uint64) {
 	}
 }
 
+// Modes for selecting the target label of each merge tuple.
+const (
+	// TargetFirst merges into the first label of each tuple.
+	TargetFirst = ""
+
+	// TargetLargest merges into the label of each tuple with the most voxels.
+	TargetLargest = "largest"
+
+	// TargetLowestID merges into the label of each tuple with the lowest id.
+	TargetLowestID = "lowest-id"
+)
+
+// selectTargets returns the merge tuples rewritten so the first label of each tuple is
+// the target chosen by the mode.  Only labels with voxels are candidates, so a tuple
+// whose labels are all missing is left unchanged.  Ties in size are broken by choosing
+// the lowest id.
+func selectTargets(tuples MergeTuples, sizes map[uint64]uint64, mode string) (MergeTuples, error) {
+	switch mode {
+	case TargetFirst:
+		return tuples, nil
+	case TargetLargest, TargetLowestID:
+	default:
+		return nil, fmt.Errorf("Unknown merge target mode %q", mode)
+	}
+	selected := make(MergeTuples, len(tuples))
+	for i, tuple := range tuples {
+		target := tuple[0]
+		found := false
+		for _, label := range tuple {
+			size := sizes[label]
+			if size == 0 {
+				continue
+			}
+			switch {
+			case !found:
+			case mode == TargetLargest && size > sizes[target]:
+			case (mode == TargetLowestID || size == sizes[target]) && label < target:
+			default:
+				continue
+			}
+			target = label
+			found = true
+		}
+		selected[i] = MergeTuple{target}
+		for _, label := range tuple {
+			if label != target {
+				selected[i] = append(selected[i], label)
+			}
+		}
+	}
+	return selected, nil
+}
+
 type sizeChange struct {
 	oldSize, newSize uint64
 }
 
+// MergeOptions modify a merge.  If Strict is true, the merge fails if any label doesn't
+// exist.  Target is the mode for selecting the target label of each tuple, e.g.,
+// TargetLargest.  User is who requested the merge, recorded in its intent and result.
+// If empty, server.AnonymousUser is recorded.  If Override is true, merges across the
+// compartments of the data's MergeGuardROI setting are allowed and logged as overrides.
+type MergeOptions struct {
+	Strict   bool
+	Target   string
+	User     string
+	Override bool
+}
+
+func (opts MergeOptions) user() string {
+	if opts.User == "" {
+		return server.AnonymousUser
+	}
+	return opts.User
+}
+
+// MergeTarget summarizes the changes to one label that received merged labels.
+// Contributions gives the voxels added by each merged label, keyed by label, so merges of
+// unexpectedly large labels can be spotted.  The target's changed blocks are counted as
+// appended, where the target already had RLEs, or created.
+type MergeTarget struct {
+	Label          uint64
+	OldSize        uint64
+	VoxelsAdded    uint64
+	NewSize        uint64
+	Contributions  map[uint64]uint64 `json:",omitempty"`
+	BlocksAppended int
+	BlocksCreated  int
+}
+
+// MergeResult summarizes a merge operation so clients need not query sizes and bounds
+// after a merge.  Block coordinates are in block space.
+type MergeResult struct {
+	User          string
+	Targets       []MergeTarget
+	Missing       []uint64 `json:",omitempty"` // labels without any voxels
+	BlocksChanged int
+	MinBlock      dvid.ChunkPoint3d
+	MaxBlock      dvid.ChunkPoint3d
+	ElapsedMs     float64
+	Timing        map[string]float64 `json:",omitempty"` // milliseconds per phase if requested
+
+	timer *dvid.PhaseTimer
+}
+
+// setBlockBounds sets the block bounds of the result from the given set of block keys.
+func (result *MergeResult) setBlockBounds(blocksChanged map[string]bool) {
+	result.BlocksChanged = len(blocksChanged)
+	first := true
+	for blockStr := range blocksChanged {
+		var index dvid.IndexZYX
+		if err := index.IndexFromBytes([]byte(blockStr)); err != nil {
+			dvid.Errorf("Bad block index in merge: %s\n", err.Error())
+			continue
+		}
+		for dim := 0; dim < 3; dim++ {
+			if first || index[dim] < result.MinBlock[dim] {
+				result.MinBlock[dim] = index[dim]
+			}
+			if first || index[dim] > result.MaxBlock[dim] {
+				result.MaxBlock[dim] = index[dim]
+			}
+		}
+		first = false
+	}
+}
+
+// LockedNodeError is returned when a label mutation targets a locked version node.
+type LockedNodeError struct {
+	UUID         dvid.UUID   `json:"uuid"`
+	OpenChildren []dvid.UUID `json:"open-children"`
+}
+
+func (e *LockedNodeError) Error() string {
+	return fmt.Sprintf("%s %s", datastore.ErrModifyLockedNode, e.UUID)
+}
+
+// checkUnlocked returns a *LockedNodeError if the given version is locked.
+func checkUnlocked(repo datastore.Repo, versionID dvid.VersionID) error {
+	uuid, err := datastore.UUIDFromVersion(versionID)
+	if err != nil {
+		return err
+	}
+	locked, openChildren, err := repo.Locked(uuid)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return &LockedNodeError{uuid, openChildren}
+	}
+	return nil
+}
+
 // MergeLabels handles merging of any number of labels throughout the various label data
 // structures.  It assumes that the merges aren't cascading, e.g., there is no attempt
 // to merge label 3 into 4 and also 4 into 5.  The caller should have flattened the merges.
+// A summary of the changed labels and blocks is returned.
+//
+// All labels are checked for existence before any data is modified.  If opts.Strict is
+// true, any missing label causes an error.  Otherwise, missing source labels are skipped and
+// all missing labels are listed in the result.  The target of each tuple is chosen by
+// the opts.Target mode, e.g., TargetLargest, using label sizes computed from the RLEs that
+// are also used for the size changes.  The requesting user is echoed in the result.
+//
+// A write-ahead intent is stored before the first modification and deleted after the
+// label blocks are relabeled, so an interrupted merge is rolled forward when the instance
+// is next loaded or repaired.  Storage failures before the intent is stored return a
+// retryable server error and leave the labels unmodified.  Blocks changed by concurrent
+// writers after they were read are handled by the instance's MergeConflict policy.
 // TODO: Provide some indication that subset of labels are under evolution, returning
 //   an "unavailable" status or 203 for non-authoritative response.  This might not be
 //   feasible for clustered DVID front-ends due to coordination issues.
-func (d *Data) MergeLabels(ctx *datastore.VersionedContext, tuples MergeTuples) error {
-	smalldata, err := storage.SmallDataStore()
+func (d *Data) MergeLabels(ctx *datastore.VersionedContext, tuples MergeTuples, opts MergeOptions) (*MergeResult, error) {
+	return d.mergeLabels(ctx, tuples, opts, dvid.NewPhaseTimer())
+}
+
+// mergeLabels is MergeLabels with the read-existing, compute, write, and notify phases
+// added to the given timer.
+func (d *Data) mergeLabels(ctx *datastore.VersionedContext, tuples MergeTuples, opts MergeOptions,
+	timer *dvid.PhaseTimer) (*MergeResult, error) {
+
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	if d.backfillRunning() {
+		return nil, server.NewError(server.ConflictError, "Can't merge labels of data %q while a backfill runs", d.DataName())
+	}
+	watched := server.WatchOperation("labels64/merge", string(d.DataName()), expectedMergeTime)
+	defer watched.Done()
+	start := time.Now()
+	defer timer.StopAll()
+	smalldata, err := acquireSmallData()
 	if err != nil {
-		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+		return nil, err
 	}
-	smallBatcher, ok := smalldata.(storage.KeyValueBatcher)
-	if !ok {
-		return fmt.Errorf("Database doesn't support Batch ops in MergeLabels()")
+	if _, ok := smalldata.(storage.KeyValueBatcher); !ok {
+		return nil, fmt.Errorf("Database doesn't support Batch ops in MergeLabels()")
 	}
-	bigdata, err := storage.BigDataStore()
+	result := &MergeResult{User: opts.user()}
+	result.timer = timer
+
+	// Count the voxels of all labels, noting missing labels before any RLEs are read or
+	// anything is modified.
+	timer.Start("read-existing")
+	labelSizes := make(map[uint64]uint64)
+	for _, tuple := range tuples {
+		if len(tuple) == 0 {
+			return nil, fmt.Errorf("Empty merge tuple given")
+		}
+		for _, label := range tuple {
+			if _, found := labelSizes[label]; found {
+				continue
+			}
+			size, err := labelSize(ctx, label)
+			if err != nil {
+				return nil, storeUnavailable(fmt.Errorf("Can't count voxels of label %d: %s", label, err.Error()))
+			}
+			labelSizes[label] = size
+			if size == 0 {
+				result.Missing = append(result.Missing, label)
+			}
+		}
+	}
+	if opts.Strict && len(result.Missing) != 0 {
+		return nil, server.NewError(server.BadRequestError, "Merge refused because labels %v do not exist", result.Missing)
+	}
+
+	// Get the RLEs of the labels that exist.
+	labelRLEs := make(map[uint64]blockRLEs, len(labelSizes))
+	for label, size := range labelSizes {
+		if size == 0 {
+			labelRLEs[label] = blockRLEs{}
+			continue
+		}
+		rles, err := getLabelRLEs(ctx, label)
+		if err != nil {
+			return nil, storeUnavailable(fmt.Errorf("Can't get block-level RLEs for label %d: %s", label, err.Error()))
+		}
+		labelRLEs[label] = rles
+	}
+	var read mergeFingerprints
+	if d.mergeConflict() != MergeConflictLastWriterWins {
+		if read, err = readFingerprints(labelRLEs); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkMergeFailpoint("read"); err != nil {
+		return nil, err
+	}
+	overridden, err := d.checkMergeGuard(ctx, tuples, labelRLEs, opts.Override)
 	if err != nil {
-		return fmt.Errorf("Cannot get datastore that handles big data: %s\n", err.Error())
+		return nil, err
+	}
+
+	// Choose the targets using the label sizes.
+	timer.Next("compute")
+	if tuples, err = selectTargets(tuples, labelSizes, opts.Target); err != nil {
+		return nil, err
 	}
 
 	// Global remapping where key = label to be merged; value = new label
@@ -63,97 +326,324 @@ func (d *Data) MergeLabels(ctx *datastore.VersionedContext, tuples MergeTuples)
 	// All blocks that have changed during this merge.  Key = string of block index
 	blocksChanged := make(map[string]bool)
 
-	// Iterate through all the merge ops to get targeted blocks and the necessary relabeling
-	for _, tuple := range tuples {
+	// Blocks of each target label that have changed, in tuple order.
+	targetBlocksChanged := make([]map[string]bool, len(tuples))
+
+	// Blocks holding each label's voxels as merges are applied in tuple order.
+	labelBlocks := make(map[uint64]map[string]bool, len(labelRLEs))
+	for label, rles := range labelRLEs {
+		labelBlocks[label] = rles.blocks()
+	}
+
+	// The RLEs of each block are combined by the worker for that block, so changes to a block
+	// are applied in tuple order while different blocks are combined in parallel.  Each shard
+	// keeps the RLEs it combined until all workers are done.
+	combiner := dvid.NewShardedExecutor(blockShards, 0, nil)
+	combined := make([]map[uint64]blockRLEs, combiner.NumShards())
+	for shard := range combined {
+		combined[shard] = make(map[uint64]blockRLEs)
+	}
+	getRLEs := func(shard int, label uint64, blockStr string) (dvid.RLEs, bool) {
+		if rles, found := combined[shard][label][blockStr]; found {
+			return rles, true
+		}
+		rles, found := labelRLEs[label][blockStr]
+		return rles, found
+	}
+
+	// Iterate through all the merge ops to get targeted blocks and the necessary relabeling.
+	// Nothing is modified until the merge intent has been stored.
+	for i, tuple := range tuples {
 
 		fmt.Printf("Processing merge list: %v\n", tuple)
 
-		// Get the block-level RLEs for the toLabel
 		var toLabelSize uint64
 		toLabel := tuple[0]
-		toLabelRLEs, err := getLabelRLEs(ctx, toLabel)
-		if err != nil {
-			return fmt.Errorf("Can't get block-level RLEs for label %d: %s", toLabel, err.Error())
-		}
 		change, found := sizeMods[toLabel]
 		if found {
 			toLabelSize = change.newSize
 		} else {
-			toLabelSize = toLabelRLEs.numVoxels()
+			toLabelSize = labelSizes[toLabel]
 		}
 		blocksChangedForLabel := make(map[string]bool)
+		target := MergeTarget{Label: toLabel, OldSize: toLabelSize}
 
 		var addedVoxels uint64
 		for _, fromLabel := range tuple[1:] {
+			if len(labelBlocks[fromLabel]) == 0 {
+				continue
+			}
 			remapping[fromLabel] = toLabel
 
 			fmt.Printf("Processing label %d to label %d...\n", fromLabel, toLabel)
 
-			fromLabelRLEs, err := getLabelRLEs(ctx, fromLabel)
-			if err != nil {
-				return fmt.Errorf("Can't get block-level RLEs for label %d: %s", fromLabel, err.Error())
-			}
-			fromLabelSize := fromLabelRLEs.numVoxels()
+			fromLabelSize := labelSizes[fromLabel]
 
 			sizeMods[fromLabel] = sizeChange{fromLabelSize, 0}
 			addedVoxels += fromLabelSize
+			if target.Contributions == nil {
+				target.Contributions = make(map[uint64]uint64)
+			}
+			target.Contributions[fromLabel] = fromLabelSize
 
 			// Append or insert RLE runs for fromLabel blocks into toLabel blocks.
-			for blockStr, fromRLEs := range fromLabelRLEs {
+			for blockStr := range labelBlocks[fromLabel] {
+				if !blocksChangedForLabel[blockStr] {
+					if labelBlocks[toLabel][blockStr] {
+						target.BlocksAppended++
+					} else {
+						target.BlocksCreated++
+					}
+				}
+
 				// Mark the fromLabel blocks as modified
 				blocksChanged[blockStr] = true
 				blocksChangedForLabel[blockStr] = true
-
-				// Get the toLabel RLEs for this block and add the fromLabel RLEs
-				toRLEs, found := toLabelRLEs[blockStr]
-				if found {
-					toRLEs.Add(fromRLEs)
-				} else {
-					toRLEs = fromRLEs
-				}
-				toLabelRLEs[blockStr] = toRLEs
+				labelBlocks[toLabel][blockStr] = true
+
+				fromLabel, blockStr := fromLabel, blockStr
+				combiner.Submit(blockStr, func(shard int) error {
+					// Get the toLabel RLEs for this block and add the fromLabel RLEs
+					fromRLEs, _ := getRLEs(shard, fromLabel, blockStr)
+					toRLEs, found := getRLEs(shard, toLabel, blockStr)
+					if found {
+						toRLEs.Add(fromRLEs)
+					} else {
+						toRLEs = fromRLEs
+					}
+					if combined[shard][toLabel] == nil {
+						combined[shard][toLabel] = make(blockRLEs)
+					}
+					combined[shard][toLabel][blockStr] = toRLEs
+					return nil
+				})
 			}
-
-			// Delete all fromLabel RLEs since they are all integrated into toLabel RLEs
-			minIndex := voxels.NewLabelSpatialMapIndex(fromLabel, dvid.MinIndexZYX.Bytes())
-			maxIndex := voxels.NewLabelSpatialMapIndex(fromLabel, dvid.MaxIndexZYX.Bytes())
-			if err := smalldata.DeleteRange(ctx, minIndex, maxIndex); err != nil {
-				return fmt.Errorf("Can't delete label %d RLEs: %s", fromLabel, err.Error())
+		}
+		targetBlocksChanged[i] = blocksChangedForLabel
+		sizeMods[toLabel] = sizeChange{toLabelSize, toLabelSize + addedVoxels}
+		target.VoxelsAdded = addedVoxels
+		target.NewSize = toLabelSize + addedVoxels
+		result.Targets = append(result.Targets, target)
+	}
+	if err := combiner.Wait(); err != nil {
+		return nil, err
+	}
+	for _, shardRLEs := range combined {
+		for label, rles := range shardRLEs {
+			for blockStr, blockRLEs := range rles {
+				labelRLEs[label][blockStr] = blockRLEs
 			}
+		}
+	}
 
-			// Delete the fromLabel surface.
-			surfaceIndex := voxels.NewLabelSurfaceIndex(fromLabel)
-			if err := bigdata.Delete(ctx, surfaceIndex); err != nil {
-				return fmt.Errorf("Can't delete label %d surface: %s", fromLabel, err.Error())
-			}
+	// Recombine blocks changed by concurrent writers since they were read.
+	if read != nil {
+		checked := read.overwritten(tuples, targetBlocksChanged)
+		if err := d.verifyMerge(ctx, tuples, labelRLEs, targetBlocksChanged, checked); err != nil {
+			return nil, err
 		}
+	}
 
-		// Update datastore with all toLabel RLEs that were changed
-		batch := smallBatcher.NewBatch(ctx)
-		for blockStr := range blocksChangedForLabel {
-			toLabelRLEsIndex := voxels.NewLabelSpatialMapIndex(toLabel, []byte(blockStr))
-			serialization, err := toLabelRLEs[blockStr].MarshalBinary()
-			if err != nil {
-				dvid.Errorf("Error serializing RLEs for label %d: %s\n", toLabel, err.Error())
+	// Store the intent before any modification so an interrupted merge can be completed.
+	timer.Next("write")
+	timer.Start("intent")
+	intent := &mergeIntent{
+		ID:       newIntentID(),
+		Op:       "merge",
+		Phase:    intentMergeRLEs,
+		Tuples:   tuples,
+		User:     opts.user(),
+		Override: overridden,
+		Targets:  result.Targets,
+	}
+	if err := intent.setBlocks(blocksChanged); err != nil {
+		return nil, err
+	}
+	intent.setSizes(sizeMods)
+	if err := d.putIntent(ctx, intent); err != nil {
+		return nil, storeUnavailable(err)
+	}
+	if err := checkMergeFailpoint("intent"); err != nil {
+		return nil, d.interrupted(ctx, intent, err)
+	}
+
+	timer.Next("rles")
+	op := d.journalOp(intent)
+	for i, tuple := range tuples {
+		// Store all toLabel RLEs that were changed before deleting any fromLabel RLEs, so
+		// voxels are never absent from the sparse volumes.
+		toLabel := tuple[0]
+		if err := putJournaledRLEs(ctx, toLabel, labelRLEs[toLabel], targetBlocksChanged[i], op); err != nil {
+			return nil, d.interrupted(ctx, intent, err)
+		}
+		if err := checkMergeFailpoint("rles"); err != nil {
+			return nil, d.interrupted(ctx, intent, err)
+		}
+		for _, fromLabel := range tuple[1:] {
+			if len(labelRLEs[fromLabel]) == 0 {
 				continue
 			}
-			batch.Put(toLabelRLEsIndex, serialization)
-		}
-		if err := batch.Commit(); err != nil {
-			dvid.Errorf("Error on updating RLEs for label %d: %s\n", toLabel, err.Error())
+			if err := deleteJournaledBlocks(ctx, fromLabel, labelRLEs[fromLabel].blocks(), op); err != nil {
+				return nil, d.interrupted(ctx, intent, err)
+			}
 		}
-		sizeMods[toLabel] = sizeChange{toLabelSize, toLabelSize + addedVoxels}
 
 		// Recompute the toLabel surface
-		go d.recomputeSurface(ctx, toLabel, toLabelRLEs)
+		go d.recomputeSurface(ctx, toLabel, labelRLEs[toLabel])
+	}
+
+	d.invalidateAdjacency(ctx.VersionID(), intent.labels())
+	d.invalidateCompartments(ctx.VersionID(), intent.labels())
+	timer.Stop()
+	intent.Phase = intentRelabel
+	if err := d.putIntent(ctx, intent); err != nil {
+		return nil, d.interrupted(ctx, intent, err)
+	}
+	if err := checkMergeFailpoint("relabel"); err != nil {
+		return nil, d.interrupted(ctx, intent, err)
 	}
 
-	// Update all label size data (key: sz + b)
-	go updateLabelSizes(ctx, sizeMods)
+	// Update all label size data (key: sz + b) and the size history, then relabel the
+	// label blocks and clear the intent.
+	timer.Next("notify")
+	d.setFinishing(intent.ID, true)
+	go func() {
+		if err := d.finishMerge(ctx, intent); err != nil {
+			d.needsRepair(ctx.VersionID(), intent, err)
+		}
+		d.setFinishing(intent.ID, false)
+	}()
+
+	result.setBlockBounds(blocksChanged)
+	result.ElapsedMs = float64(time.Since(start)) / float64(time.Millisecond)
+	return result, nil
+}
+
+// interrupted flags a merge that failed after its intent was stored and returns an error.
+func (d *Data) interrupted(ctx *datastore.VersionedContext, intent *mergeIntent, err error) error {
+	d.needsRepair(ctx.VersionID(), intent, err)
+	return server.NewError(server.StorageError, "Merge interrupted in %s phase and needs repair: %s", intent.Phase, err.Error())
+}
+
+// finishMerge updates the label sizes, label blocks, and annotations of a merge whose
+// sparse volumes are complete, then deletes its intent.
+func (d *Data) finishMerge(ctx *datastore.VersionedContext, intent *mergeIntent) error {
+	updateLabelSizes(ctx, intent.sizeMods(), "merge")
+	if err := d.relabelBlocks(ctx, intent.blocksChanged(), intent.remapping()); err != nil {
+		return err
+	}
+	d.invalidateAdjacency(ctx.VersionID(), intent.labels())
+	d.invalidateCompartments(ctx.VersionID(), intent.labels())
+	if err := d.mergeAnnotations(ctx.VersionID(), intent.Tuples); err != nil {
+		return err
+	}
+	if err := d.logMerge(ctx, intent); err != nil {
+		return err
+	}
+	d.pruneJournalInBackground()
+	return d.deleteIntent(ctx, intent.ID)
+}
 
-	// Iterate through all the label blocks and perform the actual relabeling.
-	go d.relabelBlocks(ctx, blocksChanged, remapping)
+// putLabelRLEs stores a label's RLEs for the given blocks.  Blocks are written by the
+// worker for each block in batches of at most maxBlockBatch blocks.
+func putLabelRLEs(ctx *datastore.VersionedContext, label uint64, rles blockRLEs, blocks map[string]bool) error {
+	return putJournaledRLEs(ctx, label, rles, blocks, nil)
+}
 
+// putJournaledRLEs is putLabelRLEs with each block's put journaled in its batch if the
+// journal op isn't nil.
+func putJournaledRLEs(ctx *datastore.VersionedContext, label uint64, rles blockRLEs, blocks map[string]bool, op *journalOp) error {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	smallBatcher, ok := smalldata.(storage.KeyValueBatcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in putLabelRLEs()")
+	}
+	rleMu.RLock()
+	defer rleMu.RUnlock()
+	var batches []storage.Batch
+	writer := dvid.NewShardedExecutor(blockShards, maxBlockBatch, func(shard int) error {
+		err := batches[shard].Commit()
+		batches[shard] = nil
+		return err
+	})
+	batches = make([]storage.Batch, writer.NumShards())
+	for blockStr := range blocks {
+		blockStr := blockStr
+		writer.Submit(blockStr, func(shard int) error {
+			serialization, err := encodeLabelBlock(ctx.Data(), []byte(blockStr), rles[blockStr])
+			if err != nil {
+				return fmt.Errorf("Error serializing RLEs for label %d: %s\n", label, err.Error())
+			}
+			if batches[shard] == nil {
+				batches[shard] = smallBatcher.NewBatch(ctx)
+			}
+			if err := op.journal(ctx, smalldata, batches[shard], label, []byte(blockStr), JournalPut); err != nil {
+				return fmt.Errorf("Error journaling RLEs for label %d: %s\n", label, err.Error())
+			}
+			batches[shard].Put(voxels.NewLabelSpatialMapIndex(label, []byte(blockStr)), serialization)
+			return nil
+		})
+	}
+	if err := writer.Wait(); err != nil {
+		return fmt.Errorf("Error on updating RLEs for label %d: %s\n", label, err.Error())
+	}
+	return nil
+}
+
+// deleteLabelBlocks deletes a label's RLEs for the given blocks and the label's surface.
+// Only the blocks read by the caller are deleted, so blocks added by a concurrent writer
+// are kept and stores never have to scan the label's whole key range.  Blocks are deleted
+// by the worker for each block in batches of at most maxBlockBatch blocks.
+func deleteLabelBlocks(ctx *datastore.VersionedContext, label uint64, blocks map[string]bool) error {
+	return deleteJournaledBlocks(ctx, label, blocks, nil)
+}
+
+// deleteJournaledBlocks is deleteLabelBlocks with each block's delete journaled in its
+// batch if the journal op isn't nil.
+func deleteJournaledBlocks(ctx *datastore.VersionedContext, label uint64, blocks map[string]bool, op *journalOp) error {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	smallBatcher, ok := smalldata.(storage.KeyValueBatcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in deleteLabelBlocks()")
+	}
+	bigdata, err := storage.BigDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles big data: %s\n", err.Error())
+	}
+	rleMu.RLock()
+	defer rleMu.RUnlock()
+	var batches []storage.Batch
+	deleter := dvid.NewShardedExecutor(blockShards, maxBlockBatch, func(shard int) error {
+		err := batches[shard].Commit()
+		batches[shard] = nil
+		return err
+	})
+	batches = make([]storage.Batch, deleter.NumShards())
+	for blockStr := range blocks {
+		blockStr := blockStr
+		deleter.Submit(blockStr, func(shard int) error {
+			if batches[shard] == nil {
+				batches[shard] = smallBatcher.NewBatch(ctx)
+			}
+			if err := op.journal(ctx, smalldata, batches[shard], label, []byte(blockStr), JournalDelete); err != nil {
+				return fmt.Errorf("Error journaling delete of label %d RLEs: %s", label, err.Error())
+			}
+			batches[shard].Delete(voxels.NewLabelSpatialMapIndex(label, []byte(blockStr)))
+			return nil
+		})
+	}
+	if err := deleter.Wait(); err != nil {
+		return fmt.Errorf("Can't delete label %d RLEs: %s", label, err.Error())
+	}
+	if err := bigdata.Delete(ctx, voxels.NewLabelSurfaceIndex(label)); err != nil {
+		return fmt.Errorf("Can't delete label %d surface: %s", label, err.Error())
+	}
 	return nil
 }
 
@@ -169,9 +659,10 @@ func (d *Data) recomputeSurface(ctx *datastore.VersionedContext, label uint64, r
 	}
 }
 
-// Update all label size data (key: sz + b)
-func updateLabelSizes(ctx *datastore.VersionedContext, sizeMods map[uint64]sizeChange) {
-	smalldata, err := storage.SmallDataStore()
+// Update all label size data (key: sz + b) and record the new sizes in the size history
+// with the given operation.
+func updateLabelSizes(ctx *datastore.VersionedContext, sizeMods map[uint64]sizeChange, op string) {
+	smalldata, err := smallDataStore()
 	if err != nil {
 		dvid.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
 		return
@@ -184,11 +675,16 @@ func updateLabelSizes(ctx *datastore.VersionedContext, sizeMods map[uint64]sizeC
 	// For every label key, delete the current label size and add the new one.
 	timedLog := dvid.NewTimeLog()
 	batch := smallBatcher.NewBatch(ctx)
+	newSizes := make(map[uint64]uint64, len(sizeMods))
 	for label, change := range sizeMods {
 		oldKey := voxels.NewLabelSizesIndex(change.oldSize, label)
 		newKey := voxels.NewLabelSizesIndex(change.newSize, label)
 		batch.Put(newKey, dvid.EmptyValue())
 		batch.Delete(oldKey)
+		newSizes[label] = change.newSize
+	}
+	if err := putSizeHistory(batch, ctx, newSizes, op); err != nil {
+		dvid.Errorf("Error on recording size history on %s: %s\n", ctx, err.Error())
 	}
 	if err := batch.Commit(); err != nil {
 		dvid.Errorf("Error on updating label sizes on %s: %s\n", ctx, err.Error())
@@ -196,57 +692,58 @@ func updateLabelSizes(ctx *datastore.VersionedContext, sizeMods map[uint64]sizeC
 	timedLog.Infof("Updated %d label sizes", len(sizeMods))
 }
 
-// Iterate through all the label blocks and perform the actual relabeling.
+// Iterate through all the label blocks and perform the actual relabeling.  Each block is
+// read, relabeled, and written by the worker for that block.
 func (d *Data) relabelBlocks(ctx *datastore.VersionedContext, blocksChanged map[string]bool,
-	remapping map[uint64]uint64) {
+	remapping map[uint64]uint64) error {
 
 	bigdata, err := storage.BigDataStore()
 	if err != nil {
-		dvid.Errorf("In relabeling, can't get big datastore: %s\n", err.Error())
-		return
+		return fmt.Errorf("In relabeling, can't get big datastore: %s\n", err.Error())
 	}
 
 	// Iterate through all modified blocks
 	timedLog := dvid.NewTimeLog()
-	wg := new(sync.WaitGroup)
-	for blockStr, _ := range blocksChanged {
+	relabeler := dvid.NewShardedExecutor(blockShards, 0, nil)
+	for blockStr := range blocksChanged {
 		blockKey := voxels.NewVoxelBlockIndexByCoord(blockStr)
-		value, err := bigdata.Get(ctx, blockKey)
-		if err != nil {
-			dvid.Errorf("Error in getting block of labels with block %v: %s\n",
-				[]byte(blockStr), err.Error())
-			return
-		}
-		<-server.HandlerToken
-		wg.Add(1)
-		go d.relabelChunk(ctx, blockKey, value, remapping, wg)
+		relabeler.Submit(blockStr, func(shard int) error {
+			// Hold a token while processing a block to limit overall server load.
+			<-server.HandlerToken
+			defer func() {
+				server.HandlerToken <- 1
+			}()
+			return d.relabelBlock(ctx, bigdata, blockKey, remapping)
+		})
+	}
+	if err := relabeler.Wait(); err != nil {
+		return err
 	}
-	wg.Wait()
 	timedLog.Infof("Completed relabeling of %d blocks", len(blocksChanged))
+	return nil
 }
 
-func (d *Data) relabelChunk(ctx *datastore.VersionedContext, k, v []byte,
-	remapping map[uint64]uint64, wg *sync.WaitGroup) {
-
-	defer func() {
-		// After processing a chunk, return the token.
-		server.HandlerToken <- 1
+// relabelBlock relabels a stored block of labels using the remapping.
+func (d *Data) relabelBlock(ctx *datastore.VersionedContext, bigdata storage.BigDataStorer, k []byte,
+	remapping map[uint64]uint64) error {
 
-		// Notify the requestor that this chunk is done.
-		wg.Done()
-	}()
+	v, err := bigdata.Get(ctx, k)
+	if err != nil {
+		return fmt.Errorf("Error in getting block of labels with key %v: %s", k, err.Error())
+	}
+	if v == nil {
+		return nil
+	}
 
 	// Initialize the label buffer.  For voxels, this data needs to be uncompressed and deserialized.
 	blockData, _, err := dvid.DeserializeData(v, true)
 	if err != nil {
-		dvid.Infof("Unable to deserialize block in '%s': %s\n", d.DataName(), err.Error())
-		return
+		return fmt.Errorf("Unable to deserialize block in '%s': %s", d.DataName(), err.Error())
 	}
 	numElements := int32(d.BlockSize().Prod())
 	if int32(len(blockData)) != numElements*8 {
-		dvid.Errorf("Received block with %d bytes instead of bytes for %d labels\n",
+		return fmt.Errorf("Received block with %d bytes instead of bytes for %d labels",
 			len(blockData), numElements)
-		return
 	}
 
 	// Iterate through this block of labels and relabel if label in remapping.
@@ -259,17 +756,12 @@ func (d *Data) relabelChunk(ctx *datastore.VersionedContext, k, v []byte,
 	}
 
 	// Store this block.
-	bigdata, err := storage.BigDataStore()
-	if err != nil {
-		dvid.Errorf("Unable to obtain BigData store in %q: %s\n", d.DataName(), err.Error())
-		return
-	}
 	serialization, err := dvid.SerializeData(blockData, d.Compression(), d.Checksum())
 	if err != nil {
-		dvid.Errorf("Unable to serialize block in %q: %s\n", d.DataName(), err.Error())
-		return
+		return fmt.Errorf("Unable to serialize block in %q: %s", d.DataName(), err.Error())
 	}
 	if err := bigdata.Put(ctx, k, serialization); err != nil {
-		dvid.Errorf("Error in putting key %v: %s\n", k, err.Error())
+		return fmt.Errorf("Error in putting key %v: %s", k, err.Error())
 	}
+	return nil
 }
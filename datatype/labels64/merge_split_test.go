@@ -0,0 +1,141 @@
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestMergeContributions(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	d, err := NewData(repo.RootUUID(), 475, "contributionlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+
+	// Label 2 shares block A with the target and also has block B, while label 3 only has
+	// block C.
+	blockA, blockB, blockC := dvid.IndexZYX{0, 0, 0}, dvid.IndexZYX{1, 0, 0}, dvid.IndexZYX{0, 1, 0}
+	labels := map[uint64]blockRLEs{
+		1: {string(blockA.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{0, 0, 0}, 10)}},
+		2: {
+			string(blockA.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{0, 1, 0}, 5)},
+			string(blockB.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{32, 2, 0}, 7)},
+		},
+		3: {string(blockC.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{0, 32, 0}, 4)}},
+	}
+	for label, rles := range labels {
+		if err := putLabelRLEs(ctx, label, rles, rles.blocks()); err != nil {
+			t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+		}
+	}
+
+	result, err := d.MergeLabels(ctx, MergeTuples{{1, 2, 3, 4}}, MergeOptions{Target: TargetFirst})
+	if err != nil {
+		t.Fatalf("Unable to merge labels: %s\n", err.Error())
+	}
+	d.waitFinishing()
+	expected := []MergeTarget{{
+		Label:          1,
+		OldSize:        10,
+		VoxelsAdded:    16,
+		NewSize:        26,
+		Contributions:  map[uint64]uint64{2: 12, 3: 4},
+		BlocksAppended: 1,
+		BlocksCreated:  2,
+	}}
+	if !reflect.DeepEqual(result.Targets, expected) {
+		t.Errorf("Expected merge targets %+v, got %+v\n", expected, result.Targets)
+	}
+	if !reflect.DeepEqual(result.Missing, []uint64{4}) {
+		t.Errorf("Expected missing label 4, got %v\n", result.Missing)
+	}
+
+	// Contributions are returned as a JSON object keyed by label.
+	jsonBytes, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("Unable to encode merge result: %s\n", err.Error())
+	}
+	if !strings.Contains(string(jsonBytes), `"Contributions":{"2":12,"3":4}`) {
+		t.Errorf("Expected contributions by label in merge result JSON: %s\n", jsonBytes)
+	}
+
+	// The merge log record has the same breakdown.
+	records, err := d.getMergeLog(ctx)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Bad merge log: %v, %v\n", records, err)
+	}
+	if !reflect.DeepEqual(records[0].Targets, expected) {
+		t.Errorf("Expected merge log targets %+v, got %+v\n", expected, records[0].Targets)
+	}
+}
+
+func TestMergeSplitQueryParams(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 476, "querylabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	defer d.waitFinishing()
+	ctx := datastore.NewVersionedContext(d, versionID)
+	block := dvid.IndexZYX{0, 0, 0}
+	for label := uint64(1); label <= 2; label++ {
+		rles := blockRLEs{string(block.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{0, int32(label), 0}, 10)}}
+		if err := putLabelRLEs(ctx, label, rles, map[string]bool{string(block.Bytes()): true}); err != nil {
+			t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+		}
+	}
+
+	post := func(endpoint, query, body string) *httptest.ResponseRecorder {
+		apiStr := fmt.Sprintf("%snode/%s/querylabels/%s%s", server.WebAPIPath, uuid, endpoint, query)
+		r, _ := http.NewRequest("POST", apiStr, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+		return w
+	}
+
+	// Unknown parameters are only rejected with strict=true, which on merges also refuses
+	// missing labels.
+	w := post("merge", "?strict=true&targt=largest", "[[1, 2]]")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "targt") || !strings.Contains(w.Body.String(), "opid") {
+		t.Errorf("Expected strict merge with unknown parameter to list valid options, got %d %s\n", w.Code, w.Body.String())
+	}
+	if w = post("merge", "?strict=true", "[[1, 3]]"); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "do not exist") {
+		t.Errorf("Expected strict merge with missing label to fail, got %d %s\n", w.Code, w.Body.String())
+	}
+	if w = post("merge", "?timing=maybe", "[[1, 2]]"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad boolean parameter to fail, got %d %s\n", w.Code, w.Body.String())
+	}
+	if w = post("split", "?strict=true&label=3", ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "label") {
+		t.Errorf("Expected strict split with unknown parameter to fail, got %d %s\n", w.Code, w.Body.String())
+	}
+	if w = post("merge", "?targt=largest&terse=true", "[[1, 2]]"); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("Expected unknown parameter to be ignored without strict, got %d %s\n", w.Code, w.Body.String())
+	}
+
+	// The help text is generated from the parameter tables.
+	for _, param := range mergeQueryParams {
+		if !strings.Contains(HelpMessage, "    "+param.Name+" ") {
+			t.Errorf("Expected help text to document merge parameter %q\n", param.Name)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+/*
+	This file supports optimistic concurrency for merges.  The label block RLEs a merge
+	reads are fingerprinted, and before the merge modifies anything, the blocks it will
+	overwrite or delete are read again.  Blocks changed by a concurrent writer, e.g., a
+	labelblk sync, are recombined from their new RLEs and verified again, and a merge whose
+	blocks keep changing fails with a conflict.  Instances whose MergeConflict setting is
+	"last-writer-wins" skip the verification, so merges overwrite concurrent writes.
+*/
+
+package labels64
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// Policies for merges whose blocks were changed by concurrent writers.
+const (
+	// MergeConflictFail recombines changed blocks up to the MergeRetries setting, then
+	// fails the merge with a conflict.
+	MergeConflictFail = "fail"
+
+	// MergeConflictLastWriterWins doesn't check for changed blocks, so the merge overwrites
+	// concurrent writes to its blocks.
+	MergeConflictLastWriterWins = "last-writer-wins"
+)
+
+// DefaultMergeRetries is how many times a merge's changed blocks are recombined before
+// the merge fails if the MergeRetries setting is 0.
+const DefaultMergeRetries = 3
+
+// validateMergeConflict checks that a merge conflict policy is known.
+func validateMergeConflict(value string) error {
+	switch strings.ToLower(value) {
+	case MergeConflictFail, MergeConflictLastWriterWins:
+		return nil
+	default:
+		return fmt.Errorf("unknown merge conflict policy %q", value)
+	}
+}
+
+// mergeConflict returns the policy for merges whose blocks were changed concurrently.
+func (d *Data) mergeConflict() string {
+	if strings.ToLower(d.MergeConflict) == MergeConflictLastWriterWins {
+		return MergeConflictLastWriterWins
+	}
+	return MergeConflictFail
+}
+
+func (d *Data) mergeRetries() int {
+	if d.MergeRetries > 0 {
+		return d.MergeRetries
+	}
+	return DefaultMergeRetries
+}
+
+// labelBlock identifies the RLEs of a label in a block.
+type labelBlock struct {
+	label    uint64
+	blockStr string
+}
+
+// blockFingerprint identifies serialized RLEs by their length and CRC-32 checksum, so
+// absent RLEs have the zero fingerprint.
+type blockFingerprint struct {
+	length   int
+	checksum uint32
+}
+
+func fingerprintRLEs(serialization []byte) blockFingerprint {
+	return blockFingerprint{len(serialization), crc32.ChecksumIEEE(serialization)}
+}
+
+// mergeFingerprints are the fingerprints of label blocks as a merge read them.
+type mergeFingerprints map[labelBlock]blockFingerprint
+
+// readFingerprints returns the fingerprints of the RLEs read for a merge, which must be
+// taken before the RLEs are combined.
+func readFingerprints(labelRLEs map[uint64]blockRLEs) (mergeFingerprints, error) {
+	read := make(mergeFingerprints)
+	for label, blocks := range labelRLEs {
+		for blockStr, rles := range blocks {
+			serialization, err := rles.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			read[labelBlock{label, blockStr}] = fingerprintRLEs(serialization)
+		}
+	}
+	return read, nil
+}
+
+// overwritten returns the fingerprints of the label blocks a merge overwrites or deletes:
+// the changed blocks of each target and all blocks of the merged labels.  Target blocks
+// that weren't read have the zero fingerprint.
+func (read mergeFingerprints) overwritten(tuples MergeTuples, targetBlocksChanged []map[string]bool) mergeFingerprints {
+	merged := make(map[uint64]bool)
+	for _, tuple := range tuples {
+		for _, fromLabel := range tuple[1:] {
+			merged[fromLabel] = true
+		}
+	}
+	checked := make(mergeFingerprints)
+	for key, fingerprint := range read {
+		if merged[key.label] {
+			checked[key] = fingerprint
+		}
+	}
+	for i, tuple := range tuples {
+		for blockStr := range targetBlocksChanged[i] {
+			key := labelBlock{tuple[0], blockStr}
+			checked[key] = read[key]
+		}
+	}
+	return checked
+}
+
+// changedBlocks returns the blocks where any label's stored RLEs differ from the
+// fingerprints.
+func (checked mergeFingerprints) changedBlocks(ctx *datastore.VersionedContext) (map[string]bool, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	changed := make(map[string]bool)
+	for key, fingerprint := range checked {
+		if changed[key.blockStr] {
+			continue
+		}
+		serialization, err := getStoredBlockRLEs(ctx, smalldata, key.label, key.blockStr)
+		if err != nil {
+			return nil, err
+		}
+		if fingerprintRLEs(serialization) != fingerprint {
+			changed[key.blockStr] = true
+		}
+	}
+	return changed, nil
+}
+
+// getStoredBlockRLEs returns the serialized RLEs of a label in a block, or nil if the label
+// has none there.
+func getStoredBlockRLEs(ctx *datastore.VersionedContext, smalldata storage.SmallDataStorer, label uint64,
+	blockStr string) ([]byte, error) {
+
+	index := voxels.NewLabelSpatialMapIndex(label, []byte(blockStr))
+	value, err := smalldata.Get(ctx, index)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return expandStoredRLEs(ctx, ctx.ConstructKey(index), value)
+}
+
+// verifyMerge rereads the blocks a merge overwrites or deletes and recombines the labels'
+// RLEs in the blocks changed since they were read, up to the instance's merge retries.
+// The recombined RLEs replace those in labelRLEs, and the changed blocks of targets are
+// updated.  A conflict error is returned if blocks are still changing.
+func (d *Data) verifyMerge(ctx *datastore.VersionedContext, tuples MergeTuples, labelRLEs map[uint64]blockRLEs,
+	targetBlocksChanged []map[string]bool, checked mergeFingerprints) error {
+
+	retries := d.mergeRetries()
+	for attempt := 0; ; attempt++ {
+		if err := checkMergeFailpoint("verify"); err != nil {
+			return err
+		}
+		changed, err := checked.changedBlocks(ctx)
+		if err != nil {
+			return storeUnavailable(err)
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		if attempt == retries {
+			return server.NewError(server.ConflictError, "Merge of data %q refused because %d blocks were changed by concurrent writes after %d retries",
+				d.DataName(), len(changed), retries)
+		}
+		dvid.Infof("Recombining %d blocks of merge in data %q changed by concurrent writes\n", len(changed), d.DataName())
+		if err := remergeBlocks(ctx, tuples, labelRLEs, targetBlocksChanged, checked, changed); err != nil {
+			return storeUnavailable(err)
+		}
+	}
+}
+
+// remergeBlocks rereads the RLEs of all labels of a merge in the given blocks, noting
+// their fingerprints, and combines them in tuple order like MergeLabels.
+func remergeBlocks(ctx *datastore.VersionedContext, tuples MergeTuples, labelRLEs map[uint64]blockRLEs,
+	targetBlocksChanged []map[string]bool, checked mergeFingerprints, blocks map[string]bool) error {
+
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	for blockStr := range blocks {
+		current := make(map[uint64]dvid.RLEs)
+		reread := make(map[uint64]bool)
+		for _, tuple := range tuples {
+			for _, label := range tuple {
+				if reread[label] {
+					continue
+				}
+				reread[label] = true
+				serialization, err := getStoredBlockRLEs(ctx, smalldata, label, blockStr)
+				if err != nil {
+					return err
+				}
+				checked[labelBlock{label, blockStr}] = fingerprintRLEs(serialization)
+				if serialization == nil {
+					continue
+				}
+				var rles dvid.RLEs
+				if err := rles.UnmarshalBinary(serialization); err != nil {
+					return fmt.Errorf("Unable to unmarshal RLE for label %d in block %v", label, []byte(blockStr))
+				}
+				current[label] = rles
+			}
+		}
+		for i, tuple := range tuples {
+			toLabel := tuple[0]
+			delete(targetBlocksChanged[i], blockStr)
+			for _, fromLabel := range tuple[1:] {
+				fromRLEs, found := current[fromLabel]
+				if !found {
+					continue
+				}
+				targetBlocksChanged[i][blockStr] = true
+				if toRLEs, found := current[toLabel]; found {
+					toRLEs.Add(fromRLEs)
+					current[toLabel] = toRLEs
+				} else {
+					current[toLabel] = append(dvid.RLEs{}, fromRLEs...)
+				}
+			}
+		}
+		for _, tuple := range tuples {
+			for _, label := range tuple {
+				if rles, found := current[label]; found {
+					if labelRLEs[label] == nil {
+						labelRLEs[label] = blockRLEs{}
+					}
+					labelRLEs[label][blockStr] = rles
+				} else {
+					delete(labelRLEs[label], blockStr)
+				}
+			}
+		}
+	}
+	return nil
+}
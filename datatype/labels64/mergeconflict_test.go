@@ -0,0 +1,135 @@
+package labels64
+
+import (
+	"testing"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestMergeConflictPolicy(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+	defer func() {
+		mergeFailpoint = nil
+	}()
+
+	repo, versionID := initTestRepo()
+	blockA, blockB := dvid.IndexZYX{0, 0, 0}, dvid.IndexZYX{1, 0, 0}
+	setup := func(id dvid.InstanceID, name dvid.DataString, config dvid.Config) (*Data, *datastore.VersionedContext) {
+		d, err := NewData(repo.RootUUID(), id, name, config)
+		if err != nil {
+			t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+		}
+		ctx := datastore.NewVersionedContext(d, versionID)
+		label1RLEs := blockRLEs{string(blockA.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{0, 0, 0}, 10)}}
+		label2RLEs := blockRLEs{string(blockB.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{32, 2, 0}, 7)}}
+		if err := putLabelRLEs(ctx, 1, label1RLEs, label1RLEs.blocks()); err != nil {
+			t.Fatalf("Unable to store label 1: %s\n", err.Error())
+		}
+		if err := putLabelRLEs(ctx, 2, label2RLEs, label2RLEs.blocks()); err != nil {
+			t.Fatalf("Unable to store label 2: %s\n", err.Error())
+		}
+		return d, ctx
+	}
+
+	// A writer adds voxels to both labels in block B after the merge has read it.
+	concurrentWrite := func(ctx *datastore.VersionedContext) error {
+		label1RLEs := blockRLEs{string(blockB.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{32, 5, 0}, 2)}}
+		label2RLEs := blockRLEs{string(blockB.Bytes()): dvid.RLEs{
+			dvid.NewRLE(dvid.Point3d{32, 2, 0}, 7),
+			dvid.NewRLE(dvid.Point3d{32, 3, 0}, 3),
+		}}
+		if err := putLabelRLEs(ctx, 1, label1RLEs, label1RLEs.blocks()); err != nil {
+			return err
+		}
+		return putLabelRLEs(ctx, 2, label2RLEs, label2RLEs.blocks())
+	}
+	merge := func(d *Data, ctx *datastore.VersionedContext) error {
+		_, err := d.MergeLabels(ctx, MergeTuples{{1, 2}}, MergeOptions{Target: TargetFirst})
+		d.waitFinishing()
+		return err
+	}
+	checkLabel := func(ctx *datastore.VersionedContext, label, expected uint64, blocks int, policy string) {
+		rles, err := getLabelRLEs(ctx, label)
+		if err != nil {
+			t.Fatalf("Unable to get label %d RLEs: %s\n", label, err.Error())
+		}
+		if numVoxels := rles.numVoxels(); numVoxels != expected || len(rles) != blocks {
+			t.Errorf("Expected %d voxels in %d blocks for label %d with %s policy, got %d voxels in %d blocks\n",
+				expected, blocks, label, policy, numVoxels, len(rles))
+		}
+	}
+
+	// With the default policy, the concurrently written voxels are merged, not lost.
+	d, ctx := setup(467, "conflictlabels", dvid.NewConfig())
+	var written bool
+	mergeFailpoint = func(step string) error {
+		if step == "read" && !written {
+			written = true
+			return concurrentWrite(ctx)
+		}
+		return nil
+	}
+	if err := merge(d, ctx); err != nil {
+		t.Fatalf("Unable to merge with concurrent write: %s\n", err.Error())
+	}
+	mergeFailpoint = nil
+	checkLabel(ctx, 1, 22, 2, "default")
+	checkLabel(ctx, 2, 0, 0, "default")
+
+	// The last writer wins when merges don't check for concurrent writes.
+	config := dvid.NewConfig()
+	config.Set("MergeConflict", "last-writer-wins")
+	d, ctx = setup(468, "lastwriterlabels", config)
+	mergeFailpoint = func(step string) error {
+		if step == "read" {
+			return concurrentWrite(ctx)
+		}
+		return nil
+	}
+	if err := merge(d, ctx); err != nil {
+		t.Fatalf("Unable to merge with last-writer-wins policy: %s\n", err.Error())
+	}
+	mergeFailpoint = nil
+	checkLabel(ctx, 1, 17, 2, "last-writer-wins")
+
+	// Blocks that keep changing fail the merge after the retries without modifying labels.
+	config = dvid.NewConfig()
+	config.Set("MergeRetries", "2")
+	d, ctx = setup(469, "busylabels", config)
+	var verifications int32
+	mergeFailpoint = func(step string) error {
+		if step != "verify" {
+			return nil
+		}
+		verifications++
+		rles := blockRLEs{string(blockB.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{32, 2, 0}, 7+verifications)}}
+		return putLabelRLEs(ctx, 2, rles, rles.blocks())
+	}
+	err := merge(d, ctx)
+	mergeFailpoint = nil
+	if err == nil || server.ErrorKindOf(err) != server.ConflictError {
+		t.Fatalf("Expected conflict merging blocks that keep changing, got %v\n", err)
+	}
+	if verifications != 3 {
+		t.Errorf("Expected 3 verifications for 2 retries, got %d\n", verifications)
+	}
+	if pending := d.pendingIntents(); len(pending) != 0 {
+		t.Errorf("Expected no repairs needed after refused merge, got %v\n", pending)
+	}
+	checkLabel(ctx, 1, 10, 1, "busy")
+	checkLabel(ctx, 2, 10, 1, "busy")
+
+	// Settings are validated.
+	config = dvid.NewConfig()
+	config.Set("MergeConflict", "overwrite")
+	if _, err := NewData(repo.RootUUID(), 470, "badconflictlabels", config); err == nil {
+		t.Errorf("Expected error for unknown MergeConflict setting\n")
+	}
+	if d.mergeConflict() != MergeConflictFail || d.mergeRetries() != 2 {
+		t.Errorf("Bad merge conflict settings: %q, %d\n", d.mergeConflict(), d.mergeRetries())
+	}
+}
@@ -0,0 +1,284 @@
+/*
+	This file guards against merges across compartments, e.g., brain hemispheres, given by
+	the ROIs named in the MergeGuardROI setting.  Each label's compartment is the ROI holding
+	the majority of its voxels, judged by block, and merges of labels in different
+	compartments are refused unless overridden.
+*/
+
+package labels64
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/roi"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// outsideCompartments is reported for labels with most voxels outside all guard ROIs.
+// Such labels may be merged with labels of any compartment.
+const outsideCompartments = "none"
+
+type compartmentKey struct {
+	version dvid.VersionID
+	label   uint64
+}
+
+// compartmentMu guards the compartment caches of all data instances.
+var compartmentMu sync.Mutex
+
+// roiSpans holds the spans of an ROI keyed by the ROI block's z and y, so voxels can be
+// tested in any order.
+type roiSpans struct {
+	name      dvid.DataString
+	blockSize dvid.Point3d
+	spans     map[[2]int32][][2]int32
+}
+
+// contains returns true if the voxel is within the ROI.
+func (g *roiSpans) contains(pt dvid.Point3d) bool {
+	var block [3]int32
+	for i := 0; i < 3; i++ {
+		block[i] = pt[i] / g.blockSize[i]
+		if pt[i] < 0 && pt[i]%g.blockSize[i] != 0 {
+			block[i]--
+		}
+	}
+	for _, span := range g.spans[[2]int32{block[2], block[1]}] {
+		if block[0] >= span[0] && block[0] <= span[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// containsBlock returns true if the center of a block of the given size is within the ROI.
+func (g *roiSpans) containsBlock(block dvid.IndexZYX, blockSize dvid.Point3d) bool {
+	return g.contains(dvid.Point3d{
+		block[0]*blockSize[0] + blockSize[0]/2,
+		block[1]*blockSize[1] + blockSize[1]/2,
+		block[2]*blockSize[2] + blockSize[2]/2,
+	})
+}
+
+// mergeGuardROIs returns the names of the guard ROIs in the MergeGuardROI setting.
+func (s *Settings) mergeGuardROIs() []dvid.DataString {
+	var names []dvid.DataString
+	for _, name := range strings.Split(s.MergeGuardROI, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, dvid.DataString(name))
+		}
+	}
+	return names
+}
+
+// validateMergeGuardROI checks that a MergeGuardROI setting has no empty ROI names.  An
+// empty setting turns off the guard.
+func validateMergeGuardROI(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	for _, name := range strings.Split(value, ",") {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("empty ROI name in %q", value)
+		}
+	}
+	return nil
+}
+
+// loadROISpans reads the spans of a named roi instance at a version.
+func loadROISpans(versionID dvid.VersionID, name dvid.DataString) (*roiSpans, error) {
+	dataservice, err := datastore.GetData(versionID, name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get ROI %q: %s", name, err.Error())
+	}
+	roiData, ok := dataservice.(*roi.Data)
+	if !ok {
+		return nil, fmt.Errorf("Data %q is not a roi instance", name)
+	}
+	spans, err := roi.GetSpans(datastore.NewVersionedContext(roiData, versionID))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read ROI %q: %s", name, err.Error())
+	}
+	r := &roiSpans{name, roiData.BlockSize, make(map[[2]int32][][2]int32)}
+	for _, span := range spans {
+		zy := [2]int32{span[0], span[1]}
+		r.spans[zy] = append(r.spans[zy], [2]int32{span[2], span[3]})
+	}
+	return r, nil
+}
+
+// loadGuardROIs reads the spans of the guard ROIs at a version.
+func (d *Data) loadGuardROIs(versionID dvid.VersionID) ([]*roiSpans, error) {
+	var guards []*roiSpans
+	for _, name := range d.mergeGuardROIs() {
+		guard, err := loadROISpans(versionID, name)
+		if err != nil {
+			return nil, fmt.Errorf("Bad merge guard ROI for %q: %s", d.DataName(), err.Error())
+		}
+		guards = append(guards, guard)
+	}
+	return guards, nil
+}
+
+// labelCompartment returns the guard ROI holding the most voxels of a label, where the
+// voxels of each block are assigned to the ROI holding the block's center.  Ties go to the
+// first ROI by name.
+func labelCompartment(guards []*roiSpans, blockSize dvid.Point3d, rles blockRLEs) (string, error) {
+	votes := make(map[string]uint64)
+	for blockStr, blockRLE := range rles {
+		var block dvid.IndexZYX
+		if err := block.IndexFromBytes([]byte(blockStr)); err != nil {
+			return "", err
+		}
+		compartment := outsideCompartments
+		for _, guard := range guards {
+			if guard.containsBlock(block, blockSize) {
+				compartment = string(guard.name)
+				break
+			}
+		}
+		numVoxels, _ := blockRLE.Stats()
+		votes[compartment] += uint64(numVoxels)
+	}
+	names := make([]string, 0, len(votes))
+	for name := range votes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var majority string
+	for _, name := range names {
+		if majority == "" || votes[name] > votes[majority] {
+			majority = name
+		}
+	}
+	return majority, nil
+}
+
+// labelCompartments returns the compartments of labels with voxels, using the cached
+// compartments at the context's version where available.
+func (d *Data) labelCompartments(ctx *datastore.VersionedContext, labelRLEs map[uint64]blockRLEs) (map[uint64]string, error) {
+	compartments := make(map[uint64]string, len(labelRLEs))
+	compartmentMu.Lock()
+	for label := range labelRLEs {
+		if compartment, found := d.compartments[compartmentKey{ctx.VersionID(), label}]; found {
+			compartments[label] = compartment
+		}
+	}
+	generation := d.compartmentGen
+	compartmentMu.Unlock()
+
+	var guards []*roiSpans
+	computed := make(map[uint64]string)
+	for label, rles := range labelRLEs {
+		if _, found := compartments[label]; found || len(rles) == 0 {
+			continue
+		}
+		if guards == nil {
+			var err error
+			if guards, err = d.loadGuardROIs(ctx.VersionID()); err != nil {
+				return nil, err
+			}
+		}
+		blockSize, ok := d.BlockSize().(dvid.Point3d)
+		if !ok {
+			return nil, fmt.Errorf("Can't get compartments of data %q with non-3d block size %s", d.DataName(), d.BlockSize())
+		}
+		compartment, err := labelCompartment(guards, blockSize, rles)
+		if err != nil {
+			return nil, err
+		}
+		compartments[label] = compartment
+		computed[label] = compartment
+	}
+
+	// Compartments computed across an invalidation may be stale, so they aren't kept.
+	compartmentMu.Lock()
+	if generation == d.compartmentGen {
+		if d.compartments == nil {
+			d.compartments = make(map[compartmentKey]string)
+		}
+		for label, compartment := range computed {
+			d.compartments[compartmentKey{ctx.VersionID(), label}] = compartment
+		}
+	}
+	compartmentMu.Unlock()
+	return compartments, nil
+}
+
+// invalidateCompartments drops the cached compartments of the labels at the version.  If
+// labels is nil, all cached compartments at the version are dropped.
+func (d *Data) invalidateCompartments(version dvid.VersionID, labels map[uint64]bool) {
+	compartmentMu.Lock()
+	defer compartmentMu.Unlock()
+	d.compartmentGen++
+	for key := range d.compartments {
+		if key.version == version && (labels == nil || labels[key.label]) {
+			delete(d.compartments, key)
+		}
+	}
+}
+
+// resetCompartments drops all cached compartments, e.g., after the guard ROIs change.
+func (d *Data) resetCompartments() {
+	compartmentMu.Lock()
+	d.compartmentGen++
+	d.compartments = nil
+	compartmentMu.Unlock()
+}
+
+// checkMergeGuard returns true if any merge tuple has labels in different compartments of
+// the guard ROIs.  Such merges are refused with a ConflictError listing the compartment of
+// each label unless override is true.
+func (d *Data) checkMergeGuard(ctx *datastore.VersionedContext, tuples MergeTuples, labelRLEs map[uint64]blockRLEs,
+	override bool) (bool, error) {
+
+	if len(d.mergeGuardROIs()) == 0 {
+		return false, nil
+	}
+	compartments, err := d.labelCompartments(ctx, labelRLEs)
+	if err != nil {
+		return false, err
+	}
+	var crossings []string
+	for _, tuple := range tuples {
+		var inside string
+		crossed := false
+		for _, label := range tuple {
+			compartment, found := compartments[label]
+			if !found || compartment == outsideCompartments {
+				continue
+			}
+			if inside == "" {
+				inside = compartment
+			} else if compartment != inside {
+				crossed = true
+			}
+		}
+		if !crossed {
+			continue
+		}
+		var labels []string
+		for _, label := range tuple {
+			if compartment, found := compartments[label]; found {
+				labels = append(labels, fmt.Sprintf("label %d in %q", label, compartment))
+			}
+		}
+		crossings = append(crossings, strings.Join(labels, ", "))
+	}
+	if len(crossings) == 0 {
+		return false, nil
+	}
+	if !override {
+		return true, server.NewError(server.ConflictError,
+			"Merge refused because labels are in different compartments of merge guard ROIs: %s.  Use override=true to merge anyway",
+			strings.Join(crossings, "; "))
+	}
+	dvid.Infof("Overriding merge guard of labels64 %q for merges across compartments: %s\n", d.DataName(),
+		strings.Join(crossings, "; "))
+	return true, nil
+}
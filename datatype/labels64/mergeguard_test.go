@@ -0,0 +1,135 @@
+package labels64
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/roi"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestMergeGuardROI(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	roiT, err := datastore.TypeServiceByName("roi")
+	if err != nil {
+		t.Fatalf("Can't get roi type: %s\n", err.Error())
+	}
+
+	// The "left" compartment has block x 0-1 and "right" has block x 3-4 within 4x4 blocks in y and z.
+	for name, xs := range map[string][2]int32{"left": {0, 1}, "right": {3, 4}} {
+		dataservice, err := repo.NewData(roiT, dvid.DataString(name), dvid.NewConfig())
+		if err != nil {
+			t.Fatalf("Unable to create roi %q: %s\n", name, err.Error())
+		}
+		var spans []dvid.Span
+		for z := int32(0); z < 4; z++ {
+			for y := int32(0); y < 4; y++ {
+				spans = append(spans, dvid.Span{z, y, xs[0], xs[1]})
+			}
+		}
+		if err := dataservice.(*roi.Data).PutSpans(versionID, spans, true); err != nil {
+			t.Fatalf("Unable to put roi %q: %s\n", name, err.Error())
+		}
+	}
+
+	config := dvid.NewConfig()
+	config.Set("MergeGuardROI", "left, right")
+	d, err := NewData(uuid, 400, "guardedlabels", config)
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	put := func(label uint64, runs map[dvid.IndexZYX]int32) {
+		rles := blockRLEs{}
+		for block, length := range runs {
+			start := dvid.Point3d{block[0] * 32, block[1] * 32, block[2] * 32}
+			rles[string(block.Bytes())] = dvid.RLEs{dvid.NewRLE(start, length)}
+		}
+		putSyntheticRLEs(t, ctx, label, rles)
+	}
+	put(1, map[dvid.IndexZYX]int32{{0, 0, 0}: 20, {1, 0, 0}: 20})
+	put(2, map[dvid.IndexZYX]int32{{1, 1, 0}: 10})
+	put(3, map[dvid.IndexZYX]int32{{3, 0, 0}: 20})
+	put(4, map[dvid.IndexZYX]int32{{1, 2, 0}: 5, {3, 2, 0}: 20, {4, 2, 0}: 20}) // straddles, mostly right
+	put(5, map[dvid.IndexZYX]int32{{10, 0, 0}: 30})                             // outside both
+	// Merges across compartments are refused without modifying labels.
+	_, err = d.MergeLabels(ctx, MergeTuples{{1, 2}, {1, 3}}, MergeOptions{})
+	if err == nil || server.ErrorKindOf(err) != server.ConflictError {
+		t.Fatalf("Expected conflict merging labels in different compartments, got %v\n", err)
+	}
+	if !strings.Contains(err.Error(), `label 1 in "left"`) || !strings.Contains(err.Error(), `label 3 in "right"`) {
+		t.Errorf("Expected error giving compartments of labels 1 and 3, got %s\n", err.Error())
+	}
+	if sizes, err := getAllLabelSizes(ctx); err != nil || sizes[1] != 40 || sizes[2] != 10 || sizes[3] != 20 {
+		t.Errorf("Expected refused merge to leave labels unmodified, got %v, %v\n", sizes, err)
+	}
+	compartmentMu.Lock()
+	cached := d.compartments[compartmentKey{versionID, 3}]
+	compartmentMu.Unlock()
+	if cached != "right" {
+		t.Errorf("Expected cached compartment of label 3, got %q\n", cached)
+	}
+
+	// Merges within a compartment or with labels outside all compartments are allowed.
+	if _, err := d.MergeLabels(ctx, MergeTuples{{3, 4, 5}, {1, 2}}, MergeOptions{}); err != nil {
+		t.Fatalf("Unable to merge labels within compartments: %s\n", err.Error())
+	}
+	d.waitFinishing()
+	compartmentMu.Lock()
+	_, found := d.compartments[compartmentKey{versionID, 3}]
+	compartmentMu.Unlock()
+	if found {
+		t.Errorf("Expected merge to invalidate cached compartment of label 3\n")
+	}
+
+	// Overrides are allowed through the merge endpoint and recorded in the merge log.
+	post := func(query string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("/api/node/%s/guardedlabels/merge%s", uuid, query)
+		r, _ := http.NewRequest("POST", url, bytes.NewBufferString("[[1, 3]]"))
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+		return w
+	}
+	if w := post(""); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `label 3 in \"right\"`) {
+		t.Fatalf("Expected 409 for merge across compartments, got %d: %s\n", w.Code, w.Body.String())
+	}
+	if w := post("?override=true"); w.Code != http.StatusOK {
+		t.Fatalf("Expected overridden merge to succeed, got %d: %s\n", w.Code, w.Body.String())
+	}
+	d.waitFinishing()
+	records, err := d.getMergeLog(ctx)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Expected 2 logged merges, got %v, %v\n", records, err)
+	}
+	if records[0].Override || !records[1].Override {
+		t.Errorf("Expected only the last merge to be logged as an override, got %+v\n", records)
+	}
+	if sizes, err := getAllLabelSizes(ctx); err != nil || sizes[1] != 145 || sizes[3] != 0 {
+		t.Errorf("Expected overridden merge into label 1, got %v, %v\n", sizes, err)
+	}
+
+	// Guard ROIs are checked when set and can be turned off.
+	bad := dvid.NewConfig()
+	bad.Set("MergeGuardROI", "left,,right")
+	if err := d.ModifyConfig(bad); err == nil {
+		t.Errorf("Expected error for empty guard ROI name\n")
+	}
+	off := dvid.NewConfig()
+	off.Set("MergeGuardROI", "")
+	if err := d.ModifyConfig(off); err != nil || len(d.mergeGuardROIs()) != 0 {
+		t.Errorf("Expected guard to be turned off, got %v, %v\n", d.mergeGuardROIs(), err)
+	}
+}
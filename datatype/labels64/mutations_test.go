@@ -0,0 +1,115 @@
+package labels64
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestListLabelMutations(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	kvT, err := datastore.TypeServiceByName("keyvalue")
+	if err != nil {
+		t.Fatalf("Can't get keyvalue type: %s\n", err.Error())
+	}
+	if _, err := repo.NewData(kvT, "notlabels", dvid.NewConfig()); err != nil {
+		t.Fatalf("Unable to create keyvalue data: %s\n", err.Error())
+	}
+
+	// Add the labels64 instances to the repo directly since they can't be made through it.
+	allData, err := repo.GetAllData()
+	if err != nil {
+		t.Fatalf("Unable to get repo data: %s\n", err.Error())
+	}
+	merge := func(d *Data, tuples MergeTuples) {
+		ctx := datastore.NewVersionedContext(d, versionID)
+		if _, err := d.MergeLabels(ctx, tuples, MergeOptions{User: "tester"}); err != nil {
+			t.Fatalf("Unable to merge %v: %s\n", tuples, err.Error())
+		}
+		d.waitFinishing()
+	}
+	var instances []*Data
+	for i, name := range []dvid.DataString{"auditlabels1", "auditlabels2", "unmerged"} {
+		d, err := NewData(uuid, dvid.InstanceID(463+i), name, dvid.NewConfig())
+		if err != nil {
+			t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+		}
+		allData[name] = d
+		instances = append(instances, d)
+	}
+	before := time.Now()
+	merge(instances[0], MergeTuples{{1, 2}})
+	merge(instances[1], MergeTuples{{5, 6, 7}, {8, 9}})
+	merge(instances[0], MergeTuples{{1, 3}})
+
+	page, err := datastore.ListLabelMutations(repo, time.Time{}, nil, 0)
+	if err != nil {
+		t.Fatalf("Unable to list label mutations: %s\n", err.Error())
+	}
+	expected := []struct {
+		instance dvid.DataString
+		labels   []uint64
+	}{
+		{"auditlabels1", []uint64{1, 2}},
+		{"auditlabels2", []uint64{5, 6, 7}},
+		{"auditlabels2", []uint64{8, 9}},
+		{"auditlabels1", []uint64{1, 3}},
+	}
+	if len(page.Mutations) != len(expected) || page.Next != "" || len(page.Skipped) != 0 {
+		t.Fatalf("Expected %d mutations on one page, got %+v\n", len(expected), page)
+	}
+	for i, mutation := range page.Mutations {
+		if mutation.Instance != expected[i].instance || !reflect.DeepEqual(mutation.Labels, expected[i].labels) ||
+			mutation.Op != "merge" || mutation.User != "tester" || mutation.UUID != uuid || mutation.Time.Before(before) {
+			t.Errorf("Bad mutation %d: %+v\n", i, mutation)
+		}
+	}
+	if page.Mutations[1].ID != page.Mutations[2].ID {
+		t.Errorf("Expected tuples of one merge to share an id: %+v\n", page.Mutations[1:3])
+	}
+
+	// Pages of one mutation follow each other through the cursor.
+	var cursor *datastore.MutationCursor
+	for i := range expected {
+		page, err := datastore.ListLabelMutations(repo, time.Time{}, cursor, 1)
+		if err != nil {
+			t.Fatalf("Unable to list page %d of label mutations: %s\n", i, err.Error())
+		}
+		if len(page.Mutations) != 1 || !reflect.DeepEqual(page.Mutations[0].Labels, expected[i].labels) {
+			t.Fatalf("Bad page %d of label mutations: %+v\n", i, page)
+		}
+		if page.Next == "" {
+			if i != len(expected)-1 {
+				t.Fatalf("Expected a cursor after page %d\n", i)
+			}
+			break
+		}
+		if cursor, err = datastore.ParseMutationCursor(page.Next); err != nil {
+			t.Fatalf("Unable to parse cursor %q: %s\n", page.Next, err.Error())
+		}
+	}
+
+	// Only mutations at or after the since time are listed.
+	page, err = datastore.ListLabelMutations(repo, page.Mutations[3].Time, nil, 0)
+	if err != nil {
+		t.Fatalf("Unable to list recent label mutations: %s\n", err.Error())
+	}
+	if len(page.Mutations) != 1 || !reflect.DeepEqual(page.Mutations[0].Labels, []uint64{1, 3}) {
+		t.Errorf("Expected only the last merge since its time, got %+v\n", page.Mutations)
+	}
+
+	if _, err := datastore.ListLabelMutations(repo, time.Time{}, nil, datastore.MaxMutationLimit+1); err == nil {
+		t.Errorf("Expected error listing more than the maximum number of mutations\n")
+	}
+	if _, err := datastore.ParseMutationCursor("12_abc"); err == nil {
+		t.Errorf("Expected error parsing a bad cursor\n")
+	}
+}
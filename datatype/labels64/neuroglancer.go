@@ -0,0 +1,82 @@
+/*
+	This file implements the "neuroglancer" endpoint, which describes a ready-to-use
+	Neuroglancer segmentation layer for the labels and the endpoints of their sparse volumes.
+*/
+
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// NeuroglancerLayer is a Neuroglancer layer with a "dvid" data source, whose URL is of
+// the form dvid://<server URL>/<UUID>/<data name>.
+type NeuroglancerLayer struct {
+	Type   string `json:"type"`
+	Source string `json:"source"`
+	Name   string `json:"name"`
+}
+
+// NeuroglancerBounds is the extent of the labels in voxels, where Max is exclusive.
+type NeuroglancerBounds struct {
+	Min dvid.Point3d `json:"min"`
+	Max dvid.Point3d `json:"max"`
+}
+
+// NeuroglancerDescriptor is the response of the "neuroglancer" endpoint.  The sparse volume
+// URLs are templates where {label} is replaced by a label.
+type NeuroglancerDescriptor struct {
+	Layer              NeuroglancerLayer   `json:"layer"`
+	URL                string              `json:"url"`
+	DataType           string              `json:"dataType"`
+	VoxelSize          dvid.NdFloat32      `json:"voxelSize"`
+	VoxelUnits         dvid.NdString       `json:"voxelUnits"`
+	BlockSize          dvid.Point          `json:"blockSize"`
+	Bounds             *NeuroglancerBounds `json:"bounds,omitempty"`
+	SparseVolume       string              `json:"sparsevol"`
+	SparseVolumeCoarse string              `json:"sparsevolCoarse"`
+}
+
+// neuroglancer returns the Neuroglancer descriptor of the labels as served at the given
+// server URL and version.  Bounds are omitted if no labels have been stored.
+func (d *Data) neuroglancer(serverURL string, uuid dvid.UUID) *NeuroglancerDescriptor {
+	url := fmt.Sprintf("%s%snode/%s/%s", serverURL, server.WebAPIPath, uuid, d.DataName())
+	desc := &NeuroglancerDescriptor{
+		Layer: NeuroglancerLayer{
+			Type:   "segmentation",
+			Source: fmt.Sprintf("dvid://%s/%s/%s", serverURL, uuid, d.DataName()),
+			Name:   string(d.DataName()),
+		},
+		URL:                url,
+		DataType:           "uint64",
+		VoxelSize:          d.Properties.VoxelSize,
+		VoxelUnits:         d.Properties.VoxelUnits,
+		BlockSize:          d.BlockSize(),
+		SparseVolume:       url + "/sparsevol/{label}",
+		SparseVolumeCoarse: url + "/sparsevol-coarse/{label}",
+	}
+	extents := d.Extents()
+	minPt, minOK := extents.MinPoint.(dvid.Point3d)
+	maxPt, maxOK := extents.MaxPoint.(dvid.Point3d)
+	if minOK && maxOK {
+		desc.Bounds = &NeuroglancerBounds{minPt, maxPt.AddScalar(1).(dvid.Point3d)}
+	}
+	return desc
+}
+
+// serveNeuroglancer handles GET requests of the Neuroglancer descriptor.  The server URL is
+// the base URL of the request.
+func (d *Data) serveNeuroglancer(w http.ResponseWriter, r *http.Request, requestID string, uuid dvid.UUID) {
+	jsonBytes, err := json.Marshal(d.neuroglancer(server.BaseURL(r), uuid))
+	if err != nil {
+		server.ErrorResponse(w, r, requestID, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
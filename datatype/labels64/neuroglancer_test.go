@@ -0,0 +1,67 @@
+package labels64
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestNeuroglancer(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 360, "segmentation", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	get := func(host string, headers map[string]string) string {
+		apiStr := fmt.Sprintf("%snode/%s/segmentation/neuroglancer", server.WebAPIPath, uuid)
+		r, _ := http.NewRequest("GET", apiStr, nil)
+		r.Host = host
+		for header, value := range headers {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Bad neuroglancer response: %d %s\n", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	// Data without labels has no bounds.
+	url := fmt.Sprintf("http://dvid.example.org:8000/api/node/%s/segmentation", uuid)
+	expected := fmt.Sprintf(`{"layer":{"type":"segmentation","source":"dvid://http://dvid.example.org:8000/%s/segmentation","name":"segmentation"},`+
+		`"url":"%s","dataType":"uint64","voxelSize":[8,8,8],"voxelUnits":["nanometers","nanometers","nanometers"],"blockSize":[32,32,32],`+
+		`"sparsevol":"%s/sparsevol/{label}","sparsevolCoarse":"%s/sparsevol-coarse/{label}"}`, uuid, url, url, url)
+	if body := get("dvid.example.org:8000", nil); body != expected {
+		t.Errorf("Expected descriptor:\n%s\ngot:\n%s\n", expected, body)
+	}
+
+	// Proxied deployments use the forwarded host, scheme, and path prefix, and stored labels
+	// give bounds.
+	d.Extents().AdjustPoints(dvid.Point3d{10, 20, 30}, dvid.Point3d{209, 119, 59})
+	url = fmt.Sprintf("https://emdata.example.org/dvid/api/node/%s/segmentation", uuid)
+	expected = fmt.Sprintf(`{"layer":{"type":"segmentation","source":"dvid://https://emdata.example.org/dvid/%s/segmentation","name":"segmentation"},`+
+		`"url":"%s","dataType":"uint64","voxelSize":[8,8,8],"voxelUnits":["nanometers","nanometers","nanometers"],"blockSize":[32,32,32],`+
+		`"bounds":{"min":[10,20,30],"max":[210,120,60]},"sparsevol":"%s/sparsevol/{label}","sparsevolCoarse":"%s/sparsevol-coarse/{label}"}`,
+		uuid, url, url, url)
+	body := get("10.0.0.5:8000", map[string]string{
+		"X-Forwarded-Host":   "emdata.example.org",
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Prefix": "dvid",
+	})
+	if body != expected {
+		t.Errorf("Expected proxied descriptor:\n%s\ngot:\n%s\n", expected, body)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+	This file guards the reading of POSTed payloads so malformed or malicious requests
+	can't force the server into huge allocations.
+*/
+
+package labels64
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// DefaultMaxPostBytes is the largest POSTed merge, split, or annotation payload accepted
+// by data without a MaxPostBytes setting.
+const DefaultMaxPostBytes = 256 * dvid.Mega
+
+// Sizes in bytes of the header of an encoded sparse volume and each of its spans.
+const (
+	sparseVolHeaderSize = 12
+	sparseVolSpanSize   = 16
+)
+
+// PayloadTooLargeError is returned when a POSTed payload exceeds the limit of the data.
+type PayloadTooLargeError struct {
+	Size  int64 // The size of the payload or -1 if unknown.
+	Limit int64
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	if e.Size < 0 {
+		return fmt.Sprintf("POSTed data exceeds the limit of %d bytes", e.Limit)
+	}
+	return fmt.Sprintf("POSTed data of %d bytes exceeds the limit of %d bytes", e.Size, e.Limit)
+}
+
+// maxPostBytes returns the largest POSTed payload accepted by the data.
+func (d *Data) maxPostBytes() int64 {
+	if d.MaxPostBytes <= 0 {
+		return DefaultMaxPostBytes
+	}
+	return d.MaxPostBytes
+}
+
+// limitBody checks a request's Content-Length against the data's payload limit and limits
+// the reading of its body to that size.
+func (d *Data) limitBody(w http.ResponseWriter, r *http.Request) (io.Reader, error) {
+	limit := d.maxPostBytes()
+	if r.ContentLength > limit {
+		return nil, &PayloadTooLargeError{r.ContentLength, limit}
+	}
+	return http.MaxBytesReader(w, r.Body, limit), nil
+}
+
+// readPostBody returns a POSTed body no larger than the data's payload limit.
+func (d *Data) readPostBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := d.limitBody(w, r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		if limit := d.maxPostBytes(); int64(len(data)) >= limit {
+			return nil, &PayloadTooLargeError{-1, limit}
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// readSparseVol reads a POSTed binary sparse volume in the format returned by the
+// "sparsevol" endpoint.  The number of spans given in the header must agree with the
+// Content-Length if one is given and must fit within the data's payload limit, and spans
+// are allocated as they are read, so a bad header can't force a large allocation.
+func (d *Data) readSparseVol(w http.ResponseWriter, r *http.Request) (dvid.RLEs, error) {
+	body, err := d.limitBody(w, r)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, sparseVolHeaderSize)
+	if _, err := io.ReadFull(body, header); err != nil {
+		return nil, fmt.Errorf("Unable to read sparse volume header: %s", err.Error())
+	}
+	if header[0] != 0 {
+		return nil, fmt.Errorf("Expected binary sparse volume with payload descriptor 0, got %d", header[0])
+	}
+	if header[1] != 3 {
+		return nil, fmt.Errorf("Expected sparse volume with 3 dimensions, got %d", header[1])
+	}
+	if header[2] != 0 {
+		return nil, fmt.Errorf("Expected sparse volume with runs along X (dimension 0), got dimension %d", header[2])
+	}
+	numSpans := binary.LittleEndian.Uint32(header[8:12])
+	size := sparseVolHeaderSize + int64(numSpans)*sparseVolSpanSize
+	if r.ContentLength >= 0 && size != r.ContentLength {
+		return nil, fmt.Errorf("Sparse volume with %d spans requires %d bytes, but Content-Length is %d",
+			numSpans, size, r.ContentLength)
+	}
+	if limit := d.maxPostBytes(); size > limit {
+		return nil, &PayloadTooLargeError{size, limit}
+	}
+	var rles dvid.RLEs
+	if err := rles.UnmarshalBinaryReader(body, numSpans); err != nil {
+		return nil, fmt.Errorf("Bad sparse volume: %s", err.Error())
+	}
+	return rles, nil
+}
+
+// payloadErrorResponse writes a 413 Request Entity Too Large for payloads over the limit
+// and an error response for other errors.
+func payloadErrorResponse(w http.ResponseWriter, r *http.Request, requestID string, err error) {
+	if _, ok := err.(*PayloadTooLargeError); !ok {
+		server.ErrorResponse(w, r, requestID, err)
+		return
+	}
+	dvid.Errorf("ERROR [%s] %s (%s).", requestID, err.Error(), r.URL.Path)
+	w.Header().Set("X-Request-Id", requestID)
+	http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,198 @@
+package labels64
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/client"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// sparseVolBody returns an encoded binary sparse volume whose header gives numSpans spans
+// followed by the given number of encoded spans.
+func sparseVolBody(numSpans uint32, spans int) []byte {
+	body := make([]byte, sparseVolHeaderSize+spans*sparseVolSpanSize)
+	body[1] = 3
+	binary.LittleEndian.PutUint32(body[8:12], numSpans)
+	for i := 0; i < spans; i++ {
+		span := body[sparseVolHeaderSize+i*sparseVolSpanSize:]
+		binary.LittleEndian.PutUint32(span[0:4], uint32(i))
+		binary.LittleEndian.PutUint32(span[4:8], 2)
+		binary.LittleEndian.PutUint32(span[8:12], 3)
+		binary.LittleEndian.PutUint32(span[12:16], 10)
+	}
+	return body
+}
+
+// postRequest returns a POST request with the given body and Content-Length, where a
+// negative Content-Length means the length is unknown.
+func postRequest(body []byte, contentLength int64) *http.Request {
+	r, _ := http.NewRequest("POST", "/split", bytes.NewReader(body))
+	r.ContentLength = contentLength
+	if contentLength < 0 {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return r
+}
+
+func TestReadSparseVol(t *testing.T) {
+	d := &Data{Settings: Settings{MaxPostBytes: 1000}}
+
+	body := sparseVolBody(5, 5)
+	for _, contentLength := range []int64{int64(len(body)), -1} {
+		rles, err := d.readSparseVol(httptest.NewRecorder(), postRequest(body, contentLength))
+		if err != nil {
+			t.Fatalf("Unable to read sparse volume with Content-Length %d: %s\n", contentLength, err.Error())
+		}
+		if len(rles) != 5 {
+			t.Errorf("Expected 5 spans, got %d\n", len(rles))
+		}
+		if numVoxels, _ := rles.Stats(); numVoxels != 50 {
+			t.Errorf("Expected 50 voxels, got %d\n", numVoxels)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		body          []byte
+		contentLength int64
+		tooLarge      bool
+	}{
+		{"huge span count", sparseVolBody(0xFFFFFFFF, 2), -1, true},
+		{"huge span count with length", sparseVolBody(0xFFFFFFFF, 2), 12 + 2*16, false},
+		{"span count over limit", sparseVolBody(100, 2), -1, true},
+		{"content length over limit", sparseVolBody(2, 2), 5000, true},
+		{"short body", sparseVolBody(5, 2), -1, false},
+		{"length mismatch", sparseVolBody(5, 5), 12 + 4*16, false},
+		{"short header", sparseVolBody(5, 5)[:8], -1, false},
+	}
+	for _, test := range tests {
+		_, err := d.readSparseVol(httptest.NewRecorder(), postRequest(test.body, test.contentLength))
+		if err == nil {
+			t.Errorf("Expected error for %s\n", test.name)
+			continue
+		}
+		_, tooLarge := err.(*PayloadTooLargeError)
+		if tooLarge != test.tooLarge {
+			t.Errorf("Expected too large %t for %s, got error %q\n", test.tooLarge, test.name, err.Error())
+		}
+		if tooLarge && !strings.Contains(err.Error(), "1000 bytes") {
+			t.Errorf("Expected %s error to state the limit, got %q\n", test.name, err.Error())
+		}
+	}
+}
+
+func TestReadPostBody(t *testing.T) {
+	d := &Data{Settings: Settings{MaxPostBytes: 10}}
+
+	data, err := d.readPostBody(httptest.NewRecorder(), postRequest([]byte("[ [2, 3] ]"), -1))
+	if err != nil || string(data) != "[ [2, 3] ]" {
+		t.Errorf("Expected body within limit to be read, got %q, %v\n", data, err)
+	}
+	for _, contentLength := range []int64{11, -1} {
+		_, err := d.readPostBody(httptest.NewRecorder(), postRequest([]byte("[ [2, 3, 4] ]"), contentLength))
+		if _, ok := err.(*PayloadTooLargeError); !ok {
+			t.Errorf("Expected body over limit with Content-Length %d to be refused, got %v\n", contentLength, err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := postRequest([]byte("[ [2, 3, 4] ]"), -1)
+	payloadErrorResponse(w, r, server.NewRequestID(), &PayloadTooLargeError{-1, 10})
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "10 bytes") {
+		t.Errorf("Expected 413 stating the limit, got %d: %q\n", w.Code, w.Body.String())
+	}
+
+	d = &Data{}
+	if d.maxPostBytes() != DefaultMaxPostBytes {
+		t.Errorf("Expected default limit %d, got %d\n", DefaultMaxPostBytes, d.maxPostBytes())
+	}
+}
+
+// Random headers and bodies should never panic or allocate much more than the body.
+func TestSparseVolAdversarialHeaders(t *testing.T) {
+	d := &Data{Settings: Settings{MaxPostBytes: 64 * dvid.Kilo}}
+	rng := rand.New(rand.NewSource(11))
+	counts := []uint32{0, 1, 0x7FFFFFFF, 0x80000000, 0xFFFFFFFF}
+	var memStats runtime.MemStats
+	for i := 0; i < 500; i++ {
+		body := make([]byte, rng.Intn(2000))
+		rng.Read(body)
+		if len(body) >= sparseVolHeaderSize && rng.Intn(2) == 0 {
+			copy(body, sparseVolBody(0, 0))
+			numSpans := rng.Uint32()
+			if i < len(counts) {
+				numSpans = counts[i]
+			}
+			binary.LittleEndian.PutUint32(body[8:12], numSpans)
+		}
+		contentLength := int64(-1)
+		switch rng.Intn(3) {
+		case 0:
+			contentLength = int64(len(body))
+		case 1:
+			contentLength = rng.Int63n(1 << 40)
+		}
+
+		runtime.ReadMemStats(&memStats)
+		before := memStats.TotalAlloc
+		rles, err := d.readSparseVol(httptest.NewRecorder(), postRequest(body, contentLength))
+		runtime.ReadMemStats(&memStats)
+		if allocated := memStats.TotalAlloc - before; allocated > 256*dvid.Kilo {
+			t.Errorf("Reading %d byte body with Content-Length %d allocated %d bytes\n",
+				len(body), contentLength, allocated)
+		}
+		if err == nil && sparseVolHeaderSize+len(rles)*sparseVolSpanSize != len(body) {
+			t.Errorf("Read %d spans from %d byte body\n", len(rles), len(body))
+		}
+	}
+}
+
+// The client's split encoding is read by the split endpoint's sparse volume reader.
+func TestClientSplitEncoding(t *testing.T) {
+	d := &Data{Settings: Settings{MaxPostBytes: 1000}}
+	var received dvid.RLEs
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rles, err := d.readSparseVol(w, r)
+		if err != nil {
+			payloadErrorResponse(w, r, server.NewRequestID(), err)
+			return
+		}
+		received = rles
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"label": 23}`))
+	}))
+	defer ts.Close()
+
+	rles := dvid.RLEs{
+		dvid.NewRLE(dvid.Point3d{10, 40, 10}, 20),
+		dvid.NewRLE(dvid.Point3d{10, 41, 10}, 20),
+	}
+	label, err := client.Split(ts.URL, "a9b8c7", "labels", rles)
+	if err != nil {
+		t.Fatalf("Unable to split: %s\n", err.Error())
+	}
+	if label != 23 {
+		t.Errorf("Expected new label 23, got %d\n", label)
+	}
+	if !reflect.DeepEqual(received, rles) {
+		t.Errorf("Expected split spans %v, got %v\n", rles, received)
+	}
+
+	for i := 0; i < 100; i++ {
+		rles = append(rles, dvid.NewRLE(dvid.Point3d{0, int32(i), 50}, 5))
+	}
+	_, err = client.Split(ts.URL, "a9b8c7", "labels", rles)
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for split over the size limit, got %v\n", err)
+	}
+}
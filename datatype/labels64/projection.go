@@ -0,0 +1,334 @@
+/*
+	This file supports XY projections of labels through a slab of Z, where each pixel is the
+	label with the most voxels in its column.  Projections are computed a column of blocks at
+	a time so memory use doesn't grow with the size of the projected area.
+*/
+
+package labels64
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/common/labels"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+const (
+	// MaxProjectionScale is the largest downsampling level of a projection, where each pixel
+	// of a projection at scale N covers 2^N x 2^N voxel columns.
+	MaxProjectionScale = 10
+
+	// ProjectionJobTTL is how long the result of an asynchronous projection is kept after
+	// the projection finishes.
+	ProjectionJobTTL = 10 * time.Minute
+)
+
+// projectionReq is a parsed projection request.
+type projectionReq struct {
+	offset   dvid.Point3d
+	nx, ny   int32
+	depth    int32
+	scale    uint8
+	colormap bool
+}
+
+// outSize returns the size in pixels of the projection image.
+func (req projectionReq) outSize() (w, h int32) {
+	f := int32(1) << req.scale
+	return (req.nx + f - 1) / f, (req.ny + f - 1) / f
+}
+
+// parseProjectionReq parses the "xy/<size>/<offset>/<depth>" part of a projection request
+// and its query string.
+func parseProjectionReq(parts []string, query url.Values) (*projectionReq, error) {
+	if len(parts) < 4 {
+		return nil, fmt.Errorf("projection must be followed by xy/<size>/<offset>/<depth>")
+	}
+	if parts[0] != "xy" {
+		return nil, fmt.Errorf("only xy projections are supported, not %q", parts[0])
+	}
+	size, err := dvid.StringToPoint(parts[1], "_")
+	if err != nil || size.NumDims() != 2 {
+		return nil, fmt.Errorf("projection size must be given as \"nx_ny\", not %q", parts[1])
+	}
+	offset, err := dvid.StringToPoint3d(parts[2], "_")
+	if err != nil {
+		return nil, fmt.Errorf("projection offset must be given as \"x_y_z\", not %q", parts[2])
+	}
+	depth, err := strconv.ParseInt(parts[3], 10, 32)
+	if err != nil || depth <= 0 {
+		return nil, fmt.Errorf("projection depth must be a positive number of Z slices, not %q", parts[3])
+	}
+	req := &projectionReq{
+		offset: offset,
+		nx:     size.Value(0),
+		ny:     size.Value(1),
+		depth:  int32(depth),
+	}
+	if req.nx <= 0 || req.ny <= 0 {
+		return nil, fmt.Errorf("projection size must be positive, not %q", parts[1])
+	}
+	if s := query.Get("scale"); s != "" {
+		scale, err := strconv.ParseUint(s, 10, 8)
+		if err != nil || scale > MaxProjectionScale {
+			return nil, fmt.Errorf("projection scale must be from 0 to %d, not %q", MaxProjectionScale, s)
+		}
+		req.scale = uint8(scale)
+	}
+	switch colormap := query.Get("colormap"); colormap {
+	case "":
+	case "hash":
+		req.colormap = true
+	default:
+		return nil, fmt.Errorf("colormap must be \"hash\", not %q", colormap)
+	}
+	return req, nil
+}
+
+// project returns the label with the most voxels, excluding the background label 0, in each
+// projected column of the request.  Ties go to the lowest label.
+func (d *Data) project(ctx *datastore.VersionedContext, req projectionReq) ([]uint64, error) {
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	if !ok {
+		return nil, fmt.Errorf("projection requires 3d blocks, not %s", d.BlockSize())
+	}
+	outW, outH := req.outSize()
+	winners := make([]uint64, outW*outH)
+
+	// Columns are a block wide unless a projected pixel is larger.
+	f := int32(1) << req.scale
+	strideX := ((blockSize[0] + f - 1) / f) * f
+	strideY := ((blockSize[1] + f - 1) / f) * f
+	for y0 := int32(0); y0 < req.ny; y0 += strideY {
+		for x0 := int32(0); x0 < req.nx; x0 += strideX {
+			cw, ch := strideX, strideY
+			if x0+cw > req.nx {
+				cw = req.nx - x0
+			}
+			if y0+ch > req.ny {
+				ch = req.ny - y0
+			}
+			offset := dvid.Point3d{req.offset[0] + x0, req.offset[1] + y0, req.offset[2]}
+			subvol := dvid.NewSubvolume(offset, dvid.Point3d{cw, ch, req.depth})
+			e, err := d.NewExtHandler(subvol, nil)
+			if err != nil {
+				return nil, err
+			}
+			data, err := voxels.GetVolume(ctx, d, e, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			// Count labels in each projected pixel of the column.
+			ow, oh := (cw+f-1)/f, (ch+f-1)/f
+			hists := make([]map[uint64]uint32, ow*oh)
+			i := 0
+			for z := int32(0); z < req.depth; z++ {
+				for y := int32(0); y < ch; y++ {
+					row := (y / f) * ow
+					for x := int32(0); x < cw; x++ {
+						label := binary.LittleEndian.Uint64(data[i : i+8])
+						i += 8
+						if label == 0 {
+							continue
+						}
+						p := row + x/f
+						if hists[p] == nil {
+							hists[p] = make(map[uint64]uint32)
+						}
+						hists[p][label]++
+					}
+				}
+			}
+			for py := int32(0); py < oh; py++ {
+				for px := int32(0); px < ow; px++ {
+					var winner uint64
+					var most uint32
+					for label, count := range hists[py*ow+px] {
+						if count > most || (count == most && label < winner) {
+							winner, most = label, count
+						}
+					}
+					winners[(y0/f+py)*outW+x0/f+px] = winner
+				}
+			}
+		}
+	}
+	return winners, nil
+}
+
+// encodeProjection returns the projected labels as little-endian uint64 values or as a
+// PNG with each label's color in the palette and black for the background label 0.
+func encodeProjection(req projectionReq, colors labels.Palette, winners []uint64) (contentType string, data []byte, err error) {
+	if !req.colormap {
+		data = make([]byte, len(winners)*8)
+		for i, label := range winners {
+			binary.LittleEndian.PutUint64(data[i*8:], label)
+		}
+		return "application/octet-stream", data, nil
+	}
+	outW, outH := req.outSize()
+	img := image.NewNRGBA(image.Rect(0, 0, int(outW), int(outH)))
+	for i, label := range winners {
+		c := colors.Color(label)
+		img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = c.R, c.G, c.B, c.A
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", nil, err
+	}
+	return "image/png", buf.Bytes(), nil
+}
+
+// projectionJob is an asynchronous projection whose result is kept until it expires.
+type projectionJob struct {
+	id       string
+	dataName dvid.DataString
+
+	// Set when the job finishes.
+	done        bool
+	err         error
+	contentType string
+	result      []byte
+	expires     time.Time
+}
+
+var projectionJobs = struct {
+	sync.Mutex
+	jobs map[string]*projectionJob
+}{
+	jobs: make(map[string]*projectionJob),
+}
+
+// expireProjectionJobs removes finished jobs past their expiration.  The caller must hold
+// the projectionJobs lock.
+func expireProjectionJobs(now time.Time) {
+	for id, job := range projectionJobs.jobs {
+		if job.done && now.After(job.expires) {
+			delete(projectionJobs.jobs, id)
+		}
+	}
+}
+
+// startProjection computes a projection in the background once the server's throttle
+// allows it, returning the job id.
+func (d *Data) startProjection(ctx *datastore.VersionedContext, req projectionReq) string {
+	job := &projectionJob{id: server.NewRequestID(), dataName: d.DataName()}
+	projectionJobs.Lock()
+	expireProjectionJobs(time.Now())
+	projectionJobs.jobs[job.id] = job
+	projectionJobs.Unlock()
+
+	go func() {
+		<-server.Throttle
+		winners, err := d.project(ctx, req)
+		server.Throttle <- 1
+		var contentType string
+		var result []byte
+		if err == nil {
+			contentType, result, err = encodeProjection(req, d.colors(), winners)
+		}
+		projectionJobs.Lock()
+		job.done = true
+		job.err, job.contentType, job.result = err, contentType, result
+		job.expires = time.Now().Add(ProjectionJobTTL)
+		projectionJobs.Unlock()
+		if err != nil {
+			dvid.Errorf("Projection job %s on %q failed: %s\n", job.id, d.DataName(), err.Error())
+		}
+	}()
+	return job.id
+}
+
+// serveProjection handles GET requests for projections, where parts follow "projection".
+func (d *Data) serveProjection(ctx *datastore.VersionedContext, w http.ResponseWriter, r *http.Request, requestID string, parts []string) {
+	req, err := parseProjectionReq(parts, r.URL.Query())
+	if err != nil {
+		server.ErrorResponse(w, r, requestID, err)
+		return
+	}
+	if r.URL.Query().Get("async") == "true" {
+		id := d.startProjection(ctx, *req)
+		jsonBytes, err := json.Marshal(struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		}{id, "running"})
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(jsonBytes)
+		return
+	}
+
+	select {
+	case <-server.Throttle:
+		defer func() {
+			server.Throttle <- 1
+		}()
+	default:
+		server.ErrorResponse(w, r, requestID, server.NewError(server.UnavailableError,
+			"Server already running maximum of %d throttled operations; retry or use \"async=true\"", server.MaxThrottledOps))
+		return
+	}
+	winners, err := d.project(ctx, *req)
+	if err != nil {
+		server.ErrorResponse(w, r, requestID, server.NewError(server.StorageError, "%s", err.Error()))
+		return
+	}
+	contentType, data, err := encodeProjection(*req, d.colors(), winners)
+	if err != nil {
+		server.ErrorResponse(w, r, requestID, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// serveProjectionJob returns the status or result of an asynchronous projection.
+func (d *Data) serveProjectionJob(w http.ResponseWriter, r *http.Request, requestID, id string) {
+	projectionJobs.Lock()
+	expireProjectionJobs(time.Now())
+	job, found := projectionJobs.jobs[id]
+	var done bool
+	var jobErr error
+	var contentType string
+	var result []byte
+	if found {
+		done, jobErr, contentType, result = job.done, job.err, job.contentType, job.result
+	}
+	projectionJobs.Unlock()
+
+	if !found || job.dataName != d.DataName() {
+		server.ErrorResponse(w, r, requestID, server.NewError(server.NotFoundError,
+			"no projection job %q for %q, which may have expired", id, d.DataName()))
+		return
+	}
+	if !done {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"id":%q,"status":"running"}`, id)
+		return
+	}
+	if jobErr != nil {
+		server.ErrorResponse(w, r, requestID, server.NewError(server.StorageError, "projection job %s failed: %s", id, jobErr.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(result)
+}
@@ -0,0 +1,136 @@
+package labels64
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestProjection(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 1000, "bodies", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewServerContext(context.Background(), repo, versionID)
+	serve := func(method, endpoint string, body []byte) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, fmt.Sprintf("%snode/%s/bodies/%s", server.WebAPIPath, uuid, endpoint), bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		d.ServeHTTP(ctx, w, r)
+		return w
+	}
+
+	// Label 5 dominates x < 20, label 7 the rest of y < 30, and other columns are empty.
+	vol := newTestVolume(40, 40, 8)
+	vol.add(testBody{label: 5, offset: dvid.Point3d{0, 0, 0}, size: dvid.Point3d{20, 40, 5}}, 0)
+	vol.add(testBody{label: 7, offset: dvid.Point3d{0, 0, 5}, size: dvid.Point3d{40, 30, 3}}, 0)
+	if w := serve("POST", "raw/0_1_2/40_40_8/0_0_0", vol.data); w.Code != http.StatusOK {
+		t.Fatalf("Unable to post label volume: %d %s\n", w.Code, w.Body.String())
+	}
+	expectedLabel := func(x, y int32) uint64 {
+		switch {
+		case x < 20:
+			return 5
+		case y < 30:
+			return 7
+		default:
+			return 0
+		}
+	}
+
+	w := serve("GET", "projection/xy/40_40/0_0_0/8", nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 40*40*8 {
+		t.Fatalf("Bad projection response: %d with %d bytes\n", w.Code, w.Body.Len())
+	}
+	raw := w.Body.Bytes()
+	for y := int32(0); y < 40; y++ {
+		for x := int32(0); x < 40; x++ {
+			label := binary.LittleEndian.Uint64(raw[(y*40+x)*8:])
+			if label != expectedLabel(x, y) {
+				t.Fatalf("Expected label %d at (%d,%d), got %d\n", expectedLabel(x, y), x, y, label)
+			}
+		}
+	}
+
+	// Downsampled projections are PNGs with black background.
+	w = serve("GET", "projection/xy/40_40/0_0_0/8?scale=2&colormap=hash", nil)
+	if w.Code != http.StatusOK || w.HeaderMap.Get("Content-Type") != "image/png" {
+		t.Fatalf("Bad colormapped projection response: %d %s\n", w.Code, w.Body.String())
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to decode projection PNG: %s\n", err.Error())
+	}
+	if img.Bounds().Dx() != 10 || img.Bounds().Dy() != 10 {
+		t.Errorf("Expected 10 x 10 projection at scale 2, got %v\n", img.Bounds())
+	}
+	if r, g, b, _ := img.At(9, 9).RGBA(); r != 0 || g != 0 || b != 0 {
+		t.Errorf("Expected black pixel for background, got (%d,%d,%d)\n", r, g, b)
+	}
+	if img.At(0, 0) == img.At(9, 0) {
+		t.Errorf("Expected different colors for labels 5 and 7\n")
+	}
+
+	for _, bad := range []string{"projection/xz/40_40/0_0_0/8", "projection/xy/40_40/0_0_0/0", "projection/xy/40_40/0_0_0/8?scale=11"} {
+		if w := serve("GET", bad, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d\n", bad, w.Code)
+		}
+	}
+
+	// Synchronous projections are refused while the throttle is exhausted, but asynchronous
+	// ones wait for it.
+	var held int
+	for held < server.MaxThrottledOps {
+		<-server.Throttle
+		held++
+	}
+	if w := serve("GET", "projection/xy/40_40/0_0_0/8", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for projection while throttled, got %d\n", w.Code)
+	}
+	w = serve("GET", "projection/xy/40_40/0_0_0/8?async=true", nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 for async projection, got %d %s\n", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	i := strings.Index(body, `"id":"`)
+	if i < 0 {
+		t.Fatalf("No job id in async projection response %q\n", body)
+	}
+	id := body[i+6:]
+	id = id[:strings.Index(id, `"`)]
+	if w := serve("GET", "projection-job/"+id, nil); w.Code != http.StatusAccepted {
+		t.Errorf("Expected running status for throttled job, got %d\n", w.Code)
+	}
+	for ; held > 0; held-- {
+		server.Throttle <- 1
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		w = serve("GET", "projection-job/"+id, nil)
+		if w.Code != http.StatusAccepted || time.Since(start) > 10*time.Second {
+			break
+		}
+	}
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), raw) {
+		t.Errorf("Expected async projection to match synchronous one, got %d with %d bytes\n", w.Code, w.Body.Len())
+	}
+	if w := serve("GET", "projection-job/unknown", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown projection job, got %d\n", w.Code)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+	This file supports freezing a labels64 instance against all modifications, e.g., after
+	a segmentation is released, independent of whether version nodes are locked.
+*/
+
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+)
+
+// checkWritable returns a read-only error if the data has been frozen.
+func (d *Data) checkWritable() error {
+	if d.ReadOnly {
+		return server.NewError(server.ReadOnlyError, "labels64 %q is read-only", d.DataName())
+	}
+	return nil
+}
+
+// setReadOnly freezes or unfreezes the data and saves the change to the repo.
+func (d *Data) setReadOnly(repo datastore.Repo, readOnly bool) error {
+	d.ReadOnly = readOnly
+	if err := repo.Save(); err != nil {
+		return err
+	}
+	if readOnly {
+		dvid.Infof("labels64 %q is now read-only\n", d.DataName())
+	} else {
+		dvid.Infof("labels64 %q is now writable\n", d.DataName())
+	}
+	return nil
+}
+
+// serveReadOnly handles GET and administrative POST requests on the read-only flag.
+func (d *Data) serveReadOnly(repo datastore.Repo, w http.ResponseWriter, r *http.Request, requestID string) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if !server.IsAdmin(r) {
+			err := fmt.Errorf("Changing read-only flag of %q requires the %s header with the server's admin token",
+				d.DataName(), server.AdminTokenHeader)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			dvid.Errorf("ERROR [%s]: %s (%s).", requestID, err.Error(), r.URL.Path)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		var flag struct {
+			ReadOnly *bool `json:"readonly"`
+		}
+		if err := json.Unmarshal(data, &flag); err != nil || flag.ReadOnly == nil {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Expected JSON like {\"readonly\": true}, got %q", string(data)))
+			return
+		}
+		if err := d.setReadOnly(repo, *flag.ReadOnly); err != nil {
+			server.ErrorResponse(w, r, requestID, server.NewError(server.StorageError, "%s", err.Error()))
+			return
+		}
+	default:
+		server.ErrorResponse(w, r, requestID, fmt.Errorf("readonly endpoint does not accept %s", r.Method))
+		return
+	}
+	jsonBytes, err := json.Marshal(struct {
+		ReadOnly bool `json:"readonly"`
+	}{d.ReadOnly})
+	if err != nil {
+		server.ErrorResponse(w, r, requestID, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,117 @@
+package labels64
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/client"
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestReadOnly(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 1000, "bodies", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewServerContext(context.Background(), repo, versionID)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.ServeHTTP(ctx, w, r)
+	}))
+	defer ts.Close()
+
+	postReadOnly := func(token string) *http.Response {
+		r, _ := http.NewRequest("POST", fmt.Sprintf("%s/api/node/%s/bodies/readonly", ts.URL, uuid), strings.NewReader(`{"readonly": true}`))
+		if token != "" {
+			r.Header.Set(server.AdminTokenHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("Unable to POST readonly: %s\n", err.Error())
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Only admins can change the flag over HTTP.
+	if resp := postReadOnly(""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for readonly request without admin token, got %d\n", resp.StatusCode)
+	}
+	server.SetAdminToken("secret")
+	defer server.SetAdminToken("")
+	if resp := postReadOnly("wrong"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for readonly request with wrong token, got %d\n", resp.StatusCode)
+	}
+	if d.ReadOnly {
+		t.Fatalf("Non-admin request froze data\n")
+	}
+	if resp := postReadOnly("secret"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected admin to freeze data, got %d\n", resp.StatusCode)
+	}
+	if !d.ReadOnly {
+		t.Fatalf("Admin request did not freeze data\n")
+	}
+
+	// Every modification is refused with a readonly error.
+	checkRefused := func(route string, err error) {
+		if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusForbidden || e.Kind != "readonly" {
+			t.Errorf("Expected %s to be refused with readonly error, got %v\n", route, err)
+		}
+	}
+	err = client.Merge(ts.URL, string(uuid), "bodies", [][]uint64{{1, 2}}, nil)
+	checkRefused("merge", err)
+	_, err = client.Split(ts.URL, string(uuid), "bodies", dvid.RLEs{dvid.NewRLE(dvid.Point3d{0, 0, 0}, 10)})
+	checkRefused("split", err)
+	for _, endpoint := range []string{"raw/0_1_2/2_2_2/0_0_0", "annotation/1"} {
+		r, _ := http.NewRequest("POST", fmt.Sprintf("/api/node/%s/bodies/%s", uuid, endpoint), bytes.NewReader(make([]byte, 64)))
+		w := httptest.NewRecorder()
+		d.ServeHTTP(ctx, w, r)
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"kind":"readonly"`) {
+			t.Errorf("Expected POST %s to be refused with readonly error, got %d: %s\n", endpoint, w.Code, w.Body.String())
+		}
+	}
+	storeCtx := datastore.NewVersionedContext(d, versionID)
+	if _, err := d.MergeLabels(storeCtx, MergeTuples{{1, 2}}, MergeOptions{Target: TargetFirst}); server.ErrorKindOf(err) != server.ReadOnlyError {
+		t.Errorf("Expected MergeLabels to be refused, got %v\n", err)
+	}
+	if err := d.PutAnnotation(versionID, 1, Annotation{}); server.ErrorKindOf(err) != server.ReadOnlyError {
+		t.Errorf("Expected PutAnnotation to be refused, got %v\n", err)
+	}
+	load := datastore.Request{Command: dvid.Command{"node", string(uuid), "bodies", "load", "0,0,0", "*.png"}}
+	if err := d.DoRPC(load, &datastore.Response{}); server.ErrorKindOf(err) != server.ReadOnlyError {
+		t.Errorf("Expected load command to be refused, got %v\n", err)
+	}
+
+	// Reads keep working and report the flag.
+	if _, err := client.GetSparseVol(ts.URL, string(uuid), "bodies", 1, nil, false); err != nil {
+		t.Errorf("Expected sparsevol to work on read-only data, got %s\n", err.Error())
+	}
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/api/node/%s/bodies/info", uuid), nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(ctx, w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ReadOnly":true`) {
+		t.Errorf("Expected info to report read-only flag, got %d: %s\n", w.Code, w.Body.String())
+	}
+
+	// The command line can unfreeze the data without an admin token.
+	unfreeze := datastore.Request{Command: dvid.Command{"node", string(uuid), "bodies", "readonly", "false"}}
+	if err := d.DoRPC(unfreeze, &datastore.Response{}); err != nil {
+		t.Fatalf("Unable to unfreeze data: %s\n", err.Error())
+	}
+	if d.checkWritable() != nil {
+		t.Errorf("Expected data to be writable after readonly command\n")
+	}
+}
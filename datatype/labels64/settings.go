@@ -0,0 +1,489 @@
+/*
+	This file declares the configuration settings of labels64 data, which are used to
+	validate settings on creation and modification and to report them, and the typed
+	settings they're parsed into.
+*/
+
+package labels64
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/keyvalue"
+	"github.com/janelia-flyem/dvid/datatype/roi"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// settings is the schema for labels64 configuration.  The voxel settings are modifiable
+// because voxels data allows their modification.
+var settings = dvid.Settings{
+	{
+		Name:    "LabelType",
+		Type:    dvid.SettingString,
+		Default: "standard",
+		Help:    `Either "standard" or "raveler".`,
+		Validate: func(value string) error {
+			switch strings.ToLower(value) {
+			case "standard", "raveler":
+				return nil
+			default:
+				return fmt.Errorf("unknown label type %q", value)
+			}
+		},
+	},
+	{
+		Name:    "StrictMerge",
+		Type:    dvid.SettingBool,
+		Default: "false",
+		Help:    "If true, merges fail when any label doesn't exist.",
+	},
+	{
+		Name:    "AllowForce",
+		Type:    dvid.SettingBool,
+		Default: "false",
+		Help:    `If true, merges with "force=true" may modify locked nodes.`,
+	},
+	{
+		Name:    "ReadOnly",
+		Type:    dvid.SettingBool,
+		Default: "false",
+		Help:    `If true, the data is created frozen.  Afterwards, use the "readonly" command or endpoint.`,
+	},
+	{
+		Name:       "Annotations",
+		Type:       dvid.SettingString,
+		Modifiable: true,
+		Help:       "Name of a keyvalue instance holding JSON object annotations keyed by label.",
+	},
+	{
+		Name:       "MaxPostBytes",
+		Type:       dvid.SettingInt,
+		Default:    strconv.Itoa(DefaultMaxPostBytes),
+		Modifiable: true,
+		Help:       "Largest POSTed merge, split, or annotation payload in bytes, or 0 for the default.",
+		Validate: func(value string) error {
+			if n, _ := strconv.Atoi(value); n < 0 {
+				return fmt.Errorf("limit %d can't be negative", n)
+			}
+			return nil
+		},
+	},
+	{
+		Name:       "OpKeyWindow",
+		Type:       dvid.SettingDuration,
+		Default:    DefaultOpKeyWindow.String(),
+		Modifiable: true,
+		Help:       "How long results of operations with idempotency keys are kept, or 0 for the default.",
+		Validate: func(value string) error {
+			if window, _ := time.ParseDuration(value); window < 0 {
+				return fmt.Errorf("window %s can't be negative", window)
+			}
+			return nil
+		},
+	},
+	{
+		Name:       "MaxMutations",
+		Type:       dvid.SettingInt,
+		Default:    strconv.Itoa(DefaultMaxMutations),
+		Modifiable: true,
+		Help:       "Maximum concurrent merges, splits, repairs, and annotation POSTs, or 0 for the default.",
+		Validate:   validateLimit,
+	},
+	{
+		Name:       "MaxLargeReads",
+		Type:       dvid.SettingInt,
+		Default:    strconv.Itoa(DefaultMaxLargeReads),
+		Modifiable: true,
+		Help:       "Maximum concurrent sparse volume, surface, adjacency, and projection requests, or 0 for the default.",
+		Validate:   validateLimit,
+	},
+	{
+		Name:       "MaxSmallReads",
+		Type:       dvid.SettingInt,
+		Default:    strconv.Itoa(DefaultMaxSmallReads),
+		Modifiable: true,
+		Help:       "Maximum concurrent label, size, mapping, and annotation GETs, or 0 for the default.",
+		Validate:   validateLimit,
+	},
+	{
+		Name:       "MaxQueueWait",
+		Type:       dvid.SettingDuration,
+		Default:    DefaultMaxQueueWait.String(),
+		Modifiable: true,
+		Help:       "How long requests wait when their concurrency class is at its maximum, or 0 for the default.",
+		Validate: func(value string) error {
+			if wait, _ := time.ParseDuration(value); wait < 0 {
+				return fmt.Errorf("wait %s can't be negative", wait)
+			}
+			return nil
+		},
+	},
+	{
+		Name:       "DedupRLEs",
+		Type:       dvid.SettingBool,
+		Default:    "false",
+		Modifiable: true,
+		Help:       "If true, RLEs of blocks filled by a label, completely or by half, are stored as sentinels.",
+	},
+	{
+		Name:       "MergeGuardROI",
+		Type:       dvid.SettingString,
+		Modifiable: true,
+		Help:       "Comma-separated names of roi instances giving compartments that merges may not cross.",
+		Validate:   validateMergeGuardROI,
+	},
+	{
+		Name:       "Journal",
+		Type:       dvid.SettingBool,
+		Default:    "false",
+		Modifiable: true,
+		Help:       "If true, each merge's changes to label block RLEs are journaled with a hash of the prior RLEs.",
+	},
+	{
+		Name:       "JournalValues",
+		Type:       dvid.SettingBool,
+		Default:    "false",
+		Modifiable: true,
+		Help:       "If true, journal entries also keep the prior RLEs until the journal retention period passes.",
+	},
+	{
+		Name:       "JournalRetention",
+		Type:       dvid.SettingDuration,
+		Default:    DefaultJournalRetention.String(),
+		Modifiable: true,
+		Help:       "How long journal entries keep prior RLEs, or 0 for the default.",
+		Validate: func(value string) error {
+			if retention, _ := time.ParseDuration(value); retention < 0 {
+				return fmt.Errorf("retention %s can't be negative", retention)
+			}
+			return nil
+		},
+	},
+	{
+		Name:       "TrashRetention",
+		Type:       dvid.SettingDuration,
+		Default:    DefaultTrashRetention.String(),
+		Modifiable: true,
+		Help:       "How long trashed labels are kept before they are purged, or 0 for the default.",
+		Validate: func(value string) error {
+			if retention, _ := time.ParseDuration(value); retention < 0 {
+				return fmt.Errorf("retention %s can't be negative", retention)
+			}
+			return nil
+		},
+	},
+	{
+		Name:       "MergeConflict",
+		Type:       dvid.SettingString,
+		Default:    MergeConflictFail,
+		Modifiable: true,
+		Help:       `Either "fail" or "last-writer-wins" for merges whose blocks are changed by concurrent writes.`,
+		Validate:   validateMergeConflict,
+	},
+	{
+		Name:       "MergeRetries",
+		Type:       dvid.SettingInt,
+		Default:    strconv.Itoa(DefaultMergeRetries),
+		Modifiable: true,
+		Help:       "How many times blocks changed by concurrent writes are recombined before a merge fails, or 0 for the default.",
+		Validate:   validateLimit,
+	},
+	{
+		Name:       "BlockSize",
+		Type:       dvid.SettingString,
+		Default:    fmt.Sprintf("%d,%d,%d", voxels.DefaultBlockSize, voxels.DefaultBlockSize, voxels.DefaultBlockSize),
+		Modifiable: true,
+		Help:       "Size of blocks in voxels along each dimension.",
+		Validate:   validateBlockSize,
+	},
+	{
+		Name:       "VoxelSize",
+		Type:       dvid.SettingString,
+		Default:    "8,8,8",
+		Modifiable: true,
+		Help:       "Resolution of voxels along each dimension.",
+		Validate: func(value string) error {
+			_, err := dvid.StringToNdFloat32(value, ",")
+			return err
+		},
+	},
+	{
+		Name:       "VoxelUnits",
+		Type:       dvid.SettingString,
+		Default:    "nanometers,nanometers,nanometers",
+		Modifiable: true,
+		Help:       "Resolution units along each dimension.",
+	},
+	{
+		Name:       "Background",
+		Type:       dvid.SettingInt,
+		Default:    "0",
+		Modifiable: true,
+		Help:       "Value of voxels outside stored blocks.",
+		Validate: func(value string) error {
+			_, err := strconv.ParseUint(value, 10, 8)
+			return err
+		},
+	},
+}
+
+// validateBlockSize checks that a block size is 3d with positive sizes, which the label
+// indices require.
+func validateBlockSize(value string) error {
+	size, err := dvid.StringToPoint(value, ",")
+	if err != nil {
+		return err
+	}
+	if size.NumDims() != 3 {
+		return fmt.Errorf("block size %q must be 3d", value)
+	}
+	for dim := uint8(0); dim < 3; dim++ {
+		if size.Value(dim) <= 0 {
+			return fmt.Errorf("block size %q must be positive", value)
+		}
+	}
+	return nil
+}
+
+// validateLimit checks that a limit isn't negative.
+func validateLimit(value string) error {
+	if n, _ := strconv.Atoi(value); n < 0 {
+		return fmt.Errorf("limit %d can't be negative", n)
+	}
+	return nil
+}
+
+// Settings are the labels64 settings of data beyond those of voxels data.  They're
+// parsed from a configuration by Parse.
+type Settings struct {
+	Labeling LabelType
+
+	// StrictMerge is the default for whether merges refuse labels that don't exist.
+	StrictMerge bool
+
+	// AllowForce permits merges with "force=true" to modify locked version nodes.
+	AllowForce bool
+
+	// Annotations is the name of a keyvalue instance holding label annotations or empty if
+	// there are none.
+	Annotations dvid.DataString
+
+	// MaxPostBytes is the largest POSTed payload accepted or 0 for DefaultMaxPostBytes.
+	MaxPostBytes int64
+
+	// ReadOnly freezes the data against all modifications regardless of node locks.
+	ReadOnly bool
+
+	// OpKeyWindow is how long results of operations with idempotency keys are kept or 0
+	// for DefaultOpKeyWindow.
+	OpKeyWindow time.Duration
+
+	// MaxMutations, MaxLargeReads, and MaxSmallReads are the maximum numbers of concurrent
+	// requests of each concurrency class, or 0 for the defaults.  MaxQueueWait is how long
+	// requests of a saturated class wait for a slot, or 0 for DefaultMaxQueueWait.
+	MaxMutations  int
+	MaxLargeReads int
+	MaxSmallReads int
+	MaxQueueWait  time.Duration
+
+	// DedupRLEs stores the RLEs of blocks filled by a label, completely or by half, as
+	// sentinels.
+	DedupRLEs bool
+
+	// MergeGuardROI is a comma-separated list of roi instances giving compartments that
+	// merges may not cross, or empty if merges aren't guarded.
+	MergeGuardROI string
+
+	// Journal records each merge's changes to label block RLEs with a hash of the prior
+	// RLEs, which are also kept if JournalValues is true.  JournalRetention is how long
+	// prior RLEs are kept or 0 for DefaultJournalRetention.
+	Journal          bool
+	JournalValues    bool
+	JournalRetention time.Duration
+
+	// TrashRetention is how long trashed labels are kept or 0 for DefaultTrashRetention.
+	TrashRetention time.Duration
+
+	// MergeConflict is the policy for merges whose blocks are changed by concurrent writes,
+	// MergeConflictFail if empty.  MergeRetries is how many times those blocks are
+	// recombined before the merge fails or 0 for DefaultMergeRetries.
+	MergeConflict string
+	MergeRetries  int
+}
+
+// Parse checks a configuration against the settings schema and sets the settings it
+// gives, leaving the others unchanged, so it parses both the configuration of new data
+// and, if modifying is true, changes to existing data.  If getData isn't nil, it looks up
+// instances of the repo, and the instances named by the settings must exist with the
+// right datatypes.  The settings are unchanged if there's an error.
+func (s *Settings) Parse(c dvid.Config, modifying bool, getData func(dvid.DataString) (datastore.DataService, error)) error {
+	if err := settings.Check(c, modifying); err != nil {
+		return err
+	}
+	parsed := *s
+	labelType, found, err := c.GetString("LabelType")
+	if err != nil {
+		return err
+	}
+	if found {
+		parsed.Labeling = Standard64bit
+		if strings.ToLower(labelType) == "raveler" {
+			parsed.Labeling = RavelerLabel
+		}
+	}
+	annotations, found, err := c.GetString("Annotations")
+	if err != nil {
+		return err
+	}
+	if found {
+		parsed.Annotations = dvid.DataString(annotations)
+	}
+	mergeGuardROI, found, err := c.GetString("MergeGuardROI")
+	if err != nil {
+		return err
+	}
+	if found {
+		parsed.MergeGuardROI = mergeGuardROI
+	}
+	mergeConflict, found, err := c.GetString("MergeConflict")
+	if err != nil {
+		return err
+	}
+	if found {
+		parsed.MergeConflict = strings.ToLower(mergeConflict)
+	}
+	maxPostBytes, found, err := c.GetInt("MaxPostBytes")
+	if err != nil {
+		return err
+	}
+	if found {
+		parsed.MaxPostBytes = int64(maxPostBytes)
+	}
+	for name, setting := range map[string]*bool{
+		"StrictMerge":   &parsed.StrictMerge,
+		"AllowForce":    &parsed.AllowForce,
+		"ReadOnly":      &parsed.ReadOnly,
+		"DedupRLEs":     &parsed.DedupRLEs,
+		"Journal":       &parsed.Journal,
+		"JournalValues": &parsed.JournalValues,
+	} {
+		value, found, err := c.GetBool(name)
+		if err != nil {
+			return err
+		}
+		if found {
+			*setting = value
+		}
+	}
+	for name, setting := range map[string]*int{
+		"MaxMutations":  &parsed.MaxMutations,
+		"MaxLargeReads": &parsed.MaxLargeReads,
+		"MaxSmallReads": &parsed.MaxSmallReads,
+		"MergeRetries":  &parsed.MergeRetries,
+	} {
+		value, found, err := c.GetInt(name)
+		if err != nil {
+			return err
+		}
+		if found {
+			*setting = value
+		}
+	}
+	for name, setting := range map[string]*time.Duration{
+		"OpKeyWindow":      &parsed.OpKeyWindow,
+		"MaxQueueWait":     &parsed.MaxQueueWait,
+		"JournalRetention": &parsed.JournalRetention,
+		"TrashRetention":   &parsed.TrashRetention,
+	} {
+		value, found, err := c.GetString(name)
+		if err != nil {
+			return err
+		}
+		if found {
+			if *setting, err = time.ParseDuration(value); err != nil {
+				return err
+			}
+		}
+	}
+	if getData != nil {
+		if err := parsed.checkReferences(getData); err != nil {
+			return err
+		}
+	}
+	*s = parsed
+	return nil
+}
+
+// checkReferences checks that the annotations and guard ROI settings name instances of the
+// right datatypes.
+func (s *Settings) checkReferences(getData func(dvid.DataString) (datastore.DataService, error)) error {
+	if s.Annotations != "" {
+		if err := checkReference(getData, "Annotations", s.Annotations, keyvalue.TypeName); err != nil {
+			return err
+		}
+	}
+	for _, name := range s.mergeGuardROIs() {
+		if err := checkReference(getData, "MergeGuardROI", name, roi.TypeName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReference checks that a setting names an instance of a datatype.
+func checkReference(getData func(dvid.DataString) (datastore.DataService, error), setting string,
+	name dvid.DataString, typename dvid.TypeString) error {
+
+	dataservice, err := getData(name)
+	if err != nil || dataservice == nil {
+		return fmt.Errorf("Bad %q setting: no data instance %q", setting, name)
+	}
+	if dataservice.TypeName() != typename {
+		return fmt.Errorf("Bad %q setting: %q is %s data, not %s", setting, name, dataservice.TypeName(), typename)
+	}
+	return nil
+}
+
+// CheckReferences checks that the instances named by the settings exist in the repo with
+// the right datatypes.  It implements datastore.ReferenceChecker.
+func (d *Data) CheckReferences(getData func(dvid.DataString) (datastore.DataService, error)) error {
+	return d.Settings.checkReferences(getData)
+}
+
+// settingValues returns the current values of the instance's settings by name.
+func (d *Data) settingValues() map[string]interface{} {
+	labelType := "standard"
+	if d.Labeling == RavelerLabel {
+		labelType = "raveler"
+	}
+	return map[string]interface{}{
+		"LabelType":        labelType,
+		"StrictMerge":      d.StrictMerge,
+		"AllowForce":       d.AllowForce,
+		"ReadOnly":         d.ReadOnly,
+		"Annotations":      string(d.Annotations),
+		"MaxPostBytes":     d.maxPostBytes(),
+		"OpKeyWindow":      d.opKeyWindow().String(),
+		"MaxMutations":     d.maxConcurrency(MutationClass),
+		"MaxLargeReads":    d.maxConcurrency(LargeReadClass),
+		"MaxSmallReads":    d.maxConcurrency(SmallReadClass),
+		"MaxQueueWait":     d.maxQueueWait().String(),
+		"DedupRLEs":        d.DedupRLEs,
+		"MergeGuardROI":    d.MergeGuardROI,
+		"Journal":          d.Journal,
+		"JournalValues":    d.JournalValues,
+		"JournalRetention": d.journalRetention().String(),
+		"TrashRetention":   d.trashRetention().String(),
+		"MergeConflict":    d.mergeConflict(),
+		"MergeRetries":     d.mergeRetries(),
+		"BlockSize":        d.BlockSize(),
+		"VoxelSize":        d.Properties.Resolution.VoxelSize,
+		"VoxelUnits":       d.Properties.Resolution.VoxelUnits,
+		"Background":       d.Properties.Background,
+	}
+}
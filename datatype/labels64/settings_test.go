@@ -0,0 +1,210 @@
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/roi"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestSettings(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+
+	config := dvid.NewConfig()
+	config.Set("BlkSize", "16,16,16")
+	_, err := NewData(uuid, 400, "settinglabels", config)
+	if err == nil || !strings.Contains(err.Error(), "BlockSize") {
+		t.Errorf("Expected error listing accepted settings for misspelled setting, got %v\n", err)
+	}
+	for key, value := range map[string]string{"ReadOnly": "maybe", "LabelType": "rgb", "BlockSize": "a,b,c", "MaxPostBytes": "-1"} {
+		config := dvid.NewConfig()
+		config.Set(key, value)
+		if _, err := NewData(uuid, 400, "settinglabels", config); err == nil {
+			t.Errorf("Expected error for setting %s=%s\n", key, value)
+		}
+	}
+
+	config = dvid.NewConfig()
+	config.Set("BlockSize", "16,16,16")
+	config.Set("ReadOnly", "true")
+	config.Set("Annotations", "bodyannotations")
+	d, err := NewData(uuid, 400, "settinglabels", config)
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	if !d.ReadOnly || d.checkWritable() == nil {
+		t.Errorf("Expected data created read-only to be frozen\n")
+	}
+
+	// Read-only status can't be changed through settings, but annotations can.
+	config = dvid.NewConfig()
+	config.Set("ReadOnly", "false")
+	if err := d.ModifyConfig(config); err == nil || !strings.Contains(err.Error(), "can't be changed") {
+		t.Errorf("Expected error modifying read-only setting, got %v\n", err)
+	}
+	config = dvid.NewConfig()
+	config.Set("Annotations", "otherannotations")
+	if err := d.ModifyConfig(config); err != nil {
+		t.Fatalf("Unable to modify annotations: %s\n", err.Error())
+	}
+
+	ctx := datastore.NewServerContext(context.Background(), repo, versionID)
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/api/node/%s/settinglabels/settings", uuid), nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(ctx, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad status %d for settings: %s\n", w.Code, w.Body.String())
+	}
+	var got []dvid.SettingValue
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unable to decode settings: %s\n", err.Error())
+	}
+	values := make(map[string]interface{}, len(got))
+	for _, setting := range got {
+		values[setting.Name] = setting.Value
+	}
+	if values["ReadOnly"] != true || values["Annotations"] != "otherannotations" || values["LabelType"] != "standard" {
+		t.Errorf("Unexpected setting values: %v\n", values)
+	}
+	if values["MaxPostBytes"] != float64(DefaultMaxPostBytes) {
+		t.Errorf("Expected default payload limit, got %v\n", values["MaxPostBytes"])
+	}
+}
+
+func TestSettingsValidation(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	kvT, err := datastore.TypeServiceByName("keyvalue")
+	if err != nil {
+		t.Fatalf("Can't get keyvalue type: %s\n", err.Error())
+	}
+	if _, err := repo.NewData(kvT, "bodyannotations", dvid.NewConfig()); err != nil {
+		t.Fatalf("Unable to create keyvalue instance: %s\n", err.Error())
+	}
+	roiT, err := datastore.TypeServiceByName("roi")
+	if err != nil {
+		t.Fatalf("Can't get roi type: %s\n", err.Error())
+	}
+	dataservice, err := repo.NewData(roiT, "left", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create roi instance: %s\n", err.Error())
+	}
+	if err := dataservice.(*roi.Data).PutSpans(versionID, []dvid.Span{{0, 0, 0, 1}}, true); err != nil {
+		t.Fatalf("Unable to put roi: %s\n", err.Error())
+	}
+
+	for _, tc := range []struct {
+		key, value string
+		expected   string
+	}{
+		{"BlkSize", "16,16,16", `Unknown setting "blksize".  Accepted settings are: ` + strings.Join(settings.Names(false), ", ")},
+		{"LabelType", "rgb", `Bad "LabelType" setting: unknown label type "rgb"`},
+		{"BlockSize", "16,16", `Bad "BlockSize" setting: block size "16,16" must be 3d`},
+		{"BlockSize", "16,0,16", `Bad "BlockSize" setting: block size "16,0,16" must be positive`},
+		{"MaxPostBytes", "-1", `Bad "MaxPostBytes" setting: limit -1 can't be negative`},
+		{"MaxMutations", "-2", `Bad "MaxMutations" setting: limit -2 can't be negative`},
+		{"OpKeyWindow", "-1s", `Bad "OpKeyWindow" setting: window -1s can't be negative`},
+		{"MaxQueueWait", "-1m", `Bad "MaxQueueWait" setting: wait -1m0s can't be negative`},
+		{"JournalRetention", "-1h", `Bad "JournalRetention" setting: retention -1h0m0s can't be negative`},
+		{"TrashRetention", "-1h", `Bad "TrashRetention" setting: retention -1h0m0s can't be negative`},
+		{"Background", "256", `Bad "Background" setting: strconv.ParseUint: parsing "256": value out of range`},
+		{"MergeGuardROI", "left,,right", `Bad "MergeGuardROI" setting: empty ROI name in "left,,right"`},
+		{"Annotations", "missing", `Bad "Annotations" setting: no data instance "missing"`},
+		{"Annotations", "left", `Bad "Annotations" setting: "left" is roi data, not keyvalue`},
+		{"MergeGuardROI", "left, missing", `Bad "MergeGuardROI" setting: no data instance "missing"`},
+		{"MergeGuardROI", "bodyannotations", `Bad "MergeGuardROI" setting: "bodyannotations" is keyvalue data, not roi`},
+	} {
+		config := dvid.NewConfig()
+		config.Set(tc.key, tc.value)
+		var s Settings
+		if err := s.Parse(config, false, repo.GetDataByName); err == nil || err.Error() != tc.expected {
+			t.Errorf("Expected error for %s=%s:\n  %s\ngot:\n  %v\n", tc.key, tc.value, tc.expected, err)
+		}
+		if s != (Settings{}) {
+			t.Errorf("Expected settings unchanged by bad %s=%s, got %+v\n", tc.key, tc.value, s)
+		}
+	}
+
+	// Instances named by the settings are checked when data is created in a repo.
+	config := dvid.NewConfig()
+	config.Set("Annotations", "missing")
+	d, err := NewData(uuid, 460, "checkedlabels", config)
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	var checker datastore.ReferenceChecker = d
+	expectedErr := `Bad "Annotations" setting: no data instance "missing"`
+	if err := checker.CheckReferences(repo.GetDataByName); err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected error %q checking references, got %v\n", expectedErr, err)
+	}
+
+	config = dvid.NewConfig()
+	config.Set("LabelType", "raveler")
+	config.Set("Annotations", "bodyannotations")
+	config.Set("MergeGuardROI", "left")
+	config.Set("MaxQueueWait", "5s")
+	config.Set("Journal", "true")
+	if d, err = NewData(uuid, 461, "checkedlabels", config); err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	if err := d.CheckReferences(repo.GetDataByName); err != nil {
+		t.Errorf("Unexpected error checking references: %s\n", err.Error())
+	}
+	expected := Settings{Labeling: RavelerLabel, Annotations: "bodyannotations", MergeGuardROI: "left",
+		MaxQueueWait: 5 * time.Second, Journal: true}
+	if d.Settings != expected {
+		t.Errorf("Expected settings %+v, got %+v\n", expected, d.Settings)
+	}
+
+	// Bad modifications through the settings endpoint are rejected without changing any setting.
+	for body, message := range map[string]string{
+		`{"DedupRLEs": "true", "Annotations": "missing"}`:           `Bad "Annotations" setting: no data instance "missing"`,
+		`{"DedupRLEs": "true", "MergeGuardROI": "bodyannotations"}`: `Bad "MergeGuardROI" setting: "bodyannotations" is keyvalue data, not roi`,
+		`{"DedupRLEs": "true", "LabelType": "standard"}`:            `Setting "LabelType" can't be changed after creation`,
+	} {
+		r, _ := http.NewRequest("POST", fmt.Sprintf("/api/node/%s/checkedlabels/settings", uuid), strings.NewReader(body))
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+		var response struct {
+			Error string `json:"error"`
+			Kind  string `json:"kind"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Errorf("Bad error response for %s: %s\n", body, w.Body.String())
+		}
+		if w.Code != http.StatusBadRequest || response.Kind != "bad-request" || !strings.Contains(response.Error, message) {
+			t.Errorf("Expected 400 with %s for %s, got %d: %s\n", message, body, w.Code, w.Body.String())
+		}
+	}
+	if d.Settings != expected {
+		t.Errorf("Expected rejected modifications to leave settings %+v, got %+v\n", expected, d.Settings)
+	}
+	config = dvid.NewConfig()
+	config.Set("DedupRLEs", "true")
+	config.Set("Annotations", "")
+	if err := d.modifyConfig(config, repo.GetDataByName); err != nil {
+		t.Fatalf("Unable to modify settings: %s\n", err.Error())
+	}
+	expected.DedupRLEs = true
+	expected.Annotations = ""
+	if d.Settings != expected {
+		t.Errorf("Expected settings %+v, got %+v\n", expected, d.Settings)
+	}
+}
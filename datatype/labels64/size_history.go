@@ -0,0 +1,233 @@
+/*
+	This file supports the history of label sizes across the version DAG.  A size record
+	is stored for each version where a label's size changes, so the size of a label at any
+	ancestor can be found by walking up the version DAG.
+*/
+
+package labels64
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// SizeRecord gives the size of a label at a version.  The Op is the operation that
+// set the size at that version, e.g., "merge" or "backfill", and is empty if the size
+// was inherited from an ancestor.
+type SizeRecord struct {
+	UUID dvid.UUID `json:"uuid"`
+	Size uint64    `json:"size"`
+	Op   string    `json:"op"`
+}
+
+// sizeEntry is a stored size record, which notes the version it was written so
+// entries inherited from ancestors can be detected.
+type sizeEntry struct {
+	version dvid.VersionID
+	size    uint64
+	op      string
+}
+
+func (e sizeEntry) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, dvid.VersionIDSize+8+len(e.op))
+	copy(buf[0:dvid.VersionIDSize], e.version.Bytes())
+	binary.LittleEndian.PutUint64(buf[dvid.VersionIDSize:dvid.VersionIDSize+8], e.size)
+	copy(buf[dvid.VersionIDSize+8:], e.op)
+	return buf, nil
+}
+
+func (e *sizeEntry) UnmarshalBinary(b []byte) error {
+	if len(b) < dvid.VersionIDSize+8 {
+		return fmt.Errorf("Size history record has only %d bytes", len(b))
+	}
+	e.version = dvid.VersionIDFromBytes(b[0:dvid.VersionIDSize])
+	e.size = binary.LittleEndian.Uint64(b[dvid.VersionIDSize : dvid.VersionIDSize+8])
+	e.op = string(b[dvid.VersionIDSize+8:])
+	return nil
+}
+
+// putSizeHistory adds size records for the given labels at the context's version to a batch.
+func putSizeHistory(batch storage.Batch, ctx *datastore.VersionedContext, sizes map[uint64]uint64, op string) error {
+	for label, size := range sizes {
+		entry := sizeEntry{ctx.VersionID(), size, op}
+		serialization, err := entry.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		batch.Put(voxels.NewLabelSizeHistoryIndex(label), serialization)
+	}
+	return nil
+}
+
+// ancestry returns the versions from the context's version back to the root.
+func ancestry(ctx *datastore.VersionedContext) ([]dvid.VersionID, error) {
+	it, err := ctx.GetIterator()
+	if err != nil {
+		return nil, err
+	}
+	var versions []dvid.VersionID
+	for ; it.Valid(); it.Next() {
+		versions = append(versions, it.VersionID())
+	}
+	return versions, nil
+}
+
+// GetSizeHistory returns the sizes of a label from the context's version back to the root.
+// Versions where the label didn't change inherit the size of their ancestor, and versions
+// before the label's first size record are omitted.
+func (d *Data) GetSizeHistory(ctx *datastore.VersionedContext, label uint64) ([]SizeRecord, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	versions, err := ancestry(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the records from the root down so sizes can be inherited.
+	index := voxels.NewLabelSizeHistoryIndex(label)
+	history := []SizeRecord{}
+	var last *SizeRecord
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		uuid, err := datastore.UUIDFromVersion(v)
+		if err != nil {
+			return nil, err
+		}
+		value, err := smalldata.Get(datastore.NewVersionedContext(d, v), index)
+		if err != nil {
+			return nil, err
+		}
+		var record SizeRecord
+		if value != nil {
+			var entry sizeEntry
+			if err := entry.UnmarshalBinary(value); err != nil {
+				return nil, err
+			}
+			if entry.version == v {
+				record = SizeRecord{uuid, entry.size, entry.op}
+			} else {
+				record = SizeRecord{uuid, entry.size, ""}
+			}
+		} else if last != nil {
+			record = SizeRecord{uuid, last.Size, ""}
+		} else {
+			continue
+		}
+		history = append(history, record)
+		last = &history[len(history)-1]
+	}
+
+	// Return the history starting with the requested version.
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return history, nil
+}
+
+// getAllLabelSizes returns the sizes of all labels at a version by scanning their RLEs.
+func getAllLabelSizes(ctx *datastore.VersionedContext) (map[uint64]uint64, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	begIndex := voxels.NewLabelSpatialMapIndex(0, dvid.MinIndexZYX.Bytes())
+	endIndex := voxels.NewLabelSpatialMapIndex(math.MaxUint64, dvid.MaxIndexZYX.Bytes())
+
+	sizes := make(map[uint64]uint64)
+	var f storage.ChunkProcessor = func(chunk *storage.Chunk) error {
+		label, _, err := voxels.DecodeLabelSpatialMapKey(chunk.K)
+		if err != nil {
+			return fmt.Errorf("Can't recover label with chunk key %v: %s\n", chunk.K, err.Error())
+		}
+		value, err := expandStoredRLEs(ctx, chunk.K, chunk.V)
+		if err != nil {
+			return err
+		}
+		var rles dvid.RLEs
+		if err := rles.UnmarshalBinary(value); err != nil {
+			return fmt.Errorf("Unable to unmarshal RLE for label in block %v", chunk.K)
+		}
+		numVoxels, _ := rles.Stats()
+		sizes[label] += uint64(numVoxels)
+		return nil
+	}
+	if err := smalldata.ProcessRange(ctx, begIndex, endIndex, &storage.ChunkOp{}, f); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// BackfillSizeHistory scans the RLEs of the context's version and each ancestor, adding
+// size records with a "backfill" op wherever a label's size differs from its parent's.
+// Versions that already have a record for a label are not modified.
+func (d *Data) BackfillSizeHistory(ctx *datastore.VersionedContext) error {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	smallBatcher, ok := smalldata.(storage.KeyValueBatcher)
+	if !ok {
+		return fmt.Errorf("Database doesn't support Batch ops in BackfillSizeHistory()")
+	}
+	versions, err := ancestry(ctx)
+	if err != nil {
+		return err
+	}
+
+	timedLog := dvid.NewTimeLog()
+	var numRecords int
+	parentSizes := make(map[uint64]uint64)
+	for i := len(versions) - 1; i >= 0; i-- {
+		vctx := datastore.NewVersionedContext(d, versions[i])
+		sizes, err := getAllLabelSizes(vctx)
+		if err != nil {
+			return err
+		}
+
+		// Labels that disappeared since the parent now have zero size.
+		for label := range parentSizes {
+			if _, found := sizes[label]; !found {
+				sizes[label] = 0
+			}
+		}
+		changed := make(map[uint64]uint64)
+		for label, size := range sizes {
+			if parentSize, found := parentSizes[label]; found && parentSize == size {
+				continue
+			}
+			value, err := smalldata.Get(vctx, voxels.NewLabelSizeHistoryIndex(label))
+			if err != nil {
+				return err
+			}
+			if value != nil {
+				var entry sizeEntry
+				if err := entry.UnmarshalBinary(value); err != nil {
+					return err
+				}
+				if entry.version == versions[i] {
+					continue
+				}
+			}
+			changed[label] = size
+		}
+		batch := smallBatcher.NewBatch(vctx)
+		if err := putSizeHistory(batch, vctx, changed, "backfill"); err != nil {
+			return err
+		}
+		if err := batch.Commit(); err != nil {
+			return fmt.Errorf("Error on backfilling size history on %s: %s", vctx, err.Error())
+		}
+		numRecords += len(changed)
+		parentSizes = sizes
+	}
+	timedLog.Infof("Backfilled %d label size records across %d versions", numRecords, len(versions))
+	return nil
+}
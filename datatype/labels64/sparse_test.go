@@ -6,13 +6,25 @@ package labels64
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/client"
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
 	"github.com/janelia-flyem/dvid/dvid"
 	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
 	"github.com/janelia-flyem/dvid/tests"
 )
 
@@ -28,6 +40,35 @@ func TestBaseAddMerge(t *testing.T) {
 	}
 }
 
+func TestSelectTargets(t *testing.T) {
+	sizes := map[uint64]uint64{1: 100, 2: 500, 3: 500, 4: 20, 5: 0}
+	tuples := MergeTuples{
+		{4, 1, 3, 2}, // tie in largest size between 2 and 3
+		{5, 4, 1},    // missing label 5 is never a target
+		{6, 5},       // all labels missing
+	}
+	tests := []struct {
+		mode     string
+		expected MergeTuples
+	}{
+		{TargetFirst, tuples},
+		{TargetLargest, MergeTuples{{2, 4, 1, 3}, {1, 5, 4}, {6, 5}}},
+		{TargetLowestID, MergeTuples{{1, 4, 3, 2}, {1, 5, 4}, {6, 5}}},
+	}
+	for _, test := range tests {
+		selected, err := selectTargets(tuples, sizes, test.mode)
+		if err != nil {
+			t.Fatalf("Error selecting targets with mode %q: %s\n", test.mode, err.Error())
+		}
+		if !reflect.DeepEqual(selected, test.expected) {
+			t.Errorf("Mode %q: expected %v, got %v\n", test.mode, test.expected, selected)
+		}
+	}
+	if _, err := selectTargets(tuples, sizes, "smallest"); err == nil {
+		t.Errorf("Expected error on unknown target mode\n")
+	}
+}
+
 // A single label block within the volume
 type testBody struct {
 	label        uint64
@@ -53,49 +94,32 @@ func (b testBody) checkCoarse(t *testing.T, encoding []byte) {
 }
 
 // Makes sure the sparse volume encoding matches the actual body voxels.
-func (b testBody) checkSparseVol(t *testing.T, encoding []byte, bounds dvid.Bounds) {
-	// Get to the  # spans and RLE in encoding
-	spansEncoding := encoding[8:]
-	var spans dvid.Spans
-	if err := spans.UnmarshalBinary(spansEncoding); err != nil {
-		t.Errorf("Error in decoding sparse volume: %s\n", err.Error())
-		return
-	}
-
+func (b testBody) checkSparseVol(t *testing.T, rles dvid.RLEs, bounds dvid.Bounds) {
 	// Create potentially bounded spans
-	expected := dvid.Spans{}
-	if bounds.IsSet() {
-		for _, span := range b.voxelSpans {
-			if bounds.OutsideY(span[1]) || bounds.OutsideZ(span[0]) {
-				continue
-			}
-			expected = append(expected, span)
+	expected := dvid.RLEs{}
+	for _, span := range b.voxelSpans {
+		if bounds.IsSet() && (bounds.OutsideY(span[1]) || bounds.OutsideZ(span[0])) {
+			continue
 		}
-	} else {
-		expected = b.voxelSpans
+		start := dvid.Point3d{span[2], span[1], span[0]}
+		expected = append(expected, dvid.NewRLE(start, span[3]-span[2]+1))
 	}
 
 	// Check those spans match the body voxels.
-	if !reflect.DeepEqual(spans, expected) {
-		t.Errorf("Expected spans for label %d:\n%s\nGot spans:\n%s\n", b.label, expected, spans)
+	if !reflect.DeepEqual(rles, expected) {
+		t.Errorf("Expected spans for label %d:\n%s\nGot spans:\n%s\n", b.label, expected, rles)
 	}
 }
 
-func checkSpans(t *testing.T, encoding []byte, minx, maxx int32) {
-	// Get to the  # spans and RLE in encoding
-	spansEncoding := encoding[8:]
-	var spans dvid.Spans
-	if err := spans.UnmarshalBinary(spansEncoding); err != nil {
-		t.Errorf("Error in decoding coarse sparse volume: %s\n", err.Error())
-		return
-	}
-	for _, span := range spans {
-		if span[2] < minx {
-			t.Errorf("Found span violating min x %d: %s\n", minx, span)
+func checkSpans(t *testing.T, rles dvid.RLEs, minx, maxx int32) {
+	for _, rle := range rles {
+		start := rle.StartPt()
+		if start[0] < minx {
+			t.Errorf("Found span violating min x %d: %s\n", minx, rle)
 			return
 		}
-		if span[3] > maxx {
-			t.Errorf("Found span violating max x %d: %s\n", maxx, span)
+		if start[0]+rle.Length()-1 > maxx {
+			t.Errorf("Found span violating max x %d: %s\n", maxx, rle)
 		}
 	}
 }
@@ -215,9 +239,14 @@ func (v *testVolume) hasLabel(label uint64, body *testBody) bool {
 
 type mergeJSON string
 
-func (mjson mergeJSON) send(t *testing.T, uuid dvid.UUID, name string) {
+func (mjson mergeJSON) send(t *testing.T, uuid dvid.UUID, name string) MergeResult {
 	apiStr := fmt.Sprintf("%snode/%s/%s/merge", server.WebAPIPath, uuid, name)
-	server.TestHTTP(t, "POST", apiStr, bytes.NewBuffer([]byte(mjson)))
+	response := server.TestHTTP(t, "POST", apiStr, bytes.NewBuffer([]byte(mjson)))
+	var result MergeResult
+	if err := json.Unmarshal(response, &result); err != nil {
+		t.Fatalf("Bad merge response %q: %s\n", string(response), err.Error())
+	}
+	return result
 }
 
 func createLabelTestVolume(t *testing.T, uuid dvid.UUID, name string) *testVolume {
@@ -231,8 +260,13 @@ func createLabelTestVolume(t *testing.T, uuid dvid.UUID, name string) *testVolum
 	volume.add(body3, 0)
 	volume.add(body4, 0)
 
-	// Send data over HTTP to populate a data instance
+	// Send data over HTTP to populate a data instance, then wait for its denormalization.
 	volume.put(t, uuid, name)
+	d, err := GetByUUID(uuid, dvid.DataString(name))
+	if err != nil {
+		t.Fatalf("Unable to get labels64 data: %s\n", err.Error())
+	}
+	d.waitFinishing()
 	return volume
 }
 
@@ -247,10 +281,6 @@ func TestSparseVolumes(t *testing.T) {
 	server.CreateTestInstance(t, uuid, "labels64", labelsName)
 	_ = createLabelTestVolume(t, uuid, labelsName)
 
-	// TODO -- Remove this hack in favor of whatever will be the method
-	// for discerning denormalizations are not yet complete.
-	time.Sleep(10 * time.Second)
-
 	for _, label := range []uint64{1, 3, 4} {
 		// Get the coarse sparse volumes for each label and make sure they are correct.
 		reqStr := fmt.Sprintf("%snode/%s/%s/sparsevol-coarse/%d", server.WebAPIPath, uuid, labelsName, label)
@@ -258,28 +288,364 @@ func TestSparseVolumes(t *testing.T) {
 		bodies[label-1].checkCoarse(t, encoding)
 	}
 
+	ts := httptest.NewServer(http.HandlerFunc(server.ServeSingleHTTP))
+	defer ts.Close()
 	for _, label := range []uint64{1, 2, 3, 4} {
 		// Check full sparse volumes
-		reqStr := fmt.Sprintf("%snode/%s/%s/sparsevol/%d", server.WebAPIPath, uuid, labelsName, label)
-		encoding := server.TestHTTP(t, "GET", reqStr, nil)
-		bodies[label-1].checkSparseVol(t, encoding, dvid.Bounds{})
+		rles, err := client.GetSparseVol(ts.URL, string(uuid), labelsName, label, nil, false)
+		if err != nil {
+			t.Fatalf("Unable to get sparse volume for label %d: %s\n", label, err.Error())
+		}
+		bodies[label-1].checkSparseVol(t, rles, dvid.Bounds{})
 
 		// Check Y/Z restriction
-		reqStr = fmt.Sprintf("%snode/%s/%s/sparsevol/%d?miny=30&maxy=50&minz=20&maxz=40&exact=true", server.WebAPIPath, uuid, labelsName, label)
-		encoding = server.TestHTTP(t, "GET", reqStr, nil)
 		var bound dvid.Bounds
 		bound.SetMinY(30)
 		bound.SetMaxY(50)
 		bound.SetMinZ(20)
 		bound.SetMaxZ(40)
-		bodies[label-1].checkSparseVol(t, encoding, bound)
+		rles, err = client.GetSparseVol(ts.URL, string(uuid), labelsName, label, &bound, true)
+		if err != nil {
+			t.Fatalf("Unable to get bounded sparse volume for label %d: %s\n", label, err.Error())
+		}
+		bodies[label-1].checkSparseVol(t, rles, bound)
 
 		// Check X restriction
 		minx := int32(20)
 		maxx := int32(47)
-		reqStr = fmt.Sprintf("%snode/%s/%s/sparsevol/%d?minx=%d&maxx=%d&exact=true", server.WebAPIPath, uuid, labelsName, label, minx, maxx)
-		encoding = server.TestHTTP(t, "GET", reqStr, nil)
-		checkSpans(t, encoding, minx, maxx)
+		bound = dvid.Bounds{}
+		bound.SetMinX(minx)
+		bound.SetMaxX(maxx)
+		rles, err = client.GetSparseVol(ts.URL, string(uuid), labelsName, label, &bound, true)
+		if err != nil {
+			t.Fatalf("Unable to get X-bounded sparse volume for label %d: %s\n", label, err.Error())
+		}
+		checkSpans(t, rles, minx, maxx)
+	}
+}
+
+func TestSparseVolBatch(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 300, "batchlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	expected := make(map[uint64]dvid.RLEs)
+	for label := uint64(1); label <= 3; label++ {
+		var all dvid.RLEs
+		rles := syntheticLabel(int32(label), 4)
+		for b := int32(0); b < int32(label); b++ {
+			block := dvid.IndexZYX{b, 0, 0}
+			all = append(all, rles[string(block.Bytes())]...)
+		}
+		expected[label] = all
+		blocks := make(map[string]bool, len(rles))
+		for blockStr := range rles {
+			blocks[blockStr] = true
+		}
+		if err := putLabelRLEs(ctx, label, rles, blocks); err != nil {
+			t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+		}
+	}
+	checkLabel := func(label uint64, rles dvid.RLEs) {
+		if !reflect.DeepEqual(rles, expected[label]) {
+			t.Errorf("Expected spans for label %d:\n%s\nGot spans:\n%s\n", label, expected[label], rles)
+		}
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	// Get many sparse volumes at once, including a missing label, with gzip encoding.
+	vols, err := client.GetSparseVols(ts.URL, string(uuid), "batchlabels", []uint64{3, 1, 999, 2})
+	if err != nil {
+		t.Fatalf("Unable to get batch of sparse volumes: %s\n", err.Error())
+	}
+	for label := uint64(1); label <= 3; label++ {
+		checkLabel(label, vols[label])
+	}
+	if rles, found := vols[999]; !found || rles != nil {
+		t.Errorf("Expected missing label with no spans, got %v\n", rles)
+	}
+
+	// Without gzip, labels are streamed in the requested order.
+	r, _ := http.NewRequest("POST", fmt.Sprintf("%snode/%s/batchlabels/sparsevols", server.WebAPIPath, uuid),
+		strings.NewReader("[2, 999, 1]"))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("Expected uncompressed response, got %d with encoding %q\n", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	reader := client.NewSparseVolReader(w.Body)
+	for _, label := range []uint64{2, 999, 1} {
+		got, rles, err := reader.Next()
+		if err != nil || got != label {
+			t.Fatalf("Expected label %d in stream, got %d, err %v\n", label, got, err)
+		}
+		if label != 999 {
+			checkLabel(label, rles)
+		}
+	}
+	if _, _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected end of sparsevols stream, got %v\n", err)
+	}
+
+	// Requests must be POSTs of JSON arrays, which are allowed on read-only data.
+	r, _ = http.NewRequest("GET", fmt.Sprintf("%snode/%s/batchlabels/sparsevols", server.WebAPIPath, uuid), nil)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected GET of sparsevols to fail, got %d\n", w.Code)
+	}
+	d.ReadOnly = true
+	for _, body := range []string{"[1]", "{\"labels\": [1]}"} {
+		r, _ = http.NewRequest("POST", fmt.Sprintf("%snode/%s/batchlabels/sparsevols", server.WebAPIPath, uuid), strings.NewReader(body))
+		w = httptest.NewRecorder()
+		handler(w, r)
+		if (body == "[1]") != (w.Code == http.StatusOK) {
+			t.Errorf("Unexpected status %d for body %s on read-only data\n", w.Code, body)
+		}
+	}
+}
+
+func TestForEachBlock(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	labelsName := "mylabels"
+	uuid := repo.RootUUID()
+	server.CreateTestInstance(t, uuid, "labels64", labelsName)
+	createLabelTestVolume(t, uuid, labelsName)
+
+	d, err := GetByUUID(uuid, dvid.DataString(labelsName))
+	if err != nil {
+		t.Fatalf("Unable to get labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	for _, body := range bodies {
+		// Expected blocks from the body's block spans, which are in z, y, x0, x1 order.
+		var expected []dvid.IndexZYX
+		for _, span := range body.blockSpans {
+			for x := span[2]; x <= span[3]; x++ {
+				expected = append(expected, dvid.IndexZYX{x, span[1], span[0]})
+			}
+		}
+		minZ, maxZ := body.blockSpans[0][0], body.blockSpans[len(body.blockSpans)-1][0]
+
+		optsList := []*BlockOptions{
+			nil,
+			{KeysOnly: true},
+			{ZBounded: true, MinZ: minZ, MaxZ: minZ},
+			{ZBounded: true, MinZ: minZ + 1, MaxZ: maxZ, KeysOnly: true},
+		}
+		for _, opts := range optsList {
+			var got []dvid.IndexZYX
+			err := ForEachBlock(ctx, body.label, opts, func(block dvid.IndexZYX, rles dvid.RLEs) error {
+				if opts != nil && opts.KeysOnly && rles != nil {
+					t.Errorf("Label %d: expected no RLEs for keys-only iteration\n", body.label)
+				}
+				if (opts == nil || !opts.KeysOnly) && len(rles) == 0 {
+					t.Errorf("Label %d: expected RLEs for block %v\n", body.label, block)
+				}
+				got = append(got, block)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Error iterating over label %d blocks: %s\n", body.label, err.Error())
+			}
+			var want []dvid.IndexZYX
+			for _, block := range expected {
+				if opts == nil || !opts.ZBounded || (block[2] >= opts.MinZ && block[2] <= opts.MaxZ) {
+					want = append(want, block)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Label %d with options %v: expected blocks %v, got %v\n", body.label, opts, want, got)
+			}
+		}
+	}
+}
+
+// syntheticLabel returns RLEs for a label with the given number of blocks, each holding
+// spansPerBlock spans of 3 voxels.
+func syntheticLabel(numBlocks, spansPerBlock int32) blockRLEs {
+	rles := make(blockRLEs, numBlocks)
+	for b := int32(0); b < numBlocks; b++ {
+		block := dvid.IndexZYX{b, 0, 0}
+		blockRLEs := make(dvid.RLEs, spansPerBlock)
+		for i := int32(0); i < spansPerBlock; i++ {
+			blockRLEs[i] = dvid.NewRLE(dvid.Point3d{b * 32, i % 32, i / 32}, 3)
+		}
+		rles[string(block.Bytes())] = blockRLEs
+	}
+	return rles
+}
+
+// putSyntheticLabel stores a synthetic label in new labels64 data.
+func putSyntheticLabel(tb testing.TB, id dvid.InstanceID, label uint64, rles blockRLEs) *datastore.VersionedContext {
+	repo, versionID := initTestRepo()
+	d, err := NewData(repo.RootUUID(), id, "synthetic", dvid.NewConfig())
+	if err != nil {
+		tb.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	blocks := make(map[string]bool, len(rles))
+	for blockStr := range rles {
+		blocks[blockStr] = true
+	}
+	if err := putLabelRLEs(ctx, label, rles, blocks); err != nil {
+		tb.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+	}
+	return ctx
+}
+
+func TestCountLabel(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	ctx := putSyntheticLabel(t, 300, 7, syntheticLabel(5, 100))
+	numVoxels, numSpans, numBlocks, err := CountLabel(ctx, 7)
+	if err != nil {
+		t.Fatalf("Unable to count label: %s\n", err.Error())
+	}
+	if numVoxels != 1500 || numSpans != 500 || numBlocks != 5 {
+		t.Errorf("Expected 1500 voxels in 500 spans and 5 blocks, got %d voxels in %d spans and %d blocks\n",
+			numVoxels, numSpans, numBlocks)
+	}
+	if numVoxels, numSpans, numBlocks, err = CountLabel(ctx, 8); err != nil {
+		t.Fatalf("Unable to count missing label: %s\n", err.Error())
+	}
+	if numVoxels != 0 || numSpans != 0 || numBlocks != 0 {
+		t.Errorf("Expected empty count for missing label, got %d, %d, %d\n", numVoxels, numSpans, numBlocks)
+	}
+}
+
+// Compare memory use of label sizes computed from materialized RLEs and from counts.
+const benchBlocks, benchSpansPerBlock = 100, 2000
+
+func BenchmarkLabelSizeFromRLEs(b *testing.B) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	ctx := putSyntheticLabel(b, 301, 7, syntheticLabel(benchBlocks, benchSpansPerBlock))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rles, err := getLabelRLEs(ctx, 7)
+		if err != nil {
+			b.Fatalf("Unable to get label RLEs: %s\n", err.Error())
+		}
+		if rles.numVoxels() != 3*benchBlocks*benchSpansPerBlock {
+			b.Fatalf("Bad label size\n")
+		}
+	}
+}
+
+func BenchmarkCountLabel(b *testing.B) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	ctx := putSyntheticLabel(b, 302, 7, syntheticLabel(benchBlocks, benchSpansPerBlock))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		numVoxels, _, _, err := CountLabel(ctx, 7)
+		if err != nil {
+			b.Fatalf("Unable to count label: %s\n", err.Error())
+		}
+		if numVoxels != 3*benchBlocks*benchSpansPerBlock {
+			b.Fatalf("Bad label size\n")
+		}
+	}
+}
+
+// benchDeleteLabel times deleting a 3-block label next to labels with many blocks, restoring
+// the label between iterations.
+func benchDeleteLabel(b *testing.B, id dvid.InstanceID, deleteLabel func(ctx *datastore.VersionedContext, rles blockRLEs) error) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	ctx := putSyntheticLabel(b, id, 6, syntheticLabel(benchBlocks, 10))
+	small := syntheticLabel(3, 10)
+	large := syntheticLabel(benchBlocks, 10)
+	if err := putLabelRLEs(ctx, 8, large, large.blocks()); err != nil {
+		b.Fatalf("Unable to store label 8: %s\n", err.Error())
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := putLabelRLEs(ctx, 7, small, small.blocks()); err != nil {
+			b.Fatalf("Unable to store label 7: %s\n", err.Error())
+		}
+		b.StartTimer()
+		if err := deleteLabel(ctx, small); err != nil {
+			b.Fatalf("Unable to delete label 7: %s\n", err.Error())
+		}
+	}
+}
+
+func BenchmarkDeleteLabelBlocks(b *testing.B) {
+	benchDeleteLabel(b, 303, func(ctx *datastore.VersionedContext, rles blockRLEs) error {
+		return deleteLabelBlocks(ctx, 7, rles.blocks())
+	})
+}
+
+// BenchmarkDeleteLabelRange is the range deletion formerly used by merges, for comparison.
+func BenchmarkDeleteLabelRange(b *testing.B) {
+	benchDeleteLabel(b, 304, func(ctx *datastore.VersionedContext, rles blockRLEs) error {
+		smalldata, err := storage.SmallDataStore()
+		if err != nil {
+			return err
+		}
+		minIndex, maxIndex := voxels.LabelRange(7)
+		return smalldata.DeleteRange(ctx, minIndex, maxIndex)
+	})
+}
+
+func TestListLabels(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, _ := initTestRepo()
+	labelsName := "mylabels"
+	uuid := repo.RootUUID()
+	server.CreateTestInstance(t, uuid, "labels64", labelsName)
+	createLabelTestVolume(t, uuid, labelsName)
+
+	var body1Voxels uint64
+	for _, span := range body1.voxelSpans {
+		body1Voxels += uint64(span[3] - span[2] + 1)
+	}
+	listTests := []struct {
+		query    string
+		expected LabelList
+	}{
+		{"", LabelList{Labels: []uint64{1, 2, 3, 4}}},
+		{"?count=2", LabelList{Labels: []uint64{1, 2}, Next: 3}},
+		{"?start=3&count=2", LabelList{Labels: []uint64{3, 4}}},
+		{"?start=2&count=1", LabelList{Labels: []uint64{2}, Next: 3}},
+		{"?start=5", LabelList{Labels: []uint64{}}},
+		{fmt.Sprintf("?minsize=%d&count=1", body1Voxels+1), LabelList{Labels: []uint64{2}, Next: 3}},
+	}
+	for _, test := range listTests {
+		reqStr := fmt.Sprintf("%snode/%s/%s/labels%s", server.WebAPIPath, uuid, labelsName, test.query)
+		response := server.TestHTTP(t, "GET", reqStr, nil)
+		var list LabelList
+		if err := json.Unmarshal(response, &list); err != nil {
+			t.Fatalf("Bad label list response %q: %s\n", string(response), err.Error())
+		}
+		if !reflect.DeepEqual(list, test.expected) {
+			t.Errorf("Label list %q: expected %v, got %v\n", test.query, test.expected, list)
+		}
 	}
 }
 
@@ -294,10 +660,6 @@ func TestMergeLabels(t *testing.T) {
 	server.CreateTestInstance(t, uuid, "labels64", labelsName)
 	vol := createLabelTestVolume(t, uuid, labelsName)
 
-	// TODO -- Remove this hack in favor of whatever will be the method
-	// for discerning denormalizations are not yet complete.
-	time.Sleep(10 * time.Second)
-
 	expected := newTestVolume(100, 100, 100)
 	expected.add(body1, 0)
 	expected.add(body2, 0)
@@ -312,7 +674,21 @@ func TestMergeLabels(t *testing.T) {
 	testMerge := mergeJSON(`
 		[ [2, 3] ]
 	`)
-	testMerge.send(t, uuid, labelsName)
+	result := testMerge.send(t, uuid, labelsName)
+	var body3Voxels uint64
+	for _, span := range body3.voxelSpans {
+		body3Voxels += uint64(span[3] - span[2] + 1)
+	}
+	if len(result.Targets) != 1 || result.Targets[0].Label != 2 || result.Targets[0].VoxelsAdded != body3Voxels {
+		t.Errorf("Expected merge of %d voxels into label 2, got %v\n", body3Voxels, result.Targets)
+	}
+	var body3Blocks int
+	for _, span := range body3.blockSpans {
+		body3Blocks += int(span[3] - span[2] + 1)
+	}
+	if result.BlocksChanged != body3Blocks {
+		t.Errorf("Expected %d blocks changed, got %d\n", body3Blocks, result.BlocksChanged)
+	}
 
 	// Make sure changes are correct after completion
 	retrieved := newTestVolume(100, 100, 100)
@@ -334,6 +710,625 @@ func TestMergeLabels(t *testing.T) {
 	}
 }
 
+func TestMergeCrashRecovery(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+	defer func() {
+		mergeFailpoint = nil
+	}()
+
+	repo, versionID := initTestRepo()
+	blockA, blockB, blockC := dvid.IndexZYX{0, 0, 0}, dvid.IndexZYX{1, 0, 0}, dvid.IndexZYX{2, 0, 0}
+	label1RLEs := blockRLEs{
+		string(blockA.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{0, 0, 0}, 10)},
+		string(blockB.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{32, 1, 0}, 5)},
+	}
+	label2RLEs := blockRLEs{
+		string(blockB.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{32, 2, 0}, 7)},
+		string(blockC.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{64, 0, 0}, 3)},
+	}
+	blocksOf := func(rles blockRLEs) map[string]bool {
+		blocks := make(map[string]bool, len(rles))
+		for blockStr := range rles {
+			blocks[blockStr] = true
+		}
+		return blocks
+	}
+
+	for i, step := range []string{"intent", "rles", "relabel"} {
+		d, err := NewData(repo.RootUUID(), dvid.InstanceID(100+i), "crashlabels", dvid.NewConfig())
+		if err != nil {
+			t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+		}
+		ctx := datastore.NewVersionedContext(d, versionID)
+		if err := putLabelRLEs(ctx, 1, label1RLEs, blocksOf(label1RLEs)); err != nil {
+			t.Fatalf("Unable to store label 1: %s\n", err.Error())
+		}
+		if err := putLabelRLEs(ctx, 2, label2RLEs, blocksOf(label2RLEs)); err != nil {
+			t.Fatalf("Unable to store label 2: %s\n", err.Error())
+		}
+
+		// Simulate a crash at the step.
+		failStep := step
+		mergeFailpoint = func(s string) error {
+			if s == failStep {
+				return fmt.Errorf("simulated crash")
+			}
+			return nil
+		}
+		if _, err := d.MergeLabels(ctx, MergeTuples{{1, 2}}, MergeOptions{Target: TargetFirst, User: "proofreader"}); err == nil {
+			t.Fatalf("Expected merge interrupted at %q step to fail\n", step)
+		}
+		if pending := d.pendingIntents(); len(pending) != 1 || pending[0].Op != "merge" || pending[0].User != "proofreader" {
+			t.Errorf("Expected merge interrupted at %q step to need repair, got %v\n", step, pending)
+		}
+		mergeFailpoint = nil
+
+		// Reloading the instance rolls the merge forward.
+		if err := d.Recover(); err != nil {
+			t.Fatalf("Unable to recover merge interrupted at %q step: %s\n", step, err.Error())
+		}
+		if pending := d.pendingIntents(); len(pending) != 0 {
+			t.Errorf("Expected no repairs needed after recovery from %q step, got %v\n", step, pending)
+		}
+		intents, err := d.getIntents()
+		if err != nil {
+			t.Fatalf("Unable to get intents: %s\n", err.Error())
+		}
+		if len(intents) != 0 {
+			t.Errorf("Expected intent to be deleted after recovery from %q step\n", step)
+		}
+		rles, err := getLabelRLEs(ctx, 2)
+		if err != nil {
+			t.Fatalf("Unable to get label 2 RLEs: %s\n", err.Error())
+		}
+		if len(rles) != 0 {
+			t.Errorf("Expected label 2 to be merged after recovery from %q step, got %v\n", step, rles)
+		}
+		if rles, err = getLabelRLEs(ctx, 1); err != nil {
+			t.Fatalf("Unable to get label 1 RLEs: %s\n", err.Error())
+		}
+		if numVoxels := rles.numVoxels(); numVoxels != 25 || len(rles) != 3 {
+			t.Errorf("Expected 25 voxels in 3 blocks for label 1 after recovery from %q step, got %d voxels in %d blocks\n",
+				step, numVoxels, len(rles))
+		}
+	}
+}
+
+func TestMergeConcurrentWrite(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+	defer func() {
+		mergeFailpoint = nil
+	}()
+
+	repo, versionID := initTestRepo()
+	d, err := NewData(repo.RootUUID(), 110, "racelabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	defer d.waitFinishing()
+	ctx := datastore.NewVersionedContext(d, versionID)
+	blockA, blockB, blockC := dvid.IndexZYX{0, 0, 0}, dvid.IndexZYX{1, 0, 0}, dvid.IndexZYX{5, 5, 5}
+	label1RLEs := blockRLEs{string(blockA.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{0, 0, 0}, 10)}}
+	label2RLEs := blockRLEs{string(blockB.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{32, 2, 0}, 7)}}
+	if err := putLabelRLEs(ctx, 1, label1RLEs, label1RLEs.blocks()); err != nil {
+		t.Fatalf("Unable to store label 1: %s\n", err.Error())
+	}
+	if err := putLabelRLEs(ctx, 2, label2RLEs, label2RLEs.blocks()); err != nil {
+		t.Fatalf("Unable to store label 2: %s\n", err.Error())
+	}
+
+	// A writer adds a block to label 2 after the merge has read label 2's RLEs.
+	addedRLEs := blockRLEs{string(blockC.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{160, 160, 160}, 4)}}
+	mergeFailpoint = func(step string) error {
+		if step == "intent" {
+			return putLabelRLEs(ctx, 2, addedRLEs, addedRLEs.blocks())
+		}
+		return nil
+	}
+	if _, err := d.MergeLabels(ctx, MergeTuples{{1, 2}}, MergeOptions{Target: TargetFirst}); err != nil {
+		t.Fatalf("Unable to merge: %s\n", err.Error())
+	}
+	mergeFailpoint = nil
+
+	// The merged voxels move to label 1 and the concurrently written voxels are kept.
+	rles, err := getLabelRLEs(ctx, 1)
+	if err != nil {
+		t.Fatalf("Unable to get label 1 RLEs: %s\n", err.Error())
+	}
+	if numVoxels := rles.numVoxels(); numVoxels != 17 || len(rles) != 2 {
+		t.Errorf("Expected 17 voxels in 2 blocks for label 1, got %d voxels in %d blocks\n", numVoxels, len(rles))
+	}
+	if rles, err = getLabelRLEs(ctx, 2); err != nil {
+		t.Fatalf("Unable to get label 2 RLEs: %s\n", err.Error())
+	}
+	if _, found := rles[string(blockC.Bytes())]; !found || rles.numVoxels() != 4 || len(rles) != 1 {
+		t.Errorf("Expected concurrently written block of label 2 to be kept, got %v\n", rles)
+	}
+}
+
+func TestMergeAnnotation(t *testing.T) {
+	target := Annotation{"name": json.RawMessage(`"a"`)}
+	merged := Annotation{"name": json.RawMessage(`"b"`), "status": json.RawMessage(`"traced"`)}
+	for i := 0; i < 2; i++ {
+		var err error
+		if target, err = mergeAnnotation(target, 2, merged); err != nil {
+			t.Fatalf("Unable to merge annotation: %s\n", err.Error())
+		}
+	}
+	jsonBytes, err := json.Marshal(target)
+	if err != nil {
+		t.Fatalf("Unable to marshal annotation: %s\n", err.Error())
+	}
+	expected := `{"merged-from":[{"label":2,"annotation":{"name":"b","status":"traced"}}],"name":"a","status":"traced"}`
+	if string(jsonBytes) != expected {
+		t.Errorf("Expected merged annotation %s, got %s\n", expected, string(jsonBytes))
+	}
+
+	// Labels without annotations can be merge targets.
+	if target, err = mergeAnnotation(nil, 3, merged); err != nil {
+		t.Fatalf("Unable to merge annotation into empty annotation: %s\n", err.Error())
+	}
+	if string(target["name"]) != `"b"` {
+		t.Errorf("Expected merged name in empty target, got %v\n", target)
+	}
+}
+
+func TestMergeAnnotations(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	kvtype, err := datastore.TypeServiceByName("keyvalue")
+	if err != nil {
+		t.Fatalf("Can't get keyvalue type: %s\n", err.Error())
+	}
+	if _, err := repo.NewData(kvtype, "bodyannotations", dvid.NewConfig()); err != nil {
+		t.Fatalf("Unable to create keyvalue instance: %s\n", err.Error())
+	}
+	config := dvid.NewConfig()
+	config.Set("Annotations", "bodyannotations")
+	d, err := NewData(repo.RootUUID(), 200, "annotatedlabels", config)
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	for label := uint64(1); label <= 3; label++ {
+		block := dvid.IndexZYX{int32(label), 0, 0}
+		rles := blockRLEs{string(block.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{int32(label) * 32, 0, 0}, 10)}}
+		if err := putLabelRLEs(ctx, label, rles, map[string]bool{string(block.Bytes()): true}); err != nil {
+			t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+		}
+	}
+	annotations := map[uint64]string{
+		1: `{"name": "a"}`,
+		2: `{"name": "b", "status": "traced"}`,
+	}
+	for label, jsonStr := range annotations {
+		var annotation Annotation
+		if err := json.Unmarshal([]byte(jsonStr), &annotation); err != nil {
+			t.Fatalf("Bad test annotation: %s\n", err.Error())
+		}
+		if err := d.PutAnnotation(versionID, label, annotation); err != nil {
+			t.Fatalf("Unable to put annotation of label %d: %s\n", label, err.Error())
+		}
+	}
+
+	if _, err := d.MergeLabels(ctx, MergeTuples{{1, 2, 3}}, MergeOptions{Target: TargetFirst}); err != nil {
+		t.Fatalf("Unable to merge labels: %s\n", err.Error())
+	}
+
+	// Annotations are moved when the merge finishes in the background.
+	d.waitFinishing()
+	annotation, err := d.GetAnnotation(versionID, 2)
+	if err != nil {
+		t.Fatalf("Unable to get annotation of label 2: %s\n", err.Error())
+	}
+	if annotation != nil {
+		t.Fatalf("Expected annotation of merged label 2 to be deleted, got %v\n", annotation)
+	}
+	if annotation, err = d.GetAnnotation(versionID, 1); err != nil {
+		t.Fatalf("Unable to get annotation of label 1: %s\n", err.Error())
+	}
+	var mergedFrom []MergedAnnotation
+	if err := json.Unmarshal(annotation[AnnotationMergedFrom], &mergedFrom); err != nil {
+		t.Fatalf("Bad merged-from field in %v: %s\n", annotation, err.Error())
+	}
+	if string(annotation["name"]) != `"a"` || string(annotation["status"]) != `"traced"` ||
+		len(mergedFrom) != 1 || mergedFrom[0].Label != 2 {
+		t.Errorf("Unexpected annotation of merge target: %v\n", annotation)
+	}
+}
+
+func TestMergeTiming(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 300, "timedlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	defer d.waitFinishing()
+	ctx := datastore.NewVersionedContext(d, versionID)
+	for label := uint64(1); label <= 3; label++ {
+		block := dvid.IndexZYX{int32(label), 0, 0}
+		rles := blockRLEs{string(block.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{int32(label) * 32, 0, 0}, 10)}}
+		if err := putLabelRLEs(ctx, label, rles, map[string]bool{string(block.Bytes()): true}); err != nil {
+			t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+		}
+	}
+
+	apiStr := fmt.Sprintf("%snode/%s/timedlabels/merge?timing=true", server.WebAPIPath, uuid)
+	r, _ := http.NewRequest("POST", apiStr, strings.NewReader("[[1, 2, 3]]"))
+	w := httptest.NewRecorder()
+	start := time.Now()
+	d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+	wall := float64(time.Since(start)) / float64(time.Millisecond)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad merge response: %d %s\n", w.Code, w.Body.String())
+	}
+	var result MergeResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad merge response %q: %s\n", w.Body.String(), err.Error())
+	}
+
+	// All phases are accounted for, and the top-level phases cover the request.
+	var topLevel float64
+	for _, phase := range []string{"parse", "read-existing", "compute", "write", "notify"} {
+		ms, found := result.Timing[phase]
+		if !found {
+			t.Errorf("Expected %q phase in merge timing %v\n", phase, result.Timing)
+		}
+		topLevel += ms
+	}
+	if topLevel > wall || wall-topLevel > 20 {
+		t.Errorf("Expected merge phases totaling %f ms to be within 20 ms of wall time %f ms\n", topLevel, wall)
+	}
+	nested := result.Timing["write/intent"] + result.Timing["write/rles"]
+	if _, found := result.Timing["write/rles"]; !found || nested > result.Timing["write"] {
+		t.Errorf("Expected nested write phases within write phase, got %v\n", result.Timing)
+	}
+	if len(result.Timing) != 7 {
+		t.Errorf("Expected 7 phases in merge timing, got %v\n", result.Timing)
+	}
+
+	// Timing is only returned when requested.
+	untimed, err := d.MergeLabels(ctx, MergeTuples{{1, 4}}, MergeOptions{Target: TargetFirst})
+	if err != nil {
+		t.Fatalf("Unable to merge labels: %s\n", err.Error())
+	}
+	if jsonBytes, _ := json.Marshal(untimed); strings.Contains(string(jsonBytes), "Timing") {
+		t.Errorf("Expected no timing in merge result without request, got %s\n", string(jsonBytes))
+	}
+}
+
+func TestMergeAttribution(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 310, "attributedlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	defer d.waitFinishing()
+	ctx := datastore.NewVersionedContext(d, versionID)
+	for label := uint64(1); label <= 4; label++ {
+		block := dvid.IndexZYX{int32(label), 0, 0}
+		rles := blockRLEs{string(block.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{int32(label) * 32, 0, 0}, 10)}}
+		if err := putLabelRLEs(ctx, label, rles, map[string]bool{string(block.Bytes()): true}); err != nil {
+			t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+		}
+	}
+
+	merge := func(body, user string) MergeResult {
+		apiStr := fmt.Sprintf("%snode/%s/attributedlabels/merge", server.WebAPIPath, uuid)
+		r, _ := http.NewRequest("POST", apiStr, strings.NewReader(body))
+		if user != "" {
+			r.Header.Set(server.UserHeader, user)
+		}
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Bad merge response: %d %s\n", w.Code, w.Body.String())
+		}
+		var result MergeResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Bad merge response %q: %s\n", w.Body.String(), err.Error())
+		}
+		return result
+	}
+	if result := merge("[[1, 2]]", "alice"); result.User != "alice" {
+		t.Errorf("Expected merge attributed to alice, got %q\n", result.User)
+	}
+	if result := merge("[[3, 4]]", ""); result.User != server.AnonymousUser {
+		t.Errorf("Expected anonymous merge, got %q\n", result.User)
+	}
+
+	// Intents stored before users were recorded still decode, and older readers can decode
+	// intents with users.
+	legacy := struct {
+		ID     uint64
+		Op     string
+		Phase  string
+		Tuples MergeTuples
+		Blocks []dvid.IndexZYX
+		Sizes  []intentSize
+	}{7, "merge", intentMergeRLEs, MergeTuples{{1, 2}}, []dvid.IndexZYX{{1, 0, 0}}, []intentSize{{1, 10, 20}}}
+	legacyJSON, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatalf("Unable to encode legacy intent: %s\n", err.Error())
+	}
+	var intent mergeIntent
+	if err := json.Unmarshal(legacyJSON, &intent); err != nil {
+		t.Fatalf("Unable to decode legacy intent: %s\n", err.Error())
+	}
+	if intent.ID != 7 || intent.User != "" || !reflect.DeepEqual(intent.Sizes, legacy.Sizes) {
+		t.Errorf("Unexpected decoding of legacy intent: %+v\n", intent)
+	}
+	intent.User = "alice"
+	intentJSON, err := json.Marshal(intent)
+	if err != nil {
+		t.Fatalf("Unable to encode intent: %s\n", err.Error())
+	}
+	legacy.ID = 0
+	if err := json.Unmarshal(intentJSON, &legacy); err != nil || legacy.ID != 7 || legacy.Op != "merge" {
+		t.Errorf("Unable to decode intent with user into legacy intent: %+v, %v\n", legacy, err)
+	}
+}
+
+// overlappingLabel returns RLEs for a label whose blocks and runs overlap those of other
+// overlapping labels, so merges combine runs within shared blocks.
+func overlappingLabel(label uint64, numBlocks int32) blockRLEs {
+	rles := make(blockRLEs)
+	step := int32(label%4) + 1
+	for b := int32(0); b < numBlocks; b += step {
+		block := dvid.IndexZYX{b, 0, 0}
+		x := b*32 + int32(label%3)*5
+		rles[string(block.Bytes())] = dvid.RLEs{
+			dvid.NewRLE(dvid.Point3d{x, int32(label % 4), 0}, 10),
+			dvid.NewRLE(dvid.Point3d{x, int32(label), 1}, 4),
+		}
+	}
+	return rles
+}
+
+func TestShardedMergeMatchesSerial(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	d, err := NewData(repo.RootUUID(), 320, "shardedlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	const numLabels = 24
+	const numBlocks = 2500 // more blocks than are written in one batch
+	for label := uint64(1); label <= numLabels; label++ {
+		rles := overlappingLabel(label, numBlocks)
+		blocks := make(map[string]bool, len(rles))
+		for blockStr := range rles {
+			blocks[blockStr] = true
+		}
+		if err := putLabelRLEs(ctx, label, rles, blocks); err != nil {
+			t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+		}
+	}
+
+	// Merge many labels sharing blocks and compare with merging each block serially.
+	tuples := MergeTuples{{1, 2, 3, 4, 5, 6, 7, 8}, {9, 10, 11}, {12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22}}
+	expected := make(map[uint64]blockRLEs)
+	for _, tuple := range tuples {
+		toRLEs := overlappingLabel(tuple[0], numBlocks)
+		for _, fromLabel := range tuple[1:] {
+			for blockStr, fromRLEs := range overlappingLabel(fromLabel, numBlocks) {
+				if rles, found := toRLEs[blockStr]; found {
+					rles.Add(fromRLEs)
+					toRLEs[blockStr] = rles
+				} else {
+					toRLEs[blockStr] = fromRLEs
+				}
+			}
+		}
+		expected[tuple[0]] = toRLEs
+	}
+	if _, err := d.MergeLabels(ctx, tuples, MergeOptions{Target: TargetFirst}); err != nil {
+		t.Fatalf("Unable to merge labels: %s\n", err.Error())
+	}
+	for label := uint64(1); label <= numLabels; label++ {
+		got, err := getLabelRLEs(ctx, label)
+		if err != nil {
+			t.Fatalf("Unable to get RLEs of label %d: %s\n", label, err.Error())
+		}
+		want, isTarget := expected[label]
+		if !isTarget {
+			if label <= 22 && len(got) != 0 {
+				t.Errorf("Expected merged label %d to be deleted, got %d blocks\n", label, len(got))
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Merged RLEs of label %d don't match serial merge: %d blocks vs %d\n", label, len(got), len(want))
+		}
+	}
+
+	// Let relabeling finish before the store is closed.
+	d.waitFinishing()
+}
+
+func TestMergeMissingLabels(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, _ := initTestRepo()
+	labelsName := "mylabels"
+	uuid := repo.RootUUID()
+	server.CreateTestInstance(t, uuid, "labels64", labelsName)
+	createLabelTestVolume(t, uuid, labelsName)
+
+	ts := httptest.NewServer(http.HandlerFunc(server.ServeSingleHTTP))
+	defer ts.Close()
+	strictTests := []struct {
+		merge   [][]uint64
+		missing string
+	}{
+		{[][]uint64{{20, 3}}, "[20]"},            // missing target
+		{[][]uint64{{2, 30, 3}}, "[30]"},         // missing source
+		{[][]uint64{{20, 30, 40}}, "[20 30 40]"}, // all missing
+	}
+	for _, test := range strictTests {
+		err := client.Merge(ts.URL, string(uuid), labelsName, test.merge, url.Values{"strict": {"true"}})
+		e, ok := err.(*client.Error)
+		if !ok || e.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected strict merge %v to fail with 400, got %v\n", test.merge, err)
+			continue
+		}
+		if !strings.Contains(e.Message, test.missing) {
+			t.Errorf("Expected strict merge %v error to list labels %s, got %q\n", test.merge, test.missing, e.Message)
+		}
+	}
+
+	// Nothing should have been changed by the refused merges.
+	retrieved := newTestVolume(100, 100, 100)
+	retrieved.get(t, uuid, labelsName)
+	if !retrieved.isLabel(3, &body3) {
+		t.Errorf("Label 3 was modified by a refused strict merge\n")
+	}
+
+	// Non-strict merges skip missing labels and report them.
+	result := mergeJSON(`[ [2, 30, 3] ]`).send(t, uuid, labelsName)
+	if len(result.Missing) != 1 || result.Missing[0] != 30 {
+		t.Errorf("Expected missing label 30 to be reported, got %v\n", result.Missing)
+	}
+	if len(result.Targets) != 1 || result.Targets[0].VoxelsAdded == 0 {
+		t.Errorf("Expected label 3 to be merged into label 2, got %v\n", result.Targets)
+	}
+}
+
+func TestMergeLockedNode(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, _ := initTestRepo()
+	labelsName := "mylabels"
+	uuid := repo.RootUUID()
+	server.CreateTestInstance(t, uuid, "labels64", labelsName)
+	createLabelTestVolume(t, uuid, labelsName)
+
+	// Commit the root and make an open child.
+	if err := repo.Lock(uuid); err != nil {
+		t.Fatalf("Unable to lock root node: %s\n", err.Error())
+	}
+	child, err := repo.NewVersion(uuid)
+	if err != nil {
+		t.Fatalf("Unable to create child node: %s\n", err.Error())
+	}
+
+	apiStr := fmt.Sprintf("%snode/%s/%s/merge", server.WebAPIPath, uuid, labelsName)
+	req, _ := http.NewRequest("POST", apiStr, bytes.NewBufferString("[ [2, 3] ]"))
+	w := httptest.NewRecorder()
+	server.ServeSingleHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for merge on locked node, got %d\n", w.Code)
+	}
+	var conflict LockedNodeError
+	if err := json.Unmarshal(w.Body.Bytes(), &conflict); err != nil {
+		t.Fatalf("Bad locked node response %q: %s\n", w.Body.String(), err.Error())
+	}
+	if conflict.UUID != uuid || len(conflict.OpenChildren) != 1 || conflict.OpenChildren[0] != child {
+		t.Errorf("Expected locked node %s with open child %s, got %v\n", uuid, child, conflict)
+	}
+
+	// Forced merges require the instance setting.
+	ts := httptest.NewServer(http.HandlerFunc(server.ServeSingleHTTP))
+	defer ts.Close()
+	force := url.Values{"force": {"true"}}
+	err = client.Merge(ts.URL, string(uuid), labelsName, [][]uint64{{2, 3}}, force)
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for forced merge without AllowForce, got %v\n", err)
+	}
+
+	d, err := GetByUUID(uuid, dvid.DataString(labelsName))
+	if err != nil {
+		t.Fatalf("Unable to get labels64 data: %s\n", err.Error())
+	}
+	defer d.waitFinishing()
+	d.AllowForce = true
+	if err := client.Merge(ts.URL, string(uuid), labelsName, [][]uint64{{2, 3}}, force); err != nil {
+		t.Fatalf("Expected forced merge to succeed, got %s\n", err.Error())
+	}
+	retrieved := newTestVolume(100, 100, 100)
+	retrieved.get(t, uuid, labelsName)
+	if !retrieved.isLabel(2, &body3) {
+		t.Errorf("Forced merge did not relabel label 3 voxels\n")
+	}
+}
+
+func TestSizeHistory(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, _ := initTestRepo()
+	labelsName := "mylabels"
+	uuid := repo.RootUUID()
+	server.CreateTestInstance(t, uuid, "labels64", labelsName)
+	createLabelTestVolume(t, uuid, labelsName)
+
+	// Backfill the root sizes, then merge in a child node.
+	d, err := GetByUUID(uuid, dvid.DataString(labelsName))
+	if err != nil {
+		t.Fatalf("Unable to get labels64 data: %s\n", err.Error())
+	}
+	defer d.waitFinishing()
+	_, rootVersion, err := datastore.MatchingUUID(string(uuid))
+	if err != nil {
+		t.Fatalf("Unable to get root version: %s\n", err.Error())
+	}
+	if err := d.BackfillSizeHistory(datastore.NewVersionedContext(d, rootVersion)); err != nil {
+		t.Fatalf("Unable to backfill size history: %s\n", err.Error())
+	}
+	if err := repo.Lock(uuid); err != nil {
+		t.Fatalf("Unable to lock root node: %s\n", err.Error())
+	}
+	child, err := repo.NewVersion(uuid)
+	if err != nil {
+		t.Fatalf("Unable to create child node: %s\n", err.Error())
+	}
+	result := mergeJSON(`[ [2, 3] ]`).send(t, child, labelsName)
+	if len(result.Targets) != 1 {
+		t.Fatalf("Expected one merge target, got %v\n", result.Targets)
+	}
+	newSize := result.Targets[0].NewSize
+	oldSize := newSize - result.Targets[0].VoxelsAdded
+
+	// Size records are written asynchronously after the merge.
+	d.waitFinishing()
+
+	apiStr := fmt.Sprintf("%snode/%s/%s/size-history/2", server.WebAPIPath, child, labelsName)
+	req, _ := http.NewRequest("GET", apiStr, nil)
+	w := httptest.NewRecorder()
+	server.ServeSingleHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bad size history response (%d): %s\n", w.Code, w.Body.String())
+	}
+	var history []SizeRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatalf("Bad size history JSON %q: %s\n", w.Body.String(), err.Error())
+	}
+	expected := []SizeRecord{
+		{child, newSize, "merge"},
+		{uuid, oldSize, "backfill"},
+	}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("Expected size history %v, got %v\n", expected, history)
+	}
+}
+
 func TestSplitLabel(t *testing.T) {
 	// Create testbed labels64 volume
 
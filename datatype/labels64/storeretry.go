@@ -0,0 +1,72 @@
+/*
+	This file supports graceful degradation of label operations when the small data store is
+	unavailable, e.g., while the storage backend is compacted or fails over.  Failures to get
+	the store are briefly retried, and failures to get or use the store before anything is
+	modified are returned as retryable 503 errors with a Retry-After header.
+*/
+
+package labels64
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+var (
+	// StoreRetries is the number of times getting the small data store is retried within
+	// a request before the request fails as unavailable.
+	StoreRetries = 3
+
+	// StoreRetryWait is the wait between attempts to get the small data store.
+	StoreRetryWait = 100 * time.Millisecond
+
+	// StoreRetryAfter is the wait suggested to clients when the small data store is
+	// unavailable.
+	StoreRetryAfter = 5 * time.Second
+)
+
+// smallDataStore returns the store used for label RLEs and other small data.  It can be
+// replaced to simulate storage failures in tests.
+var smallDataStore = storage.SmallDataStore
+
+// acquireSmallData returns the small data store, retrying failures up to StoreRetries times
+// before returning a retryable error.
+func acquireSmallData() (storage.SmallDataStorer, error) {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var smalldata storage.SmallDataStorer
+		if smalldata, err = smallDataStore(); err == nil && smalldata == nil {
+			err = fmt.Errorf("no small data store is available")
+		}
+		if err == nil {
+			return smalldata, nil
+		}
+		if attempt == StoreRetries {
+			return nil, storeUnavailable(err)
+		}
+		dvid.Infof("Retrying small data store after attempt %d failed: %s\n", attempt+1, err.Error())
+		time.Sleep(StoreRetryWait)
+	}
+}
+
+// storeUnavailable returns a retryable error for a storage failure that occurred before
+// anything was modified.
+func storeUnavailable(err error) error {
+	if _, ok := err.(*server.Error); ok {
+		return err
+	}
+	return server.NewRetryableError(StoreRetryAfter, "Storage is temporarily unavailable: %s", err.Error())
+}
+
+// storageError returns an error for a failure reading or writing the store.  Errors that
+// already have a kind, e.g., labels that don't exist, keep it.
+func storageError(err error) error {
+	if _, ok := err.(*server.Error); ok {
+		return err
+	}
+	return server.NewError(server.StorageError, "%s", err.Error())
+}
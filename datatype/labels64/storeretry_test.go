@@ -0,0 +1,135 @@
+package labels64
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+// flakyStore fails its first failReads range reads.
+type flakyStore struct {
+	storage.SmallDataStorer
+	failReads int32
+}
+
+func (fs *flakyStore) ProcessRange(ctx storage.Context, kStart, kEnd []byte, op *storage.ChunkOp, f storage.ChunkProcessor) error {
+	if atomic.AddInt32(&fs.failReads, -1) >= 0 {
+		return fmt.Errorf("simulated read failure")
+	}
+	return fs.SmallDataStorer.ProcessRange(ctx, kStart, kEnd, op, f)
+}
+
+func (fs *flakyStore) NewBatch(ctx storage.Context) storage.Batch {
+	return fs.SmallDataStorer.(storage.KeyValueBatcher).NewBatch(ctx)
+}
+
+// failingStoreGetter returns a replacement for smallDataStore that fails its first n calls
+// and then returns the given store.
+func failingStoreGetter(n int32, store storage.SmallDataStorer) func() (storage.SmallDataStorer, error) {
+	return func() (storage.SmallDataStorer, error) {
+		if atomic.AddInt32(&n, -1) >= 0 {
+			return nil, fmt.Errorf("simulated store reinitialization")
+		}
+		return store, nil
+	}
+}
+
+func TestMergeStoreUnavailable(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+	defer func(wait time.Duration) {
+		smallDataStore = storage.SmallDataStore
+		StoreRetryWait = wait
+	}(StoreRetryWait)
+	StoreRetryWait = 0
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 340, "flakylabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	defer d.waitFinishing()
+	ctx := datastore.NewVersionedContext(d, versionID)
+	for label := uint64(1); label <= 4; label++ {
+		block := dvid.IndexZYX{int32(label), 0, 0}
+		rles := blockRLEs{string(block.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{int32(label) * 32, 0, 0}, 10)}}
+		if err := putLabelRLEs(ctx, label, rles, map[string]bool{string(block.Bytes()): true}); err != nil {
+			t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+		}
+	}
+	store, err := storage.SmallDataStore()
+	if err != nil {
+		t.Fatalf("Unable to get small data store: %s\n", err.Error())
+	}
+
+	merge := func(body, key string) *httptest.ResponseRecorder {
+		apiStr := fmt.Sprintf("%snode/%s/flakylabels/merge?strict=true", server.WebAPIPath, uuid)
+		r, _ := http.NewRequest("POST", apiStr, strings.NewReader(body))
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+		return w
+	}
+	// checkUnmodified verifies a failed merge left no trace.
+	checkUnmodified := func(labels ...uint64) {
+		smallDataStore = storage.SmallDataStore
+		for _, label := range labels {
+			if size, err := labelSize(ctx, label); err != nil || size != 10 {
+				t.Errorf("Expected label %d unmodified after failed merge, got %d voxels, %v\n", label, size, err)
+			}
+		}
+		intents, err := d.getIntents()
+		if err != nil || len(intents) != 0 || len(d.pendingIntents()) != 0 {
+			t.Errorf("Expected no intents after failed merge, got %d stored, %d pending, %v\n", len(intents), len(d.pendingIntents()), err)
+		}
+	}
+
+	// Transient failures to get the store are retried within the request.
+	smallDataStore = failingStoreGetter(int32(StoreRetries), store)
+	if w := merge("[[1, 2]]", "merge-a"); w.Code != http.StatusOK {
+		t.Fatalf("Expected merge after transient store failures, got %d %s\n", w.Code, w.Body.String())
+	}
+	// Let relabeling finish before the store fails again.
+	d.waitFinishing()
+
+	// Longer failures are retryable errors that leave the labels unmodified.
+	smallDataStore = failingStoreGetter(int32(StoreRetries+1), store)
+	w := merge("[[3, 4]]", "merge-b")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "5" {
+		t.Fatalf("Expected 503 with Retry-After when store is unavailable, got %d %q %s\n",
+			w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+	checkUnmodified(3, 4)
+
+	// Failures to read the store before modification are also retryable.
+	smallDataStore = failingStoreGetter(0, &flakyStore{store, 1})
+	if w = merge("[[3, 4]]", "merge-b"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 503 with Retry-After on read failure, got %d %s\n", w.Code, w.Body.String())
+	}
+	checkUnmodified(3, 4)
+
+	// The client's retry with the same key succeeds once the store recovers.
+	smallDataStore = failingStoreGetter(0, &flakyStore{store, 0})
+	w = merge("[[3, 4]]", "merge-b")
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("Expected merge to succeed after store recovery, got %d %s\n", w.Code, w.Body.String())
+	}
+	smallDataStore = storage.SmallDataStore
+	d.waitFinishing()
+	if size, err := labelSize(ctx, 3); err != nil || size != 20 {
+		t.Errorf("Expected label 3 to have 20 voxels after merge, got %d, %v\n", size, err)
+	}
+}
@@ -0,0 +1,350 @@
+/*
+	This file supports generating synthetic labels for load testing, e.g., of merges and
+	caches on realistically large instances.  Each label is a blob grown by a random walk
+	over the rows of its own cell of the volume, with one run of voxels per row, so labels
+	are spatially coherent and never overlap.  The runs are partitioned into the blocks of
+	the data, and everything is derived from a seed so benchmarks are reproducible.
+*/
+
+package labels64
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// Distributions of the sizes of generated labels.
+const (
+	// SizesFixed gives every label the mean size.
+	SizesFixed = "fixed"
+
+	// SizesUniform draws sizes uniformly from 1 to twice the mean size.
+	SizesUniform = "uniform"
+
+	// SizesZipf gives the label of rank k a size proportional to 1/k, so a few labels are
+	// huge and most are small as in real segmentations.
+	SizesZipf = "zipf"
+)
+
+const (
+	// DefaultTestLabels is the number of generated labels if none is given.
+	DefaultTestLabels = 1000
+
+	// DefaultTestMeanSize is the mean voxels of generated labels if none is given.
+	DefaultTestMeanSize = 50000
+
+	// maxTestVoxels bounds the total voxels generated by one request.
+	maxTestVoxels = 1 << 40
+
+	// Runs of generated labels are from minTestRun to maxTestRun voxels long, and their
+	// starts vary by up to testRunJitter voxels along x.
+	minTestRun    = 8
+	maxTestRun    = 64
+	testRunJitter = 16
+
+	// testShelfWidth is the x extent of the volume filled by cells before a new row of
+	// cells is started along y.
+	testShelfWidth = 4096
+)
+
+// TestDataOptions configure the synthetic labels of GenerateTestData.
+type TestDataOptions struct {
+	Labels       int    // number of labels, which have ids 1 to Labels, or 0 for DefaultTestLabels
+	MeanSize     uint64 // mean voxels per label or 0 for DefaultTestMeanSize
+	Distribution string // distribution of label sizes, SizesZipf if empty
+	Seed         int64  // seed of the generator
+	Force        bool   // generate labels even if the data already has labels
+}
+
+// TestDataReport gives the throughput of a generation and statistics of the resulting
+// label key space.
+type TestDataReport struct {
+	Distribution string
+	Seed         int64
+	Labels       int
+	Replaced     int // number of existing labels overwritten with Force
+	Voxels       uint64
+	Elapsed      time.Duration
+	VoxelsPerSec float64
+	BlocksPerSec float64
+
+	Blocks        uint64 // number of label block keys
+	Bytes         uint64 // bytes of serialized RLEs
+	Runs          uint64
+	MeanRunLength float64
+	MeanBlocks    float64 // mean blocks of a label
+	MinBlocks     uint64  // fewest blocks of a label
+	MaxBlocks     uint64  // most blocks of a label
+	LargestLabel  uint64  // voxels of the largest label
+	Extents       dvid.Point3d
+}
+
+// String returns a summary of the report.
+func (r *TestDataReport) String() string {
+	return fmt.Sprintf("Generated %d labels (%s sizes, seed %d) with %d voxels in %s: %.0f voxels/sec, %.0f blocks/sec\n"+
+		"Key space: %d label blocks, %d bytes of RLEs, %d runs of mean length %.1f, %.1f blocks/label (min %d, max %d), "+
+		"largest label %d voxels, extents %s\n",
+		r.Labels, r.Distribution, r.Seed, r.Voxels, r.Elapsed, r.VoxelsPerSec, r.BlocksPerSec,
+		r.Blocks, r.Bytes, r.Runs, r.MeanRunLength, r.MeanBlocks, r.MinBlocks, r.MaxBlocks,
+		r.LargestLabel, r.Extents)
+}
+
+// testLabelSizes returns the sizes of generated labels in label order.
+func testLabelSizes(rng *rand.Rand, numLabels int, meanSize uint64, distribution string) ([]uint64, error) {
+	sizes := make([]uint64, numLabels)
+	switch distribution {
+	case SizesFixed:
+		for i := range sizes {
+			sizes[i] = meanSize
+		}
+	case SizesUniform:
+		for i := range sizes {
+			sizes[i] = 1 + uint64(rng.Int63n(int64(2*meanSize-1)))
+		}
+	case SizesZipf:
+		// Ranks are shuffled so label ids don't give their sizes.
+		var harmonic float64
+		for k := 1; k <= numLabels; k++ {
+			harmonic += 1 / float64(k)
+		}
+		total := float64(meanSize) * float64(numLabels)
+		for i, rank := range rng.Perm(numLabels) {
+			size := uint64(total / (harmonic * float64(rank+1)))
+			if size == 0 {
+				size = 1
+			}
+			sizes[i] = size
+		}
+	default:
+		return nil, fmt.Errorf("Unknown size distribution %q; use %q, %q, or %q", distribution, SizesFixed, SizesUniform, SizesZipf)
+	}
+	return sizes, nil
+}
+
+// testCell is the region of the volume a generated label's blob grows in.  Rows are
+// indexed by y and z offsets within the cell.
+type testCell struct {
+	origin dvid.Point3d
+	side   int32 // rows along y and z
+}
+
+// testCellSide returns the rows along y and z of a cell large enough for a label of the
+// given size made of the shortest runs.
+func testCellSide(size uint64) int32 {
+	rows := (size + minTestRun - 1) / minTestRun
+	return int32(math.Ceil(math.Sqrt(float64(rows)))) + 1
+}
+
+// testCells lays out the cells of labels of the given sizes along x in shelves that are
+// stacked along y, returning the cells and the extents of the volume.
+func testCells(sizes []uint64) ([]testCell, dvid.Point3d) {
+	cellWidth := int32(maxTestRun + testRunJitter)
+	cells := make([]testCell, len(sizes))
+	var x, y, shelfHeight int32
+	var extents dvid.Point3d
+	for i, size := range sizes {
+		side := testCellSide(size)
+		if x > 0 && x+cellWidth > testShelfWidth {
+			x = 0
+			y += shelfHeight
+			shelfHeight = 0
+		}
+		cells[i] = testCell{dvid.Point3d{x, y, 0}, side}
+		x += cellWidth
+		if side > shelfHeight {
+			shelfHeight = side
+		}
+		if x > extents[0] {
+			extents[0] = x
+		}
+		if y+side > extents[1] {
+			extents[1] = y + side
+		}
+		if side > extents[2] {
+			extents[2] = side
+		}
+	}
+	return cells, extents
+}
+
+// testRow is a row of a cell given by its y and z offsets.
+type testRow [2]int32
+
+// generateTestLabel returns the block RLEs of a blob of the given size grown from the
+// center of its cell.  Each step of the walk moves to a random unused row next to the
+// blob and adds a run, whose x start drifts from the previous run's.
+func generateTestLabel(rng *rand.Rand, cell testCell, size uint64, blockSize dvid.Point3d) blockRLEs {
+	rles := make(blockRLEs)
+	center := testRow{cell.side / 2, cell.side / 2}
+	used := map[testRow]bool{center: true}
+	frontier := []testRow{center}
+	start := int32(testRunJitter / 2)
+	for remaining := size; remaining > 0 && len(frontier) > 0; {
+		// Take a random row of the frontier.
+		i := rng.Intn(len(frontier))
+		row := frontier[i]
+		frontier[i] = frontier[len(frontier)-1]
+		frontier = frontier[:len(frontier)-1]
+
+		length := int32(minTestRun + rng.Intn(maxTestRun-minTestRun+1))
+		if uint64(length) > remaining {
+			length = int32(remaining)
+		}
+		start += int32(rng.Intn(5)) - 2
+		if start < 0 {
+			start = 0
+		} else if start > testRunJitter {
+			start = testRunJitter
+		}
+		runStart := dvid.Point3d{cell.origin[0] + start, cell.origin[1] + row[0], cell.origin[2] + row[1]}
+		addTestRun(rles, runStart, length, blockSize)
+		remaining -= uint64(length)
+
+		for _, next := range []testRow{{row[0] - 1, row[1]}, {row[0] + 1, row[1]}, {row[0], row[1] - 1}, {row[0], row[1] + 1}} {
+			if next[0] < 0 || next[1] < 0 || next[0] >= cell.side || next[1] >= cell.side || used[next] {
+				continue
+			}
+			used[next] = true
+			frontier = append(frontier, next)
+		}
+	}
+	for blockStr, runs := range rles {
+		rles[blockStr] = runs.Normalize()
+	}
+	return rles
+}
+
+// addTestRun adds a run along x to the RLEs of the blocks it spans.
+func addTestRun(rles blockRLEs, start dvid.Point3d, length int32, blockSize dvid.Point3d) {
+	for length > 0 {
+		block := dvid.IndexZYX{start[0] / blockSize[0], start[1] / blockSize[1], start[2] / blockSize[2]}
+		n := (block[0]+1)*blockSize[0] - start[0]
+		if n > length {
+			n = length
+		}
+		blockStr := string(block.Bytes())
+		rles[blockStr] = append(rles[blockStr], dvid.NewRLE(start, n))
+		start[0] += n
+		length -= n
+	}
+}
+
+// GenerateTestData writes synthetic labels with ids 1 to opts.Labels at the context's
+// version, along with their sizes.  Labels are written one at a time with their blocks in
+// batches, and the same options always give the same labels.  Data that already has labels
+// is refused unless opts.Force is set, in which case existing labels with the generated
+// ids are replaced.  Surfaces aren't computed.
+func (d *Data) GenerateTestData(ctx *datastore.VersionedContext, opts TestDataOptions) (*TestDataReport, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	blockSize, ok := d.BlockSize().(dvid.Point3d)
+	if !ok {
+		return nil, fmt.Errorf("Data %q has no 3d block size", d.DataName())
+	}
+	if opts.Labels == 0 {
+		opts.Labels = DefaultTestLabels
+	}
+	if opts.MeanSize == 0 {
+		opts.MeanSize = DefaultTestMeanSize
+	}
+	if opts.Distribution == "" {
+		opts.Distribution = SizesZipf
+	}
+	opts.Distribution = strings.ToLower(opts.Distribution)
+	if opts.Labels < 0 {
+		return nil, fmt.Errorf("Can't generate %d labels", opts.Labels)
+	}
+	if float64(opts.Labels)*float64(opts.MeanSize) > maxTestVoxels {
+		return nil, fmt.Errorf("Can't generate %d labels of mean size %d: more than %d voxels", opts.Labels, opts.MeanSize, int64(maxTestVoxels))
+	}
+	if !opts.Force {
+		existing, err := ListLabels(ctx, 0, 1, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(existing.Labels) != 0 {
+			return nil, fmt.Errorf("Data %q already has labels; use --force to generate labels anyway", d.DataName())
+		}
+	}
+
+	rng := rand.New(rand.NewSource(opts.Seed))
+	sizes, err := testLabelSizes(rng, opts.Labels, opts.MeanSize, opts.Distribution)
+	if err != nil {
+		return nil, err
+	}
+	cells, extents := testCells(sizes)
+	report := &TestDataReport{Labels: opts.Labels, Extents: extents, Distribution: opts.Distribution, Seed: opts.Seed}
+	start := time.Now()
+	sizeMods := make(map[uint64]sizeChange, maxBlockBatch)
+	for i, size := range sizes {
+		label := uint64(i + 1)
+
+		// Each label has its own generator so it doesn't depend on the others.
+		labelRNG := rand.New(rand.NewSource(opts.Seed + int64(label)*7919))
+		rles := generateTestLabel(labelRNG, cells[i], size, blockSize)
+		var oldSize uint64
+		if opts.Force {
+			existing, err := getLabelRLEs(ctx, label)
+			if err != nil {
+				return nil, err
+			}
+			if len(existing) != 0 {
+				if err := deleteLabelBlocks(ctx, label, existing.blocks()); err != nil {
+					return nil, err
+				}
+				oldSize = existing.numVoxels()
+				report.Replaced++
+			}
+		}
+		if err := putLabelRLEs(ctx, label, rles, rles.blocks()); err != nil {
+			return nil, err
+		}
+
+		numVoxels, numBlocks := rles.numVoxels(), uint64(len(rles))
+		sizeMods[label] = sizeChange{oldSize, numVoxels}
+		if len(sizeMods) == maxBlockBatch {
+			updateLabelSizes(ctx, sizeMods, "generate")
+			sizeMods = make(map[uint64]sizeChange, maxBlockBatch)
+		}
+		report.Voxels += numVoxels
+		report.Blocks += numBlocks
+		for _, blockRLEs := range rles {
+			report.Runs += uint64(len(blockRLEs))
+			report.Bytes += uint64(16 * len(blockRLEs))
+		}
+		if i == 0 || numBlocks < report.MinBlocks {
+			report.MinBlocks = numBlocks
+		}
+		if numBlocks > report.MaxBlocks {
+			report.MaxBlocks = numBlocks
+		}
+		if numVoxels > report.LargestLabel {
+			report.LargestLabel = numVoxels
+		}
+	}
+	if len(sizeMods) != 0 {
+		updateLabelSizes(ctx, sizeMods, "generate")
+	}
+	d.invalidateAdjacency(ctx.VersionID(), nil)
+	d.resetCompartments()
+
+	report.Elapsed = time.Since(start)
+	if seconds := report.Elapsed.Seconds(); seconds > 0 {
+		report.VoxelsPerSec = float64(report.Voxels) / seconds
+		report.BlocksPerSec = float64(report.Blocks) / seconds
+	}
+	if report.Labels > 0 {
+		report.MeanBlocks = float64(report.Blocks) / float64(report.Labels)
+	}
+	if report.Runs > 0 {
+		report.MeanRunLength = float64(report.Voxels) / float64(report.Runs)
+	}
+	return report, nil
+}
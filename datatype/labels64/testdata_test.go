@@ -0,0 +1,174 @@
+package labels64
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+// generatedData returns new data with synthetic labels.
+func generatedData(tb testing.TB, id dvid.InstanceID, name dvid.DataString, opts TestDataOptions) (*Data, *datastore.VersionedContext, *TestDataReport) {
+	repo, versionID := initTestRepo()
+	d, err := NewData(repo.RootUUID(), id, name, dvid.NewConfig())
+	if err != nil {
+		tb.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	report, err := d.GenerateTestData(ctx, opts)
+	if err != nil {
+		tb.Fatalf("Unable to generate test data: %s\n", err.Error())
+	}
+	return d, ctx, report
+}
+
+// generatedRun is a run of a generated label.
+type generatedRun struct {
+	label uint64
+	rle   dvid.RLE
+}
+
+type generatedRuns []generatedRun
+
+func (r generatedRuns) Len() int      { return len(r) }
+func (r generatedRuns) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r generatedRuns) Less(i, j int) bool {
+	a, b := r[i].rle.StartPt(), r[j].rle.StartPt()
+	if a[2] != b[2] {
+		return a[2] < b[2]
+	}
+	if a[1] != b[1] {
+		return a[1] < b[1]
+	}
+	return a[0] < b[0]
+}
+
+func TestGenerateTestData(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	opts := TestDataOptions{Labels: 40, MeanSize: 3000, Distribution: "zipf", Seed: 42}
+	d, ctx, report := generatedData(t, 471, "generated1", opts)
+	sizes, err := testLabelSizes(rand.New(rand.NewSource(42)), 40, 3000, SizesZipf)
+	if err != nil {
+		t.Fatalf("Unable to get label sizes: %s\n", err.Error())
+	}
+	var total uint64
+	for _, size := range sizes {
+		total += size
+	}
+	if report.Labels != 40 || report.Voxels != total || report.Blocks == 0 || report.MinBlocks == 0 ||
+		report.MaxBlocks < report.MinBlocks || report.Bytes != 16*report.Runs || report.LargestLabel <= 3000 {
+		t.Errorf("Bad report of generated labels: %+v\n", report)
+	}
+
+	// Labels have their sizes, are stored with them, and don't overlap.
+	stored, err := getAllLabelSizes(ctx)
+	if err != nil {
+		t.Fatalf("Unable to get label sizes: %s\n", err.Error())
+	}
+	var runs generatedRuns
+	var numBlocks uint64
+	labelRLEs := make(map[uint64]blockRLEs, len(sizes))
+	for i, size := range sizes {
+		label := uint64(i + 1)
+		rles, err := getLabelRLEs(ctx, label)
+		if err != nil {
+			t.Fatalf("Unable to get RLEs of label %d: %s\n", label, err.Error())
+		}
+		if rles.numVoxels() != size || stored[label] != size {
+			t.Errorf("Expected label %d to have %d voxels, got %d with stored size %d\n", label, size, rles.numVoxels(), stored[label])
+		}
+		for blockStr, blockRLEs := range rles {
+			var block dvid.IndexZYX
+			if err := block.IndexFromBytes([]byte(blockStr)); err != nil {
+				t.Fatalf("Bad block of label %d: %s\n", label, err.Error())
+			}
+			for _, rle := range blockRLEs {
+				start := rle.StartPt()
+				if start[0]/32 != block[0] || (start[0]+rle.Length()-1)/32 != block[0] ||
+					start[1]/32 != block[1] || start[2]/32 != block[2] {
+					t.Fatalf("Run %s of label %d isn't within its block %v\n", rle, label, block)
+				}
+				runs = append(runs, generatedRun{label, rle})
+			}
+		}
+		numBlocks += uint64(len(rles))
+		labelRLEs[label] = rles
+	}
+	if numBlocks != report.Blocks {
+		t.Errorf("Expected %d label blocks, got %d\n", report.Blocks, numBlocks)
+	}
+	sort.Sort(runs)
+	for i := 1; i < len(runs); i++ {
+		prev, cur := runs[i-1].rle.StartPt(), runs[i].rle.StartPt()
+		if prev[1] == cur[1] && prev[2] == cur[2] && prev[0]+runs[i-1].rle.Length() > cur[0] {
+			t.Fatalf("Runs %s of label %d and %s of label %d overlap\n", runs[i-1].rle, runs[i-1].label, runs[i].rle, runs[i].label)
+		}
+	}
+
+	// The same options give the same labels, and other seeds don't.
+	_, ctx2, report2 := generatedData(t, 472, "generated2", opts)
+	if report2.Blocks != report.Blocks || report2.Runs != report.Runs || report2.Extents != report.Extents {
+		t.Errorf("Expected same key space for same seed, got %+v and %+v\n", report, report2)
+	}
+	for label, rles := range labelRLEs {
+		rles2, err := getLabelRLEs(ctx2, label)
+		if err != nil {
+			t.Fatalf("Unable to get RLEs of label %d: %s\n", label, err.Error())
+		}
+		if !reflect.DeepEqual(rles, rles2) {
+			t.Fatalf("Expected label %d to be the same for the same seed\n", label)
+		}
+	}
+	opts.Seed = 43
+	if _, _, report3 := generatedData(t, 473, "generated3", opts); report3.Runs == report.Runs && report3.Blocks == report.Blocks {
+		t.Errorf("Expected different labels for a different seed, got %+v\n", report3)
+	}
+
+	// Data with labels is refused unless forced.
+	opts.Seed = 42
+	if _, err := d.GenerateTestData(ctx, opts); err == nil {
+		t.Errorf("Expected error generating labels in data that has labels\n")
+	}
+	opts.Labels, opts.Force = 10, true
+	if report, err = d.GenerateTestData(ctx, opts); err != nil || report.Replaced != 10 {
+		t.Errorf("Expected forced generation to replace 10 labels, got %+v, %v\n", report, err)
+	}
+	opts.Distribution = "normal"
+	if _, err := d.GenerateTestData(ctx, opts); err == nil {
+		t.Errorf("Expected error for unknown size distribution\n")
+	}
+}
+
+func BenchmarkReadGeneratedLabel(b *testing.B) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	_, ctx, _ := generatedData(b, 474, "benchgenerated", TestDataOptions{Labels: 100, MeanSize: 20000, Seed: 1})
+	sizes, err := getAllLabelSizes(ctx)
+	if err != nil {
+		b.Fatalf("Unable to get label sizes: %s\n", err.Error())
+	}
+	var largest uint64
+	for label, size := range sizes {
+		if size > sizes[largest] {
+			largest = label
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rles, err := getLabelRLEs(ctx, largest)
+		if err != nil {
+			b.Fatalf("Unable to get label RLEs: %s\n", err.Error())
+		}
+		if rles.numVoxels() != sizes[largest] {
+			b.Fatalf("Bad label size\n")
+		}
+	}
+}
@@ -0,0 +1,514 @@
+/*
+	This file supports a recoverable trash for labels.  Trashing a label moves its stored
+	RLEs into the trash key space by rewriting the first byte of each key, so values are
+	never copied or decoded, and records who trashed the label and when.  A trashed label can
+	be restored under its own id or, if the id was reused, under a new one.  Labels in the
+	trash longer than the TrashRetention period are purged in the background.
+
+	Trashing and restoring change only the sparse volume of the label along with its size,
+	size history, and surface.  Label blocks still give the label's id for its voxels.
+*/
+
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// DefaultTrashRetention is how long labels stay in the trash if the TrashRetention setting
+// is 0.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// TrashPurgeInterval is the shortest time between background purges of expired labels
+// from the trash of a data instance.
+var TrashPurgeInterval = time.Hour
+
+// trashMu guards lastTrashPurge, the time each data instance's trash was last purged.
+var (
+	trashMu        sync.Mutex
+	lastTrashPurge = make(map[dvid.InstanceID]time.Time)
+)
+
+// intentMoveRLEs is the phase of a trash or restore where the label's RLEs are being moved
+// between the sparse volume and trash key spaces.  Moves can be repeated since moved keys
+// are no longer in the range being moved.
+const intentMoveRLEs = "move-rles"
+
+// TrashRecord describes a label in the trash.
+type TrashRecord struct {
+	Label uint64    `json:"label"`
+	Size  uint64    `json:"size"`
+	User  string    `json:"user,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// TrashedLabel is a label in the trash with how long it has been there and when it will be
+// purged.
+type TrashedLabel struct {
+	TrashRecord
+	Age     string    `json:"age"`
+	Expires time.Time `json:"expires"`
+}
+
+// RestoredLabel describes a label restored from the trash.
+type RestoredLabel struct {
+	Label        uint64 `json:"label"`
+	TrashedLabel uint64 `json:"trashed_label"`
+	Size         uint64 `json:"size"`
+	Blocks       uint64 `json:"blocks"`
+}
+
+// trashRetention returns how long labels stay in the trash.
+func (d *Data) trashRetention() time.Duration {
+	if d.TrashRetention > 0 {
+		return d.TrashRetention
+	}
+	return DefaultTrashRetention
+}
+
+// getTrashRecord returns the record of a trashed label or nil if the label isn't in the
+// trash at the context's version.
+func getTrashRecord(ctx *datastore.VersionedContext, label uint64) (*TrashRecord, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	value, err := smalldata.Get(ctx, voxels.NewLabelTrashRecordIndex(label))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	record := new(TrashRecord)
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, fmt.Errorf("Bad trash record of label %d: %s", label, err.Error())
+	}
+	return record, nil
+}
+
+// moveRLEs moves the stored RLEs in an index range at the context's version to the indices
+// given by the move function, which also returns the index being moved from.  Values are
+// moved unchanged in batches of CompactBatchSize keys, and the number of keys is returned.
+func moveRLEs(ctx *datastore.VersionedContext, begIndex, endIndex dvid.IndexBytes,
+	move func(key []byte) (from, to dvid.IndexBytes, err error)) (uint64, error) {
+
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return 0, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	batcher, ok := smalldata.(storage.KeyValueBatcher)
+	if !ok {
+		return 0, fmt.Errorf("Database doesn't support Batch ops in moveRLEs()")
+	}
+	rleMu.RLock()
+	defer rleMu.RUnlock()
+	var moved, batched uint64
+	batch := batcher.NewBatch(ctx)
+	var f storage.ChunkProcessor = func(chunk *storage.Chunk) error {
+		from, to, err := move(chunk.K)
+		if err != nil {
+			return err
+		}
+		batch.Put(to, append([]byte{}, chunk.V...))
+		batch.Delete(from)
+		moved++
+		if batched++; batched >= uint64(CompactBatchSize) {
+			if err := batch.Commit(); err != nil {
+				return fmt.Errorf("Unable to write batch of moved RLEs: %s", err.Error())
+			}
+			batch, batched = batcher.NewBatch(ctx), 0
+		}
+		return nil
+	}
+	if err := smalldata.ProcessRange(ctx, begIndex, endIndex, &storage.ChunkOp{}, f); err != nil {
+		return moved, err
+	}
+	if err := batch.Commit(); err != nil {
+		return moved, fmt.Errorf("Unable to write batch of moved RLEs: %s", err.Error())
+	}
+	return moved, nil
+}
+
+// TrashLabel moves a label's sparse volume into the trash at the context's version.  The
+// label's size becomes zero and its surface is deleted.
+func (d *Data) TrashLabel(ctx *datastore.VersionedContext, label uint64, user string) (*TrashRecord, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	if d.backfillRunning() {
+		return nil, server.NewError(server.ConflictError, "Can't trash labels of data %q while a backfill runs", d.DataName())
+	}
+	record, err := getTrashRecord(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		return nil, server.NewError(server.ConflictError, "Label %d of data %q is already in the trash", label, d.DataName())
+	}
+	size, err := labelSize(ctx, label)
+	if err != nil {
+		return nil, storeUnavailable(fmt.Errorf("Can't count voxels of label %d: %s", label, err.Error()))
+	}
+	if size == 0 {
+		return nil, server.NewError(server.NotFoundError, "Label %d of data %q has no voxels to trash", label, d.DataName())
+	}
+	intent := &mergeIntent{
+		ID:     newIntentID(),
+		Op:     "trash",
+		Phase:  intentMoveRLEs,
+		Tuples: MergeTuples{{label}},
+		Sizes:  []intentSize{{label, size, 0}},
+		User:   user,
+	}
+	if err := d.putIntent(ctx, intent); err != nil {
+		return nil, storeUnavailable(err)
+	}
+	if err := d.finishTrash(ctx, intent); err != nil {
+		d.needsRepair(ctx.VersionID(), intent, err)
+		return nil, server.NewError(server.StorageError, "Trash of label %d interrupted and needs repair: %s", label, err.Error())
+	}
+	return getTrashRecord(ctx, label)
+}
+
+// finishTrash records a trashed label and moves its RLEs into the trash, then updates its
+// size and surface and deletes the intent.
+func (d *Data) finishTrash(ctx *datastore.VersionedContext, intent *mergeIntent) error {
+	if len(intent.Tuples) != 1 || len(intent.Tuples[0]) != 1 || len(intent.Sizes) != 1 {
+		return fmt.Errorf("Bad trash intent %d", intent.ID)
+	}
+	label := intent.Tuples[0][0]
+	record, err := getTrashRecord(ctx, label)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		smalldata, err := smallDataStore()
+		if err != nil {
+			return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+		}
+		// Intent ids are the time the operation began.
+		record = &TrashRecord{label, intent.Sizes[0].OldSize, intent.User, time.Unix(0, int64(intent.ID))}
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := smalldata.Put(ctx, voxels.NewLabelTrashRecordIndex(label), value); err != nil {
+			return fmt.Errorf("Unable to store trash record of label %d: %s", label, err.Error())
+		}
+	}
+
+	begIndex, endIndex := voxels.LabelRange(label)
+	_, err = moveRLEs(ctx, begIndex, endIndex, func(key []byte) (from, to dvid.IndexBytes, err error) {
+		label, blockBytes, err := voxels.DecodeLabelSpatialMapKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return voxels.NewLabelSpatialMapIndex(label, blockBytes), voxels.NewLabelTrashIndex(label, blockBytes), nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to move label %d RLEs to trash: %s", label, err.Error())
+	}
+	bigdata, err := storage.BigDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles big data: %s\n", err.Error())
+	}
+	if err := bigdata.Delete(ctx, voxels.NewLabelSurfaceIndex(label)); err != nil {
+		return fmt.Errorf("Can't delete label %d surface: %s", label, err.Error())
+	}
+	updateLabelSizes(ctx, intent.sizeMods(), "trash")
+	d.invalidateAdjacency(ctx.VersionID(), intent.labels())
+	d.invalidateCompartments(ctx.VersionID(), intent.labels())
+	if err := putLastMutation(ctx, label, labelMutation{intent.ID, time.Now()}); err != nil {
+		return err
+	}
+	d.purgeTrashInBackground()
+	return d.deleteIntent(ctx, intent.ID)
+}
+
+// RestoreTrashedLabel moves a trashed label's sparse volume out of the trash at the
+// context's version, under the given new label if it's not zero.  Restores onto a label
+// that has voxels, e.g., a trashed label's id that has since been reused, are refused.
+func (d *Data) RestoreTrashedLabel(ctx *datastore.VersionedContext, label, newLabel uint64, user string) (*RestoredLabel, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	if d.backfillRunning() {
+		return nil, server.NewError(server.ConflictError, "Can't restore labels of data %q while a backfill runs", d.DataName())
+	}
+	record, err := getTrashRecord(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, server.NewError(server.NotFoundError, "Label %d of data %q isn't in the trash", label, d.DataName())
+	}
+	target := label
+	if newLabel != 0 {
+		target = newLabel
+	}
+	size, err := labelSize(ctx, target)
+	if err != nil {
+		return nil, storeUnavailable(fmt.Errorf("Can't count voxels of label %d: %s", target, err.Error()))
+	}
+	if size != 0 {
+		if target == label {
+			return nil, server.NewError(server.ConflictError,
+				"Label %d of data %q was reused after it was trashed; restore it under a new id with \"?label=<new id>\"",
+				label, d.DataName())
+		}
+		return nil, server.NewError(server.ConflictError, "Can't restore label %d as label %d of data %q, which has voxels",
+			label, target, d.DataName())
+	}
+	intent := &mergeIntent{
+		ID:     newIntentID(),
+		Op:     "restore",
+		Phase:  intentMoveRLEs,
+		Tuples: MergeTuples{{target, label}},
+		Sizes:  []intentSize{{target, 0, record.Size}},
+		User:   user,
+	}
+	if err := d.putIntent(ctx, intent); err != nil {
+		return nil, storeUnavailable(err)
+	}
+	blocks, err := d.finishRestore(ctx, intent)
+	if err != nil {
+		d.needsRepair(ctx.VersionID(), intent, err)
+		return nil, server.NewError(server.StorageError, "Restore of label %d interrupted and needs repair: %s", label, err.Error())
+	}
+	return &RestoredLabel{Label: target, TrashedLabel: label, Size: record.Size, Blocks: blocks}, nil
+}
+
+// finishRestore moves a trashed label's RLEs out of the trash and deletes its trash
+// record, then updates the size and surface of the restored label and deletes the intent.
+// The number of blocks moved is returned.
+func (d *Data) finishRestore(ctx *datastore.VersionedContext, intent *mergeIntent) (uint64, error) {
+	if len(intent.Tuples) != 1 || len(intent.Tuples[0]) != 2 {
+		return 0, fmt.Errorf("Bad restore intent %d", intent.ID)
+	}
+	target, label := intent.Tuples[0][0], intent.Tuples[0][1]
+	begIndex, endIndex := voxels.LabelTrashRange(label)
+	blocks, err := moveRLEs(ctx, begIndex, endIndex, func(key []byte) (from, to dvid.IndexBytes, err error) {
+		label, blockBytes, err := voxels.DecodeLabelTrashKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return voxels.NewLabelTrashIndex(label, blockBytes), voxels.NewLabelSpatialMapIndex(target, blockBytes), nil
+	})
+	if err != nil {
+		return blocks, fmt.Errorf("Unable to move label %d RLEs from trash: %s", label, err.Error())
+	}
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return blocks, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	if err := smalldata.Delete(ctx, voxels.NewLabelTrashRecordIndex(label)); err != nil {
+		return blocks, fmt.Errorf("Unable to delete trash record of label %d: %s", label, err.Error())
+	}
+	updateLabelSizes(ctx, intent.sizeMods(), "restore")
+	d.invalidateAdjacency(ctx.VersionID(), intent.labels())
+	d.invalidateCompartments(ctx.VersionID(), intent.labels())
+	rles, err := getLabelRLEs(ctx, target)
+	if err != nil {
+		return blocks, err
+	}
+	d.recomputeSurface(ctx, target, rles)
+	if err := putLastMutation(ctx, target, labelMutation{intent.ID, time.Now()}); err != nil {
+		return blocks, err
+	}
+	return blocks, d.deleteIntent(ctx, intent.ID)
+}
+
+// ListTrash returns the labels in the trash at the context's version.
+func (d *Data) ListTrash(ctx *datastore.VersionedContext) ([]TrashedLabel, error) {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	kvs, err := smalldata.GetRange(ctx, voxels.NewLabelTrashRecordIndex(0), voxels.NewLabelTrashRecordIndex(math.MaxUint64))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	trashed := make([]TrashedLabel, 0, len(kvs))
+	for _, kv := range kvs {
+		var record TrashRecord
+		if err := json.Unmarshal(kv.V, &record); err != nil {
+			return nil, fmt.Errorf("Bad trash record %v: %s", kv.K, err.Error())
+		}
+		age := now.Sub(record.Time) / time.Second * time.Second
+		trashed = append(trashed, TrashedLabel{record, age.String(), record.Time.Add(d.trashRetention())})
+	}
+	return trashed, nil
+}
+
+// PurgeTrash permanently deletes the labels of all versions that were trashed before the
+// retention period ending at the given time, returning the number of labels purged.
+func (d *Data) PurgeTrash(now time.Time) (int, error) {
+	if err := d.checkWritable(); err != nil {
+		return 0, err
+	}
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return 0, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	batcher, ok := smalldata.(storage.KeyValueBatcher)
+	if !ok {
+		return 0, fmt.Errorf("Database doesn't support Batch ops in PurgeTrash()")
+	}
+
+	// Read the full keys of all versions without a versioned context.
+	dataCtx := storage.NewDataContext(d, 0)
+	minKey, err := dataCtx.MinVersionKey(voxels.NewLabelTrashRecordIndex(0))
+	if err != nil {
+		return 0, err
+	}
+	maxKey, err := dataCtx.MaxVersionKey(voxels.NewLabelTrashRecordIndex(math.MaxUint64))
+	if err != nil {
+		return 0, err
+	}
+	kvs, err := smalldata.GetRange(nil, minKey, maxKey)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := now.Add(-d.trashRetention())
+	var purged int
+	for _, kv := range kvs {
+		var record TrashRecord
+		if err := json.Unmarshal(kv.V, &record); err != nil {
+			return purged, fmt.Errorf("Bad trash record %v: %s", kv.K, err.Error())
+		}
+		if !record.Time.Before(cutoff) {
+			continue
+		}
+		_, versionID, err := storage.KeyToLocalIDs(kv.K)
+		if err != nil {
+			return purged, err
+		}
+		begIndex, endIndex := voxels.LabelTrashRange(record.Label)
+		if minKey, err = dataCtx.MinVersionKey(begIndex); err != nil {
+			return purged, err
+		}
+		if maxKey, err = dataCtx.MaxVersionKey(endIndex); err != nil {
+			return purged, err
+		}
+		var batched int
+		batch := batcher.NewBatch(nil)
+		var f storage.ChunkProcessor = func(chunk *storage.Chunk) error {
+			_, keyVersion, err := storage.KeyToLocalIDs(chunk.K)
+			if err != nil {
+				return err
+			}
+			if keyVersion != versionID {
+				return nil
+			}
+			batch.Delete(append([]byte{}, chunk.K...))
+			if batched++; batched >= CompactBatchSize {
+				if err := batch.Commit(); err != nil {
+					return fmt.Errorf("Unable to write batch of purged RLEs: %s", err.Error())
+				}
+				batch, batched = batcher.NewBatch(nil), 0
+			}
+			return nil
+		}
+		if err := smalldata.ProcessRange(nil, minKey, maxKey, &storage.ChunkOp{}, f); err != nil {
+			return purged, err
+		}
+		batch.Delete(kv.K)
+		if err := batch.Commit(); err != nil {
+			return purged, fmt.Errorf("Unable to write batch of purged RLEs: %s", err.Error())
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeTrashInBackground purges expired labels from the trash in a goroutine if the trash
+// wasn't purged within the last TrashPurgeInterval.
+func (d *Data) purgeTrashInBackground() {
+	if d.ReadOnly {
+		return
+	}
+	trashMu.Lock()
+	if time.Since(lastTrashPurge[d.InstanceID()]) < TrashPurgeInterval {
+		trashMu.Unlock()
+		return
+	}
+	lastTrashPurge[d.InstanceID()] = time.Now()
+	trashMu.Unlock()
+	go func() {
+		purged, err := d.PurgeTrash(time.Now())
+		if err != nil {
+			dvid.Errorf("Unable to purge trash of labels64 %q: %s\n", d.DataName(), err.Error())
+			return
+		}
+		if purged != 0 {
+			dvid.Infof("Purged %d expired labels from trash of labels64 %q\n", purged, d.DataName())
+		}
+	}()
+}
+
+// serveTrash handles requests to trash, restore, or list trashed labels.
+func (d *Data) serveTrash(repo datastore.Repo, ctx *datastore.VersionedContext, w http.ResponseWriter, r *http.Request,
+	requestID string, parts []string) {
+
+	endpoint := parts[3]
+	var result interface{}
+	switch {
+	case r.Method == "GET" && endpoint == "trash" && len(parts) == 4:
+		trashed, err := d.ListTrash(ctx)
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, storageError(err))
+			return
+		}
+		d.purgeTrashInBackground()
+		result = trashed
+	case r.Method == "POST" && len(parts) == 5:
+		if err := checkUnlocked(repo, ctx.VersionID()); err != nil {
+			lockedResponse(w, r, requestID, err)
+			return
+		}
+		label, err := strconv.ParseUint(parts[4], 10, 64)
+		if err != nil || label == 0 {
+			server.ErrorResponse(w, r, requestID, fmt.Errorf("Bad label %q in %s request", parts[4], endpoint))
+			return
+		}
+		user := server.RequestUser(r)
+		if endpoint == "trash" {
+			result, err = d.TrashLabel(ctx, label, user)
+		} else {
+			var newLabel uint64
+			if s := r.URL.Query().Get("label"); s != "" {
+				if newLabel, err = strconv.ParseUint(s, 10, 64); err != nil {
+					server.ErrorResponse(w, r, requestID, fmt.Errorf("Bad new label %q in restore request", s))
+					return
+				}
+			}
+			result, err = d.RestoreTrashedLabel(ctx, label, newLabel, user)
+		}
+		if err != nil {
+			server.ErrorResponse(w, r, requestID, err)
+			return
+		}
+		dvid.Infof("[%s] HTTP %s of label %d by %q (%s)\n", requestID, endpoint, label, user, r.URL)
+	default:
+		server.ErrorResponse(w, r, requestID, fmt.Errorf("%s endpoint only accepts POST of a label or GET of the trash", endpoint))
+		return
+	}
+	jsonBytes, err := json.Marshal(result)
+	if err != nil {
+		server.ErrorResponse(w, r, requestID, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
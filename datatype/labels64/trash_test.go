@@ -0,0 +1,144 @@
+package labels64
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestLabelTrash(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 450, "trashedlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	trashMu.Lock()
+	lastTrashPurge[d.InstanceID()] = time.Now()
+	trashMu.Unlock()
+
+	ctx := datastore.NewVersionedContext(d, versionID)
+	labelRLEs := make(map[uint64]blockRLEs)
+	for label := uint64(1); label <= 3; label++ {
+		rles := make(blockRLEs)
+		for x := int32(0); x < 2; x++ {
+			block := dvid.IndexZYX{x, int32(label), 0}
+			rles[string(block.Bytes())] = dvid.RLEs{dvid.NewRLE(dvid.Point3d{x*32 + 1, int32(label) * 32, 0}, 10)}
+		}
+		if err := putLabelRLEs(ctx, label, rles, rles.blocks()); err != nil {
+			t.Fatalf("Unable to store label %d: %s\n", label, err.Error())
+		}
+		labelRLEs[label] = rles
+	}
+	request := func(method, endpoint string, expected int) []byte {
+		apiStr := fmt.Sprintf("%snode/%s/trashedlabels/%s", server.WebAPIPath, uuid, endpoint)
+		r, _ := http.NewRequest(method, apiStr, nil)
+		r.Header.Set(server.UserHeader, "reviewer")
+		w := httptest.NewRecorder()
+		d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, versionID), w, r)
+		if w.Code != expected {
+			t.Fatalf("Expected status %d from %s %s, got %d: %s\n", expected, method, endpoint, w.Code, w.Body.String())
+		}
+		return w.Body.Bytes()
+	}
+	checkLabel := func(label uint64, expected blockRLEs) {
+		rles, err := getLabelRLEs(ctx, label)
+		if err != nil {
+			t.Fatalf("Unable to get RLEs of label %d: %s\n", label, err.Error())
+		}
+		if !reflect.DeepEqual(rles, expected) {
+			t.Errorf("Expected label %d RLEs %v, got %v\n", label, expected, rles)
+		}
+	}
+
+	// Trashing moves the label's RLEs into the trash and records who trashed it.
+	var record TrashRecord
+	if err := json.Unmarshal(request("POST", "trash/1", http.StatusOK), &record); err != nil {
+		t.Fatalf("Bad trash response: %s\n", err.Error())
+	}
+	if record.Label != 1 || record.Size != 20 || record.User != "reviewer" {
+		t.Errorf("Bad trash record: %+v\n", record)
+	}
+	checkLabel(1, blockRLEs{})
+	request("POST", "trash/1", http.StatusConflict)
+	request("POST", "trash/9", http.StatusNotFound)
+	var trashed []TrashedLabel
+	if err := json.Unmarshal(request("GET", "trash", http.StatusOK), &trashed); err != nil {
+		t.Fatalf("Bad trash listing: %s\n", err.Error())
+	}
+	if len(trashed) != 1 || trashed[0].Label != 1 || trashed[0].Size != 20 ||
+		!trashed[0].Expires.Equal(trashed[0].Time.Add(DefaultTrashRetention)) {
+		t.Errorf("Bad trash listing: %+v\n", trashed)
+	}
+	history, err := d.GetSizeHistory(ctx, 1)
+	if err != nil || len(history) == 0 || history[0].Op != "trash" || history[0].Size != 0 {
+		t.Errorf("Expected size history of trash, got %v, %v\n", history, err)
+	}
+
+	// Restoring moves the RLEs back.
+	var restored RestoredLabel
+	if err := json.Unmarshal(request("POST", "restore/1", http.StatusOK), &restored); err != nil {
+		t.Fatalf("Bad restore response: %s\n", err.Error())
+	}
+	if restored != (RestoredLabel{1, 1, 20, 2}) {
+		t.Errorf("Bad restore response: %+v\n", restored)
+	}
+	checkLabel(1, labelRLEs[1])
+	request("POST", "restore/1", http.StatusNotFound)
+
+	// A label whose id was reused must be restored under a new id.
+	request("POST", "trash/1", http.StatusOK)
+	reusedBlock := dvid.IndexZYX{5, 5, 5}
+	reused := blockRLEs{string(reusedBlock.Bytes()): dvid.RLEs{dvid.NewRLE(dvid.Point3d{160, 160, 160}, 4)}}
+	if err := putLabelRLEs(ctx, 1, reused, reused.blocks()); err != nil {
+		t.Fatalf("Unable to reuse label 1: %s\n", err.Error())
+	}
+	if body := request("POST", "restore/1", http.StatusConflict); !strings.Contains(string(body), "new id") {
+		t.Errorf("Expected guidance to restore under a new id, got %s\n", body)
+	}
+	request("POST", "restore/1?label=2", http.StatusConflict)
+	request("POST", "restore/1?label=7", http.StatusOK)
+	checkLabel(7, labelRLEs[1])
+	checkLabel(1, reused)
+
+	// Interrupted trashes are rolled forward.
+	intent := &mergeIntent{ID: newIntentID(), Op: "trash", Phase: intentMoveRLEs, Tuples: MergeTuples{{3}},
+		Sizes: []intentSize{{3, 20, 0}}, User: "reviewer"}
+	if err := d.putIntent(ctx, intent); err != nil {
+		t.Fatalf("Unable to store trash intent: %s\n", err.Error())
+	}
+	result, err := d.Repair()
+	if err != nil || result.Recovered != 1 || len(result.RepairNeeded) != 0 {
+		t.Fatalf("Expected trash to be rolled forward, got %+v, %v\n", result, err)
+	}
+	checkLabel(3, blockRLEs{})
+
+	// Labels past the retention period are purged.
+	request("POST", "trash/2", http.StatusOK)
+	if purged, err := d.PurgeTrash(time.Now()); err != nil || purged != 0 {
+		t.Fatalf("Expected nothing purged within retention period, got %d, %v\n", purged, err)
+	}
+	if purged, err := d.PurgeTrash(time.Now().Add(DefaultTrashRetention + time.Hour)); err != nil || purged != 2 {
+		t.Fatalf("Expected 2 labels purged, got %d, %v\n", purged, err)
+	}
+	if err := json.Unmarshal(request("GET", "trash", http.StatusOK), &trashed); err != nil || len(trashed) != 0 {
+		t.Errorf("Expected empty trash after purge, got %+v, %v\n", trashed, err)
+	}
+	request("POST", "restore/2", http.StatusNotFound)
+	checkLabel(2, blockRLEs{})
+}
@@ -0,0 +1,168 @@
+/*
+	This file supports conditional reads of label sparse volumes.  The last mutation of each
+	label is indexed per version when merges are logged, labels are deleted or restored,
+	or voxels are written, so the ETag and Last-Modified validators of a label's sparse
+	volume can be computed without reading its blocks, and clients polling unchanged labels
+	get a 304 Not Modified.  The same record is served by the "lastmod" endpoint so clients
+	caching derived data like meshes can check many labels at once.
+*/
+
+package labels64
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+// labelMutation is the id and time of the last mutation that changed a label.
+type labelMutation struct {
+	id   uint64
+	time time.Time
+}
+
+func (m labelMutation) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buf[0:8], m.id)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(m.time.UnixNano()))
+	return buf, nil
+}
+
+func (m *labelMutation) UnmarshalBinary(b []byte) error {
+	if len(b) != 16 {
+		return fmt.Errorf("Last mutation record has %d bytes, expected 16", len(b))
+	}
+	m.id = binary.LittleEndian.Uint64(b[0:8])
+	m.time = time.Unix(0, int64(binary.LittleEndian.Uint64(b[8:16])))
+	return nil
+}
+
+// putLastMutations adds the last mutation of all labels in the merge tuples to a batch.
+func putLastMutations(batch storage.Batch, tuples MergeTuples, m labelMutation) error {
+	serialization, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	for _, tuple := range tuples {
+		for _, label := range tuple {
+			batch.Put(voxels.NewLabelLastMutationIndex(label), serialization)
+		}
+	}
+	return nil
+}
+
+// putLastMutation stores the last mutation of a label changed outside of a merge.
+func putLastMutation(ctx *datastore.VersionedContext, label uint64, m labelMutation) error {
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	serialization, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return smalldata.Put(ctx, voxels.NewLabelLastMutationIndex(label), serialization)
+}
+
+// lastMutation returns the last mutation of a label at the context's version or its
+// nearest ancestor where the label changed.  A label that was never mutated has a zero
+// mutation.
+func (d *Data) lastMutation(ctx *datastore.VersionedContext, label uint64) (labelMutation, error) {
+	var m labelMutation
+	smalldata, err := smallDataStore()
+	if err != nil {
+		return m, fmt.Errorf("Cannot get datastore that handles small data: %s\n", err.Error())
+	}
+	versions, err := ancestry(ctx)
+	if err != nil {
+		return m, err
+	}
+	index := voxels.NewLabelLastMutationIndex(label)
+	for _, v := range versions {
+		value, err := smalldata.Get(datastore.NewVersionedContext(d, v), index)
+		if err != nil {
+			return m, err
+		}
+		if value != nil {
+			err = m.UnmarshalBinary(value)
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+// MaxLastModLabels is the largest number of labels in a batch "lastmod" request.
+const MaxLastModLabels = 10000
+
+// LabelLastMod gives the last mutation of a label at a version.  Mutation is 0 if the
+// label was never mutated, and Modified is the later of the last mutation and the creation
+// of the version's node, i.e., the Last-Modified time of the label's sparse volume.
+type LabelLastMod struct {
+	Label    uint64    `json:"label"`
+	Mutation uint64    `json:"mutation"`
+	Modified time.Time `json:"modified"`
+}
+
+// GetLastMods returns the last modification of each of the given labels at the context's
+// version in the order given.
+func (d *Data) GetLastMods(ctx *datastore.VersionedContext, repo datastore.Repo, labels []uint64) ([]LabelLastMod, error) {
+	uuid, err := datastore.UUIDFromVersion(ctx.VersionID())
+	if err != nil {
+		return nil, err
+	}
+	created, err := repo.Created(uuid)
+	if err != nil {
+		return nil, err
+	}
+	lastMods := make([]LabelLastMod, len(labels))
+	for i, label := range labels {
+		m, err := d.lastMutation(ctx, label)
+		if err != nil {
+			return nil, err
+		}
+		lastMods[i] = LabelLastMod{label, m.id, created}
+		if m.time.After(created) {
+			lastMods[i].Modified = m.time
+		}
+	}
+	return lastMods, nil
+}
+
+// labelValidators returns the strong ETag and the Last-Modified time of a label's data
+// served by the given endpoint and query.  The ETag is derived from the version, label,
+// and last mutation id, while Last-Modified is the label's modification time.
+func (d *Data) labelValidators(ctx *datastore.VersionedContext, repo datastore.Repo, endpoint string,
+	label uint64, query string) (string, time.Time, error) {
+
+	lastMods, err := d.GetLastMods(ctx, repo, []uint64{label})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	uuid, err := datastore.UUIDFromVersion(ctx.VersionID())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	etag := server.ContentETag(nil, uuid, d.DataName(), endpoint, label, lastMods[0].Mutation, query)
+	return etag, lastMods[0].Modified, nil
+}
+
+// labelNotModified sets the validators of a label read and returns its ETag and true
+// after writing a 304 Not Modified if the client's copy is current.  If the validators
+// can't be computed, the read proceeds without them and the ETag is empty.
+func (d *Data) labelNotModified(w http.ResponseWriter, r *http.Request, ctx *datastore.VersionedContext,
+	repo datastore.Repo, endpoint string, label uint64) (string, bool) {
+
+	etag, lastModified, err := d.labelValidators(ctx, repo, endpoint, label, r.URL.RawQuery)
+	if err != nil {
+		dvid.Errorf("Unable to get validators of label %d: %s\n", label, err.Error())
+		return "", false
+	}
+	return etag, server.NotModified(w, r, etag, lastModified)
+}
@@ -0,0 +1,269 @@
+package labels64
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/datatype/voxels"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/server"
+	"github.com/janelia-flyem/dvid/tests"
+)
+
+func TestConditionalSparseVol(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 380, "conditionallabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	ctx := datastore.NewVersionedContext(d, versionID)
+	for label := uint64(1); label <= 3; label++ {
+		block := dvid.IndexZYX{int32(label), 0, 0}
+		rles := dvid.RLEs{dvid.NewRLE(dvid.Point3d{int32(label) * 32, 0, 0}, 10)}
+		putSyntheticRLEs(t, ctx, label, blockRLEs{string(block.Bytes()): rles})
+	}
+	serverCtx := datastore.NewServerContext(context.Background(), repo, versionID)
+	get := func(endpoint string, label uint64, headers map[string]string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", fmt.Sprintf("/api/node/%s/conditionallabels/%s/%d", uuid, endpoint, label), nil)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		d.ServeHTTP(serverCtx, w, r)
+		return w
+	}
+	validators := func(endpoint string, label uint64) (string, string) {
+		w := get(endpoint, label, nil)
+		if w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Fatalf("Expected %s of label %d, got %d: %s\n", endpoint, label, w.Code, w.Body.String())
+		}
+		etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+		if etag == "" || lastModified == "" {
+			t.Fatalf("Expected validators for %s of label %d, got %v\n", endpoint, label, w.Header())
+		}
+		return etag, lastModified
+	}
+	checkNotModified := func(endpoint string, label uint64, headers map[string]string, expected bool) {
+		w := get(endpoint, label, headers)
+		if expected && (w.Code != http.StatusNotModified || w.Body.Len() != 0) {
+			t.Errorf("Expected 304 for %s of label %d with %v, got %d\n", endpoint, label, headers, w.Code)
+		}
+		if !expected && w.Code != http.StatusOK {
+			t.Errorf("Expected 200 for %s of label %d with %v, got %d\n", endpoint, label, headers, w.Code)
+		}
+	}
+
+	// Unchanged labels are not modified.
+	before := make(map[uint64]string)
+	for label := uint64(1); label <= 3; label++ {
+		etag, lastModified := validators("sparsevol", label)
+		before[label] = etag
+		checkNotModified("sparsevol", label, map[string]string{"If-None-Match": etag}, true)
+		checkNotModified("sparsevol", label, map[string]string{"If-Modified-Since": lastModified}, true)
+	}
+	coarseETag, _ := validators("sparsevol-coarse", 3)
+	checkNotModified("sparsevol-coarse", 3, map[string]string{"If-None-Match": coarseETag}, true)
+	checkNotModified("sparsevol-coarse", 3, map[string]string{"If-None-Match": before[3]}, false)
+	if etag, _ := validators("sparsevol", 1); etag != before[1] {
+		t.Errorf("Expected stable ETag for unchanged label, got %s then %s\n", before[1], etag)
+	}
+	w := get("sparsevol", 1, map[string]string{"If-Modified-Since": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)})
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for label modified since an hour ago, got %d\n", w.Code)
+	}
+
+	// A merge bumps the validators of the merged labels but not those of other labels.
+	if _, err := d.MergeLabels(ctx, MergeTuples{{1, 2}}, MergeOptions{}); err != nil {
+		t.Fatalf("Unable to merge labels: %s\n", err.Error())
+	}
+	d.waitFinishing()
+	for _, label := range []uint64{1, 2} {
+		checkNotModified("sparsevol", label, map[string]string{"If-None-Match": before[label]}, false)
+	}
+	etag, lastModified := validators("sparsevol", 1)
+	if etag == before[1] {
+		t.Errorf("Expected ETag of merged label to change\n")
+	}
+	m, err := d.lastMutation(ctx, 1)
+	if err != nil || m.id == 0 {
+		t.Fatalf("Expected last mutation of merged label, got %v, %v\n", m, err)
+	}
+	if lastModified != m.time.UTC().Format(http.TimeFormat) {
+		t.Errorf("Expected Last-Modified from merge time %s, got %s\n", m.time, lastModified)
+	}
+	checkNotModified("sparsevol", 1, map[string]string{"If-None-Match": etag}, true)
+	checkNotModified("sparsevol", 3, map[string]string{"If-None-Match": before[3]}, true)
+	checkNotModified("sparsevol-coarse", 3, map[string]string{"If-None-Match": coarseETag}, true)
+
+	// Child versions have their own validators.
+	if err := repo.Lock(uuid); err != nil {
+		t.Fatalf("Unable to lock root: %s\n", err.Error())
+	}
+	child, err := repo.NewVersion(uuid)
+	if err != nil {
+		t.Fatalf("Unable to create child version: %s\n", err.Error())
+	}
+	childVersion, err := datastore.VersionFromUUID(child)
+	if err != nil {
+		t.Fatalf("Unable to get child version: %s\n", err.Error())
+	}
+	childCtx := datastore.NewVersionedContext(d, childVersion)
+	if inherited, err := d.lastMutation(childCtx, 1); err != nil || inherited != m {
+		t.Errorf("Expected child to inherit last mutation %v, got %v, %v\n", m, inherited, err)
+	}
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/api/node/%s/conditionallabels/sparsevol/3", child), nil)
+	r.Header.Set("If-None-Match", before[3])
+	w = httptest.NewRecorder()
+	d.ServeHTTP(datastore.NewServerContext(context.Background(), repo, childVersion), w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected root ETag not to match at child, got %d\n", w.Code)
+	}
+}
+
+func TestLabelLastMod(t *testing.T) {
+	tests.UseStore()
+	defer tests.CloseStore()
+
+	repo, versionID := initTestRepo()
+	uuid := repo.RootUUID()
+	d, err := NewData(uuid, 466, "lastmodlabels", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create labels64 data: %s\n", err.Error())
+	}
+	trashMu.Lock()
+	lastTrashPurge[d.InstanceID()] = time.Now()
+	trashMu.Unlock()
+	ctx := datastore.NewVersionedContext(d, versionID)
+	for label := uint64(1); label <= 4; label++ {
+		block := dvid.IndexZYX{int32(label), 0, 0}
+		rles := dvid.RLEs{dvid.NewRLE(dvid.Point3d{int32(label) * 32, 0, 0}, 10)}
+		putSyntheticRLEs(t, ctx, label, blockRLEs{string(block.Bytes()): rles})
+	}
+	created, err := repo.Created(uuid)
+	if err != nil {
+		t.Fatalf("Unable to get creation time of root: %s\n", err.Error())
+	}
+	serverCtx := datastore.NewServerContext(context.Background(), repo, versionID)
+	request := func(method, endpoint, body string, expected int) []byte {
+		r, _ := http.NewRequest(method, fmt.Sprintf("/api/node/%s/lastmodlabels/%s", uuid, endpoint), strings.NewReader(body))
+		w := httptest.NewRecorder()
+		d.ServeHTTP(serverCtx, w, r)
+		if w.Code != expected {
+			t.Fatalf("Expected status %d from %s %s, got %d: %s\n", expected, method, endpoint, w.Code, w.Body.String())
+		}
+		return w.Body.Bytes()
+	}
+	lastMods := func() map[uint64]LabelLastMod {
+		var batch []LabelLastMod
+		if err := json.Unmarshal(request("POST", "lastmod", "[1, 2, 3, 4, 9]", http.StatusOK), &batch); err != nil {
+			t.Fatalf("Bad batch lastmod response: %s\n", err.Error())
+		}
+		mods := make(map[uint64]LabelLastMod, len(batch))
+		for i, lastMod := range batch {
+			if lastMod.Label != []uint64{1, 2, 3, 4, 9}[i] {
+				t.Fatalf("Expected batch lastmod in request order, got %v\n", batch)
+			}
+			var single LabelLastMod
+			if err := json.Unmarshal(request("GET", fmt.Sprintf("lastmod/%d", lastMod.Label), "", http.StatusOK), &single); err != nil {
+				t.Fatalf("Bad lastmod response: %s\n", err.Error())
+			}
+			if single.Label != lastMod.Label || single.Mutation != lastMod.Mutation || !single.Modified.Equal(lastMod.Modified) {
+				t.Errorf("Single lastmod %+v differs from batch %+v\n", single, lastMod)
+			}
+			mods[lastMod.Label] = lastMod
+		}
+		return mods
+	}
+	checkChanged := func(op string, before map[uint64]LabelLastMod, changed ...uint64) map[uint64]LabelLastMod {
+		after := lastMods()
+		var mutation uint64
+		for label, lastMod := range after {
+			wasChanged := false
+			for _, c := range changed {
+				wasChanged = wasChanged || c == label
+			}
+			switch {
+			case wasChanged && (lastMod.Mutation == before[label].Mutation || lastMod.Modified.Before(before[label].Modified)):
+				t.Errorf("Expected %s to change lastmod of label %d, got %+v then %+v\n", op, label, before[label], lastMod)
+			case wasChanged && mutation != 0 && lastMod.Mutation != mutation:
+				t.Errorf("Expected %s to give its labels one mutation, got %d and %d\n", op, mutation, lastMod.Mutation)
+			case !wasChanged && lastMod != before[label]:
+				t.Errorf("Expected %s not to change lastmod of label %d, got %+v then %+v\n", op, label, before[label], lastMod)
+			}
+			if wasChanged {
+				mutation = lastMod.Mutation
+			}
+		}
+		return after
+	}
+
+	// Labels never mutated have no mutation and the node's creation time.
+	mods := lastMods()
+	for label, lastMod := range mods {
+		if lastMod.Mutation != 0 || !lastMod.Modified.Equal(created) {
+			t.Errorf("Expected unmutated label %d to have creation time, got %+v\n", label, lastMod)
+		}
+	}
+
+	// Reads don't change the record.
+	request("GET", "sparsevol/1", "", http.StatusOK)
+	request("GET", "sparsevol-coarse/2", "", http.StatusOK)
+	request("POST", "sparsevols", "[1, 3]", http.StatusOK)
+	request("GET", "size-history/1", "", http.StatusOK)
+	mods = checkChanged("reads", mods)
+
+	// Merges change the target and merged labels.
+	if _, err := d.MergeLabels(ctx, MergeTuples{{1, 2}}, MergeOptions{}); err != nil {
+		t.Fatalf("Unable to merge labels: %s\n", err.Error())
+	}
+	d.waitFinishing()
+	mods = checkChanged("merge", mods, 1, 2)
+	etag := server.ContentETag(nil, uuid, d.DataName(), "sparsevol", uint64(1), mods[1].Mutation, "")
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/api/node/%s/lastmodlabels/sparsevol/1", uuid), nil)
+	w := httptest.NewRecorder()
+	d.ServeHTTP(serverCtx, w, r)
+	if w.Header().Get("ETag") != etag || w.Header().Get("Last-Modified") != mods[1].Modified.UTC().Format(http.TimeFormat) {
+		t.Errorf("Expected sparsevol validators from lastmod %+v, got %v\n", mods[1], w.Header())
+	}
+
+	// Deleting and restoring labels through the trash changes them.
+	if _, err := d.TrashLabel(ctx, 3, "tester"); err != nil {
+		t.Fatalf("Unable to trash label 3: %s\n", err.Error())
+	}
+	mods = checkChanged("trash", mods, 3)
+	if _, err := d.RestoreTrashedLabel(ctx, 3, 9, "tester"); err != nil {
+		t.Fatalf("Unable to restore label 3: %s\n", err.Error())
+	}
+	mods = checkChanged("restore", mods, 9)
+
+	// Voxel writes change the labels in the written blocks once they're indexed.
+	blockData := make([]byte, d.BlockSize().Prod()*8)
+	for i := 0; i < 5; i++ {
+		binary.LittleEndian.PutUint64(blockData[i*8:], 4)
+	}
+	blocks := make(voxels.BlockChannel, 1)
+	blocks <- voxels.Block3d{Index: &dvid.IndexZYX{4, 0, 0}, Data: blockData}
+	close(blocks)
+	d.startDenorm(versionID, blocks)
+	d.waitFinishing()
+	checkChanged("voxel write", mods, 4)
+
+	// Bad requests are rejected.
+	request("GET", "lastmod", "", http.StatusBadRequest)
+	request("GET", "lastmod/abc", "", http.StatusBadRequest)
+	request("POST", "lastmod", "{}", http.StatusBadRequest)
+	request("DELETE", "lastmod/1", "", http.StatusBadRequest)
+}
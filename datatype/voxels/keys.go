@@ -59,6 +59,49 @@ const (
 	// KeyLabelSurface have keys of form 'b' and have the label's sparse volume
 	// for its value.
 	KeyLabelSurface
+
+	// KeyLabelSizeHistory have keys of form 'b' and have the label's size and
+	// the operation that set it for each version where the label changed.
+	KeyLabelSizeHistory
+
+	// KeyLabelIntent have keys of form 'i' and have a write-ahead record of a label
+	// operation that is in progress.
+	KeyLabelIntent
+
+	// KeyLabelOpKey have keys of form 's' and have the result of a completed label
+	// operation submitted with the given idempotency key.
+	KeyLabelOpKey
+
+	// KeyLabelMergeLog have keys of form 'i' and have the record of a completed merge.
+	KeyLabelMergeLog
+
+	// KeyLabelMapping has a single key per version and has the label each merged
+	// label was merged into.
+	KeyLabelMapping
+
+	// KeyLabelLastMutation have keys of form 'b' and have the id and time of the last
+	// mutation that changed the label.
+	KeyLabelLastMutation
+
+	// KeyLabelBackfill has a single key per version and has the cursor of an unfinished
+	// backfill of label RLEs.
+	KeyLabelBackfill
+
+	// KeyLabelCompaction has a single key for all versions and has the cursor of an
+	// unfinished compaction of label RLEs.
+	KeyLabelCompaction
+
+	// KeyLabelBlockJournal have keys of form 'b+s+i' and have a journal entry of a
+	// mutation of the label's RLEs in a block.
+	KeyLabelBlockJournal
+
+	// KeyLabelTrash have keys of form 'b+s' and have the RLEs of a trashed label for a
+	// block.  The keys differ from KeyLabelSpatialMap keys only in their first byte.
+	KeyLabelTrash
+
+	// KeyLabelTrashRecord have keys of form 'b' and have who trashed the label, when,
+	// and its size.
+	KeyLabelTrashRecord
 )
 
 func (t KeyType) String() string {
@@ -79,6 +122,28 @@ func (t KeyType) String() string {
 		return "Forward Label sorted by volume"
 	case KeyLabelSurface:
 		return "Forward Label Surface"
+	case KeyLabelSizeHistory:
+		return "Forward Label Size History"
+	case KeyLabelIntent:
+		return "Label Operation Intent"
+	case KeyLabelOpKey:
+		return "Label Operation Idempotency Key"
+	case KeyLabelMergeLog:
+		return "Label Merge Log"
+	case KeyLabelMapping:
+		return "Merged Label Mapping"
+	case KeyLabelLastMutation:
+		return "Label Last Mutation"
+	case KeyLabelBackfill:
+		return "Label Backfill Cursor"
+	case KeyLabelCompaction:
+		return "Label Compaction Cursor"
+	case KeyLabelBlockJournal:
+		return "Label Block Journal"
+	case KeyLabelTrash:
+		return "Trashed Label to Spatial Index Map"
+	case KeyLabelTrashRecord:
+		return "Trashed Label Record"
 	default:
 		return "Unknown Key Type"
 	}
@@ -199,6 +264,21 @@ func NewLabelSpatialMapIndex(label uint64, blockBytes []byte) dvid.IndexBytes {
 	return dvid.IndexBytes(index)
 }
 
+// LabelRange returns the first and last LabelSpatialMap indices for a label, which span
+// all blocks containing the label.
+func LabelRange(label uint64) (begIndex, endIndex dvid.IndexBytes) {
+	return LabelZRange(label, dvid.MinIndexZYX[2], dvid.MaxIndexZYX[2])
+}
+
+// LabelZRange returns the first and last LabelSpatialMap indices for a label's blocks with
+// block Z coordinates from minZ to maxZ, inclusive.  Since blocks are ordered by Z, then Y,
+// then X, the range includes every X and Y at the bounding Z coordinates.
+func LabelZRange(label uint64, minZ, maxZ int32) (begIndex, endIndex dvid.IndexBytes) {
+	minZYX := dvid.IndexZYX{dvid.MinIndexZYX[0], dvid.MinIndexZYX[1], minZ}
+	maxZYX := dvid.IndexZYX{dvid.MaxIndexZYX[0], dvid.MaxIndexZYX[1], maxZ}
+	return NewLabelSpatialMapIndex(label, minZYX.Bytes()), NewLabelSpatialMapIndex(label, maxZYX.Bytes())
+}
+
 // DecodeLabelSpatialMapKey returns a label and block index bytes from a LabelSpatialMap key.
 // The block index bytes are returned because different block indices may be used (e.g., CZYX),
 // and its up to caller to determine which one is used for this particular key.
@@ -236,6 +316,131 @@ func LabelFromLabelSizesKey(key []byte) (uint64, error) {
 	return binary.BigEndian.Uint64(indexBytes[9:17]), nil
 }
 
+// NewLabelSizeHistoryIndex returns an identifier for a given label's size history.
+func NewLabelSizeHistoryIndex(label uint64) dvid.IndexBytes {
+	index := make([]byte, 1+8)
+	index[0] = byte(KeyLabelSizeHistory)
+	binary.BigEndian.PutUint64(index[1:9], label)
+	return dvid.IndexBytes(index)
+}
+
+// NewLabelIntentIndex returns an identifier for a label operation's intent record.
+func NewLabelIntentIndex(id uint64) dvid.IndexBytes {
+	index := make([]byte, 1+8)
+	index[0] = byte(KeyLabelIntent)
+	binary.BigEndian.PutUint64(index[1:9], id)
+	return dvid.IndexBytes(index)
+}
+
+// NewLabelOpKeyIndex returns an identifier for the result of a label operation submitted
+// with the given idempotency key.
+func NewLabelOpKeyIndex(key string) dvid.IndexBytes {
+	index := make([]byte, 1+len(key))
+	index[0] = byte(KeyLabelOpKey)
+	copy(index[1:], key)
+	return dvid.IndexBytes(index)
+}
+
+// NewLabelMergeLogIndex returns an identifier for the log record of a completed merge.
+func NewLabelMergeLogIndex(id uint64) dvid.IndexBytes {
+	index := make([]byte, 1+8)
+	index[0] = byte(KeyLabelMergeLog)
+	binary.BigEndian.PutUint64(index[1:9], id)
+	return dvid.IndexBytes(index)
+}
+
+// NewLabelMappingIndex returns the identifier of the merged label mapping.
+func NewLabelMappingIndex() dvid.IndexBytes {
+	return dvid.IndexBytes{byte(KeyLabelMapping)}
+}
+
+// NewLabelLastMutationIndex returns an identifier for the last mutation of a given label.
+func NewLabelLastMutationIndex(label uint64) dvid.IndexBytes {
+	index := make([]byte, 1+8)
+	index[0] = byte(KeyLabelLastMutation)
+	binary.BigEndian.PutUint64(index[1:9], label)
+	return dvid.IndexBytes(index)
+}
+
+// NewLabelBackfillIndex returns the identifier of the label RLE backfill cursor.
+func NewLabelBackfillIndex() dvid.IndexBytes {
+	return dvid.IndexBytes{byte(KeyLabelBackfill)}
+}
+
+// NewLabelCompactionIndex returns the identifier of the label RLE compaction cursor.
+func NewLabelCompactionIndex() dvid.IndexBytes {
+	return dvid.IndexBytes{byte(KeyLabelCompaction)}
+}
+
+// NewLabelBlockJournalIndex returns an identifier for the journal entry of a mutation of a
+// label's RLEs in a block.
+func NewLabelBlockJournalIndex(label uint64, blockBytes []byte, id uint64) dvid.IndexBytes {
+	sz := len(blockBytes)
+	index := make([]byte, 1+8+sz+8)
+	index[0] = byte(KeyLabelBlockJournal)
+	binary.BigEndian.PutUint64(index[1:9], label)
+	copy(index[9:], blockBytes)
+	binary.BigEndian.PutUint64(index[9+sz:], id)
+	return dvid.IndexBytes(index)
+}
+
+// DecodeLabelBlockJournalKey returns the label, block index, and mutation id of a full
+// key of a label block journal entry.
+func DecodeLabelBlockJournalKey(key []byte) (label uint64, blockBytes []byte, id uint64, err error) {
+	var ctx storage.DataContext
+	var index []byte
+	index, err = ctx.IndexFromKey(key)
+	if err != nil {
+		return
+	}
+	if index[0] != byte(KeyLabelBlockJournal) || len(index) < 1+8+8 {
+		err = fmt.Errorf("Expected KeyLabelBlockJournal index, got %v instead", index)
+		return
+	}
+	label = binary.BigEndian.Uint64(index[1:9])
+	blockBytes = index[9 : len(index)-8]
+	id = binary.BigEndian.Uint64(index[len(index)-8:])
+	return
+}
+
+// NewLabelTrashIndex returns an identifier for storing the RLEs of a trashed label for a
+// block.
+func NewLabelTrashIndex(label uint64, blockBytes []byte) dvid.IndexBytes {
+	index := NewLabelSpatialMapIndex(label, blockBytes)
+	index[0] = byte(KeyLabelTrash)
+	return index
+}
+
+// LabelTrashRange returns the first and last LabelTrash indices for a trashed label.
+func LabelTrashRange(label uint64) (begIndex, endIndex dvid.IndexBytes) {
+	return NewLabelTrashIndex(label, dvid.MinIndexZYX.Bytes()), NewLabelTrashIndex(label, dvid.MaxIndexZYX.Bytes())
+}
+
+// DecodeLabelTrashKey returns a label and block index bytes from a LabelTrash key.
+func DecodeLabelTrashKey(key []byte) (label uint64, blockBytes []byte, err error) {
+	var ctx storage.DataContext
+	var index []byte
+	index, err = ctx.IndexFromKey(key)
+	if err != nil {
+		return
+	}
+	if index[0] != byte(KeyLabelTrash) {
+		err = fmt.Errorf("Expected KeyLabelTrash index, got %d byte instead", index[0])
+		return
+	}
+	label = binary.BigEndian.Uint64(index[1:9])
+	blockBytes = index[9:]
+	return
+}
+
+// NewLabelTrashRecordIndex returns an identifier for the record of a trashed label.
+func NewLabelTrashRecordIndex(label uint64) dvid.IndexBytes {
+	index := make([]byte, 1+8)
+	index[0] = byte(KeyLabelTrashRecord)
+	binary.BigEndian.PutUint64(index[1:9], label)
+	return dvid.IndexBytes(index)
+}
+
 // NewLabelSurfaceIndex returns an identifier for a given label's surface.
 func NewLabelSurfaceIndex(label uint64) dvid.IndexBytes {
 	index := make([]byte, 1+8)
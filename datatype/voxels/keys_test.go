@@ -0,0 +1,91 @@
+package voxels
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+	"github.com/janelia-flyem/dvid/storage"
+)
+
+func TestLabelSpatialMapKeys(t *testing.T) {
+	dtype, err := datastore.TypeServiceByName("grayscale8")
+	if err != nil {
+		t.Fatalf("Can't get grayscale type: %s\n", err.Error())
+	}
+	data, err := datastore.NewDataService(dtype, dvid.UUID("a9b8c7"), 1, "grayscale", dvid.NewConfig())
+	if err != nil {
+		t.Fatalf("Unable to create base data: %s\n", err.Error())
+	}
+	ctx := storage.NewDataContext(data, 1)
+
+	labels := []uint64{0, 1, 255, 256, math.MaxUint32, math.MaxUint32 + 1, math.MaxUint64 - 1, math.MaxUint64}
+	coords := []int32{math.MinInt32, math.MinInt32 + 1, -1, 0, 1, math.MaxInt32 - 1, math.MaxInt32}
+	for _, label := range labels {
+		for _, x := range coords {
+			for _, y := range []int32{math.MinInt32, 0, math.MaxInt32} {
+				for _, z := range coords {
+					block := dvid.IndexZYX{x, y, z}
+					key := ctx.ConstructKey(NewLabelSpatialMapIndex(label, block.Bytes()))
+					gotLabel, blockBytes, err := DecodeLabelSpatialMapKey(key)
+					if err != nil {
+						t.Fatalf("Error decoding key for label %d, block %v: %s\n", label, block, err.Error())
+					}
+					var gotBlock dvid.IndexZYX
+					if err := gotBlock.IndexFromBytes(blockBytes); err != nil {
+						t.Fatalf("Error decoding block for label %d, block %v: %s\n", label, block, err.Error())
+					}
+					if gotLabel != label || gotBlock != block {
+						t.Errorf("Expected label %d, block %v after round-trip, got label %d, block %v\n",
+							label, block, gotLabel, gotBlock)
+					}
+
+					// Each key is within its label range but not other labels' ranges.
+					index := NewLabelSpatialMapIndex(label, block.Bytes())
+					beg, end := LabelRange(label)
+					if bytes.Compare(index, beg) < 0 || bytes.Compare(index, end) > 0 {
+						t.Errorf("Label %d, block %v index outside of label range\n", label, block)
+					}
+					if label != 0 {
+						beg, end = LabelRange(label - 1)
+						if bytes.Compare(index, beg) >= 0 && bytes.Compare(index, end) <= 0 {
+							t.Errorf("Label %d, block %v index inside range of label %d\n", label, block, label-1)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestLabelZRange(t *testing.T) {
+	tests := []struct {
+		minZ, maxZ int32
+		z          int32
+		inside     bool
+	}{
+		{0, 10, 0, true},
+		{0, 10, 10, true},
+		{0, 10, 11, false},
+		{0, 10, -1, false},
+		{-5, -5, -5, true},
+		{math.MinInt32, math.MaxInt32, math.MinInt32, true},
+		{math.MinInt32, math.MaxInt32, math.MaxInt32, true},
+		{math.MaxInt32, math.MaxInt32, math.MaxInt32 - 1, false},
+	}
+	const label = 23
+	for _, test := range tests {
+		beg, end := LabelZRange(label, test.minZ, test.maxZ)
+		for _, xy := range []int32{math.MinInt32, 0, math.MaxInt32} {
+			block := dvid.IndexZYX{xy, xy, test.z}
+			index := NewLabelSpatialMapIndex(label, block.Bytes())
+			inside := bytes.Compare(index, beg) >= 0 && bytes.Compare(index, end) <= 0
+			if inside != test.inside {
+				t.Errorf("Block %v in Z range [%d,%d]: expected inside = %t, got %t\n",
+					block, test.minZ, test.maxZ, test.inside, inside)
+			}
+		}
+	}
+}
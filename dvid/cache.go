@@ -0,0 +1,194 @@
+/*
+	This file supports size-bounded in-memory caches that can be inspected and cleared
+	through data instance HTTP APIs.
+*/
+
+package dvid
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// CacheAgeBucket gives the number of cache entries younger than MaxAge.  The last bucket
+// of a histogram has an empty MaxAge and holds all older entries.
+type CacheAgeBucket struct {
+	MaxAge  string
+	Entries int
+}
+
+// cacheAgeLimits are the upper bounds of all but the last age histogram bucket.
+var cacheAgeLimits = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 24 * time.Hour}
+
+// CacheStats describes the usage of a cache.
+type CacheStats struct {
+	Entries  int
+	Bytes    uint64
+	MaxBytes uint64
+	Hits     uint64
+	Misses   uint64
+	HitRate  float64
+	Ages     []CacheAgeBucket
+}
+
+// CacheTags are attributes of a cached entry, e.g., "scale" -> "2", that can be used to
+// select entries for eviction.
+type CacheTags map[string]string
+
+// Matches returns true if all the given filter attributes are in the tags.  An empty
+// filter matches everything.
+func (tags CacheTags) Matches(filter CacheTags) bool {
+	for k, v := range filter {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// CacheInspector is implemented by data services with in-memory caches that can be
+// inspected and cleared by operators.
+type CacheInspector interface {
+	// CacheStats returns current statistics or nil if there is no active cache.
+	CacheStats() *CacheStats
+
+	// ClearCache evicts all entries matching the filter and returns the number evicted.
+	ClearCache(filter CacheTags) int
+}
+
+type cacheEntry struct {
+	key     string
+	value   []byte
+	tags    CacheTags
+	created time.Time
+}
+
+// Cache is a least-recently-used cache of byte slices that limits the total bytes held.
+// It is safe for concurrent use.
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes uint64
+	curBytes uint64
+	lru      *list.List // front is most recently used
+	entries  map[string]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+// NewCache returns a cache that holds at most maxBytes of values.
+func NewCache(maxBytes uint64) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached value for the key.  The returned slice must not be modified.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[key]
+	if !found {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+// Set adds or replaces the value for the key, evicting least recently used entries if
+// necessary.  Values larger than the cache are not stored.
+func (c *Cache) Set(key string, value []byte, tags CacheTags) {
+	size := uint64(len(value))
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[key]; found {
+		c.remove(elem)
+	}
+	for c.curBytes+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	entry := &cacheEntry{key: key, value: value, tags: tags, created: time.Now()}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.curBytes += size
+}
+
+// remove deletes an element.  The caller must hold the lock.
+func (c *Cache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.curBytes -= uint64(len(entry.value))
+}
+
+// Delete evicts the entry for the key, returning false if there was none.
+func (c *Cache) Delete(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[key]
+	if found {
+		c.remove(elem)
+	}
+	return found
+}
+
+// Clear evicts all entries whose tags match the filter and returns the number evicted.
+func (c *Cache) Clear(filter CacheTags) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var evicted int
+	var next *list.Element
+	for elem := c.lru.Front(); elem != nil; elem = next {
+		next = elem.Next()
+		if elem.Value.(*cacheEntry).tags.Matches(filter) {
+			c.remove(elem)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Len returns the number of cached entries.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Stats returns the current cache statistics.
+func (c *Cache) Stats() *CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := &CacheStats{
+		Entries:  c.lru.Len(),
+		Bytes:    c.curBytes,
+		MaxBytes: c.maxBytes,
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Ages:     make([]CacheAgeBucket, len(cacheAgeLimits)+1),
+	}
+	if c.hits+c.misses != 0 {
+		stats.HitRate = float64(c.hits) / float64(c.hits+c.misses)
+	}
+	for i, limit := range cacheAgeLimits {
+		stats.Ages[i].MaxAge = limit.String()
+	}
+	now := time.Now()
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		age := now.Sub(elem.Value.(*cacheEntry).created)
+		bucket := len(cacheAgeLimits)
+		for i, limit := range cacheAgeLimits {
+			if age < limit {
+				bucket = i
+				break
+			}
+		}
+		stats.Ages[bucket].Entries++
+	}
+	return stats
+}
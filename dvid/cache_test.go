@@ -0,0 +1,84 @@
+package dvid
+
+import (
+	"fmt"
+	"sync"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestCacheLRU(c *C) {
+	cache := NewCache(30)
+	cache.Set("a", make([]byte, 10), nil)
+	cache.Set("b", make([]byte, 10), nil)
+	cache.Set("c", make([]byte, 10), nil)
+
+	_, found := cache.Get("a") // make "b" least recently used
+	c.Assert(found, Equals, true)
+	cache.Set("d", make([]byte, 10), nil)
+
+	_, found = cache.Get("b")
+	c.Assert(found, Equals, false)
+	c.Assert(cache.Len(), Equals, 3)
+
+	cache.Set("huge", make([]byte, 31), nil)
+	_, found = cache.Get("huge")
+	c.Assert(found, Equals, false)
+
+	stats := cache.Stats()
+	c.Assert(stats.Entries, Equals, 3)
+	c.Assert(stats.Bytes, Equals, uint64(30))
+	c.Assert(stats.Hits, Equals, uint64(1))
+	c.Assert(stats.Misses, Equals, uint64(2))
+	c.Assert(stats.Ages[0].Entries, Equals, 3)
+}
+
+func (suite *DataSuite) TestCacheClear(c *C) {
+	cache := NewCache(1000)
+	for scale := 0; scale < 3; scale++ {
+		for _, plane := range []string{"xy", "xz"} {
+			key := fmt.Sprintf("%s-%d", plane, scale)
+			cache.Set(key, []byte(key), CacheTags{"scale": fmt.Sprintf("%d", scale), "plane": plane})
+		}
+	}
+	c.Assert(cache.Clear(CacheTags{"scale": "1", "plane": "xz"}), Equals, 1)
+	c.Assert(cache.Clear(CacheTags{"plane": "xy"}), Equals, 3)
+	c.Assert(cache.Len(), Equals, 2)
+	c.Assert(cache.Delete("xz-0"), Equals, true)
+	c.Assert(cache.Delete("xz-0"), Equals, false)
+	c.Assert(cache.Clear(nil), Equals, 1)
+	c.Assert(cache.Stats().Bytes, Equals, uint64(0))
+}
+
+func (suite *DataSuite) TestCacheConcurrentClear(c *C) {
+	cache := NewCache(100 * Kilo)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := fmt.Sprintf("%d-%d", i, j%50)
+				if value, found := cache.Get(key); found {
+					c.Check(string(value), Equals, key)
+				} else {
+					cache.Set(key, []byte(key), CacheTags{"writer": fmt.Sprintf("%d", i)})
+				}
+				if j%100 == 0 {
+					cache.Clear(CacheTags{"writer": fmt.Sprintf("%d", (i+1)%8)})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	var total uint64
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 50; j++ {
+			key := fmt.Sprintf("%d-%d", i, j)
+			if _, found := cache.Get(key); found {
+				total += uint64(len(key))
+			}
+		}
+	}
+	c.Assert(cache.Stats().Bytes, Equals, total)
+}
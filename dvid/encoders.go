@@ -0,0 +1,299 @@
+/*
+	This file provides a registry of image encoders that convert raw pixel data of a given
+	channel type into a standard image format.  Unlike WriteImageHttp, which accepts a Go image,
+	these encoders work directly from little-endian pixel data so higher precision channel types
+	like uint16 and float32 can be sent without loss.
+*/
+
+package dvid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/janelia-flyem/go/go.image/bmp"
+)
+
+// Channel types for raw pixel data, named as in the Google BrainMaps API.
+const (
+	ChannelUint8   = "uint8"
+	ChannelUint16  = "uint16"
+	ChannelUint64  = "uint64"
+	ChannelFloat32 = "float"
+)
+
+// ChannelBytes returns the number of bytes per pixel for a channel type.
+func ChannelBytes(channelType string) (int, error) {
+	switch channelType {
+	case ChannelUint8:
+		return 1, nil
+	case ChannelUint16:
+		return 2, nil
+	case ChannelFloat32:
+		return 4, nil
+	case ChannelUint64:
+		return 8, nil
+	default:
+		return 0, fmt.Errorf("Unknown channel type %q", channelType)
+	}
+}
+
+// ImageEncoder encodes little-endian pixel data into an image format.
+type ImageEncoder interface {
+	// ContentType returns the media type for the encoded image.
+	ContentType() string
+
+	// CanEncode returns true if the encoder can handle the given channel type.
+	CanEncode(channelType string) bool
+
+	// Encode writes an nx x ny image.  The options string is whatever follows the
+	// colon in a format string, e.g., "80" for "jpeg:80", and may be empty.
+	Encode(w io.Writer, data []byte, nx, ny int, channelType, options string) error
+}
+
+var (
+	imageEncodersMu sync.RWMutex
+	imageEncoders   = map[string]ImageEncoder{}
+)
+
+// RegisterImageEncoder makes an encoder available for the given format names.
+func RegisterImageEncoder(enc ImageEncoder, formats ...string) {
+	imageEncodersMu.Lock()
+	defer imageEncodersMu.Unlock()
+	for _, format := range formats {
+		imageEncoders[format] = enc
+	}
+}
+
+// GetImageEncoder returns the encoder for a format string of the form "jpeg" or "jpeg:80",
+// as well as any options following the colon.  An empty format string is treated as "png".
+func GetImageEncoder(formatStr string) (ImageEncoder, string, error) {
+	format := strings.SplitN(formatStr, ":", 2)
+	name := format[0]
+	if name == "" {
+		name = "png"
+	}
+	var options string
+	if len(format) > 1 {
+		options = format[1]
+	}
+	imageEncodersMu.RLock()
+	enc, found := imageEncoders[name]
+	imageEncodersMu.RUnlock()
+	if !found {
+		return nil, "", fmt.Errorf("Illegal image format requested: %s", name)
+	}
+	return enc, options, nil
+}
+
+// EncodeImageHttp writes pixel data of a given channel type to a HTTP response writer
+// using a format and optional compression strength specified in a string, e.g., "png", "jpg:80".
+func EncodeImageHttp(w http.ResponseWriter, data []byte, nx, ny int, channelType, formatStr string) error {
+	enc, options, err := GetImageEncoder(formatStr)
+	if err != nil {
+		return err
+	}
+	if !enc.CanEncode(channelType) {
+		return fmt.Errorf("Image format %q cannot encode %s data", formatStr, channelType)
+	}
+	w.Header().Set("Content-type", enc.ContentType())
+	return enc.Encode(w, data, nx, ny, channelType, options)
+}
+
+type encodeFunc func(w io.Writer, data []byte, nx, ny int, channelType, options string) error
+
+// imageEncoder implements ImageEncoder from a function.
+type imageEncoder struct {
+	contentType  string
+	channelTypes []string
+	encode       encodeFunc
+}
+
+func (enc imageEncoder) ContentType() string {
+	return enc.contentType
+}
+
+func (enc imageEncoder) CanEncode(channelType string) bool {
+	for _, ct := range enc.channelTypes {
+		if ct == channelType {
+			return true
+		}
+	}
+	return false
+}
+
+func (enc imageEncoder) Encode(w io.Writer, data []byte, nx, ny int, channelType, options string) error {
+	if !enc.CanEncode(channelType) {
+		return fmt.Errorf("Cannot encode %s data as %s", channelType, enc.contentType)
+	}
+	bytesPerPixel, err := ChannelBytes(channelType)
+	if err != nil {
+		return err
+	}
+	if len(data) != nx*ny*bytesPerPixel {
+		return fmt.Errorf("Expected %d bytes for %d x %d %s image, got %d bytes",
+			nx*ny*bytesPerPixel, nx, ny, channelType, len(data))
+	}
+	return enc.encode(w, data, nx, ny, channelType, options)
+}
+
+func init() {
+	RegisterImageEncoder(imageEncoder{
+		"image/png",
+		[]string{ChannelUint8, ChannelUint16, ChannelUint64},
+		encodePNG,
+	}, "png")
+	RegisterImageEncoder(imageEncoder{
+		"image/jpeg",
+		[]string{ChannelUint8},
+		encodeJPEG,
+	}, "jpeg", "jpg")
+	RegisterImageEncoder(imageEncoder{
+		"image/tiff",
+		[]string{ChannelUint8, ChannelUint16, ChannelFloat32, ChannelUint64},
+		encodeTIFF,
+	}, "tiff", "tif")
+	RegisterImageEncoder(imageEncoder{
+		"image/bmp",
+		[]string{ChannelUint8},
+		encodeBMP,
+	}, "bmp")
+}
+
+// goImageFromChannel returns a Go image for the raw data.  Note that Go 16-bit images
+// are big-endian so uint16 data is copied.
+func goImageFromChannel(data []byte, nx, ny int, channelType string) (image.Image, error) {
+	switch channelType {
+	case ChannelUint8:
+		return ImageGrayFromData(data, nx, ny), nil
+	case ChannelUint16:
+		img := image.NewGray16(image.Rect(0, 0, nx, ny))
+		for i := 0; i < len(data); i += 2 {
+			img.Pix[i] = data[i+1]
+			img.Pix[i+1] = data[i]
+		}
+		return img, nil
+	case ChannelUint64:
+		return ImageNRGBA64FromData(data, nx, ny), nil
+	default:
+		return nil, fmt.Errorf("Can't convert %s data to go image", channelType)
+	}
+}
+
+func encodePNG(w io.Writer, data []byte, nx, ny int, channelType, options string) error {
+	img, err := goImageFromChannel(data, nx, ny, channelType)
+	if err != nil {
+		return err
+	}
+	encoder := png.Encoder{CompressionLevel: png.DefaultCompression}
+	if options != "" {
+		level, err := strconv.Atoi(options)
+		if err != nil {
+			return fmt.Errorf("Bad png compression level %q: %s", options, err.Error())
+		}
+		switch {
+		case level == 0:
+			encoder.CompressionLevel = png.NoCompression
+		case level < 5:
+			encoder.CompressionLevel = png.BestSpeed
+		case level > 7:
+			encoder.CompressionLevel = png.BestCompression
+		}
+	}
+	return encoder.Encode(w, img)
+}
+
+func encodeJPEG(w io.Writer, data []byte, nx, ny int, channelType, options string) error {
+	quality := DefaultJPEGQuality
+	if options != "" {
+		var err error
+		if quality, err = strconv.Atoi(options); err != nil {
+			return fmt.Errorf("Bad jpeg quality %q: %s", options, err.Error())
+		}
+	}
+	return jpeg.Encode(w, ImageGrayFromData(data, nx, ny), &jpeg.Options{Quality: quality})
+}
+
+func encodeBMP(w io.Writer, data []byte, nx, ny int, channelType, options string) error {
+	return bmp.Encode(w, ImageGrayFromData(data, nx, ny))
+}
+
+// TIFF tags used in our single-strip, uncompressed, grayscale TIFF.
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip    = 278
+	tiffStripByteCounts = 279
+	tiffSampleFormat    = 339
+
+	tiffShort = 3
+	tiffLong  = 4
+)
+
+// encodeTIFF writes a little-endian TIFF with the pixel data in a single uncompressed strip.
+// Float data uses the IEEE floating point sample format.
+func encodeTIFF(w io.Writer, data []byte, nx, ny int, channelType, options string) error {
+	bytesPerPixel, err := ChannelBytes(channelType)
+	if err != nil {
+		return err
+	}
+	sampleFormat := uint32(1) // unsigned integer
+	if channelType == ChannelFloat32 {
+		sampleFormat = 3
+	}
+	entries := []struct {
+		tag, datatype uint16
+		value         uint32
+	}{
+		{tiffImageWidth, tiffLong, uint32(nx)},
+		{tiffImageLength, tiffLong, uint32(ny)},
+		{tiffBitsPerSample, tiffShort, uint32(bytesPerPixel * 8)},
+		{tiffCompression, tiffShort, 1},
+		{tiffPhotometric, tiffShort, 1}, // black is zero
+		{tiffStripOffsets, tiffLong, 0}, // set below
+		{tiffSamplesPerPixel, tiffShort, 1},
+		{tiffRowsPerStrip, tiffLong, uint32(ny)},
+		{tiffStripByteCounts, tiffLong, uint32(len(data))},
+		{tiffSampleFormat, tiffShort, sampleFormat},
+	}
+	const ifdOffset = 8
+	dataOffset := ifdOffset + 2 + 12*len(entries) + 4
+	entries[5].value = uint32(dataOffset)
+
+	var buf bytes.Buffer
+	buf.WriteString("II")
+	binary.Write(&buf, binary.LittleEndian, uint16(42))
+	binary.Write(&buf, binary.LittleEndian, uint32(ifdOffset))
+	binary.Write(&buf, binary.LittleEndian, uint16(len(entries)))
+	for _, entry := range entries {
+		binary.Write(&buf, binary.LittleEndian, entry.tag)
+		binary.Write(&buf, binary.LittleEndian, entry.datatype)
+		binary.Write(&buf, binary.LittleEndian, uint32(1))
+		if entry.datatype == tiffShort {
+			binary.Write(&buf, binary.LittleEndian, uint16(entry.value))
+			binary.Write(&buf, binary.LittleEndian, uint16(0))
+		} else {
+			binary.Write(&buf, binary.LittleEndian, entry.value)
+		}
+	}
+	binary.Write(&buf, binary.LittleEndian, uint32(0)) // no more IFDs
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,134 @@
+package dvid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"math"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+// readTestTIFF returns the width, height, bits per sample, sample format, and strip data of
+// a single-strip little-endian TIFF.
+func readTestTIFF(c *C, b []byte) (nx, ny, bits, format uint32, data []byte) {
+	c.Assert(string(b[0:2]), Equals, "II")
+	c.Assert(binary.LittleEndian.Uint16(b[2:4]), Equals, uint16(42))
+	ifd := binary.LittleEndian.Uint32(b[4:8])
+	numEntries := int(binary.LittleEndian.Uint16(b[ifd : ifd+2]))
+	var offset, count uint32
+	for i := 0; i < numEntries; i++ {
+		entry := b[int(ifd)+2+i*12:]
+		tag := binary.LittleEndian.Uint16(entry[0:2])
+		datatype := binary.LittleEndian.Uint16(entry[2:4])
+		var value uint32
+		if datatype == tiffShort {
+			value = uint32(binary.LittleEndian.Uint16(entry[8:10]))
+		} else {
+			value = binary.LittleEndian.Uint32(entry[8:12])
+		}
+		switch tag {
+		case tiffImageWidth:
+			nx = value
+		case tiffImageLength:
+			ny = value
+		case tiffBitsPerSample:
+			bits = value
+		case tiffSampleFormat:
+			format = value
+		case tiffStripOffsets:
+			offset = value
+		case tiffStripByteCounts:
+			count = value
+		}
+	}
+	data = b[offset : offset+count]
+	return
+}
+
+func (suite *DataSuite) TestPNG16Encoding(c *C) {
+	nx, ny := 37, 11
+	data := make([]byte, nx*ny*2)
+	for i := 0; i < nx*ny; i++ {
+		binary.LittleEndian.PutUint16(data[i*2:i*2+2], uint16(i*150))
+	}
+	enc, options, err := GetImageEncoder("png:9")
+	c.Assert(err, IsNil)
+	c.Assert(options, Equals, "9")
+	c.Assert(enc.CanEncode(ChannelUint16), Equals, true)
+
+	var buf bytes.Buffer
+	err = enc.Encode(&buf, data, nx, ny, ChannelUint16, options)
+	c.Assert(err, IsNil)
+
+	img, err := png.Decode(&buf)
+	c.Assert(err, IsNil)
+	gray16, ok := img.(*image.Gray16)
+	c.Assert(ok, Equals, true)
+	for y := 0; y < ny; y++ {
+		for x := 0; x < nx; x++ {
+			i := y*nx + x
+			c.Assert(gray16.Gray16At(x, y).Y, Equals, uint16(i*150))
+		}
+	}
+}
+
+func (suite *DataSuite) TestPNG8Encoding(c *C) {
+	nx, ny := 20, 30
+	data := make([]byte, nx*ny)
+	for i := range data {
+		data[i] = uint8(i)
+	}
+	enc, options, err := GetImageEncoder("")
+	c.Assert(err, IsNil)
+	c.Assert(enc.ContentType(), Equals, "image/png")
+
+	var buf bytes.Buffer
+	err = enc.Encode(&buf, data, nx, ny, ChannelUint8, options)
+	c.Assert(err, IsNil)
+
+	img, err := png.Decode(&buf)
+	c.Assert(err, IsNil)
+	gray, ok := img.(*image.Gray)
+	c.Assert(ok, Equals, true)
+	c.Assert(gray.Pix, DeepEquals, data)
+}
+
+func (suite *DataSuite) TestTIFFFloatEncoding(c *C) {
+	nx, ny := 13, 7
+	data := make([]byte, nx*ny*4)
+	for i := 0; i < nx*ny; i++ {
+		binary.LittleEndian.PutUint32(data[i*4:i*4+4], math.Float32bits(float32(i)*0.37-5.0))
+	}
+	enc, options, err := GetImageEncoder("tif")
+	c.Assert(err, IsNil)
+	c.Assert(enc.ContentType(), Equals, "image/tiff")
+
+	var buf bytes.Buffer
+	err = enc.Encode(&buf, data, nx, ny, ChannelFloat32, options)
+	c.Assert(err, IsNil)
+
+	tnx, tny, bits, format, tdata := readTestTIFF(c, buf.Bytes())
+	c.Assert(tnx, Equals, uint32(nx))
+	c.Assert(tny, Equals, uint32(ny))
+	c.Assert(bits, Equals, uint32(32))
+	c.Assert(format, Equals, uint32(3))
+	for i := 0; i < nx*ny; i++ {
+		value := math.Float32frombits(binary.LittleEndian.Uint32(tdata[i*4 : i*4+4]))
+		c.Assert(value, Equals, float32(i)*0.37-5.0)
+	}
+}
+
+func (suite *DataSuite) TestImpossibleEncoding(c *C) {
+	enc, _, err := GetImageEncoder("jpeg:80")
+	c.Assert(err, IsNil)
+	c.Assert(enc.CanEncode(ChannelFloat32), Equals, false)
+
+	var buf bytes.Buffer
+	err = enc.Encode(&buf, make([]byte, 16), 2, 2, ChannelFloat32, "80")
+	c.Assert(err, NotNil)
+
+	_, _, err = GetImageEncoder("gif")
+	c.Assert(err, NotNil)
+}
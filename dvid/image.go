@@ -1331,22 +1331,14 @@ func ImageNRGBA64FromData(data []byte, nx, ny int) (img *image.NRGBA64) {
 	return
 }
 
-// Sets the header's content type to approrprirate media type.
-// Default is PNG.
+// Sets the header's content type to approrprirate media type using the registered
+// image encoders.  Default is PNG.
 func SetImageHeader(w http.ResponseWriter, formatStr string) error {
-	format := strings.Split(formatStr, ":")
-	switch format[0] {
-	case "", "png":
-		w.Header().Set("Content-type", "image/png")
-	case "jpg", "jpeg":
-		w.Header().Set("Content-type", "image/jpeg")
-	case "tiff", "tif":
-		w.Header().Set("Content-type", "image/tiff")
-	case "bmp":
-		w.Header().Set("Content-type", "image/bmp")
-	default:
-		return fmt.Errorf("Illegal image format requested: %s", format[0])
+	enc, _, err := GetImageEncoder(formatStr)
+	if err != nil {
+		return err
 	}
+	w.Header().Set("Content-type", enc.ContentType())
 	return nil
 }
 
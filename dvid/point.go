@@ -611,14 +611,14 @@ func (p Point3d) Expand2d(plane DataShape, size Point2d) (Point3d, error) {
 	pt := p
 	switch {
 	case plane.Equals(XY):
-		p[0] += size[0]
-		p[1] += size[1]
+		pt[0] += size[0]
+		pt[1] += size[1]
 	case plane.Equals(XZ):
-		p[0] += size[0]
-		p[2] += size[1]
+		pt[0] += size[0]
+		pt[2] += size[1]
 	case plane.Equals(YZ):
-		p[1] += size[0]
-		p[2] += size[1]
+		pt[1] += size[0]
+		pt[2] += size[1]
 	default:
 		return Point3d{}, fmt.Errorf("Can't expand 3d point by %s", plane)
 	}
@@ -1511,6 +1511,10 @@ func (s *Spans) UnmarshalBinary(b []byte) error {
 		*s = Spans{}
 		return nil
 	}
+	if uint64(numSpans)*16 > uint64(buf.Len()) {
+		return fmt.Errorf("Encoding of %d spans requires %d bytes, only %d available",
+			numSpans, uint64(numSpans)*16, buf.Len())
+	}
 	*s = make(Spans, int(numSpans), int(numSpans))
 	for i := uint32(0); i < numSpans; i++ {
 		if err := binary.Read(buf, binary.LittleEndian, &((*s)[i][2])); err != nil {
@@ -68,6 +68,10 @@ func (s *DataSuite) TestPoint3d(c *C) {
 	c.Assert(result, Equals, Point3d{123, 617, 99})
 	result, _ = b.Min(a)
 	c.Assert(result, Equals, Point3d{123, 617, 99})
+
+	expanded, err := a.Expand2d(XZ, Point2d{10, 20})
+	c.Assert(err, IsNil)
+	c.Assert(expanded, Equals, Point3d{133, 8191, 32021})
 }
 
 func (s *DataSuite) TestPointNd(c *C) {
@@ -0,0 +1,157 @@
+package dvid
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SettingType is the type of value of a configuration setting.  All values are given as
+// strings, which must parse as the type.
+type SettingType string
+
+const (
+	SettingString   SettingType = "string"
+	SettingBool     SettingType = "bool"
+	SettingInt      SettingType = "int"
+	SettingDuration SettingType = "duration"
+)
+
+// CommonSettings are configuration keys accepted for any data type because the datastore
+// uses them when creating data.
+var CommonSettings = []string{"typename", "dataname", "versioned", "compression", "checksum"}
+
+// MaskedValue replaces the values of secret settings when settings are reported.
+const MaskedValue = "********"
+
+// Setting describes a configuration key accepted by a data type.  Names are matched
+// without regard to case.
+type Setting struct {
+	Name       string
+	Type       SettingType
+	Required   bool
+	Default    string
+	Modifiable bool // can be changed after the data is created
+	Secret     bool // value is masked when reported
+	Help       string
+
+	// Validate optionally checks a value that has already been parsed as the setting's type.
+	Validate func(value string) error `json:"-"`
+}
+
+// check returns an error if the value doesn't parse as the setting's type or fails its
+// validator.
+func (s Setting) check(c Config) error {
+	var value string
+	var err error
+	switch s.Type {
+	case SettingBool:
+		if _, _, err = c.GetBool(s.Name); err == nil {
+			value, _, _ = c.GetString(s.Name)
+		}
+	case SettingInt:
+		if _, _, err = c.GetInt(s.Name); err == nil {
+			value, _, _ = c.GetString(s.Name)
+		}
+	case SettingDuration:
+		if value, _, err = c.GetString(s.Name); err == nil {
+			_, err = time.ParseDuration(value)
+		}
+	default:
+		value, _, err = c.GetString(s.Name)
+	}
+	if err == nil && s.Validate != nil {
+		err = s.Validate(value)
+	}
+	if err != nil {
+		return fmt.Errorf("Bad %q setting: %s", s.Name, err.Error())
+	}
+	return nil
+}
+
+// Settings is the schema for the configuration of a data type.
+type Settings []Setting
+
+// Find returns the setting with the given name.
+func (s Settings) Find(name string) (Setting, bool) {
+	for _, setting := range s {
+		if strings.EqualFold(setting.Name, name) {
+			return setting, true
+		}
+	}
+	return Setting{}, false
+}
+
+// Names returns the names of the settings in order.  If modifiable is true, only the
+// names of settings that can be changed after creation are returned.
+func (s Settings) Names(modifiable bool) []string {
+	names := make([]string, 0, len(s))
+	for _, setting := range s {
+		if setting.Modifiable || !modifiable {
+			names = append(names, setting.Name)
+		}
+	}
+	return names
+}
+
+// Check validates a configuration against the schema.  Keys that are neither settings
+// nor CommonSettings are rejected with a message listing the accepted settings, values
+// must parse as their type and pass any validator, and required settings must be given.
+// If modify is true, the configuration changes existing data, so required settings needn't
+// be given and only modifiable settings are accepted.
+func (s Settings) Check(c Config, modify bool) error {
+	common := make(map[string]bool, len(CommonSettings))
+	for _, name := range CommonSettings {
+		common[name] = true
+	}
+	var keys []string
+	for key := range c.GetAll() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if common[key] {
+			continue
+		}
+		setting, found := s.Find(key)
+		if !found {
+			return fmt.Errorf("Unknown setting %q.  Accepted settings are: %s", key, strings.Join(s.Names(modify), ", "))
+		}
+		if modify && !setting.Modifiable {
+			return fmt.Errorf("Setting %q can't be changed after creation.  Modifiable settings are: %s",
+				setting.Name, strings.Join(s.Names(true), ", "))
+		}
+		if err := setting.check(c); err != nil {
+			return err
+		}
+	}
+	if !modify {
+		for _, setting := range s {
+			if _, found := c.Get(setting.Name); setting.Required && !found {
+				return fmt.Errorf("Required setting %q is missing", setting.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// SettingValue is a setting along with its current value.
+type SettingValue struct {
+	Setting
+	Value interface{}
+}
+
+// Values returns the settings with their current values, which are given by setting name.
+// Non-empty values of secret settings are masked.
+func (s Settings) Values(current map[string]interface{}) []SettingValue {
+	values := make([]SettingValue, len(s))
+	for i, setting := range s {
+		value := current[setting.Name]
+		if setting.Secret && value != nil && value != "" {
+			value = MaskedValue
+		}
+		values[i] = SettingValue{setting, value}
+	}
+	return values
+}
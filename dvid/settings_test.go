@@ -0,0 +1,71 @@
+package dvid
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+var testSettings = Settings{
+	{Name: "volumeid", Type: SettingString, Required: true},
+	{Name: "authkey", Type: SettingString, Required: true, Secret: true},
+	{Name: "tilesize", Type: SettingInt, Default: "512", Validate: func(value string) error {
+		if value == "0" {
+			return fmt.Errorf("tile size must be positive")
+		}
+		return nil
+	}},
+	{Name: "healthcheck", Type: SettingDuration},
+	{Name: "fallback", Type: SettingBool, Modifiable: true},
+}
+
+func (suite *DataSuite) TestSettingsCheck(c *C) {
+	config := NewConfig()
+	config.Set("typename", "googlevoxels")
+	config.Set("VolumeID", "123:test")
+	config.Set("authkey", "key")
+	config.Set("tilesize", "256")
+	config.Set("healthcheck", "5m")
+	c.Assert(testSettings.Check(config, false), IsNil)
+
+	config.Set("tilsize", "256")
+	err := testSettings.Check(config, false)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "tilsize"), Equals, true)
+	c.Assert(strings.Contains(err.Error(), "volumeid, authkey, tilesize, healthcheck, fallback"), Equals, true)
+	config.Remove("tilsize")
+
+	for key, value := range map[string]string{"tilesize": "big", "healthcheck": "5 minutes", "fallback": "maybe"} {
+		bad := NewConfig()
+		bad.Set("volumeid", "123:test")
+		bad.Set("authkey", "key")
+		bad.Set(key, value)
+		c.Assert(testSettings.Check(bad, false), NotNil, Commentf("setting %s=%s", key, value))
+	}
+	config.Set("tilesize", "0")
+	c.Assert(testSettings.Check(config, false), ErrorMatches, `Bad "tilesize" setting: tile size must be positive`)
+
+	missing := NewConfig()
+	missing.Set("volumeid", "123:test")
+	c.Assert(testSettings.Check(missing, false), ErrorMatches, `Required setting "authkey" is missing`)
+
+	// Only modifiable settings can be changed and required settings needn't be given.
+	modify := NewConfig()
+	modify.Set("fallback", "true")
+	c.Assert(testSettings.Check(modify, true), IsNil)
+	modify.Set("tilesize", "256")
+	c.Assert(testSettings.Check(modify, true), ErrorMatches, `Setting "tilesize" can't be changed after creation.*`)
+}
+
+func (suite *DataSuite) TestSettingsValues(c *C) {
+	values := testSettings.Values(map[string]interface{}{"volumeid": "123:test", "authkey": "key", "tilesize": 512})
+	c.Assert(values, HasLen, len(testSettings))
+	c.Assert(values[0].Value, Equals, "123:test")
+	c.Assert(values[1].Value, Equals, MaskedValue)
+	c.Assert(values[2].Value, Equals, 512)
+	c.Assert(values[3].Value, IsNil)
+
+	values = testSettings.Values(map[string]interface{}{"authkey": ""})
+	c.Assert(values[1].Value, Equals, "")
+}
@@ -0,0 +1,146 @@
+/*
+	This file provides an executor that runs tasks on a fixed pool of workers, where tasks
+	with the same key, e.g., a block coordinate, always run on the same worker.
+*/
+
+package dvid
+
+import (
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// shardQueueSize is the number of tasks that can be waiting for each worker before
+// Submit blocks.
+const shardQueueSize = 64
+
+// ShardTask is a task run by a ShardedExecutor.  The shard is the index of the worker running
+// the task, so tasks can use per-shard state, e.g., a storage batch, without locking.
+type ShardTask func(shard int) error
+
+// ShardedExecutor runs tasks on N workers, routing each task by the FNV hash of its key so
+// all tasks with the same key run serially in submission order while tasks with different
+// keys proceed in parallel.  After every batchSize tasks on a shard and after the shard's
+// last task, the flush function, if any, is called for that shard.  After the first error,
+// remaining tasks and flushes are skipped.
+type ShardedExecutor struct {
+	shards    []chan ShardTask
+	batchSize int
+	flush     func(shard int) error
+
+	failed int32 // set atomically on the first error
+	errs   chan error
+	wg     sync.WaitGroup
+
+	errList   []error
+	collected chan struct{} // closed when all errors have been collected
+	waitOnce  sync.Once
+	err       error
+}
+
+// NewShardedExecutor returns an executor with the given number of workers, or one per CPU
+// if numShards is not positive.  If batchSize is not positive, shards are only flushed after
+// their last task.
+func NewShardedExecutor(numShards, batchSize int, flush func(shard int) error) *ShardedExecutor {
+	if numShards <= 0 {
+		numShards = runtime.NumCPU()
+	}
+	e := &ShardedExecutor{
+		shards:    make([]chan ShardTask, numShards),
+		batchSize: batchSize,
+		flush:     flush,
+		errs:      make(chan error, numShards),
+		collected: make(chan struct{}),
+	}
+	go e.collectErrors()
+	e.wg.Add(numShards)
+	for i := range e.shards {
+		e.shards[i] = make(chan ShardTask, shardQueueSize)
+		go e.work(i)
+	}
+	return e
+}
+
+// NumShards returns the number of workers.
+func (e *ShardedExecutor) NumShards() int {
+	return len(e.shards)
+}
+
+// Shard returns the index of the worker that runs tasks with the given key.
+func (e *ShardedExecutor) Shard(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(e.shards)))
+}
+
+// Submit queues a task on the worker for the key.  It must not be called after Wait.
+func (e *ShardedExecutor) Submit(key string, task ShardTask) {
+	e.shards[e.Shard(key)] <- task
+}
+
+// Wait waits for all submitted tasks and flushes to complete and returns an error
+// summarizing any errors.
+func (e *ShardedExecutor) Wait() error {
+	e.waitOnce.Do(func() {
+		for _, tasks := range e.shards {
+			close(tasks)
+		}
+		e.wg.Wait()
+		close(e.errs)
+		<-e.collected
+		switch len(e.errList) {
+		case 0:
+		case 1:
+			e.err = e.errList[0]
+		default:
+			e.err = fmt.Errorf("%s (and %d other errors)", e.errList[0].Error(), len(e.errList)-1)
+		}
+	})
+	return e.err
+}
+
+func (e *ShardedExecutor) collectErrors() {
+	for err := range e.errs {
+		e.errList = append(e.errList, err)
+	}
+	close(e.collected)
+}
+
+func (e *ShardedExecutor) fail(err error) {
+	atomic.StoreInt32(&e.failed, 1)
+	e.errs <- err
+}
+
+func (e *ShardedExecutor) work(shard int) {
+	defer e.wg.Done()
+	var pending int
+	for task := range e.shards[shard] {
+		if atomic.LoadInt32(&e.failed) != 0 {
+			continue
+		}
+		if err := task(shard); err != nil {
+			e.fail(err)
+			continue
+		}
+		pending++
+		if e.batchSize > 0 && pending >= e.batchSize {
+			e.flushShard(shard)
+			pending = 0
+		}
+	}
+	if pending > 0 && atomic.LoadInt32(&e.failed) == 0 {
+		e.flushShard(shard)
+	}
+}
+
+func (e *ShardedExecutor) flushShard(shard int) {
+	if e.flush == nil {
+		return
+	}
+	if err := e.flush(shard); err != nil {
+		e.fail(err)
+	}
+}
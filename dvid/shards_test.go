@@ -0,0 +1,126 @@
+package dvid
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestShardedExecutorOrder(c *C) {
+	const numKeys = 50
+	const tasksPerKey = 200
+
+	var mu sync.Mutex
+	flushes := make([]int, 4)
+	executor := NewShardedExecutor(4, 10, func(shard int) error {
+		mu.Lock()
+		flushes[shard]++
+		mu.Unlock()
+		return nil
+	})
+	c.Assert(executor.NumShards(), Equals, 4)
+
+	// Tasks on the same key run in submission order on one shard without locking.
+	seen := make([][]int, numKeys)
+	shardOf := make([]int32, numKeys)
+	var running int32
+	var maxRunning int32
+	var wg sync.WaitGroup
+	for k := 0; k < numKeys; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			key := fmt.Sprintf("block-%d", k)
+			for i := 0; i < tasksPerKey; i++ {
+				i := i
+				executor.Submit(key, func(shard int) error {
+					n := atomic.AddInt32(&running, 1)
+					for {
+						max := atomic.LoadInt32(&maxRunning)
+						if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+							break
+						}
+					}
+					seen[k] = append(seen[k], i)
+					atomic.StoreInt32(&shardOf[k], int32(shard))
+					atomic.AddInt32(&running, -1)
+					return nil
+				})
+			}
+		}(k)
+	}
+	wg.Wait()
+	c.Assert(executor.Wait(), IsNil)
+
+	for k := 0; k < numKeys; k++ {
+		c.Assert(seen[k], HasLen, tasksPerKey)
+		for i, task := range seen[k] {
+			if task != i {
+				c.Fatalf("Key %d ran task %d at position %d", k, task, i)
+			}
+		}
+		c.Assert(int(shardOf[k]), Equals, executor.Shard(fmt.Sprintf("block-%d", k)))
+	}
+	c.Assert(maxRunning <= 4, Equals, true)
+
+	// Each shard is flushed after every 10 tasks and after its last task.
+	var totalFlushes int
+	for _, n := range flushes {
+		totalFlushes += n
+	}
+	c.Assert(totalFlushes >= numKeys*tasksPerKey/10, Equals, true)
+	c.Assert(totalFlushes <= numKeys*tasksPerKey/10+4, Equals, true)
+}
+
+func (suite *DataSuite) TestShardedExecutorErrors(c *C) {
+	executor := NewShardedExecutor(0, 0, nil)
+	c.Assert(executor.NumShards() > 0, Equals, true)
+	c.Assert(executor.Wait(), IsNil)
+
+	// Remaining tasks and flushes are skipped after the first error.
+	var flushed int32
+	executor = NewShardedExecutor(1, 0, func(shard int) error {
+		atomic.AddInt32(&flushed, 1)
+		return nil
+	})
+	var ran int32
+	for i := 0; i < 1000; i++ {
+		i := i
+		executor.Submit(fmt.Sprintf("%d", i%7), func(shard int) error {
+			atomic.AddInt32(&ran, 1)
+			if i == 3 {
+				return fmt.Errorf("task %d failed", i)
+			}
+			return nil
+		})
+	}
+	err := executor.Wait()
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, "task 3 failed")
+	c.Assert(executor.Wait(), Equals, err)
+	c.Assert(atomic.LoadInt32(&ran), Equals, int32(4))
+	c.Assert(atomic.LoadInt32(&flushed), Equals, int32(0))
+
+	// Errors from different shards are aggregated.
+	executor = NewShardedExecutor(2, 0, nil)
+	keys := make([]string, 2)
+	for i := 0; keys[0] == "" || keys[1] == ""; i++ {
+		key := fmt.Sprintf("block-%d", i)
+		keys[executor.Shard(key)] = key
+	}
+	var started sync.WaitGroup
+	started.Add(2)
+	for _, key := range keys {
+		executor.Submit(key, func(shard int) error {
+			started.Done()
+			started.Wait()
+			return fmt.Errorf("shard %d failed", shard)
+		})
+	}
+	err = executor.Wait()
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "(and 1 other errors)"), Equals, true)
+}
@@ -0,0 +1,123 @@
+package dvid
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// Phase is the time spent in one phase of an operation.  Nested phases are named by
+// their path, e.g., "write/rles", and have a depth one larger than their parent.
+type Phase struct {
+	Name    string
+	Depth   int
+	Elapsed time.Duration
+
+	start time.Time
+}
+
+// PhaseTimer breaks down the time of an operation into phases, which may be nested.
+// Consecutive phases started with Next share the same instant so top-level phases
+// account for all time between the first and last phase.
+// Example:
+//     timer := NewPhaseTimer()
+//     timer.Start("parse")
+//     ...
+//     timer.Next("write")
+//     timer.Start("rles")      // nested phase "write/rles"
+//     ...
+//     timer.Stop()             // ends "write/rles"
+//     timer.Stop()             // ends "write"
+//     Infof("Merged labels: %s\n", timer)
+type PhaseTimer struct {
+	start  time.Time
+	phases []Phase
+	open   []int // indices of started phases that haven't stopped, innermost last
+}
+
+// NewPhaseTimer returns a timer with room for a typical number of phases.
+func NewPhaseTimer() *PhaseTimer {
+	return &PhaseTimer{
+		start:  time.Now(),
+		phases: make([]Phase, 0, 8),
+		open:   make([]int, 0, 4),
+	}
+}
+
+func (t *PhaseTimer) startAt(name string, now time.Time) {
+	depth := len(t.open)
+	if depth > 0 {
+		name = t.phases[t.open[depth-1]].Name + "/" + name
+	}
+	t.open = append(t.open, len(t.phases))
+	t.phases = append(t.phases, Phase{Name: name, Depth: depth, start: now})
+}
+
+func (t *PhaseTimer) stopAt(now time.Time) {
+	n := len(t.open)
+	if n == 0 {
+		return
+	}
+	phase := &t.phases[t.open[n-1]]
+	phase.Elapsed = now.Sub(phase.start)
+	t.open = t.open[:n-1]
+}
+
+// Start begins a phase nested within the innermost running phase, if any.
+func (t *PhaseTimer) Start(name string) {
+	t.startAt(name, time.Now())
+}
+
+// Stop ends the innermost running phase.
+func (t *PhaseTimer) Stop() {
+	t.stopAt(time.Now())
+}
+
+// Next ends the innermost running phase and starts the given phase at the same level.
+func (t *PhaseTimer) Next(name string) {
+	now := time.Now()
+	t.stopAt(now)
+	t.startAt(name, now)
+}
+
+// StopAll ends all running phases.
+func (t *PhaseTimer) StopAll() {
+	now := time.Now()
+	for len(t.open) > 0 {
+		t.stopAt(now)
+	}
+}
+
+// Phases returns the phases in the order they were started.  Running phases have zero
+// elapsed time.
+func (t *PhaseTimer) Phases() []Phase {
+	return t.phases
+}
+
+// Elapsed returns the time since the timer was created.
+func (t *PhaseTimer) Elapsed() time.Duration {
+	return time.Since(t.start)
+}
+
+// Millis returns the elapsed milliseconds of each phase by name, where the times of
+// repeated phases are added.
+func (t *PhaseTimer) Millis() map[string]float64 {
+	millis := make(map[string]float64, len(t.phases))
+	for _, phase := range t.phases {
+		millis[phase.Name] += float64(phase.Elapsed) / float64(time.Millisecond)
+	}
+	return millis
+}
+
+// String returns the phases and their elapsed times in order, e.g.,
+// "parse=1.2ms write=30ms write/rles=25ms".
+func (t *PhaseTimer) String() string {
+	var buf bytes.Buffer
+	for i, phase := range t.phases {
+		if i != 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(&buf, "%s=%s", phase.Name, phase.Elapsed)
+	}
+	return buf.String()
+}
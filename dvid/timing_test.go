@@ -0,0 +1,54 @@
+package dvid
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/janelia-flyem/go/gocheck"
+)
+
+func (suite *DataSuite) TestPhaseTimer(c *C) {
+	timer := NewPhaseTimer()
+	timer.Start("parse")
+	time.Sleep(2 * time.Millisecond)
+	timer.Next("write")
+	timer.Start("rles")
+	time.Sleep(3 * time.Millisecond)
+	timer.Next("sizes")
+	time.Sleep(time.Millisecond)
+	timer.Stop()
+	timer.Next("notify")
+	timer.StopAll()
+	total := timer.Elapsed()
+
+	phases := timer.Phases()
+	c.Assert(phases, HasLen, 5)
+	names := make([]string, len(phases))
+	var topLevel, nested time.Duration
+	for i, phase := range phases {
+		names[i] = phase.Name
+		switch phase.Depth {
+		case 0:
+			topLevel += phase.Elapsed
+		case 1:
+			nested += phase.Elapsed
+		}
+	}
+	c.Assert(names, DeepEquals, []string{"parse", "write", "write/rles", "write/sizes", "notify"})
+	c.Assert(phases[2].Depth, Equals, 1)
+
+	// Consecutive phases leave no gaps, so top-level phases account for the wall time.
+	c.Assert(topLevel <= total, Equals, true)
+	c.Assert(total-topLevel < time.Millisecond, Equals, true)
+	c.Assert(nested <= phases[1].Elapsed, Equals, true)
+	c.Assert(phases[0].Elapsed >= 2*time.Millisecond, Equals, true)
+
+	millis := timer.Millis()
+	c.Assert(millis["write/rles"] >= 3, Equals, true)
+	c.Assert(strings.HasPrefix(timer.String(), "parse="), Equals, true)
+	c.Assert(strings.Contains(timer.String(), " write/sizes="), Equals, true)
+
+	// Extra stops are ignored.
+	timer.Stop()
+	c.Assert(timer.Phases(), HasLen, 5)
+}
@@ -8,8 +8,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
+	"sort"
 	"strconv"
 )
 
@@ -321,6 +323,16 @@ func NewRLE(start Point3d, length int32) RLE {
 	return RLE{start, length}
 }
 
+// StartPt returns the coordinate of the first voxel of the run.
+func (rle RLE) StartPt() Point3d {
+	return rle.start
+}
+
+// Length returns the number of voxels in the run.
+func (rle RLE) Length() int32 {
+	return rle.length
+}
+
 // RLEs are simply a slice of RLE.
 type RLEs []RLE
 
@@ -411,6 +423,42 @@ func (rles *RLEs) UnmarshalBinary(b []byte) error {
 	return nil
 }
 
+// rleReadChunk is the number of RLEs read at a time by UnmarshalBinaryReader, so a bad
+// count can only force an allocation as large as the data actually read.
+const rleReadChunk = 4096
+
+// UnmarshalBinaryReader reads the given number of encoded RLEs from a reader.  The RLEs
+// are allocated as they are read rather than all at once, and a short read returns an
+// error, so a stream that lies about its number of RLEs can't force a large allocation.
+func (rles *RLEs) UnmarshalBinaryReader(r io.Reader, numRLEs uint32) error {
+	capacity := numRLEs
+	if capacity > rleReadChunk {
+		capacity = rleReadChunk
+	}
+	*rles = make(RLEs, 0, capacity)
+	buf := make([]byte, 16*capacity)
+	for remaining := numRLEs; remaining > 0; {
+		n := remaining
+		if n > rleReadChunk {
+			n = rleReadChunk
+		}
+		if _, err := io.ReadFull(r, buf[:16*n]); err != nil {
+			return fmt.Errorf("Expected %d RLEs, only able to read %d: %s", numRLEs, len(*rles), err.Error())
+		}
+		for i := uint32(0); i < n; i++ {
+			b := buf[16*i:]
+			var rle RLE
+			rle.start[0] = int32(binary.LittleEndian.Uint32(b[0:4]))
+			rle.start[1] = int32(binary.LittleEndian.Uint32(b[4:8]))
+			rle.start[2] = int32(binary.LittleEndian.Uint32(b[8:12]))
+			rle.length = int32(binary.LittleEndian.Uint32(b[12:16]))
+			*rles = append(*rles, rle)
+		}
+		remaining -= n
+	}
+	return nil
+}
+
 // Add adds the given RLEs to the receiver when there's a possibility of overlapping RLEs.
 // If you are guaranteed the RLEs are disjoint, e.g., the passed and receiver RLEs are in
 // different subvolumes, then just concatenate the RLEs instead of calling this function.
@@ -450,6 +498,51 @@ func (rles *RLEs) Add(rles2 RLEs) {
 	}
 }
 
+// rlesByZYX sorts RLEs by the z, y, and x of their starts.
+type rlesByZYX RLEs
+
+func (r rlesByZYX) Len() int      { return len(r) }
+func (r rlesByZYX) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rlesByZYX) Less(i, j int) bool {
+	a, b := r[i].start, r[j].start
+	if a[2] != b[2] {
+		return a[2] < b[2]
+	}
+	if a[1] != b[1] {
+		return a[1] < b[1]
+	}
+	return a[0] < b[0]
+}
+
+// Normalize returns a copy of the RLEs sorted by z, y, and x, with adjacent or overlapping
+// runs along a row merged into a single run.  The voxels covered are unchanged.
+func (rles RLEs) Normalize() RLEs {
+	if len(rles) == 0 {
+		return RLEs{}
+	}
+	sorted := make(RLEs, len(rles))
+	copy(sorted, rles)
+	sort.Sort(rlesByZYX(sorted))
+	normalized := make(RLEs, 0, len(sorted))
+	for _, rle := range sorted {
+		if rle.length <= 0 {
+			continue
+		}
+		if n := len(normalized); n > 0 {
+			last := &normalized[n-1]
+			if last.start[1] == rle.start[1] && last.start[2] == rle.start[2] &&
+				rle.start[0] <= last.start[0]+last.length {
+				if end := rle.start[0] + rle.length; end > last.start[0]+last.length {
+					last.length = end - last.start[0]
+				}
+				continue
+			}
+		}
+		normalized = append(normalized, rle)
+	}
+	return normalized
+}
+
 // Stats returns the total number of voxels and runs.
 func (rles RLEs) Stats() (numVoxels, numRuns int32) {
 	if rles == nil || len(rles) == 0 {
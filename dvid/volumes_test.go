@@ -1,6 +1,9 @@
 package dvid
 
 import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
 	_ "testing"
 
 	. "github.com/janelia-flyem/go/gocheck"
@@ -56,6 +59,92 @@ func (s *VolumeTest) TestRLE(c *C) {
 	c.Assert(s.rles, DeepEquals, expectedRLEs)
 }
 
+func (s *VolumeTest) TestRLENormalize(c *C) {
+	rles := RLEs{
+		{Point3d{10, 3, 4}, 5},
+		{Point3d{0, 3, 4}, 10},
+		{Point3d{12, 3, 4}, 2},
+		{Point3d{20, 3, 4}, 4},
+		{Point3d{0, 2, 4}, 3},
+		{Point3d{5, 3, 1}, 1},
+		{Point3d{6, 3, 1}, 0},
+	}
+	expected := RLEs{
+		{Point3d{5, 3, 1}, 1},
+		{Point3d{0, 2, 4}, 3},
+		{Point3d{0, 3, 4}, 15},
+		{Point3d{20, 3, 4}, 4},
+	}
+	c.Assert(rles.Normalize(), DeepEquals, expected)
+	c.Assert(rles[0], DeepEquals, RLE{Point3d{10, 3, 4}, 5})
+	c.Assert(expected.Normalize(), DeepEquals, expected)
+	c.Assert(RLEs(nil).Normalize(), HasLen, 0)
+}
+
+func (s *VolumeTest) TestRLEReader(c *C) {
+	var expected RLEs
+	c.Assert(expected.UnmarshalBinary(s.encoding), IsNil)
+
+	var obtained RLEs
+	err := obtained.UnmarshalBinaryReader(bytes.NewReader(s.encoding), 3)
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, expected)
+
+	// More RLEs than a single chunk.
+	many := make(RLEs, 2*rleReadChunk+5)
+	for i := range many {
+		many[i] = RLE{Point3d{int32(i), 2, 3}, int32(i%7 + 1)}
+	}
+	encoding, err := many.MarshalBinary()
+	c.Assert(err, IsNil)
+	err = obtained.UnmarshalBinaryReader(bytes.NewReader(encoding), uint32(len(many)))
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, many)
+
+	// Short reads fail rather than returning partial RLEs.
+	err = obtained.UnmarshalBinaryReader(bytes.NewReader(s.encoding[:40]), 3)
+	c.Assert(err, NotNil)
+	err = obtained.UnmarshalBinaryReader(bytes.NewReader(s.encoding), 4)
+	c.Assert(err, NotNil)
+}
+
+func (s *VolumeTest) TestAdversarialRLECounts(c *C) {
+	rng := rand.New(rand.NewSource(7))
+	counts := []uint32{0, 1, 3, rleReadChunk, rleReadChunk + 1, 1 << 24, 0x7FFFFFFF, 0xFFFFFFFF}
+	for i := 0; i < 200; i++ {
+		var numRLEs uint32
+		if i < len(counts) {
+			numRLEs = counts[i]
+		} else {
+			numRLEs = rng.Uint32()
+		}
+		data := make([]byte, rng.Intn(1000))
+		rng.Read(data)
+
+		var rles RLEs
+		err := rles.UnmarshalBinaryReader(bytes.NewReader(data), numRLEs)
+		if uint64(numRLEs)*16 > uint64(len(data)) {
+			c.Assert(err, NotNil)
+		} else {
+			c.Assert(err, IsNil)
+			c.Assert(len(rles), Equals, int(numRLEs))
+		}
+		c.Assert(cap(rles) <= rleReadChunk+len(data)/16, Equals, true)
+
+		// Spans with the same count in their header.
+		encoding := make([]byte, 4+len(data))
+		binary.LittleEndian.PutUint32(encoding, numRLEs)
+		copy(encoding[4:], data)
+		var spans Spans
+		err = spans.UnmarshalBinary(encoding)
+		if uint64(numRLEs)*16 > uint64(len(data)) {
+			c.Assert(err, NotNil)
+		} else {
+			c.Assert(err, IsNil)
+		}
+	}
+}
+
 func (s *VolumeTest) TestSparseVol(c *C) {
 	var vol SparseVol
 	err := vol.AddSerializedRLEs(s.encoding)
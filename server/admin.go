@@ -0,0 +1,32 @@
+/*
+	This file supports administrative HTTP requests, which must present the admin token
+	given in the server configuration.
+*/
+
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// AdminTokenHeader is the request header holding the admin token.
+const AdminTokenHeader = "X-DVID-Admin-Token"
+
+var adminToken string
+
+// SetAdminToken sets the token required for administrative HTTP requests.  An empty
+// token refuses all administrative HTTP requests.
+func SetAdminToken(token string) {
+	adminToken = token
+}
+
+// IsAdmin returns true if the request presents the admin token.  If the server has no
+// admin token, administrative changes can only be made through the command line.
+func IsAdmin(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := r.Header.Get(AdminTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
@@ -0,0 +1,63 @@
+/*
+	This file resolves the base URL of this server as seen by clients, so links generated by
+	handlers are correct behind a reverse proxy that terminates TLS or serves DVID under a
+	path prefix.
+*/
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var baseURL string
+
+// SetBaseURL sets the base URL of this server as seen by clients, e.g.,
+// "https://emdata.example.org/dvid", which overrides any description of the server in the
+// requests.  An empty URL uses that of each request.
+func SetBaseURL(u string) error {
+	if u != "" {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("Bad base URL %q: expected a URL like \"https://dvid.example.org/prefix\"", u)
+		}
+	}
+	baseURL = strings.TrimRight(u, "/")
+	return nil
+}
+
+// firstForwarded returns the first value of a possibly comma-separated forwarded header,
+// which is the one set by the proxy closest to the client.
+func firstForwarded(r *http.Request, header string) string {
+	return strings.TrimSpace(strings.Split(r.Header.Get(header), ",")[0])
+}
+
+// BaseURL returns the scheme, host, and any path prefix of this server as seen by the client
+// of a request without a trailing slash, e.g., "https://emdata.example.org/dvid".  The base
+// URL set in the server configuration takes precedence.  Otherwise requests through a proxy
+// are described by the first X-Forwarded-Proto, X-Forwarded-Host, and X-Forwarded-Prefix
+// values, if any.
+func BaseURL(r *http.Request) string {
+	if baseURL != "" {
+		return baseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if forwarded := firstForwarded(r, "X-Forwarded-Proto"); forwarded != "" {
+		scheme = strings.ToLower(forwarded)
+	}
+	host := r.Host
+	if forwarded := firstForwarded(r, "X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	prefix := strings.Trim(firstForwarded(r, "X-Forwarded-Prefix"), "/")
+	if prefix != "" {
+		prefix = "/" + prefix
+	}
+	return scheme + "://" + host + prefix
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestBaseURL(t *testing.T) {
+	defer SetBaseURL("")
+
+	r, _ := http.NewRequest("GET", "/api/help", nil)
+	r.Host = "10.0.0.5:8000"
+	if u := BaseURL(r); u != "http://10.0.0.5:8000" {
+		t.Errorf("Expected base URL of direct request, got %q\n", u)
+	}
+	r.TLS = &tls.ConnectionState{}
+	if u := BaseURL(r); u != "https://10.0.0.5:8000" {
+		t.Errorf("Expected https base URL of TLS request, got %q\n", u)
+	}
+	r.TLS = nil
+
+	// The first forwarded values are those of the proxy closest to the client.
+	r.Header.Set("X-Forwarded-Proto", "HTTPS, http")
+	r.Header.Set("X-Forwarded-Host", "emdata.example.org, internal-proxy:80")
+	r.Header.Set("X-Forwarded-Prefix", "/dvid/, /")
+	if u := BaseURL(r); u != "https://emdata.example.org/dvid" {
+		t.Errorf("Expected base URL from forwarded headers, got %q\n", u)
+	}
+
+	// The configured base URL takes precedence over the forwarded headers.
+	if err := SetBaseURL("https://dvid.example.org/prod/"); err != nil {
+		t.Fatalf("Unable to set base URL: %s\n", err.Error())
+	}
+	if u := BaseURL(r); u != "https://dvid.example.org/prod" {
+		t.Errorf("Expected configured base URL, got %q\n", u)
+	}
+	for _, bad := range []string{"dvid.example.org", "ftp://dvid.example.org", "https://"} {
+		if err := SetBaseURL(bad); err == nil {
+			t.Errorf("Expected error setting bad base URL %q\n", bad)
+		}
+	}
+	if u := BaseURL(r); u != "https://dvid.example.org/prod" {
+		t.Errorf("Expected bad base URLs to be ignored, got %q\n", u)
+	}
+	SetBaseURL("")
+	if u := BaseURL(r); u != "https://emdata.example.org/dvid" {
+		t.Errorf("Expected cleared base URL to use forwarded headers, got %q\n", u)
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// ErrorKind classifies errors returned by HTTP handlers so clients can decide whether
+// a request should be retried, corrected, or abandoned.
+type ErrorKind uint8
+
+const (
+	// BadRequestError is the default kind and signals a malformed or illegal request.
+	BadRequestError ErrorKind = iota
+
+	// NotFoundError signals the requested data is not available.
+	NotFoundError
+
+	// UpstreamError signals a failure of an external service, e.g., a proxied API.
+	UpstreamError
+
+	// StorageError signals a failure of the storage engine.
+	StorageError
+
+	// ConflictError signals the request conflicts with the current state of the data.
+	ConflictError
+
+	// UnavailableError signals a service is known to be down so the request was not attempted.
+	UnavailableError
+
+	// ReadOnlyError signals the request would modify data that has been frozen.
+	ReadOnlyError
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case BadRequestError:
+		return "bad-request"
+	case NotFoundError:
+		return "not-found"
+	case UpstreamError:
+		return "upstream"
+	case StorageError:
+		return "storage"
+	case ConflictError:
+		return "conflict"
+	case UnavailableError:
+		return "unavailable"
+	case ReadOnlyError:
+		return "readonly"
+	default:
+		return "unknown"
+	}
+}
+
+// StatusCode returns the HTTP status code corresponding to the error kind.
+func (k ErrorKind) StatusCode() int {
+	switch k {
+	case NotFoundError:
+		return http.StatusNotFound
+	case UpstreamError:
+		return http.StatusBadGateway
+	case StorageError:
+		return http.StatusInternalServerError
+	case ConflictError:
+		return http.StatusConflict
+	case UnavailableError:
+		return http.StatusServiceUnavailable
+	case ReadOnlyError:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// Error is an error tagged with an ErrorKind.  If RetryAfter is non-zero, responses for
+// the error advise clients to retry after that wait using the Retry-After header.
+type Error struct {
+	Kind       ErrorKind
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// NewError returns an error of the given kind with a formatted message.
+func NewError(kind ErrorKind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// NewRetryableError returns an UnavailableError with a formatted message that advises
+// clients to retry the request after the given wait.
+func NewRetryableError(retryAfter time.Duration, format string, args ...interface{}) error {
+	return &Error{Kind: UnavailableError, Message: fmt.Sprintf(format, args...), RetryAfter: retryAfter}
+}
+
+// retryAfterSeconds returns the whole number of seconds, rounded up, for a Retry-After header.
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10)
+}
+
+// ErrorKindOf returns the kind of the given error.  Errors that were not created
+// via NewError are considered bad requests.
+func ErrorKindOf(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return BadRequestError
+}
+
+var (
+	requestIDPrefix  = strconv.FormatInt(time.Now().Unix(), 36)
+	requestIDCounter uint64
+)
+
+// NewRequestID returns an identifier unique to this server process that can be used to
+// correlate log lines with error responses for a single request.
+func NewRequestID() string {
+	return fmt.Sprintf("%s-%d", requestIDPrefix, atomic.AddUint64(&requestIDCounter, 1))
+}
+
+// ErrorResponse writes an error using a status code appropriate for the kind of error.
+// The response is JSON of the form {"error": ..., "kind": ..., "request-id": ...}
+// unless the client's Accept header prefers text/plain.
+func ErrorResponse(w http.ResponseWriter, r *http.Request, requestID string, err error) {
+	kind := ErrorKindOf(err)
+	dvid.Errorf("ERROR [%s] %s: %s (%s).", requestID, kind, err.Error(), r.URL.Path)
+
+	w.Header().Set("X-Request-Id", requestID)
+	if e, ok := err.(*Error); ok && e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(e.RetryAfter))
+	}
+	if prefersPlainText(r) {
+		errorMsg := fmt.Sprintf("ERROR: %s (%s).", err.Error(), r.URL.Path)
+		http.Error(w, errorMsg, kind.StatusCode())
+		return
+	}
+	jsonBytes, jsonErr := json.Marshal(struct {
+		Error     string `json:"error"`
+		Kind      string `json:"kind"`
+		RequestID string `json:"request-id"`
+	}{
+		err.Error(),
+		kind.String(),
+		requestID,
+	})
+	if jsonErr != nil {
+		http.Error(w, err.Error(), kind.StatusCode())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(kind.StatusCode())
+	w.Write(jsonBytes)
+}
+
+// prefersPlainText returns true if the Accept header ranks text/plain above JSON.
+func prefersPlainText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+	var plainQ, jsonQ float64 = -1, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		switch mediaType {
+		case "text/plain":
+			if q > plainQ {
+				plainQ = q
+			}
+		case "application/json":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+	return plainQ > 0 && plainQ > jsonQ
+}
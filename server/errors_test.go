@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorResponseStatus(t *testing.T) {
+	tests := []struct {
+		kind   ErrorKind
+		status int
+		name   string
+	}{
+		{BadRequestError, http.StatusBadRequest, "bad-request"},
+		{NotFoundError, http.StatusNotFound, "not-found"},
+		{UpstreamError, http.StatusBadGateway, "upstream"},
+		{StorageError, http.StatusInternalServerError, "storage"},
+		{ConflictError, http.StatusConflict, "conflict"},
+		{UnavailableError, http.StatusServiceUnavailable, "unavailable"},
+		{ReadOnlyError, http.StatusForbidden, "readonly"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/api/node/abc/mydata/tile", nil)
+		w := httptest.NewRecorder()
+		ErrorResponse(w, r, "myid", NewError(test.kind, "some error %d", 23))
+		if w.Code != test.status {
+			t.Errorf("Expected status %d for %s error, got %d\n", test.status, test.kind, w.Code)
+		}
+		var resp struct {
+			Error     string `json:"error"`
+			Kind      string `json:"kind"`
+			RequestID string `json:"request-id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Unable to decode JSON error response %q: %s\n", w.Body.String(), err.Error())
+		}
+		if resp.Error != "some error 23" || resp.Kind != test.name || resp.RequestID != "myid" {
+			t.Errorf("Bad JSON error response for %s: %v\n", test.kind, resp)
+		}
+	}
+
+	// Errors without a kind should be bad requests.
+	r, _ := http.NewRequest("GET", "/api/node/abc/mydata/tile", nil)
+	w := httptest.NewRecorder()
+	ErrorResponse(w, r, "myid", fmt.Errorf("plain error"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for untyped error, got %d\n", w.Code)
+	}
+}
+
+func TestErrorResponsePlainText(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/api/node/abc/mydata/tile", nil)
+	r.Header.Set("Accept", "application/json;q=0.5, text/plain")
+	w := httptest.NewRecorder()
+	ErrorResponse(w, r, "myid", NewError(UpstreamError, "google is down"))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected status 502, got %d\n", w.Code)
+	}
+	if !strings.HasPrefix(w.Body.String(), "ERROR: google is down") {
+		t.Errorf("Expected plain text error, got %q\n", w.Body.String())
+	}
+	if w.Header().Get("X-Request-Id") != "myid" {
+		t.Errorf("Expected request id header, got %q\n", w.Header().Get("X-Request-Id"))
+	}
+}
+
+func TestErrorResponseRetryAfter(t *testing.T) {
+	r, _ := http.NewRequest("POST", "/api/node/abc/mydata/merge", nil)
+	w := httptest.NewRecorder()
+	ErrorResponse(w, r, "myid", NewRetryableError(1500*time.Millisecond, "store is reinitializing"))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d\n", w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("Expected Retry-After of 2 seconds, got %q\n", retryAfter)
+	}
+
+	// Other errors don't suggest a retry.
+	w = httptest.NewRecorder()
+	ErrorResponse(w, r, "myid", NewError(UnavailableError, "google is down"))
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "" {
+		t.Errorf("Expected no Retry-After header, got %q\n", retryAfter)
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	id1 := NewRequestID()
+	id2 := NewRequestID()
+	if id1 == id2 {
+		t.Errorf("Expected unique request ids, got %q twice\n", id1)
+	}
+}
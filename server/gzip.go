@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+// WriteJSON writes already marshaled JSON to the response, gzip-encoding it if the client
+// accepts gzip.  Since the whole response is available, the Content-Length is always set.
+func WriteJSON(w http.ResponseWriter, r *http.Request, jsonBytes []byte) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Encoding")
+	if dvid.SupportsGzipEncoding(r) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(jsonBytes); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		jsonBytes = buf.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(jsonBytes)))
+	_, err := w.Write(jsonBytes)
+	return err
+}
+
+// GzipResponseWriter is an http.ResponseWriter that transparently gzip-encodes the response
+// body with chunked transfer if the client accepts gzip.  Responses that already have a
+// Content-Encoding or are images or binary data are passed through without compression.
+// Close must be called after the handler finishes writing.
+type GzipResponseWriter struct {
+	http.ResponseWriter
+
+	accepted bool // client accepts gzip
+	decided  bool // whether compression decision has been made
+	gz       *gzip.Writer
+}
+
+// NewGzipResponseWriter returns a wrapper around w that will compress the response
+// if the request allows it.
+func NewGzipResponseWriter(w http.ResponseWriter, r *http.Request) *GzipResponseWriter {
+	return &GzipResponseWriter{
+		ResponseWriter: w,
+		accepted:       dvid.SupportsGzipEncoding(r),
+	}
+}
+
+// decide determines whether we should compress the response based on headers set so far.
+func (w *GzipResponseWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	if !w.accepted {
+		return
+	}
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" {
+		return
+	}
+	contentType := header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "image/") || contentType == "application/octet-stream" {
+		return
+	}
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+}
+
+func (w *GzipResponseWriter) WriteHeader(code int) {
+	w.decide()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *GzipResponseWriter) Write(b []byte) (int, error) {
+	w.decide()
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Flush sends any buffered compressed data to the client.
+func (w *GzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the gzip stream if the response was compressed.
+func (w *GzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
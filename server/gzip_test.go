@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testJSON = `{"VolumeID":"281930192:stanford","TileSize":512,"Levels":{"0":{"Resolution":[4,4,40]}}}`
+
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder) []byte {
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		return w.Body.Bytes()
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Unable to read gzip response: %s\n", err.Error())
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Unable to decompress gzip response: %s\n", err.Error())
+	}
+	return data
+}
+
+func TestWriteJSON(t *testing.T) {
+	var bodies [][]byte
+	for _, encoding := range []string{"", "gzip, deflate"} {
+		r, _ := http.NewRequest("GET", "/api/node/abc/mydata/info", nil)
+		if encoding != "" {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		if err := WriteJSON(w, r, []byte(testJSON)); err != nil {
+			t.Fatalf("Error writing JSON: %s\n", err.Error())
+		}
+		if encoding == "" && w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("Expected identity encoding, got %q\n", w.Header().Get("Content-Encoding"))
+		}
+		if encoding != "" && w.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("Expected gzip encoding, got %q\n", w.Header().Get("Content-Encoding"))
+		}
+		if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) {
+			t.Errorf("Bad Content-Length %q for body of %d bytes\n", w.Header().Get("Content-Length"), w.Body.Len())
+		}
+		bodies = append(bodies, decodeBody(t, w))
+	}
+	if !bytes.Equal(bodies[0], bodies[1]) || string(bodies[0]) != testJSON {
+		t.Errorf("Compressed and identity paths differ:\n%s\n%s\n", string(bodies[0]), string(bodies[1]))
+	}
+}
+
+func TestGzipResponseWriter(t *testing.T) {
+	jsonHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testJSON))
+	}
+	imageHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("not really a png"))
+	}
+
+	var bodies [][]byte
+	for _, encoding := range []string{"", "gzip"} {
+		r, _ := http.NewRequest("GET", "/api/node/abc/mydata/info", nil)
+		r.Header.Set("Accept-Encoding", encoding)
+		w := httptest.NewRecorder()
+		gw := NewGzipResponseWriter(w, r)
+		jsonHandler(gw, r)
+		if err := gw.Close(); err != nil {
+			t.Fatalf("Error closing gzip writer: %s\n", err.Error())
+		}
+		bodies = append(bodies, decodeBody(t, w))
+	}
+	if !bytes.Equal(bodies[0], bodies[1]) || string(bodies[0]) != testJSON {
+		t.Errorf("Compressed and identity paths differ:\n%s\n%s\n", string(bodies[0]), string(bodies[1]))
+	}
+
+	// Images should not be compressed.
+	r, _ := http.NewRequest("GET", "/api/node/abc/mydata/tile", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	gw := NewGzipResponseWriter(w, r)
+	imageHandler(gw, r)
+	gw.Close()
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Image response should not have been compressed\n")
+	}
+	if !strings.HasPrefix(w.Body.String(), "not really") {
+		t.Errorf("Image response was altered: %q\n", w.Body.String())
+	}
+}
@@ -0,0 +1,236 @@
+/*
+	This file supports per-route latency summaries of HTTP requests.  Latencies are
+	recorded in log-scale histograms with atomic counters so observations are cheap
+	enough to make on every request.
+*/
+
+package server
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyOutcome classifies the result of a request for latency summaries.
+type LatencyOutcome uint8
+
+const (
+	// LatencyOK is a request that succeeded.
+	LatencyOK LatencyOutcome = iota
+
+	// LatencyClientError is a request that failed with a 4xx status.
+	LatencyClientError
+
+	// LatencyServerError is a request that failed with a 5xx status.
+	LatencyServerError
+
+	numLatencyOutcomes
+)
+
+// LatencyOutcomeOf returns the outcome corresponding to an HTTP status code.
+func LatencyOutcomeOf(status int) LatencyOutcome {
+	switch {
+	case status >= 500:
+		return LatencyServerError
+	case status >= 400:
+		return LatencyClientError
+	default:
+		return LatencyOK
+	}
+}
+
+const (
+	// Each power of 2 nanoseconds is split into this many buckets, so latencies are
+	// estimated within about 6%.
+	latencySubBuckets = 8
+
+	// Latencies up to 2^48 nanoseconds (about 3 days) are distinguished.
+	latencyMaxExp     = 48
+	numLatencyBuckets = latencyMaxExp * latencySubBuckets
+)
+
+// latencyBucket returns the histogram bucket for a latency.
+func latencyBucket(d time.Duration) int {
+	if d < 1 {
+		return 0
+	}
+	frac, exp := math.Frexp(float64(d)) // d = frac * 2^exp with frac in [0.5, 1)
+	i := (exp-1)*latencySubBuckets + int((2*frac-1)*latencySubBuckets)
+	if i >= numLatencyBuckets {
+		return numLatencyBuckets - 1
+	}
+	return i
+}
+
+// latencyBucketValue returns the midpoint in nanoseconds of a histogram bucket.
+func latencyBucketValue(i int) float64 {
+	exp, sub := i/latencySubBuckets, i%latencySubBuckets
+	lo := math.Ldexp(1+float64(sub)/latencySubBuckets, exp)
+	hi := math.Ldexp(1+float64(sub+1)/latencySubBuckets, exp)
+	return (lo + hi) / 2
+}
+
+// routeLatency is the latency histogram of a route.  All fields are updated atomically.
+type routeLatency struct {
+	totalNs  uint64
+	maxNs    uint64
+	outcomes [numLatencyOutcomes]uint64
+	buckets  [numLatencyBuckets]uint64
+}
+
+func (rl *routeLatency) observe(outcome LatencyOutcome, d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	ns := uint64(d)
+	atomic.AddUint64(&rl.buckets[latencyBucket(d)], 1)
+	atomic.AddUint64(&rl.outcomes[outcome], 1)
+	atomic.AddUint64(&rl.totalNs, ns)
+	for {
+		max := atomic.LoadUint64(&rl.maxNs)
+		if ns <= max || atomic.CompareAndSwapUint64(&rl.maxNs, max, ns) {
+			break
+		}
+	}
+}
+
+// LatencySummary gives the number of requests for a route by outcome and estimated
+// latency quantiles in milliseconds.
+type LatencySummary struct {
+	Count        uint64  `json:"count"`
+	OK           uint64  `json:"ok"`
+	ClientErrors uint64  `json:"client-errors"`
+	ServerErrors uint64  `json:"server-errors"`
+	MeanMs       float64 `json:"mean-ms"`
+	P50Ms        float64 `json:"p50-ms"`
+	P90Ms        float64 `json:"p90-ms"`
+	P95Ms        float64 `json:"p95-ms"`
+	P99Ms        float64 `json:"p99-ms"`
+	MaxMs        float64 `json:"max-ms"`
+}
+
+func (rl *routeLatency) summary() LatencySummary {
+	var counts [numLatencyBuckets]uint64
+	var s LatencySummary
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&rl.buckets[i])
+		s.Count += counts[i]
+	}
+	s.OK = atomic.LoadUint64(&rl.outcomes[LatencyOK])
+	s.ClientErrors = atomic.LoadUint64(&rl.outcomes[LatencyClientError])
+	s.ServerErrors = atomic.LoadUint64(&rl.outcomes[LatencyServerError])
+	if s.Count == 0 {
+		return s
+	}
+	const nsPerMs = float64(time.Millisecond)
+	s.MeanMs = float64(atomic.LoadUint64(&rl.totalNs)) / float64(s.Count) / nsPerMs
+	maxNs := float64(atomic.LoadUint64(&rl.maxNs))
+	s.MaxMs = maxNs / nsPerMs
+
+	quantile := func(q float64) float64 {
+		rank := uint64(math.Ceil(q * float64(s.Count)))
+		var n uint64
+		for i, count := range counts {
+			n += count
+			if n >= rank {
+				return math.Min(latencyBucketValue(i), maxNs) / nsPerMs
+			}
+		}
+		return s.MaxMs
+	}
+	s.P50Ms = quantile(0.5)
+	s.P90Ms = quantile(0.9)
+	s.P95Ms = quantile(0.95)
+	s.P99Ms = quantile(0.99)
+	return s
+}
+
+// LatencyRecorder maintains latency histograms for named routes.
+type LatencyRecorder struct {
+	mu     sync.RWMutex
+	routes map[string]*routeLatency
+}
+
+// NewLatencyRecorder returns an empty latency recorder.
+func NewLatencyRecorder() *LatencyRecorder {
+	return &LatencyRecorder{routes: make(map[string]*routeLatency)}
+}
+
+// Observe records the outcome and latency of a request for a route.
+func (lr *LatencyRecorder) Observe(route string, outcome LatencyOutcome, d time.Duration) {
+	lr.mu.RLock()
+	rl, found := lr.routes[route]
+	lr.mu.RUnlock()
+	if !found {
+		lr.mu.Lock()
+		if rl, found = lr.routes[route]; !found {
+			rl = new(routeLatency)
+			lr.routes[route] = rl
+		}
+		lr.mu.Unlock()
+	}
+	rl.observe(outcome, d)
+}
+
+// Summaries returns the latency summaries of all routes.
+func (lr *LatencyRecorder) Summaries() map[string]LatencySummary {
+	lr.mu.RLock()
+	routes := make([]string, 0, len(lr.routes))
+	for route := range lr.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	summaries := make(map[string]LatencySummary, len(routes))
+	for _, route := range routes {
+		summaries[route] = lr.routes[route].summary()
+	}
+	lr.mu.RUnlock()
+	return summaries
+}
+
+// Reset discards all recorded latencies.
+func (lr *LatencyRecorder) Reset() {
+	lr.mu.Lock()
+	lr.routes = make(map[string]*routeLatency)
+	lr.mu.Unlock()
+}
+
+// Latencies is the server-wide recorder of request latencies, which are returned by
+// the /api/server/latency endpoint.
+var Latencies = NewLatencyRecorder()
+
+// LatencyTimer is a http.ResponseWriter that records the latency of a request for a
+// route in Latencies when Done is called, using the response status for its outcome.
+type LatencyTimer struct {
+	http.ResponseWriter
+	route  string
+	start  time.Time
+	status int
+}
+
+// TimeLatency starts timing a request for a route.  The returned LatencyTimer should
+// be used in place of the given writer so the response status can be recorded.
+func TimeLatency(route string, w http.ResponseWriter) *LatencyTimer {
+	return &LatencyTimer{ResponseWriter: w, route: route, start: time.Now(), status: http.StatusOK}
+}
+
+func (lt *LatencyTimer) WriteHeader(status int) {
+	lt.status = status
+	lt.ResponseWriter.WriteHeader(status)
+}
+
+// Flush allows streaming responses through the timer.
+func (lt *LatencyTimer) Flush() {
+	if f, ok := lt.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Done records the request's latency.
+func (lt *LatencyTimer) Done() {
+	Latencies.Observe(lt.route, LatencyOutcomeOf(lt.status), time.Since(lt.start))
+}
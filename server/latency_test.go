@@ -0,0 +1,110 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatencyBuckets(t *testing.T) {
+	prev := -1
+	for _, d := range []time.Duration{0, 1, 2, 3, 100, time.Microsecond, time.Millisecond, time.Second, time.Hour, 1 << 62} {
+		i := latencyBucket(d)
+		if i < prev || i >= numLatencyBuckets {
+			t.Errorf("Bad bucket %d for latency %s after bucket %d\n", i, d, prev)
+		}
+		prev = i
+		if d >= 1 && d < 1<<latencyMaxExp {
+			if v := latencyBucketValue(i); math.Abs(v-float64(d))/float64(d) > 0.07 {
+				t.Errorf("Bucket value %g for latency %d is more than 7%% off\n", v, d)
+			}
+		}
+	}
+}
+
+func TestLatencySummaries(t *testing.T) {
+	lr := NewLatencyRecorder()
+	for i := 1; i <= 1000; i++ {
+		outcome := LatencyOK
+		switch {
+		case i%100 == 0:
+			outcome = LatencyServerError
+		case i%50 == 0:
+			outcome = LatencyClientError
+		}
+		lr.Observe("tile", outcome, time.Duration(i)*time.Millisecond)
+	}
+	lr.Observe("raw", LatencyOK, 5*time.Millisecond)
+
+	summaries := lr.Summaries()
+	if len(summaries) != 2 {
+		t.Fatalf("Expected summaries for 2 routes, got %v\n", summaries)
+	}
+	s := summaries["tile"]
+	if s.Count != 1000 || s.OK != 980 || s.ClientErrors != 10 || s.ServerErrors != 10 {
+		t.Errorf("Bad tile counts: %+v\n", s)
+	}
+	expected := []struct {
+		name      string
+		got, want float64
+	}{
+		{"mean", s.MeanMs, 500.5},
+		{"p50", s.P50Ms, 500},
+		{"p90", s.P90Ms, 900},
+		{"p95", s.P95Ms, 950},
+		{"p99", s.P99Ms, 990},
+		{"max", s.MaxMs, 1000},
+	}
+	for _, e := range expected {
+		if math.Abs(e.got-e.want)/e.want > 0.07 {
+			t.Errorf("Expected tile %s latency near %g ms, got %g ms\n", e.name, e.want, e.got)
+		}
+	}
+	if s := summaries["raw"]; s.Count != 1 || s.P99Ms > 5 || s.MaxMs != 5 {
+		t.Errorf("Bad single latency summary: %+v\n", s)
+	}
+
+	lr.Reset()
+	if summaries := lr.Summaries(); len(summaries) != 0 {
+		t.Errorf("Expected no summaries after reset, got %v\n", summaries)
+	}
+}
+
+func TestLatencyTimer(t *testing.T) {
+	Latencies.Reset()
+	defer Latencies.Reset()
+
+	w := httptest.NewRecorder()
+	timer := TimeLatency("test/ok", w)
+	timer.Write([]byte("data"))
+	timer.Done()
+
+	timer = TimeLatency("test/fail", httptest.NewRecorder())
+	timer.WriteHeader(http.StatusBadGateway)
+	timer.Done()
+
+	summaries := Latencies.Summaries()
+	if s := summaries["test/ok"]; s.Count != 1 || s.OK != 1 {
+		t.Errorf("Expected one OK request, got %+v\n", s)
+	}
+	if s := summaries["test/fail"]; s.Count != 1 || s.ServerErrors != 1 {
+		t.Errorf("Expected one server error, got %+v\n", s)
+	}
+	if w.Body.String() != "data" {
+		t.Errorf("Timer did not pass through response body: %q\n", w.Body.String())
+	}
+}
+
+func BenchmarkLatencyObserve(b *testing.B) {
+	lr := NewLatencyRecorder()
+	routes := []string{"googlevoxels/tile", "googlevoxels/raw", "labels64/merge"}
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			lr.Observe(routes[i%len(routes)], LatencyOK, time.Duration(i)*time.Microsecond)
+			i++
+		}
+	})
+}
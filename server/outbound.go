@@ -0,0 +1,80 @@
+/*
+	This file supports configuration of HTTP requests from DVID to external services, e.g.,
+	through an egress proxy with a private certificate authority.
+*/
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OutboundConfig gives settings for requests from DVID to external services.
+type OutboundConfig struct {
+	// Proxy is the URL of an HTTP proxy.  If empty, the HTTP_PROXY and HTTPS_PROXY
+	// environment variables are used.
+	Proxy string
+
+	// CABundle is the path of a PEM file of trusted certificate authorities, which replace
+	// the system's.  If empty, the system's certificate authorities are used.
+	CABundle string
+}
+
+var outboundConfig OutboundConfig
+
+// Outbound returns the server-wide defaults for requests to external services.
+func Outbound() OutboundConfig {
+	return outboundConfig
+}
+
+// NewOutboundTransport returns a transport that uses the given proxy URL and CA bundle
+// path.  Empty settings use the environment's proxy and the system's certificate authorities.
+func NewOutboundTransport(proxy, caBundle string) (*http.Transport, error) {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("Bad proxy URL %q: expected a URL like \"http://proxy.example.com:3128\"", proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if caBundle != "" {
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA bundle: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No PEM certificates found in CA bundle %q", caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return transport, nil
+}
+
+// OutboundErrorMessage describes an error from a request to an external service,
+// distinguishing TLS verification failures from connectivity failures.
+func OutboundErrorMessage(err error) string {
+	cause := err
+	if urlErr, ok := err.(*url.Error); ok {
+		cause = urlErr.Err
+	}
+	switch cause.(type) {
+	case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError:
+		return fmt.Sprintf("TLS verification failed (check the CA bundle): %s", err.Error())
+	}
+	if strings.Contains(err.Error(), "x509:") || strings.Contains(err.Error(), "tls:") {
+		return fmt.Sprintf("TLS verification failed (check the CA bundle): %s", err.Error())
+	}
+	return fmt.Sprintf("connection failed (check the proxy): %s", err.Error())
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOutboundCABundle(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	// Without the test server's certificate, verification fails.
+	transport, err := NewOutboundTransport("", "")
+	if err != nil {
+		t.Fatalf("Unable to create default transport: %s\n", err.Error())
+	}
+	_, err = (&http.Client{Transport: transport}).Get(ts.URL)
+	if err == nil {
+		t.Fatalf("Expected TLS verification failure without CA bundle\n")
+	}
+	if msg := OutboundErrorMessage(err); !strings.HasPrefix(msg, "TLS verification failed") {
+		t.Errorf("Expected TLS verification failure message, got %q\n", msg)
+	}
+
+	// With the test server's certificate in a CA bundle, the request succeeds.
+	f, err := ioutil.TempFile("", "cabundle")
+	if err != nil {
+		t.Fatalf("Unable to create CA bundle file: %s\n", err.Error())
+	}
+	defer os.Remove(f.Name())
+	cert := ts.TLS.Certificates[0].Certificate[0]
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert}); err != nil {
+		t.Fatalf("Unable to write CA bundle: %s\n", err.Error())
+	}
+	f.Close()
+	if transport, err = NewOutboundTransport("", f.Name()); err != nil {
+		t.Fatalf("Unable to create transport with CA bundle: %s\n", err.Error())
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Request with CA bundle failed: %s\n", err.Error())
+	}
+	resp.Body.Close()
+
+	if _, err := NewOutboundTransport("", "/nonexistent/cabundle.pem"); err == nil {
+		t.Errorf("Expected error for missing CA bundle\n")
+	}
+}
+
+func TestOutboundProxy(t *testing.T) {
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHost = r.URL.Host
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	transport, err := NewOutboundTransport(proxy.URL, "")
+	if err != nil {
+		t.Fatalf("Unable to create transport with proxy: %s\n", err.Error())
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://brainmaps.example.com/volumes")
+	if err != nil {
+		t.Fatalf("Request through proxy failed: %s\n", err.Error())
+	}
+	resp.Body.Close()
+	if proxiedHost != "brainmaps.example.com" {
+		t.Errorf("Expected proxy to receive request for brainmaps.example.com, got %q\n", proxiedHost)
+	}
+
+	// A proxy that can't be reached is reported as a connectivity failure.
+	proxy.Close()
+	if _, err = (&http.Client{Transport: transport}).Get("http://brainmaps.example.com/volumes"); err == nil {
+		t.Fatalf("Expected error with closed proxy\n")
+	}
+	if msg := OutboundErrorMessage(err); !strings.HasPrefix(msg, "connection failed") {
+		t.Errorf("Expected connection failure message, got %q\n", msg)
+	}
+
+	if _, err := NewOutboundTransport("not a url", ""); err == nil {
+		t.Errorf("Expected error for bad proxy URL\n")
+	}
+}
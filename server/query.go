@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// QueryParam declares a query-string parameter accepted by an HTTP endpoint.
+type QueryParam struct {
+	Name string
+	Help string
+}
+
+// QueryParams is the set of query-string parameters accepted by an HTTP endpoint.
+// Datatypes should declare a QueryParams table for each endpoint so the parameters
+// can be validated and documented in one place.
+type QueryParams []QueryParam
+
+// Names returns the sorted names of the parameters.
+func (params QueryParams) Names() []string {
+	names := make([]string, len(params))
+	for i, param := range params {
+		names[i] = param.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (params QueryParams) has(name string) bool {
+	for _, param := range params {
+		if param.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Help returns the parameter table formatted for inclusion in help text.  The "strict"
+// parameter accepted by every endpoint is listed last unless the table declares it to
+// document a meaning specific to the endpoint.
+func (params QueryParams) Help() string {
+	var lines string
+	for _, param := range params {
+		lines += fmt.Sprintf("    %-14s%s\n", param.Name, strings.Replace(param.Help, "\n", "\n                  ", -1))
+	}
+	if !params.has("strict") {
+		lines += fmt.Sprintf("    %-14s%s\n", "strict", `If "true", unknown query-string parameters cause an error.`)
+	}
+	return lines
+}
+
+// Query provides typed access with range checking to the query-string of a request.
+type Query struct {
+	values url.Values
+	params QueryParams
+}
+
+// NewQuery parses the query-string of a request given the parameters declared for the
+// endpoint.  If strict is true or the request has "strict=true", any query-string parameter
+// not among the declared parameters causes an error listing the valid options.  Endpoints
+// may declare "strict" themselves to give it further meaning, but "strict=true" always
+// enables this check.
+func NewQuery(r *http.Request, params QueryParams, strict bool) (*Query, error) {
+	q := &Query{r.URL.Query(), params}
+	isStrict, err := q.GetBool("strict", strict)
+	if err != nil {
+		return nil, err
+	}
+	if isStrict {
+		var unknown []string
+		for name := range q.values {
+			if name != "strict" && !params.has(name) {
+				unknown = append(unknown, name)
+			}
+		}
+		if len(unknown) != 0 {
+			sort.Strings(unknown)
+			return nil, fmt.Errorf("unknown query-string parameter(s) %s: valid options are %s",
+				strings.Join(unknown, ", "), strings.Join(params.Names(), ", "))
+		}
+	}
+	return q, nil
+}
+
+// Has returns true if the named parameter was present in the query-string.
+func (q *Query) Has(name string) bool {
+	_, found := q.values[name]
+	return found
+}
+
+// GetString returns the named parameter or a default value if not present.
+func (q *Query) GetString(name, defaultValue string) string {
+	if !q.Has(name) {
+		return defaultValue
+	}
+	return q.values.Get(name)
+}
+
+// GetInt returns the named parameter as an integer, checking that it lies within
+// [min, max].  The default value is returned if the parameter is not present.
+func (q *Query) GetInt(name string, defaultValue, min, max int) (int, error) {
+	if !q.Has(name) {
+		return defaultValue, nil
+	}
+	s := q.values.Get(name)
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("query-string parameter %q must be an integer, not %q", name, s)
+	}
+	if i < min || i > max {
+		return 0, fmt.Errorf("query-string parameter %q must be between %d and %d, not %d", name, min, max, i)
+	}
+	return i, nil
+}
+
+// GetBool returns the named parameter as a boolean.  The default value is returned if
+// the parameter is not present.
+func (q *Query) GetBool(name string, defaultValue bool) (bool, error) {
+	if !q.Has(name) {
+		return defaultValue, nil
+	}
+	s := q.values.Get(name)
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("query-string parameter %q must be true or false, not %q", name, s)
+	}
+	return b, nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var testParams = QueryParams{
+	{"tilesize", "Size in pixels along one dimension of square tile."},
+	{"noblanks", "Return 404 for tiles outside volume."},
+}
+
+func TestQueryGetters(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/api/node/abc/mydata/tile/xy/0/0_0_0?tilesize=256&noblanks=true", nil)
+	q, err := NewQuery(r, testParams, false)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing query: %s\n", err.Error())
+	}
+	tilesize, err := q.GetInt("tilesize", 512, 1, 4096)
+	if err != nil || tilesize != 256 {
+		t.Errorf("Expected tilesize 256, got %d (%v)\n", tilesize, err)
+	}
+	noblanks, err := q.GetBool("noblanks", false)
+	if err != nil || !noblanks {
+		t.Errorf("Expected noblanks true, got %t (%v)\n", noblanks, err)
+	}
+	scale, err := q.GetInt("scale", 3, 0, 10)
+	if err != nil || scale != 3 {
+		t.Errorf("Expected default scale 3, got %d (%v)\n", scale, err)
+	}
+
+	for _, bad := range []string{"tilesize=0", "tilesize=-8", "tilesize=abc", "tilesize=100000"} {
+		r, _ = http.NewRequest("GET", "/api/node/abc/mydata/tile/xy/0/0_0_0?"+bad, nil)
+		q, err = NewQuery(r, testParams, false)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing query: %s\n", err.Error())
+		}
+		if _, err = q.GetInt("tilesize", 512, 1, 4096); err == nil {
+			t.Errorf("Expected error for %q\n", bad)
+		}
+	}
+}
+
+func TestQueryStrict(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/api/node/abc/mydata/tile/xy/0/0_0_0?tilesize=256&tilsize=3", nil)
+	if _, err := NewQuery(r, testParams, false); err != nil {
+		t.Errorf("Unknown parameter should be ignored when not strict: %s\n", err.Error())
+	}
+	_, err := NewQuery(r, testParams, true)
+	if err == nil {
+		t.Fatalf("Expected error for unknown parameter in strict mode\n")
+	}
+	if !strings.Contains(err.Error(), "tilsize") || !strings.Contains(err.Error(), "noblanks, tilesize") {
+		t.Errorf("Strict error should list unknown and valid parameters: %s\n", err.Error())
+	}
+
+	r, _ = http.NewRequest("GET", "/api/node/abc/mydata/tile/xy/0/0_0_0?tilsize=3&strict=true", nil)
+	if _, err := NewQuery(r, testParams, false); err == nil {
+		t.Errorf("Expected strict=true in query string to enable strict mode\n")
+	}
+}
+
+func TestQueryHelp(t *testing.T) {
+	help := testParams.Help()
+	if !strings.Contains(help, "tilesize") || !strings.Contains(help, "unknown query-string parameters") {
+		t.Errorf("Expected help to list declared parameters and strict:\n%s", help)
+	}
+	if help = (QueryParams{}).Help(); !strings.HasPrefix(strings.TrimSpace(help), "strict") {
+		t.Errorf("Expected help for endpoint without parameters to list strict:\n%s", help)
+	}
+	declared := append(QueryParams{{"strict", "Endpoint-specific strictness."}}, testParams...)
+	if help = declared.Help(); strings.Count(help, "    strict ") != 1 {
+		t.Errorf("Expected declared strict parameter to be listed once:\n%s", help)
+	}
+}
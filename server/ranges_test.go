@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func rangedGet(t *testing.T, data []byte, etag, byteRange, ifRange string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("GET", "/api/node/abc/labels/sparsevol/23", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %s\n", err.Error())
+	}
+	if byteRange != "" {
+		r.Header.Set("Range", byteRange)
+	}
+	if ifRange != "" {
+		r.Header.Set("If-Range", ifRange)
+	}
+	w := httptest.NewRecorder()
+	ServeRanged(w, r, "application/octet-stream", etag, data)
+	return w
+}
+
+func TestServeRangedChunks(t *testing.T) {
+	data := make([]byte, 3*1024*1024+17)
+	rand.New(rand.NewSource(23)).Read(data)
+	etag := ContentETag(data, "version", "labels", 23, "")
+
+	full := rangedGet(t, data, etag, "", "")
+	if full.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for full download, got %d\n", full.Code)
+	}
+	if full.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Expected Accept-Ranges to be advertised, got %q\n", full.Header().Get("Accept-Ranges"))
+	}
+	if full.Header().Get("ETag") != etag {
+		t.Errorf("Expected ETag %s, got %s\n", etag, full.Header().Get("ETag"))
+	}
+
+	var assembled []byte
+	chunk := len(data) / 3
+	ranges := []string{
+		fmt.Sprintf("bytes=0-%d", chunk-1),
+		fmt.Sprintf("bytes=%d-%d", chunk, 2*chunk-1),
+		fmt.Sprintf("bytes=%d-", 2*chunk),
+	}
+	for i, byteRange := range ranges {
+		w := rangedGet(t, data, etag, byteRange, etag)
+		if w.Code != http.StatusPartialContent {
+			t.Fatalf("Chunk %d: expected status 206, got %d\n", i, w.Code)
+		}
+		begin := len(assembled)
+		expected := fmt.Sprintf("bytes %d-%d/%d", begin, begin+w.Body.Len()-1, len(data))
+		if got := w.Header().Get("Content-Range"); got != expected {
+			t.Errorf("Chunk %d: expected Content-Range %q, got %q\n", i, expected, got)
+		}
+		assembled = append(assembled, w.Body.Bytes()...)
+	}
+	if !bytes.Equal(assembled, full.Body.Bytes()) {
+		t.Errorf("Ranged download of %d bytes differs from full download of %d bytes\n", len(assembled), full.Body.Len())
+	}
+}
+
+func TestServeRangedStaleIfRange(t *testing.T) {
+	data := []byte("0123456789")
+	etag := ContentETag(data, "version", "labels", 23)
+	stale := ContentETag([]byte("9876543210"), "version", "labels", 23)
+	if stale == etag {
+		t.Fatalf("Expected ETag to change when payload changes\n")
+	}
+	w := rangedGet(t, data, etag, "bytes=5-", stale)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected full response for stale If-Range, got status %d\n", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("Expected full payload for stale If-Range, got %q\n", w.Body.String())
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	etag := ContentETag(nil, "version", "labels", 23, 7)
+	modified := time.Date(2015, 6, 1, 12, 0, 0, 500, time.UTC)
+	check := func(method string, headers map[string]string, expected bool) {
+		r, _ := http.NewRequest(method, "/api/node/abc/labels/sparsevol/23", nil)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		if NotModified(w, r, etag, modified) != expected {
+			t.Errorf("Expected not modified %t for %s %v\n", expected, method, headers)
+		}
+		if expected && w.Code != http.StatusNotModified {
+			t.Errorf("Expected 304 for %v, got %d\n", headers, w.Code)
+		}
+		if w.Header().Get("ETag") != etag || w.Header().Get("Last-Modified") != "Mon, 01 Jun 2015 12:00:00 GMT" {
+			t.Errorf("Expected validators for %v, got %v\n", headers, w.Header())
+		}
+	}
+	check("GET", nil, false)
+	check("GET", map[string]string{"If-None-Match": etag}, true)
+	check("HEAD", map[string]string{"If-None-Match": `"abc", W/` + etag}, true)
+	check("GET", map[string]string{"If-None-Match": `"abc"`}, false)
+	check("POST", map[string]string{"If-None-Match": etag}, false)
+	check("GET", map[string]string{"If-Modified-Since": "Mon, 01 Jun 2015 12:00:00 GMT"}, true)
+	check("GET", map[string]string{"If-Modified-Since": "Mon, 01 Jun 2015 11:59:59 GMT"}, false)
+	check("GET", map[string]string{"If-Modified-Since": "not a date"}, false)
+
+	// If-None-Match takes precedence over If-Modified-Since.
+	check("GET", map[string]string{"If-None-Match": `"abc"`, "If-Modified-Since": "Mon, 01 Jun 2015 12:00:00 GMT"}, false)
+}
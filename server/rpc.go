@@ -27,6 +27,12 @@ const RPCHelpMessage = `Commands executed on the server (rpc address = %s):
 
 	repo <UUID> new <datatype name> <data name> <datatype-specific config>...
 
+	repo <UUID> clone-instance <source UUID> <source data name> [<data name>] <settings...>
+
+		where <settings> are optional "key=value" strings that override settings of
+		the source instance, e.g., authkey=<key> for googlevoxels.  Only datatypes
+		that support cloning, e.g., googlevoxels, can be cloned.
+
 	repo <UUID> push <remote DVID address> <settings...>
 
 		where <settings> are optional "key=value" strings that provide:
@@ -180,6 +186,33 @@ func (c *RPCConnection) Do(cmd datastore.Request, reply *datastore.Response) err
 			}
 			reply.Text = fmt.Sprintf("Data %q [%s] added to node %s\n", dataname, typename, uuid)
 			repo.AddToLog(cmd.String())
+		case "clone-instance":
+			var srcUUIDStr, srcName, dataname string
+			cmd.CommandArgs(3, &srcUUIDStr, &srcName, &dataname)
+			if srcName == "" {
+				return fmt.Errorf("clone-instance requires a source UUID and data name: %q", cmd)
+			}
+			srcUUID, _, err := datastore.MatchingUUID(srcUUIDStr)
+			if err != nil {
+				return err
+			}
+			srcRepo, err := datastore.RepoFromUUID(srcUUID)
+			if err != nil {
+				return err
+			}
+			src, err := srcRepo.GetDataByName(dvid.DataString(srcName))
+			if err != nil {
+				return err
+			}
+			if dataname == "" {
+				dataname = srcName
+			}
+			config := cmd.Settings()
+			if _, err = repo.CloneData(src, dvid.DataString(dataname), config); err != nil {
+				return err
+			}
+			reply.Text = fmt.Sprintf("Data %q [%s] cloned from %q of node %s to node %s\n", dataname, src.TypeName(), srcName, srcUUID, uuid)
+			repo.AddToLog(cmd.String())
 		case "push":
 			var target string
 			cmd.CommandArgs(3, &target)
@@ -194,6 +194,7 @@ func Shutdown() {
 		}
 		time.Sleep(1 * time.Second)
 	}
+	datastore.Shutdown()
 	storage.Shutdown()
 	dvid.BlockOnActiveCgo()
 }
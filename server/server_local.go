@@ -67,9 +67,16 @@ type tomlConfig struct {
 }
 
 type serverConfig struct {
-	Notify  []string
-	Logging dvid.LogConfig
-	Email   smtpServer
+	Notify     []string
+	AdminToken string
+	BaseURL    string
+	Logging    dvid.LogConfig
+	Email      smtpServer
+	Outbound   OutboundConfig
+
+	// WatchdogFactor is the multiple of their expected duration after which long
+	// operations are wedged.  If 0, DefaultWatchdogFactor is used.
+	WatchdogFactor float64
 }
 
 type smtpServer struct {
@@ -90,6 +97,12 @@ func LoadConfig(filename string) (*dvid.LogConfig, error) {
 	if _, err := toml.DecodeFile(filename, &(localConfig.settings)); err != nil {
 		return nil, fmt.Errorf("Could not decode TOML config: %s\n", err.Error())
 	}
+	outboundConfig = localConfig.settings.Server.Outbound
+	adminToken = localConfig.settings.Server.AdminToken
+	Operations.SetFactor(localConfig.settings.Server.WatchdogFactor)
+	if err := SetBaseURL(localConfig.settings.Server.BaseURL); err != nil {
+		return nil, err
+	}
 	return &(localConfig.settings.Server.Logging), nil
 }
 
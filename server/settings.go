@@ -0,0 +1,127 @@
+/*
+	This file supports server-wide settings of datatypes, which can be read and changed
+	through /api/server/settings/{name} without a restart and persist in the metadata store.
+*/
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/janelia-flyem/dvid/datastore"
+	"github.com/janelia-flyem/dvid/dvid"
+
+	"github.com/zenazn/goji/web"
+)
+
+// SettingsHandler is implemented by packages with server-wide settings.
+type SettingsHandler interface {
+	// Settings returns the current settings as JSON.
+	Settings() ([]byte, error)
+
+	// SetSettings validates and applies settings given as JSON.  Settings absent from the
+	// JSON are unchanged.  Nothing is changed if an error is returned.
+	SetSettings(jsonBytes []byte) error
+}
+
+var (
+	settingsMu       sync.RWMutex
+	settingsHandlers = make(map[string]SettingsHandler)
+)
+
+// RegisterSettings makes server-wide settings available under the given name.  It is
+// usually called from a package's init().
+func RegisterSettings(name string, handler SettingsHandler) {
+	settingsMu.Lock()
+	settingsHandlers[name] = handler
+	settingsMu.Unlock()
+}
+
+func settingsHandler(name string) (SettingsHandler, bool) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	handler, found := settingsHandlers[name]
+	return handler, found
+}
+
+// LoadSettings applies any persisted server-wide settings to their registered handlers.
+// It should be called after the datastore is initialized and before requests are served.
+// Persisted settings that are no longer valid are logged and skipped.
+func LoadSettings() error {
+	settingsMu.RLock()
+	names := make([]string, 0, len(settingsHandlers))
+	for name := range settingsHandlers {
+		names = append(names, name)
+	}
+	settingsMu.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		value, err := datastore.GetServerSettings(name)
+		if err != nil {
+			return fmt.Errorf("Unable to load %q server settings: %s", name, err.Error())
+		}
+		if value == nil {
+			continue
+		}
+		handler, _ := settingsHandler(name)
+		if err := handler.SetSettings(value); err != nil {
+			dvid.Errorf("Ignoring persisted %q server settings %s: %s\n", name, string(value), err.Error())
+			continue
+		}
+		dvid.Infof("Loaded %q server settings: %s\n", name, string(value))
+	}
+	return nil
+}
+
+func serverSettingsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	requestID := NewRequestID()
+	name := c.URLParams["name"]
+	handler, found := settingsHandler(name)
+	if !found {
+		ErrorResponse(w, r, requestID, NewError(NotFoundError, "no server settings named %q", name))
+		return
+	}
+
+	if r.Method == "POST" {
+		if !IsAdmin(r) {
+			err := fmt.Errorf("Changing %q server settings requires the %s header with the server's admin token",
+				name, AdminTokenHeader)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			dvid.Errorf("ERROR [%s]: %s (%s).", requestID, err.Error(), r.URL.Path)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := handler.SetSettings(data); err != nil {
+			ErrorResponse(w, r, requestID, err)
+			return
+		}
+		current, err := handler.Settings()
+		if err != nil {
+			ErrorResponse(w, r, requestID, err)
+			return
+		}
+		if err := datastore.PutServerSettings(name, current); err != nil {
+			ErrorResponse(w, r, requestID, NewError(StorageError, "settings changed but not persisted: %s", err.Error()))
+			return
+		}
+		dvid.Infof("[%s] Changed %q server settings to %s\n", requestID, name, string(current))
+	}
+
+	current, err := handler.Settings()
+	if err != nil {
+		ErrorResponse(w, r, requestID, err)
+		return
+	}
+	if err := WriteJSON(w, r, current); err != nil {
+		ErrorResponse(w, r, requestID, err)
+	}
+}
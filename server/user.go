@@ -0,0 +1,26 @@
+/*
+	This file identifies the user making a request so changes can be attributed.
+*/
+
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// UserHeader is the request header naming the user making the request.
+const UserHeader = "X-DVID-User"
+
+// AnonymousUser is the user of requests that don't name one.
+const AnonymousUser = "anonymous"
+
+// RequestUser returns the user named by the request's X-DVID-User header or AnonymousUser
+// if there is none.
+func RequestUser(r *http.Request) string {
+	user := strings.TrimSpace(r.Header.Get(UserHeader))
+	if user == "" {
+		return AnonymousUser
+	}
+	return user
+}
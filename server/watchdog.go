@@ -0,0 +1,186 @@
+/*
+	This file supports a watchdog for long operations like label merges and requests to
+	external services.  Operations register when they start and deregister when done, and a
+	background monitor warns about operations running much longer than expected, logging a
+	dump of all goroutine stacks once per wedged operation so its state can be examined.
+*/
+
+package server
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/dvid/dvid"
+)
+
+const (
+	// DefaultWatchdogFactor is the multiple of its expected duration after which an
+	// operation is considered wedged.
+	DefaultWatchdogFactor = 5
+
+	// WatchdogInterval is how often running operations are checked.
+	WatchdogInterval = 10 * time.Second
+
+	// maxStackDump is the largest goroutine stack dump logged for a wedged operation.
+	maxStackDump = 1 << 20
+)
+
+// goroutineDump returns the stacks of all goroutines, truncated to maxStackDump bytes.
+var goroutineDump = func() []byte {
+	buf := make([]byte, maxStackDump)
+	return buf[:runtime.Stack(buf, true)]
+}
+
+// watchedOp is a running operation registered with a watchdog.
+type watchedOp struct {
+	id       uint64
+	kind     string
+	instance string
+	start    time.Time
+	expected time.Duration
+	wedged   bool
+}
+
+// WatchedOp is the registration of a running operation, which must be ended by Done.
+type WatchedOp struct {
+	w  *Watchdog
+	id uint64
+}
+
+// Done deregisters the operation.  It may be called more than once.
+func (op *WatchedOp) Done() {
+	op.w.mu.Lock()
+	delete(op.w.ops, op.id)
+	op.w.mu.Unlock()
+}
+
+// OperationInfo describes a running operation for the /api/server/operations endpoint.
+type OperationInfo struct {
+	ID         uint64    `json:"id"`
+	Kind       string    `json:"kind"`
+	Instance   string    `json:"instance,omitempty"`
+	Start      time.Time `json:"start"`
+	ElapsedMs  float64   `json:"elapsed-ms"`
+	ExpectedMs float64   `json:"expected-ms"`
+	Wedged     bool      `json:"wedged"`
+}
+
+type operationsByStart []OperationInfo
+
+func (o operationsByStart) Len() int      { return len(o) }
+func (o operationsByStart) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o operationsByStart) Less(i, j int) bool {
+	if !o[i].Start.Equal(o[j].Start) {
+		return o[i].Start.Before(o[j].Start)
+	}
+	return o[i].ID < o[j].ID
+}
+
+// Watchdog tracks running operations and warns about those that run longer than a
+// multiple of their expected duration.
+type Watchdog struct {
+	mu      sync.Mutex
+	nextID  uint64
+	ops     map[uint64]*watchedOp
+	factor  float64
+	monitor sync.Once
+}
+
+// NewWatchdog returns a watchdog that considers operations wedged after the given multiple
+// of their expected duration.
+func NewWatchdog(factor float64) *Watchdog {
+	return &Watchdog{ops: make(map[uint64]*watchedOp), factor: factor}
+}
+
+// SetFactor sets the multiple of their expected duration after which operations are
+// considered wedged.  Factors of 1 or less are ignored.
+func (w *Watchdog) SetFactor(factor float64) {
+	if factor <= 1 {
+		return
+	}
+	w.mu.Lock()
+	w.factor = factor
+	w.mu.Unlock()
+}
+
+// Start registers an operation of a kind, e.g., "labels64/merge", on a data instance that
+// is expected to take about the given duration.  The monitor is started with the first
+// operation registered with the watchdog.
+func (w *Watchdog) Start(kind, instance string, expected time.Duration) *WatchedOp {
+	w.monitor.Do(func() { go w.run(WatchdogInterval) })
+	w.mu.Lock()
+	w.nextID++
+	id := w.nextID
+	w.ops[id] = &watchedOp{id, kind, instance, time.Now(), expected, false}
+	w.mu.Unlock()
+	return &WatchedOp{w, id}
+}
+
+// Operations returns the running operations in the order they started.
+func (w *Watchdog) Operations() []OperationInfo {
+	now := time.Now()
+	w.mu.Lock()
+	infos := make([]OperationInfo, 0, len(w.ops))
+	for _, op := range w.ops {
+		infos = append(infos, OperationInfo{
+			ID:         op.id,
+			Kind:       op.kind,
+			Instance:   op.instance,
+			Start:      op.start,
+			ElapsedMs:  float64(now.Sub(op.start)) / float64(time.Millisecond),
+			ExpectedMs: float64(op.expected) / float64(time.Millisecond),
+			Wedged:     op.wedged,
+		})
+	}
+	w.mu.Unlock()
+	sort.Sort(operationsByStart(infos))
+	return infos
+}
+
+// Check warns about operations that have become wedged by the given time and logs a dump
+// of goroutine stacks if there are any.  Each operation is reported once.  It returns the
+// number of newly wedged operations.
+func (w *Watchdog) Check(now time.Time) int {
+	var wedged []watchedOp
+	w.mu.Lock()
+	for _, op := range w.ops {
+		if op.wedged || op.expected <= 0 {
+			continue
+		}
+		if float64(now.Sub(op.start)) > w.factor*float64(op.expected) {
+			op.wedged = true
+			wedged = append(wedged, *op)
+		}
+	}
+	w.mu.Unlock()
+	if len(wedged) == 0 {
+		return 0
+	}
+	for _, op := range wedged {
+		dvid.Warningf("Wedged operation: id=%d kind=%s instance=%q elapsed=%s expected=%s\n",
+			op.id, op.kind, op.instance, now.Sub(op.start), op.expected)
+	}
+	dvid.Warningf("Goroutine stacks for %d wedged operations:\n%s\n", len(wedged), goroutineDump())
+	return len(wedged)
+}
+
+// run checks running operations at the given interval forever.
+func (w *Watchdog) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		w.Check(now)
+	}
+}
+
+// Operations is the server-wide watchdog of long operations, which are returned by the
+// /api/server/operations endpoint.
+var Operations = NewWatchdog(DefaultWatchdogFactor)
+
+// WatchOperation registers a long operation with the server-wide watchdog.  Done must be
+// called on the returned registration when the operation ends.
+func WatchOperation(kind, instance string, expected time.Duration) *WatchedOp {
+	return Operations.Start(kind, instance, expected)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchdogConcurrentOperations(t *testing.T) {
+	w := NewWatchdog(DefaultWatchdogFactor)
+	var wg sync.WaitGroup
+	for i := 0; i < 2000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			op := w.Start("test/short", "data", time.Second)
+			if i%10 == 0 {
+				w.Operations()
+			}
+			op.Done()
+			op.Done()
+		}(i)
+	}
+	wg.Wait()
+	if ops := w.Operations(); len(ops) != 0 {
+		t.Errorf("Expected no running operations, got %d: %+v\n", len(ops), ops)
+	}
+	if n := w.Check(time.Now().Add(time.Hour)); n != 0 {
+		t.Errorf("Expected no wedged operations after all are done, got %d\n", n)
+	}
+}
+
+func TestWatchdogWedged(t *testing.T) {
+	var dumps int
+	saved := goroutineDump
+	goroutineDump = func() []byte {
+		dumps++
+		return []byte("goroutine 1 [running]:")
+	}
+	defer func() { goroutineDump = saved }()
+
+	w := NewWatchdog(3)
+	slow := w.Start("test/slow", "data1", time.Second)
+	fast := w.Start("test/fast", "data2", time.Minute)
+	unbounded := w.Start("test/unbounded", "", 0)
+	defer slow.Done()
+	defer fast.Done()
+	defer unbounded.Done()
+
+	start := time.Now()
+	if n := w.Check(start.Add(2 * time.Second)); n != 0 || dumps != 0 {
+		t.Errorf("Expected no wedged operations before the factor is exceeded, got %d with %d dumps\n", n, dumps)
+	}
+	if n := w.Check(start.Add(10 * time.Second)); n != 1 || dumps != 1 {
+		t.Errorf("Expected one wedged operation with one dump, got %d with %d dumps\n", n, dumps)
+	}
+	if n := w.Check(start.Add(20 * time.Second)); n != 0 || dumps != 1 {
+		t.Errorf("Expected a wedged operation to be reported once, got %d with %d dumps\n", n, dumps)
+	}
+
+	ops := w.Operations()
+	if len(ops) != 3 {
+		t.Fatalf("Expected 3 running operations, got %+v\n", ops)
+	}
+	for i, kind := range []string{"test/slow", "test/fast", "test/unbounded"} {
+		if ops[i].Kind != kind {
+			t.Errorf("Expected operation %d to be %q, got %+v\n", i, kind, ops[i])
+		}
+		if ops[i].Wedged != (kind == "test/slow") {
+			t.Errorf("Bad wedged status for operation %+v\n", ops[i])
+		}
+	}
+	if ops[0].Instance != "data1" || ops[0].ExpectedMs != 1000 {
+		t.Errorf("Bad slow operation: %+v\n", ops[0])
+	}
+
+	// Lowering the factor makes more operations wedged, but factors of 1 or less are ignored.
+	w.SetFactor(0.5)
+	if n := w.Check(start.Add(2 * time.Minute)); n != 0 {
+		t.Errorf("Expected ignored factor to leave the fast operation running, got %d wedged\n", n)
+	}
+	w.SetFactor(1.5)
+	if n := w.Check(start.Add(2 * time.Minute)); n != 1 || dumps != 2 {
+		t.Errorf("Expected fast operation to become wedged, got %d with %d dumps\n", n, dumps)
+	}
+	slow.Done()
+	if ops := w.Operations(); len(ops) != 2 || ops[0].Kind != "test/fast" {
+		t.Errorf("Expected slow operation to be removed when done, got %+v\n", ops)
+	}
+}
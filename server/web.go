@@ -14,8 +14,10 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"code.google.com/p/go.net/context"
 
@@ -95,6 +97,39 @@ const WebHelp = `
 
 	Returns JSON with datatype names and their URLs.
 
+ GET    /api/server/latency
+ DELETE /api/server/latency
+
+	Returns JSON with request latency summaries for timed routes, e.g., "googlevoxels/tile",
+	keyed by route name:
+
+	{ "googlevoxels/tile": { "count": 120, "ok": 118, "client-errors": 1, "server-errors": 1,
+	  "mean-ms": 35.2, "p50-ms": 28.1, "p90-ms": 61.5, "p95-ms": 80.3, "p99-ms": 142.0,
+	  "max-ms": 210.4 }, ... }
+
+	Quantiles are estimated within about 6%%.  A DELETE discards all recorded latencies.
+
+ GET  /api/server/operations
+
+	Returns JSON with the long operations now running, e.g., label merges and requests to
+	Google, in the order they started:
+
+	[ { "id": 12, "kind": "labels64/merge", "instance": "bodies", "start": <time>,
+	    "elapsed-ms": 95210.4, "expected-ms": 30000, "wedged": false }, ... ]
+
+	Operations running longer than a multiple of their expected duration, 5 unless the
+	server configuration gives a WatchdogFactor, are wedged.  A warning and a dump of all
+	goroutine stacks are logged once when an operation becomes wedged.
+
+ GET  /api/server/settings/{name}
+ POST /api/server/settings/{name}
+
+	Returns JSON with the named server-wide settings, e.g., "googlevoxels" for the defaults
+	of googlevoxels instances.  A POST with a JSON object changes the given settings for
+	subsequent requests without a restart and persists them.  Settings absent from the
+	object are unchanged.  POST requires the X-DVID-Admin-Token header with the server's
+	admin token and returns the resulting settings.  See the datatype help for its settings.
+
  POST /api/repos
 
 	Creates a new repository.  Expects configuration data in JSON as the body of the POST.
@@ -114,6 +149,23 @@ const WebHelp = `
 	Returns JSON for just the repository with given root UUID.  The UUID string can be
 	shortened as long as it is uniquely identifiable across the managed repositories.
 
+ GET  /api/repo/{uuid}/label-mutations?since=2015-06-01T00:00:00Z&limit=500&cursor=...
+
+	Returns JSON for the label mutations, e.g., merges, logged by all data instances of the
+	repository in time order.  Requires the X-DVID-Admin-Token header with the server's
+	admin token.  The response is {"mutations": [...], "next": cursor, "skipped": {...}},
+	where each mutation gives its "instance", "uuid", "id", "op", "labels", "user", and
+	"time".  For merges, labels are the target label followed by the merged labels, and
+	mutations from one merge share an id.
+
+	Query-string options:
+
+	since   Only mutations at or after this RFC3339 time are returned.
+	limit   Maximum number of mutations returned (default 500, at most 10000).
+	cursor  The "next" value of the previous page, which is omitted on the last page.
+
+	Instances whose mutations can't be read are listed in "skipped" with the error.
+
  POST /api/repo/{uuid}/lock
 
 	Locks the node (version) with given UUID.  This is required before a version can 
@@ -262,6 +314,13 @@ func initRoutes() {
 	mainMux.Get("/api/server/info/", serverInfoHandler)
 	mainMux.Get("/api/server/types", serverTypesHandler)
 	mainMux.Get("/api/server/types/", serverTypesHandler)
+	mainMux.Get("/api/server/latency", serverLatencyHandler)
+	mainMux.Delete("/api/server/latency", serverLatencyResetHandler)
+	mainMux.Get("/api/server/operations", serverOperationsHandler)
+	mainMux.Get("/api/server/settings/:name", serverSettingsHandler)
+	if !readonly {
+		mainMux.Post("/api/server/settings/:name", serverSettingsHandler)
+	}
 
 	if !readonly {
 		mainMux.Post("/api/repos", reposPostHandler)
@@ -274,6 +333,7 @@ func initRoutes() {
 	repoMux.Use(repoSelector)
 	repoMux.Head("/api/repo/:uuid", repoHeadHandler)
 	repoMux.Get("/api/repo/:uuid/info", repoInfoHandler)
+	repoMux.Get("/api/repo/:uuid/label-mutations", repoLabelMutationsHandler)
 	repoMux.Post("/api/repo/:uuid/instance", repoNewDataHandler)
 	repoMux.Post("/api/repo/:uuid/lock", repoLockHandler)
 	repoMux.Post("/api/repo/:uuid/branch", repoBranchHandler)
@@ -407,7 +467,7 @@ func instanceSelector(c *web.C, h http.Handler) http.Handler {
 		}
 		dataservice, err := repo.GetDataByName(dataname)
 		if err != nil {
-			BadRequest(w, r, err.Error())
+			ErrorResponse(w, r, NewRequestID(), NewError(NotFoundError, "%s", err.Error()))
 			return
 		}
 
@@ -530,6 +590,33 @@ func serverInfoHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, jsonStr)
 }
 
+func serverLatencyHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := json.Marshal(Latencies.Summaries())
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	if err := WriteJSON(w, r, jsonBytes); err != nil {
+		BadRequest(w, r, err.Error())
+	}
+}
+
+func serverOperationsHandler(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := json.Marshal(Operations.Operations())
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	if err := WriteJSON(w, r, jsonBytes); err != nil {
+		BadRequest(w, r, err.Error())
+	}
+}
+
+func serverLatencyResetHandler(w http.ResponseWriter, r *http.Request) {
+	Latencies.Reset()
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func serverTypesHandler(w http.ResponseWriter, r *http.Request) {
 	jsonMap := make(map[dvid.TypeString]string)
 	typemap, err := datastore.Types()
@@ -605,6 +692,55 @@ func repoInfoHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, string(jsonBytes))
 }
 
+func repoLabelMutationsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !IsAdmin(r) {
+		err := fmt.Errorf("Listing label mutations requires the %s header with the server's admin token",
+			AdminTokenHeader)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		dvid.Errorf("ERROR: %s (%s).", err.Error(), r.URL.Path)
+		return
+	}
+	queryValues := r.URL.Query()
+	var since time.Time
+	if sinceStr := queryValues.Get("since"); sinceStr != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, sinceStr); err != nil {
+			BadRequest(w, r, fmt.Sprintf("Bad 'since' time %q, expected RFC3339 format", sinceStr))
+			return
+		}
+	}
+	var limit int
+	if limitStr := queryValues.Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			BadRequest(w, r, fmt.Sprintf("Bad 'limit' %q, expected a positive integer", limitStr))
+			return
+		}
+	}
+	var cursor *datastore.MutationCursor
+	if cursorStr := queryValues.Get("cursor"); cursorStr != "" {
+		var err error
+		if cursor, err = datastore.ParseMutationCursor(cursorStr); err != nil {
+			BadRequest(w, r, err.Error())
+			return
+		}
+	}
+
+	repo := (c.Env["repo"]).(datastore.Repo)
+	page, err := datastore.ListLabelMutations(repo, since, cursor, limit)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	jsonBytes, err := json.Marshal(page)
+	if err != nil {
+		BadRequest(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
+
 func repoDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	queryValues := r.URL.Query()
 	imsure := queryValues.Get("imsure")
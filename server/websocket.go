@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message types of WebSocket data frames.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+// Opcodes of WebSocket frames that aren't data messages.
+const (
+	continuationFrame = 0
+	closeFrame        = 8
+	pingFrame         = 9
+	pongFrame         = 10
+)
+
+// Status codes of WebSocket close frames.
+const (
+	CloseNormal       = 1000
+	CloseProtocol     = 1002
+	CloseTooLarge     = 1009
+	closeNoStatus     = 1005
+	maxControlPayload = 125
+)
+
+// DefaultMaxMessageSize is the largest message a WebSocket reads unless its MaxMessageSize
+// is set.
+const DefaultMaxMessageSize = 1 << 20
+
+// webSocketGUID is appended to a client's key to compute the handshake's accept value.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrWebSocketClosed is returned when writing to a WebSocket after its close frame was sent.
+var ErrWebSocketClosed = errors.New("websocket is closed")
+
+// WebSocket is a minimal RFC 6455 connection for handlers that stream messages to clients.
+// Messages may be written concurrently with each other and with a single reader.  Pings
+// are answered while reading, and extensions and subprotocols are not supported.
+type WebSocket struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // clients mask the frames they send
+
+	// MaxMessageSize is the largest message that is read.  Larger messages close the
+	// connection with a CloseTooLarge status.
+	MaxMessageSize int
+
+	mu        sync.Mutex // guards writes
+	closeSent bool
+	frameBuf  []byte // reused for frames written
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for a Sec-WebSocket-Key.
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+webSocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerHasToken returns true if a comma-separated header has the given token, ignoring case.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UpgradeWebSocket completes the opening handshake of a WebSocket request and takes over
+// its connection.  If an error is returned, nothing has been written to the response, so
+// the handler should respond with the error as usual.  Otherwise the handler must not use
+// the response, and should close the WebSocket when done.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+	if r.Method != "GET" {
+		return nil, NewError(BadRequestError, "WebSocket requests must use GET, not %s", r.Method)
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return nil, NewError(BadRequestError, "request must upgrade the connection to a WebSocket")
+	}
+	if version := r.Header.Get("Sec-WebSocket-Version"); version != "13" {
+		return nil, NewError(BadRequestError, "unsupported WebSocket version %q, expected 13", version)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, NewError(BadRequestError, "WebSocket request has no Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("server connection cannot be upgraded to a WebSocket")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("unable to upgrade connection to a WebSocket: %s", err.Error())
+	}
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		webSocketAccept(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocket{conn: conn, br: rw.Reader}, nil
+}
+
+// DialWebSocket opens a WebSocket to the given ws:// or http:// URL.  It's meant for tests
+// and tools talking to a DVID server, so TLS is not supported.
+func DialWebSocket(urlStr string) (*WebSocket, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported WebSocket URL scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if !strings.Contains(host, ":") {
+		host += ":80"
+	}
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake has bad Sec-WebSocket-Accept")
+	}
+	return &WebSocket{conn: conn, br: br, client: true}, nil
+}
+
+// SetReadDeadline sets the deadline for reading the next message.
+func (ws *WebSocket) SetReadDeadline(t time.Time) error {
+	return ws.conn.SetReadDeadline(t)
+}
+
+// RemoteAddr returns the address of the other end of the connection.
+func (ws *WebSocket) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+// ReadMessage returns the type and payload of the next text or binary message, answering
+// pings while waiting.  A close frame from the other end is acknowledged and io.EOF is
+// returned.
+func (ws *WebSocket) ReadMessage() (messageType int, data []byte, err error) {
+	maxSize := ws.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	for {
+		fin, opcode, payload, err := ws.readFrame(maxSize - len(data))
+		if err != nil {
+			return 0, nil, err
+		}
+		switch opcode {
+		case pingFrame:
+			if err := ws.writeFrame(pongFrame, payload); err != nil && err != ErrWebSocketClosed {
+				return 0, nil, err
+			}
+			continue
+		case pongFrame:
+			continue
+		case closeFrame:
+			code := closeNoStatus
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			ws.WriteClose(code, "")
+			return 0, nil, io.EOF
+		case continuationFrame:
+			if messageType == 0 {
+				ws.WriteClose(CloseProtocol, "unexpected continuation frame")
+				return 0, nil, fmt.Errorf("WebSocket continuation frame without a message")
+			}
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				ws.WriteClose(CloseProtocol, "expected continuation frame")
+				return 0, nil, fmt.Errorf("WebSocket message started before previous message finished")
+			}
+			messageType = opcode
+		default:
+			ws.WriteClose(CloseProtocol, "unknown opcode")
+			return 0, nil, fmt.Errorf("unknown WebSocket opcode %d", opcode)
+		}
+		data = append(data, payload...)
+		if fin {
+			return messageType, data, nil
+		}
+	}
+}
+
+// readFrame reads the next frame, whose payload may be at most maxPayload bytes unless
+// it's a control frame.
+func (ws *WebSocket) readFrame(maxPayload int) (fin bool, opcode int, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(ws.br, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = int(header[0] & 0x0f)
+	masked := header[1]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		ws.WriteClose(CloseProtocol, "reserved bits set")
+		return false, 0, nil, fmt.Errorf("WebSocket frame has reserved bits set")
+	}
+	if masked == ws.client {
+		ws.WriteClose(CloseProtocol, "bad masking")
+		return false, 0, nil, fmt.Errorf("WebSocket frame masking is wrong for this end of the connection")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= closeFrame {
+		if !fin || length > maxControlPayload {
+			ws.WriteClose(CloseProtocol, "bad control frame")
+			return false, 0, nil, fmt.Errorf("WebSocket control frame is fragmented or too large")
+		}
+	} else if length > uint64(maxPayload) {
+		ws.WriteClose(CloseTooLarge, "message too large")
+		return false, 0, nil, fmt.Errorf("WebSocket message exceeds the maximum message size")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(ws.br, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// WriteMessage sends a text or binary message in a single frame.
+func (ws *WebSocket) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("bad WebSocket message type %d", messageType)
+	}
+	return ws.writeFrame(messageType, data)
+}
+
+// WriteClose sends a close frame with the given status code and reason.  Only the first
+// close frame is sent, after which writes return ErrWebSocketClosed.
+func (ws *WebSocket) WriteClose(code int, reason string) error {
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+	var payload []byte
+	if code != closeNoStatus {
+		payload = make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+	}
+	return ws.writeFrame(closeFrame, payload)
+}
+
+func (ws *WebSocket) writeFrame(opcode int, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closeSent {
+		return ErrWebSocketClosed
+	}
+	if opcode == closeFrame {
+		ws.closeSent = true
+	}
+
+	frame := ws.frameBuf[:0]
+	frame = append(frame, 0x80|byte(opcode))
+	var maskBit byte
+	if ws.client {
+		maskBit = 0x80
+	}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126, byte(length>>8), byte(length))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(length))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, ext[:]...)
+	}
+	if ws.client {
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+		ws.frameBuf = frame[:0]
+		_, err := ws.conn.Write(frame)
+		return err
+	}
+	ws.frameBuf = frame[:0]
+	if _, err := ws.conn.Write(frame); err != nil {
+		return err
+	}
+	_, err := ws.conn.Write(payload)
+	return err
+}
+
+// Close closes the connection without a closing handshake.  Handlers that end a stream
+// normally should send WriteClose first.
+func (ws *WebSocket) Close() error {
+	return ws.conn.Close()
+}
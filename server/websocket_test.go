@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoWebSocket echoes messages until the client closes the connection, then sends the
+// read error to done.
+func echoWebSocket(done chan error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, err := UpgradeWebSocket(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), ErrorKindOf(err).StatusCode())
+			return
+		}
+		defer ws.Close()
+		ws.MaxMessageSize = 100000
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			if err := ws.WriteMessage(messageType, data); err != nil {
+				done <- err
+				return
+			}
+		}
+	}
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	if accept := webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Bad accept value for RFC 6455 sample key: %s\n", accept)
+	}
+
+	done := make(chan error, 1)
+	ts := httptest.NewServer(echoWebSocket(done))
+	defer ts.Close()
+
+	ws, err := DialWebSocket(strings.Replace(ts.URL, "http://", "ws://", 1) + "/echo")
+	if err != nil {
+		t.Fatalf("Unable to dial WebSocket: %s\n", err.Error())
+	}
+	defer ws.Close()
+
+	// Messages of each payload length encoding are echoed, and pings are answered while reading.
+	large := bytes.Repeat([]byte("0123456789"), 7000)
+	messages := []struct {
+		messageType int
+		data        []byte
+	}{
+		{TextMessage, []byte(`{"hello": "world"}`)},
+		{BinaryMessage, bytes.Repeat([]byte{7}, 300)},
+		{BinaryMessage, large},
+		{TextMessage, nil},
+	}
+	for i, msg := range messages {
+		if i == 1 {
+			if err := ws.writeFrame(pingFrame, []byte("ping")); err != nil {
+				t.Fatalf("Unable to ping: %s\n", err.Error())
+			}
+		}
+		if err := ws.WriteMessage(msg.messageType, msg.data); err != nil {
+			t.Fatalf("Unable to write message %d: %s\n", i, err.Error())
+		}
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("Unable to read echo of message %d: %s\n", i, err.Error())
+		}
+		if messageType != msg.messageType || !bytes.Equal(data, msg.data) {
+			t.Errorf("Bad echo of message %d: type %d with %d bytes\n", i, messageType, len(data))
+		}
+	}
+
+	// The closing handshake ends the stream at both ends.
+	if err := ws.WriteClose(CloseNormal, "done"); err != nil {
+		t.Fatalf("Unable to close: %s\n", err.Error())
+	}
+	if _, _, err := ws.ReadMessage(); err != io.EOF {
+		t.Errorf("Expected EOF after closing handshake, got %v\n", err)
+	}
+	if err := <-done; err != io.EOF {
+		t.Errorf("Expected server to read EOF after close, got %v\n", err)
+	}
+	if err := ws.WriteMessage(TextMessage, []byte("late")); err != ErrWebSocketClosed {
+		t.Errorf("Expected error writing after close, got %v\n", err)
+	}
+}
+
+func TestWebSocketErrors(t *testing.T) {
+	done := make(chan error, 1)
+	ts := httptest.NewServer(echoWebSocket(done))
+	defer ts.Close()
+
+	// Plain requests aren't upgraded.
+	resp, err := http.Get(ts.URL + "/echo")
+	if err != nil {
+		t.Fatalf("Unable to GET: %s\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad request for plain GET, got status %d\n", resp.StatusCode)
+	}
+	if _, err := DialWebSocket("wss://localhost/echo"); err == nil {
+		t.Errorf("Expected error dialing unsupported scheme\n")
+	}
+
+	// Messages over the maximum size close the connection.
+	ws, err := DialWebSocket(ts.URL + "/echo")
+	if err != nil {
+		t.Fatalf("Unable to dial WebSocket: %s\n", err.Error())
+	}
+	defer ws.Close()
+	if err := ws.WriteMessage(BinaryMessage, make([]byte, 100001)); err != nil {
+		t.Fatalf("Unable to write message: %s\n", err.Error())
+	}
+	if err := <-done; err == nil || err == io.EOF {
+		t.Errorf("Expected error reading message over maximum size, got %v\n", err)
+	}
+	if _, _, err := ws.ReadMessage(); err != io.EOF {
+		t.Errorf("Expected close after message over maximum size, got %v\n", err)
+	}
+}
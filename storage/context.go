@@ -182,6 +182,11 @@ func (ctx *DataContext) VersionID() dvid.VersionID {
 	return ctx.version
 }
 
+// Data returns the data instance of the context.
+func (ctx *DataContext) Data() dvid.Data {
+	return ctx.data
+}
+
 func (ctx *DataContext) ConstructKey(index []byte) []byte {
 	key := append([]byte{dataKeyPrefix}, ctx.data.InstanceID().Bytes()...)
 	key = append(key, index...)
@@ -508,12 +508,14 @@ func (db *LevelDB) KeysInRange(ctx storage.Context, kStart, kEnd []byte) ([][]by
 
 	// Run the range query on a potentially versioned key in a goroutine.
 	go func() {
+		defer close(ch)
 		if ctx != nil && ctx.Versioned() {
 			db.versionedRange(ctx.(storage.VersionedContext), kStart, kEnd, ch, true)
 		} else {
 			db.unversionedRange(ctx, kStart, kEnd, ch, true)
 		}
 	}()
+	defer drainRange(ch)
 
 	// Consume the keys.
 	values := [][]byte{}
@@ -529,6 +531,88 @@ func (db *LevelDB) KeysInRange(ctx storage.Context, kStart, kEnd []byte) ([][]by
 	}
 }
 
+// FirstKeyInRange returns the first full key spanning (kStart, kEnd) or nil if there
+// is no key in the range.  If the keys are versioned, only keys in the ancestor path of
+// the current context's version are considered.  Unlike KeysInRange, iteration stops
+// at the first key found.
+func (db *LevelDB) FirstKeyInRange(ctx storage.Context, kStart, kEnd []byte) ([]byte, error) {
+	dvid.StartCgo()
+	ro := levigo.NewReadOptions()
+	it := db.ldb.NewIterator(ro)
+	defer func() {
+		it.Close()
+		dvid.StopCgo()
+	}()
+
+	if ctx == nil || !ctx.Versioned() {
+		keyEnd := constructKey(ctx, kEnd)
+		it.Seek(constructKey(ctx, kStart))
+		if !it.Valid() {
+			return nil, it.GetError()
+		}
+		itKey := it.Key()
+		storage.StoreKeyBytesRead <- len(itKey)
+		if bytes.Compare(itKey, keyEnd) > 0 {
+			return nil, nil
+		}
+		return itKey, nil
+	}
+
+	vctx := ctx.(storage.VersionedContext)
+	minKey, err := vctx.MinVersionKey(kStart)
+	if err != nil {
+		return nil, err
+	}
+	maxKey, err := vctx.MaxVersionKey(kEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Gather the versions of each index in turn until one is in the ancestor path.
+	var values []*storage.KeyValue
+	var maxVersionKey []byte
+	for it.Seek(minKey); ; it.Next() {
+		var itKey []byte
+		if it.Valid() {
+			itKey = it.Key()
+			storage.StoreKeyBytesRead <- len(itKey)
+		}
+		if itKey == nil || bytes.Compare(itKey, maxVersionKey) > 0 {
+			if len(values) != 0 {
+				kv, err := vctx.VersionedKeyValue(values)
+				if err != nil {
+					return nil, err
+				}
+				if kv != nil {
+					return kv.K, nil
+				}
+				values = []*storage.KeyValue{}
+			}
+			if itKey == nil {
+				return nil, it.GetError()
+			}
+			if bytes.Compare(itKey, maxKey) > 0 {
+				return nil, nil
+			}
+			indexBytes, err := vctx.IndexFromKey(itKey)
+			if err != nil {
+				return nil, err
+			}
+			if maxVersionKey, err = vctx.MaxVersionKey(indexBytes); err != nil {
+				return nil, err
+			}
+		}
+		values = append(values, &storage.KeyValue{K: itKey})
+	}
+}
+
+// drainRange consumes any key-value pairs left in a range after its consumer returns, so
+// the goroutine sending them closes its iterator before the consumer returns.
+func drainRange(ch chan errorableKV) {
+	for range ch {
+	}
+}
+
 // GetRange returns a range of values spanning (kStart, kEnd) keys.  These key-value
 // pairs will be sorted in ascending key order.  If the keys are versioned, all key-value
 // pairs for the particular version will be returned.
@@ -537,12 +621,14 @@ func (db *LevelDB) GetRange(ctx storage.Context, kStart, kEnd []byte) ([]*storag
 
 	// Run the range query on a potentially versioned key in a goroutine.
 	go func() {
+		defer close(ch)
 		if ctx != nil && ctx.Versioned() {
 			db.versionedRange(ctx.(storage.VersionedContext), kStart, kEnd, ch, false)
 		} else {
 			db.unversionedRange(ctx, kStart, kEnd, ch, false)
 		}
 	}()
+	defer drainRange(ch)
 
 	// Consume the key-value pairs.
 	values := []*storage.KeyValue{}
@@ -566,12 +652,14 @@ func (db *LevelDB) ProcessRange(ctx storage.Context, kStart, kEnd []byte, op *st
 
 	// Run the range query on a potentially versioned key in a goroutine.
 	go func() {
+		defer close(ch)
 		if ctx != nil && ctx.Versioned() {
 			db.versionedRange(ctx.(storage.VersionedContext), kStart, kEnd, ch, false)
 		} else {
 			db.unversionedRange(ctx, kStart, kEnd, ch, false)
 		}
 	}()
+	defer drainRange(ch)
 
 	// Consume the key-value pairs.
 	for {
@@ -656,12 +744,14 @@ func (db *LevelDB) DeleteRange(ctx storage.Context, kStart, kEnd []byte) error {
 
 	// Run the keys-only range query in a goroutine.
 	go func() {
+		defer close(ch)
 		if ctx != nil && ctx.Versioned() {
 			db.versionedRange(ctx.(storage.VersionedContext), kStart, kEnd, ch, true)
 		} else {
 			db.unversionedRange(ctx, kStart, kEnd, ch, true)
 		}
 	}()
+	defer drainRange(ch)
 
 	// Consume the key-value pairs.
 	numKV := 0
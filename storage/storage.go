@@ -246,6 +246,15 @@ type KeyValueBatcher interface {
 	NewBatch(ctx Context) Batch
 }
 
+// KeyValueSeeker allows finding the first key in a range without reading the rest of
+// the range, so sparse key spaces can be traversed by repeatedly seeking past keys.
+type KeyValueSeeker interface {
+	// FirstKeyInRange returns the first full key spanning (kStart, kEnd) or nil if
+	// there is no key in the range.  If the keys are versioned, only keys in the ancestor
+	// path of the context's version are considered.
+	FirstKeyInRange(ctx Context, kStart, kEnd []byte) ([]byte, error)
+}
+
 // Batch groups operations into a transaction.
 // Clear() and Close() were removed due to how other key-value stores implement batches.
 // It's easier to implement cross-database handling of a simple write/delete batch